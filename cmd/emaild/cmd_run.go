@@ -38,13 +38,36 @@ func cmdRun(p *program.Program) {
 	}
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for signo := range sigChan {
+		if signo == syscall.SIGHUP {
+			p.Info("received signal %d (%v), reloading", signo, signo)
+			reload(p, server, cfgPath)
+			continue
+		}
 
-	select {
-	case signo := <-sigChan:
 		fmt.Fprintln(os.Stderr)
 		p.Info("received signal %d (%v)", signo, signo)
+		break
 	}
 
 	server.Stop()
 }
+
+func reload(p *program.Program, s *server.Server, cfgPath string) {
+	var cfg server.ServerCfg
+
+	if cfgPath != "" {
+		if err := cfg.Load(cfgPath); err != nil {
+			p.Error("cannot load configuration from %q: %v", cfgPath, err)
+			return
+		}
+	}
+
+	cfg.BuildId = buildId
+
+	if err := s.Reload(cfg); err != nil {
+		p.Error("cannot reload server: %v", err)
+	}
+}
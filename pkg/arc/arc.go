@@ -0,0 +1,170 @@
+package arc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+// RFC 8617 The Authenticated Received Chain (ARC) Protocol
+
+// Chain validation status (RFC 8617 4.4.), used both for the cv= tag of
+// ARC-Seal fields and for validation results.
+type Status string
+
+const (
+	StatusNone Status = "none"
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+)
+
+// RFC 8617 4.2.1. The maximum number of ARC sets in a chain.
+const MaxInstance = 50
+
+const (
+	SealFieldName                  = "ARC-Seal"
+	MessageSignatureFieldName      = "ARC-Message-Signature"
+	AuthenticationResultsFieldName = "ARC-Authentication-Results"
+)
+
+// Set is a group of ARC header fields sharing the same instance number.
+type Set struct {
+	Instance int
+
+	AuthenticationResults *imf.Field
+	MessageSignature      *imf.Field
+	Seal                  *imf.Field
+}
+
+// Fields returns the raw fields of the set in the order used to compute
+// seals (RFC 8617 5.1.1.).
+func (s *Set) Fields() ([]string, error) {
+	fields := []*imf.Field{s.AuthenticationResults, s.MessageSignature, s.Seal}
+	raws := make([]string, len(fields))
+
+	for i, field := range fields {
+		raw, err := dkim.FieldRaw(field)
+		if err != nil {
+			return nil, err
+		}
+
+		raws[i] = raw
+	}
+
+	return raws, nil
+}
+
+// ExtractSets returns the ARC sets of a message ordered by instance number.
+// An error is returned if the structure of the chain is invalid (RFC 8617
+// 4.2.).
+func ExtractSets(msg *imf.Message) ([]*Set, error) {
+	sets := make(map[int]*Set)
+	maxInstance := 0
+
+	for _, field := range msg.Header {
+		var name string
+		switch {
+		case strings.EqualFold(field.Name, SealFieldName):
+			name = SealFieldName
+		case strings.EqualFold(field.Name, MessageSignatureFieldName):
+			name = MessageSignatureFieldName
+		case strings.EqualFold(field.Name, AuthenticationResultsFieldName):
+			name = AuthenticationResultsFieldName
+		default:
+			continue
+		}
+
+		raw, err := dkim.FieldRaw(field)
+		if err != nil {
+			return nil, err
+		}
+
+		_, value, _ := strings.Cut(raw, ":")
+
+		instance, err := parseInstance(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s field: %w", name, err)
+		}
+
+		set, found := sets[instance]
+		if !found {
+			set = &Set{Instance: instance}
+			sets[instance] = set
+		}
+
+		var ptr **imf.Field
+		switch name {
+		case SealFieldName:
+			ptr = &set.Seal
+		case MessageSignatureFieldName:
+			ptr = &set.MessageSignature
+		case AuthenticationResultsFieldName:
+			ptr = &set.AuthenticationResults
+		}
+
+		if *ptr != nil {
+			return nil, fmt.Errorf("duplicate %s field for instance %d",
+				name, instance)
+		}
+
+		*ptr = field
+
+		maxInstance = max(maxInstance, instance)
+	}
+
+	list := make([]*Set, maxInstance)
+
+	for i := 1; i <= maxInstance; i++ {
+		set, found := sets[i]
+		if !found {
+			return nil, fmt.Errorf("missing arc set for instance %d", i)
+		}
+
+		if set.Seal == nil || set.MessageSignature == nil ||
+			set.AuthenticationResults == nil {
+			return nil, fmt.Errorf("incomplete arc set for instance %d", i)
+		}
+
+		list[i-1] = set
+	}
+
+	return list, nil
+}
+
+func parseInstance(name, value string) (int, error) {
+	var s string
+
+	if name == AuthenticationResultsFieldName {
+		// The instance tag is followed by the content of an
+		// Authentication-Results field.
+		tag, _, _ := strings.Cut(value, ";")
+
+		tags, err := dkim.ParseTagList(tag)
+		if err != nil {
+			return 0, err
+		}
+
+		s, _ = tags.Value("i")
+	} else {
+		tags, err := dkim.ParseTagList(value)
+		if err != nil {
+			return 0, err
+		}
+
+		s, _ = tags.Value("i")
+	}
+
+	if s == "" {
+		return 0, fmt.Errorf("missing instance tag")
+	}
+
+	instance, err := strconv.Atoi(s)
+	if err != nil || instance < 1 || instance > MaxInstance {
+		return 0, fmt.Errorf("invalid instance %q", s)
+	}
+
+	return instance, nil
+}
@@ -0,0 +1,136 @@
+package arc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+func TestSealAndValidate(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	publicKeyData, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("cannot encode public key: %v", err)
+	}
+
+	resolver := dns.NewFakeResolver()
+	resolver.TXT["arc._domainkey.example.net"] = []string{
+		"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(publicKeyData),
+	}
+
+	verifier := NewVerifier(dkim.NewVerifier(resolver))
+
+	sealer := Sealer{
+		SigningDomain: &dkim.SigningDomain{
+			Domain:   "example.net",
+			Selector: "arc",
+			Key: &dkim.PrivateKey{
+				Algorithm: dkim.AlgorithmRSASHA256,
+				Signer:    privateKey,
+			},
+			SignedFields: dkim.DefaultSignedFields,
+		},
+	}
+
+	msgData := "From: Alice <alice@example.com>\r\n" +
+		"To: list@example.net\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"Hello everyone.\r\n"
+
+	newMessage := func() *imf.Message {
+		msg, err := imf.NewMessageDecoder().DecodeAll([]byte(msgData))
+		if err != nil {
+			t.Fatalf("cannot decode message: %v", err)
+		}
+
+		return msg
+	}
+
+	seal := func(msg *imf.Message, status Status) {
+		ar := imf.Field{
+			Name: "Authentication-Results",
+			Value: &imf.AuthenticationResultsFieldValue{
+				AuthservId: "mx.example.net",
+				Results: []*imf.AuthenticationResult{{
+					Method: "spf",
+					Result: "pass",
+					Properties: []imf.AuthenticationResultProperty{{
+						Type:  "smtp",
+						Name:  "mailfrom",
+						Value: "example.com",
+					}},
+				}},
+			},
+		}
+
+		msg.Header = append([]*imf.Field{&ar}, msg.Header...)
+
+		if err := sealer.Seal(msg, "mx.example.net", status,
+			time.Now()); err != nil {
+			t.Fatalf("cannot seal message: %v", err)
+		}
+	}
+
+	// Message without chain
+	msg := newMessage()
+
+	if result := verifier.Validate(context.Background(), msg); result.Status != StatusNone {
+		t.Errorf("validation of an unsealed message returned %v", result)
+	}
+
+	// Two hops
+	seal(msg, StatusNone)
+	seal(msg, StatusPass)
+
+	result := verifier.Validate(context.Background(), msg)
+	if result.Status != StatusPass || result.Instance != 2 {
+		t.Errorf("validation returned %v", result)
+	}
+
+	sets, err := ExtractSets(msg)
+	if err != nil {
+		t.Fatalf("cannot extract sets: %v", err)
+	}
+
+	if len(sets) != 2 {
+		t.Fatalf("%d sets extracted instead of two", len(sets))
+	}
+
+	// Modification of the message after the last hop
+	msg.Body = append(msg.Body, "Extra line.\r\n"...)
+
+	result = verifier.Validate(context.Background(), msg)
+	if result.Status != StatusFail {
+		t.Errorf("validation of a modified message returned %v", result)
+	}
+
+	// Modification of the chain itself
+	msg = newMessage()
+	seal(msg, StatusNone)
+	seal(msg, StatusPass)
+
+	for _, field := range msg.Header {
+		if field.Name == AuthenticationResultsFieldName {
+			field.Raw += " dkim=pass"
+			break
+		}
+	}
+
+	result = verifier.Validate(context.Background(), msg)
+	if result.Status != StatusFail {
+		t.Errorf("validation of a modified chain returned %v", result)
+	}
+}
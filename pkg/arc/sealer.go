@@ -0,0 +1,265 @@
+package arc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-ejson"
+)
+
+var (
+	ErrChainFailed  = errors.New("arc chain already marked as failed")
+	ErrChainTooLong = errors.New("arc chain too long")
+)
+
+type seal struct {
+	algorithm   dkim.Algorithm
+	signature   []byte
+	domain      string
+	selector    string
+	chainStatus Status
+}
+
+func parseSeal(field *imf.Field) (*seal, error) {
+	// RFC 8617 4.1.3. ARC-Seal
+	raw, err := dkim.FieldRaw(field)
+	if err != nil {
+		return nil, err
+	}
+
+	_, value, _ := strings.Cut(raw, ":")
+
+	tags, err := dkim.ParseTagList(value)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"a", "b", "cv", "d", "s"} {
+		if _, found := tags.Value(name); !found {
+			return nil, fmt.Errorf("missing tag %q", name)
+		}
+	}
+
+	// The h tag is not allowed in ARC-Seal fields
+	if _, found := tags.Value("h"); found {
+		return nil, fmt.Errorf("invalid tag \"h\"")
+	}
+
+	var s seal
+
+	a, _ := tags.Value("a")
+	s.algorithm = dkim.Algorithm(strings.ToLower(a))
+	if s.algorithm != dkim.AlgorithmRSASHA256 {
+		return nil, fmt.Errorf("unsupported algorithm %q", a)
+	}
+
+	b, _ := tags.Value("b")
+	s.signature, err = base64.StdEncoding.DecodeString(dkim.RemoveWhitespace(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	d, _ := tags.Value("d")
+	s.domain = strings.ToLower(d)
+
+	s.selector, _ = tags.Value("s")
+
+	cv, _ := tags.Value("cv")
+	s.chainStatus = Status(strings.ToLower(cv))
+
+	switch s.chainStatus {
+	case StatusNone, StatusPass, StatusFail:
+	default:
+		return nil, fmt.Errorf("invalid chain validation status %q", cv)
+	}
+
+	return &s, nil
+}
+
+type SealerCfg struct {
+	// The domain used to seal messages; it must be configured as a DKIM
+	// signing domain, whose key and signed fields are used for ARC.
+	Domain string `json:"domain"`
+}
+
+func (cfg *SealerCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("domain", cfg.Domain)
+}
+
+// Sealer adds ARC sets to messages forwarded by the server (RFC 8617 5.1.).
+type Sealer struct {
+	Cfg SealerCfg
+
+	SigningDomain *dkim.SigningDomain
+}
+
+func NewSealer(cfg SealerCfg, signer *dkim.Signer) (*Sealer, error) {
+	sd := signer.Domain(cfg.Domain)
+	if sd == nil {
+		return nil, fmt.Errorf("no dkim signing domain configured for %q",
+			cfg.Domain)
+	}
+
+	// RFC 8617 4.1.3. rsa-sha256 is the only supported algorithm
+	if sd.Key.Algorithm != dkim.AlgorithmRSASHA256 {
+		return nil, fmt.Errorf("unsupported key algorithm %q for domain %q",
+			sd.Key.Algorithm, cfg.Domain)
+	}
+
+	s := Sealer{
+		Cfg: cfg,
+
+		SigningDomain: sd,
+	}
+
+	return &s, nil
+}
+
+// Seal adds a new ARC set at the top of the header of a message. The
+// authentication results are copied from the first Authentication-Results
+// field using authservId, and chainStatus is the result of the validation of
+// the existing chain.
+func (s *Sealer) Seal(msg *imf.Message, authservId string, chainStatus Status, now time.Time) error {
+	sets, err := ExtractSets(msg)
+	if err != nil {
+		return fmt.Errorf("invalid arc chain: %w", err)
+	}
+
+	// RFC 8617 5.1.2. Chains which already failed are not extended
+	if len(sets) > 0 {
+		lastSeal, err := parseSeal(sets[len(sets)-1].Seal)
+		if err != nil {
+			return fmt.Errorf("invalid arc chain: %w", err)
+		}
+
+		if lastSeal.chainStatus == StatusFail {
+			return ErrChainFailed
+		}
+	} else {
+		chainStatus = StatusNone
+	}
+
+	instance := len(sets) + 1
+	if instance > MaxInstance {
+		return ErrChainTooLong
+	}
+
+	sd := s.SigningDomain
+	i := strconv.Itoa(instance)
+	t := strconv.FormatInt(now.Unix(), 10)
+
+	// ARC-Authentication-Results
+	aarField := imf.Field{
+		Name: AuthenticationResultsFieldName,
+		Value: utils.Ref(imf.OptionalFieldValue(
+			"i=" + i + "; " + authenticationResults(msg, authservId))),
+	}
+
+	aarField.Raw, err = dkim.FieldRaw(&aarField)
+	if err != nil {
+		return err
+	}
+
+	// ARC-Message-Signature
+	names := append([]string{"DKIM-Signature"}, sd.SignedFields...)
+
+	var signedFields []string
+	for _, name := range names {
+		if strings.EqualFold(name, "From") || hasField(msg, name) {
+			signedFields = append(signedFields, name)
+		}
+	}
+
+	c := dkim.CanonicalizationRelaxed
+	bodyHash := sha256.Sum256(dkim.CanonicalizeBody(msg.Body, c))
+
+	amsTags := dkim.TagList{
+		{Name: "i", Value: i},
+		{Name: "a", Value: string(sd.Key.Algorithm)},
+		{Name: "c", Value: string(c) + "/" + string(c)},
+		{Name: "d", Value: sd.Domain},
+		{Name: "s", Value: sd.Selector},
+		{Name: "t", Value: t},
+		{Name: "h", Value: strings.ToLower(strings.Join(signedFields, ":"))},
+		{Name: "bh", Value: base64.StdEncoding.EncodeToString(bodyHash[:])},
+	}
+
+	fields, err := dkim.SelectHeaderFields(msg.Header, signedFields)
+	if err != nil {
+		return err
+	}
+
+	amsField, err := dkim.SignFields(MessageSignatureFieldName, amsTags,
+		fields, c, sd.Key)
+	if err != nil {
+		return fmt.Errorf("cannot sign message: %w", err)
+	}
+
+	// ARC-Seal
+	var sealedFields []string
+	for _, set := range sets {
+		setFields, err := set.Fields()
+		if err != nil {
+			return err
+		}
+
+		sealedFields = append(sealedFields, setFields...)
+	}
+
+	sealedFields = append(sealedFields, aarField.Raw, amsField.Raw)
+
+	asTags := dkim.TagList{
+		{Name: "i", Value: i},
+		{Name: "a", Value: string(sd.Key.Algorithm)},
+		{Name: "t", Value: t},
+		{Name: "cv", Value: string(chainStatus)},
+		{Name: "d", Value: sd.Domain},
+		{Name: "s", Value: sd.Selector},
+	}
+
+	asField, err := dkim.SignFields(SealFieldName, asTags, sealedFields, c,
+		sd.Key)
+	if err != nil {
+		return fmt.Errorf("cannot seal message: %w", err)
+	}
+
+	header := []*imf.Field{asField, amsField, &aarField}
+	msg.Header = append(header, msg.Header...)
+
+	return nil
+}
+
+func authenticationResults(msg *imf.Message, authservId string) string {
+	for _, field := range msg.Header {
+		if !strings.EqualFold(field.Name, "Authentication-Results") {
+			continue
+		}
+
+		value, ok := field.Value.(*imf.AuthenticationResultsFieldValue)
+		if ok && strings.EqualFold(value.AuthservId, authservId) {
+			return value.String()
+		}
+	}
+
+	// RFC 8601 2.2. No authentication was performed
+	value := imf.AuthenticationResultsFieldValue{AuthservId: authservId}
+	return value.String()
+}
+
+func hasField(msg *imf.Message, name string) bool {
+	for _, field := range msg.Header {
+		if strings.EqualFold(field.Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
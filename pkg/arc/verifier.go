@@ -0,0 +1,237 @@
+package arc
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+type Result struct {
+	Status Status
+	Reason string // optional
+
+	Instance int    // highest instance of the chain
+	Domain   string // d= tag of the highest ARC-Seal field
+
+	// The instance of the oldest ARC-Message-Signature field which still
+	// validates, or zero if all of them do (RFC 8617 5.2.).
+	OldestPass int
+}
+
+func (r *Result) String() string {
+	s := string(r.Status)
+
+	if r.Instance > 0 {
+		s += fmt.Sprintf(" (i=%d %s)", r.Instance, r.Domain)
+	}
+
+	if r.Reason != "" {
+		s += ": " + r.Reason
+	}
+
+	return s
+}
+
+// AuthenticationResult returns the representation of the result in an
+// Authentication-Results field (RFC 8617 10.1.).
+func (r *Result) AuthenticationResult() *imf.AuthenticationResult {
+	ar := imf.AuthenticationResult{
+		Method: "arc",
+		Result: string(r.Status),
+	}
+
+	if r.Status == StatusPass && r.OldestPass > 0 {
+		ar.Properties = append(ar.Properties, imf.AuthenticationResultProperty{
+			Type:  "header",
+			Name:  "oldest-pass",
+			Value: strconv.Itoa(r.OldestPass),
+		})
+	}
+
+	return &ar
+}
+
+// Verifier validates ARC chains. Public keys are obtained with the DKIM
+// verifier since ARC uses the same key records.
+type Verifier struct {
+	DKIMVerifier *dkim.Verifier
+}
+
+func NewVerifier(dkimVerifier *dkim.Verifier) *Verifier {
+	return &Verifier{
+		DKIMVerifier: dkimVerifier,
+	}
+}
+
+// Validate validates the ARC chain of a message (RFC 8617 5.2.).
+func (v *Verifier) Validate(ctx context.Context, msg *imf.Message) *Result {
+	result := Result{Status: StatusNone}
+
+	fail := func(format string, args ...any) *Result {
+		result.Status = StatusFail
+		result.Reason = fmt.Sprintf(format, args...)
+		return &result
+	}
+
+	sets, err := ExtractSets(msg)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	if len(sets) == 0 {
+		return &result
+	}
+
+	result.Instance = len(sets)
+
+	seals := make([]*seal, len(sets))
+
+	for i, set := range sets {
+		seal, err := parseSeal(set.Seal)
+		if err != nil {
+			return fail("invalid seal for instance %d: %v", set.Instance, err)
+		}
+
+		// RFC 8617 5.2. Steps 2 and 3: a chain already marked as failed
+		// cannot pass, and the first instance must have cv=none while the
+		// other ones must have cv=pass.
+		expectedStatus := StatusPass
+		if i == 0 {
+			expectedStatus = StatusNone
+		}
+
+		if seal.chainStatus == StatusFail {
+			return fail("chain marked as failed at instance %d",
+				set.Instance)
+		}
+
+		if seal.chainStatus != expectedStatus {
+			return fail("invalid chain validation status %q for instance %d",
+				seal.chainStatus, set.Instance)
+		}
+
+		seals[i] = seal
+	}
+
+	result.Domain = seals[len(seals)-1].domain
+
+	// Step 4: the most recent message signature must validate
+	latest := sets[len(sets)-1]
+	if err := v.verifyMessageSignature(ctx, msg, latest); err != nil {
+		return fail("invalid message signature for instance %d: %v",
+			latest.Instance, err)
+	}
+
+	// Step 5: find the oldest message signature which still validates
+	for i := len(sets) - 2; i >= 0; i-- {
+		if err := v.verifyMessageSignature(ctx, msg, sets[i]); err != nil {
+			result.OldestPass = sets[i].Instance + 1
+			break
+		}
+	}
+
+	// Step 6: all seals must validate
+	for i := len(sets) - 1; i >= 0; i-- {
+		if err := v.verifySeal(ctx, sets[:i+1], seals[i]); err != nil {
+			return fail("invalid seal for instance %d: %v", sets[i].Instance,
+				err)
+		}
+	}
+
+	result.Status = StatusPass
+	return &result
+}
+
+func (v *Verifier) verifyMessageSignature(ctx context.Context, msg *imf.Message, set *Set) error {
+	// RFC 8617 4.1.2. ARC-Message-Signature fields use the DKIM-Signature
+	// syntax without the v= tag.
+	raw, err := dkim.FieldRaw(set.MessageSignature)
+	if err != nil {
+		return err
+	}
+
+	_, value, _ := strings.Cut(raw, ":")
+
+	sig, err := dkim.ParseSignature(value, false)
+	if err != nil {
+		return err
+	}
+
+	if sig.Algorithm != dkim.AlgorithmRSASHA256 {
+		return fmt.Errorf("unsupported algorithm %q", sig.Algorithm)
+	}
+
+	if sig.BodyHash == nil {
+		return fmt.Errorf("missing tag \"bh\"")
+	}
+
+	for _, name := range sig.Fields {
+		if strings.EqualFold(name, SealFieldName) {
+			return fmt.Errorf("arc-seal fields must not be signed")
+		}
+	}
+
+	body := dkim.CanonicalizeBody(msg.Body, sig.BodyCanon)
+	if sig.BodyLength >= 0 && sig.BodyLength <= len(body) {
+		body = body[:sig.BodyLength]
+	}
+
+	bodyHash := sha256.Sum256(body)
+	if string(bodyHash[:]) != string(sig.BodyHash) {
+		return fmt.Errorf("body hash mismatch")
+	}
+
+	key, err := v.DKIMVerifier.LookupKey(ctx, sig)
+	if err != nil {
+		return err
+	}
+
+	fields, err := dkim.SelectHeaderFields(msg.Header, sig.Fields)
+	if err != nil {
+		return err
+	}
+
+	digest := dkim.HeaderHash(fields, dkim.StripTagValue(raw, "b"),
+		sig.HeaderCanon)
+
+	return key.Verify(sig.Algorithm, digest, sig.Signature)
+}
+
+func (v *Verifier) verifySeal(ctx context.Context, sets []*Set, seal *seal) error {
+	// RFC 8617 5.1.1. The seal covers all ARC fields up to its own instance,
+	// ordered by instance, with relaxed header canonicalization.
+	var fields []string
+
+	for _, set := range sets {
+		setFields, err := set.Fields()
+		if err != nil {
+			return err
+		}
+
+		fields = append(fields, setFields...)
+	}
+
+	sealRaw := fields[len(fields)-1]
+	fields = fields[:len(fields)-1]
+
+	sig := dkim.Signature{
+		Algorithm: seal.algorithm,
+		Domain:    seal.domain,
+		Selector:  seal.selector,
+	}
+
+	key, err := v.DKIMVerifier.LookupKey(ctx, &sig)
+	if err != nil {
+		return err
+	}
+
+	digest := dkim.HeaderHash(fields, dkim.StripTagValue(sealRaw, "b"),
+		dkim.CanonicalizationRelaxed)
+
+	return key.Verify(seal.algorithm, digest, seal.signature)
+}
@@ -0,0 +1,146 @@
+package delivery
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/maildir"
+	"github.com/galdor/emaild/pkg/utils"
+)
+
+var ErrMailboxNotFound = errors.New("mailbox not found")
+
+// LocalTransport delivers messages to the Maildir directories of local
+// users. The user is identified by the local part of the recipient address.
+type LocalTransport struct {
+	Cfg LocalTransportCfg
+}
+
+func NewLocalTransport(cfg LocalTransportCfg) *LocalTransport {
+	return &LocalTransport{
+		Cfg: cfg,
+	}
+}
+
+// CheckRecipient returns ErrMailboxNotFound if there is no mailbox for a
+// recipient, so that unknown recipients can be rejected before the message is
+// received.
+func (t *LocalTransport) CheckRecipient(recipient imf.SpecificAddress) error {
+	_, err := t.mailboxPath(recipient)
+	return err
+}
+
+// Deliver writes a message to the mailbox of a recipient, in a folder if
+// folder is not empty. Folders are created if they do not exist. Flags are
+// IMAP flags; those without Maildir equivalent are ignored. The reverse-path
+// is nil for the null reverse-path. Messages are stored with LF line endings
+// as expected by Maildir readers.
+func (t *LocalTransport) Deliver(reversePath *imf.SpecificAddress, recipient imf.SpecificAddress, folder string, flags []string, msg *imf.Message) error {
+	if folder != "" && !maildir.IsValidFolderName(folder) {
+		return fmt.Errorf("invalid folder name %q", folder)
+	}
+
+	dirPath, err := t.mailboxPath(recipient)
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeLocalMessage(reversePath, recipient, msg)
+	if err != nil {
+		return err
+	}
+
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+
+	m := maildir.NewMaildir(dirPath)
+	if folder != "" {
+		m = m.Folder(folder)
+	}
+
+	if err := m.Create(); err != nil {
+		return err
+	}
+
+	if _, err := m.DeliverWithFlags(data, maildirFlags(flags)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// maildirFlags converts IMAP system flags to Maildir flags.
+func maildirFlags(flags []string) string {
+	var buf strings.Builder
+
+	for _, flag := range flags {
+		switch strings.ToLower(flag) {
+		case `\seen`:
+			buf.WriteByte('S')
+		case `\answered`:
+			buf.WriteByte('R')
+		case `\flagged`:
+			buf.WriteByte('F')
+		case `\deleted`:
+			buf.WriteByte('T')
+		case `\draft`:
+			buf.WriteByte('D')
+		}
+	}
+
+	return buf.String()
+}
+
+func (t *LocalTransport) mailboxPath(recipient imf.SpecificAddress) (string, error) {
+	user := strings.ToLower(recipient.LocalPart)
+
+	if user == "" || user[0] == '.' || strings.ContainsAny(user, "/\\\x00") {
+		return "", ErrMailboxNotFound
+	}
+
+	dirPath := path.Join(t.Cfg.Path, user)
+
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", ErrMailboxNotFound
+		}
+
+		return "", fmt.Errorf("cannot stat %q: %w", dirPath, err)
+	}
+
+	if !info.IsDir() {
+		return "", ErrMailboxNotFound
+	}
+
+	return dirPath, nil
+}
+
+func encodeLocalMessage(reversePath *imf.SpecificAddress, recipient imf.SpecificAddress, msg *imf.Message) ([]byte, error) {
+	// RFC 5321 4.4. The Return-Path field is added at final delivery and
+	// contains the reverse-path; previous Return-Path fields are removed.
+	// Delivered-To is not standard but is used by most MTAs to detect
+	// forwarding loops.
+	header := []*imf.Field{
+		{
+			Name:  "Return-Path",
+			Value: &imf.ReturnPathFieldValue{Address: reversePath},
+		},
+		{
+			Name:  "Delivered-To",
+			Value: utils.Ref(imf.OptionalFieldValue(recipient.String())),
+		},
+	}
+
+	for _, field := range msg.Header {
+		if !strings.EqualFold(field.Name, "Return-Path") {
+			header = append(header, field)
+		}
+	}
+
+	return EncodeMessage(&imf.Message{Header: header, Body: msg.Body})
+}
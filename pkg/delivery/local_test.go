@@ -0,0 +1,119 @@
+package delivery
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+func TestLocalTransport(t *testing.T) {
+	dirPath := t.TempDir()
+
+	if err := os.Mkdir(path.Join(dirPath, "bob"), 0700); err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+
+	transport := NewLocalTransport(LocalTransportCfg{Path: dirPath})
+
+	msgData := "Return-Path: <forged@example.net>\r\n" +
+		"From: alice@example.org\r\n" +
+		"To:  bob@example.com\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"Hello Bob.\r\n"
+
+	msg, err := imf.NewMessageDecoder().DecodeAll([]byte(msgData))
+	if err != nil {
+		t.Fatalf("cannot decode message: %v", err)
+	}
+
+	alice := imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+	bob := imf.SpecificAddress{LocalPart: "Bob", Domain: "example.com"}
+	carol := imf.SpecificAddress{LocalPart: "carol", Domain: "example.com"}
+
+	if err := transport.Deliver(&alice, bob, "", nil, msg); err != nil {
+		t.Fatalf("cannot deliver message: %v", err)
+	}
+
+	if err := transport.Deliver(nil, bob, "", nil, msg); err != nil {
+		t.Fatalf("cannot deliver message: %v", err)
+	}
+
+	if err := transport.CheckRecipient(bob); err != nil {
+		t.Errorf("cannot check recipient: %v", err)
+	}
+
+	err = transport.CheckRecipient(carol)
+	if !errors.Is(err, ErrMailboxNotFound) {
+		t.Errorf("check of unknown user should have failed with %q but "+
+			"returned %v", ErrMailboxNotFound, err)
+	}
+
+	err = transport.Deliver(&alice, carol, "", nil, msg)
+	if !errors.Is(err, ErrMailboxNotFound) {
+		t.Errorf("delivery to unknown user should have failed with %q but "+
+			"returned %v", ErrMailboxNotFound, err)
+	}
+
+	entries, err := os.ReadDir(path.Join(dirPath, "bob", "new"))
+	if err != nil {
+		t.Fatalf("cannot read directory: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("%d messages were delivered instead of 2", len(entries))
+	}
+
+	expectedData := map[string]bool{
+		"Return-Path: <alice@example.org>\n" +
+			"Delivered-To: Bob@example.com\n" +
+			"From: alice@example.org\n" +
+			"To:  bob@example.com\n" +
+			"Subject: hello\n" +
+			"\n" +
+			"Hello Bob.\n": true,
+		"Return-Path: <>\n" +
+			"Delivered-To: Bob@example.com\n" +
+			"From: alice@example.org\n" +
+			"To:  bob@example.com\n" +
+			"Subject: hello\n" +
+			"\n" +
+			"Hello Bob.\n": true,
+	}
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(path.Join(dirPath, "bob", "new", entry.Name()))
+		if err != nil {
+			t.Fatalf("cannot read message: %v", err)
+		}
+
+		if !expectedData[string(data)] {
+			t.Errorf("unexpected message content:\n%s", data)
+		}
+
+		delete(expectedData, string(data))
+	}
+
+	if entries, _ := os.ReadDir(path.Join(dirPath, "bob", "tmp")); len(entries) > 0 {
+		t.Errorf("temporary files were not removed")
+	}
+
+	flags := []string{`\Seen`, "$Junk"}
+
+	if err := transport.Deliver(&alice, bob, "Junk", flags, msg); err != nil {
+		t.Fatalf("cannot deliver message: %v", err)
+	}
+
+	entries, err = os.ReadDir(path.Join(dirPath, "bob", ".Junk", "cur"))
+	if err != nil {
+		t.Fatalf("cannot read directory: %v", err)
+	}
+
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ":2,S") {
+		t.Errorf("invalid messages in folder %v", entries)
+	}
+}
@@ -0,0 +1,36 @@
+package delivery
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+// EncodeMessage returns the data of a message to be delivered. Fields are
+// written as they were received: encoding decoded fields again would alter
+// them, invalidating DKIM signatures and losing fields we failed to parse.
+// Only fields created locally are encoded.
+func EncodeMessage(msg *imf.Message) ([]byte, error) {
+	var buf bytes.Buffer
+
+	for _, field := range msg.Header {
+		if field.Raw != "" {
+			buf.WriteString(field.Raw)
+			buf.WriteString("\r\n")
+			continue
+		}
+
+		e := imf.NewDataEncoder(imf.MaxLineLength)
+		if err := e.WriteField(field); err != nil {
+			return nil, fmt.Errorf("cannot encode field %q: %w", field.Name, err)
+		}
+
+		buf.Write(e.Bytes())
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(msg.Body)
+
+	return buf.Bytes(), nil
+}
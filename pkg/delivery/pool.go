@@ -0,0 +1,446 @@
+package delivery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/go-ejson"
+	"github.com/galdor/go-log"
+)
+
+const (
+	DefaultMaxConnections           = 100
+	DefaultMaxConnectionsPerHost    = 5
+	DefaultMaxIdleTime              = 30 // seconds
+	DefaultMaxMessagesPerConnection = 100
+	DefaultStatsInterval            = 300 // seconds
+)
+
+type PoolCfg struct {
+	Log *log.Logger `json:"-"`
+
+	MaxConnections           int `json:"max_connections,omitempty"`
+	MaxConnectionsPerHost    int `json:"max_connections_per_host,omitempty"`
+	MaxIdleTime              int `json:"max_idle_time,omitempty"` // seconds
+	MaxMessagesPerConnection int `json:"max_messages_per_connection,omitempty"`
+
+	// The interval between two log messages containing pool statistics
+	// (seconds)
+	StatsInterval int `json:"stats_interval,omitempty"`
+}
+
+func (cfg *PoolCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckIntMin("max_connections", cfg.MaxConnections, 0)
+	v.CheckIntMin("max_connections_per_host", cfg.MaxConnectionsPerHost, 0)
+	v.CheckIntMin("max_idle_time", cfg.MaxIdleTime, 0)
+	v.CheckIntMin("max_messages_per_connection",
+		cfg.MaxMessagesPerConnection, 0)
+	v.CheckIntMin("stats_interval", cfg.StatsInterval, 0)
+}
+
+type PoolStats struct {
+	NbConnections     int `json:"nb_connections"`
+	NbIdleConnections int `json:"nb_idle_connections"`
+	NbWaiters         int `json:"nb_waiters"`
+
+	NbDials     uint64 `json:"nb_dials"`
+	NbReuses    uint64 `json:"nb_reuses"`
+	NbEvictions uint64 `json:"nb_evictions"`
+
+	Hosts map[string]PoolHostStats `json:"hosts"`
+}
+
+type PoolHostStats struct {
+	NbConnections     int `json:"nb_connections"`
+	NbIdleConnections int `json:"nb_idle_connections"`
+}
+
+// PoolConn is an SMTP client session owned by the caller between calls to
+// Pool.Acquire and either Pool.Release or Pool.Discard.
+type PoolConn struct {
+	Client *smtp.Client
+
+	key        string
+	nbMessages int
+	lastUse    time.Time
+}
+
+// MessageSent must be called after each transaction so that connections are
+// not used for more than the configured number of messages.
+func (pc *PoolConn) MessageSent() {
+	pc.nbMessages++
+}
+
+type poolHost struct {
+	nbConns int
+	idle    []*PoolConn // most recently used last
+}
+
+// Pool maintains open SMTP sessions to destinations so that they can be
+// reused for multiple transactions, and limits the number of concurrent
+// connections both per destination and globally. Destinations are identified
+// by a key chosen by the caller, usually the address of the remote server
+// combined with the name of the transport.
+type Pool struct {
+	Cfg PoolCfg
+	Log *log.Logger
+
+	hosts   map[string]*poolHost
+	nbConns int
+	waiters []chan struct{}
+	stats   PoolStats
+	mutex   sync.Mutex
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewPool(cfg PoolCfg) *Pool {
+	if cfg.MaxConnections == 0 {
+		cfg.MaxConnections = DefaultMaxConnections
+	}
+
+	if cfg.MaxConnectionsPerHost == 0 {
+		cfg.MaxConnectionsPerHost = DefaultMaxConnectionsPerHost
+	}
+
+	if cfg.MaxIdleTime == 0 {
+		cfg.MaxIdleTime = DefaultMaxIdleTime
+	}
+
+	if cfg.MaxMessagesPerConnection == 0 {
+		cfg.MaxMessagesPerConnection = DefaultMaxMessagesPerConnection
+	}
+
+	if cfg.StatsInterval == 0 {
+		cfg.StatsInterval = DefaultStatsInterval
+	}
+
+	p := Pool{
+		Cfg: cfg,
+		Log: cfg.Log,
+
+		hosts: make(map[string]*poolHost),
+
+		stopChan: make(chan struct{}),
+	}
+
+	return &p
+}
+
+func (p *Pool) Start() {
+	p.wg.Add(1)
+	go p.main()
+}
+
+func (p *Pool) Stop() {
+	close(p.stopChan)
+	p.wg.Wait()
+
+	p.mutex.Lock()
+	var conns []*PoolConn
+	for _, host := range p.hosts {
+		conns = append(conns, host.idle...)
+		p.nbConns -= len(host.idle)
+		host.nbConns -= len(host.idle)
+		host.idle = nil
+	}
+	p.mutex.Unlock()
+
+	for _, pc := range conns {
+		pc.Client.Quit()
+	}
+}
+
+func (p *Pool) main() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	statsTicker := time.NewTicker(time.Duration(p.Cfg.StatsInterval) *
+		time.Second)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case <-p.stopChan:
+			return
+
+		case <-ticker.C:
+			p.closeExpiredConns()
+
+		case <-statsTicker.C:
+			p.logStats()
+		}
+	}
+}
+
+// logStats logs the current statistics of the pool; data are attached to the
+// log message so that they can be collected from structured logs.
+func (p *Pool) logStats() {
+	stats := p.Stats()
+
+	data := log.Data{
+		"nb_connections":      stats.NbConnections,
+		"nb_idle_connections": stats.NbIdleConnections,
+		"nb_waiters":          stats.NbWaiters,
+		"nb_dials":            stats.NbDials,
+		"nb_reuses":           stats.NbReuses,
+		"nb_evictions":        stats.NbEvictions,
+	}
+
+	p.Log.InfoData(data, "%d connections (%d idle) to %d hosts, "+
+		"%d waiters", stats.NbConnections, stats.NbIdleConnections,
+		len(stats.Hosts), stats.NbWaiters)
+}
+
+func (p *Pool) maxIdleTime() time.Duration {
+	return time.Duration(p.Cfg.MaxIdleTime) * time.Second
+}
+
+func (p *Pool) closeExpiredConns() {
+	now := time.Now()
+
+	var conns []*PoolConn
+
+	p.mutex.Lock()
+	for key, host := range p.hosts {
+		var idle []*PoolConn
+
+		for _, pc := range host.idle {
+			if now.Sub(pc.lastUse) > p.maxIdleTime() {
+				conns = append(conns, pc)
+				host.nbConns--
+				p.nbConns--
+			} else {
+				idle = append(idle, pc)
+			}
+		}
+
+		host.idle = idle
+
+		if host.nbConns == 0 {
+			delete(p.hosts, key)
+		}
+	}
+
+	if len(conns) > 0 {
+		p.notifyWaiters()
+	}
+	p.mutex.Unlock()
+
+	for _, pc := range conns {
+		p.Log.Debug(2, "closing idle connection to %q", pc.key)
+		pc.Client.Quit()
+	}
+}
+
+// Acquire returns an idle session for the destination if there is one, or
+// establishes a new session with the dial function. If connection limits are
+// reached, it waits until a connection is released or the context is
+// canceled.
+func (p *Pool) Acquire(ctx context.Context, key string, dial func() (*smtp.Client, error)) (*PoolConn, error) {
+	for {
+		p.mutex.Lock()
+
+		// The host entry is only created when we open a connection: waiting
+		// callers must not leave empty entries behind them.
+		host := p.hosts[key]
+
+		if host != nil && len(host.idle) > 0 {
+			pc := host.idle[len(host.idle)-1]
+			host.idle = host.idle[:len(host.idle)-1]
+
+			p.stats.NbReuses++
+			p.mutex.Unlock()
+
+			return pc, nil
+		}
+
+		var evictedConn *PoolConn
+
+		canDial := host == nil || host.nbConns < p.Cfg.MaxConnectionsPerHost
+		if canDial && p.nbConns >= p.Cfg.MaxConnections {
+			// We cannot open a new connection because of the global limit,
+			// but we may be able to close an idle connection to another
+			// destination.
+			evictedConn = p.evictIdleConn()
+			canDial = evictedConn != nil
+		}
+
+		if canDial {
+			if host == nil {
+				host = &poolHost{}
+				p.hosts[key] = host
+			}
+
+			host.nbConns++
+			p.nbConns++
+			p.stats.NbDials++
+			p.mutex.Unlock()
+
+			if evictedConn != nil {
+				evictedConn.Client.Close()
+			}
+
+			client, err := dial()
+			if err != nil {
+				p.mutex.Lock()
+				p.releaseSlot(key, host)
+				p.mutex.Unlock()
+
+				return nil, err
+			}
+
+			pc := PoolConn{
+				Client: client,
+
+				key: key,
+			}
+
+			return &pc, nil
+		}
+
+		waitChan := make(chan struct{})
+		p.waiters = append(p.waiters, waitChan)
+
+		p.mutex.Unlock()
+
+		select {
+		case <-waitChan:
+
+		case <-ctx.Done():
+			p.mutex.Lock()
+			p.removeWaiter(waitChan)
+			p.mutex.Unlock()
+
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Release returns a session to the pool after a successful transaction or a
+// transaction rejected by the server. The session is reset so that it can be
+// used for the next transaction.
+func (p *Pool) Release(pc *PoolConn) {
+	if pc.nbMessages >= p.Cfg.MaxMessagesPerConnection {
+		pc.Client.Quit()
+		p.discard(pc)
+		return
+	}
+
+	if err := pc.Client.Reset(); err != nil {
+		p.Log.Debug(1, "cannot reset connection to %q: %v", pc.key, err)
+		p.Discard(pc)
+		return
+	}
+
+	pc.lastUse = time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	host := p.hosts[pc.key]
+	host.idle = append(host.idle, pc)
+
+	p.notifyWaiters()
+}
+
+// Discard closes a session which cannot be reused, for example after a
+// network error.
+func (p *Pool) Discard(pc *PoolConn) {
+	pc.Client.Close()
+	p.discard(pc)
+}
+
+func (p *Pool) discard(pc *PoolConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.releaseSlot(pc.key, p.hosts[pc.key])
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := p.stats
+
+	stats.NbConnections = p.nbConns
+	stats.NbWaiters = len(p.waiters)
+	stats.Hosts = make(map[string]PoolHostStats)
+
+	for key, host := range p.hosts {
+		stats.NbIdleConnections += len(host.idle)
+
+		stats.Hosts[key] = PoolHostStats{
+			NbConnections:     host.nbConns,
+			NbIdleConnections: len(host.idle),
+		}
+	}
+
+	return stats
+}
+
+func (p *Pool) releaseSlot(key string, host *poolHost) {
+	host.nbConns--
+	p.nbConns--
+
+	if host.nbConns == 0 {
+		delete(p.hosts, key)
+	}
+
+	p.notifyWaiters()
+}
+
+func (p *Pool) evictIdleConn() *PoolConn {
+	var oldestConn *PoolConn
+	var oldestHost *poolHost
+
+	for _, host := range p.hosts {
+		if len(host.idle) > 0 {
+			pc := host.idle[0]
+
+			if oldestConn == nil || pc.lastUse.Before(oldestConn.lastUse) {
+				oldestConn = pc
+				oldestHost = host
+			}
+		}
+	}
+
+	if oldestConn == nil {
+		return nil
+	}
+
+	oldestHost.idle = oldestHost.idle[1:]
+	oldestHost.nbConns--
+	p.nbConns--
+
+	if oldestHost.nbConns == 0 {
+		delete(p.hosts, oldestConn.key)
+	}
+
+	p.stats.NbEvictions++
+
+	return oldestConn
+}
+
+func (p *Pool) notifyWaiters() {
+	for _, waitChan := range p.waiters {
+		close(waitChan)
+	}
+
+	p.waiters = nil
+}
+
+func (p *Pool) removeWaiter(waitChan chan struct{}) {
+	for i, c := range p.waiters {
+		if c == waitChan {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return
+		}
+	}
+}
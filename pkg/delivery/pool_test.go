@@ -0,0 +1,197 @@
+package delivery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/go-log"
+)
+
+func startTestSMTPServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				conn.Write([]byte("220 test\r\n"))
+
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					if strings.HasPrefix(line, "QUIT") {
+						conn.Write([]byte("221 bye\r\n"))
+						return
+					}
+
+					conn.Write([]byte("250 ok\r\n"))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func newTestPool(cfg PoolCfg) *Pool {
+	cfg.Log = log.DefaultLogger("test")
+
+	pool := NewPool(cfg)
+	pool.Start()
+
+	return pool
+}
+
+func TestPoolReuse(t *testing.T) {
+	address := startTestSMTPServer(t)
+
+	pool := newTestPool(PoolCfg{})
+	defer pool.Stop()
+
+	dial := func() (*smtp.Client, error) {
+		return smtp.NewClient(address, smtp.ClientCfg{})
+	}
+
+	ctx := context.Background()
+
+	pc, err := pool.Acquire(ctx, address, dial)
+	if err != nil {
+		t.Fatalf("cannot acquire connection: %v", err)
+	}
+
+	pc.MessageSent()
+	pool.Release(pc)
+
+	pc2, err := pool.Acquire(ctx, address, dial)
+	if err != nil {
+		t.Fatalf("cannot acquire connection: %v", err)
+	}
+
+	if pc2 != pc {
+		t.Errorf("idle connection was not reused")
+	}
+
+	stats := pool.Stats()
+
+	if stats.NbDials != 1 {
+		t.Errorf("%d connections were established but there should have "+
+			"been only one", stats.NbDials)
+	}
+
+	if stats.NbReuses != 1 {
+		t.Errorf("connections were reused %d times instead of once",
+			stats.NbReuses)
+	}
+
+	pool.Discard(pc2)
+
+	if n := pool.Stats().NbConnections; n != 0 {
+		t.Errorf("pool contains %d connections after discarding the last "+
+			"one", n)
+	}
+}
+
+func TestPoolHostLimit(t *testing.T) {
+	address := startTestSMTPServer(t)
+
+	pool := newTestPool(PoolCfg{MaxConnectionsPerHost: 1})
+	defer pool.Stop()
+
+	dial := func() (*smtp.Client, error) {
+		return smtp.NewClient(address, smtp.ClientCfg{})
+	}
+
+	pc, err := pool.Acquire(context.Background(), address, dial)
+	if err != nil {
+		t.Fatalf("cannot acquire connection: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+
+	_, err = pool.Acquire(ctx, address, dial)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("connection acquisition should have timed out but "+
+			"returned %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.Release(pc)
+	}()
+
+	pc2, err := pool.Acquire(context.Background(), address, dial)
+	if err != nil {
+		t.Fatalf("cannot acquire connection: %v", err)
+	}
+
+	pool.Release(pc2)
+}
+
+func TestPoolGlobalLimit(t *testing.T) {
+	address := startTestSMTPServer(t)
+
+	pool := newTestPool(PoolCfg{MaxConnections: 1})
+	defer pool.Stop()
+
+	dial := func() (*smtp.Client, error) {
+		return smtp.NewClient(address, smtp.ClientCfg{})
+	}
+
+	pc, err := pool.Acquire(context.Background(), "a", dial)
+	if err != nil {
+		t.Fatalf("cannot acquire connection: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+
+	_, err = pool.Acquire(ctx, "b", dial)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("connection acquisition should have timed out but "+
+			"returned %v", err)
+	}
+
+	// Waiting for a connection must not create an entry for the host
+	if _, found := pool.Stats().Hosts["b"]; found {
+		t.Errorf("pool contains an entry for a host without connection")
+	}
+
+	pool.Release(pc)
+
+	// The idle connection to the first host is evicted to make room for the
+	// second one.
+	pc2, err := pool.Acquire(context.Background(), "b", dial)
+	if err != nil {
+		t.Fatalf("cannot acquire connection: %v", err)
+	}
+
+	if stats := pool.Stats(); stats.NbEvictions != 1 || len(stats.Hosts) != 1 {
+		t.Errorf("invalid pool statistics %#v", stats)
+	}
+
+	pool.Release(pc2)
+}
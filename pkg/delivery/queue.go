@@ -0,0 +1,562 @@
+package delivery
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dsn"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-ejson"
+	"github.com/galdor/go-log"
+)
+
+// The queue stores messages until they have been delivered to all their
+// recipients. Each message is stored in two files: "<id>.eml" contains the
+// message and "<id>.json" its envelope and delivery state. The message file
+// is written first so that a state file always refers to a complete message.
+
+const (
+	DefaultMinRetryDelay = 300       // seconds
+	DefaultMaxRetryDelay = 4 * 3600  // seconds
+	DefaultMaxQueueAge   = 5 * 86400 // seconds
+	DefaultNbWorkers     = 10
+
+	QueueDeliveryTimeout = 10 * time.Minute
+)
+
+type QueueCfg struct {
+	Log            *log.Logger         `json:"-"`
+	Handler        QueueHandler        `json:"-"`
+	FailureHandler QueueFailureHandler `json:"-"`
+
+	// The directory containing queued messages
+	Path string `json:"path"`
+
+	// Failed deliveries are retried after MinRetryDelay, the delay doubling
+	// after each attempt up to MaxRetryDelay. Recipients which could not be
+	// reached after MaxAge are given up on (RFC 5321 4.5.4.1.).
+	MinRetryDelay int `json:"min_retry_delay,omitempty"` // seconds
+	MaxRetryDelay int `json:"max_retry_delay,omitempty"` // seconds
+	MaxAge        int `json:"max_age,omitempty"`         // seconds
+
+	// The maximum number of messages delivered concurrently
+	NbWorkers int `json:"nb_workers,omitempty"`
+}
+
+func (cfg *QueueCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("path", cfg.Path)
+	v.CheckIntMin("min_retry_delay", cfg.MinRetryDelay, 0)
+	v.CheckIntMin("max_retry_delay", cfg.MaxRetryDelay, 0)
+	v.CheckIntMin("max_age", cfg.MaxAge, 0)
+	v.CheckIntMin("nb_workers", cfg.NbWorkers, 0)
+}
+
+// QueuedMessage is a message waiting to be delivered to some of its
+// recipients.
+type QueuedMessage struct {
+	Id           string
+	ReversePath  *imf.SpecificAddress // nil for the null reverse-path
+	Recipients   []imf.SpecificAddress
+	CreationTime time.Time
+	NbAttempts   int // previous attempts
+
+	// DSN parameters of the transaction the message was received in (RFC
+	// 3461); recipient parameters are indexed as recipients.
+	DSNParameters          dsn.Parameters
+	RecipientDSNParameters []dsn.RecipientParameters
+
+	Data []byte
+}
+
+// QueueHandler delivers a queued message and returns an error for each
+// recipient, nil if the message was delivered. Recipients whose error is
+// permanent (see IsPermanentError) are given up on immediately; others are
+// retried later.
+type QueueHandler func(ctx context.Context, msg *QueuedMessage) []error
+
+// QueueFailure is a recipient the queue has given up on.
+type QueueFailure struct {
+	Recipient     imf.SpecificAddress
+	DSNParameters dsn.RecipientParameters
+	Err           error
+	Expired       bool // true if the error was transient but MaxAge was reached
+}
+
+// QueueFailureHandler is called after each delivery attempt with the
+// recipients the message could not be delivered to, so that the sender can
+// be notified.
+type QueueFailureHandler func(msg *QueuedMessage, failures []QueueFailure)
+
+type queueEntry struct {
+	Id           string            `json:"id"`
+	ReversePath  string            `json:"reverse_path"`
+	Recipients   []*queueRecipient `json:"recipients"`
+	CreationTime time.Time         `json:"creation_time"`
+	NbAttempts   int               `json:"nb_attempts"`
+	NextAttempt  time.Time         `json:"next_attempt"`
+
+	ReturnType dsn.ReturnType `json:"return_type,omitempty"`
+	EnvelopeId string         `json:"envelope_id,omitempty"`
+
+	inProgress bool
+}
+
+type queueRecipient struct {
+	Address   string `json:"address"`
+	LastError string `json:"last_error,omitempty"`
+
+	Notify            []dsn.NotifyCondition `json:"notify,omitempty"`
+	OriginalRecipient string                `json:"original_recipient,omitempty"`
+}
+
+type Queue struct {
+	Cfg QueueCfg
+	Log *log.Logger
+
+	entries map[string]*queueEntry
+	mutex   sync.Mutex
+
+	workerChan chan struct{}
+	wakeupChan chan struct{}
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewQueue(cfg QueueCfg) (*Queue, error) {
+	if cfg.MinRetryDelay == 0 {
+		cfg.MinRetryDelay = DefaultMinRetryDelay
+	}
+
+	if cfg.MaxRetryDelay == 0 {
+		cfg.MaxRetryDelay = DefaultMaxRetryDelay
+	}
+
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = DefaultMaxQueueAge
+	}
+
+	if cfg.NbWorkers == 0 {
+		cfg.NbWorkers = DefaultNbWorkers
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	q := Queue{
+		Cfg: cfg,
+		Log: cfg.Log,
+
+		entries: make(map[string]*queueEntry),
+
+		workerChan: make(chan struct{}, cfg.NbWorkers),
+		wakeupChan: make(chan struct{}, 1),
+
+		ctx:      ctx,
+		cancel:   cancel,
+		stopChan: make(chan struct{}),
+	}
+
+	if err := os.MkdirAll(cfg.Path, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create directory %q: %w", cfg.Path, err)
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return &q, nil
+}
+
+func (q *Queue) Start() {
+	q.wg.Add(1)
+	go q.main()
+}
+
+// Stop interrupts ongoing deliveries and waits for them to finish; messages
+// which were not delivered stay in the queue and are retried after a restart.
+func (q *Queue) Stop() {
+	close(q.stopChan)
+	q.cancel()
+	q.wg.Wait()
+}
+
+// Enqueue stores a message for delivery and returns its identifier. The
+// envelope, DSN parameters and data of the message are used; other fields are
+// set by the queue. The message is on disk when the function returns, so that
+// it is not lost if the server is stopped.
+func (q *Queue) Enqueue(msg *QueuedMessage) (string, error) {
+	id, err := generateQueueId()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	entry := queueEntry{
+		Id:           id,
+		ReversePath:  smtp.FormatPath(msg.ReversePath),
+		CreationTime: now,
+		NextAttempt:  now,
+
+		ReturnType: msg.DSNParameters.ReturnType,
+		EnvelopeId: msg.DSNParameters.EnvelopeId,
+	}
+
+	for i, recipient := range msg.Recipients {
+		qr := queueRecipient{Address: smtp.FormatPath(&recipient)}
+
+		if i < len(msg.RecipientDSNParameters) {
+			params := msg.RecipientDSNParameters[i]
+
+			qr.Notify = params.Notify
+			if params.OriginalRecipient != nil {
+				qr.OriginalRecipient =
+					smtp.FormatPath(params.OriginalRecipient)
+			}
+		}
+
+		entry.Recipients = append(entry.Recipients, &qr)
+	}
+
+	if err := utils.WriteFileAtomically(q.dataPath(id), msg.Data); err != nil {
+		return "", err
+	}
+
+	if err := q.writeEntry(&entry); err != nil {
+		os.Remove(q.dataPath(id))
+		return "", err
+	}
+
+	q.mutex.Lock()
+	q.entries[id] = &entry
+	q.mutex.Unlock()
+
+	q.Log.Info("message %s queued for %d recipients", id,
+		len(msg.Recipients))
+
+	q.wakeup()
+
+	return id, nil
+}
+
+func (q *Queue) wakeup() {
+	select {
+	case q.wakeupChan <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) main() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stopChan:
+			return
+
+		case <-ticker.C:
+		case <-q.wakeupChan:
+		}
+
+		q.processEntries(time.Now())
+	}
+}
+
+func (q *Queue) processEntries(now time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, entry := range q.entries {
+		if entry.inProgress || entry.NextAttempt.After(now) {
+			continue
+		}
+
+		select {
+		case q.workerChan <- struct{}{}:
+		default:
+			// All workers are busy; remaining entries will be processed
+			// during the next iteration.
+			return
+		}
+
+		entry.inProgress = true
+
+		q.wg.Add(1)
+		go q.processEntry(entry)
+	}
+}
+
+func (q *Queue) processEntry(entry *queueEntry) {
+	defer q.wg.Done()
+	defer func() { <-q.workerChan }()
+
+	msg, err := q.queuedMessage(entry)
+	if err != nil {
+		q.Log.Error("cannot load message %s: %v", entry.Id, err)
+		q.reschedule(entry, time.Now())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(q.ctx, QueueDeliveryTimeout)
+	errs := q.Cfg.Handler(ctx, msg)
+	cancel()
+
+	now := time.Now()
+	expired := now.Sub(entry.CreationTime) >=
+		time.Duration(q.Cfg.MaxAge)*time.Second
+
+	var remaining []*queueRecipient
+	var failures []QueueFailure
+
+	for i, recipient := range entry.Recipients {
+		err := errs[i]
+
+		switch {
+		case err == nil:
+			q.Log.Info("message %s delivered to %s", entry.Id,
+				recipient.Address)
+
+		case IsPermanentError(err):
+			q.Log.Error("cannot deliver message %s to %s: %v", entry.Id,
+				recipient.Address, err)
+
+			failures = append(failures, QueueFailure{
+				Recipient:     msg.Recipients[i],
+				DSNParameters: msg.RecipientDSNParameters[i],
+				Err:           err,
+			})
+
+		case expired:
+			q.Log.Error("cannot deliver message %s to %s: giving up after "+
+				"%d attempts: %v", entry.Id, recipient.Address,
+				entry.NbAttempts+1, err)
+
+			failures = append(failures, QueueFailure{
+				Recipient:     msg.Recipients[i],
+				DSNParameters: msg.RecipientDSNParameters[i],
+				Err:           err,
+				Expired:       true,
+			})
+
+		default:
+			q.Log.Info("cannot deliver message %s to %s, will retry: %v",
+				entry.Id, recipient.Address, err)
+
+			recipient.LastError = err.Error()
+			remaining = append(remaining, recipient)
+		}
+	}
+
+	if len(failures) > 0 && q.Cfg.FailureHandler != nil {
+		q.Cfg.FailureHandler(msg, failures)
+	}
+
+	q.mutex.Lock()
+	entry.Recipients = remaining
+	q.mutex.Unlock()
+
+	if len(remaining) == 0 {
+		q.remove(entry)
+		return
+	}
+
+	q.reschedule(entry, now)
+}
+
+func (q *Queue) queuedMessage(entry *queueEntry) (*QueuedMessage, error) {
+	reversePath, _, err := smtp.ParsePath([]byte(entry.ReversePath), true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reverse-path %q: %w",
+			entry.ReversePath, err)
+	}
+
+	var recipients []imf.SpecificAddress
+	var recipientParams []dsn.RecipientParameters
+
+	for _, recipient := range entry.Recipients {
+		forwardPath, _, err := smtp.ParsePath([]byte(recipient.Address),
+			false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w",
+				recipient.Address, err)
+		}
+
+		params := dsn.RecipientParameters{Notify: recipient.Notify}
+
+		if recipient.OriginalRecipient != "" {
+			addr, _, err := smtp.ParsePath(
+				[]byte(recipient.OriginalRecipient), false)
+			if err != nil {
+				return nil, fmt.Errorf("invalid original recipient %q: %w",
+					recipient.OriginalRecipient, err)
+			}
+
+			params.OriginalRecipient = addr
+		}
+
+		recipients = append(recipients, *forwardPath)
+		recipientParams = append(recipientParams, params)
+	}
+
+	data, err := os.ReadFile(q.dataPath(entry.Id))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", q.dataPath(entry.Id), err)
+	}
+
+	msg := QueuedMessage{
+		Id:           entry.Id,
+		ReversePath:  reversePath,
+		Recipients:   recipients,
+		CreationTime: entry.CreationTime,
+		NbAttempts:   entry.NbAttempts,
+
+		DSNParameters: dsn.Parameters{
+			ReturnType: entry.ReturnType,
+			EnvelopeId: entry.EnvelopeId,
+		},
+		RecipientDSNParameters: recipientParams,
+
+		Data: data,
+	}
+
+	return &msg, nil
+}
+
+func (q *Queue) reschedule(entry *queueEntry, now time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entry.NbAttempts++
+	entry.NextAttempt = now.Add(q.retryDelay(entry.NbAttempts))
+	entry.inProgress = false
+
+	if err := q.writeEntry(entry); err != nil {
+		q.Log.Error("cannot update message %s: %v", entry.Id, err)
+	}
+}
+
+func (q *Queue) retryDelay(nbAttempts int) time.Duration {
+	delay := time.Duration(q.Cfg.MinRetryDelay) * time.Second
+	maxDelay := time.Duration(q.Cfg.MaxRetryDelay) * time.Second
+
+	for i := 1; i < nbAttempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxDelay)
+}
+
+func (q *Queue) remove(entry *queueEntry) {
+	q.mutex.Lock()
+	delete(q.entries, entry.Id)
+	q.mutex.Unlock()
+
+	// The state file is removed first: a message file without state file is
+	// deleted when the queue is loaded.
+	for _, filePath := range []string{q.entryPath(entry.Id),
+		q.dataPath(entry.Id)} {
+		if err := os.Remove(filePath); err != nil {
+			q.Log.Error("cannot delete %q: %v", filePath, err)
+		}
+	}
+}
+
+func (q *Queue) load() error {
+	dirEntries, err := os.ReadDir(q.Cfg.Path)
+	if err != nil {
+		return fmt.Errorf("cannot read directory %q: %w", q.Cfg.Path, err)
+	}
+
+	for _, dirEntry := range dirEntries {
+		id, found := strings.CutSuffix(dirEntry.Name(), ".json")
+		if !found {
+			continue
+		}
+
+		entry, err := q.readEntry(id)
+		if err != nil {
+			return err
+		}
+
+		q.entries[id] = entry
+	}
+
+	// Remove files left by interrupted writes
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		id, _, _ := strings.Cut(name, ".")
+
+		if q.entries[id] == nil || strings.HasSuffix(name, ".tmp") {
+			filePath := path.Join(q.Cfg.Path, name)
+
+			q.Log.Info("deleting orphan file %q", filePath)
+
+			if err := os.Remove(filePath); err != nil {
+				return fmt.Errorf("cannot delete %q: %w", filePath, err)
+			}
+		}
+	}
+
+	if len(q.entries) > 0 {
+		q.Log.Info("%d queued messages loaded", len(q.entries))
+	}
+
+	return nil
+}
+
+func (q *Queue) readEntry(id string) (*queueEntry, error) {
+	filePath := q.entryPath(id)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	var entry queueEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("cannot decode %q: %w", filePath, err)
+	}
+
+	return &entry, nil
+}
+
+func (q *Queue) writeEntry(entry *queueEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot encode queue entry: %w", err)
+	}
+
+	return utils.WriteFileAtomically(q.entryPath(entry.Id), data)
+}
+
+func (q *Queue) entryPath(id string) string {
+	return path.Join(q.Cfg.Path, id+".json")
+}
+
+func (q *Queue) dataPath(id string) string {
+	return path.Join(q.Cfg.Path, id+".eml")
+}
+
+func generateQueueId() (string, error) {
+	data := make([]byte, 12)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	return hex.EncodeToString(data), nil
+}
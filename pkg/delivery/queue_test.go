@@ -0,0 +1,213 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dsn"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/go-log"
+)
+
+func TestQueue(t *testing.T) {
+	dirPath := t.TempDir()
+
+	alice := imf.SpecificAddress{LocalPart: "alice", Domain: "example.com"}
+	bob := imf.SpecificAddress{LocalPart: "bob", Domain: "example.net"}
+	carol := imf.SpecificAddress{LocalPart: "carol", Domain: "example.net"}
+	dave := imf.SpecificAddress{LocalPart: "dave", Domain: "example.net"}
+
+	dsnParams := dsn.Parameters{ReturnType: dsn.ReturnFull, EnvelopeId: "42"}
+	daveParams := dsn.RecipientParameters{
+		Notify:            []dsn.NotifyCondition{dsn.NotifyFailure},
+		OriginalRecipient: &dave,
+	}
+
+	var attempts [][]string
+
+	handler := func(ctx context.Context, msg *QueuedMessage) []error {
+		var recipients []string
+		errs := make([]error, len(msg.Recipients))
+
+		for i, recipient := range msg.Recipients {
+			recipients = append(recipients, recipient.String())
+
+			switch {
+			case recipient == carol && len(attempts) == 0:
+				errs[i] = errors.New("connection refused")
+			case recipient == dave:
+				errs[i] = smtp.NewError(550, "5.1.1", "unknown mailbox")
+			}
+		}
+
+		if string(msg.Data) != "test" || *msg.ReversePath != alice ||
+			msg.DSNParameters != dsnParams {
+			t.Errorf("invalid queued message %#v", msg)
+		}
+
+		attempts = append(attempts, recipients)
+
+		return errs
+	}
+
+	var failures []QueueFailure
+
+	failureHandler := func(msg *QueuedMessage, fs []QueueFailure) {
+		failures = append(failures, fs...)
+	}
+
+	cfg := QueueCfg{
+		Log:            log.DefaultLogger("test"),
+		Handler:        handler,
+		FailureHandler: failureHandler,
+
+		Path: dirPath,
+	}
+
+	queue, err := NewQueue(cfg)
+	if err != nil {
+		t.Fatalf("cannot create queue: %v", err)
+	}
+
+	id, err := queue.Enqueue(&QueuedMessage{
+		ReversePath:   &alice,
+		Recipients:    []imf.SpecificAddress{bob, carol, dave},
+		DSNParameters: dsnParams,
+		RecipientDSNParameters: []dsn.RecipientParameters{
+			{}, {}, daveParams,
+		},
+		Data: []byte("test"),
+	})
+	if err != nil {
+		t.Fatalf("cannot enqueue message: %v", err)
+	}
+
+	now := time.Now()
+
+	queue.processEntries(now)
+	queue.wg.Wait()
+
+	if len(attempts) != 1 || len(attempts[0]) != 3 {
+		t.Fatalf("invalid delivery attempts %v", attempts)
+	}
+
+	if len(failures) != 1 || failures[0].Recipient != dave ||
+		failures[0].Expired {
+		t.Fatalf("invalid delivery failures %#v", failures)
+	}
+
+	if params := failures[0].DSNParameters; len(params.Notify) != 1 ||
+		params.OriginalRecipient == nil || *params.OriginalRecipient != dave {
+		t.Errorf("invalid recipient DSN parameters %#v", params)
+	}
+
+	// The queue is loaded again to make sure that the state of the message
+	// was saved.
+	queue, err = NewQueue(cfg)
+	if err != nil {
+		t.Fatalf("cannot create queue: %v", err)
+	}
+
+	entry := queue.entries[id]
+	if entry == nil || len(entry.Recipients) != 1 || entry.NbAttempts != 1 {
+		t.Fatalf("invalid queue entry %#v", entry)
+	}
+
+	queue.processEntries(now)
+	queue.wg.Wait()
+
+	if len(attempts) != 1 {
+		t.Fatalf("message was delivered again before the retry delay")
+	}
+
+	queue.processEntries(now.Add(2 * DefaultMinRetryDelay * time.Second))
+	queue.wg.Wait()
+
+	if len(attempts) != 2 || len(attempts[1]) != 1 ||
+		attempts[1][0] != carol.String() {
+		t.Fatalf("invalid delivery attempts %v", attempts)
+	}
+
+	if len(queue.entries) != 0 {
+		t.Errorf("message was not removed from the queue")
+	}
+
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		t.Fatalf("cannot read directory: %v", err)
+	}
+
+	if len(dirEntries) != 0 {
+		t.Errorf("queue directory still contains %d files", len(dirEntries))
+	}
+}
+
+func TestQueueExpiration(t *testing.T) {
+	alice := imf.SpecificAddress{LocalPart: "alice", Domain: "example.com"}
+	bob := imf.SpecificAddress{LocalPart: "bob", Domain: "example.net"}
+
+	handler := func(ctx context.Context, msg *QueuedMessage) []error {
+		return []error{errors.New("connection refused")}
+	}
+
+	var failures []QueueFailure
+
+	failureHandler := func(msg *QueuedMessage, fs []QueueFailure) {
+		failures = append(failures, fs...)
+	}
+
+	cfg := QueueCfg{
+		Log:            log.DefaultLogger("test"),
+		Handler:        handler,
+		FailureHandler: failureHandler,
+
+		Path: t.TempDir(),
+	}
+
+	queue, err := NewQueue(cfg)
+	if err != nil {
+		t.Fatalf("cannot create queue: %v", err)
+	}
+
+	id, err := queue.Enqueue(&QueuedMessage{
+		ReversePath: &alice,
+		Recipients:  []imf.SpecificAddress{bob},
+		Data:        []byte("test"),
+	})
+	if err != nil {
+		t.Fatalf("cannot enqueue message: %v", err)
+	}
+
+	entry := queue.entries[id]
+	entry.CreationTime = entry.CreationTime.Add(
+		-DefaultMaxQueueAge * time.Second)
+
+	queue.processEntries(time.Now())
+	queue.wg.Wait()
+
+	if len(failures) != 1 || failures[0].Recipient != bob ||
+		!failures[0].Expired {
+		t.Fatalf("invalid delivery failures %#v", failures)
+	}
+
+	if len(queue.entries) != 0 {
+		t.Errorf("message was not removed from the queue")
+	}
+}
+
+func TestQueueRetryDelay(t *testing.T) {
+	queue := Queue{Cfg: QueueCfg{MinRetryDelay: 60, MaxRetryDelay: 300}}
+
+	delays := []time.Duration{60, 120, 240, 300, 300}
+
+	for i, delay := range delays {
+		if d := queue.retryDelay(i + 1); d != delay*time.Second {
+			t.Errorf("retry delay after %d attempts is %v instead of %v",
+				i+1, d, delay*time.Second)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/go-log"
+)
+
+const DefaultSMTPPort = 25
+
+type RemoteTransportCfg struct {
+	Log      *log.Logger
+	Pool     *Pool
+	Resolver dns.Resolver
+
+	// The domain sent with EHLO commands
+	Domain string
+
+	ConnectionTimeout time.Duration
+	CommandTimeout    time.Duration
+}
+
+// RemoteTransport delivers messages to other servers, either directly to the
+// MX servers of the recipient domain or through a relay. Sessions are
+// obtained from the connection pool so that consecutive messages sent to the
+// same server reuse the same connection.
+type RemoteTransport struct {
+	Cfg RemoteTransportCfg
+	Log *log.Logger
+}
+
+func NewRemoteTransport(cfg RemoteTransportCfg) *RemoteTransport {
+	return &RemoteTransport{
+		Cfg: cfg,
+		Log: cfg.Log,
+	}
+}
+
+// IsPermanentError returns true if an error returned by a transport means
+// that the delivery will never succeed. Replies of remote servers are
+// *smtp.ReplyError values and failures detected locally are *smtp.Error
+// values; other errors, e.g. network errors, are transient.
+func IsPermanentError(err error) bool {
+	var replyErr *smtp.ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Reply.IsPermanentFailure()
+	}
+
+	var smtpErr *smtp.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.IsPermanent()
+	}
+
+	return false
+}
+
+type remoteServer struct {
+	host    string
+	address string
+}
+
+// Deliver sends a message to recipients which all belong to the same domain
+// and are reached with the same route. The message data must use CRLF line
+// endings. The returned slice contains an error for each recipient, nil if
+// the message was accepted by the remote server.
+func (t *RemoteTransport) Deliver(ctx context.Context, route *Route, domain string, reversePath *imf.SpecificAddress, recipients []imf.SpecificAddress, data []byte) []error {
+	servers, err := t.servers(ctx, route, domain)
+	if err != nil {
+		return repeatError(err, len(recipients))
+	}
+
+	// RFC 5321 5.1. Servers are tried in order until we can establish a
+	// session with one of them.
+	for _, server := range servers {
+		key := route.TransportName + "/" + server.address
+
+		dial := func() (*smtp.Client, error) {
+			return t.dial(route, server)
+		}
+
+		pc, err := t.Cfg.Pool.Acquire(ctx, key, dial)
+		if err != nil {
+			t.Log.Debug(1, "cannot connect to %s: %v", server.address, err)
+			continue
+		}
+
+		return t.send(pc, reversePath, recipients, data)
+	}
+
+	err = fmt.Errorf("cannot connect to any server for domain %q", domain)
+	return repeatError(err, len(recipients))
+}
+
+func (t *RemoteTransport) servers(ctx context.Context, route *Route, domain string) ([]remoteServer, error) {
+	switch route.Transport.Type {
+	case TransportTypeRelay:
+		cfg := route.Transport.Relay
+
+		server := remoteServer{
+			host:    cfg.Host,
+			address: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		}
+
+		return []remoteServer{server}, nil
+
+	case TransportTypeMX:
+		hosts, err := t.lookupMX(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+
+		servers := make([]remoteServer, len(hosts))
+		for i, host := range hosts {
+			servers[i] = remoteServer{
+				host:    host,
+				address: net.JoinHostPort(host, strconv.Itoa(DefaultSMTPPort)),
+			}
+		}
+
+		return servers, nil
+	}
+
+	return nil, fmt.Errorf("transport type %q does not support remote "+
+		"delivery", route.Transport.Type)
+}
+
+// lookupMX returns the hosts of the MX servers of a domain ordered by
+// preference (RFC 5321 5.1.).
+func (t *RemoteTransport) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := t.Cfg.Resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			// Without MX records, the domain is used as an implicit MX
+			return []string{domain}, nil
+		}
+
+		return nil, fmt.Errorf("cannot look up MX records of %q: %w", domain,
+			err)
+	}
+
+	// RFC 7505 3. A single MX record whose target is the root domain (null
+	// MX) indicates that the domain does not accept mail.
+	if len(mxs) == 1 && strings.TrimSuffix(mxs[0].Host, ".") == "" {
+		return nil, smtp.NewError(556, "5.1.10", "domain %q does not "+
+			"accept mail", domain)
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+
+	return hosts, nil
+}
+
+func (t *RemoteTransport) dial(route *Route, server remoteServer) (*smtp.Client, error) {
+	cfg := smtp.ClientCfg{
+		Log:               t.Log,
+		ConnectionTimeout: t.Cfg.ConnectionTimeout,
+		CommandTimeout:    t.Cfg.CommandTimeout,
+
+		Domain: t.Cfg.Domain,
+
+		TLSConfig: &tls.Config{ServerName: server.host},
+	}
+
+	relay := route.Transport.Relay
+
+	tlsMode := TLSModeStartTLS
+	requireTLS := false
+
+	if relay != nil {
+		if relay.TLS != "" {
+			tlsMode = relay.TLS
+		}
+
+		requireTLS = tlsMode != TLSModeNone
+		cfg.TLSConfig.InsecureSkipVerify = relay.TLSInsecureSkipVerify
+	} else {
+		// RFC 7435 MX servers are reached with opportunistic TLS: nothing
+		// ties their name to the recipient domain, so their certificate
+		// cannot be meaningfully verified.
+		cfg.TLSConfig.InsecureSkipVerify = true
+	}
+
+	cfg.ImplicitTLS = tlsMode == TLSModeImplicit
+
+	client, err := smtp.NewClient(server.address, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsMode == TLSModeStartTLS && (requireTLS ||
+		client.HasExtension("STARTTLS")) {
+		if err := client.StartTLS(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("cannot start tls: %w", err)
+		}
+	}
+
+	if relay != nil && relay.Username != "" {
+		if err := client.Auth(relay.Username, relay.Password); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("cannot authenticate: %w", err)
+		}
+	}
+
+	return client, nil
+}
+
+// send runs a transaction on a pooled session. Sessions are returned to the
+// pool unless a network error occurred.
+func (t *RemoteTransport) send(pc *PoolConn, reversePath *imf.SpecificAddress, recipients []imf.SpecificAddress, data []byte) []error {
+	client := pc.Client
+
+	fail := func(err error) []error {
+		if isReplyError(err) {
+			t.Cfg.Pool.Release(pc)
+		} else {
+			t.Cfg.Pool.Discard(pc)
+		}
+
+		return repeatError(err, len(recipients))
+	}
+
+	if err := client.Mail(reversePath); err != nil {
+		return fail(err)
+	}
+
+	errs := make([]error, len(recipients))
+	nbAccepted := 0
+
+	for i, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			if !isReplyError(err) {
+				return fail(err)
+			}
+
+			errs[i] = err
+			continue
+		}
+
+		nbAccepted++
+	}
+
+	if nbAccepted == 0 {
+		t.Cfg.Pool.Release(pc)
+		return errs
+	}
+
+	if err := client.Data(data); err != nil {
+		if !isReplyError(err) {
+			return fail(err)
+		}
+
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+
+	pc.MessageSent()
+	t.Cfg.Pool.Release(pc)
+
+	return errs
+}
+
+func isReplyError(err error) bool {
+	var replyErr *smtp.ReplyError
+	return errors.As(err, &replyErr)
+}
+
+func repeatError(err error, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+
+	return errs
+}
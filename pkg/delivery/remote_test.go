@@ -0,0 +1,196 @@
+package delivery
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/smtp"
+)
+
+// startTestRelayServer starts a minimal SMTP server which requires
+// authentication, rejects recipients whose local part is "unknown" and sends
+// the commands and data it receives on a channel.
+func startTestRelayServer(t *testing.T) (string, int, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	lines := make(chan string, 100)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				conn.Write([]byte("220 test\r\n"))
+
+				authenticated := false
+				inData := false
+
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					line = strings.TrimRight(line, "\r\n")
+					lines <- line
+
+					var reply string
+
+					switch {
+					case inData:
+						if line == "." {
+							inData = false
+							reply = "250 queued"
+						}
+					case strings.HasPrefix(line, "EHLO"):
+						reply = "250-test\r\n250 AUTH PLAIN"
+					case strings.HasPrefix(line, "AUTH"):
+						authenticated = true
+						reply = "235 ok"
+					case !authenticated:
+						reply = "530 authentication required"
+					case strings.HasPrefix(line, "RCPT TO:<unknown@"):
+						reply = "550 5.1.1 unknown mailbox"
+					case line == "DATA":
+						inData = true
+						reply = "354 go ahead"
+					case line == "QUIT":
+						conn.Write([]byte("221 bye\r\n"))
+						return
+					default:
+						reply = "250 ok"
+					}
+
+					if reply != "" {
+						conn.Write([]byte(reply + "\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	host, portString, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	return host, port, lines
+}
+
+func TestRemoteTransportRelay(t *testing.T) {
+	host, port, lines := startTestRelayServer(t)
+
+	pool := newTestPool(PoolCfg{})
+	defer pool.Stop()
+
+	transport := NewRemoteTransport(RemoteTransportCfg{
+		Log:    pool.Log,
+		Pool:   pool,
+		Domain: "mail.example.com",
+	})
+
+	route := Route{
+		Domain:        "*",
+		TransportName: "gateway",
+		Transport: &TransportCfg{
+			Type: TransportTypeRelay,
+			Relay: &RelayTransportCfg{
+				Host:     host,
+				Port:     port,
+				TLS:      TLSModeNone,
+				Username: "alice",
+				Password: "secret",
+			},
+		},
+	}
+
+	alice := imf.SpecificAddress{LocalPart: "alice", Domain: "example.com"}
+	bob := imf.SpecificAddress{LocalPart: "bob", Domain: "example.net"}
+	unknown := imf.SpecificAddress{LocalPart: "unknown", Domain: "example.net"}
+
+	data := []byte("Subject: test\r\n\r\n.hello\r\n")
+
+	errs := transport.Deliver(context.Background(), &route, "example.net",
+		&alice, []imf.SpecificAddress{bob, unknown}, data)
+
+	if errs[0] != nil {
+		t.Errorf("cannot deliver message to %s: %v", bob.String(), errs[0])
+	}
+
+	if errs[1] == nil || !IsPermanentError(errs[1]) {
+		t.Errorf("delivery to %s should have failed permanently but "+
+			"returned %v", unknown.String(), errs[1])
+	}
+
+	var received []string
+	for len(lines) > 0 {
+		received = append(received, <-lines)
+	}
+
+	expected := []string{
+		"EHLO mail.example.com",
+		"AUTH PLAIN AGFsaWNlAHNlY3JldA==",
+		"MAIL FROM:<alice@example.com>",
+		"RCPT TO:<bob@example.net>",
+		"RCPT TO:<unknown@example.net>",
+		"DATA",
+		"Subject: test",
+		"",
+		"..hello",
+		".",
+		"RSET",
+	}
+
+	if strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("server received %q instead of %q", received, expected)
+	}
+
+	if n := pool.Stats().NbIdleConnections; n != 1 {
+		t.Errorf("pool contains %d idle connections instead of 1", n)
+	}
+}
+
+func TestRemoteTransportNullMX(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+	resolver.MX["example.net"] = []*net.MX{{Host: ".", Pref: 0}}
+
+	pool := newTestPool(PoolCfg{})
+	defer pool.Stop()
+
+	transport := NewRemoteTransport(RemoteTransportCfg{
+		Log:      pool.Log,
+		Pool:     pool,
+		Resolver: resolver,
+	})
+
+	route := Route{
+		Domain:        "*",
+		TransportName: "mx",
+		Transport:     &TransportCfg{Type: TransportTypeMX},
+	}
+
+	bob := imf.SpecificAddress{LocalPart: "bob", Domain: "example.net"}
+
+	errs := transport.Deliver(context.Background(), &route, "example.net",
+		nil, []imf.SpecificAddress{bob}, []byte("\r\n"))
+
+	if smtpErr, ok := errs[0].(*smtp.Error); !ok || smtpErr.Status != "5.1.10" {
+		t.Errorf("delivery should have failed with a null MX error but "+
+			"returned %v", errs[0])
+	}
+}
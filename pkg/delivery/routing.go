@@ -0,0 +1,272 @@
+package delivery
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/go-ejson"
+)
+
+type TransportType string
+
+const (
+	TransportTypeMX     TransportType = "mx"
+	TransportTypeRelay  TransportType = "relay"
+	TransportTypeLocal  TransportType = "local"
+	TransportTypeReject TransportType = "reject"
+)
+
+var TransportTypeValues = []TransportType{
+	TransportTypeMX,
+	TransportTypeRelay,
+	TransportTypeLocal,
+	TransportTypeReject,
+}
+
+type TLSMode string
+
+const (
+	TLSModeNone     TLSMode = "none"
+	TLSModeStartTLS TLSMode = "starttls"
+	TLSModeImplicit TLSMode = "implicit"
+)
+
+var TLSModeValues = []TLSMode{
+	TLSModeNone,
+	TLSModeStartTLS,
+	TLSModeImplicit,
+}
+
+const DefaultRouteKey = "*"
+
+type RoutingCfg struct {
+	// Transports are identified by name and referenced in routes. Routes map
+	// domains to transport names. Domains are either a fully qualified domain
+	// name (e.g. "example.com"), a wildcard matching all subdomains of a
+	// domain (e.g. "*.example.com") or "*" for the default route.
+	Transports map[string]*TransportCfg `json:"transports"`
+	Routes     map[string]string        `json:"routes"`
+}
+
+type TransportCfg struct {
+	Type   TransportType       `json:"type"`
+	Relay  *RelayTransportCfg  `json:"relay,omitempty"`
+	Local  *LocalTransportCfg  `json:"local,omitempty"`
+	Reject *RejectTransportCfg `json:"reject,omitempty"`
+}
+
+type RelayTransportCfg struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+
+	TLS                   TLSMode `json:"tls,omitempty"`
+	TLSInsecureSkipVerify bool    `json:"tls_insecure_skip_verify,omitempty"`
+
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type LocalTransportCfg struct {
+	// The directory containing the Maildir directory of each user. Only
+	// recipients whose directory exists are accepted.
+	Path string `json:"path"`
+}
+
+const (
+	DefaultRejectCode    = 554
+	DefaultRejectStatus  = "5.7.1"
+	DefaultRejectMessage = "delivery to this domain is not allowed"
+)
+
+type RejectTransportCfg struct {
+	Code    int    `json:"code,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (cfg *RoutingCfg) ValidateJSON(v *ejson.Validator) {
+	v.WithChild("transports", func() {
+		for name, tcfg := range cfg.Transports {
+			v.CheckObject(name, tcfg)
+		}
+	})
+
+	v.WithChild("routes", func() {
+		for domain, name := range cfg.Routes {
+			v.Check(domain, validateRouteDomain(domain), "invalid_route_domain",
+				"invalid route domain")
+
+			_, found := cfg.Transports[name]
+			v.Check(domain, found, "unknown_transport",
+				"unknown transport %q", name)
+		}
+	})
+}
+
+func (cfg *TransportCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringValue("type", cfg.Type, TransportTypeValues)
+
+	switch cfg.Type {
+	case TransportTypeRelay:
+		v.CheckObject("relay", cfg.Relay)
+	case TransportTypeLocal:
+		v.CheckObject("local", cfg.Local)
+	case TransportTypeReject:
+		v.CheckOptionalObject("reject", cfg.Reject)
+	}
+}
+
+func (cfg *RelayTransportCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("host", cfg.Host)
+	v.CheckIntMinMax("port", cfg.Port, 1, 65535)
+
+	if cfg.TLS != "" {
+		v.CheckStringValue("tls", cfg.TLS, TLSModeValues)
+	}
+
+	if cfg.Password != "" {
+		v.CheckStringNotEmpty("username", cfg.Username)
+	}
+}
+
+func (cfg *LocalTransportCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("path", cfg.Path)
+}
+
+func (cfg *RejectTransportCfg) ValidateJSON(v *ejson.Validator) {
+	if cfg.Code != 0 {
+		v.CheckIntMinMax("code", cfg.Code, 500, 599)
+	}
+
+	if cfg.Status != "" {
+		v.Check("status", strings.HasPrefix(cfg.Status, "5."),
+			"invalid_status", "status must be a permanent failure status")
+	}
+}
+
+func validateRouteDomain(domain string) bool {
+	if domain == DefaultRouteKey {
+		return true
+	}
+
+	domain = strings.TrimPrefix(domain, "*.")
+
+	return domain != "" && !strings.Contains(domain, "*")
+}
+
+type Route struct {
+	Domain        string // the route key which matched
+	TransportName string
+	Transport     *TransportCfg
+}
+
+type Router struct {
+	Cfg RoutingCfg
+
+	exactRoutes    map[string]string
+	wildcardRoutes map[string]string
+	defaultRoute   string
+}
+
+var defaultTransport = TransportCfg{
+	Type: TransportTypeMX,
+}
+
+func NewRouter(cfg RoutingCfg) *Router {
+	r := Router{
+		Cfg: cfg,
+
+		exactRoutes:    make(map[string]string),
+		wildcardRoutes: make(map[string]string),
+	}
+
+	for domain, name := range cfg.Routes {
+		domain = strings.ToLower(domain)
+
+		if domain == DefaultRouteKey {
+			r.defaultRoute = name
+		} else if suffix, found := strings.CutPrefix(domain, "*."); found {
+			r.wildcardRoutes[suffix] = name
+		} else {
+			r.exactRoutes[domain] = name
+		}
+	}
+
+	return &r
+}
+
+// Route returns the route to use for a recipient domain. Exact matches take
+// precedence over wildcards, and the most specific wildcard wins. Without any
+// matching route, messages are delivered directly to the MX servers of the
+// domain.
+func (r *Router) Route(domain string) (*Route, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if name, found := r.exactRoutes[domain]; found {
+		return r.route(domain, name)
+	}
+
+	for parent := domain; ; {
+		dot := strings.IndexByte(parent, '.')
+		if dot == -1 {
+			break
+		}
+
+		parent = parent[dot+1:]
+
+		if name, found := r.wildcardRoutes[parent]; found {
+			return r.route("*."+parent, name)
+		}
+	}
+
+	if r.defaultRoute != "" {
+		return r.route(DefaultRouteKey, r.defaultRoute)
+	}
+
+	route := Route{
+		Domain:        DefaultRouteKey,
+		TransportName: string(TransportTypeMX),
+		Transport:     &defaultTransport,
+	}
+
+	return &route, nil
+}
+
+// RejectionError returns the error used to reply to messages sent with a
+// reject transport.
+func (r *Route) RejectionError() *smtp.Error {
+	var cfg RejectTransportCfg
+	if r.Transport.Reject != nil {
+		cfg = *r.Transport.Reject
+	}
+
+	if cfg.Code == 0 {
+		cfg.Code = DefaultRejectCode
+	}
+
+	if cfg.Status == "" {
+		cfg.Status = DefaultRejectStatus
+	}
+
+	if cfg.Message == "" {
+		cfg.Message = DefaultRejectMessage
+	}
+
+	return smtp.NewError(cfg.Code, cfg.Status, "%s", cfg.Message)
+}
+
+func (r *Router) route(domain, name string) (*Route, error) {
+	transport, found := r.Cfg.Transports[name]
+	if !found {
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+
+	route := Route{
+		Domain:        domain,
+		TransportName: name,
+		Transport:     transport,
+	}
+
+	return &route, nil
+}
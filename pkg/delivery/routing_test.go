@@ -0,0 +1,129 @@
+package delivery
+
+import "testing"
+
+func TestRouterRoute(t *testing.T) {
+	cfg := RoutingCfg{
+		Transports: map[string]*TransportCfg{
+			"gateway": {
+				Type: TransportTypeRelay,
+				Relay: &RelayTransportCfg{
+					Host: "gateway.example.com",
+					Port: 587,
+					TLS:  TLSModeStartTLS,
+				},
+			},
+			"partner": {
+				Type: TransportTypeRelay,
+				Relay: &RelayTransportCfg{
+					Host: "mx.partner.example",
+					Port: 25,
+				},
+			},
+			"local": {
+				Type: TransportTypeLocal,
+			},
+			"direct": {
+				Type: TransportTypeMX,
+			},
+		},
+		Routes: map[string]string{
+			"example.com":            "local",
+			"*.example.com":          "gateway",
+			"*.internal.example.com": "local",
+			"partner.example":        "partner",
+			"public.example":         "direct",
+			"*":                      "gateway",
+		},
+	}
+
+	router := NewRouter(cfg)
+
+	tests := []struct {
+		domain    string
+		transport string
+	}{
+		{"example.com", "local"},
+		{"EXAMPLE.com.", "local"},
+		{"foo.example.com", "gateway"},
+		{"a.b.example.com", "gateway"},
+		{"internal.example.com", "gateway"},
+		{"db.internal.example.com", "local"},
+		{"partner.example", "partner"},
+		{"sub.partner.example", "gateway"},
+		{"public.example", "direct"},
+		{"example.org", "gateway"},
+	}
+
+	for _, test := range tests {
+		route, err := router.Route(test.domain)
+		if err != nil {
+			t.Errorf("cannot route %q: %v", test.domain, err)
+			continue
+		}
+
+		if route.TransportName != test.transport {
+			t.Errorf("%q is routed to %q but should be routed to %q",
+				test.domain, route.TransportName, test.transport)
+		}
+	}
+}
+
+func TestRouterDefaultRoute(t *testing.T) {
+	router := NewRouter(RoutingCfg{})
+
+	route, err := router.Route("example.com")
+	if err != nil {
+		t.Fatalf("cannot route domain: %v", err)
+	}
+
+	if route.Transport.Type != TransportTypeMX {
+		t.Errorf("domain is routed to a %q transport but should be routed "+
+			"to a %q transport", route.Transport.Type, TransportTypeMX)
+	}
+}
+
+func TestRouteRejectionError(t *testing.T) {
+	cfg := RoutingCfg{
+		Transports: map[string]*TransportCfg{
+			"blocked": {
+				Type: TransportTypeReject,
+				Reject: &RejectTransportCfg{
+					Code:    550,
+					Status:  "5.7.27",
+					Message: "domain does not accept mail",
+				},
+			},
+			"default": {
+				Type: TransportTypeReject,
+			},
+		},
+		Routes: map[string]string{
+			"blocked.example": "blocked",
+			"*":               "default",
+		},
+	}
+
+	router := NewRouter(cfg)
+
+	tests := []struct {
+		domain string
+		reply  string
+	}{
+		{"blocked.example", "550 5.7.27 domain does not accept mail"},
+		{"example.com", "554 5.7.1 delivery to this domain is not allowed"},
+	}
+
+	for _, test := range tests {
+		route, err := router.Route(test.domain)
+		if err != nil {
+			t.Errorf("cannot route %q: %v", test.domain, err)
+			continue
+		}
+
+		if reply := route.RejectionError().Error(); reply != test.reply {
+			t.Errorf("%q is rejected with %q instead of %q", test.domain,
+				reply, test.reply)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// JunkMailboxName is the name of the mailbox or folder created for messages
+// identified as spam when there is none.
+const JunkMailboxName = "Junk"
+
+// StoreTransport delivers messages to mailboxes of accounts of the message
+// store.
+type StoreTransport struct {
+	Store *mailstore.Store
+}
+
+func NewStoreTransport(store *mailstore.Store) *StoreTransport {
+	return &StoreTransport{
+		Store: store,
+	}
+}
+
+// Deliver appends a message to a mailbox of a user, INBOX if the mailbox name
+// is empty. Invalid flags are ignored. The quota is the maximum size of the
+// account in bytes; zero means no limit. The reverse-path is nil for the null
+// reverse-path.
+func (t *StoreTransport) Deliver(reversePath *imf.SpecificAddress, recipient imf.SpecificAddress, user string, quota int, mailbox string, flags []string, msg *imf.Message) error {
+	if mailbox == "" {
+		mailbox = mailstore.InboxName
+	}
+
+	data, err := encodeLocalMessage(reversePath, recipient, msg)
+	if err != nil {
+		return err
+	}
+
+	if err := t.CheckQuota(user, quota, len(data)); err != nil {
+		return err
+	}
+
+	account, err := t.Store.Account(user)
+	if err != nil {
+		return err
+	}
+
+	var validFlags []string
+	for _, flag := range flags {
+		if mailstore.IsValidFlag(flag) {
+			validFlags = append(validFlags, flag)
+		}
+	}
+
+	if _, err := account.AppendMessage(mailbox, data, validFlags,
+		time.Time{}); err != nil {
+		if errors.Is(err, mailstore.ErrMailboxNotFound) {
+			return ErrMailboxNotFound
+		}
+
+		return fmt.Errorf("cannot append message: %w", err)
+	}
+
+	return nil
+}
+
+// CheckQuota returns ErrQuotaExceeded if a message of a given size in bytes
+// does not fit in the account of a user. The quota is the maximum size of the
+// account in bytes; zero means no limit.
+func (t *StoreTransport) CheckQuota(user string, quota int, size int) error {
+	if quota == 0 {
+		return nil
+	}
+
+	account, err := t.Store.Account(user)
+	if err != nil {
+		return err
+	}
+
+	if account.Size()+int64(size) > int64(quota) {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// JunkMailbox returns the name of the mailbox used for spam in the account of
+// a user: the mailbox with the \Junk special use attribute (RFC 6154) if
+// there is one, or a mailbox created for this purpose.
+func (t *StoreTransport) JunkMailbox(user string) (string, error) {
+	account, err := t.Store.Account(user)
+	if err != nil {
+		return "", err
+	}
+
+	for _, mb := range account.Mailboxes() {
+		if mb.SpecialUse == mailstore.SpecialUseJunk {
+			return mb.Name, nil
+		}
+	}
+
+	err = account.CreateSpecialUseMailbox(JunkMailboxName,
+		mailstore.SpecialUseJunk)
+	if err != nil && !errors.Is(err, mailstore.ErrMailboxExists) {
+		return "", fmt.Errorf("cannot create mailbox %q: %w",
+			JunkMailboxName, err)
+	}
+
+	return JunkMailboxName, nil
+}
@@ -0,0 +1,104 @@
+package delivery
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/go-log"
+)
+
+func TestStoreTransport(t *testing.T) {
+	store := mailstore.NewStore(mailstore.Cfg{
+		Log:  log.DefaultLogger("test"),
+		Path: t.TempDir(),
+	})
+	defer store.Close()
+
+	transport := NewStoreTransport(store)
+
+	msgData := "From: alice@example.org\r\n" +
+		"To: bob@example.com\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"Hello Bob.\r\n"
+
+	msg, err := imf.NewMessageDecoder().DecodeAll([]byte(msgData))
+	if err != nil {
+		t.Fatalf("cannot decode message: %v", err)
+	}
+
+	alice := imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+	bob := imf.SpecificAddress{LocalPart: "bob", Domain: "example.com"}
+
+	user := "bob@example.com"
+
+	if err := transport.Deliver(&alice, bob, user, 0, "", nil, msg); err != nil {
+		t.Fatalf("cannot deliver message: %v", err)
+	}
+
+	account, err := store.Account(user)
+	if err != nil {
+		t.Fatalf("cannot open account: %v", err)
+	}
+
+	size := int(account.Size())
+
+	err = transport.Deliver(&alice, bob, user, size+10, "", nil, msg)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("delivery should have failed with %q but returned %v",
+			ErrQuotaExceeded, err)
+	}
+
+	if err := transport.Deliver(&alice, bob, user, size*2, "", nil, msg); err != nil {
+		t.Fatalf("cannot deliver message: %v", err)
+	}
+
+	msgs, err := account.Messages(mailstore.InboxName)
+	if err != nil {
+		t.Fatalf("cannot list messages: %v", err)
+	}
+
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages were delivered instead of 2", len(msgs))
+	}
+
+	data, err := account.MessageData(mailstore.InboxName, msgs[0].UID)
+	if err != nil {
+		t.Fatalf("cannot read message: %v", err)
+	}
+
+	expectedPrefix := "Return-Path: <alice@example.org>\r\n" +
+		"Delivered-To: bob@example.com\r\n"
+
+	if len(data) < len(expectedPrefix) ||
+		string(data[:len(expectedPrefix)]) != expectedPrefix {
+		t.Errorf("invalid message data:\n%s", data)
+	}
+
+	junk, err := transport.JunkMailbox(user)
+	if err != nil {
+		t.Fatalf("cannot find junk mailbox: %v", err)
+	}
+
+	flags := []string{`\Seen`, "$Junk", "(invalid)"}
+
+	if err := transport.Deliver(&alice, bob, user, 0, junk, flags, msg); err != nil {
+		t.Fatalf("cannot deliver message: %v", err)
+	}
+
+	info, err := account.Mailbox(junk)
+	if err != nil {
+		t.Fatalf("cannot find mailbox %q: %v", junk, err)
+	}
+
+	if info.SpecialUse != mailstore.SpecialUseJunk || info.NbMessages != 1 ||
+		info.NbUnseen != 0 {
+		t.Errorf("invalid junk mailbox %#v", info)
+	}
+
+	if junk2, _ := transport.JunkMailbox(user); junk2 != junk {
+		t.Errorf("junk mailbox changed from %q to %q", junk, junk2)
+	}
+}
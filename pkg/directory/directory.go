@@ -0,0 +1,508 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/go-ejson"
+	"go.n16f.net/eyaml"
+)
+
+// The directory contains the domains hosted by the server and their
+// addresses. Each address of a domain is either:
+//
+//   - a user, i.e. an account with a password and a mailbox in the message
+//     store, identified by its full address;
+//   - an alias, i.e. another address receiving messages sent to the alias;
+//   - a distribution list, i.e. a set of addresses receiving messages sent to
+//     the list.
+//
+// Aliases and lists can refer to other aliases and lists, including in other
+// hosted domains, and to addresses outside hosted domains. Local parts are
+// case-insensitive.
+
+const (
+	DefaultRecipientDelimiter = "+"
+
+	// The maximum depth of alias and list expansion
+	MaxExpansionDepth = 10
+)
+
+var ErrRecipientNotFound = errors.New("recipient not found")
+
+type Cfg struct {
+	// The path of a YAML file containing the directory, read again when the
+	// server is reloaded. Domains must be empty when it is set.
+	Path string `json:"path,omitempty"`
+
+	// The separator between the user and the detail of local parts (RFC
+	// 5233), e.g. "+" for "alice+lists@example.com".
+	RecipientDelimiter string `json:"recipient_delimiter,omitempty"`
+
+	// Disable plus addressing: local parts containing the recipient
+	// delimiter must then match an address exactly.
+	DisablePlusAddressing bool `json:"disable_plus_addressing,omitempty"`
+
+	Domains map[string]*DomainCfg `json:"domains,omitempty"`
+}
+
+type DomainCfg struct {
+	// Users, aliases and lists are indexed by local part
+	Users   map[string]*UserCfg `json:"users,omitempty"`
+	Aliases map[string]string   `json:"aliases,omitempty"`
+	Lists   map[string]*ListCfg `json:"lists,omitempty"`
+
+	// The address receiving messages sent to unknown addresses of the domain
+	CatchAll string `json:"catch_all,omitempty"`
+}
+
+type UserCfg struct {
+	Password string `json:"password"` // SHA-512 crypt hash
+
+	// The maximum size of the account in the message store (bytes); zero
+	// for no limit.
+	Quota int `json:"quota,omitempty"`
+}
+
+type ListCfg struct {
+	Members []string `json:"members"`
+}
+
+func (cfg *Cfg) ValidateJSON(v *ejson.Validator) {
+	if cfg.Path != "" {
+		v.Check("domains", len(cfg.Domains) == 0, "unexpected_domains",
+			"domains cannot be set when the directory is loaded from a file")
+	}
+
+	v.WithChild("domains", func() {
+		for name, dcfg := range cfg.Domains {
+			v.CheckObject(name, dcfg)
+		}
+	})
+}
+
+func (cfg *DomainCfg) ValidateJSON(v *ejson.Validator) {
+	v.WithChild("users", func() {
+		for localPart, ucfg := range cfg.Users {
+			v.CheckObject(localPart, ucfg)
+		}
+	})
+
+	v.WithChild("aliases", func() {
+		for localPart, addr := range cfg.Aliases {
+			v.CheckStringNotEmpty(localPart, addr)
+		}
+	})
+
+	v.WithChild("lists", func() {
+		for localPart, lcfg := range cfg.Lists {
+			v.CheckObject(localPart, lcfg)
+		}
+	})
+}
+
+func (cfg *UserCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("password", cfg.Password)
+	v.CheckIntMin("quota", cfg.Quota, 0)
+}
+
+func (cfg *ListCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckArrayNotEmpty("members", cfg.Members)
+}
+
+type User struct {
+	Name         string // full address, in lower case
+	PasswordHash string
+	Quota        int
+}
+
+type domain struct {
+	users    map[string]*User
+	aliases  map[string]imf.SpecificAddress
+	lists    map[string][]imf.SpecificAddress
+	catchAll *imf.SpecificAddress
+}
+
+type Directory struct {
+	Cfg Cfg
+
+	domains   map[string]*domain
+	passwords sasl.PasswordTable
+}
+
+// Recipients is the result of the expansion of an address.
+type Recipients struct {
+	Users []*User
+
+	// Addresses outside hosted domains
+	Addresses []imf.SpecificAddress
+}
+
+// Load creates a directory, reading the directory file if there is one.
+func Load(cfg Cfg) (*Directory, error) {
+	if cfg.Path != "" {
+		data, err := os.ReadFile(cfg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %q: %w", cfg.Path, err)
+		}
+
+		var fileCfg Cfg
+		if err := eyaml.Load(data, &fileCfg); err != nil {
+			return nil, fmt.Errorf("cannot load %q: %w", cfg.Path, err)
+		}
+
+		if fileCfg.Path != "" {
+			return nil, fmt.Errorf("invalid path in %q", cfg.Path)
+		}
+
+		if fileCfg.RecipientDelimiter == "" {
+			fileCfg.RecipientDelimiter = cfg.RecipientDelimiter
+		}
+
+		fileCfg.DisablePlusAddressing = fileCfg.DisablePlusAddressing ||
+			cfg.DisablePlusAddressing
+
+		fileCfg.Path = cfg.Path
+		cfg = fileCfg
+	}
+
+	if cfg.RecipientDelimiter == "" {
+		cfg.RecipientDelimiter = DefaultRecipientDelimiter
+	}
+
+	d := Directory{
+		Cfg: cfg,
+
+		domains:   make(map[string]*domain),
+		passwords: make(sasl.PasswordTable),
+	}
+
+	for name, dcfg := range cfg.Domains {
+		if err := d.addDomain(name, dcfg); err != nil {
+			return nil, fmt.Errorf("invalid domain %q: %w", name, err)
+		}
+	}
+
+	// Expanding every address makes sure that all local targets exist, that
+	// no expansion is deeper than the limit and that loops do not result in
+	// addresses without any recipient.
+	for _, addr := range d.addresses() {
+		if err := d.checkAddress(addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+	}
+
+	for name, dom := range d.domains {
+		if dom.catchAll == nil {
+			continue
+		}
+
+		if err := d.checkAddress(*dom.catchAll); err != nil {
+			return nil, fmt.Errorf("invalid catch-all address of domain %q: "+
+				"%w", name, err)
+		}
+	}
+
+	return &d, nil
+}
+
+func (d *Directory) checkAddress(addr imf.SpecificAddress) error {
+	rs, err := d.Resolve(addr)
+	if err != nil {
+		return err
+	}
+
+	if len(rs.Users) == 0 && len(rs.Addresses) == 0 {
+		return fmt.Errorf("expansion loop")
+	}
+
+	return nil
+}
+
+func (d *Directory) addDomain(name string, cfg *DomainCfg) error {
+	name = strings.ToLower(name)
+
+	dom := domain{
+		users:   make(map[string]*User),
+		aliases: make(map[string]imf.SpecificAddress),
+		lists:   make(map[string][]imf.SpecificAddress),
+	}
+
+	checkLocalPart := func(localPart string) (string, error) {
+		key := strings.ToLower(localPart)
+
+		if key == "" {
+			return "", fmt.Errorf("empty local part")
+		}
+
+		_, isUser := dom.users[key]
+		_, isAlias := dom.aliases[key]
+		_, isList := dom.lists[key]
+
+		if isUser || isAlias || isList {
+			return "", fmt.Errorf("duplicate local part %q", localPart)
+		}
+
+		return key, nil
+	}
+
+	for localPart, ucfg := range cfg.Users {
+		key, err := checkLocalPart(localPart)
+		if err != nil {
+			return err
+		}
+
+		user := User{
+			Name:         key + "@" + name,
+			PasswordHash: ucfg.Password,
+			Quota:        ucfg.Quota,
+		}
+
+		dom.users[key] = &user
+		d.passwords[user.Name] = user.PasswordHash
+	}
+
+	for localPart, target := range cfg.Aliases {
+		key, err := checkLocalPart(localPart)
+		if err != nil {
+			return err
+		}
+
+		addr, err := parseAddress(target)
+		if err != nil {
+			return fmt.Errorf("invalid target of alias %q: %w", localPart, err)
+		}
+
+		dom.aliases[key] = *addr
+	}
+
+	for localPart, lcfg := range cfg.Lists {
+		key, err := checkLocalPart(localPart)
+		if err != nil {
+			return err
+		}
+
+		members := make([]imf.SpecificAddress, len(lcfg.Members))
+
+		for i, member := range lcfg.Members {
+			addr, err := parseAddress(member)
+			if err != nil {
+				return fmt.Errorf("invalid member of list %q: %w", localPart,
+					err)
+			}
+
+			members[i] = *addr
+		}
+
+		dom.lists[key] = members
+	}
+
+	if cfg.CatchAll != "" {
+		addr, err := parseAddress(cfg.CatchAll)
+		if err != nil {
+			return fmt.Errorf("invalid catch-all address: %w", err)
+		}
+
+		dom.catchAll = addr
+	}
+
+	d.domains[name] = &dom
+
+	return nil
+}
+
+// addresses returns all addresses defined in the directory.
+func (d *Directory) addresses() []imf.SpecificAddress {
+	var addrs []imf.SpecificAddress
+
+	for name, dom := range d.domains {
+		var localParts []string
+
+		for localPart := range dom.users {
+			localParts = append(localParts, localPart)
+		}
+
+		for localPart := range dom.aliases {
+			localParts = append(localParts, localPart)
+		}
+
+		for localPart := range dom.lists {
+			localParts = append(localParts, localPart)
+		}
+
+		sort.Strings(localParts)
+
+		for _, localPart := range localParts {
+			addrs = append(addrs, imf.SpecificAddress{
+				LocalPart: localPart,
+				Domain:    imf.Domain(name),
+			})
+		}
+	}
+
+	return addrs
+}
+
+func (d *Directory) HasDomain(name string) bool {
+	_, found := d.domains[strings.ToLower(name)]
+	return found
+}
+
+// User returns the user identified by a full address, or nil if there is no
+// such user.
+func (d *Directory) User(name string) *User {
+	localPart, domainName, found := strings.Cut(name, "@")
+	if !found {
+		return nil
+	}
+
+	dom := d.domains[strings.ToLower(domainName)]
+	if dom == nil {
+		return nil
+	}
+
+	return dom.users[strings.ToLower(localPart)]
+}
+
+// UserAddresses returns the addresses of a user: its own address and the
+// aliases and lists of hosted domains which only designate this user.
+func (d *Directory) UserAddresses(name string) []imf.SpecificAddress {
+	user := d.User(name)
+	if user == nil {
+		return nil
+	}
+
+	var addrs []imf.SpecificAddress
+
+	for _, addr := range d.addresses() {
+		rs, err := d.Resolve(addr)
+		if err != nil {
+			continue
+		}
+
+		if len(rs.Users) == 1 && rs.Users[0] == user &&
+			len(rs.Addresses) == 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// Authenticate implements sasl.Authenticator for directory users. User names
+// are full addresses in lower case: the user name identifies the account in
+// the message store, so it must not have several spellings.
+func (d *Directory) Authenticate(username, password string) error {
+	return d.passwords.Authenticate(username, password)
+}
+
+// Resolve expands an address to the users and external addresses it
+// designates. ErrRecipientNotFound is returned for addresses of hosted
+// domains which do not exist. Addresses outside hosted domains are returned
+// as they are.
+func (d *Directory) Resolve(addr imf.SpecificAddress) (*Recipients, error) {
+	var rs Recipients
+
+	seen := make(map[string]bool)
+
+	if err := d.resolve(addr, &rs, seen, 0); err != nil {
+		return nil, err
+	}
+
+	return &rs, nil
+}
+
+func (d *Directory) resolve(addr imf.SpecificAddress, rs *Recipients, seen map[string]bool, depth int) error {
+	if depth > MaxExpansionDepth {
+		return fmt.Errorf("expansion of %q too deep", addr)
+	}
+
+	dom := d.domains[strings.ToLower(string(addr.Domain))]
+	if dom == nil {
+		key := strings.ToLower(addr.String())
+		if !seen[key] {
+			seen[key] = true
+			rs.Addresses = append(rs.Addresses, addr)
+		}
+
+		return nil
+	}
+
+	localPart := strings.ToLower(addr.LocalPart)
+
+	found := dom.has(localPart)
+
+	// RFC 5233 Sieve Email Filtering: Subaddress Extension. The detail part
+	// is only ignored if the full local part does not exist.
+	if !found && !d.Cfg.DisablePlusAddressing {
+		if user, _, cut := strings.Cut(localPart,
+			d.Cfg.RecipientDelimiter); cut && user != "" {
+			if dom.has(user) {
+				localPart = user
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		if dom.catchAll == nil {
+			return fmt.Errorf("%w: %s", ErrRecipientNotFound, addr)
+		}
+
+		return d.resolve(*dom.catchAll, rs, seen, depth+1)
+	}
+
+	// Lists can contain each other, and an address can be reached through
+	// several aliases and lists: each address is only expanded once.
+	key := localPart + "@" + strings.ToLower(string(addr.Domain))
+	if seen[key] {
+		return nil
+	}
+
+	seen[key] = true
+
+	if user := dom.users[localPart]; user != nil {
+		rs.Users = append(rs.Users, user)
+		return nil
+	}
+
+	if target, found := dom.aliases[localPart]; found {
+		return d.resolve(target, rs, seen, depth+1)
+	}
+
+	for _, member := range dom.lists[localPart] {
+		if err := d.resolve(member, rs, seen, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (dom *domain) has(localPart string) bool {
+	_, isUser := dom.users[localPart]
+	_, isAlias := dom.aliases[localPart]
+	_, isList := dom.lists[localPart]
+
+	return isUser || isAlias || isList
+}
+
+func parseAddress(s string) (*imf.SpecificAddress, error) {
+	d := imf.NewDataDecoder([]byte(s))
+
+	spec, err := d.ReadSpecificAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Empty() {
+		return nil, fmt.Errorf("invalid trailing data")
+	}
+
+	return spec, nil
+}
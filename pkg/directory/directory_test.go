@@ -0,0 +1,248 @@
+package directory
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/sasl"
+)
+
+func testDirectoryCfg(t *testing.T) Cfg {
+	hash, err := sasl.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	return Cfg{
+		Domains: map[string]*DomainCfg{
+			"Example.com": {
+				Users: map[string]*UserCfg{
+					"alice":     {Password: hash, Quota: 1000},
+					"Bob":       {Password: hash},
+					"bob+admin": {Password: hash},
+				},
+				Aliases: map[string]string{
+					"postmaster": "alice@example.com",
+					"webmaster":  "postmaster@example.com",
+				},
+				Lists: map[string]*ListCfg{
+					"team": {
+						Members: []string{
+							"alice@example.com",
+							"bob@example.com",
+							"staff@example.com",
+							"carol@example.net",
+						},
+					},
+					"staff": {
+						Members: []string{
+							"team@example.com",
+							"webmaster@example.com",
+							"dave@example.net",
+						},
+					},
+				},
+			},
+			"example.org": {
+				Aliases: map[string]string{
+					"eve": "bob@example.com",
+				},
+				CatchAll: "alice@example.com",
+			},
+		},
+	}
+}
+
+func resolveTestAddress(t *testing.T, d *Directory, s string) ([]string, error) {
+	addr, err := parseAddress(s)
+	if err != nil {
+		t.Fatalf("cannot parse address %q: %v", s, err)
+	}
+
+	rs, err := d.Resolve(*addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, user := range rs.Users {
+		names = append(names, user.Name)
+	}
+
+	for _, addr := range rs.Addresses {
+		names = append(names, addr.String())
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func TestDirectoryResolve(t *testing.T) {
+	d, err := Load(testDirectoryCfg(t))
+	if err != nil {
+		t.Fatalf("cannot load directory: %v", err)
+	}
+
+	tests := []struct {
+		addr  string
+		names []string
+	}{
+		{"alice@example.com", []string{"alice@example.com"}},
+		{"ALICE@EXAMPLE.COM", []string{"alice@example.com"}},
+		{"alice+lists@example.com", []string{"alice@example.com"}},
+		{"bob@example.com", []string{"bob@example.com"}},
+		{"bob+admin@example.com", []string{"bob+admin@example.com"}},
+		{"bob+other@example.com", []string{"bob@example.com"}},
+		{"webmaster@example.com", []string{"alice@example.com"}},
+		{"webmaster+x@example.com", []string{"alice@example.com"}},
+		{"team@example.com", []string{"alice@example.com",
+			"bob@example.com", "carol@example.net", "dave@example.net"}},
+		{"eve@example.org", []string{"bob@example.com"}},
+		{"unknown@example.org", []string{"alice@example.com"}},
+		{"frank@example.net", []string{"frank@example.net"}},
+	}
+
+	for _, test := range tests {
+		names, err := resolveTestAddress(t, d, test.addr)
+		if err != nil {
+			t.Errorf("cannot resolve %q: %v", test.addr, err)
+			continue
+		}
+
+		if strings.Join(names, ",") != strings.Join(test.names, ",") {
+			t.Errorf("%q resolved to %v instead of %v", test.addr, names,
+				test.names)
+		}
+	}
+
+	for _, addr := range []string{"carol@example.com", "+x@example.com"} {
+		if _, err := resolveTestAddress(t, d, addr); !errors.Is(err,
+			ErrRecipientNotFound) {
+			t.Errorf("resolving %q should have failed with %q but returned %v",
+				addr, ErrRecipientNotFound, err)
+		}
+	}
+
+	d.Cfg.DisablePlusAddressing = true
+
+	if _, err := resolveTestAddress(t, d, "alice+lists@example.com"); !errors.Is(
+		err, ErrRecipientNotFound) {
+		t.Errorf("plus addressing should have been disabled")
+	}
+}
+
+func TestDirectoryUsers(t *testing.T) {
+	d, err := Load(testDirectoryCfg(t))
+	if err != nil {
+		t.Fatalf("cannot load directory: %v", err)
+	}
+
+	if !d.HasDomain("EXAMPLE.com") || d.HasDomain("example.net") {
+		t.Errorf("invalid hosted domains")
+	}
+
+	user := d.User("Alice@example.com")
+	if user == nil {
+		t.Fatalf("user not found")
+	}
+
+	if user.Name != "alice@example.com" || user.Quota != 1000 {
+		t.Errorf("invalid user %#v", user)
+	}
+
+	if d.User("postmaster@example.com") != nil {
+		t.Errorf("aliases should not be users")
+	}
+
+	var addrs []string
+	for _, addr := range d.UserAddresses("alice@example.com") {
+		addrs = append(addrs, addr.String())
+	}
+
+	sort.Strings(addrs)
+
+	expectedAddrs := []string{"alice@example.com", "postmaster@example.com",
+		"webmaster@example.com"}
+	if strings.Join(addrs, ",") != strings.Join(expectedAddrs, ",") {
+		t.Errorf("user addresses are %v instead of %v", addrs, expectedAddrs)
+	}
+
+	if err := d.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Errorf("cannot authenticate: %v", err)
+	}
+
+	if err := d.Authenticate("alice@example.com", "foo"); !errors.Is(err,
+		sasl.ErrAuthenticationFailed) {
+		t.Errorf("authentication should have failed but returned %v", err)
+	}
+}
+
+func TestDirectoryInvalid(t *testing.T) {
+	tests := map[string]*DomainCfg{
+		"unknown alias target": {
+			Aliases: map[string]string{"a": "b@example.com"},
+		},
+		"invalid alias target": {
+			Aliases: map[string]string{"a": "foo"},
+		},
+		"duplicate local part": {
+			Users:   map[string]*UserCfg{"a": {Password: "x"}},
+			Aliases: map[string]string{"A": "a@example.com"},
+		},
+		"unknown catch-all target": {
+			CatchAll: "b@example.com",
+		},
+		"alias loop": {
+			Aliases: map[string]string{
+				"a": "b@example.com",
+				"b": "c@example.com",
+				"c": "a@example.com",
+			},
+		},
+	}
+
+	for label, dcfg := range tests {
+		cfg := Cfg{Domains: map[string]*DomainCfg{"example.com": dcfg}}
+
+		if _, err := Load(cfg); err == nil {
+			t.Errorf("%s: loading should have failed", label)
+		}
+	}
+}
+
+func TestDirectoryFile(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "directory.yaml")
+
+	data := `domains:
+  example.com:
+    users:
+      alice:
+        password: "x"
+    aliases:
+      abuse: "alice@example.com"
+`
+
+	if err := os.WriteFile(filePath, []byte(data), 0600); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+
+	d, err := Load(Cfg{Path: filePath})
+	if err != nil {
+		t.Fatalf("cannot load directory: %v", err)
+	}
+
+	names, err := resolveTestAddress(t, d, "abuse@example.com")
+	if err != nil {
+		t.Fatalf("cannot resolve address: %v", err)
+	}
+
+	if len(names) != 1 || names[0] != "alice@example.com" {
+		t.Errorf("invalid expansion %v", names)
+	}
+}
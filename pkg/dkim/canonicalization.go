@@ -0,0 +1,202 @@
+package dkim
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+// RFC 6376 3.4. Canonicalization
+
+type Canonicalization string
+
+const (
+	CanonicalizationSimple  Canonicalization = "simple"
+	CanonicalizationRelaxed Canonicalization = "relaxed"
+)
+
+var CanonicalizationValues = []Canonicalization{
+	CanonicalizationSimple,
+	CanonicalizationRelaxed,
+}
+
+func ParseCanonicalizations(s string) (Canonicalization, Canonicalization, error) {
+	// RFC 6376 3.5. If only one algorithm is named, it is used for the header
+	// and "simple" is used for the body.
+
+	header, body, found := strings.Cut(s, "/")
+	if !found {
+		body = string(CanonicalizationSimple)
+	}
+
+	headerCanon := Canonicalization(strings.ToLower(header))
+	if err := headerCanon.validate(); err != nil {
+		return "", "", err
+	}
+
+	bodyCanon := Canonicalization(strings.ToLower(body))
+	if err := bodyCanon.validate(); err != nil {
+		return "", "", err
+	}
+
+	return headerCanon, bodyCanon, nil
+}
+
+func (c Canonicalization) validate() error {
+	switch c {
+	case CanonicalizationSimple, CanonicalizationRelaxed:
+		return nil
+	}
+
+	return fmt.Errorf("unknown canonicalization algorithm %q", string(c))
+}
+
+// FieldRaw returns the raw representation of a field without the final EOL
+// sequence. Fields read from a message keep their original representation,
+// including folding; fields created locally are encoded.
+func FieldRaw(field *imf.Field) (string, error) {
+	if field.Raw != "" {
+		return field.Raw, nil
+	}
+
+	e := imf.NewDataEncoder(imf.MaxLineLength)
+	if err := e.WriteField(field); err != nil {
+		return "", fmt.Errorf("cannot encode field %q: %w", field.Name, err)
+	}
+
+	return strings.TrimSuffix(string(e.Bytes()), "\r\n"), nil
+}
+
+// CanonicalizeHeaderField returns the canonical representation of a raw
+// header field, including the final CRLF sequence.
+func CanonicalizeHeaderField(raw string, c Canonicalization) string {
+	switch c {
+	case CanonicalizationRelaxed:
+		// RFC 6376 3.4.2. The "relaxed" Header Canonicalization Algorithm
+		name, value, _ := strings.Cut(raw, ":")
+
+		name = strings.ToLower(strings.TrimRight(name, " \t"))
+
+		value = strings.ReplaceAll(value, "\r\n", "")
+		value = strings.ReplaceAll(value, "\n", "")
+		value = string(compressWSP([]byte(value)))
+		value = strings.Trim(value, " ")
+
+		return name + ":" + value + "\r\n"
+
+	default:
+		// RFC 6376 3.4.1. The "simple" Header Canonicalization Algorithm
+		return raw + "\r\n"
+	}
+}
+
+// CanonicalizeBody returns the canonical representation of a message body.
+func CanonicalizeBody(body []byte, c Canonicalization) []byte {
+	var buf bytes.Buffer
+
+	lines := splitLines(body)
+
+	if c == CanonicalizationRelaxed {
+		// RFC 6376 3.4.4. The "relaxed" Body Canonicalization Algorithm
+		for i, line := range lines {
+			line = compressWSP(line)
+			lines[i] = bytes.TrimRight(line, " ")
+		}
+	}
+
+	// Both algorithms ignore empty lines at the end of the body
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+
+	// RFC 6376 3.4.3. The "simple" Body Canonicalization Algorithm. An empty
+	// body is canonicalized as a single CRLF sequence with the simple
+	// algorithm, and as an empty string with the relaxed one.
+	if buf.Len() == 0 && c == CanonicalizationSimple {
+		buf.WriteString("\r\n")
+	}
+
+	return buf.Bytes()
+}
+
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+
+	for len(data) > 0 {
+		eol := bytes.IndexByte(data, '\n')
+		if eol == -1 {
+			lines = append(lines, data)
+			break
+		}
+
+		line := data[:eol]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+
+		lines = append(lines, line)
+		data = data[eol+1:]
+	}
+
+	return lines
+}
+
+func compressWSP(data []byte) []byte {
+	buf := make([]byte, 0, len(data))
+
+	inWSP := false
+	for _, c := range data {
+		if c == ' ' || c == '\t' {
+			if !inWSP {
+				buf = append(buf, ' ')
+			}
+
+			inWSP = true
+			continue
+		}
+
+		buf = append(buf, c)
+		inWSP = false
+	}
+
+	return buf
+}
+
+// SelectHeaderFields returns the raw representation of the fields listed in
+// names. RFC 6376 5.4.2. When a field name appears multiple times, instances
+// are selected from the bottom of the header to the top. Names which do not
+// match any remaining field are ignored.
+func SelectHeaderFields(header []*imf.Field, names []string) ([]string, error) {
+	used := make(map[*imf.Field]bool)
+
+	var fields []string
+
+	for _, name := range names {
+		for i := len(header) - 1; i >= 0; i-- {
+			field := header[i]
+
+			if used[field] || !strings.EqualFold(field.Name, name) {
+				continue
+			}
+
+			raw, err := FieldRaw(field)
+			if err != nil {
+				return nil, err
+			}
+
+			fields = append(fields, raw)
+			used[field] = true
+
+			break
+		}
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,202 @@
+package dkim
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+func TestCanonicalization(t *testing.T) {
+	// RFC 6376 3.4.6. Canonicalization Examples
+	header := []string{
+		"A: X",
+		"B : Y\t\r\n\tZ  ",
+	}
+
+	body := []byte(" C \r\nD \t E\r\n\r\n\r\n")
+
+	tests := []struct {
+		c      Canonicalization
+		header string
+		body   string
+	}{
+		{
+			CanonicalizationRelaxed,
+			"a:X\r\nb:Y Z\r\n",
+			" C\r\nD E\r\n",
+		},
+		{
+			CanonicalizationSimple,
+			"A: X\r\nB : Y\t\r\n\tZ  \r\n",
+			" C \r\nD \t E\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		var buf strings.Builder
+		for _, field := range header {
+			buf.WriteString(CanonicalizeHeaderField(field, test.c))
+		}
+
+		if s := buf.String(); s != test.header {
+			t.Errorf("%s: header is canonicalized to %q but should be "+
+				"canonicalized to %q", test.c, s, test.header)
+		}
+
+		if s := string(CanonicalizeBody(body, test.c)); s != test.body {
+			t.Errorf("%s: body is canonicalized to %q but should be "+
+				"canonicalized to %q", test.c, s, test.body)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	msgData := "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.net\r\n" +
+		"Subject:   hello\r\n" +
+		"  world\r\n" +
+		"\r\n" +
+		"Hello Bob.\r\n"
+
+	for _, c := range CanonicalizationValues {
+		msg, err := imf.NewMessageDecoder().DecodeAll([]byte(msgData))
+		if err != nil {
+			t.Fatalf("cannot decode message: %v", err)
+		}
+
+		sd := SigningDomain{
+			Domain:       "example.com",
+			Selector:     "test",
+			Key:          &PrivateKey{AlgorithmEd25519SHA256, privateKey},
+			HeaderCanon:  c,
+			BodyCanon:    c,
+			SignedFields: DefaultSignedFields,
+		}
+
+		field, err := sd.Sign(msg, time.Now())
+		if err != nil {
+			t.Fatalf("%s: cannot sign message: %v", c, err)
+		}
+
+		tags, err := ParseTagList(string(*field.Value.(*imf.OptionalFieldValue)))
+		if err != nil {
+			t.Fatalf("%s: cannot parse signature tags: %v", c, err)
+		}
+
+		h, _ := tags.Value("h")
+		if h != "from:subject:to" {
+			t.Errorf("%s: signed fields are %q", c, h)
+		}
+
+		bh, _ := tags.Value("bh")
+		ebh := base64.StdEncoding.EncodeToString(
+			hashData(CanonicalizeBody(msg.Body, c)))
+		if bh != ebh {
+			t.Errorf("%s: body hash is %q but should be %q", c, bh, ebh)
+		}
+
+		b, _ := tags.Value("b")
+		signature, err := base64.StdEncoding.DecodeString(RemoveWhitespace(b))
+		if err != nil {
+			t.Fatalf("%s: invalid signature: %v", c, err)
+		}
+
+		fields, err := SelectHeaderFields(msg.Header, strings.Split(h, ":"))
+		if err != nil {
+			t.Fatalf("%s: cannot select fields: %v", c, err)
+		}
+
+		digest := HeaderHash(fields, StripTagValue(field.Raw, "b"), c)
+		if !ed25519.Verify(publicKey, digest, signature) {
+			t.Errorf("%s: invalid signature", c)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	resolver := dns.NewFakeResolver()
+	resolver.TXT["test._domainkey.example.com"] = []string{
+		"v=DKIM1; k=ed25519; p=" +
+			base64.StdEncoding.EncodeToString(publicKey),
+	}
+	resolver.TempErrors["broken._domainkey.example.com"] = true
+
+	verifier := NewVerifier(resolver)
+
+	msgData := "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.net\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"Hello Bob.\r\n"
+
+	tests := []struct {
+		selector string
+		modify   func(*imf.Message)
+		status   Status
+	}{
+		{"test", nil, StatusPass},
+		{"test", func(msg *imf.Message) {
+			msg.Body = append(msg.Body, "Extra line.\r\n"...)
+		}, StatusFail},
+		{"test", func(msg *imf.Message) {
+			msg.Header[2].Raw = "Subject: goodbye"
+		}, StatusFail},
+		{"unknown", nil, StatusPermError},
+		{"broken", nil, StatusTempError},
+	}
+
+	for _, test := range tests {
+		msg, err := imf.NewMessageDecoder().DecodeAll([]byte(msgData))
+		if err != nil {
+			t.Fatalf("cannot decode message: %v", err)
+		}
+
+		sd := SigningDomain{
+			Domain:       "example.com",
+			Selector:     test.selector,
+			Key:          &PrivateKey{AlgorithmEd25519SHA256, privateKey},
+			HeaderCanon:  CanonicalizationRelaxed,
+			BodyCanon:    CanonicalizationSimple,
+			SignedFields: DefaultSignedFields,
+		}
+
+		field, err := sd.Sign(msg, time.Now())
+		if err != nil {
+			t.Fatalf("cannot sign message: %v", err)
+		}
+
+		msg.Header = append([]*imf.Field{field}, msg.Header...)
+
+		if test.modify != nil {
+			test.modify(msg)
+		}
+
+		results := verifier.Verify(context.Background(), msg)
+		if len(results) != 1 {
+			t.Errorf("%d results returned instead of one", len(results))
+			continue
+		}
+
+		if results[0].Status != test.status {
+			t.Errorf("verification returned %v but should have returned %q",
+				results[0], test.status)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+type Algorithm string
+
+const (
+	AlgorithmRSASHA256     Algorithm = "rsa-sha256"
+	AlgorithmEd25519SHA256 Algorithm = "ed25519-sha256" // RFC 8463
+)
+
+type PrivateKey struct {
+	Algorithm Algorithm
+	Signer    crypto.Signer
+}
+
+func LoadPrivateKey(filePath string) (*PrivateKey, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	return ParsePrivateKey(data)
+}
+
+func ParsePrivateKey(data []byte) (*PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block found")
+	}
+
+	var key any
+	var err error
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported pem block type %q", block.Type)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		// RFC 8301 3.2. Signers must use keys of at least 1024 bits.
+		if k.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("rsa key is too small (%d bits)",
+				k.N.BitLen())
+		}
+
+		return &PrivateKey{Algorithm: AlgorithmRSASHA256, Signer: k}, nil
+
+	case ed25519.PrivateKey:
+		return &PrivateKey{Algorithm: AlgorithmEd25519SHA256, Signer: k}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// Sign signs a SHA-256 digest. For Ed25519, RFC 8463 3. specifies that the
+// digest itself is signed with PureEdDSA.
+func (k *PrivateKey) Sign(digest []byte) ([]byte, error) {
+	switch k.Algorithm {
+	case AlgorithmRSASHA256:
+		return k.Signer.Sign(rand.Reader, digest, crypto.SHA256)
+	case AlgorithmEd25519SHA256:
+		return k.Signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+}
+
+// SignatureLength returns the length of the base64 representation of
+// signatures generated with the key.
+func (k *PrivateKey) SignatureLength() int {
+	var size int
+
+	switch k.Algorithm {
+	case AlgorithmRSASHA256:
+		size = k.Signer.(*rsa.PrivateKey).Size()
+	case AlgorithmEd25519SHA256:
+		size = ed25519.SignatureSize
+	}
+
+	return base64.StdEncoding.EncodedLen(size)
+}
+
+func hashData(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
@@ -0,0 +1,307 @@
+package dkim
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-ejson"
+)
+
+var ErrNoSigningDomain = errors.New("no signing domain")
+
+// The default list of signed fields, see RFC 6376 5.4.1. Fields which are
+// not present in the message are not signed, with the exception of From
+// which is mandatory.
+var DefaultSignedFields = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Id", "List-Unsubscribe",
+}
+
+type SignerCfg struct {
+	Domains map[string]*SigningDomainCfg `json:"domains"`
+}
+
+type SigningDomainCfg struct {
+	Selector         string   `json:"selector"`
+	PrivateKeyPath   string   `json:"private_key_path"`
+	Canonicalization string   `json:"canonicalization,omitempty"`
+	SignedFields     []string `json:"signed_fields,omitempty"`
+	Expiration       int      `json:"expiration,omitempty"` // seconds
+}
+
+func (cfg *SignerCfg) ValidateJSON(v *ejson.Validator) {
+	v.WithChild("domains", func() {
+		for domain, dcfg := range cfg.Domains {
+			v.CheckObject(domain, dcfg)
+		}
+	})
+}
+
+func (cfg *SigningDomainCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("selector", cfg.Selector)
+	v.CheckStringNotEmpty("private_key_path", cfg.PrivateKeyPath)
+
+	if cfg.Canonicalization != "" {
+		_, _, err := ParseCanonicalizations(cfg.Canonicalization)
+		v.Check("canonicalization", err == nil, "invalid_canonicalization",
+			"invalid canonicalization: %v", err)
+	}
+
+	v.CheckIntMin("expiration", cfg.Expiration, 0)
+}
+
+type SigningDomain struct {
+	Domain          string
+	Selector        string
+	Key             *PrivateKey
+	HeaderCanon     Canonicalization
+	BodyCanon       Canonicalization
+	SignedFields    []string
+	ExpirationDelay time.Duration
+}
+
+type Signer struct {
+	Cfg SignerCfg
+
+	domains map[string]*SigningDomain
+}
+
+func NewSigner(cfg SignerCfg) (*Signer, error) {
+	s := Signer{
+		Cfg: cfg,
+
+		domains: make(map[string]*SigningDomain),
+	}
+
+	for domain, dcfg := range cfg.Domains {
+		key, err := LoadPrivateKey(dcfg.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load private key for domain %q: %w",
+				domain, err)
+		}
+
+		sd := SigningDomain{
+			Domain:          strings.ToLower(domain),
+			Selector:        dcfg.Selector,
+			Key:             key,
+			HeaderCanon:     CanonicalizationRelaxed,
+			BodyCanon:       CanonicalizationRelaxed,
+			SignedFields:    dcfg.SignedFields,
+			ExpirationDelay: time.Duration(dcfg.Expiration) * time.Second,
+		}
+
+		if dcfg.Canonicalization != "" {
+			sd.HeaderCanon, sd.BodyCanon, err =
+				ParseCanonicalizations(dcfg.Canonicalization)
+			if err != nil {
+				return nil, fmt.Errorf("invalid canonicalization for domain "+
+					"%q: %w", domain, err)
+			}
+		}
+
+		if len(sd.SignedFields) == 0 {
+			sd.SignedFields = DefaultSignedFields
+		}
+
+		s.domains[sd.Domain] = &sd
+	}
+
+	return &s, nil
+}
+
+// Domain returns the configuration of a signing domain, or nil if there is
+// none.
+func (s *Signer) Domain(domain string) *SigningDomain {
+	return s.domains[strings.ToLower(domain)]
+}
+
+// SigningDomain returns the signing domain to use for a message based on the
+// domain of its first From address. If there is no configuration for this
+// domain, parent domains are tried so that a key configured for
+// "example.com" is used for "mail.example.com".
+func (s *Signer) SigningDomain(msg *imf.Message) (*SigningDomain, error) {
+	domain := FromDomain(msg)
+	if domain == "" {
+		return nil, fmt.Errorf("cannot find from domain")
+	}
+
+	for {
+		if sd, found := s.domains[domain]; found {
+			return sd, nil
+		}
+
+		dot := strings.IndexByte(domain, '.')
+		if dot == -1 {
+			break
+		}
+
+		domain = domain[dot+1:]
+	}
+
+	return nil, ErrNoSigningDomain
+}
+
+// Sign adds a DKIM-Signature field at the top of the header of a message.
+// ErrNoSigningDomain is returned if no key is configured for the domain of
+// the message.
+func (s *Signer) Sign(msg *imf.Message) error {
+	sd, err := s.SigningDomain(msg)
+	if err != nil {
+		return err
+	}
+
+	field, err := sd.Sign(msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	msg.Header = append([]*imf.Field{field}, msg.Header...)
+
+	return nil
+}
+
+// Sign returns a DKIM-Signature field for a message. The message is not
+// modified.
+func (sd *SigningDomain) Sign(msg *imf.Message, now time.Time) (*imf.Field, error) {
+	// RFC 6376 5. Signer Actions
+	var signedFields []string
+	for _, name := range sd.SignedFields {
+		if strings.EqualFold(name, "From") || hasField(msg, name) {
+			signedFields = append(signedFields, name)
+		}
+	}
+
+	bodyHash := hashData(CanonicalizeBody(msg.Body, sd.BodyCanon))
+
+	tags := TagList{
+		{"v", "1"},
+		{"a", string(sd.Key.Algorithm)},
+		{"c", string(sd.HeaderCanon) + "/" + string(sd.BodyCanon)},
+		{"d", sd.Domain},
+		{"s", sd.Selector},
+		{"t", strconv.FormatInt(now.Unix(), 10)},
+	}
+
+	if sd.ExpirationDelay > 0 {
+		expiration := now.Add(sd.ExpirationDelay)
+		tags = append(tags, Tag{"x", strconv.FormatInt(expiration.Unix(), 10)})
+	}
+
+	tags = append(tags,
+		Tag{"h", strings.ToLower(strings.Join(signedFields, ":"))},
+		Tag{"bh", base64.StdEncoding.EncodeToString(bodyHash)},
+	)
+
+	fields, err := SelectHeaderFields(msg.Header, signedFields)
+	if err != nil {
+		return nil, err
+	}
+
+	return SignFields("DKIM-Signature", tags, fields, sd.HeaderCanon, sd.Key)
+}
+
+// SignFields computes a signature over a list of raw header fields followed
+// by the signature field itself, and returns the signature field with the b=
+// tag set. It is shared by DKIM-Signature, ARC-Message-Signature and
+// ARC-Seal fields.
+func SignFields(name string, tags TagList, fields []string, c Canonicalization, key *PrivateKey) (*imf.Field, error) {
+	// RFC 6376 3.7. The signature field is hashed with an empty b= tag but
+	// with the exact same folding as the final field. The length of the
+	// signature only depends on the key, so we generate the field with a
+	// placeholder of the right length.
+	placeholder := strings.Repeat("A", key.SignatureLength())
+
+	field := signatureField(name, append(tags, Tag{"b", placeholder}))
+
+	raw, err := FieldRaw(field)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := HeaderHash(fields, StripTagValue(raw, "b"), c)
+
+	signature, err := key.Sign(digest)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign header hash: %w", err)
+	}
+
+	b := base64.StdEncoding.EncodeToString(signature)
+
+	field = signatureField(name, append(tags, Tag{"b", b}))
+
+	field.Raw, err = FieldRaw(field)
+	if err != nil {
+		return nil, err
+	}
+
+	return field, nil
+}
+
+// HeaderHash returns the digest of canonicalized header fields followed by
+// the signature field, the latter being added without its final CRLF
+// sequence (RFC 6376 3.7.).
+func HeaderHash(fields []string, signatureField string, c Canonicalization) []byte {
+	var buf bytes.Buffer
+
+	for _, field := range fields {
+		buf.WriteString(CanonicalizeHeaderField(field, c))
+	}
+
+	canonicalField := CanonicalizeHeaderField(signatureField, c)
+	buf.WriteString(strings.TrimSuffix(canonicalField, "\r\n"))
+
+	return hashData(buf.Bytes())
+}
+
+func signatureField(name string, tags TagList) *imf.Field {
+	value := imf.OptionalFieldValue(tags.String())
+
+	return &imf.Field{
+		Name:  name,
+		Value: utils.Ref(value),
+	}
+}
+
+func hasField(msg *imf.Message, name string) bool {
+	for _, field := range msg.Header {
+		if strings.EqualFold(field.Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FromDomain returns the lower case domain of the first address of the From
+// field of a message, or an empty string if there is no valid From field.
+func FromDomain(msg *imf.Message) string {
+	for _, field := range msg.Header {
+		if !strings.EqualFold(field.Name, "From") || field.HasError() {
+			continue
+		}
+
+		value, ok := field.Value.(*imf.FromFieldValue)
+		if !ok || len(*value) == 0 {
+			continue
+		}
+
+		switch addr := (*value)[0].(type) {
+		case *imf.Mailbox:
+			return strings.ToLower(string(addr.Domain))
+		case *imf.Group:
+			if len(addr.Mailboxes) > 0 {
+				return strings.ToLower(string(addr.Mailboxes[0].Domain))
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,132 @@
+package dkim
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RFC 6376 3.2. Tag=Value Lists
+
+type Tag struct {
+	Name  string
+	Value string
+}
+
+type TagList []Tag
+
+func ParseTagList(s string) (TagList, error) {
+	var tags TagList
+
+	names := make(map[string]struct{})
+
+	for _, part := range strings.Split(s, ";") {
+		part = trimFWS(part)
+		if part == "" {
+			// A trailing semicolon is allowed
+			continue
+		}
+
+		name, value, found := strings.Cut(part, "=")
+		if !found {
+			return nil, fmt.Errorf("missing '=' character in tag %q", part)
+		}
+
+		name = trimFWS(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty tag name")
+		}
+
+		for i := 0; i < len(name); i++ {
+			c := name[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '_') {
+				return nil, fmt.Errorf("invalid tag name %q", name)
+			}
+		}
+
+		// Tags with duplicate names must cause the entire tag list to be
+		// considered invalid.
+		if _, found := names[name]; found {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		names[name] = struct{}{}
+
+		tags = append(tags, Tag{Name: name, Value: trimFWS(value)})
+	}
+
+	return tags, nil
+}
+
+func (tags TagList) Value(name string) (string, bool) {
+	for _, tag := range tags {
+		if tag.Name == name {
+			return tag.Value, true
+		}
+	}
+
+	return "", false
+}
+
+func (tags TagList) String() string {
+	var buf strings.Builder
+
+	for i, tag := range tags {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+
+		buf.WriteString(tag.Name)
+		buf.WriteByte('=')
+		buf.WriteString(tag.Value)
+	}
+
+	return buf.String()
+}
+
+func trimFWS(s string) string {
+	return strings.Trim(s, " \t\r\n")
+}
+
+// RemoveWhitespace removes all whitespace characters, including folding, from
+// a tag value; used for base64 values and lists.
+func RemoveWhitespace(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			return -1
+		}
+
+		return c
+	}, s)
+}
+
+// StripTagValue returns a raw field with the value of a tag removed, leaving
+// the tag itself in place. It is used to remove the signature from the
+// DKIM-Signature field when computing the header hash (RFC 6376 3.7.).
+func StripTagValue(raw, name string) string {
+	colon := strings.IndexByte(raw, ':')
+	if colon == -1 {
+		return raw
+	}
+
+	value := raw[colon+1:]
+
+	var buf strings.Builder
+	buf.WriteString(raw[:colon+1])
+
+	for i, part := range strings.Split(value, ";") {
+		if i > 0 {
+			buf.WriteByte(';')
+		}
+
+		tagName, _, found := strings.Cut(part, "=")
+		if found && trimFWS(tagName) == name {
+			eq := strings.IndexByte(part, '=')
+			buf.WriteString(part[:eq+1])
+			continue
+		}
+
+		buf.WriteString(part)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,580 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/utils"
+)
+
+// RFC 6376 6. Verifier Actions
+
+// Result statuses as defined in RFC 8601 2.7.1.
+type Status string
+
+const (
+	StatusNone      Status = "none"
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusPolicy    Status = "policy"
+	StatusNeutral   Status = "neutral"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+// MaxSignatures is the maximum number of signatures verified in a message;
+// others are ignored, see RFC 6376 8.4.
+const MaxSignatures = 10
+
+type Result struct {
+	Status Status
+	Reason string // optional
+
+	Domain    string // d= tag
+	Selector  string // s= tag
+	Identity  string // i= tag
+	Algorithm Algorithm
+	Signature string // b= tag, used to identify the signature
+	Testing   bool   // true if the key is flagged as being tested (t=y)
+}
+
+func (r *Result) String() string {
+	s := string(r.Status)
+
+	if r.Domain != "" {
+		s += " (" + r.Domain + ")"
+	}
+
+	if r.Reason != "" {
+		s += ": " + r.Reason
+	}
+
+	return s
+}
+
+type Verifier struct {
+	Resolver dns.Resolver
+	Timeout  time.Duration
+
+	// Used for expiration checks; time.Now if nil
+	Now func() time.Time
+}
+
+func NewVerifier(resolver dns.Resolver) *Verifier {
+	return &Verifier{
+		Resolver: resolver,
+		Timeout:  10 * time.Second,
+	}
+}
+
+// Verify checks all DKIM-Signature fields of a message and returns one result
+// per signature. An empty list means that the message is not signed.
+func (v *Verifier) Verify(ctx context.Context, msg *imf.Message) []*Result {
+	var results []*Result
+
+	for _, field := range msg.Header {
+		if !strings.EqualFold(field.Name, "DKIM-Signature") {
+			continue
+		}
+
+		if len(results) >= MaxSignatures {
+			break
+		}
+
+		results = append(results, v.verifySignature(ctx, msg, field))
+	}
+
+	return results
+}
+
+type Signature struct {
+	Tags TagList
+
+	Algorithm   Algorithm
+	Signature   []byte
+	BodyHash    []byte
+	HeaderCanon Canonicalization
+	BodyCanon   Canonicalization
+	Domain      string
+	Selector    string
+	Identity    string
+	Fields      []string
+	BodyLength  int // -1 if the whole body is signed
+	Timestamp   time.Time
+	Expiration  time.Time
+}
+
+func ParseSignature(value string, requireVersion bool) (*Signature, error) {
+	tags, err := ParseTagList(value)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := Signature{
+		Tags:       tags,
+		BodyLength: -1,
+	}
+
+	required := []string{"a", "b", "d", "h", "s"}
+	if requireVersion {
+		required = append(required, "v", "bh")
+	}
+
+	for _, name := range required {
+		if _, found := tags.Value(name); !found {
+			return nil, fmt.Errorf("missing tag %q", name)
+		}
+	}
+
+	if version, found := tags.Value("v"); found && requireVersion &&
+		version != "1" {
+		return nil, fmt.Errorf("unsupported version %q", version)
+	}
+
+	a, _ := tags.Value("a")
+	sig.Algorithm = Algorithm(strings.ToLower(a))
+	if sig.Algorithm != AlgorithmRSASHA256 &&
+		sig.Algorithm != AlgorithmEd25519SHA256 {
+		return nil, fmt.Errorf("unsupported algorithm %q", a)
+	}
+
+	b, _ := tags.Value("b")
+	sig.Signature, err = base64.StdEncoding.DecodeString(RemoveWhitespace(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	if bh, found := tags.Value("bh"); found {
+		sig.BodyHash, err = base64.StdEncoding.DecodeString(RemoveWhitespace(bh))
+		if err != nil {
+			return nil, fmt.Errorf("invalid body hash: %w", err)
+		}
+	}
+
+	sig.HeaderCanon = CanonicalizationSimple
+	sig.BodyCanon = CanonicalizationSimple
+	if c, found := tags.Value("c"); found {
+		sig.HeaderCanon, sig.BodyCanon, err = ParseCanonicalizations(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d, _ := tags.Value("d")
+	sig.Domain = strings.ToLower(d)
+
+	s, _ := tags.Value("s")
+	sig.Selector = s
+
+	h, _ := tags.Value("h")
+	for _, name := range strings.Split(RemoveWhitespace(h), ":") {
+		if name != "" {
+			sig.Fields = append(sig.Fields, name)
+		}
+	}
+
+	if q, found := tags.Value("q"); found {
+		methods := strings.Split(RemoveWhitespace(q), ":")
+		if !containsFold(methods, "dns/txt") {
+			return nil, fmt.Errorf("unsupported query methods %q", q)
+		}
+	}
+
+	if l, found := tags.Value("l"); found {
+		sig.BodyLength, err = strconv.Atoi(l)
+		if err != nil || sig.BodyLength < 0 {
+			return nil, fmt.Errorf("invalid body length %q", l)
+		}
+	}
+
+	if t, found := tags.Value("t"); found {
+		timestamp, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", t)
+		}
+
+		sig.Timestamp = time.Unix(timestamp, 0)
+	}
+
+	if x, found := tags.Value("x"); found {
+		expiration, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiration %q", x)
+		}
+
+		sig.Expiration = time.Unix(expiration, 0)
+	}
+
+	return &sig, nil
+}
+
+func (v *Verifier) verifySignature(ctx context.Context, msg *imf.Message, field *imf.Field) *Result {
+	var result Result
+
+	fail := func(status Status, format string, args ...any) *Result {
+		result.Status = status
+		result.Reason = fmt.Sprintf(format, args...)
+		return &result
+	}
+
+	raw, err := FieldRaw(field)
+	if err != nil {
+		return fail(StatusPermError, "%v", err)
+	}
+
+	_, value, _ := strings.Cut(raw, ":")
+
+	sig, err := ParseSignature(value, true)
+	if err != nil {
+		return fail(StatusPermError, "invalid signature: %v", err)
+	}
+
+	result.Domain = sig.Domain
+	result.Selector = sig.Selector
+	result.Algorithm = sig.Algorithm
+
+	b, _ := sig.Tags.Value("b")
+	result.Signature = RemoveWhitespace(b)
+
+	// RFC 6376 3.5. The identity must be the same as or a subdomain of the
+	// signing domain.
+	if i, found := sig.Tags.Value("i"); found {
+		result.Identity = i
+
+		at := strings.LastIndexByte(i, '@')
+		if at == -1 {
+			return fail(StatusPermError, "invalid identity %q", i)
+		}
+
+		if !IsSubdomain(strings.ToLower(i[at+1:]), sig.Domain) {
+			return fail(StatusPermError, "identity domain does not match "+
+				"signing domain")
+		}
+	} else {
+		result.Identity = "@" + sig.Domain
+	}
+
+	// RFC 6376 5.4. The From field must be signed.
+	if !containsFold(sig.Fields, "From") {
+		return fail(StatusPermError, "from field not signed")
+	}
+
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+
+	if !sig.Expiration.IsZero() && now.After(sig.Expiration) {
+		return fail(StatusFail, "signature expired")
+	}
+
+	// Public key
+	key, err := v.LookupKey(ctx, sig)
+	if err != nil {
+		var keyErr *KeyError
+		if errors.As(err, &keyErr) && keyErr.Temporary {
+			return fail(StatusTempError, "%v", err)
+		}
+
+		return fail(StatusPermError, "%v", err)
+	}
+
+	result.Testing = key.Testing
+
+	if key.Strict && result.Identity != "" {
+		// t=s: the i= domain must be exactly the d= domain
+		at := strings.LastIndexByte(result.Identity, '@')
+		if !strings.EqualFold(result.Identity[at+1:], sig.Domain) {
+			return fail(StatusPermError, "identity domain not allowed by key")
+		}
+	}
+
+	// Body hash
+	body := CanonicalizeBody(msg.Body, sig.BodyCanon)
+	if sig.BodyLength >= 0 {
+		if sig.BodyLength > len(body) {
+			return fail(StatusPermError, "body length greater than actual "+
+				"body length")
+		}
+
+		body = body[:sig.BodyLength]
+	}
+
+	if string(hashData(body)) != string(sig.BodyHash) {
+		return fail(StatusFail, "body hash mismatch")
+	}
+
+	// Header hash
+	fields, err := SelectHeaderFields(msg.Header, sig.Fields)
+	if err != nil {
+		return fail(StatusPermError, "%v", err)
+	}
+
+	digest := HeaderHash(fields, StripTagValue(raw, "b"), sig.HeaderCanon)
+
+	if err := key.Verify(sig.Algorithm, digest, sig.Signature); err != nil {
+		return fail(StatusFail, "%v", err)
+	}
+
+	result.Status = StatusPass
+	return &result
+}
+
+type KeyError struct {
+	Err       error
+	Temporary bool
+}
+
+func (err *KeyError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *KeyError) Unwrap() error {
+	return err.Err
+}
+
+// LookupKey fetches and parses the public key referenced by the selector and
+// domain of a signature.
+func (v *Verifier) LookupKey(ctx context.Context, sig *Signature) (*PublicKey, error) {
+	name := sig.Selector + "._domainkey." + sig.Domain
+
+	ctx, cancel := context.WithTimeout(ctx, v.Timeout)
+	defer cancel()
+
+	records, err := v.Resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, &KeyError{Err: fmt.Errorf("no key for signature")}
+		}
+
+		return nil, &KeyError{
+			Err:       fmt.Errorf("cannot lookup key: %w", err),
+			Temporary: true,
+		}
+	}
+
+	if len(records) == 0 {
+		return nil, &KeyError{Err: fmt.Errorf("no key for signature")}
+	}
+
+	// Multiple TXT strings for the same record are already concatenated by
+	// the resolver. RFC 6376 3.6.2.2. If there are multiple records, the
+	// verifier may use the first one.
+	key, err := ParsePublicKey(records[0])
+	if err != nil {
+		return nil, &KeyError{Err: fmt.Errorf("invalid key: %w", err)}
+	}
+
+	if key.Algorithm != sig.Algorithm {
+		return nil, &KeyError{Err: fmt.Errorf("key type does not match " +
+			"signature algorithm")}
+	}
+
+	return key, nil
+}
+
+type PublicKey struct {
+	Algorithm Algorithm
+	Key       crypto.PublicKey
+	Testing   bool
+	Strict    bool
+}
+
+// ParsePublicKey parses a key record as defined in RFC 6376 3.6.1.
+func ParsePublicKey(record string) (*PublicKey, error) {
+	tags, err := ParseTagList(record)
+	if err != nil {
+		return nil, err
+	}
+
+	if version, found := tags.Value("v"); found && version != "DKIM1" {
+		return nil, fmt.Errorf("unsupported version %q", version)
+	}
+
+	if h, found := tags.Value("h"); found {
+		hashes := strings.Split(RemoveWhitespace(h), ":")
+		if !containsFold(hashes, "sha256") {
+			return nil, fmt.Errorf("sha256 not allowed by key")
+		}
+	}
+
+	if s, found := tags.Value("s"); found {
+		services := strings.Split(RemoveWhitespace(s), ":")
+		if !containsFold(services, "*") && !containsFold(services, "email") {
+			return nil, fmt.Errorf("email service not allowed by key")
+		}
+	}
+
+	var key PublicKey
+
+	if t, found := tags.Value("t"); found {
+		for _, flag := range strings.Split(RemoveWhitespace(t), ":") {
+			switch flag {
+			case "y":
+				key.Testing = true
+			case "s":
+				key.Strict = true
+			}
+		}
+	}
+
+	p, found := tags.Value("p")
+	if !found {
+		return nil, fmt.Errorf("missing tag \"p\"")
+	}
+
+	p = RemoveWhitespace(p)
+	if p == "" {
+		return nil, fmt.Errorf("key revoked")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key data: %w", err)
+	}
+
+	k, _ := tags.Value("k")
+
+	switch strings.ToLower(k) {
+	case "", "rsa":
+		key.Algorithm = AlgorithmRSASHA256
+
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			// Some domains publish PKCS #1 keys instead of
+			// SubjectPublicKeyInfo structures.
+			rsaPub, err2 := x509.ParsePKCS1PublicKey(data)
+			if err2 != nil {
+				return nil, fmt.Errorf("invalid rsa key: %w", err)
+			}
+
+			pub = rsaPub
+		}
+
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key is not an rsa key")
+		}
+
+		// RFC 8301 3.2. Verifiers must not consider signatures using keys
+		// smaller than 1024 bits as valid.
+		if rsaPub.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("rsa key is too small (%d bits)",
+				rsaPub.N.BitLen())
+		}
+
+		key.Key = rsaPub
+
+	case "ed25519":
+		key.Algorithm = AlgorithmEd25519SHA256
+
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key size")
+		}
+
+		key.Key = ed25519.PublicKey(data)
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k)
+	}
+
+	return &key, nil
+}
+
+func (k *PublicKey) Verify(algorithm Algorithm, digest, signature []byte) error {
+	switch algorithm {
+	case AlgorithmRSASHA256:
+		key, ok := k.Key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("invalid key type")
+		}
+
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature)
+		if err != nil {
+			return fmt.Errorf("signature mismatch")
+		}
+
+	case AlgorithmEd25519SHA256:
+		key, ok := k.Key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("invalid key type")
+		}
+
+		if !ed25519.Verify(key, digest, signature) {
+			return fmt.Errorf("signature mismatch")
+		}
+
+	default:
+		return fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+
+	return nil
+}
+
+func IsSubdomain(domain, parent string) bool {
+	domain = strings.ToLower(domain)
+	parent = strings.ToLower(parent)
+
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
+
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthenticationResult returns the representation of the result in an
+// Authentication-Results field (RFC 8601 2.2.).
+func (r *Result) AuthenticationResult() *imf.AuthenticationResult {
+	ar := imf.AuthenticationResult{
+		Method: "dkim",
+		Result: string(r.Status),
+	}
+
+	if r.Reason != "" {
+		ar.Reason = utils.Ref(r.Reason)
+	}
+
+	addProperty := func(name, value string) {
+		ar.Properties = append(ar.Properties, imf.AuthenticationResultProperty{
+			Type:  "header",
+			Name:  name,
+			Value: value,
+		})
+	}
+
+	if r.Domain != "" {
+		addProperty("d", r.Domain)
+	}
+
+	if r.Identity != "" && strings.IndexByte(r.Identity, '@') > 0 {
+		addProperty("i", r.Identity)
+	}
+
+	if r.Selector != "" {
+		addProperty("s", r.Selector)
+	}
+
+	// RFC 6008 uses the first 8 characters of the signature to identify it
+	if len(r.Signature) >= 8 {
+		addProperty("b", r.Signature[:8])
+	}
+
+	return &ar
+}
@@ -0,0 +1,316 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/spf"
+	"github.com/galdor/go-ejson"
+)
+
+// RFC 7489 Domain-based Message Authentication, Reporting, and Conformance
+// (DMARC)
+
+// Result statuses as defined in RFC 8601 2.7.1. and RFC 7489 11.2.
+type Status string
+
+const (
+	StatusNone      Status = "none"
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+var (
+	ErrNoAuthorDomain        = errors.New("missing author domain")
+	ErrMultipleAuthorDomains = errors.New("multiple author domains")
+)
+
+type Result struct {
+	Status Status
+	Reason string // optional
+
+	Domain       string  // RFC5322.From domain
+	PolicyDomain string  // domain the record was found for
+	Record       *Record // nil if there is no policy
+
+	// The policy requested by the domain owner, and the one actually applied
+	// after sampling (pct tag).
+	Policy      Policy
+	Disposition Policy
+
+	SPFResult   *spf.CheckResult
+	SPFAligned  bool
+	DKIMResults []*dkim.Result
+	DKIMAligned bool
+}
+
+func (r *Result) String() string {
+	s := string(r.Status)
+
+	if r.Domain != "" {
+		s += " (" + r.Domain + ")"
+	}
+
+	if r.Disposition != "" {
+		s += " disposition=" + string(r.Disposition)
+	}
+
+	if r.Reason != "" {
+		s += ": " + r.Reason
+	}
+
+	return s
+}
+
+// AuthenticationResult returns the representation of the result in an
+// Authentication-Results field (RFC 7489 11.2.).
+func (r *Result) AuthenticationResult() *imf.AuthenticationResult {
+	ar := imf.AuthenticationResult{
+		Method: "dmarc",
+		Result: string(r.Status),
+	}
+
+	if r.Policy != "" {
+		ar.Comment = fmt.Sprintf("p=%s dis=%s", r.Policy, r.Disposition)
+	}
+
+	if r.Domain != "" {
+		ar.Properties = append(ar.Properties, imf.AuthenticationResultProperty{
+			Type:  "header",
+			Name:  "from",
+			Value: r.Domain,
+		})
+	}
+
+	return &ar
+}
+
+type Cfg struct {
+	// Path of a copy of the Public Suffix List used to find organizational
+	// domains. Without it, domains such as "example.co.uk" and
+	// "other.co.uk" would share the same organizational domain and be
+	// aligned with each other.
+	PublicSuffixListPath string `json:"public_suffix_list_path"`
+
+	Reporting *ReportingCfg `json:"reporting,omitempty"`
+}
+
+func (cfg *Cfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("public_suffix_list_path", cfg.PublicSuffixListPath)
+	v.CheckOptionalObject("reporting", cfg.Reporting)
+}
+
+type Evaluator struct {
+	Resolver         dns.Resolver
+	Timeout          time.Duration
+	PublicSuffixList *PublicSuffixList
+
+	// Used for the sampling of messages when pct is lower than 100; returns
+	// an integer in [0, n). Defaults to math/rand.Intn.
+	Rand func(n int) int
+}
+
+func NewEvaluator(resolver dns.Resolver, psl *PublicSuffixList) *Evaluator {
+	return &Evaluator{
+		Resolver:         resolver,
+		Timeout:          10 * time.Second,
+		PublicSuffixList: psl,
+		Rand:             rand.Intn,
+	}
+}
+
+// Evaluate applies the DMARC policy of the author domain of a message based
+// on the SPF and DKIM results previously obtained (RFC 7489 6.6.).
+func (e *Evaluator) Evaluate(ctx context.Context, msg *imf.Message, spfResult *spf.CheckResult, dkimResults []*dkim.Result) *Result {
+	ctx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+
+	result := Result{
+		Status:      StatusNone,
+		SPFResult:   spfResult,
+		DKIMResults: dkimResults,
+	}
+
+	domain, err := AuthorDomain(msg)
+	if err != nil {
+		result.Status = StatusPermError
+		result.Reason = err.Error()
+		return &result
+	}
+
+	result.Domain = domain
+
+	record, policyDomain, err := e.lookupRecord(ctx, domain)
+	if err != nil {
+		result.Status = StatusTempError
+		result.Reason = err.Error()
+		return &result
+	}
+
+	if record == nil {
+		return &result
+	}
+
+	result.Record = record
+	result.PolicyDomain = policyDomain
+
+	// RFC 7489 3.1. Identifier Alignment
+	if spfResult != nil && spfResult.Result == spf.ResultPass {
+		result.SPFAligned = e.aligned(spfResult.Domain, domain,
+			record.SPFAlignment)
+	}
+
+	for _, dkimResult := range dkimResults {
+		if dkimResult.Status == dkim.StatusPass &&
+			e.aligned(dkimResult.Domain, domain, record.DKIMAlignment) {
+			result.DKIMAligned = true
+			break
+		}
+	}
+
+	// RFC 7489 6.6.3. The subdomain policy applies when the record was found
+	// for the organizational domain.
+	result.Policy = record.Policy
+	if policyDomain != domain {
+		result.Policy = record.SubdomainPolicy
+	}
+
+	if result.SPFAligned || result.DKIMAligned {
+		result.Status = StatusPass
+		result.Disposition = PolicyNone
+		return &result
+	}
+
+	result.Status = StatusFail
+	result.Disposition = result.Policy
+
+	// RFC 7489 6.6.4. Messages which are not sampled are subject to the next
+	// policy down.
+	if record.Percent < 100 && e.Rand(100) >= record.Percent {
+		switch result.Disposition {
+		case PolicyReject:
+			result.Disposition = PolicyQuarantine
+		case PolicyQuarantine:
+			result.Disposition = PolicyNone
+		}
+	}
+
+	return &result
+}
+
+func (e *Evaluator) aligned(domain, authorDomain string, alignment Alignment) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if alignment == AlignmentStrict {
+		return domain == authorDomain
+	}
+
+	psl := e.PublicSuffixList
+	return psl.OrganizationalDomain(domain) ==
+		psl.OrganizationalDomain(authorDomain)
+}
+
+func (e *Evaluator) lookupRecord(ctx context.Context, domain string) (*Record, string, error) {
+	// RFC 7489 6.6.3. Policy Discovery
+	record, err := e.lookupDomainRecord(ctx, domain)
+	if err != nil || record != nil {
+		return record, domain, err
+	}
+
+	orgDomain := e.PublicSuffixList.OrganizationalDomain(domain)
+	if orgDomain == domain {
+		return nil, "", nil
+	}
+
+	record, err = e.lookupDomainRecord(ctx, orgDomain)
+	return record, orgDomain, err
+}
+
+func (e *Evaluator) lookupDomainRecord(ctx context.Context, domain string) (*Record, error) {
+	txts, err := e.Resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("cannot lookup dmarc record: %w", err)
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+
+	// RFC 7489 6.6.3. Invalid records and multiple records are handled as
+	// if there was no record at all.
+	if len(records) != 1 {
+		return nil, nil
+	}
+
+	record, err := ParseRecord(records[0])
+	if err != nil {
+		return nil, nil
+	}
+
+	return record, nil
+}
+
+// AuthorDomain returns the domain of the RFC5322.From identifier of a message
+// (RFC 7489 6.6.1.).
+func AuthorDomain(msg *imf.Message) (string, error) {
+	var domain string
+	nbFields := 0
+
+	for _, field := range msg.Header {
+		if !strings.EqualFold(field.Name, "From") {
+			continue
+		}
+
+		nbFields++
+		if nbFields > 1 {
+			return "", ErrMultipleAuthorDomains
+		}
+
+		value, ok := field.Value.(*imf.FromFieldValue)
+		if field.HasError() || !ok {
+			return "", ErrNoAuthorDomain
+		}
+
+		var mailboxes []*imf.Mailbox
+		for _, addr := range *value {
+			switch addr := addr.(type) {
+			case *imf.Mailbox:
+				mailboxes = append(mailboxes, addr)
+			case *imf.Group:
+				mailboxes = append(mailboxes, addr.Mailboxes...)
+			}
+		}
+
+		for _, mailbox := range mailboxes {
+			mailboxDomain := strings.ToLower(string(mailbox.Domain))
+
+			if domain != "" && mailboxDomain != domain {
+				return "", ErrMultipleAuthorDomains
+			}
+
+			domain = mailboxDomain
+		}
+	}
+
+	if domain == "" {
+		return "", ErrNoAuthorDomain
+	}
+
+	return domain, nil
+}
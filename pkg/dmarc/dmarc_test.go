@@ -0,0 +1,239 @@
+package dmarc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/spf"
+)
+
+func testPublicSuffixList(t *testing.T) *PublicSuffixList {
+	psl, err := ParsePublicSuffixList([]byte(`// Test list
+com
+net
+org
+uk
+co.uk
+*.ck
+!www.ck
+`))
+	if err != nil {
+		t.Fatalf("cannot parse list: %v", err)
+	}
+
+	return psl
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	psl := testPublicSuffixList(t)
+
+	tests := []struct {
+		domain    string
+		orgDomain string
+	}{
+		{"example.com", "example.com"},
+		{"mail.example.com", "example.com"},
+		{"a.b.example.co.uk", "example.co.uk"},
+		{"co.uk", "co.uk"},
+		{"foo.bar.ck", "foo.bar.ck"},
+		{"www.ck", "www.ck"},
+		{"a.www.ck", "www.ck"},
+		{"example.org", "example.org"},
+	}
+
+	for _, test := range tests {
+		orgDomain := psl.OrganizationalDomain(test.domain)
+		if orgDomain != test.orgDomain {
+			t.Errorf("organizational domain of %q is %q but should be %q",
+				test.domain, orgDomain, test.orgDomain)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	record, err := ParseRecord("v=DMARC1; p=reject; sp=quarantine; pct=50; " +
+		"adkim=s; rua=mailto:dmarc@example.com!10m,mailto:x@example.net")
+	if err != nil {
+		t.Fatalf("cannot parse record: %v", err)
+	}
+
+	if record.Policy != PolicyReject {
+		t.Errorf("policy is %q", record.Policy)
+	}
+
+	if record.SubdomainPolicy != PolicyQuarantine {
+		t.Errorf("subdomain policy is %q", record.SubdomainPolicy)
+	}
+
+	if record.Percent != 50 {
+		t.Errorf("percent is %d", record.Percent)
+	}
+
+	if record.DKIMAlignment != AlignmentStrict ||
+		record.SPFAlignment != AlignmentRelaxed {
+		t.Errorf("alignments are %q and %q", record.DKIMAlignment,
+			record.SPFAlignment)
+	}
+
+	addrs := strings.Join(record.ReportAddresses(), ",")
+	if addrs != "dmarc@example.com,x@example.net" {
+		t.Errorf("report addresses are %q", addrs)
+	}
+
+	invalidRecords := []string{
+		"p=reject; v=DMARC1",
+		"v=DMARC1",
+		"v=DMARC1; p=maybe",
+		"v=DMARC1; p=none; pct=200",
+	}
+
+	for _, s := range invalidRecords {
+		if _, err := ParseRecord(s); err == nil {
+			t.Errorf("record %q was parsed but should be invalid", s)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+	resolver.TXT["_dmarc.example.com"] = []string{
+		"v=DMARC1; p=reject; sp=quarantine; rua=mailto:dmarc@example.com",
+	}
+	resolver.TXT["_dmarc.example.net"] = []string{
+		"v=DMARC1; p=reject; pct=0; aspf=s",
+	}
+
+	resolver.TXT["_dmarc.example.co.uk"] = []string{"v=DMARC1; p=reject"}
+
+	evaluator := NewEvaluator(resolver, testPublicSuffixList(t))
+	evaluator.Rand = func(n int) int { return n - 1 }
+
+	spfResult := func(domain string, result spf.Result) *spf.CheckResult {
+		return &spf.CheckResult{Domain: domain, Result: result}
+	}
+
+	dkimResult := func(domain string, status dkim.Status) []*dkim.Result {
+		return []*dkim.Result{{Domain: domain, Status: status}}
+	}
+
+	tests := []struct {
+		from        string
+		spfResult   *spf.CheckResult
+		dkimResults []*dkim.Result
+		status      Status
+		disposition Policy
+	}{
+		{"example.com", spfResult("example.com", spf.ResultPass), nil,
+			StatusPass, PolicyNone},
+		{"example.com", spfResult("bounces.example.com", spf.ResultPass), nil,
+			StatusPass, PolicyNone},
+		{"example.com", nil, dkimResult("example.com", dkim.StatusPass),
+			StatusPass, PolicyNone},
+		{"example.com", spfResult("example.org", spf.ResultPass),
+			dkimResult("example.org", dkim.StatusPass),
+			StatusFail, PolicyReject},
+		{"example.com", spfResult("example.com", spf.ResultFail),
+			dkimResult("example.com", dkim.StatusFail),
+			StatusFail, PolicyReject},
+		{"mail.example.com", nil, nil, StatusFail, PolicyQuarantine},
+		{"example.net", spfResult("mail.example.net", spf.ResultPass), nil,
+			StatusFail, PolicyQuarantine},
+		{"example.org", nil, nil, StatusNone, ""},
+		// Domains under a public suffix with several labels are not
+		// aligned with each other.
+		{"example.co.uk", spfResult("other.co.uk", spf.ResultPass),
+			dkimResult("other.co.uk", dkim.StatusPass),
+			StatusFail, PolicyReject},
+		{"mail.example.co.uk", spfResult("example.co.uk", spf.ResultPass),
+			nil, StatusPass, PolicyNone},
+		{"example.co.uk", spfResult("bounces.example.co.uk", spf.ResultPass),
+			nil, StatusPass, PolicyNone},
+	}
+
+	for _, test := range tests {
+		msg := imf.Message{
+			Header: []*imf.Field{{
+				Name: "From",
+				Value: &imf.FromFieldValue{&imf.Mailbox{
+					SpecificAddress: imf.SpecificAddress{
+						LocalPart: "alice",
+						Domain:    imf.Domain(test.from),
+					},
+				}},
+			}},
+		}
+
+		result := evaluator.Evaluate(context.Background(), &msg,
+			test.spfResult, test.dkimResults)
+
+		if result.Status != test.status ||
+			result.Disposition != test.disposition {
+			t.Errorf("evaluation for %q returned %v but should have "+
+				"returned %q with disposition %q", test.from, result,
+				test.status, test.disposition)
+		}
+	}
+}
+
+func TestAggregateReports(t *testing.T) {
+	record, err := ParseRecord("v=DMARC1; p=none; rua=mailto:r@example.com")
+	if err != nil {
+		t.Fatalf("cannot parse record: %v", err)
+	}
+
+	result := Result{
+		Status:       StatusPass,
+		Domain:       "example.com",
+		PolicyDomain: "example.com",
+		Record:       record,
+		Policy:       PolicyNone,
+		Disposition:  PolicyNone,
+		DKIMAligned:  true,
+		DKIMResults: []*dkim.Result{
+			{Domain: "example.com", Selector: "s1", Status: dkim.StatusPass},
+		},
+	}
+
+	aggregator := NewAggregator()
+
+	ip := net.ParseIP("192.0.2.1")
+	aggregator.Add(&result, ip, "example.com")
+	aggregator.Add(&result, ip, "example.com")
+	aggregator.Add(&result, net.ParseIP("192.0.2.2"), "example.com")
+
+	end := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	reports := aggregator.Flush("Example", "postmaster@example.org", end)
+
+	if len(reports) != 1 {
+		t.Fatalf("%d reports generated instead of one", len(reports))
+	}
+
+	report := reports[0]
+
+	if len(report.Records) != 2 {
+		t.Fatalf("%d records generated instead of two", len(report.Records))
+	}
+
+	if n := report.Records[0].Row.Count; n != 2 {
+		t.Errorf("first record has a count of %d instead of two", n)
+	}
+
+	data, err := report.Encode()
+	if err != nil {
+		t.Fatalf("cannot encode report: %v", err)
+	}
+
+	if !strings.Contains(string(data), "<source_ip>192.0.2.2</source_ip>") {
+		t.Errorf("missing source ip in report:\n%s", data)
+	}
+
+	if reports := aggregator.Flush("Example", "", end); len(reports) != 0 {
+		t.Errorf("%d reports generated after flush", len(reports))
+	}
+}
@@ -0,0 +1,111 @@
+package dmarc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PublicSuffixList contains the rules of the Public Suffix List
+// (https://publicsuffix.org/list/) used to find organizational domains (RFC
+// 7489 3.2.).
+type PublicSuffixList struct {
+	rules      map[string]struct{}
+	exceptions map[string]struct{}
+}
+
+func LoadPublicSuffixList(filePath string) (*PublicSuffixList, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	return ParsePublicSuffixList(data)
+}
+
+func ParsePublicSuffixList(data []byte) (*PublicSuffixList, error) {
+	l := PublicSuffixList{
+		rules:      make(map[string]struct{}),
+		exceptions: make(map[string]struct{}),
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		// Rules end at the first whitespace character
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+
+		rule := strings.ToLower(fields[0])
+
+		if strings.HasPrefix(rule, "!") {
+			l.exceptions[rule[1:]] = struct{}{}
+		} else {
+			l.rules[rule] = struct{}{}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read list: %w", err)
+	}
+
+	return &l, nil
+}
+
+// PublicSuffix returns the public suffix of a domain name.
+func (l *PublicSuffixList) PublicSuffix(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	labels := strings.Split(domain, ".")
+
+	// Default rule: the last label
+	nbLabels := 1
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		suffix := strings.Join(labels[i:], ".")
+
+		if _, found := l.exceptions[suffix]; found {
+			// Exception rules take precedence and their leftmost label is
+			// not part of the public suffix.
+			return strings.Join(labels[i+1:], ".")
+		}
+
+		if _, found := l.rules[suffix]; found {
+			nbLabels = max(nbLabels, len(labels)-i)
+		}
+
+		if i > 0 {
+			wildcard := "*." + suffix
+			if _, found := l.rules[wildcard]; found {
+				nbLabels = max(nbLabels, len(labels)-i+1)
+			}
+		}
+	}
+
+	if nbLabels > len(labels) {
+		nbLabels = len(labels)
+	}
+
+	return strings.Join(labels[len(labels)-nbLabels:], ".")
+}
+
+// OrganizationalDomain returns the organizational domain of a domain name,
+// i.e. its public suffix and one additional label (RFC 7489 3.2.).
+func (l *PublicSuffixList) OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	suffix := l.PublicSuffix(domain)
+	if suffix == domain {
+		return domain
+	}
+
+	prefix := strings.TrimSuffix(domain, "."+suffix)
+	if idx := strings.LastIndexByte(prefix, '.'); idx >= 0 {
+		prefix = prefix[idx+1:]
+	}
+
+	return prefix + "." + suffix
+}
@@ -0,0 +1,174 @@
+package dmarc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dkim"
+)
+
+// RFC 7489 6.3. General Record Format
+
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+type Alignment string
+
+const (
+	AlignmentRelaxed Alignment = "r"
+	AlignmentStrict  Alignment = "s"
+)
+
+const DefaultReportInterval = 24 * time.Hour
+
+type Record struct {
+	Policy          Policy
+	SubdomainPolicy Policy
+	Percent         int
+
+	DKIMAlignment Alignment
+	SPFAlignment  Alignment
+
+	AggregateReportURIs []string
+	FailureReportURIs   []string
+	FailureOptions      string
+	ReportInterval      time.Duration
+}
+
+func ParseRecord(s string) (*Record, error) {
+	tags, err := dkim.ParseTagList(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 7489 6.4. The v tag must be first.
+	if len(tags) == 0 || tags[0].Name != "v" || tags[0].Value != "DMARC1" {
+		return nil, fmt.Errorf("missing or invalid version tag")
+	}
+
+	r := Record{
+		Percent:        100,
+		DKIMAlignment:  AlignmentRelaxed,
+		SPFAlignment:   AlignmentRelaxed,
+		FailureOptions: "0",
+		ReportInterval: DefaultReportInterval,
+	}
+
+	for _, tag := range tags[1:] {
+		value := tag.Value
+
+		switch tag.Name {
+		case "p", "sp":
+			policy, err := parsePolicy(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %q tag: %w", tag.Name, err)
+			}
+
+			if tag.Name == "p" {
+				r.Policy = policy
+			} else {
+				r.SubdomainPolicy = policy
+			}
+
+		case "pct":
+			i, err := strconv.Atoi(value)
+			if err != nil || i < 0 || i > 100 {
+				return nil, fmt.Errorf("invalid \"pct\" tag %q", value)
+			}
+
+			r.Percent = i
+
+		case "adkim", "aspf":
+			alignment := Alignment(strings.ToLower(value))
+			if alignment != AlignmentRelaxed && alignment != AlignmentStrict {
+				return nil, fmt.Errorf("invalid %q tag %q", tag.Name, value)
+			}
+
+			if tag.Name == "adkim" {
+				r.DKIMAlignment = alignment
+			} else {
+				r.SPFAlignment = alignment
+			}
+
+		case "rua":
+			r.AggregateReportURIs = parseURIList(value)
+
+		case "ruf":
+			r.FailureReportURIs = parseURIList(value)
+
+		case "fo":
+			r.FailureOptions = value
+
+		case "ri":
+			i, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid \"ri\" tag %q", value)
+			}
+
+			r.ReportInterval = time.Duration(i) * time.Second
+
+		default:
+			// RFC 7489 6.3. Unknown tags must be ignored.
+		}
+	}
+
+	if r.Policy == "" {
+		// RFC 7489 6.6.3. A record without policy but with a valid rua tag
+		// is handled as if p=none was specified.
+		if len(r.AggregateReportURIs) == 0 {
+			return nil, fmt.Errorf("missing \"p\" tag")
+		}
+
+		r.Policy = PolicyNone
+	}
+
+	if r.SubdomainPolicy == "" {
+		r.SubdomainPolicy = r.Policy
+	}
+
+	return &r, nil
+}
+
+func parsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown policy %q", s)
+}
+
+func parseURIList(s string) []string {
+	var uris []string
+
+	for _, part := range strings.Split(s, ",") {
+		// RFC 7489 6.2. URIs can be followed by a size limit, e.g. "!10m",
+		// which we do not enforce.
+		uri, _, _ := strings.Cut(strings.TrimSpace(part), "!")
+		if uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+
+	return uris
+}
+
+// ReportAddresses returns the email addresses of the aggregate report URIs.
+func (r *Record) ReportAddresses() []string {
+	var addrs []string
+
+	for _, uri := range r.AggregateReportURIs {
+		if len(uri) > 7 && strings.EqualFold(uri[:7], "mailto:") {
+			addrs = append(addrs, uri[7:])
+		}
+	}
+
+	return addrs
+}
@@ -0,0 +1,392 @@
+package dmarc
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/spf"
+	"github.com/galdor/go-ejson"
+	"github.com/galdor/go-log"
+)
+
+// RFC 7489 7.2. Aggregate Reports
+
+type AggregateReport struct {
+	XMLName         xml.Name        `xml:"feedback"`
+	Metadata        ReportMetadata  `xml:"report_metadata"`
+	PolicyPublished PolicyPublished `xml:"policy_published"`
+	Records         []*ReportRecord `xml:"record"`
+}
+
+type ReportMetadata struct {
+	OrgName   string          `xml:"org_name"`
+	Email     string          `xml:"email"`
+	ReportId  string          `xml:"report_id"`
+	DateRange ReportDateRange `xml:"date_range"`
+}
+
+type ReportDateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+type PolicyPublished struct {
+	Domain          string    `xml:"domain"`
+	DKIMAlignment   Alignment `xml:"adkim"`
+	SPFAlignment    Alignment `xml:"aspf"`
+	Policy          Policy    `xml:"p"`
+	SubdomainPolicy Policy    `xml:"sp"`
+	Percent         int       `xml:"pct"`
+	FailureOptions  string    `xml:"fo"`
+}
+
+type ReportRecord struct {
+	Row         ReportRow         `xml:"row"`
+	Identifiers ReportIdentifiers `xml:"identifiers"`
+	AuthResults ReportAuthResults `xml:"auth_results"`
+}
+
+type ReportRow struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int             `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type PolicyEvaluated struct {
+	Disposition Policy `xml:"disposition"`
+	DKIM        string `xml:"dkim"` // pass or fail
+	SPF         string `xml:"spf"`  // pass or fail
+}
+
+type ReportIdentifiers struct {
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+type ReportAuthResults struct {
+	DKIM []ReportDKIMResult `xml:"dkim"`
+	SPF  []ReportSPFResult  `xml:"spf"`
+}
+
+type ReportDKIMResult struct {
+	Domain   string      `xml:"domain"`
+	Selector string      `xml:"selector,omitempty"`
+	Result   dkim.Status `xml:"result"`
+}
+
+type ReportSPFResult struct {
+	Domain string       `xml:"domain"`
+	Scope  spf.Identity `xml:"scope"`
+	Result spf.Result   `xml:"result"`
+}
+
+// Encode returns the XML representation of the report.
+func (r *AggregateReport) Encode() ([]byte, error) {
+	data, err := xml.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// FileName returns the name of the report file as recommended by RFC 7489
+// 7.2.1.1.
+func (r *AggregateReport) FileName(receiver string) string {
+	return fmt.Sprintf("%s!%s!%d!%d.xml", receiver, r.PolicyPublished.Domain,
+		r.Metadata.DateRange.Begin, r.Metadata.DateRange.End)
+}
+
+type aggregatedDomain struct {
+	record  *Record
+	records map[string]*ReportRecord
+}
+
+// Aggregator accumulates DMARC results for policy domains which requested
+// aggregate reports.
+type Aggregator struct {
+	begin   time.Time
+	domains map[string]*aggregatedDomain
+	mutex   sync.Mutex
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		begin:   time.Now().UTC(),
+		domains: make(map[string]*aggregatedDomain),
+	}
+}
+
+// Add records the result of the evaluation of a message received from a
+// client. Results for domains without aggregate report URIs are ignored.
+func (a *Aggregator) Add(result *Result, sourceIP net.IP, envelopeFrom string) {
+	if result.Record == nil || len(result.Record.AggregateReportURIs) == 0 {
+		return
+	}
+
+	record := ReportRecord{
+		Row: ReportRow{
+			SourceIP: sourceIP.String(),
+			PolicyEvaluated: PolicyEvaluated{
+				Disposition: result.Disposition,
+				DKIM:        passOrFail(result.DKIMAligned),
+				SPF:         passOrFail(result.SPFAligned),
+			},
+		},
+		Identifiers: ReportIdentifiers{
+			EnvelopeFrom: envelopeFrom,
+			HeaderFrom:   result.Domain,
+		},
+	}
+
+	for _, dkimResult := range result.DKIMResults {
+		record.AuthResults.DKIM = append(record.AuthResults.DKIM,
+			ReportDKIMResult{
+				Domain:   dkimResult.Domain,
+				Selector: dkimResult.Selector,
+				Result:   dkimResult.Status,
+			})
+	}
+
+	if spfResult := result.SPFResult; spfResult != nil {
+		record.AuthResults.SPF = append(record.AuthResults.SPF,
+			ReportSPFResult{
+				Domain: spfResult.Domain,
+				Scope:  spfResult.Query.Identity,
+				Result: spfResult.Result,
+			})
+	}
+
+	key := record.key()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	domain, found := a.domains[result.PolicyDomain]
+	if !found {
+		domain = &aggregatedDomain{
+			records: make(map[string]*ReportRecord),
+		}
+
+		a.domains[result.PolicyDomain] = domain
+	}
+
+	domain.record = result.Record
+
+	if r, found := domain.records[key]; found {
+		r.Row.Count++
+	} else {
+		record.Row.Count = 1
+		domain.records[key] = &record
+	}
+}
+
+// Flush returns one report for each policy domain for which results were
+// recorded since the last call, and resets the aggregator.
+func (a *Aggregator) Flush(orgName, email string, end time.Time) []*AggregateReport {
+	a.mutex.Lock()
+	domains := a.domains
+	begin := a.begin
+	a.domains = make(map[string]*aggregatedDomain)
+	a.begin = end
+	a.mutex.Unlock()
+
+	names := make([]string, 0, len(domains))
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reports := make([]*AggregateReport, 0, len(names))
+
+	for _, name := range names {
+		domain := domains[name]
+		record := domain.record
+
+		report := AggregateReport{
+			Metadata: ReportMetadata{
+				OrgName: orgName,
+				Email:   email,
+				ReportId: name + "." +
+					strconv.FormatInt(begin.Unix(), 10),
+				DateRange: ReportDateRange{
+					Begin: begin.Unix(),
+					End:   end.Unix(),
+				},
+			},
+			PolicyPublished: PolicyPublished{
+				Domain:          name,
+				DKIMAlignment:   record.DKIMAlignment,
+				SPFAlignment:    record.SPFAlignment,
+				Policy:          record.Policy,
+				SubdomainPolicy: record.SubdomainPolicy,
+				Percent:         record.Percent,
+				FailureOptions:  record.FailureOptions,
+			},
+		}
+
+		keys := make([]string, 0, len(domain.records))
+		for key := range domain.records {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			report.Records = append(report.Records, domain.records[key])
+		}
+
+		reports = append(reports, &report)
+	}
+
+	return reports
+}
+
+func (r *ReportRecord) key() string {
+	parts := []string{
+		r.Row.SourceIP,
+		string(r.Row.PolicyEvaluated.Disposition),
+		r.Row.PolicyEvaluated.DKIM,
+		r.Row.PolicyEvaluated.SPF,
+		r.Identifiers.EnvelopeFrom,
+		r.Identifiers.HeaderFrom,
+	}
+
+	for _, result := range r.AuthResults.DKIM {
+		parts = append(parts, result.Domain, result.Selector,
+			string(result.Result))
+	}
+
+	for _, result := range r.AuthResults.SPF {
+		parts = append(parts, result.Domain, string(result.Scope),
+			string(result.Result))
+	}
+
+	return strings.Join(parts, "\x00")
+}
+
+func passOrFail(pass bool) string {
+	if pass {
+		return "pass"
+	}
+
+	return "fail"
+}
+
+type ReportingCfg struct {
+	Log *log.Logger `json:"-"`
+
+	Domain    string `json:"domain"` // domain of the reporting organization
+	OrgName   string `json:"org_name"`
+	Email     string `json:"email"`
+	Directory string `json:"directory"`
+}
+
+func (cfg *ReportingCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("domain", cfg.Domain)
+	v.CheckStringNotEmpty("org_name", cfg.OrgName)
+	v.CheckStringNotEmpty("email", cfg.Email)
+	v.CheckStringNotEmpty("directory", cfg.Directory)
+}
+
+// Reporter writes aggregate reports to a directory at the end of each day
+// (UTC). Reports are stored as files named according to RFC 7489 7.2.1.1 so
+// that they can be sent to the addresses listed in the rua tag of the
+// published policy.
+type Reporter struct {
+	Cfg        ReportingCfg
+	Log        *log.Logger
+	Aggregator *Aggregator
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewReporter(cfg ReportingCfg, aggregator *Aggregator) *Reporter {
+	r := Reporter{
+		Cfg:        cfg,
+		Log:        cfg.Log,
+		Aggregator: aggregator,
+
+		stopChan: make(chan struct{}),
+	}
+
+	return &r
+}
+
+func (r *Reporter) Start() error {
+	if err := os.MkdirAll(r.Cfg.Directory, 0700); err != nil {
+		return fmt.Errorf("cannot create directory %q: %w", r.Cfg.Directory,
+			err)
+	}
+
+	r.wg.Add(1)
+	go r.main()
+
+	return nil
+}
+
+func (r *Reporter) Stop() {
+	close(r.stopChan)
+	r.wg.Wait()
+
+	// Do not lose results aggregated since the beginning of the day
+	r.writeReports(time.Now().UTC())
+}
+
+func (r *Reporter) main() {
+	defer r.wg.Done()
+
+	for {
+		now := time.Now().UTC()
+		next := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+		timer := time.NewTimer(next.Sub(now))
+
+		select {
+		case <-r.stopChan:
+			timer.Stop()
+			return
+
+		case <-timer.C:
+			r.writeReports(next)
+		}
+	}
+}
+
+func (r *Reporter) writeReports(end time.Time) {
+	reports := r.Aggregator.Flush(r.Cfg.OrgName, r.Cfg.Email, end)
+
+	for _, report := range reports {
+		if err := r.writeReport(report); err != nil {
+			r.Log.Error("cannot write dmarc report for domain %q: %v",
+				report.PolicyPublished.Domain, err)
+		}
+	}
+}
+
+func (r *Reporter) writeReport(report *AggregateReport) error {
+	data, err := report.Encode()
+	if err != nil {
+		return fmt.Errorf("cannot encode report: %w", err)
+	}
+
+	filePath := path.Join(r.Cfg.Directory, report.FileName(r.Cfg.Domain))
+
+	if err := os.WriteFile(filePath, data, 0600); err != nil {
+		return fmt.Errorf("cannot write %q: %w", filePath, err)
+	}
+
+	r.Log.Info("dmarc report for domain %q written to %q",
+		report.PolicyPublished.Domain, filePath)
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// FakeResolver is an in-memory resolver used in tests. Names are case
+// insensitive and stored without trailing dot. Names listed in TempErrors
+// fail with a temporary error for all record types.
+type FakeResolver struct {
+	TXT        map[string][]string
+	IP         map[string][]net.IP
+	MX         map[string][]*net.MX
+	Addr       map[string][]string
+	TempErrors map[string]bool
+
+	nbLookups int
+	mutex     sync.Mutex
+}
+
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{
+		TXT:        make(map[string][]string),
+		IP:         make(map[string][]net.IP),
+		MX:         make(map[string][]*net.MX),
+		Addr:       make(map[string][]string),
+		TempErrors: make(map[string]bool),
+	}
+}
+
+func (r *FakeResolver) NbLookups() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.nbLookups
+}
+
+func (r *FakeResolver) lookup(name string) (string, error) {
+	r.mutex.Lock()
+	r.nbLookups++
+	r.mutex.Unlock()
+
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if r.TempErrors[key] {
+		return "", NewTemporaryError(name)
+	}
+
+	return key, nil
+}
+
+func (r *FakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	key, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	records, found := r.TXT[key]
+	if !found {
+		return nil, NewNotFoundError(name)
+	}
+
+	return records, nil
+}
+
+func (r *FakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	key, err := r.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, ip := range r.IP[key] {
+		is4 := ip.To4() != nil
+
+		switch {
+		case network == "ip4" && !is4:
+		case network == "ip6" && is4:
+		default:
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, NewNotFoundError(host)
+	}
+
+	return ips, nil
+}
+
+func (r *FakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	key, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	records, found := r.MX[key]
+	if !found {
+		return nil, NewNotFoundError(name)
+	}
+
+	return records, nil
+}
+
+func (r *FakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	key, err := r.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	names, found := r.Addr[key]
+	if !found {
+		return nil, NewNotFoundError(addr)
+	}
+
+	return names, nil
+}
@@ -0,0 +1,46 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Resolver is the subset of net.Resolver methods used for mail
+// authentication and policy checks. It is an interface so that tests can
+// use FakeResolver instead of the network.
+type Resolver interface {
+	LookupTXT(context.Context, string) ([]string, error)
+	LookupIP(context.Context, string, string) ([]net.IP, error)
+	LookupMX(context.Context, string) ([]*net.MX, error)
+	LookupAddr(context.Context, string) ([]string, error)
+}
+
+var DefaultResolver Resolver = net.DefaultResolver
+
+// IsNotFound returns true if an error indicates that a name does not exist
+// or has no record of the requested type (NXDOMAIN or NODATA).
+func IsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+
+	return false
+}
+
+func NewNotFoundError(name string) error {
+	return &net.DNSError{
+		Err:        "no such host",
+		Name:       name,
+		IsNotFound: true,
+	}
+}
+
+func NewTemporaryError(name string) error {
+	return &net.DNSError{
+		Err:         "temporary failure",
+		Name:        name,
+		IsTemporary: true,
+	}
+}
@@ -0,0 +1,319 @@
+package dnsbl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/go-ejson"
+)
+
+// RFC 5782 DNS Blacklists and Whitelists
+
+type ListType string
+
+const (
+	// Listed clients are penalized
+	ListTypeBlock ListType = "block"
+
+	// Listed clients are trusted, compensating entries in block lists
+	ListTypeAllow ListType = "allow"
+)
+
+var ListTypeValues = []ListType{
+	ListTypeBlock,
+	ListTypeAllow,
+}
+
+type Cfg struct {
+	Lists []*ListCfg `json:"lists"`
+
+	// The minimal score for a client to be considered as listed. The score
+	// is the sum of the weights of the block lists containing the client
+	// minus the sum of the weights of the allow lists containing it.
+	Threshold int `json:"threshold,omitempty"` // default: 1
+}
+
+type ListCfg struct {
+	Zone   string   `json:"zone"`
+	Type   ListType `json:"type,omitempty"`   // default: block
+	Weight int      `json:"weight,omitempty"` // default: 1
+
+	// The IPv4 addresses returned by the list which are taken into account,
+	// e.g. to only use some of the sublists of a combined list. If the list
+	// is empty, all addresses in 127.0.0.0/8 are accepted.
+	ReturnCodes []string `json:"return_codes,omitempty"`
+}
+
+func (cfg *Cfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckArrayNotEmpty("lists", cfg.Lists)
+	v.CheckObjectArray("lists", cfg.Lists)
+
+	v.CheckIntMin("threshold", cfg.Threshold, 0)
+}
+
+func (cfg *ListCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("zone", cfg.Zone)
+
+	if cfg.Type != "" {
+		v.CheckStringValue("type", cfg.Type, ListTypeValues)
+	}
+
+	v.CheckIntMin("weight", cfg.Weight, 0)
+
+	v.WithChild("return_codes", func() {
+		for i, code := range cfg.ReturnCodes {
+			v.Check(i, isReturnCode(net.ParseIP(code)),
+				"invalid_return_code", "invalid return code %q", code)
+		}
+	})
+}
+
+// RFC 5782 2.3. Entries are indicated by addresses in 127.0.0.0/8; other
+// addresses are used by some lists to signal errors such as queries sent
+// through public resolvers.
+func isReturnCode(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == 127
+}
+
+type Match struct {
+	Zone      string
+	Type      ListType
+	Weight    int
+	Addresses []net.IP
+	Reason    string // optional, content of the TXT record of the entry
+}
+
+type Result struct {
+	Score   int
+	Listed  bool
+	Matches []*Match
+
+	// Lists which could not be queried are ignored, so that a failing list
+	// does not prevent clients from connecting.
+	Errors []error
+}
+
+func (r *Result) String() string {
+	var zones []string
+	for _, m := range r.Matches {
+		zones = append(zones, m.Zone)
+	}
+
+	s := "not listed"
+	if r.Listed {
+		s = "listed"
+	}
+
+	s += " (score " + strconv.Itoa(r.Score)
+
+	if len(zones) > 0 {
+		s += ": " + strings.Join(zones, ", ")
+	}
+
+	return s + ")"
+}
+
+// BlockMatch returns the block list match with the highest weight, or nil if
+// the client is not in any block list.
+func (r *Result) BlockMatch() *Match {
+	var match *Match
+
+	for _, m := range r.Matches {
+		if m.Type == ListTypeBlock && (match == nil || m.Weight > match.Weight) {
+			match = m
+		}
+	}
+
+	return match
+}
+
+type Checker struct {
+	Cfg      Cfg
+	Resolver dns.Resolver
+	Timeout  time.Duration
+}
+
+func NewChecker(cfg Cfg, resolver dns.Resolver) *Checker {
+	if cfg.Threshold == 0 {
+		cfg.Threshold = 1
+	}
+
+	lists := make([]*ListCfg, len(cfg.Lists))
+
+	for i, list := range cfg.Lists {
+		l := *list
+
+		l.Zone = strings.ToLower(strings.Trim(l.Zone, "."))
+
+		if l.Type == "" {
+			l.Type = ListTypeBlock
+		}
+
+		if l.Weight == 0 {
+			l.Weight = 1
+		}
+
+		lists[i] = &l
+	}
+
+	cfg.Lists = lists
+
+	return &Checker{
+		Cfg:      cfg,
+		Resolver: resolver,
+		Timeout:  10 * time.Second,
+	}
+}
+
+// Check queries all lists for a client address. Lists are queried in
+// parallel.
+func (c *Checker) Check(ctx context.Context, ip net.IP) *Result {
+	var result Result
+
+	name, err := ReverseName(ip)
+	if err != nil {
+		result.Errors = append(result.Errors, err)
+		return &result
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	matches := make([]*Match, len(c.Cfg.Lists))
+	errs := make([]error, len(c.Cfg.Lists))
+
+	var wg sync.WaitGroup
+
+	for i, list := range c.Cfg.Lists {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			matches[i], errs[i] = c.query(ctx, list, name+"."+list.Zone)
+		}()
+	}
+
+	wg.Wait()
+
+	for i, match := range matches {
+		if err := errs[i]; err != nil {
+			result.Errors = append(result.Errors,
+				fmt.Errorf("cannot query %q: %w", c.Cfg.Lists[i].Zone, err))
+			continue
+		}
+
+		if match == nil {
+			continue
+		}
+
+		result.Matches = append(result.Matches, match)
+
+		switch match.Type {
+		case ListTypeBlock:
+			result.Score += match.Weight
+		case ListTypeAllow:
+			result.Score -= match.Weight
+		}
+	}
+
+	result.Listed = result.Score >= c.Cfg.Threshold
+
+	return &result
+}
+
+func (c *Checker) query(ctx context.Context, list *ListCfg, name string) (*Match, error) {
+	ips, err := c.Resolver.LookupIP(ctx, "ip4", name)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var addrs []net.IP
+
+	for _, ip := range ips {
+		if !isReturnCode(ip) {
+			continue
+		}
+
+		if len(list.ReturnCodes) > 0 && !containsIP(list.ReturnCodes, ip) {
+			continue
+		}
+
+		addrs = append(addrs, ip)
+	}
+
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	match := Match{
+		Zone:      list.Zone,
+		Type:      list.Type,
+		Weight:    list.Weight,
+		Addresses: addrs,
+	}
+
+	// RFC 5782 2.1. The TXT record of the entry usually explains why the
+	// address is listed; it is only useful for rejection messages.
+	if list.Type == ListTypeBlock {
+		if records, err := c.Resolver.LookupTXT(ctx, name); err == nil &&
+			len(records) > 0 {
+			match.Reason = records[0]
+		}
+	}
+
+	return &match, nil
+}
+
+func containsIP(codes []string, ip net.IP) bool {
+	for _, code := range codes {
+		if net.ParseIP(code).Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReverseName returns the name used to query a list for an address, without
+// the zone: octets in reverse order for IPv4 addresses (RFC 5782 2.1.) and
+// nibbles in reverse order for IPv6 addresses (RFC 5782 2.4.).
+func ReverseName(ip net.IP) (string, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0]), nil
+	}
+
+	ip6 := ip.To16()
+	if ip6 == nil {
+		return "", fmt.Errorf("invalid ip address %q", ip)
+	}
+
+	const digits = "0123456789abcdef"
+
+	var buf strings.Builder
+
+	for i := len(ip6) - 1; i >= 0; i-- {
+		if i < len(ip6)-1 {
+			buf.WriteByte('.')
+		}
+
+		buf.WriteByte(digits[ip6[i]&0x0f])
+		buf.WriteByte('.')
+		buf.WriteByte(digits[ip6[i]>>4])
+	}
+
+	return buf.String(), nil
+}
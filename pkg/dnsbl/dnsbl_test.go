@@ -0,0 +1,106 @@
+package dnsbl
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/dns"
+)
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		ip   string
+		name string
+	}{
+		{"192.0.2.99", "99.2.0.192"},
+		{"2001:db8:1:2:3:4:567:89ab",
+			"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2"},
+	}
+
+	for _, test := range tests {
+		name, err := ReverseName(net.ParseIP(test.ip))
+		if err != nil {
+			t.Errorf("%s: %v", test.ip, err)
+			continue
+		}
+
+		if name != test.name {
+			t.Errorf("name for %s is %q but should be %q",
+				test.ip, name, test.name)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+
+	resolver.IP["2.2.0.192.bl.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+	resolver.TXT["2.2.0.192.bl.example.com"] = []string{"spam source"}
+	resolver.IP["3.2.0.192.bl.example.com"] = []net.IP{net.ParseIP("127.0.0.10")}
+	resolver.IP["4.2.0.192.bl.example.com"] = []net.IP{net.ParseIP("127.255.255.254")}
+
+	resolver.IP["2.2.0.192.bl2.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+	resolver.IP["5.2.0.192.bl2.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	resolver.IP["5.2.0.192.wl.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+
+	resolver.TempErrors["6.2.0.192.bl.example.com"] = true
+
+	cfg := Cfg{
+		Lists: []*ListCfg{
+			{Zone: "bl.example.com", ReturnCodes: []string{"127.0.0.2"}},
+			{Zone: "bl2.example.com", Weight: 2},
+			{Zone: "wl.example.com", Type: ListTypeAllow, Weight: 5},
+		},
+		Threshold: 3,
+	}
+
+	checker := NewChecker(cfg, resolver)
+
+	tests := []struct {
+		ip     string
+		score  int
+		listed bool
+	}{
+		// Both block lists
+		{"192.0.2.2", 3, true},
+		// Return code filtered out
+		{"192.0.2.3", 0, false},
+		// Error code outside of 127.0.0.0/8
+		{"192.0.2.4", 0, false},
+		// Allow list
+		{"192.0.2.5", -3, false},
+		// Temporary error
+		{"192.0.2.6", 0, false},
+		// Not listed
+		{"192.0.2.7", 0, false},
+	}
+
+	for _, test := range tests {
+		result := checker.Check(context.Background(), net.ParseIP(test.ip))
+
+		if result.Score != test.score || result.Listed != test.listed {
+			t.Errorf("result for %s is %v but should have score %d",
+				test.ip, result, test.score)
+		}
+	}
+
+	result := checker.Check(context.Background(), net.ParseIP("192.0.2.2"))
+
+	if match := result.BlockMatch(); match == nil {
+		t.Errorf("missing block match")
+	} else if match.Zone != "bl2.example.com" {
+		t.Errorf("block match is %q but should be %q", match.Zone,
+			"bl2.example.com")
+	}
+
+	if reason := result.Matches[0].Reason; reason != "spam source" {
+		t.Errorf("reason is %q but should be %q", reason, "spam source")
+	}
+
+	result = checker.Check(context.Background(), net.ParseIP("192.0.2.6"))
+	if len(result.Errors) != 1 {
+		t.Errorf("%d errors returned instead of one", len(result.Errors))
+	}
+}
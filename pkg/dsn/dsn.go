@@ -0,0 +1,370 @@
+package dsn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/mime"
+	"github.com/galdor/emaild/pkg/utils"
+)
+
+// RFC 3464 An Extensible Message Format for Delivery Status Notifications
+
+var (
+	ErrNullReversePath = errors.New("null reverse-path")
+	ErrNoRecipient     = errors.New("no recipient")
+)
+
+type Action string
+
+const (
+	ActionFailed    Action = "failed"
+	ActionDelayed   Action = "delayed"
+	ActionDelivered Action = "delivered"
+	ActionRelayed   Action = "relayed"
+	ActionExpanded  Action = "expanded"
+)
+
+// RFC 3461 4.3. The RET parameter of the ESMTP MAIL command.
+type ReturnType string
+
+const (
+	ReturnFull    ReturnType = "FULL"
+	ReturnHeaders ReturnType = "HDRS"
+)
+
+type Report struct {
+	ReportingMTA   string // usually the public host of the server
+	ReceivedFrom   string // optional
+	EnvelopeId     string // optional, value of the ENVID parameter
+	ArrivalDate    time.Time
+	ReturnType     ReturnType // the default is to return headers only
+	Date           time.Time  // the date of the report, now if zero
+	MessageIdRight imf.Domain // the domain used for the Message-ID field
+
+	Recipients []*RecipientStatus
+}
+
+type RecipientStatus struct {
+	OriginalRecipient *imf.SpecificAddress // optional
+	FinalRecipient    imf.SpecificAddress
+	Action            Action
+	Status            string // e.g. "5.1.1"
+	RemoteMTA         string // optional
+	DiagnosticCode    string // optional, SMTP reply text
+	LastAttemptDate   time.Time
+	WillRetryUntil    time.Time // only used for delayed actions
+}
+
+type Bounce struct {
+	// The envelope of a bounce always has a null reverse-path (RFC 5321
+	// 4.5.5.) so that a failure to deliver it cannot generate another bounce.
+	Recipient imf.SpecificAddress
+	Message   *imf.Message
+}
+
+func GenerateBounce(report *Report, reversePath *imf.SpecificAddress, msg *imf.Message) (*Bounce, error) {
+	// Never bounce a bounce: messages with a null reverse-path are either
+	// notifications themselves or messages whose sender explicitly asked not
+	// to receive any.
+	if reversePath == nil {
+		return nil, ErrNullReversePath
+	}
+
+	if len(report.Recipients) == 0 {
+		return nil, ErrNoRecipient
+	}
+
+	date := report.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	messageId, err := generateMessageId(report)
+	if err != nil {
+		return nil, err
+	}
+
+	boundary, err := generateBoundary()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := generateBody(report, msg, boundary)
+	if err != nil {
+		return nil, err
+	}
+
+	from := imf.Mailbox{
+		SpecificAddress: imf.SpecificAddress{
+			LocalPart: "MAILER-DAEMON",
+			Domain:    imf.Domain(report.ReportingMTA),
+		},
+		DisplayName: utils.Ref("Mail Delivery System"),
+	}
+
+	to := imf.Mailbox{
+		SpecificAddress: *reversePath,
+	}
+
+	subject := "Delivery Status Notification (Failure)"
+	if report.hasOnlyAction(ActionDelayed) {
+		subject = "Delivery Status Notification (Delay)"
+	}
+
+	contentType := "multipart/report; report-type=delivery-status; " +
+		"boundary=\"" + boundary + "\""
+
+	header := []*imf.Field{
+		newField("From", &imf.FromFieldValue{&from}),
+		newField("To", &imf.ToFieldValue{&to}),
+		newField("Subject", utils.Ref(imf.SubjectFieldValue(subject))),
+		newField("Date", utils.Ref(imf.DateFieldValue(date))),
+		newField("Message-ID", utils.Ref(imf.MessageIdFieldValue(messageId))),
+		newField("Auto-Submitted", utils.Ref(imf.OptionalFieldValue("auto-replied"))),
+		newField("MIME-Version", utils.Ref(imf.OptionalFieldValue("1.0"))),
+		newField("Content-Type", utils.Ref(imf.OptionalFieldValue(contentType))),
+	}
+
+	bounce := Bounce{
+		Recipient: *reversePath,
+		Message: &imf.Message{
+			Header: header,
+			Body:   body,
+		},
+	}
+
+	return &bounce, nil
+}
+
+func (r *Report) hasOnlyAction(action Action) bool {
+	for _, rs := range r.Recipients {
+		if rs.Action != action {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newField(name string, value imf.FieldValue) *imf.Field {
+	return &imf.Field{Name: name, Value: value}
+}
+
+func generateMessageId(report *Report) (imf.MessageId, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return imf.MessageId{}, fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	right := report.MessageIdRight
+	if right == "" {
+		right = imf.Domain(report.ReportingMTA)
+	}
+
+	id := imf.MessageId{
+		Left:  "dsn." + hex.EncodeToString(data),
+		Right: right,
+	}
+
+	return id, nil
+}
+
+func generateBoundary() (string, error) {
+	data := make([]byte, 12)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	return "=_" + hex.EncodeToString(data), nil
+}
+
+func generateBody(report *Report, msg *imf.Message, boundary string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	writePartHeader := func(contentType string, fields ...string) {
+		buf.WriteString("--" + boundary + "\r\n")
+		buf.WriteString("Content-Type: " + contentType + "\r\n")
+
+		for _, field := range fields {
+			buf.WriteString(field + "\r\n")
+		}
+
+		buf.WriteString("\r\n")
+	}
+
+	buf.WriteString("This is a MIME-encapsulated message.\r\n\r\n")
+
+	// Human readable part
+	writePartHeader("text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable")
+	buf.WriteString(mime.QuotedPrintableEncode(report.humanReadableText()))
+	buf.WriteString("\r\n")
+
+	// Machine readable part
+	writePartHeader("message/delivery-status")
+	report.writeDeliveryStatus(&buf)
+
+	// Original message or header
+	if msg != nil {
+		if report.ReturnType == ReturnFull {
+			writePartHeader("message/rfc822")
+
+			if err := writeOriginalMessage(&buf, msg, true); err != nil {
+				return nil, err
+			}
+		} else {
+			writePartHeader("text/rfc822-headers")
+
+			if err := writeOriginalMessage(&buf, msg, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	buf.WriteString("--" + boundary + "--\r\n")
+
+	return buf.Bytes(), nil
+}
+
+func (r *Report) humanReadableText() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "This is the mail system at host %s.\n\n",
+		r.ReportingMTA)
+
+	if r.hasOnlyAction(ActionDelayed) {
+		buf.WriteString("Your message could not be delivered yet to the " +
+			"following recipients. Delivery will be retried, you do not " +
+			"have to resend it.\n\n")
+	} else {
+		buf.WriteString("Your message could not be delivered to one or " +
+			"more recipients. It has been returned below.\n\n")
+	}
+
+	for _, rs := range r.Recipients {
+		fmt.Fprintf(&buf, "<%s>: %s", rs.FinalRecipient, rs.Action)
+
+		if rs.DiagnosticCode != "" {
+			fmt.Fprintf(&buf, ": %s", rs.DiagnosticCode)
+		}
+
+		buf.WriteByte('\n')
+	}
+
+	return buf.String()
+}
+
+func (r *Report) writeDeliveryStatus(buf *bytes.Buffer) {
+	// RFC 3464 2.2. Per-Message DSN Fields
+	if r.EnvelopeId != "" {
+		writeDSNField(buf, "Original-Envelope-Id", r.EnvelopeId)
+	}
+
+	writeDSNField(buf, "Reporting-MTA", "dns; "+r.ReportingMTA)
+
+	if r.ReceivedFrom != "" {
+		writeDSNField(buf, "Received-From-MTA", "dns; "+r.ReceivedFrom)
+	}
+
+	if !r.ArrivalDate.IsZero() {
+		writeDSNField(buf, "Arrival-Date", formatDate(r.ArrivalDate))
+	}
+
+	// RFC 3464 2.3. Per-Recipient DSN fields
+	for _, rs := range r.Recipients {
+		buf.WriteString("\r\n")
+
+		if rs.OriginalRecipient != nil {
+			writeDSNField(buf, "Original-Recipient",
+				"rfc822; "+rs.OriginalRecipient.String())
+		}
+
+		writeDSNField(buf, "Final-Recipient",
+			"rfc822; "+rs.FinalRecipient.String())
+		writeDSNField(buf, "Action", string(rs.Action))
+		writeDSNField(buf, "Status", rs.Status)
+
+		if rs.RemoteMTA != "" {
+			writeDSNField(buf, "Remote-MTA", "dns; "+rs.RemoteMTA)
+		}
+
+		if rs.DiagnosticCode != "" {
+			writeDSNField(buf, "Diagnostic-Code", "smtp; "+rs.DiagnosticCode)
+		}
+
+		if !rs.LastAttemptDate.IsZero() {
+			writeDSNField(buf, "Last-Attempt-Date",
+				formatDate(rs.LastAttemptDate))
+		}
+
+		if rs.Action == ActionDelayed && !rs.WillRetryUntil.IsZero() {
+			writeDSNField(buf, "Will-Retry-Until",
+				formatDate(rs.WillRetryUntil))
+		}
+	}
+
+	buf.WriteString("\r\n")
+}
+
+func writeDSNField(buf *bytes.Buffer, name, value string) {
+	// Diagnostic codes are copied from SMTP replies sent by remote servers; we
+	// do not want any control character to end up in the report.
+	value = strings.Map(func(c rune) rune {
+		if c < 32 || c == 127 {
+			return ' '
+		}
+
+		return c
+	}, value)
+
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteString("\r\n")
+}
+
+func formatDate(date time.Time) string {
+	return imf.MustEncodeInlineData(func(e *imf.DataEncoder) error {
+		e.WriteDateTime(date)
+		return nil
+	})
+}
+
+func writeOriginalMessage(buf *bytes.Buffer, msg *imf.Message, withBody bool) error {
+	// We use the raw representation of fields when it is available: the
+	// original message must be returned as it was received, including fields
+	// we failed to parse.
+
+	for _, field := range msg.Header {
+		if field.Raw != "" {
+			buf.WriteString(field.Raw)
+			buf.WriteString("\r\n")
+			continue
+		}
+
+		e := imf.NewDataEncoder(imf.MaxLineLength)
+		if err := e.WriteField(field); err != nil {
+			return fmt.Errorf("cannot encode field %q: %w", field.Name, err)
+		}
+
+		buf.Write(e.Bytes())
+	}
+
+	if withBody && len(msg.Body) > 0 {
+		buf.WriteString("\r\n")
+		buf.Write(msg.Body)
+
+		if !bytes.HasSuffix(msg.Body, []byte("\r\n")) {
+			buf.WriteString("\r\n")
+		}
+	}
+
+	return nil
+}
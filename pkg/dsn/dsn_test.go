@@ -0,0 +1,115 @@
+package dsn
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+func TestGenerateBounce(t *testing.T) {
+	msgData := "From: alice@example.com\r\n" +
+		"To: bob@example.net\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"Hello Bob.\r\n"
+
+	msg, err := imf.NewMessageDecoder().DecodeAll([]byte(msgData))
+	if err != nil {
+		t.Fatalf("cannot decode message: %v", err)
+	}
+
+	reversePath := imf.SpecificAddress{
+		LocalPart: "alice",
+		Domain:    "example.com",
+	}
+
+	report := Report{
+		ReportingMTA: "mx.example.org",
+		ArrivalDate:  time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC),
+		ReturnType:   ReturnHeaders,
+		Recipients: []*RecipientStatus{
+			{
+				FinalRecipient: imf.SpecificAddress{
+					LocalPart: "bob",
+					Domain:    "example.net",
+				},
+				Action:         ActionFailed,
+				Status:         "5.1.1",
+				RemoteMTA:      "mx.example.net",
+				DiagnosticCode: "550 5.1.1 unknown user",
+			},
+		},
+	}
+
+	bounce, err := GenerateBounce(&report, &reversePath, msg)
+	if err != nil {
+		t.Fatalf("cannot generate bounce: %v", err)
+	}
+
+	if bounce.Recipient != reversePath {
+		t.Errorf("bounce is sent to %v but should be sent to %v",
+			bounce.Recipient, reversePath)
+	}
+
+	data, err := imf.NewMessageEncoder(bounce.Message).Encode()
+	if err != nil {
+		t.Fatalf("cannot encode bounce: %v", err)
+	}
+
+	bounceMsg, err := imf.NewMessageDecoder().DecodeAll(data)
+	if err != nil {
+		t.Fatalf("cannot decode bounce: %v", err)
+	}
+
+	for _, field := range bounceMsg.Header {
+		if field.HasError() {
+			t.Errorf("invalid field %q: %s", field.Name, field.Error)
+		}
+	}
+
+	body := string(bounceMsg.Body)
+
+	for _, s := range []string{
+		"Content-Type: message/delivery-status\r\n",
+		"Reporting-MTA: dns; mx.example.org\r\n",
+		"Final-Recipient: rfc822; bob@example.net\r\n",
+		"Action: failed\r\n",
+		"Status: 5.1.1\r\n",
+		"Diagnostic-Code: smtp; 550 5.1.1 unknown user\r\n",
+		"Content-Type: text/rfc822-headers\r\n",
+		"Subject: hello\r\n",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("body does not contain %q", s)
+		}
+	}
+
+	if strings.Contains(body, "Hello Bob.") {
+		t.Errorf("body contains the original body")
+	}
+}
+
+func TestGenerateBounceNullReversePath(t *testing.T) {
+	report := Report{
+		ReportingMTA: "mx.example.org",
+		Recipients: []*RecipientStatus{
+			{
+				FinalRecipient: imf.SpecificAddress{
+					LocalPart: "bob",
+					Domain:    "example.net",
+				},
+				Action: ActionFailed,
+				Status: "5.0.0",
+			},
+		},
+	}
+
+	_, err := GenerateBounce(&report, nil, &imf.Message{})
+	if !errors.Is(err, ErrNullReversePath) {
+		t.Errorf("bounce generation should have failed with %q but "+
+			"returned %v", ErrNullReversePath, err)
+	}
+}
@@ -0,0 +1,191 @@
+package dsn
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+// RFC 3461 SMTP Service Extension for Delivery Status Notifications
+
+// RFC 3461 4.4. The ENVID parameter must not exceed 100 characters.
+const MaxEnvelopeIdLength = 100
+
+// RFC 3461 4.1. The NOTIFY parameter of the ESMTP RCPT command.
+type NotifyCondition string
+
+const (
+	NotifyNever   NotifyCondition = "NEVER"
+	NotifySuccess NotifyCondition = "SUCCESS"
+	NotifyFailure NotifyCondition = "FAILURE"
+	NotifyDelay   NotifyCondition = "DELAY"
+)
+
+// Parameters contains the DSN parameters of a MAIL command.
+type Parameters struct {
+	ReturnType ReturnType // empty if not set
+	EnvelopeId string     // decoded, empty if not set
+}
+
+// RecipientParameters contains the DSN parameters of a RCPT command.
+type RecipientParameters struct {
+	Notify            []NotifyCondition    // empty if not set
+	OriginalRecipient *imf.SpecificAddress // nil if not set
+}
+
+// Notifies returns true if the sender asked to be notified of a delivery
+// status. Without NOTIFY parameter, failures and delays are reported (RFC
+// 3461 4.1.).
+func (p *RecipientParameters) Notifies(condition NotifyCondition) bool {
+	if len(p.Notify) == 0 {
+		return condition == NotifyFailure || condition == NotifyDelay
+	}
+
+	return slices.Contains(p.Notify, condition)
+}
+
+// ParseParameters extracts DSN parameters from the parameters of a MAIL
+// command as returned by smtp.ParsePath. Other parameters are ignored.
+func ParseParameters(params map[string]string) (*Parameters, error) {
+	var p Parameters
+
+	if value, found := params["RET"]; found {
+		switch ReturnType(strings.ToUpper(value)) {
+		case ReturnFull:
+			p.ReturnType = ReturnFull
+		case ReturnHeaders:
+			p.ReturnType = ReturnHeaders
+		default:
+			return nil, fmt.Errorf("invalid RET parameter %q", value)
+		}
+	}
+
+	if value, found := params["ENVID"]; found {
+		id, err := DecodeXText(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENVID parameter: %w", err)
+		}
+
+		if id == "" || len(id) > MaxEnvelopeIdLength {
+			return nil, fmt.Errorf("invalid ENVID parameter length")
+		}
+
+		p.EnvelopeId = id
+	}
+
+	return &p, nil
+}
+
+// ParseRecipientParameters extracts DSN parameters from the parameters of a
+// RCPT command as returned by smtp.ParsePath. Other parameters are ignored.
+func ParseRecipientParameters(params map[string]string) (*RecipientParameters, error) {
+	var p RecipientParameters
+
+	if value, found := params["NOTIFY"]; found {
+		for _, s := range strings.Split(value, ",") {
+			condition := NotifyCondition(strings.ToUpper(s))
+
+			switch condition {
+			case NotifyNever, NotifySuccess, NotifyFailure, NotifyDelay:
+			default:
+				return nil, fmt.Errorf("invalid NOTIFY parameter %q", value)
+			}
+
+			if slices.Contains(p.Notify, condition) {
+				return nil, fmt.Errorf("duplicate NOTIFY condition %q", s)
+			}
+
+			p.Notify = append(p.Notify, condition)
+		}
+
+		// RFC 3461 4.1. NEVER cannot be combined with other conditions.
+		if len(p.Notify) > 1 && slices.Contains(p.Notify, NotifyNever) {
+			return nil, fmt.Errorf("invalid NOTIFY parameter %q", value)
+		}
+	}
+
+	if value, found := params["ORCPT"]; found {
+		addr, err := parseOriginalRecipient(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ORCPT parameter: %w", err)
+		}
+
+		p.OriginalRecipient = addr
+	}
+
+	return &p, nil
+}
+
+func parseOriginalRecipient(s string) (*imf.SpecificAddress, error) {
+	// RFC 3461 4.2. The value is an address type followed by an
+	// xtext-encoded address. Other address types than rfc822 are accepted
+	// but not reported.
+	addrType, value, found := strings.Cut(s, ";")
+	if !found {
+		return nil, fmt.Errorf("missing address type")
+	}
+
+	if !strings.EqualFold(addrType, "rfc822") {
+		return nil, nil
+	}
+
+	value, err := DecodeXText(value)
+	if err != nil {
+		return nil, err
+	}
+
+	d := imf.NewDataDecoder([]byte(value))
+
+	addr, err := d.ReadSpecificAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Empty() {
+		return nil, fmt.Errorf("invalid trailing data")
+	}
+
+	return addr, nil
+}
+
+// DecodeXText decodes a string encoded with the xtext encoding (RFC 3461
+// 4.), where "+" followed by two upper case hexadecimal digits represents
+// a character.
+func DecodeXText(s string) (string, error) {
+	var buf strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == '+':
+			if i+2 >= len(s) || !isXTextHexDigit(s[i+1]) ||
+				!isXTextHexDigit(s[i+2]) {
+				return "", fmt.Errorf("invalid hexchar sequence")
+			}
+
+			n, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if n < 32 || n > 126 {
+				return "", fmt.Errorf("invalid encoded character 0x%02x", n)
+			}
+
+			buf.WriteByte(byte(n))
+			i += 2
+
+		case c >= '!' && c <= '~' && c != '=':
+			buf.WriteByte(c)
+
+		default:
+			return "", fmt.Errorf("invalid character 0x%02x", c)
+		}
+	}
+
+	return buf.String(), nil
+}
+
+func isXTextHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'F')
+}
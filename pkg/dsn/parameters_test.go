@@ -0,0 +1,109 @@
+package dsn
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+func TestParseParameters(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		result *Parameters // nil if the parameters are invalid
+	}{
+		{map[string]string{}, &Parameters{}},
+		{map[string]string{"SIZE": "42"}, &Parameters{}},
+		{map[string]string{"RET": "full"}, &Parameters{ReturnType: ReturnFull}},
+		{map[string]string{"RET": "HDRS", "ENVID": "a+2Bb"},
+			&Parameters{ReturnType: ReturnHeaders, EnvelopeId: "a+b"}},
+		{map[string]string{"RET": "BODY"}, nil},
+		{map[string]string{"ENVID": ""}, nil},
+		{map[string]string{"ENVID": "a+2b"}, nil},
+		{map[string]string{"ENVID": "a+0A"}, nil},
+	}
+
+	for _, test := range tests {
+		result, err := ParseParameters(test.params)
+
+		switch {
+		case test.result == nil && err == nil:
+			t.Errorf("parameters %v should have been rejected", test.params)
+
+		case test.result != nil && err != nil:
+			t.Errorf("cannot parse parameters %v: %v", test.params, err)
+
+		case test.result != nil && *result != *test.result:
+			t.Errorf("parameters %v were parsed as %#v instead of %#v",
+				test.params, result, test.result)
+		}
+	}
+}
+
+func TestParseRecipientParameters(t *testing.T) {
+	bob := imf.SpecificAddress{LocalPart: "bob+x", Domain: "example.net"}
+
+	tests := []struct {
+		params            map[string]string
+		notify            []NotifyCondition
+		originalRecipient *imf.SpecificAddress
+		valid             bool
+	}{
+		{map[string]string{}, nil, nil, true},
+		{map[string]string{"NOTIFY": "never"},
+			[]NotifyCondition{NotifyNever}, nil, true},
+		{map[string]string{"NOTIFY": "SUCCESS,FAILURE"},
+			[]NotifyCondition{NotifySuccess, NotifyFailure}, nil, true},
+		{map[string]string{"ORCPT": "rfc822;bob+2Bx@example.net"},
+			nil, &bob, true},
+		{map[string]string{"ORCPT": "x400;c=fr"}, nil, nil, true},
+		{map[string]string{"NOTIFY": "NEVER,DELAY"}, nil, nil, false},
+		{map[string]string{"NOTIFY": "FAILURE,FAILURE"}, nil, nil, false},
+		{map[string]string{"NOTIFY": "ALWAYS"}, nil, nil, false},
+		{map[string]string{"ORCPT": "bob@example.net"}, nil, nil, false},
+		{map[string]string{"ORCPT": "rfc822;bob"}, nil, nil, false},
+	}
+
+	for _, test := range tests {
+		result, err := ParseRecipientParameters(test.params)
+
+		if !test.valid {
+			if err == nil {
+				t.Errorf("parameters %v should have been rejected",
+					test.params)
+			}
+
+			continue
+		} else if err != nil {
+			t.Errorf("cannot parse parameters %v: %v", test.params, err)
+			continue
+		}
+
+		if !slices.Equal(result.Notify, test.notify) {
+			t.Errorf("parameters %v have notify conditions %v instead of %v",
+				test.params, result.Notify, test.notify)
+		}
+
+		addr := result.OriginalRecipient
+		if (addr == nil) != (test.originalRecipient == nil) ||
+			(addr != nil && *addr != *test.originalRecipient) {
+			t.Errorf("parameters %v have original recipient %v instead "+
+				"of %v", test.params, addr, test.originalRecipient)
+		}
+	}
+}
+
+func TestRecipientParametersNotifies(t *testing.T) {
+	var p RecipientParameters
+
+	if !p.Notifies(NotifyFailure) || !p.Notifies(NotifyDelay) ||
+		p.Notifies(NotifySuccess) {
+		t.Errorf("invalid default notify conditions")
+	}
+
+	p.Notify = []NotifyCondition{NotifyNever}
+
+	if p.Notifies(NotifyFailure) {
+		t.Errorf("failures notified with NOTIFY=NEVER")
+	}
+}
@@ -0,0 +1,394 @@
+package greylist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-ejson"
+	"github.com/galdor/go-log"
+)
+
+// Greylisting temporarily rejects the first delivery attempt of each
+// (client network, sender, recipient) triplet. Legitimate servers retry after
+// a while and are accepted, while most spam software never retries.
+
+const (
+	DefaultDelay              = 5 * 60         // 5 minutes
+	DefaultRetryWindow        = 2 * 24 * 3600  // 2 days
+	DefaultExpiration         = 36 * 24 * 3600 // 36 days
+	DefaultAutoWhitelistCount = 5
+	DefaultIPv4PrefixLength   = 24
+	DefaultIPv6PrefixLength   = 64
+	SaveInterval              = time.Minute
+)
+
+type Cfg struct {
+	Log *log.Logger `json:"-"`
+
+	// The file used to store triplets and whitelisted clients
+	Path string `json:"path"`
+
+	// The minimal time before a retry is accepted (seconds)
+	Delay int `json:"delay,omitempty"`
+
+	// The maximal time between the first attempt and an accepted retry
+	// (seconds); later retries restart the process.
+	RetryWindow int `json:"retry_window,omitempty"`
+
+	// The time after which unused triplets and whitelisted clients are
+	// forgotten (seconds).
+	Expiration int `json:"expiration,omitempty"`
+
+	// The number of triplets a client must have successfully retried to be
+	// whitelisted; zero to disable automatic whitelisting.
+	AutoWhitelistCount *int `json:"auto_whitelist_count,omitempty"`
+
+	// Clients are identified by network rather than by address since large
+	// senders often retry from a different address.
+	IPv4PrefixLength int `json:"ipv4_prefix_length,omitempty"`
+	IPv6PrefixLength int `json:"ipv6_prefix_length,omitempty"`
+}
+
+func (cfg *Cfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("path", cfg.Path)
+
+	v.CheckIntMin("delay", cfg.Delay, 0)
+	v.CheckIntMin("retry_window", cfg.RetryWindow, 0)
+	v.CheckIntMin("expiration", cfg.Expiration, 0)
+
+	if cfg.AutoWhitelistCount != nil {
+		v.CheckIntMin("auto_whitelist_count", *cfg.AutoWhitelistCount, 0)
+	}
+
+	v.CheckIntMinMax("ipv4_prefix_length", cfg.IPv4PrefixLength, 0, 32)
+	v.CheckIntMinMax("ipv6_prefix_length", cfg.IPv6PrefixLength, 0, 128)
+}
+
+type Triplet struct {
+	Network   string `json:"network"`
+	Sender    string `json:"sender"` // empty for the null reverse-path
+	Recipient string `json:"recipient"`
+
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Passed    bool      `json:"passed"`
+}
+
+func (t *Triplet) key() string {
+	return t.Network + " " + t.Sender + " " + t.Recipient
+}
+
+type Client struct {
+	Network  string    `json:"network"`
+	NbPasses int       `json:"nb_passes"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type state struct {
+	Triplets []*Triplet `json:"triplets"`
+	Clients  []*Client  `json:"clients"`
+}
+
+type Greylist struct {
+	Cfg Cfg
+	Log *log.Logger
+
+	triplets map[string]*Triplet
+	clients  map[string]*Client
+	modified bool
+	mutex    sync.Mutex
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewGreylist(cfg Cfg) (*Greylist, error) {
+	if cfg.Delay == 0 {
+		cfg.Delay = DefaultDelay
+	}
+
+	if cfg.RetryWindow == 0 {
+		cfg.RetryWindow = DefaultRetryWindow
+	}
+
+	if cfg.Expiration == 0 {
+		cfg.Expiration = DefaultExpiration
+	}
+
+	if cfg.AutoWhitelistCount == nil {
+		count := DefaultAutoWhitelistCount
+		cfg.AutoWhitelistCount = &count
+	}
+
+	if cfg.IPv4PrefixLength == 0 {
+		cfg.IPv4PrefixLength = DefaultIPv4PrefixLength
+	}
+
+	if cfg.IPv6PrefixLength == 0 {
+		cfg.IPv6PrefixLength = DefaultIPv6PrefixLength
+	}
+
+	g := Greylist{
+		Cfg: cfg,
+		Log: cfg.Log,
+
+		triplets: make(map[string]*Triplet),
+		clients:  make(map[string]*Client),
+
+		stopChan: make(chan struct{}),
+	}
+
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+func (g *Greylist) Start() error {
+	g.wg.Add(1)
+	go g.main()
+
+	return nil
+}
+
+func (g *Greylist) Stop() {
+	close(g.stopChan)
+	g.wg.Wait()
+
+	if err := g.save(); err != nil {
+		g.Log.Error("cannot save greylist: %v", err)
+	}
+}
+
+func (g *Greylist) main() {
+	defer g.wg.Done()
+
+	ticker := time.NewTicker(SaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.stopChan:
+			return
+
+		case <-ticker.C:
+			g.expire(time.Now())
+
+			if err := g.save(); err != nil {
+				g.Log.Error("cannot save greylist: %v", err)
+			}
+		}
+	}
+}
+
+// Check returns true if a delivery attempt is accepted, or false if it must
+// be temporarily rejected.
+func (g *Greylist) Check(ip net.IP, sender, recipient string, now time.Time) bool {
+	network := g.network(ip)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// Only changes of state are worth saving: last seen dates are saved
+	// along with them, and losing some of them on restart only shortens
+	// the lifetime of a few entries.
+
+	client := g.clients[network]
+	if client != nil && now.Sub(client.LastSeen) > g.expiration() {
+		delete(g.clients, network)
+		client = nil
+		g.modified = true
+	}
+
+	if client != nil && g.isWhitelisted(client) {
+		client.LastSeen = now
+		return true
+	}
+
+	t := Triplet{
+		Network:   network,
+		Sender:    strings.ToLower(sender),
+		Recipient: strings.ToLower(recipient),
+	}
+
+	key := t.key()
+
+	triplet := g.triplets[key]
+
+	switch {
+	case triplet == nil,
+		triplet.Passed && now.Sub(triplet.LastSeen) > g.expiration(),
+		!triplet.Passed && now.Sub(triplet.FirstSeen) > g.retryWindow():
+		// New triplet, or triplet which must start over
+		t.FirstSeen = now
+		t.LastSeen = now
+		g.triplets[key] = &t
+		g.modified = true
+		return false
+
+	case triplet.Passed:
+		triplet.LastSeen = now
+		return true
+
+	case now.Sub(triplet.FirstSeen) < g.delay():
+		// Retry before the end of the delay; it does not restart the delay
+		// so that clients retrying too often are eventually accepted.
+		triplet.LastSeen = now
+		return false
+	}
+
+	// The client retried correctly
+	triplet.Passed = true
+	triplet.LastSeen = now
+	g.modified = true
+
+	if client == nil {
+		client = &Client{Network: network}
+		g.clients[network] = client
+	}
+
+	client.NbPasses++
+	client.LastSeen = now
+
+	if g.isWhitelisted(client) {
+		g.Log.Debug(1, "client network %s whitelisted", network)
+	}
+
+	return true
+}
+
+func (g *Greylist) isWhitelisted(client *Client) bool {
+	count := *g.Cfg.AutoWhitelistCount
+	return count > 0 && client.NbPasses >= count
+}
+
+func (g *Greylist) network(ip net.IP) string {
+	var mask net.IPMask
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = net.CIDRMask(g.Cfg.IPv4PrefixLength, 32)
+	} else {
+		mask = net.CIDRMask(g.Cfg.IPv6PrefixLength, 128)
+	}
+
+	network := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return network.String()
+}
+
+func (g *Greylist) delay() time.Duration {
+	return time.Duration(g.Cfg.Delay) * time.Second
+}
+
+func (g *Greylist) retryWindow() time.Duration {
+	return time.Duration(g.Cfg.RetryWindow) * time.Second
+}
+
+func (g *Greylist) expiration() time.Duration {
+	return time.Duration(g.Cfg.Expiration) * time.Second
+}
+
+func (g *Greylist) expire(now time.Time) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for key, t := range g.triplets {
+		if (t.Passed && now.Sub(t.LastSeen) > g.expiration()) ||
+			(!t.Passed && now.Sub(t.FirstSeen) > g.retryWindow()) {
+			delete(g.triplets, key)
+			g.modified = true
+		}
+	}
+
+	for network, client := range g.clients {
+		if now.Sub(client.LastSeen) > g.expiration() {
+			delete(g.clients, network)
+			g.modified = true
+		}
+	}
+}
+
+func (g *Greylist) load() error {
+	data, err := os.ReadFile(g.Cfg.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("cannot read %q: %w", g.Cfg.Path, err)
+	}
+
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("cannot decode %q: %w", g.Cfg.Path, err)
+	}
+
+	for _, t := range s.Triplets {
+		g.triplets[t.key()] = t
+	}
+
+	for _, c := range s.Clients {
+		g.clients[c.Network] = c
+	}
+
+	return nil
+}
+
+func (g *Greylist) save() error {
+	if err := g.writeState(); err != nil {
+		// Try again next time
+		g.mutex.Lock()
+		g.modified = true
+		g.mutex.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+func (g *Greylist) writeState() error {
+	g.mutex.Lock()
+
+	if !g.modified {
+		g.mutex.Unlock()
+		return nil
+	}
+
+	var s state
+
+	for _, t := range g.triplets {
+		t2 := *t
+		s.Triplets = append(s.Triplets, &t2)
+	}
+
+	for _, c := range g.clients {
+		c2 := *c
+		s.Clients = append(s.Clients, &c2)
+	}
+
+	g.modified = false
+
+	g.mutex.Unlock()
+
+	data, err := json.Marshal(&s)
+	if err != nil {
+		return fmt.Errorf("cannot encode state: %w", err)
+	}
+
+	if err := os.MkdirAll(path.Dir(g.Cfg.Path), 0700); err != nil {
+		return fmt.Errorf("cannot create directory %q: %w",
+			path.Dir(g.Cfg.Path), err)
+	}
+
+	return utils.WriteFileAtomically(g.Cfg.Path, data)
+}
@@ -0,0 +1,141 @@
+package greylist
+
+import (
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-log"
+)
+
+func newTestGreylist(t *testing.T, filePath string) *Greylist {
+	count := 2
+
+	g, err := NewGreylist(Cfg{
+		Log:                log.DefaultLogger("test"),
+		Path:               filePath,
+		AutoWhitelistCount: &count,
+	})
+	if err != nil {
+		t.Fatalf("cannot create greylist: %v", err)
+	}
+
+	return g
+}
+
+func TestGreylist(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "greylist.json")
+
+	g := newTestGreylist(t, filePath)
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	ip := net.ParseIP("192.0.2.10")
+
+	tests := []struct {
+		ip        net.IP
+		sender    string
+		recipient string
+		delay     time.Duration
+		accepted  bool
+	}{
+		// First attempt
+		{ip, "alice@example.org", "bob@example.com", 0, false},
+		// Retry too early
+		{ip, "alice@example.org", "bob@example.com", time.Minute, false},
+		// Retry after the delay from another address of the same network
+		{net.ParseIP("192.0.2.20"), "alice@example.org", "bob@example.com",
+			5 * time.Minute, true},
+		// Known triplet
+		{ip, "Alice@example.org", "bob@example.com", time.Hour, true},
+		// New triplet, retried too late
+		{ip, "", "bob@example.com", 0, false},
+		{ip, "", "bob@example.com", 3 * 24 * time.Hour, false},
+		{ip, "", "bob@example.com", 10 * time.Minute, true},
+		// The network is now whitelisted
+		{ip, "carol@example.org", "bob@example.com", 0, true},
+		// Other networks are not
+		{net.ParseIP("198.51.100.1"), "alice@example.org", "bob@example.com",
+			0, false},
+	}
+
+	for i, test := range tests {
+		now = now.Add(test.delay)
+
+		accepted := g.Check(test.ip, test.sender, test.recipient, now)
+		if accepted != test.accepted {
+			t.Errorf("test %d: attempt from %s (%q -> %q) accepted: %v",
+				i, test.ip, test.sender, test.recipient, accepted)
+		}
+	}
+
+	if err := g.save(); err != nil {
+		t.Fatalf("cannot save greylist: %v", err)
+	}
+
+	// State must survive restarts
+	g = newTestGreylist(t, filePath)
+
+	if !g.Check(ip, "dave@example.org", "bob@example.com", now) {
+		t.Errorf("whitelisted client rejected after reload")
+	}
+
+	now = now.Add(10 * time.Minute)
+	if !g.Check(net.ParseIP("198.51.100.1"), "alice@example.org",
+		"bob@example.com", now) {
+		t.Errorf("retry rejected after reload")
+	}
+}
+
+func TestGreylistExpiration(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "greylist.json")
+
+	g := newTestGreylist(t, filePath)
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	ip := net.ParseIP("192.0.2.10")
+
+	g.Check(ip, "alice@example.org", "bob@example.com", now)
+	g.Check(ip, "carol@example.org", "bob@example.com", now)
+
+	now = now.Add(10 * time.Minute)
+	g.Check(ip, "alice@example.org", "bob@example.com", now)
+
+	if err := g.save(); err != nil {
+		t.Fatalf("cannot save greylist: %v", err)
+	}
+
+	// Attempts which do not change the state of a triplet must not cause
+	// the state to be saved again.
+	now = now.Add(time.Minute)
+	g.Check(ip, "alice@example.org", "bob@example.com", now)
+
+	if g.modified {
+		t.Errorf("greylist modified by a known triplet")
+	}
+
+	// Triplets which were never retried expire after the retry window,
+	// others after the expiration delay.
+	g.expire(now.Add(3 * 24 * time.Hour))
+
+	if len(g.triplets) != 1 {
+		t.Errorf("%d triplets left after the retry window instead of 1",
+			len(g.triplets))
+	}
+
+	g.expire(now.Add(40 * 24 * time.Hour))
+
+	if len(g.triplets) != 0 {
+		t.Errorf("%d triplets left after expiration instead of 0",
+			len(g.triplets))
+	}
+
+	if len(g.clients) != 0 {
+		t.Errorf("%d clients left after expiration instead of 0",
+			len(g.clients))
+	}
+
+	if !g.modified {
+		t.Errorf("greylist not modified by expiration")
+	}
+}
@@ -0,0 +1,370 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	stdmime "mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/mime"
+)
+
+// bodyPart is a MIME entity (RFC 2045) as seen by FETCH: message parts are
+// parsed on demand to build body structures and to extract sections.
+type bodyPart struct {
+	data   []byte // header and body
+	header []byte // including the empty line ending it
+	body   []byte
+
+	fields []mime.HeaderField
+
+	mediaType    string // lower case
+	mediaSubtype string // lower case
+	params       map[string]string
+
+	parts   []*bodyPart // multipart entities
+	message *bodyPart   // message/rfc822 entities
+}
+
+func parseBodyPart(data []byte, defaultType string) *bodyPart {
+	p := bodyPart{data: data}
+
+	p.header, p.body = mime.SplitHeader(data)
+	p.fields = mime.ParseHeaderFields(p.header)
+
+	mediaType, params, err := stdmime.ParseMediaType(p.field("Content-Type"))
+	if err != nil {
+		mediaType, params = defaultType, nil
+	}
+
+	p.mediaType, p.mediaSubtype, _ = strings.Cut(mediaType, "/")
+	p.params = params
+
+	if p.mediaType == "text" && p.params["charset"] == "" {
+		if p.params == nil {
+			p.params = make(map[string]string)
+		}
+
+		p.params["charset"] = "us-ascii"
+	}
+
+	switch {
+	case p.mediaType == "multipart":
+		childType := "text/plain"
+		if p.mediaSubtype == "digest" {
+			childType = "message/rfc822"
+		}
+
+		for _, partData := range mime.SplitMultipartBody(p.body, p.params["boundary"]) {
+			p.parts = append(p.parts, parseBodyPart(partData, childType))
+		}
+
+		if len(p.parts) == 0 {
+			// A multipart entity must contain at least one part
+			p.mediaType, p.mediaSubtype = "text", "plain"
+			p.params = map[string]string{"charset": "us-ascii"}
+		}
+
+	case p.mediaType == "message" && p.mediaSubtype == "rfc822":
+		p.message = parseBodyPart(p.body, "text/plain")
+	}
+
+	return &p
+}
+
+func (p *bodyPart) field(name string) string {
+	for _, field := range p.fields {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+
+	return ""
+}
+
+// RFC 9051 7.5.2. BODYSTRUCTURE; extension data are only included if
+// extended is true (BODYSTRUCTURE instead of BODY).
+func (p *bodyPart) writeStructure(buf *bytes.Buffer, extended bool) {
+	buf.WriteByte('(')
+
+	if p.parts != nil {
+		for _, part := range p.parts {
+			part.writeStructure(buf, extended)
+		}
+
+		buf.WriteByte(' ')
+		buf.WriteString(encodeString(strings.ToUpper(p.mediaSubtype)))
+
+		if extended {
+			buf.WriteByte(' ')
+			writeBodyParameters(buf, p.params)
+			buf.WriteByte(' ')
+			p.writeExtensionData(buf)
+		}
+
+		buf.WriteByte(')')
+		return
+	}
+
+	encoding := p.field("Content-Transfer-Encoding")
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+
+	fmt.Fprintf(buf, "%s %s ",
+		encodeString(strings.ToUpper(p.mediaType)),
+		encodeString(strings.ToUpper(p.mediaSubtype)))
+
+	writeBodyParameters(buf, p.params)
+
+	fmt.Fprintf(buf, " %s %s %s %d",
+		encodeNString(p.field("Content-ID")),
+		encodeNString(p.field("Content-Description")),
+		encodeString(strings.ToUpper(encoding)),
+		len(p.body))
+
+	if p.message != nil {
+		buf.WriteByte(' ')
+		writeEnvelope(buf, mailstore.ParseEnvelope(p.message.data))
+		buf.WriteByte(' ')
+		p.message.writeStructure(buf, extended)
+		fmt.Fprintf(buf, " %d", countLines(p.body))
+	} else if p.mediaType == "text" {
+		fmt.Fprintf(buf, " %d", countLines(p.body))
+	}
+
+	if extended {
+		buf.WriteString(" ")
+		buf.WriteString(encodeNString(p.field("Content-MD5")))
+		buf.WriteByte(' ')
+		p.writeExtensionData(buf)
+	}
+
+	buf.WriteByte(')')
+}
+
+func (p *bodyPart) writeExtensionData(buf *bytes.Buffer) {
+	disposition, params, err := stdmime.ParseMediaType(p.field("Content-Disposition"))
+	if err == nil {
+		fmt.Fprintf(buf, "(%s ", encodeString(disposition))
+		writeBodyParameters(buf, params)
+		buf.WriteByte(')')
+	} else {
+		buf.WriteString("NIL")
+	}
+
+	fmt.Fprintf(buf, " %s %s",
+		encodeNString(p.field("Content-Language")),
+		encodeNString(p.field("Content-Location")))
+}
+
+func writeBodyParameters(buf *bytes.Buffer, params map[string]string) {
+	if len(params) == 0 {
+		buf.WriteString("NIL")
+		return
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf.WriteByte('(')
+
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		fmt.Fprintf(buf, "%s %s", encodeString(strings.ToUpper(name)),
+			encodeString(params[name]))
+	}
+
+	buf.WriteByte(')')
+}
+
+func countLines(data []byte) int {
+	n := bytes.Count(data, []byte{'\n'})
+
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		n++
+	}
+
+	return n
+}
+
+// RFC 9051 6.4.5. Body sections
+type section struct {
+	Part      []int
+	Specifier string // "", "HEADER", "HEADER.FIELDS", "HEADER.FIELDS.NOT", "TEXT" or "MIME"
+	Fields    []string
+}
+
+func parseSection(s string) (*section, error) {
+	var sec section
+
+	spec, fieldList, hasFields := strings.Cut(s, " ")
+
+	parts := strings.Split(spec, ".")
+
+	for len(parts) > 0 {
+		n, err := strconv.Atoi(parts[0])
+		if err != nil {
+			break
+		}
+
+		if n <= 0 {
+			return nil, syntaxErrorf("invalid section part %q", parts[0])
+		}
+
+		sec.Part = append(sec.Part, n)
+		parts = parts[1:]
+	}
+
+	sec.Specifier = strings.ToUpper(strings.Join(parts, "."))
+
+	switch sec.Specifier {
+	case "", "HEADER", "TEXT":
+	case "MIME":
+		if len(sec.Part) == 0 {
+			return nil, syntaxErrorf("invalid MIME section")
+		}
+
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		if !hasFields {
+			return nil, syntaxErrorf("missing header field list")
+		}
+
+		fieldList, found := strings.CutPrefix(fieldList, "(")
+		fieldList, found2 := strings.CutSuffix(fieldList, ")")
+		if !found || !found2 {
+			return nil, syntaxErrorf("invalid header field list")
+		}
+
+		for _, name := range strings.Fields(fieldList) {
+			name = strings.Trim(name, `"`)
+			sec.Fields = append(sec.Fields, strings.ToUpper(name))
+		}
+
+		if len(sec.Fields) == 0 {
+			return nil, syntaxErrorf("empty header field list")
+		}
+
+		return &sec, nil
+
+	default:
+		return nil, syntaxErrorf("invalid section specifier %q", sec.Specifier)
+	}
+
+	if hasFields {
+		return nil, syntaxErrorf("invalid section %q", s)
+	}
+
+	return &sec, nil
+}
+
+func (sec *section) String() string {
+	var buf strings.Builder
+
+	for i, n := range sec.Part {
+		if i > 0 {
+			buf.WriteByte('.')
+		}
+
+		buf.WriteString(strconv.Itoa(n))
+	}
+
+	if sec.Specifier != "" {
+		if len(sec.Part) > 0 {
+			buf.WriteByte('.')
+		}
+
+		buf.WriteString(sec.Specifier)
+	}
+
+	if len(sec.Fields) > 0 {
+		buf.WriteString(" (")
+		buf.WriteString(strings.Join(sec.Fields, " "))
+		buf.WriteByte(')')
+	}
+
+	return buf.String()
+}
+
+// sectionData returns the content of a section of a message, or nil if the
+// section does not exist.
+func (p *bodyPart) sectionData(sec *section) []byte {
+	part := p
+
+	for i, n := range sec.Part {
+		// Part numbers following a message/rfc822 part refer to the parts
+		// of the encapsulated message.
+		if i > 0 && part.message != nil {
+			part = part.message
+		}
+
+		if part.parts != nil {
+			if n > len(part.parts) {
+				return nil
+			}
+
+			part = part.parts[n-1]
+		} else if n != 1 {
+			// Non-multipart messages have a single part
+			return nil
+		}
+	}
+
+	msg := part
+	if len(sec.Part) > 0 {
+		switch sec.Specifier {
+		case "":
+			return part.body
+		case "MIME":
+			return part.header
+		}
+
+		// Other specifiers only apply to encapsulated messages
+		if part.message == nil {
+			return nil
+		}
+
+		msg = part.message
+	}
+
+	switch sec.Specifier {
+	case "":
+		return msg.data
+
+	case "HEADER":
+		return msg.header
+
+	case "TEXT":
+		return msg.body
+
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		var data []byte
+
+		for _, field := range msg.fields {
+			selected := false
+			for _, name := range sec.Fields {
+				if strings.EqualFold(field.Name, name) {
+					selected = true
+					break
+				}
+			}
+
+			if selected == (sec.Specifier == "HEADER.FIELDS") {
+				data = append(data, field.Raw...)
+			}
+		}
+
+		return append(data, '\r', '\n')
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package imap
+
+import (
+	"strconv"
+)
+
+// RFC 7162 IMAP Extensions: Quick Flag Changes Resynchronization (CONDSTORE)
+// and Quick Mailbox Resynchronization (QRESYNC)
+//
+// All changes of a message (flags for the time being) share the modification
+// sequence of the message; metadata entry names used in SEARCH are accepted
+// but ignored.
+
+type qresyncParameters struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   *sequenceSet // optional
+}
+
+func modSeqArgument(value any) (uint64, error) {
+	s, ok := atomValue(value)
+	if !ok {
+		return 0, syntaxErrorf("invalid modification sequence")
+	}
+
+	// RFC 7162 7. mod-sequence-value is limited to 63 bits
+	modSeq, err := strconv.ParseUint(s, 10, 63)
+	if err != nil {
+		return 0, syntaxErrorf("invalid modification sequence %q", s)
+	}
+
+	return modSeq, nil
+}
+
+// parseQResyncParameters parses the QRESYNC parameter of SELECT and EXAMINE
+// (RFC 7162 3.2.5.). Sequence match data are ignored: they only help servers
+// which do not keep track of expunged messages.
+func parseQResyncParameters(value any) (*qresyncParameters, error) {
+	values, ok := listValue(value)
+	if !ok || len(values) < 2 || len(values) > 4 {
+		return nil, syntaxErrorf("invalid QRESYNC parameters")
+	}
+
+	var params qresyncParameters
+
+	s, _ := atomValue(values[0])
+	uidValidity, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || uidValidity == 0 {
+		return nil, syntaxErrorf("invalid UIDVALIDITY value")
+	}
+
+	params.uidValidity = uint32(uidValidity)
+
+	if params.modSeq, err = modSeqArgument(values[1]); err != nil {
+		return nil, err
+	}
+
+	values = values[2:]
+
+	if len(values) > 0 {
+		if _, isList := listValue(values[0]); !isList {
+			set, err := parseSequenceSet(values[0])
+			if err != nil {
+				return nil, err
+			}
+
+			if set.Saved {
+				return nil, syntaxErrorf("invalid known UIDs")
+			}
+
+			params.knownUIDs = set
+			values = values[1:]
+		}
+	}
+
+	if len(values) > 0 {
+		if seqMatchData, ok := listValue(values[0]); !ok || len(seqMatchData) != 2 {
+			return nil, syntaxErrorf("invalid sequence match data")
+		}
+	}
+
+	return &params, nil
+}
+
+// resynchronize sends the changes made to the selected mailbox since the
+// modification sequence known by the client (RFC 7162 3.2.5.1.).
+func (c *ServerConn) resynchronize(params *qresyncParameters) error {
+	mb := c.selected
+
+	// The client must discard its cache if UIDVALIDITY changed
+	if params.uidValidity != mb.uidValidity {
+		return nil
+	}
+
+	if err := c.writeVanishedEarlier(params.modSeq, params.knownUIDs); err != nil {
+		return err
+	}
+
+	msgs, err := c.selectedMessages()
+	if err != nil {
+		return err
+	}
+
+	for i, uid := range mb.uids {
+		msg := msgs[uid]
+		if msg == nil || msg.ModSeq <= params.modSeq {
+			continue
+		}
+
+		flags := encodeFlags(msg.Flags)
+		mb.flags[uid] = flags
+
+		c.writeUntagged("%d FETCH (UID %d FLAGS %s MODSEQ (%d))", i+1, uid,
+			flags, msg.ModSeq)
+	}
+
+	return nil
+}
+
+// writeVanishedEarlier sends the UIDs of the messages expunged after a
+// modification sequence and contained in a UID set if it is not nil.
+func (c *ServerConn) writeVanishedEarlier(modSeq uint64, set *sequenceSet) error {
+	expungedUIDs, err := c.account.ExpungedMessages(c.selected.name, modSeq)
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	largest := c.selected.lastUID()
+	for _, uid := range expungedUIDs {
+		largest = max(largest, uid)
+	}
+
+	var uids []uint32
+
+	for _, uid := range expungedUIDs {
+		if set == nil || set.contains(uid, largest) {
+			uids = append(uids, uid)
+		}
+	}
+
+	if len(uids) > 0 {
+		c.writeUntagged("VANISHED (EARLIER) %s", formatSequenceSet(uids))
+	}
+
+	return nil
+}
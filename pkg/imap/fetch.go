@@ -0,0 +1,451 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+// RFC 9051 6.4.5. FETCH Command
+
+type fetchItem struct {
+	Name    string   // upper case, "BODY[]" for sections
+	Section *section // BODY[] only
+	Peek    bool
+	Partial *[2]int64 // offset and size
+}
+
+func (item *fetchItem) needsData() bool {
+	return item.Section != nil || item.Name == "BODY" ||
+		item.Name == "BODYSTRUCTURE"
+}
+
+func parseFetchItems(value any) ([]*fetchItem, error) {
+	var names []string
+
+	switch v := value.(type) {
+	case atom:
+		// RFC 9051 6.4.5. Macros
+		switch strings.ToUpper(string(v)) {
+		case "ALL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		case "FULL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE",
+				"BODY"}
+		default:
+			names = []string{string(v)}
+		}
+
+	case list:
+		for _, v2 := range v {
+			name, ok := atomValue(v2)
+			if !ok {
+				return nil, syntaxErrorf("invalid fetch item")
+			}
+
+			names = append(names, name)
+		}
+
+	default:
+		return nil, syntaxErrorf("invalid fetch items")
+	}
+
+	items := make([]*fetchItem, len(names))
+
+	for i, name := range names {
+		item, err := parseFetchItem(name)
+		if err != nil {
+			return nil, err
+		}
+
+		items[i] = item
+	}
+
+	return items, nil
+}
+
+func parseFetchItem(s string) (*fetchItem, error) {
+	name, rest, hasSection := strings.Cut(s, "[")
+	name = strings.ToUpper(name)
+
+	if !hasSection {
+		switch name {
+		case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE",
+			"BODY", "BODYSTRUCTURE", "MODSEQ":
+			return &fetchItem{Name: name}, nil
+		}
+
+		return nil, syntaxErrorf("unknown fetch item %q", s)
+	}
+
+	item := fetchItem{Name: "BODY[]"}
+
+	switch name {
+	case "BODY":
+	case "BODY.PEEK":
+		item.Peek = true
+	default:
+		return nil, syntaxErrorf("unknown fetch item %q", s)
+	}
+
+	sectionString, partialString, found := strings.Cut(rest, "]")
+	if !found {
+		return nil, syntaxErrorf("invalid fetch item %q", s)
+	}
+
+	sec, err := parseSection(sectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	item.Section = sec
+
+	if partialString != "" {
+		partial, err := parsePartial(partialString)
+		if err != nil {
+			return nil, err
+		}
+
+		item.Partial = partial
+	}
+
+	return &item, nil
+}
+
+func parsePartial(s string) (*[2]int64, error) {
+	s, found := strings.CutPrefix(s, "<")
+	s, found2 := strings.CutSuffix(s, ">")
+	if !found || !found2 {
+		return nil, syntaxErrorf("invalid partial specification")
+	}
+
+	offsetString, sizeString, found := strings.Cut(s, ".")
+	if !found {
+		return nil, syntaxErrorf("invalid partial specification")
+	}
+
+	offset, err := strconv.ParseUint(offsetString, 10, 32)
+	if err != nil {
+		return nil, syntaxErrorf("invalid partial offset")
+	}
+
+	size, err := strconv.ParseUint(sizeString, 10, 32)
+	if err != nil || size == 0 {
+		return nil, syntaxErrorf("invalid partial size")
+	}
+
+	return &[2]int64{int64(offset), int64(size)}, nil
+}
+
+func (c *ServerConn) processFETCH(cmd *Command, uid bool) (string, error) {
+	if len(cmd.Arguments) < 2 || len(cmd.Arguments) > 3 {
+		return "", syntaxErrorf("invalid number of arguments")
+	}
+
+	set, err := parseSequenceSet(cmd.Arguments[0])
+	if err != nil {
+		return "", err
+	}
+
+	items, err := parseFetchItems(cmd.Arguments[1])
+	if err != nil {
+		return "", err
+	}
+
+	// RFC 7162 3.1.4. and 3.2.6. CHANGEDSINCE and VANISHED modifiers
+	var changedSince *uint64
+	var vanished bool
+
+	if len(cmd.Arguments) > 2 {
+		modifiers, ok := listValue(cmd.Arguments[2])
+		if !ok {
+			return "", syntaxErrorf("invalid fetch modifiers")
+		}
+
+		for i := 0; i < len(modifiers); i++ {
+			name, _ := atomValue(modifiers[i])
+
+			switch strings.ToUpper(name) {
+			case "CHANGEDSINCE":
+				if i+1 == len(modifiers) {
+					return "", syntaxErrorf("missing modification sequence")
+				}
+
+				i++
+
+				modSeq, err := modSeqArgument(modifiers[i])
+				if err != nil {
+					return "", err
+				}
+
+				changedSince = &modSeq
+
+			case "VANISHED":
+				vanished = true
+
+			default:
+				return "", syntaxErrorf("invalid fetch modifier")
+			}
+		}
+
+		if vanished && (!uid || !c.qresync || changedSince == nil) {
+			return "", syntaxErrorf("invalid use of the VANISHED modifier")
+		}
+	}
+
+	// RFC 9051 6.4.9. UID FETCH responses always contain the UID
+	hasUID := false
+	hasFlags := false
+	hasModSeq := false
+	setSeen := false
+
+	for _, item := range items {
+		switch {
+		case item.Name == "UID":
+			hasUID = true
+		case item.Name == "FLAGS":
+			hasFlags = true
+		case item.Name == "MODSEQ":
+			hasModSeq = true
+		case item.Section != nil && !item.Peek:
+			setSeen = !c.selected.readOnly
+		}
+	}
+
+	if hasModSeq || changedSince != nil {
+		c.condStore = true
+	}
+
+	needsUID := uid
+
+	// RFC 7162 3.1.4. Once CONDSTORE is enabled, flags are always returned
+	// with the UID and the modification sequence of the message.
+	if c.condStore && (hasFlags || setSeen || changedSince != nil) {
+		needsUID = true
+
+		if !hasModSeq {
+			items = append(items, &fetchItem{Name: "MODSEQ"})
+		}
+	}
+
+	if needsUID && !hasUID {
+		items = append([]*fetchItem{{Name: "UID"}}, items...)
+	}
+
+	indexes := c.selected.resolve(set, uid)
+
+	if changedSince != nil {
+		msgs, err := c.selectedMessages()
+		if err != nil {
+			return "", err
+		}
+
+		var changedIndexes []int
+		for _, idx := range indexes {
+			msg := msgs[c.selected.uids[idx]]
+			if msg != nil && msg.ModSeq > *changedSince {
+				changedIndexes = append(changedIndexes, idx)
+			}
+		}
+
+		indexes = changedIndexes
+
+		if vanished {
+			if err := c.writeVanishedEarlier(*changedSince, set); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// Fetching the content of a message sets the \Seen flag (RFC 9051
+	// 6.4.5.); the new flags are returned with the content.
+	if setSeen {
+		uids := make([]uint32, len(indexes))
+		for i, idx := range indexes {
+			uids[i] = c.selected.uids[idx]
+		}
+
+		msgs, err := c.account.StoreFlags(c.selected.name, uids,
+			mailstore.FlagOperationAdd, []string{mailstore.FlagSeen})
+		if err != nil {
+			return "", c.storeError(err)
+		}
+
+		if len(msgs) > 0 && !hasFlags {
+			items = append(items, &fetchItem{Name: "FLAGS"})
+		}
+	}
+
+	msgs, err := c.selectedMessages()
+	if err != nil {
+		return "", err
+	}
+
+	for _, idx := range indexes {
+		uid := c.selected.uids[idx]
+
+		msg := msgs[uid]
+		if msg == nil {
+			// Expunged by another session
+			continue
+		}
+
+		if err := c.writeFetchResponse(idx+1, msg, items); err != nil {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+func (c *ServerConn) writeFetchResponse(seq int, msg *mailstore.MessageInfo, items []*fetchItem) error {
+	var part *bodyPart
+
+	for _, item := range items {
+		if item.needsData() {
+			data, err := c.account.MessageData(c.selected.name, msg.UID)
+			if err != nil {
+				if errors.Is(err, mailstore.ErrMessageNotFound) {
+					// Expunged by another session
+					return nil
+				}
+
+				return c.storeError(err)
+			}
+
+			part = parseBodyPart(data, "text/plain")
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "* %d FETCH (", seq)
+
+	for i, item := range items {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		switch item.Name {
+		case "UID":
+			fmt.Fprintf(&buf, "UID %d", msg.UID)
+
+		case "FLAGS":
+			buf.WriteString("FLAGS " + encodeFlags(msg.Flags))
+			c.selected.flags[msg.UID] = encodeFlags(msg.Flags)
+
+		case "INTERNALDATE":
+			buf.WriteString("INTERNALDATE " +
+				encodeString(msg.InternalDate.Format(dateTimeLayout)))
+
+		case "RFC822.SIZE":
+			fmt.Fprintf(&buf, "RFC822.SIZE %d", msg.Size)
+
+		case "MODSEQ":
+			fmt.Fprintf(&buf, "MODSEQ (%d)", msg.ModSeq)
+
+		case "ENVELOPE":
+			buf.WriteString("ENVELOPE ")
+			writeEnvelope(&buf, msg.Envelope)
+
+		case "BODY":
+			buf.WriteString("BODY ")
+			part.writeStructure(&buf, false)
+
+		case "BODYSTRUCTURE":
+			buf.WriteString("BODYSTRUCTURE ")
+			part.writeStructure(&buf, true)
+
+		case "BODY[]":
+			data := part.sectionData(item.Section)
+
+			fmt.Fprintf(&buf, "BODY[%s]", item.Section)
+
+			if item.Partial != nil {
+				offset, size := item.Partial[0], item.Partial[1]
+
+				fmt.Fprintf(&buf, "<%d>", offset)
+
+				if data != nil {
+					offset = min(offset, int64(len(data)))
+					data = data[offset:min(offset+size, int64(len(data)))]
+				}
+			}
+
+			if data == nil {
+				buf.WriteString(" NIL")
+			} else {
+				fmt.Fprintf(&buf, " {%d}\r\n", len(data))
+				buf.Write(data)
+			}
+		}
+	}
+
+	buf.WriteString(")\r\n")
+
+	c.writeData(buf.Bytes())
+
+	return nil
+}
+
+// RFC 9051 7.5.2. ENVELOPE
+func writeEnvelope(buf *bytes.Buffer, envelope *mailstore.Envelope) {
+	if envelope == nil {
+		envelope = &mailstore.Envelope{}
+	}
+
+	date := ""
+	if envelope.Date != nil {
+		date = envelope.Date.Format(time.RFC1123Z)
+	}
+
+	fmt.Fprintf(buf, "(%s %s ", encodeNString(date),
+		encodeNString(envelope.Subject))
+
+	// Sender and Reply-To default to the content of From
+	sender := envelope.Sender
+	if len(sender) == 0 {
+		sender = envelope.From
+	}
+
+	replyTo := envelope.ReplyTo
+	if len(replyTo) == 0 {
+		replyTo = envelope.From
+	}
+
+	addrLists := [][]mailstore.Address{
+		envelope.From, sender, replyTo, envelope.To, envelope.Cc, envelope.Bcc,
+	}
+
+	for _, addrs := range addrLists {
+		writeAddresses(buf, addrs)
+		buf.WriteByte(' ')
+	}
+
+	fmt.Fprintf(buf, "%s %s)", encodeNString(envelope.InReplyTo),
+		encodeNString(envelope.MessageId))
+}
+
+func writeAddresses(buf *bytes.Buffer, addrs []mailstore.Address) {
+	if len(addrs) == 0 {
+		buf.WriteString("NIL")
+		return
+	}
+
+	buf.WriteByte('(')
+
+	for _, addr := range addrs {
+		fmt.Fprintf(buf, "(%s NIL %s %s)", encodeNString(addr.Name),
+			encodeNString(addr.LocalPart), encodeNString(addr.Domain))
+	}
+
+	buf.WriteByte(')')
+}
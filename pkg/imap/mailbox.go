@@ -0,0 +1,259 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+// selectedMailbox is the view of the selected mailbox of a session. Message
+// sequence numbers are only modified when the client is notified of new and
+// expunged messages (RFC 9051 7.5.1.), so the session keeps its own list of
+// UIDs instead of using the content of the mailbox.
+type selectedMailbox struct {
+	name        string
+	readOnly    bool
+	uidValidity uint32
+
+	uids  []uint32          // the UID of message n is uids[n-1]
+	flags map[uint32]string // the last flags sent for each message
+
+	savedUIDs []uint32 // RFC 5182 search result
+}
+
+// resolve returns the indexes of the messages contained in a sequence set.
+func (mb *selectedMailbox) resolve(set *sequenceSet, uid bool) []int {
+	var indexes []int
+
+	largest := uint32(len(mb.uids))
+	if uid {
+		largest = mb.lastUID()
+	}
+
+	for i, msgUID := range mb.uids {
+		var match bool
+
+		switch {
+		case set.Saved:
+			match = mb.isSaved(msgUID)
+		case uid:
+			match = set.contains(msgUID, largest)
+		default:
+			match = set.contains(uint32(i+1), largest)
+		}
+
+		if match {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+// sequenceNumber returns the sequence number of a message or zero if it is
+// not in the mailbox.
+func (mb *selectedMailbox) sequenceNumber(uid uint32) int {
+	i := sort.Search(len(mb.uids), func(i int) bool {
+		return mb.uids[i] >= uid
+	})
+
+	if i < len(mb.uids) && mb.uids[i] == uid {
+		return i + 1
+	}
+
+	return 0
+}
+
+func (mb *selectedMailbox) lastUID() uint32 {
+	if n := len(mb.uids); n > 0 {
+		return mb.uids[n-1]
+	}
+
+	return 0
+}
+
+func (mb *selectedMailbox) isSaved(uid uint32) bool {
+	for _, savedUID := range mb.savedUIDs {
+		if savedUID == uid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *ServerConn) selectMailbox(name string, readOnly bool) error {
+	info, err := c.account.Mailbox(name)
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	msgs, err := c.account.Messages(info.Name)
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	mb := selectedMailbox{
+		name:        info.Name,
+		readOnly:    readOnly,
+		uidValidity: info.UIDValidity,
+
+		uids:  make([]uint32, len(msgs)),
+		flags: make(map[uint32]string),
+	}
+
+	keywords := make(map[string]struct{})
+
+	for i, msg := range msgs {
+		mb.uids[i] = msg.UID
+		mb.flags[msg.UID] = encodeFlags(msg.Flags)
+
+		for _, flag := range msg.Flags {
+			if flag[0] != '\\' {
+				keywords[flag] = struct{}{}
+			}
+		}
+	}
+
+	c.selected = &mb
+
+	flags := append([]string(nil), mailstore.SystemFlags...)
+	for keyword := range keywords {
+		flags = append(flags, keyword)
+	}
+	sort.Strings(flags[len(mailstore.SystemFlags):])
+
+	permanentFlags := []string{}
+	if !readOnly {
+		permanentFlags = append(append(permanentFlags, flags...), `\*`)
+	}
+
+	// RFC 9051 6.3.2. SELECT Command
+	c.writeUntagged("%d EXISTS", len(mb.uids))
+	c.writeUntagged("OK [UIDVALIDITY %d] UIDs valid", info.UIDValidity)
+	c.writeUntagged("OK [UIDNEXT %d] predicted next UID", info.UIDNext)
+	if c.condStore {
+		c.writeUntagged("OK [HIGHESTMODSEQ %d] highest modification sequence",
+			info.HighestModSeq)
+	}
+	c.writeUntagged("FLAGS %s", encodeFlags(flags))
+	c.writeUntagged("OK [PERMANENTFLAGS %s] permanent flags",
+		encodeFlags(permanentFlags))
+	c.writeUntagged("LIST () %s %s", encodeString(mailstore.Separator),
+		encodeString(info.Name))
+
+	return nil
+}
+
+// selectedMessages returns the current messages of the selected mailbox
+// indexed by UID.
+func (c *ServerConn) selectedMessages() (map[uint32]*mailstore.MessageInfo, error) {
+	msgs, err := c.account.Messages(c.selected.name)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMailboxNotFound) {
+			c.mailboxDeleted()
+		}
+
+		return nil, c.storeError(err)
+	}
+
+	table := make(map[uint32]*mailstore.MessageInfo, len(msgs))
+	for _, msg := range msgs {
+		table[msg.UID] = msg
+	}
+
+	return table, nil
+}
+
+// update notifies the client of changes made to the selected mailbox by other
+// sessions or by the last command. Expunged messages can only be reported
+// when expunge is true.
+func (c *ServerConn) update(expunge bool) error {
+	mb := c.selected
+
+	msgs, err := c.account.Messages(mb.name)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMailboxNotFound) {
+			c.mailboxDeleted()
+		}
+
+		return fmt.Errorf("cannot read messages: %w", err)
+	}
+
+	table := make(map[uint32]*mailstore.MessageInfo, len(msgs))
+	for _, msg := range msgs {
+		table[msg.UID] = msg
+	}
+
+	if expunge {
+		// RFC 7162 3.2.10. Once QRESYNC is enabled, expunged messages are
+		// reported with a single VANISHED response.
+		var vanishedUIDs []uint32
+
+		for i := 0; i < len(mb.uids); {
+			uid := mb.uids[i]
+
+			if table[uid] != nil {
+				i++
+				continue
+			}
+
+			if c.qresync {
+				vanishedUIDs = append(vanishedUIDs, uid)
+			} else {
+				c.writeUntagged("%d EXPUNGE", i+1)
+			}
+
+			mb.uids = append(mb.uids[:i], mb.uids[i+1:]...)
+			delete(mb.flags, uid)
+		}
+
+		if len(vanishedUIDs) > 0 {
+			c.writeUntagged("VANISHED %s", formatSequenceSet(vanishedUIDs))
+		}
+	}
+
+	for i, uid := range mb.uids {
+		msg := table[uid]
+		if msg == nil {
+			continue
+		}
+
+		if flags := encodeFlags(msg.Flags); flags != mb.flags[uid] {
+			if c.condStore {
+				c.writeUntagged("%d FETCH (UID %d FLAGS %s MODSEQ (%d))", i+1,
+					uid, flags, msg.ModSeq)
+			} else {
+				c.writeUntagged("%d FETCH (UID %d FLAGS %s)", i+1, uid, flags)
+			}
+
+			mb.flags[uid] = flags
+		}
+	}
+
+	lastUID := mb.lastUID()
+	nbMessages := len(mb.uids)
+
+	for _, msg := range msgs {
+		if msg.UID > lastUID {
+			mb.uids = append(mb.uids, msg.UID)
+			mb.flags[msg.UID] = encodeFlags(msg.Flags)
+		}
+	}
+
+	if len(mb.uids) > nbMessages {
+		c.writeUntagged("%d EXISTS", len(mb.uids))
+	}
+
+	return nil
+}
+
+// mailboxDeleted closes the connection when the selected mailbox was deleted
+// or renamed by another session: the session state cannot be kept
+// consistent.
+func (c *ServerConn) mailboxDeleted() {
+	c.writeUntagged("BYE selected mailbox no longer exists")
+	panic(NewExpectedError(mailstore.ErrMailboxNotFound))
+}
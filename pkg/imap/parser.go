@@ -0,0 +1,487 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 9051 9. Formal Syntax
+//
+// Command arguments are parsed into generic values before being interpreted
+// by each command: atoms (including flags, sequence sets and fetch items),
+// strings (quoted strings and literals) and parenthesized lists.
+
+type atom string
+
+type list []any
+
+// Date and date-time values (RFC 9051 9. date, date-time)
+const (
+	dateLayout     = "2-Jan-2006"
+	dateTimeLayout = "_2-Jan-2006 15:04:05 -0700"
+)
+
+type Command struct {
+	Tag       string
+	Name      string // upper case, e.g. "UID FETCH"
+	Arguments []any
+}
+
+type commandParser struct {
+	c    *ServerConn
+	tag  string
+	line []byte
+}
+
+func (c *ServerConn) readCommand() (*Command, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	tag, rest, _ := bytes.Cut(line, []byte{' '})
+	if len(tag) == 0 || !isValidTag(tag) {
+		return nil, syntaxErrorf("invalid tag")
+	}
+
+	cmd := Command{Tag: string(tag)}
+
+	name, rest, _ := bytes.Cut(rest, []byte{' '})
+	if len(name) == 0 {
+		return &cmd, syntaxErrorf("missing command")
+	}
+
+	cmd.Name = strings.ToUpper(string(name))
+
+	p := commandParser{
+		c:    c,
+		tag:  cmd.Tag,
+		line: rest,
+	}
+
+	args, err := p.readValues(false)
+	if err != nil {
+		return &cmd, err
+	}
+
+	cmd.Arguments = args
+
+	if cmd.Name == "UID" && len(args) > 0 {
+		if subcommand, ok := args[0].(atom); ok {
+			cmd.Name += " " + strings.ToUpper(string(subcommand))
+			cmd.Arguments = args[1:]
+		}
+	}
+
+	return &cmd, nil
+}
+
+func isValidTag(tag []byte) bool {
+	for _, c := range tag {
+		if c <= 0x20 || c >= 0x7f || strings.IndexByte(`(){%*"\+`, c) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *commandParser) readValues(inList bool) (list, error) {
+	values := list{}
+
+	for {
+		p.line = bytes.TrimLeft(p.line, " ")
+
+		if len(p.line) == 0 {
+			if inList {
+				return nil, syntaxErrorf("unterminated list")
+			}
+
+			return values, nil
+		}
+
+		switch c := p.line[0]; c {
+		case '(':
+			p.line = p.line[1:]
+
+			l, err := p.readValues(true)
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, l)
+
+		case ')':
+			if !inList {
+				return nil, syntaxErrorf("unexpected ')'")
+			}
+
+			p.line = p.line[1:]
+			return values, nil
+
+		case '"':
+			s, err := p.readQuotedString()
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, s)
+
+		case '{':
+			s, err := p.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, s)
+
+		default:
+			values = append(values, p.readAtom())
+		}
+	}
+}
+
+func (p *commandParser) readQuotedString() (string, error) {
+	var buf []byte
+
+	for i := 1; i < len(p.line); i++ {
+		switch c := p.line[i]; c {
+		case '"':
+			p.line = p.line[i+1:]
+			return string(buf), nil
+
+		case '\\':
+			if i+1 == len(p.line) || (p.line[i+1] != '"' && p.line[i+1] != '\\') {
+				return "", syntaxErrorf("invalid escape sequence")
+			}
+
+			i++
+			buf = append(buf, p.line[i])
+
+		default:
+			buf = append(buf, c)
+		}
+	}
+
+	return "", syntaxErrorf("unterminated quoted string")
+}
+
+// readAtom reads an atom; brackets are included with their content so that
+// fetch items such as "BODY[HEADER.FIELDS (From To)]<0.100>" are read as a
+// single atom.
+func (p *commandParser) readAtom() atom {
+	depth := 0
+	quoted := false
+
+	i := 0
+
+loop:
+	for ; i < len(p.line); i++ {
+		c := p.line[i]
+
+		switch {
+		case quoted:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				quoted = false
+			}
+
+		case depth > 0:
+			switch c {
+			case '"':
+				quoted = true
+			case '[':
+				depth++
+			case ']':
+				depth--
+			}
+
+		case c == ' ' || c == '(' || c == ')' || c == '"' || c < 0x20 || c == 0x7f:
+			break loop
+
+		case c == '[':
+			depth++
+		}
+	}
+
+	i = min(i, len(p.line))
+
+	a := atom(p.line[:i])
+	p.line = p.line[i:]
+
+	return a
+}
+
+// readLiteral reads a literal; literals always end the line and the rest of
+// the command follows their content.
+func (p *commandParser) readLiteral() (string, error) {
+	spec, found := bytes.CutSuffix(p.line[1:], []byte{'}'})
+	if !found {
+		return "", syntaxErrorf("invalid literal")
+	}
+
+	spec, nonSync := bytes.CutSuffix(spec, []byte{'+'})
+
+	size, err := strconv.ParseInt(string(spec), 10, 64)
+	if err != nil || size < 0 {
+		return "", syntaxErrorf("invalid literal size")
+	}
+
+	if size > int64(p.c.Server.Cfg.MaxMessageSize) {
+		if nonSync {
+			// RFC 7888 4. The content follows and cannot be interpreted as
+			// a command; the only option is to close the connection.
+			c := p.c
+			c.writeTagged(p.tag, "BAD", "TOOBIG", "literal too large")
+			c.writeUntagged("BYE closing connection")
+			panic(NewExpectedError(fmt.Errorf("non-synchronizing literal " +
+				"too large")))
+		}
+
+		return "", requestErrorf("TOOBIG", "literal too large")
+	}
+
+	if !nonSync {
+		p.c.writeLine("+ ready for literal data")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(p.c.rbuf, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			panic(NewExpectedError(err))
+		}
+
+		return "", fmt.Errorf("cannot read literal: %w", err)
+	}
+
+	line, err := p.c.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	p.line = line
+
+	return string(data), nil
+}
+
+// Argument accessors
+
+func astringValue(value any) (string, bool) {
+	switch v := value.(type) {
+	case atom:
+		return string(v), true
+	case string:
+		return v, true
+	}
+
+	return "", false
+}
+
+func atomValue(value any) (string, bool) {
+	a, ok := value.(atom)
+	return string(a), ok
+}
+
+func listValue(value any) (list, bool) {
+	l, ok := value.(list)
+	return l, ok
+}
+
+func mailboxArgument(value any) (string, error) {
+	name, ok := astringValue(value)
+	if !ok {
+		return "", syntaxErrorf("invalid mailbox name")
+	}
+
+	return name, nil
+}
+
+// flagsArgument accepts either a list of flags or a single flag.
+func flagsArgument(value any) ([]string, error) {
+	l, ok := listValue(value)
+	if !ok {
+		l = list{value}
+	}
+
+	flags := make([]string, len(l))
+
+	for i, v := range l {
+		flag, ok := atomValue(v)
+		if !ok {
+			return nil, syntaxErrorf("invalid flag")
+		}
+
+		flags[i] = flag
+	}
+
+	return flags, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	date, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return time.Time{}, syntaxErrorf("invalid date %q", s)
+	}
+
+	return date, nil
+}
+
+func parseDateTime(s string) (time.Time, error) {
+	date, err := time.Parse(dateTimeLayout, s)
+	if err != nil {
+		return time.Time{}, syntaxErrorf("invalid date-time %q", s)
+	}
+
+	return date, nil
+}
+
+// Sequence sets (RFC 9051 9. sequence-set)
+
+type numRange struct {
+	Start, End uint32 // zero for "*"
+}
+
+type sequenceSet struct {
+	Ranges []numRange
+
+	// RFC 5182 2.1. "$" refers to the result of the last saved search
+	Saved bool
+}
+
+func parseSequenceSet(value any) (*sequenceSet, error) {
+	s, ok := atomValue(value)
+	if !ok {
+		return nil, syntaxErrorf("invalid sequence set")
+	}
+
+	if s == "$" {
+		return &sequenceSet{Saved: true}, nil
+	}
+
+	var set sequenceSet
+
+	for _, part := range strings.Split(s, ",") {
+		startString, endString, isRange := strings.Cut(part, ":")
+
+		start, err := parseSequenceNumber(startString)
+		if err != nil {
+			return nil, err
+		}
+
+		end := start
+		if isRange {
+			end, err = parseSequenceNumber(endString)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		set.Ranges = append(set.Ranges, numRange{Start: start, End: end})
+	}
+
+	return &set, nil
+}
+
+func parseSequenceNumber(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 || s[0] == '0' {
+		return 0, syntaxErrorf("invalid sequence number %q", s)
+	}
+
+	return uint32(n), nil
+}
+
+// contains returns true if the set contains a number; largest is the value
+// of "*".
+func (set *sequenceSet) contains(n, largest uint32) bool {
+	for _, r := range set.Ranges {
+		start, end := r.Start, r.End
+
+		if start == 0 {
+			start = largest
+		}
+
+		if end == 0 {
+			end = largest
+		}
+
+		if start > end {
+			start, end = end, start
+		}
+
+		if n >= start && n <= end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatSequenceSet returns the shortest sequence set containing a list of
+// numbers.
+func formatSequenceSet(numbers []uint32) string {
+	numbers = append([]uint32(nil), numbers...)
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	var buf strings.Builder
+
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] <= numbers[j]+1 {
+			j++
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+
+		buf.WriteString(strconv.FormatUint(uint64(numbers[i]), 10))
+
+		if numbers[j] != numbers[i] {
+			buf.WriteByte(':')
+			buf.WriteString(strconv.FormatUint(uint64(numbers[j]), 10))
+		}
+
+		i = j + 1
+	}
+
+	return buf.String()
+}
+
+// Response encoding
+
+// encodeString returns a quoted string if possible, or a literal for strings
+// which cannot be quoted.
+func encodeString(s string) string {
+	if len(s) <= 1024 && !strings.ContainsAny(s, "\r\n\x00") {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+		s = strings.ReplaceAll(s, `"`, `\"`)
+
+		return `"` + s + `"`
+	}
+
+	return "{" + strconv.Itoa(len(s)) + "}\r\n" + s
+}
+
+// encodeNString returns NIL for empty strings.
+func encodeNString(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+
+	return encodeString(s)
+}
+
+func encodeFlags(flags []string) string {
+	return "(" + strings.Join(flags, " ") + ")"
+}
@@ -0,0 +1,578 @@
+package imap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+// RFC 9051 6.4.4. SEARCH Command
+//
+// Header keys (FROM, TO, SUBJECT...) are evaluated on the message index.
+// HEADER, BODY and TEXT read the message and match raw data: encoded words
+// and content transfer encodings are not decoded.
+
+type searchKey struct {
+	Name string // upper case
+
+	String string
+	Field  string
+	Date   time.Time
+	Number int64
+	Set    *sequenceSet
+	Keys   []*searchKey // NOT, OR and parenthesized lists
+}
+
+func (key *searchKey) hasModSeq() bool {
+	if key.Name == "MODSEQ" {
+		return true
+	}
+
+	for _, key2 := range key.Keys {
+		if key2.hasModSeq() {
+			return true
+		}
+	}
+
+	return false
+}
+
+type searchParser struct {
+	args []any
+}
+
+func (p *searchParser) next() (any, error) {
+	if len(p.args) == 0 {
+		return nil, syntaxErrorf("missing search argument")
+	}
+
+	value := p.args[0]
+	p.args = p.args[1:]
+
+	return value, nil
+}
+
+func (p *searchParser) nextString() (string, error) {
+	value, err := p.next()
+	if err != nil {
+		return "", err
+	}
+
+	s, ok := astringValue(value)
+	if !ok {
+		return "", syntaxErrorf("invalid search argument")
+	}
+
+	return s, nil
+}
+
+func (p *searchParser) parseKeys() ([]*searchKey, error) {
+	var keys []*searchKey
+
+	for len(p.args) > 0 {
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, syntaxErrorf("missing search criteria")
+	}
+
+	return keys, nil
+}
+
+func (p *searchParser) parseKey() (*searchKey, error) {
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := listValue(value); ok {
+		p2 := searchParser{args: l}
+
+		keys, err := p2.parseKeys()
+		if err != nil {
+			return nil, err
+		}
+
+		return &searchKey{Name: "AND", Keys: keys}, nil
+	}
+
+	name, ok := atomValue(value)
+	if !ok || name == "" {
+		return nil, syntaxErrorf("invalid search key")
+	}
+
+	if c := name[0]; (c >= '0' && c <= '9') || c == '*' || c == '$' {
+		set, err := parseSequenceSet(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return &searchKey{Name: "SEQUENCE-SET", Set: set}, nil
+	}
+
+	key := searchKey{Name: strings.ToUpper(name)}
+
+	switch key.Name {
+	case "ALL", "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "SEEN",
+		"UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+
+	case "BCC", "BODY", "CC", "FROM", "SUBJECT", "TEXT", "TO", "KEYWORD",
+		"UNKEYWORD":
+		if key.String, err = p.nextString(); err != nil {
+			return nil, err
+		}
+
+	case "HEADER":
+		if key.Field, err = p.nextString(); err != nil {
+			return nil, err
+		}
+
+		if key.String, err = p.nextString(); err != nil {
+			return nil, err
+		}
+
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		s, err := p.nextString()
+		if err != nil {
+			return nil, err
+		}
+
+		if key.Date, err = parseDate(s); err != nil {
+			return nil, err
+		}
+
+	case "LARGER", "SMALLER":
+		s, err := p.nextString()
+		if err != nil {
+			return nil, err
+		}
+
+		if key.Number, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, syntaxErrorf("invalid number %q", s)
+		}
+
+	case "UID":
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if key.Set, err = parseSequenceSet(value); err != nil {
+			return nil, err
+		}
+
+	case "MODSEQ":
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		// RFC 7162 3.1.5. The optional metadata entry name (a quoted
+		// string) and type are ignored.
+		if _, ok := value.(string); ok {
+			if _, err := p.next(); err != nil {
+				return nil, err
+			}
+
+			if value, err = p.next(); err != nil {
+				return nil, err
+			}
+		}
+
+		modSeq, err := modSeqArgument(value)
+		if err != nil {
+			return nil, err
+		}
+
+		key.Number = int64(modSeq)
+
+	case "NOT":
+		key2, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+
+		key.Keys = []*searchKey{key2}
+
+	case "OR":
+		key1, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+
+		key2, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+
+		key.Keys = []*searchKey{key1, key2}
+
+	default:
+		return nil, syntaxErrorf("unknown search key %q", name)
+	}
+
+	return &key, nil
+}
+
+type searchMessage struct {
+	seq  uint32
+	info *mailstore.MessageInfo
+	part *bodyPart // loaded on demand
+}
+
+type searchContext struct {
+	c          *ServerConn
+	nbMessages uint32
+	lastUID    uint32
+}
+
+func (ctx *searchContext) message(msg *searchMessage) (*bodyPart, error) {
+	if msg.part == nil {
+		c := ctx.c
+
+		data, err := c.account.MessageData(c.selected.name, msg.info.UID)
+		if err != nil {
+			return nil, c.storeError(err)
+		}
+
+		msg.part = parseBodyPart(data, "text/plain")
+	}
+
+	return msg.part, nil
+}
+
+func (ctx *searchContext) match(key *searchKey, msg *searchMessage) (bool, error) {
+	info := msg.info
+
+	switch key.Name {
+	case "ALL":
+		return true, nil
+
+	case "AND":
+		for _, key2 := range key.Keys {
+			if match, err := ctx.match(key2, msg); err != nil || !match {
+				return false, err
+			}
+		}
+
+		return true, nil
+
+	case "NOT":
+		match, err := ctx.match(key.Keys[0], msg)
+		return !match, err
+
+	case "OR":
+		for _, key2 := range key.Keys {
+			if match, err := ctx.match(key2, msg); err != nil || match {
+				return match, err
+			}
+		}
+
+		return false, nil
+
+	case "SEQUENCE-SET":
+		if key.Set.Saved {
+			return ctx.c.selected.isSaved(info.UID), nil
+		}
+
+		return key.Set.contains(msg.seq, ctx.nbMessages), nil
+
+	case "UID":
+		if key.Set.Saved {
+			return ctx.c.selected.isSaved(info.UID), nil
+		}
+
+		return key.Set.contains(info.UID, ctx.lastUID), nil
+
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "SEEN":
+		return info.HasFlag(`\` + key.Name), nil
+
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		return !info.HasFlag(`\` + key.Name[2:]), nil
+
+	case "KEYWORD":
+		return info.HasFlag(key.String), nil
+
+	case "UNKEYWORD":
+		return !info.HasFlag(key.String), nil
+
+	case "LARGER":
+		return info.Size > key.Number, nil
+
+	case "MODSEQ":
+		return info.ModSeq >= uint64(key.Number), nil
+
+	case "SMALLER":
+		return info.Size < key.Number, nil
+
+	case "BEFORE", "ON", "SINCE":
+		return matchDate(key.Name, info.InternalDate, key.Date), nil
+
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		if info.Envelope == nil || info.Envelope.Date == nil {
+			return false, nil
+		}
+
+		return matchDate(key.Name[4:], *info.Envelope.Date, key.Date), nil
+
+	case "SUBJECT":
+		if info.Envelope == nil {
+			return false, nil
+		}
+
+		return containsFold(info.Envelope.Subject, key.String), nil
+
+	case "FROM", "TO", "CC", "BCC":
+		if info.Envelope == nil {
+			return false, nil
+		}
+
+		var addrs []mailstore.Address
+
+		switch key.Name {
+		case "FROM":
+			addrs = info.Envelope.From
+		case "TO":
+			addrs = info.Envelope.To
+		case "CC":
+			addrs = info.Envelope.Cc
+		case "BCC":
+			addrs = info.Envelope.Bcc
+		}
+
+		for _, addr := range addrs {
+			s := fmt.Sprintf("%s <%s@%s>", addr.Name, addr.LocalPart,
+				addr.Domain)
+
+			if containsFold(s, key.String) {
+				return true, nil
+			}
+		}
+
+		return false, nil
+
+	case "HEADER":
+		part, err := ctx.message(msg)
+		if err != nil {
+			return false, err
+		}
+
+		for _, field := range part.fields {
+			if strings.EqualFold(field.Name, key.Field) &&
+				containsFold(field.Value, key.String) {
+				return true, nil
+			}
+		}
+
+		return false, nil
+
+	case "BODY":
+		part, err := ctx.message(msg)
+		if err != nil {
+			return false, err
+		}
+
+		return containsFold(string(part.body), key.String), nil
+
+	case "TEXT":
+		part, err := ctx.message(msg)
+		if err != nil {
+			return false, err
+		}
+
+		return containsFold(string(part.data), key.String), nil
+	}
+
+	return false, fmt.Errorf("unhandled search key %q", key.Name)
+}
+
+// matchDate compares dates disregarding time and timezone (RFC 9051 6.4.4.).
+func matchDate(op string, date, refDate time.Time) bool {
+	year, month, day := date.Date()
+	d := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+
+	switch op {
+	case "BEFORE":
+		return d.Before(refDate)
+	case "ON":
+		return d.Equal(refDate)
+	case "SINCE":
+		return !d.Before(refDate)
+	}
+
+	return false
+}
+
+func containsFold(s, substring string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substring))
+}
+
+// RFC 4731 3.1. Search result options (part of IMAP4rev2)
+var searchReturnOptions = []string{"MIN", "MAX", "ALL", "COUNT", "SAVE"}
+
+func (c *ServerConn) processSEARCH(cmd *Command, uid bool) (string, error) {
+	args := cmd.Arguments
+
+	returnOptions := map[string]bool{}
+
+	if len(args) >= 2 {
+		if name, _ := atomValue(args[0]); strings.EqualFold(name, "RETURN") {
+			l, ok := listValue(args[1])
+			if !ok {
+				return "", syntaxErrorf("invalid search return options")
+			}
+
+			for _, value := range l {
+				option, _ := atomValue(value)
+				option = strings.ToUpper(option)
+
+				if !isSearchReturnOption(option) {
+					return "", syntaxErrorf("invalid search return option")
+				}
+
+				returnOptions[option] = true
+			}
+
+			args = args[2:]
+		}
+	}
+
+	if len(returnOptions) == 0 {
+		returnOptions["ALL"] = true
+	}
+
+	if len(args) >= 2 {
+		if name, _ := atomValue(args[0]); strings.EqualFold(name, "CHARSET") {
+			charset, _ := astringValue(args[1])
+
+			switch strings.ToUpper(charset) {
+			case "UTF-8", "US-ASCII":
+			default:
+				return "", requestErrorf("BADCHARSET (UTF-8 US-ASCII)",
+					"unsupported charset")
+			}
+
+			args = args[2:]
+		}
+	}
+
+	p := searchParser{args: args}
+
+	keys, err := p.parseKeys()
+	if err != nil {
+		return "", err
+	}
+
+	key := &searchKey{Name: "AND", Keys: keys}
+
+	msgs, err := c.selectedMessages()
+	if err != nil {
+		return "", err
+	}
+
+	ctx := searchContext{
+		c:          c,
+		nbMessages: uint32(len(c.selected.uids)),
+		lastUID:    c.selected.lastUID(),
+	}
+
+	hasModSeq := key.hasModSeq()
+	if hasModSeq {
+		c.condStore = true
+	}
+
+	var results, resultUIDs []uint32
+	var highestModSeq uint64
+
+	for i, msgUID := range c.selected.uids {
+		info := msgs[msgUID]
+		if info == nil {
+			continue
+		}
+
+		msg := searchMessage{
+			seq:  uint32(i + 1),
+			info: info,
+		}
+
+		match, err := ctx.match(key, &msg)
+		if err != nil {
+			return "", err
+		}
+
+		if match {
+			resultUIDs = append(resultUIDs, msgUID)
+			highestModSeq = max(highestModSeq, info.ModSeq)
+
+			if uid {
+				results = append(results, msgUID)
+			} else {
+				results = append(results, msg.seq)
+			}
+		}
+	}
+
+	if returnOptions["SAVE"] {
+		c.selected.savedUIDs = resultUIDs
+
+		if len(returnOptions) == 1 {
+			return "", nil
+		}
+	}
+
+	// RFC 9051 7.3.4. ESEARCH Response
+	var buf strings.Builder
+
+	fmt.Fprintf(&buf, "ESEARCH (TAG %s)", encodeString(cmd.Tag))
+
+	if uid {
+		buf.WriteString(" UID")
+	}
+
+	if len(results) > 0 {
+		if returnOptions["MIN"] {
+			fmt.Fprintf(&buf, " MIN %d", results[0])
+		}
+
+		if returnOptions["MAX"] {
+			fmt.Fprintf(&buf, " MAX %d", results[len(results)-1])
+		}
+
+		if returnOptions["ALL"] {
+			fmt.Fprintf(&buf, " ALL %s", formatSequenceSet(results))
+		}
+	}
+
+	if returnOptions["COUNT"] {
+		fmt.Fprintf(&buf, " COUNT %d", len(results))
+	}
+
+	// RFC 7162 3.1.5. The highest modification sequence of the messages
+	// found is returned when the MODSEQ search key is used.
+	if hasModSeq && len(results) > 0 {
+		fmt.Fprintf(&buf, " MODSEQ %d", highestModSeq)
+	}
+
+	c.writeUntagged("%s", buf.String())
+
+	return "", nil
+}
+
+func isSearchReturnOption(option string) bool {
+	for _, o := range searchReturnOptions {
+		if option == o {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,244 @@
+package imap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-ejson"
+	"github.com/galdor/go-log"
+)
+
+// RFC 9051 Internet Message Access Protocol (IMAP) - Version 4rev2
+
+const (
+	DefaultPort            = 143
+	DefaultImplicitTLSPort = 993
+
+	DefaultMaxMessageSize = 32 * 1024 * 1024
+
+	// The number of failed authentication attempts after which the
+	// connection is closed
+	MaxAuthenticationFailures = 3
+
+	MaxLineLength = 65536
+)
+
+type ServerCfg struct {
+	Log           *log.Logger        `json:"-"`
+	Authenticator sasl.Authenticator `json:"-"`
+	Store         *mailstore.Store   `json:"-"`
+
+	// The TLS configuration used for STARTTLS or implicit TLS, loaded from
+	// TLS if not set
+	TLSConfig *tls.Config `json:"-"`
+
+	Host string `json:"host"`
+	Port int    `json:"port,omitempty"`
+
+	TLS *utils.TLSCfg `json:"tls,omitempty"`
+
+	// Establish TLS as soon as the connection is accepted instead of waiting
+	// for the STARTTLS command.
+	ImplicitTLS bool `json:"implicit_tls,omitempty"`
+
+	// Authentication transmits passwords in clear text and is therefore only
+	// allowed on TLS connections unless this option is set.
+	AllowInsecureAuthentication bool `json:"allow_insecure_authentication,omitempty"`
+
+	MaxMessageSize int `json:"max_message_size,omitempty"`
+}
+
+func (cfg *ServerCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("host", cfg.Host)
+
+	if cfg.Port != 0 {
+		v.CheckIntMinMax("port", cfg.Port, 1, 65535)
+	}
+
+	v.CheckOptionalObject("tls", cfg.TLS)
+
+	if cfg.ImplicitTLS {
+		v.Check("tls", cfg.TLS != nil, "missing_tls_configuration",
+			"implicit TLS requires a TLS configuration")
+	}
+
+	v.CheckIntMin("max_message_size", cfg.MaxMessageSize, 0)
+}
+
+type Server struct {
+	Cfg ServerCfg
+	Log *log.Logger
+
+	listeners []net.Listener
+
+	conns      map[*ServerConn]struct{}
+	connsMutex sync.Mutex
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewServer(cfg ServerCfg) (*Server, error) {
+	if cfg.Port == 0 {
+		if cfg.ImplicitTLS {
+			cfg.Port = DefaultImplicitTLSPort
+		} else {
+			cfg.Port = DefaultPort
+		}
+	}
+
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = DefaultMaxMessageSize
+	}
+
+	if cfg.TLSConfig == nil && cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.ServerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.TLSConfig = tlsCfg
+	}
+
+	if cfg.ImplicitTLS && cfg.TLSConfig == nil {
+		return nil, fmt.Errorf("implicit TLS requires a TLS configuration")
+	}
+
+	s := Server{
+		Cfg: cfg,
+		Log: cfg.Log,
+
+		conns: make(map[*ServerConn]struct{}),
+
+		stopChan: make(chan struct{}),
+	}
+
+	return &s, nil
+}
+
+func (s *Server) Start() error {
+	addrs, err := s.resolveHost()
+	if err != nil {
+		return err
+	}
+
+	addrTable := make(map[string]struct{})
+	for _, addr := range addrs {
+		addrTable[addr] = struct{}{}
+	}
+
+	port := strconv.Itoa(s.Cfg.Port)
+
+	for addr := range addrTable {
+		listener, err := net.Listen("tcp", net.JoinHostPort(addr, port))
+		if err != nil {
+			return fmt.Errorf("cannot listen on %q: %w", addr, err)
+		}
+
+		s.Log.Info("listening on %q", addr)
+
+		s.listeners = append(s.listeners, listener)
+
+		s.wg.Add(1)
+		go s.listen(listener)
+	}
+
+	return nil
+}
+
+func (s *Server) resolveHost() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var resolver net.Resolver
+
+	addrs, err := resolver.LookupHost(ctx, s.Cfg.Host)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve host: %w", err)
+	}
+
+	return addrs, nil
+}
+
+func (s *Server) Stop() {
+	close(s.stopChan)
+
+	s.connsMutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMutex.Unlock()
+
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+
+	s.wg.Wait()
+}
+
+func (s *Server) listen(listener net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			s.Log.Error("cannot accept connection: %v", err)
+
+			select {
+			case <-s.stopChan:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+
+		if err := s.handleConnection(conn); err != nil {
+			s.Log.Error("%v", err)
+			conn.Close()
+			continue
+		}
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) error {
+	remoteAddr := conn.RemoteAddr().String()
+
+	addr, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return fmt.Errorf("invalid remote address %q: %w", remoteAddr, err)
+	}
+
+	s.Log.Debug(1, "accepting connection from %q", addr)
+
+	logData := log.Data{
+		"address": addr,
+	}
+
+	c := ServerConn{
+		Server: s,
+		Log:    s.Log.Child("conn", logData),
+
+		conn: conn,
+	}
+
+	s.connsMutex.Lock()
+	s.conns[&c] = struct{}{}
+	s.connsMutex.Unlock()
+
+	c.Start()
+
+	return nil
+}
@@ -0,0 +1,1712 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-log"
+)
+
+type ExpectedError struct {
+	Err error
+}
+
+func NewExpectedError(err error) *ExpectedError {
+	return &ExpectedError{Err: err}
+}
+
+func (err *ExpectedError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *ExpectedError) Unwrap() error {
+	return err.Err
+}
+
+// RequestError is an error caused by a command which cannot be executed; the
+// client receives a tagged NO response, or a tagged BAD response for invalid
+// commands, and the connection stays open.
+type RequestError struct {
+	Status  string // "NO" or "BAD"
+	Code    string // optional response code
+	Message string
+}
+
+func (err *RequestError) Error() string {
+	return err.Message
+}
+
+func requestErrorf(code, format string, args ...any) *RequestError {
+	return &RequestError{
+		Status:  "NO",
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func syntaxErrorf(format string, args ...any) *RequestError {
+	return &RequestError{
+		Status:  "BAD",
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+type ServerConn struct {
+	Server *Server
+	Log    *log.Logger
+
+	tls            bool
+	identity       string // empty until authenticated
+	nbAuthFailures int
+
+	account  *mailstore.Account
+	selected *selectedMailbox
+
+	// RFC 7162 3.1. CONDSTORE is enabled by ENABLE or by the first command
+	// using it; QRESYNC is only enabled by ENABLE and implies CONDSTORE.
+	condStore bool
+	qresync   bool
+
+	// Set by commands which send their own tagged response
+	responded bool
+
+	conn net.Conn
+	rbuf *bufio.Reader
+	wbuf bytes.Buffer
+}
+
+func (c *ServerConn) Start() {
+	c.rbuf = bufio.NewReaderSize(c.conn, MaxLineLength)
+
+	c.Server.wg.Add(1)
+	go c.main()
+}
+
+func (c *ServerConn) Close() {
+	c.conn.Close()
+}
+
+func (c *ServerConn) main() {
+	defer func() {
+		c.conn.Close()
+
+		c.Server.connsMutex.Lock()
+		delete(c.Server.conns, c)
+		c.Server.connsMutex.Unlock()
+
+		c.Server.wg.Done()
+	}()
+
+	defer func() {
+		if v := recover(); v != nil {
+			if err, ok := v.(error); ok {
+				var expectedError *ExpectedError
+
+				if errors.As(err, &expectedError) {
+					return
+				}
+			}
+
+			msg := utils.RecoverValueString(v)
+			trace := utils.StackTrace(0, 20, true)
+
+			c.Log.Error("panic: %s\n%s", msg, trace)
+		}
+	}()
+
+	if c.Server.Cfg.ImplicitTLS {
+		c.startTLS()
+	}
+
+	c.writeUntagged("OK [CAPABILITY %s] emaild ready", c.capabilities())
+
+	for {
+		cmd, err := c.readCommand()
+		if err != nil {
+			var requestErr *RequestError
+			if errors.As(err, &requestErr) {
+				tag := "*"
+				if cmd != nil {
+					tag = cmd.Tag
+				}
+
+				c.writeRequestError(tag, requestErr)
+				continue
+			}
+
+			c.Log.Error("cannot read command: %v", err)
+			c.writeUntagged("BYE %v", err)
+			return
+		}
+
+		c.responded = false
+
+		code, err := c.processCommand(cmd)
+		if err != nil {
+			var requestErr *RequestError
+			if errors.As(err, &requestErr) {
+				c.writeRequestError(cmd.Tag, requestErr)
+				continue
+			}
+
+			c.Log.Error("%s: %v", cmd.Name, err)
+			c.writeUntagged("BYE internal error")
+			return
+		}
+
+		if c.responded {
+			continue
+		}
+
+		if c.selected != nil {
+			if err := c.update(allowsExpungeResponses(cmd.Name)); err != nil {
+				c.Log.Error("cannot update selected mailbox: %v", err)
+				c.writeUntagged("BYE internal error")
+				return
+			}
+		}
+
+		c.writeTagged(cmd.Tag, "OK", code, "%s completed", cmd.Name)
+
+		if cmd.Name == "LOGOUT" {
+			return
+		}
+	}
+}
+
+// RFC 9051 7.5.1. EXPUNGE responses must not be sent during FETCH, STORE and
+// SEARCH commands since clients could not know which message a sequence
+// number refers to.
+func allowsExpungeResponses(command string) bool {
+	switch command {
+	case "FETCH", "STORE", "SEARCH":
+		return false
+	}
+
+	return true
+}
+
+// readRawLine reads a line without its line ending; contrary to readLine, it
+// does not panic when the connection is closed.
+func (c *ServerConn) readRawLine() ([]byte, error) {
+	s, err := c.rbuf.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("line too long")
+		}
+
+		return nil, err
+	}
+
+	if len(s) < 2 || s[len(s)-2] != '\r' {
+		return nil, fmt.Errorf("missing carriage return before newline")
+	}
+
+	return bytes.Clone(s[:len(s)-2]), nil
+}
+
+func (c *ServerConn) readLine() ([]byte, error) {
+	line, err := c.readRawLine()
+	if err != nil {
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			panic(NewExpectedError(err))
+		}
+
+		return nil, fmt.Errorf("cannot read connection: %w", err)
+	}
+
+	return line, nil
+}
+
+func (c *ServerConn) writeLine(format string, args ...any) {
+	c.wbuf.Reset()
+
+	fmt.Fprintf(&c.wbuf, format, args...)
+	c.wbuf.WriteString("\r\n")
+
+	c.flush()
+}
+
+func (c *ServerConn) writeData(data []byte) {
+	c.wbuf.Reset()
+	c.wbuf.Write(data)
+	c.flush()
+}
+
+func (c *ServerConn) flush() {
+	if _, err := io.Copy(c.conn, &c.wbuf); err != nil {
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			panic(NewExpectedError(err))
+		}
+
+		panic(err)
+	}
+}
+
+func (c *ServerConn) writeUntagged(format string, args ...any) {
+	c.writeLine("* "+format, args...)
+}
+
+func (c *ServerConn) writeTagged(tag, status, code, format string, args ...any) {
+	c.wbuf.Reset()
+
+	c.wbuf.WriteString(tag + " " + status)
+
+	if code != "" {
+		c.wbuf.WriteString(" [" + code + "]")
+	}
+
+	c.wbuf.WriteByte(' ')
+	fmt.Fprintf(&c.wbuf, format, args...)
+	c.wbuf.WriteString("\r\n")
+
+	c.flush()
+}
+
+func (c *ServerConn) writeRequestError(tag string, err *RequestError) {
+	c.writeTagged(tag, err.Status, err.Code, "%s", err.Message)
+}
+
+func (c *ServerConn) canAuthenticate() bool {
+	return c.tls || c.Server.Cfg.AllowInsecureAuthentication
+}
+
+// IMAP4rev2 includes various extensions which used to be optional; they are
+// listed for clients checking them individually.
+func (c *ServerConn) capabilities() string {
+	caps := []string{"IMAP4rev2"}
+
+	if c.identity == "" {
+		if c.Server.Cfg.TLSConfig != nil && !c.tls {
+			caps = append(caps, "STARTTLS")
+		}
+
+		if c.canAuthenticate() {
+			for _, mechanism := range sasl.Mechanisms {
+				caps = append(caps, "AUTH="+mechanism)
+			}
+
+			caps = append(caps, "SASL-IR")
+		} else {
+			caps = append(caps, "LOGINDISABLED")
+		}
+	}
+
+	caps = append(caps, "CONDSTORE", "CREATE-SPECIAL-USE", "ENABLE", "ESEARCH",
+		"IDLE", "LIST-EXTENDED", "LIST-STATUS", "LITERAL+", "MOVE",
+		"NAMESPACE", "QRESYNC", "SEARCHRES", "SPECIAL-USE", "STATUS=SIZE",
+		"UIDPLUS", "UNSELECT")
+
+	return strings.Join(caps, " ")
+}
+
+type commandState int
+
+const (
+	stateAny commandState = iota
+	stateNotAuthenticated
+	stateAuthenticated
+	stateSelected
+)
+
+func (c *ServerConn) processCommand(cmd *Command) (string, error) {
+	var fn func(*Command) (string, error)
+	state := stateAuthenticated
+
+	uidFn := func(fn func(*Command, bool) (string, error), uid bool) func(*Command) (string, error) {
+		return func(cmd *Command) (string, error) { return fn(cmd, uid) }
+	}
+
+	switch cmd.Name {
+	case "CAPABILITY":
+		fn, state = c.processCAPABILITY, stateAny
+	case "NOOP":
+		fn, state = c.processNOOP, stateAny
+	case "LOGOUT":
+		fn, state = c.processLOGOUT, stateAny
+
+	case "STARTTLS":
+		fn, state = c.processSTARTTLS, stateNotAuthenticated
+	case "AUTHENTICATE":
+		fn, state = c.processAUTHENTICATE, stateNotAuthenticated
+	case "LOGIN":
+		fn, state = c.processLOGIN, stateNotAuthenticated
+
+	case "ENABLE":
+		fn = c.processENABLE
+	case "SELECT":
+		fn = uidFn(c.processSELECT, false)
+	case "EXAMINE":
+		fn = uidFn(c.processSELECT, true)
+	case "CREATE":
+		fn = c.processCREATE
+	case "DELETE":
+		fn = c.processDELETE
+	case "RENAME":
+		fn = c.processRENAME
+	case "SUBSCRIBE":
+		fn = c.processSUBSCRIBE
+	case "UNSUBSCRIBE":
+		fn = c.processUNSUBSCRIBE
+	case "LIST":
+		fn = c.processLIST
+	case "NAMESPACE":
+		fn = c.processNAMESPACE
+	case "STATUS":
+		fn = c.processSTATUS
+	case "APPEND":
+		fn = c.processAPPEND
+	case "IDLE":
+		fn = c.processIDLE
+
+	case "CLOSE":
+		fn, state = c.processCLOSE, stateSelected
+	case "UNSELECT":
+		fn, state = c.processUNSELECT, stateSelected
+	case "EXPUNGE":
+		fn, state = uidFn(c.processEXPUNGE, false), stateSelected
+	case "UID EXPUNGE":
+		fn, state = uidFn(c.processEXPUNGE, true), stateSelected
+	case "SEARCH":
+		fn, state = uidFn(c.processSEARCH, false), stateSelected
+	case "UID SEARCH":
+		fn, state = uidFn(c.processSEARCH, true), stateSelected
+	case "FETCH":
+		fn, state = uidFn(c.processFETCH, false), stateSelected
+	case "UID FETCH":
+		fn, state = uidFn(c.processFETCH, true), stateSelected
+	case "STORE":
+		fn, state = uidFn(c.processSTORE, false), stateSelected
+	case "UID STORE":
+		fn, state = uidFn(c.processSTORE, true), stateSelected
+	case "COPY":
+		fn, state = uidFn(c.processCOPY, false), stateSelected
+	case "UID COPY":
+		fn, state = uidFn(c.processCOPY, true), stateSelected
+	case "MOVE":
+		fn, state = uidFn(c.processMOVE, false), stateSelected
+	case "UID MOVE":
+		fn, state = uidFn(c.processMOVE, true), stateSelected
+
+	default:
+		return "", syntaxErrorf("unknown command %q", cmd.Name)
+	}
+
+	switch state {
+	case stateNotAuthenticated:
+		if c.identity != "" {
+			return "", syntaxErrorf("already authenticated")
+		}
+
+	case stateAuthenticated:
+		if c.identity == "" {
+			return "", syntaxErrorf("authentication required")
+		}
+
+	case stateSelected:
+		if c.identity == "" {
+			return "", syntaxErrorf("authentication required")
+		}
+
+		if c.selected == nil {
+			return "", syntaxErrorf("no mailbox selected")
+		}
+	}
+
+	return fn(cmd)
+}
+
+func checkNbArguments(cmd *Command, n int) error {
+	if len(cmd.Arguments) != n {
+		return syntaxErrorf("invalid number of arguments")
+	}
+
+	return nil
+}
+
+func (c *ServerConn) processCAPABILITY(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 0); err != nil {
+		return "", err
+	}
+
+	c.writeUntagged("CAPABILITY %s", c.capabilities())
+	return "", nil
+}
+
+func (c *ServerConn) processNOOP(cmd *Command) (string, error) {
+	// Changes of the selected mailbox are sent after each command
+	return "", nil
+}
+
+func (c *ServerConn) processLOGOUT(cmd *Command) (string, error) {
+	c.writeUntagged("BYE logging out")
+	return "", nil
+}
+
+func (c *ServerConn) processSTARTTLS(cmd *Command) (string, error) {
+	if c.Server.Cfg.TLSConfig == nil {
+		return "", syntaxErrorf("STARTTLS not supported")
+	}
+
+	if c.tls {
+		return "", syntaxErrorf("TLS already active")
+	}
+
+	// Data sent by the client after the command must not be processed once
+	// TLS is active.
+	if c.rbuf.Buffered() > 0 {
+		return "", syntaxErrorf("unexpected data after STARTTLS")
+	}
+
+	c.writeTagged(cmd.Tag, "OK", "", "begin TLS negotiation")
+	c.responded = true
+
+	c.startTLS()
+	return "", nil
+}
+
+func (c *ServerConn) startTLS() {
+	tlsConn := tls.Server(c.conn, c.Server.Cfg.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Log.Error("cannot establish TLS connection: %v", err)
+		panic(NewExpectedError(err))
+	}
+
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReaderSize(c.conn, MaxLineLength)
+	c.tls = true
+}
+
+func (c *ServerConn) processLOGIN(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 2); err != nil {
+		return "", err
+	}
+
+	if !c.canAuthenticate() {
+		return "", requestErrorf("PRIVACYREQUIRED",
+			"authentication requires a TLS connection")
+	}
+
+	username, ok := astringValue(cmd.Arguments[0])
+	if !ok {
+		return "", syntaxErrorf("invalid user name")
+	}
+
+	password, ok := astringValue(cmd.Arguments[1])
+	if !ok {
+		return "", syntaxErrorf("invalid password")
+	}
+
+	err := c.Server.Cfg.Authenticator.Authenticate(username, password)
+	if err != nil {
+		return "", c.authenticationFailure(err)
+	}
+
+	return c.authenticated(username)
+}
+
+func (c *ServerConn) processAUTHENTICATE(cmd *Command) (string, error) {
+	if len(cmd.Arguments) < 1 || len(cmd.Arguments) > 2 {
+		return "", syntaxErrorf("invalid number of arguments")
+	}
+
+	if !c.canAuthenticate() {
+		return "", requestErrorf("PRIVACYREQUIRED",
+			"authentication requires a TLS connection")
+	}
+
+	name, ok := atomValue(cmd.Arguments[0])
+	if !ok {
+		return "", syntaxErrorf("invalid mechanism")
+	}
+
+	mechanism, err := sasl.NewServerMechanism(name, c.Server.Cfg.Authenticator)
+	if err != nil {
+		return "", requestErrorf("CANNOT", "unsupported mechanism %q", name)
+	}
+
+	var response []byte
+
+	// RFC 4959 3. Initial response, "=" being an empty response
+	if len(cmd.Arguments) > 1 {
+		initialResponse, ok := atomValue(cmd.Arguments[1])
+		if !ok {
+			return "", syntaxErrorf("invalid initial response")
+		}
+
+		response, err = decodeSASLResponse(initialResponse)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for {
+		challenge, done, err := mechanism.Next(response)
+		if err != nil {
+			return "", c.authenticationFailure(err)
+		}
+
+		if done {
+			break
+		}
+
+		c.writeLine("+ %s", base64.StdEncoding.EncodeToString(challenge))
+
+		line, err := c.readLine()
+		if err != nil {
+			return "", err
+		}
+
+		if string(line) == "*" {
+			return "", syntaxErrorf("authentication aborted")
+		}
+
+		response, err = base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return "", syntaxErrorf("invalid response")
+		}
+
+		if response == nil {
+			response = []byte{}
+		}
+	}
+
+	return c.authenticated(mechanism.Identity())
+}
+
+func decodeSASLResponse(s string) ([]byte, error) {
+	if s == "=" {
+		return []byte{}, nil
+	}
+
+	response, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, syntaxErrorf("invalid initial response")
+	}
+
+	if response == nil {
+		response = []byte{}
+	}
+
+	return response, nil
+}
+
+func (c *ServerConn) authenticated(identity string) (string, error) {
+	account, err := c.Server.Cfg.Store.Account(identity)
+	if err != nil {
+		return "", c.storeError(err)
+	}
+
+	c.identity = identity
+	c.account = account
+
+	c.Log.Info("user %q authenticated", c.identity)
+
+	return "CAPABILITY " + c.capabilities(), nil
+}
+
+func (c *ServerConn) authenticationFailure(err error) error {
+	if !errors.Is(err, sasl.ErrAuthenticationFailed) {
+		c.Log.Error("authentication error: %v", err)
+	}
+
+	c.nbAuthFailures++
+
+	if c.nbAuthFailures >= MaxAuthenticationFailures {
+		c.writeUntagged("BYE too many authentication failures")
+		panic(NewExpectedError(err))
+	}
+
+	return requestErrorf("AUTHENTICATIONFAILED", "authentication failed")
+}
+
+func (c *ServerConn) processENABLE(cmd *Command) (string, error) {
+	if len(cmd.Arguments) == 0 {
+		return "", syntaxErrorf("missing capability")
+	}
+
+	// RFC 5161 3.1. Unknown capabilities are ignored; the response only
+	// contains capabilities enabled by the command.
+	var enabled []string
+
+	for _, value := range cmd.Arguments {
+		name, ok := atomValue(value)
+		if !ok {
+			return "", syntaxErrorf("invalid capability")
+		}
+
+		switch name = strings.ToUpper(name); name {
+		case "CONDSTORE":
+			if !c.condStore {
+				c.condStore = true
+				enabled = append(enabled, name)
+			}
+
+		case "QRESYNC":
+			if !c.qresync {
+				c.condStore = true
+				c.qresync = true
+				enabled = append(enabled, name)
+			}
+		}
+	}
+
+	if len(enabled) > 0 {
+		c.writeUntagged("ENABLED %s", strings.Join(enabled, " "))
+	} else {
+		c.writeUntagged("ENABLED")
+	}
+
+	return "", nil
+}
+
+func (c *ServerConn) processSELECT(cmd *Command, readOnly bool) (string, error) {
+	if len(cmd.Arguments) < 1 || len(cmd.Arguments) > 2 {
+		return "", syntaxErrorf("invalid number of arguments")
+	}
+
+	name, err := mailboxArgument(cmd.Arguments[0])
+	if err != nil {
+		return "", err
+	}
+
+	var qresyncParams *qresyncParameters
+
+	if len(cmd.Arguments) > 1 {
+		params, ok := listValue(cmd.Arguments[1])
+		if !ok {
+			return "", syntaxErrorf("invalid select parameters")
+		}
+
+		for i := 0; i < len(params); i++ {
+			param, _ := atomValue(params[i])
+
+			switch strings.ToUpper(param) {
+			case "CONDSTORE":
+				c.condStore = true
+
+			case "QRESYNC":
+				if !c.qresync {
+					return "", syntaxErrorf("QRESYNC is not enabled")
+				}
+
+				if i+1 == len(params) {
+					return "", syntaxErrorf("missing QRESYNC parameters")
+				}
+
+				i++
+
+				if qresyncParams, err = parseQResyncParameters(params[i]); err != nil {
+					return "", err
+				}
+
+			default:
+				return "", syntaxErrorf("invalid select parameter")
+			}
+		}
+	}
+
+	// RFC 9051 6.3.2. Selecting a mailbox closes the selected mailbox even
+	// if the command fails.
+	if c.selected != nil {
+		c.selected = nil
+		c.writeUntagged("OK [CLOSED] previous mailbox closed")
+	}
+
+	if err := c.selectMailbox(name, readOnly); err != nil {
+		return "", err
+	}
+
+	if qresyncParams != nil {
+		if err := c.resynchronize(qresyncParams); err != nil {
+			return "", err
+		}
+	}
+
+	if readOnly {
+		return "READ-ONLY", nil
+	}
+
+	return "READ-WRITE", nil
+}
+
+func (c *ServerConn) processCREATE(cmd *Command) (string, error) {
+	if len(cmd.Arguments) < 1 || len(cmd.Arguments) > 2 {
+		return "", syntaxErrorf("invalid number of arguments")
+	}
+
+	name, err := mailboxArgument(cmd.Arguments[0])
+	if err != nil {
+		return "", err
+	}
+
+	// RFC 6154 3. CREATE-SPECIAL-USE: "(USE (<attributes>))"
+	var specialUse string
+
+	if len(cmd.Arguments) > 1 {
+		params, ok := listValue(cmd.Arguments[1])
+		if !ok || len(params) != 2 {
+			return "", syntaxErrorf("invalid create parameters")
+		}
+
+		if name, _ := atomValue(params[0]); !strings.EqualFold(name, "USE") {
+			return "", syntaxErrorf("invalid create parameter")
+		}
+
+		uses, err := flagsArgument(params[1])
+		if err != nil {
+			return "", err
+		}
+
+		switch len(uses) {
+		case 0:
+		case 1:
+			specialUse = uses[0]
+		default:
+			return "", requestErrorf("USEATTR",
+				"mailboxes can only have one special use")
+		}
+	}
+
+	// RFC 9051 6.3.4. A trailing separator indicates that the client intends
+	// to create child mailboxes; superior mailboxes are created if necessary.
+	name = strings.TrimSuffix(name, mailstore.Separator)
+
+	parts := strings.Split(name, mailstore.Separator)
+
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], mailstore.Separator)
+
+		err := c.account.CreateMailbox(parent)
+		if err != nil && !errors.Is(err, mailstore.ErrMailboxExists) {
+			return "", c.storeError(err)
+		}
+	}
+
+	if specialUse == "" {
+		err = c.account.CreateMailbox(name)
+	} else {
+		err = c.account.CreateSpecialUseMailbox(name, specialUse)
+	}
+	if err != nil {
+		return "", c.storeError(err)
+	}
+
+	return "", nil
+}
+
+func (c *ServerConn) processDELETE(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 1); err != nil {
+		return "", err
+	}
+
+	name, err := mailboxArgument(cmd.Arguments[0])
+	if err != nil {
+		return "", err
+	}
+
+	if c.selected != nil &&
+		c.selected.name == mailstore.NormalizeMailboxName(name) {
+		c.selected = nil
+	}
+
+	if err := c.account.DeleteMailbox(name); err != nil {
+		return "", c.storeError(err)
+	}
+
+	return "", nil
+}
+
+func (c *ServerConn) processRENAME(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 2); err != nil {
+		return "", err
+	}
+
+	oldName, err := mailboxArgument(cmd.Arguments[0])
+	if err != nil {
+		return "", err
+	}
+
+	newName, err := mailboxArgument(cmd.Arguments[1])
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.account.RenameMailbox(oldName, newName); err != nil {
+		return "", c.storeError(err)
+	}
+
+	// The selected mailbox or one of its parents may have been renamed
+	if mb := c.selected; mb != nil {
+		oldName = mailstore.NormalizeMailboxName(oldName)
+
+		if mb.name == oldName {
+			mb.name = newName
+		} else if suffix, found := strings.CutPrefix(mb.name, oldName+mailstore.Separator); found {
+			mb.name = newName + mailstore.Separator + suffix
+		}
+	}
+
+	return "", nil
+}
+
+// Subscriptions are not stored: all mailboxes are considered subscribed.
+
+func (c *ServerConn) processSUBSCRIBE(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 1); err != nil {
+		return "", err
+	}
+
+	name, err := mailboxArgument(cmd.Arguments[0])
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := c.account.Mailbox(name); err != nil {
+		return "", c.storeError(err)
+	}
+
+	return "", nil
+}
+
+func (c *ServerConn) processUNSUBSCRIBE(cmd *Command) (string, error) {
+	return "", requestErrorf("CANNOT", "all mailboxes are subscribed")
+}
+
+// RFC 9051 6.3.9. LIST Command, including the extended syntax of RFC 5258,
+// the STATUS return option of RFC 5819 and the SPECIAL-USE options of RFC
+// 6154. Special use attributes are always returned.
+func (c *ServerConn) processLIST(cmd *Command) (string, error) {
+	args := cmd.Arguments
+
+	var subscribedAttr, specialUseOnly bool
+	var statusItems list
+
+	if len(args) > 0 {
+		if options, ok := listValue(args[0]); ok {
+			for _, value := range options {
+				option, _ := atomValue(value)
+
+				switch strings.ToUpper(option) {
+				case "SUBSCRIBED":
+					subscribedAttr = true
+				case "SPECIAL-USE":
+					specialUseOnly = true
+				case "REMOTE", "RECURSIVEMATCH":
+				default:
+					return "", syntaxErrorf("invalid selection option")
+				}
+			}
+
+			args = args[1:]
+		}
+	}
+
+	if len(args) != 2 && len(args) != 4 {
+		return "", syntaxErrorf("invalid number of arguments")
+	}
+
+	reference, ok := astringValue(args[0])
+	if !ok {
+		return "", syntaxErrorf("invalid reference name")
+	}
+
+	var patterns []string
+
+	patternValues, ok := listValue(args[1])
+	if !ok {
+		patternValues = list{args[1]}
+	}
+
+	for _, value := range patternValues {
+		pattern, ok := astringValue(value)
+		if !ok {
+			return "", syntaxErrorf("invalid mailbox pattern")
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	if len(args) == 4 {
+		if name, _ := atomValue(args[2]); !strings.EqualFold(name, "RETURN") {
+			return "", syntaxErrorf("invalid argument")
+		}
+
+		options, ok := listValue(args[3])
+		if !ok {
+			return "", syntaxErrorf("invalid return options")
+		}
+
+		for i := 0; i < len(options); i++ {
+			option, _ := atomValue(options[i])
+
+			switch strings.ToUpper(option) {
+			case "SUBSCRIBED":
+				subscribedAttr = true
+			case "CHILDREN", "SPECIAL-USE":
+			case "STATUS":
+				if i+1 == len(options) {
+					return "", syntaxErrorf("missing status items")
+				}
+
+				if statusItems, ok = listValue(options[i+1]); !ok {
+					return "", syntaxErrorf("invalid status items")
+				}
+
+				i++
+			default:
+				return "", syntaxErrorf("invalid return option")
+			}
+		}
+	}
+
+	if len(patterns) == 1 && patterns[0] == "" {
+		// RFC 9051 6.3.9. Hierarchy delimiter request
+		c.writeUntagged(`LIST (\Noselect) %s ""`,
+			encodeString(mailstore.Separator))
+		return "", nil
+	}
+
+	mailboxes := c.account.Mailboxes()
+
+	// Parents of existing mailboxes may not exist; they are still listed
+	// so that clients can display the hierarchy.
+	names := make(map[string]bool)
+	specialUses := make(map[string]string)
+	for _, mb := range mailboxes {
+		names[mb.Name] = true
+		specialUses[mb.Name] = mb.SpecialUse
+	}
+
+	var candidates []string
+	for _, mb := range mailboxes {
+		parts := strings.Split(mb.Name, mailstore.Separator)
+
+		for i := 1; i <= len(parts); i++ {
+			name := strings.Join(parts[:i], mailstore.Separator)
+
+			if _, found := names[name]; !found || i == len(parts) {
+				names[name] = i == len(parts)
+				candidates = append(candidates, name)
+			}
+		}
+	}
+
+	for _, name := range candidates {
+		if !matchMailboxPatterns(reference, patterns, name) {
+			continue
+		}
+
+		if specialUseOnly && specialUses[name] == "" {
+			continue
+		}
+
+		var attrs []string
+
+		exists := names[name]
+		if !exists {
+			attrs = append(attrs, `\NonExistent`)
+		}
+
+		hasChildren := false
+		for name2 := range names {
+			if strings.HasPrefix(name2, name+mailstore.Separator) {
+				hasChildren = true
+				break
+			}
+		}
+
+		if hasChildren {
+			attrs = append(attrs, `\HasChildren`)
+		} else {
+			attrs = append(attrs, `\HasNoChildren`)
+		}
+
+		if subscribedAttr && exists {
+			attrs = append(attrs, `\Subscribed`)
+		}
+
+		if specialUse := specialUses[name]; specialUse != "" {
+			attrs = append(attrs, specialUse)
+		}
+
+		c.writeUntagged("LIST %s %s %s", encodeFlags(attrs),
+			encodeString(mailstore.Separator), encodeString(name))
+
+		if statusItems != nil && exists {
+			if err := c.writeStatus(name, statusItems); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return "", nil
+}
+
+func matchMailboxPatterns(reference string, patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		pattern = reference + pattern
+
+		// INBOX is case-insensitive
+		if len(pattern) >= len(mailstore.InboxName) &&
+			strings.EqualFold(pattern[:len(mailstore.InboxName)], mailstore.InboxName) {
+			pattern = mailstore.InboxName + pattern[len(mailstore.InboxName):]
+		}
+
+		if matchMailboxPattern(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchMailboxPattern matches a mailbox name against a pattern where "*"
+// matches any sequence of characters and "%" any sequence of characters
+// except the hierarchy separator.
+func matchMailboxPattern(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*', '%':
+			for i := 0; i <= len(name); i++ {
+				if matchMailboxPattern(pattern[1:], name[i:]) {
+					return true
+				}
+
+				if i < len(name) && pattern[0] == '%' &&
+					strings.HasPrefix(name[i:], mailstore.Separator) {
+					return false
+				}
+			}
+
+			return false
+
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+
+	return len(name) == 0
+}
+
+func (c *ServerConn) processNAMESPACE(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 0); err != nil {
+		return "", err
+	}
+
+	// RFC 9051 6.3.10. A single personal namespace
+	c.writeUntagged(`NAMESPACE (("" %s)) NIL NIL`,
+		encodeString(mailstore.Separator))
+	return "", nil
+}
+
+func (c *ServerConn) processSTATUS(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 2); err != nil {
+		return "", err
+	}
+
+	name, err := mailboxArgument(cmd.Arguments[0])
+	if err != nil {
+		return "", err
+	}
+
+	items, ok := listValue(cmd.Arguments[1])
+	if !ok || len(items) == 0 {
+		return "", syntaxErrorf("invalid status items")
+	}
+
+	if err := c.writeStatus(name, items); err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
+
+// RFC 9051 6.3.11. STATUS Command
+func (c *ServerConn) writeStatus(name string, items list) error {
+	info, err := c.account.Mailbox(name)
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	msgs, err := c.account.Messages(info.Name)
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	var values []string
+
+	for _, value := range items {
+		item, _ := atomValue(value)
+		item = strings.ToUpper(item)
+
+		var n int64
+
+		switch item {
+		case "MESSAGES":
+			n = int64(info.NbMessages)
+
+		case "UIDNEXT":
+			n = int64(info.UIDNext)
+
+		case "UIDVALIDITY":
+			n = int64(info.UIDValidity)
+
+		case "UNSEEN":
+			n = int64(info.NbUnseen)
+
+		case "DELETED":
+			for _, msg := range msgs {
+				if msg.HasFlag(mailstore.FlagDeleted) {
+					n++
+				}
+			}
+
+		case "SIZE":
+			for _, msg := range msgs {
+				n += msg.Size
+			}
+
+		case "HIGHESTMODSEQ":
+			n = int64(info.HighestModSeq)
+			c.condStore = true
+
+		default:
+			return syntaxErrorf("invalid status item")
+		}
+
+		values = append(values, fmt.Sprintf("%s %d", item, n))
+	}
+
+	c.writeUntagged("STATUS %s (%s)", encodeString(info.Name),
+		strings.Join(values, " "))
+
+	return nil
+}
+
+func (c *ServerConn) processAPPEND(cmd *Command) (string, error) {
+	args := cmd.Arguments
+
+	if len(args) < 2 || len(args) > 4 {
+		return "", syntaxErrorf("invalid number of arguments")
+	}
+
+	name, err := mailboxArgument(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	args = args[1:]
+
+	var flags []string
+
+	if _, ok := listValue(args[0]); ok {
+		if flags, err = flagsArgument(args[0]); err != nil {
+			return "", err
+		}
+
+		args = args[1:]
+	}
+
+	var date time.Time
+
+	if len(args) == 2 {
+		s, ok := args[0].(string)
+		if !ok {
+			return "", syntaxErrorf("invalid date")
+		}
+
+		if date, err = parseDateTime(s); err != nil {
+			return "", err
+		}
+
+		args = args[1:]
+	}
+
+	if len(args) != 1 {
+		return "", syntaxErrorf("invalid arguments")
+	}
+
+	data, ok := args[0].(string)
+	if !ok {
+		return "", syntaxErrorf("invalid message")
+	}
+
+	uid, err := c.account.AppendMessage(name, []byte(data), flags, date)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMailboxNotFound) {
+			return "", requestErrorf("TRYCREATE", "mailbox does not exist")
+		}
+
+		return "", c.storeError(err)
+	}
+
+	info, err := c.account.Mailbox(name)
+	if err != nil {
+		return "", c.storeError(err)
+	}
+
+	// RFC 9051 6.3.12. The APPENDUID response code is part of IMAP4rev2
+	return fmt.Sprintf("APPENDUID %d %d", info.UIDValidity, uid), nil
+}
+
+// RFC 2177 IMAP4 IDLE command (part of IMAP4rev2)
+func (c *ServerConn) processIDLE(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 0); err != nil {
+		return "", err
+	}
+
+	changes, unwatch := c.account.Watch()
+	defer unwatch()
+
+	type lineResult struct {
+		line []byte
+		err  error
+	}
+
+	// The line is read in a separate goroutine so that changes can be sent
+	// while waiting for the client. The channel is buffered so that the
+	// goroutine never blocks if the connection fails while idling.
+	lineChan := make(chan lineResult, 1)
+
+	c.writeLine("+ idling")
+
+	go func() {
+		line, err := c.readRawLine()
+		lineChan <- lineResult{line, err}
+	}()
+
+	for {
+		select {
+		case <-changes:
+			if c.selected != nil {
+				if err := c.update(true); err != nil {
+					return "", err
+				}
+			}
+
+		case result := <-lineChan:
+			if result.err != nil {
+				if result.err == io.EOF || errors.Is(result.err, net.ErrClosed) {
+					panic(NewExpectedError(result.err))
+				}
+
+				return "", fmt.Errorf("cannot read connection: %w", result.err)
+			}
+
+			if !strings.EqualFold(string(result.line), "DONE") {
+				return "", syntaxErrorf("invalid IDLE continuation")
+			}
+
+			return "", nil
+		}
+	}
+}
+
+func (c *ServerConn) processCLOSE(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 0); err != nil {
+		return "", err
+	}
+
+	// RFC 9051 6.4.1. Deleted messages are silently expunged
+	if !c.selected.readOnly {
+		if _, err := c.expungeDeletedMessages(nil); err != nil {
+			return "", err
+		}
+	}
+
+	c.selected = nil
+
+	return "", nil
+}
+
+func (c *ServerConn) processUNSELECT(cmd *Command) (string, error) {
+	if err := checkNbArguments(cmd, 0); err != nil {
+		return "", err
+	}
+
+	c.selected = nil
+
+	return "", nil
+}
+
+func (c *ServerConn) processEXPUNGE(cmd *Command, uid bool) (string, error) {
+	var set *sequenceSet
+
+	if uid {
+		if err := checkNbArguments(cmd, 1); err != nil {
+			return "", err
+		}
+
+		var err error
+		if set, err = parseSequenceSet(cmd.Arguments[0]); err != nil {
+			return "", err
+		}
+	} else {
+		if err := checkNbArguments(cmd, 0); err != nil {
+			return "", err
+		}
+	}
+
+	if c.selected.readOnly {
+		return "", requestErrorf("", "mailbox is read-only")
+	}
+
+	// EXPUNGE responses are sent by the update following the command
+	if _, err := c.expungeDeletedMessages(set); err != nil {
+		return "", err
+	}
+
+	if c.condStore {
+		info, err := c.account.Mailbox(c.selected.name)
+		if err != nil {
+			return "", c.storeError(err)
+		}
+
+		return fmt.Sprintf("HIGHESTMODSEQ %d", info.HighestModSeq), nil
+	}
+
+	return "", nil
+}
+
+// expungeDeletedMessages expunges messages of the selected mailbox which
+// have the \Deleted flag and are contained in a UID set if it is not nil.
+func (c *ServerConn) expungeDeletedMessages(set *sequenceSet) ([]uint32, error) {
+	msgs, err := c.selectedMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []int
+	if set != nil {
+		indexes = c.selected.resolve(set, true)
+	} else {
+		for i := range c.selected.uids {
+			indexes = append(indexes, i)
+		}
+	}
+
+	var uids []uint32
+
+	for _, idx := range indexes {
+		uid := c.selected.uids[idx]
+
+		if msg := msgs[uid]; msg != nil && msg.HasFlag(mailstore.FlagDeleted) {
+			uids = append(uids, uid)
+		}
+	}
+
+	if err := c.account.ExpungeMessages(c.selected.name, uids); err != nil {
+		return nil, c.storeError(err)
+	}
+
+	return uids, nil
+}
+
+// RFC 9051 6.4.6. STORE Command, with the UNCHANGEDSINCE modifier of RFC
+// 7162 3.1.3.
+func (c *ServerConn) processSTORE(cmd *Command, uid bool) (string, error) {
+	args := cmd.Arguments
+
+	if len(args) < 3 {
+		return "", syntaxErrorf("invalid number of arguments")
+	}
+
+	set, err := parseSequenceSet(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	args = args[1:]
+
+	var unchangedSince *uint64
+
+	if modifiers, ok := listValue(args[0]); ok {
+		if len(modifiers) != 2 {
+			return "", syntaxErrorf("invalid store modifiers")
+		}
+
+		if name, _ := atomValue(modifiers[0]); !strings.EqualFold(name, "UNCHANGEDSINCE") {
+			return "", syntaxErrorf("invalid store modifier")
+		}
+
+		modSeq, err := modSeqArgument(modifiers[1])
+		if err != nil {
+			return "", err
+		}
+
+		unchangedSince = &modSeq
+		c.condStore = true
+
+		args = args[1:]
+
+		if len(args) < 2 {
+			return "", syntaxErrorf("invalid number of arguments")
+		}
+	}
+
+	itemName, ok := atomValue(args[0])
+	if !ok {
+		return "", syntaxErrorf("invalid store item")
+	}
+
+	itemName = strings.ToUpper(itemName)
+	itemName, silent := strings.CutSuffix(itemName, ".SILENT")
+
+	var op mailstore.FlagOperation
+
+	switch itemName {
+	case "FLAGS":
+		op = mailstore.FlagOperationReplace
+	case "+FLAGS":
+		op = mailstore.FlagOperationAdd
+	case "-FLAGS":
+		op = mailstore.FlagOperationRemove
+	default:
+		return "", syntaxErrorf("invalid store item")
+	}
+
+	var flags []string
+
+	if len(args) == 2 {
+		flags, err = flagsArgument(args[1])
+	} else {
+		flags, err = flagsArgument(list(args[1:]))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if c.selected.readOnly {
+		return "", requestErrorf("", "mailbox is read-only")
+	}
+
+	indexes := c.selected.resolve(set, uid)
+
+	uids := make([]uint32, len(indexes))
+	for i, idx := range indexes {
+		uids[i] = c.selected.uids[idx]
+	}
+
+	var modifiedMsgs []*mailstore.MessageInfo
+	var failedUIDs []uint32
+
+	switch {
+	case unchangedSince == nil:
+		modifiedMsgs, err = c.account.StoreFlags(c.selected.name, uids, op,
+			flags)
+
+	case *unchangedSince == 0:
+		// Every message has a modification sequence greater than zero
+		failedUIDs = uids
+
+	default:
+		modifiedMsgs, failedUIDs, err = c.account.StoreFlagsUnchangedSince(
+			c.selected.name, uids, op, flags, *unchangedSince)
+	}
+	if err != nil {
+		return "", c.storeError(err)
+	}
+
+	failed := make(map[uint32]bool)
+	for _, failedUID := range failedUIDs {
+		failed[failedUID] = true
+	}
+
+	code := ""
+	if len(failedUIDs) > 0 {
+		var numbers []uint32
+
+		for _, idx := range indexes {
+			if msgUID := c.selected.uids[idx]; failed[msgUID] {
+				if uid {
+					numbers = append(numbers, msgUID)
+				} else {
+					numbers = append(numbers, uint32(idx+1))
+				}
+			}
+		}
+
+		code = "MODIFIED " + formatSequenceSet(numbers)
+	}
+
+	if silent {
+		// Changes made by this command must not be reported by the next
+		// update, but the new modification sequences must be (RFC 7162
+		// 3.1.3.).
+		for _, msg := range modifiedMsgs {
+			c.selected.flags[msg.UID] = encodeFlags(msg.Flags)
+
+			if c.condStore {
+				if seq := c.selected.sequenceNumber(msg.UID); seq > 0 {
+					c.writeUntagged("%d FETCH (UID %d MODSEQ (%d))", seq,
+						msg.UID, msg.ModSeq)
+				}
+			}
+		}
+
+		return code, nil
+	}
+
+	msgs, err := c.selectedMessages()
+	if err != nil {
+		return "", err
+	}
+
+	for _, idx := range indexes {
+		msgUID := c.selected.uids[idx]
+
+		msg := msgs[msgUID]
+		if msg == nil || failed[msgUID] {
+			continue
+		}
+
+		flags := encodeFlags(msg.Flags)
+		c.selected.flags[msgUID] = flags
+
+		switch {
+		case c.condStore:
+			c.writeUntagged("%d FETCH (UID %d FLAGS %s MODSEQ (%d))", idx+1,
+				msgUID, flags, msg.ModSeq)
+		case uid:
+			c.writeUntagged("%d FETCH (UID %d FLAGS %s)", idx+1, msgUID, flags)
+		default:
+			c.writeUntagged("%d FETCH (FLAGS %s)", idx+1, flags)
+		}
+	}
+
+	return code, nil
+}
+
+func (c *ServerConn) processCOPY(cmd *Command, uid bool) (string, error) {
+	code, _, err := c.copyMessages(cmd, uid)
+	return code, err
+}
+
+// RFC 9051 6.4.8. MOVE Command
+func (c *ServerConn) processMOVE(cmd *Command, uid bool) (string, error) {
+	if c.selected.readOnly {
+		return "", requestErrorf("", "mailbox is read-only")
+	}
+
+	code, uids, err := c.copyMessages(cmd, uid)
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.account.ExpungeMessages(c.selected.name, uids); err != nil {
+		return "", c.storeError(err)
+	}
+
+	// The COPYUID response code is sent before EXPUNGE responses
+	if code != "" {
+		c.writeUntagged("OK [%s] messages moved", code)
+	}
+
+	return "", nil
+}
+
+// copyMessages copies messages to another mailbox and returns the COPYUID
+// response code (RFC 9051 7.1.) and the UIDs of the messages copied.
+func (c *ServerConn) copyMessages(cmd *Command, uid bool) (string, []uint32, error) {
+	if err := checkNbArguments(cmd, 2); err != nil {
+		return "", nil, err
+	}
+
+	set, err := parseSequenceSet(cmd.Arguments[0])
+	if err != nil {
+		return "", nil, err
+	}
+
+	destName, err := mailboxArgument(cmd.Arguments[1])
+	if err != nil {
+		return "", nil, err
+	}
+
+	indexes := c.selected.resolve(set, uid)
+
+	uids := make([]uint32, len(indexes))
+	for i, idx := range indexes {
+		uids[i] = c.selected.uids[idx]
+	}
+
+	newUIDs, err := c.account.CopyMessages(c.selected.name, uids, destName)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMailboxNotFound) {
+			if _, err2 := c.account.Mailbox(destName); err2 != nil {
+				return "", nil, requestErrorf("TRYCREATE",
+					"mailbox does not exist")
+			}
+		}
+
+		return "", nil, c.storeError(err)
+	}
+
+	var srcUIDs, destUIDs []uint32
+
+	for i, newUID := range newUIDs {
+		if newUID != 0 {
+			srcUIDs = append(srcUIDs, uids[i])
+			destUIDs = append(destUIDs, newUID)
+		}
+	}
+
+	if len(destUIDs) == 0 {
+		return "", nil, nil
+	}
+
+	info, err := c.account.Mailbox(destName)
+	if err != nil {
+		return "", nil, c.storeError(err)
+	}
+
+	code := fmt.Sprintf("COPYUID %d %s %s", info.UIDValidity,
+		formatSequenceSet(srcUIDs), formatSequenceSet(destUIDs))
+
+	return code, srcUIDs, nil
+}
+
+// storeError converts message store errors to request errors.
+func (c *ServerConn) storeError(err error) error {
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, mailstore.ErrMailboxNotFound):
+		return requestErrorf("NONEXISTENT", "mailbox does not exist")
+	case errors.Is(err, mailstore.ErrMailboxExists):
+		return requestErrorf("ALREADYEXISTS", "mailbox already exists")
+	case errors.Is(err, mailstore.ErrInvalidMailboxName):
+		return requestErrorf("CANNOT", "invalid mailbox name")
+	case errors.Is(err, mailstore.ErrInboxOperation):
+		return requestErrorf("CANNOT", "operation not allowed on INBOX")
+	case errors.Is(err, mailstore.ErrMessageNotFound):
+		return requestErrorf("NONEXISTENT", "message does not exist")
+	case errors.Is(err, mailstore.ErrInvalidSpecialUse):
+		return requestErrorf("USEATTR", "unsupported special use attribute")
+	case errors.Is(err, mailstore.ErrInvalidFlag):
+		return syntaxErrorf("%v", err)
+	case errors.Is(err, mailstore.ErrInvalidUser):
+		return requestErrorf("AUTHORIZATIONFAILED", "invalid user")
+	}
+
+	c.Log.Error("message store error: %v", err)
+	return requestErrorf("SERVERBUG", "internal error")
+}
@@ -0,0 +1,508 @@
+package imap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/testutils"
+	"github.com/galdor/go-log"
+)
+
+const testMessage = "From: Alice <alice@example.org>\r\n" +
+	"To: Bob <bob@example.com>\r\n" +
+	"Subject: Meeting\r\n" +
+	"Date: Mon, 1 Jul 2024 12:00:00 +0000\r\n" +
+	"Message-ID: <1@example.org>\r\n" +
+	"\r\n" +
+	"Hello Bob.\r\n"
+
+const testMultipartMessage = "From: Alice <alice@example.org>\r\n" +
+	"To: Bob <bob@example.com>\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"\r\n" +
+	"AAAA\r\n" +
+	"--b1--\r\n"
+
+func startTestServer(t *testing.T, cfg ServerCfg) *Server {
+	hash, err := sasl.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	cfg.Log = log.DefaultLogger("test")
+	cfg.Authenticator = sasl.PasswordTable{"bob": hash}
+	cfg.Store = mailstore.NewStore(mailstore.Cfg{
+		Log:  log.DefaultLogger("test"),
+		Path: t.TempDir(),
+	})
+	cfg.Host = "127.0.0.1"
+
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("cannot create server: %v", err)
+	}
+
+	server.Cfg.Port = 0 // random port instead of the default one
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+
+	t.Cleanup(func() {
+		server.Stop()
+		cfg.Store.Close()
+	})
+
+	return server
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	rbuf *bufio.Reader
+
+	nbCommands int
+}
+
+func newTestClient(t *testing.T, server *Server) *testClient {
+	address := server.listeners[0].Addr().String()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("cannot connect to server: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	c := testClient{
+		t:    t,
+		conn: conn,
+		rbuf: bufio.NewReader(conn),
+	}
+
+	return &c
+}
+
+func (c *testClient) write(data string) {
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatalf("cannot write data: %v", err)
+	}
+}
+
+// readLine reads a response line; literals are included in the line which
+// contains them.
+func (c *testClient) readLine() string {
+	var buf strings.Builder
+
+	for {
+		line, err := c.rbuf.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("cannot read response: %v", err)
+		}
+
+		line = strings.TrimSuffix(line, "\r\n")
+		buf.WriteString(line)
+
+		start := strings.LastIndexByte(line, '{')
+		if !strings.HasSuffix(line, "}") || start == -1 {
+			return buf.String()
+		}
+
+		size, err := strconv.Atoi(line[start+1 : len(line)-1])
+		if err != nil {
+			return buf.String()
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.rbuf, data); err != nil {
+			c.t.Fatalf("cannot read literal: %v", err)
+		}
+
+		buf.Write(data)
+	}
+}
+
+// command sends a command and returns the untagged responses and the tagged
+// response without its tag.
+func (c *testClient) command(format string, args ...any) ([]string, string) {
+	c.nbCommands++
+	tag := "A" + strconv.Itoa(c.nbCommands)
+
+	c.write(tag + " " + fmt.Sprintf(format, args...) + "\r\n")
+
+	return c.readResponse(tag)
+}
+
+func (c *testClient) readResponse(tag string) ([]string, string) {
+	var lines []string
+
+	for {
+		line := c.readLine()
+
+		if response, found := strings.CutPrefix(line, tag+" "); found {
+			return lines, response
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+func (c *testClient) expect(prefix string, format string, args ...any) []string {
+	lines, response := c.command(format, args...)
+	if !strings.HasPrefix(response, prefix) {
+		c.t.Fatalf("%q: response is %q but should start with %q",
+			fmt.Sprintf(format, args...), response, prefix)
+	}
+
+	return lines
+}
+
+func (c *testClient) startTLS() {
+	c.expect("OK", "STARTTLS")
+
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("cannot establish TLS connection: %v", err)
+	}
+
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReader(tlsConn)
+}
+
+func checkLine(t *testing.T, lines []string, line string) {
+	t.Helper()
+
+	for _, l := range lines {
+		if l == line {
+			return
+		}
+	}
+
+	t.Errorf("missing line %q in %q", line, lines)
+}
+
+func literal(s string) string {
+	return "{" + strconv.Itoa(len(s)) + "+}\r\n" + s
+}
+
+func TestServer(t *testing.T) {
+	server := startTestServer(t, ServerCfg{TLSConfig: testutils.TLSConfig(t)})
+
+	c := newTestClient(t, server)
+
+	greeting := c.readLine()
+	if !strings.Contains(greeting, " STARTTLS ") ||
+		!strings.Contains(greeting, " LOGINDISABLED ") {
+		t.Errorf("invalid greeting %q", greeting)
+	}
+
+	c.expect("NO [PRIVACYREQUIRED]", `LOGIN bob secret`)
+	c.expect("BAD", `SELECT INBOX`)
+
+	c.startTLS()
+
+	lines := c.expect("OK", `CAPABILITY`)
+	if len(lines) != 1 || !strings.Contains(lines[0], " AUTH=PLAIN ") {
+		t.Errorf("invalid capabilities %q", lines)
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00bob\x00secret"))
+
+	c.expect("NO [AUTHENTICATIONFAILED]", `LOGIN bob invalid`)
+	c.expect("OK [CAPABILITY IMAP4rev2 ", `AUTHENTICATE PLAIN %s`, credentials)
+
+	account, err := server.Cfg.Store.Account("bob")
+	if err != nil {
+		t.Fatalf("cannot open account: %v", err)
+	}
+
+	// Mailboxes
+	c.expect("OK", `CREATE Archive/2024/`)
+	c.expect("NO [ALREADYEXISTS]", `CREATE Archive`)
+	c.expect("OK", `CREATE Drafts`)
+
+	lines = c.expect("OK", `LIST "" *`)
+	checkLine(t, lines, `* LIST (\HasChildren) "/" "Archive"`)
+	checkLine(t, lines, `* LIST (\HasNoChildren) "/" "Archive/2024"`)
+	checkLine(t, lines, `* LIST (\HasNoChildren) "/" "INBOX"`)
+
+	lines = c.expect("OK", `LIST "" %%`)
+	if len(lines) != 3 {
+		t.Errorf("invalid mailbox list %q", lines)
+	}
+
+	c.expect("OK", `RENAME Drafts Templates`)
+	c.expect("OK", `DELETE Templates`)
+	c.expect("NO [NONEXISTENT]", `DELETE Templates`)
+
+	// Messages
+	c.write(fmt.Sprintf("A100 APPEND INBOX (\\Flagged) {%d}\r\n",
+		len(testMessage)))
+	if line := c.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("invalid continuation request %q", line)
+	}
+	c.write(testMessage + "\r\n")
+	if _, response := c.readResponse("A100"); !strings.HasPrefix(response, "OK [APPENDUID ") {
+		t.Errorf("invalid APPEND response %q", response)
+	}
+
+	c.expect("OK [APPENDUID ", `APPEND INBOX %s`, literal(testMultipartMessage))
+	c.expect("NO [TRYCREATE]", `APPEND Unknown %s`, literal(testMessage))
+
+	lines = c.expect("OK [READ-WRITE]", `SELECT INBOX`)
+	checkLine(t, lines, `* 2 EXISTS`)
+
+	lines = c.expect("OK", `FETCH 1 (FLAGS ENVELOPE)`)
+	checkLine(t, lines, `* 1 FETCH (FLAGS (\Flagged) ENVELOPE `+
+		`("Mon, 01 Jul 2024 12:00:00 +0000" "Meeting" `+
+		`(("Alice" NIL "alice" "example.org")) `+
+		`(("Alice" NIL "alice" "example.org")) `+
+		`(("Alice" NIL "alice" "example.org")) `+
+		`(("Bob" NIL "bob" "example.com")) NIL NIL NIL "<1@example.org>"))`)
+
+	lines = c.expect("OK", `FETCH 2 BODYSTRUCTURE`)
+	checkLine(t, lines, `* 2 FETCH (BODYSTRUCTURE (`+
+		`("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 6 1 NIL NIL NIL NIL)`+
+		`("APPLICATION" "PDF" ("NAME" "report.pdf") NIL NIL "BASE64" 4 NIL `+
+		`("attachment" ("FILENAME" "report.pdf")) NIL NIL) `+
+		`"MIXED" ("BOUNDARY" "b1") NIL NIL NIL))`)
+
+	lines = c.expect("OK", `UID FETCH 2 BODY.PEEK[2.MIME]`)
+	checkLine(t, lines, `* 2 FETCH (UID 2 BODY[2.MIME] {143}`+
+		"Content-Type: application/pdf; name=\"report.pdf\"\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n"+
+		"\r\n)")
+
+	lines = c.expect("OK", `FETCH 1 BODY.PEEK[HEADER.FIELDS (Subject)]`)
+	checkLine(t, lines, "* 1 FETCH (BODY[HEADER.FIELDS (SUBJECT)] {20}"+
+		"Subject: Meeting\r\n\r\n)")
+
+	lines = c.expect("OK", `FETCH 1 BODY[]<0.10>`)
+	checkLine(t, lines, `* 1 FETCH (BODY[]<0> {10}From: Alic FLAGS (\Flagged \Seen))`)
+
+	lines = c.expect("OK", `SEARCH UNSEEN`)
+	checkLine(t, lines, fmt.Sprintf(`* ESEARCH (TAG "A%d") ALL 2`, c.nbCommands))
+
+	lines = c.expect("OK", `UID SEARCH RETURN (COUNT) SUBJECT meeting`)
+	checkLine(t, lines, fmt.Sprintf(`* ESEARCH (TAG "A%d") UID COUNT 1`,
+		c.nbCommands))
+
+	lines = c.expect("OK", `UID STORE 2 +FLAGS (\Deleted)`)
+	checkLine(t, lines, `* 2 FETCH (UID 2 FLAGS (\Deleted))`)
+
+	archive, err := account.Mailbox("Archive")
+	if err != nil {
+		t.Fatalf("cannot read mailbox: %v", err)
+	}
+
+	c.expect(fmt.Sprintf("OK [COPYUID %d 1 1]", archive.UIDValidity),
+		`COPY 1 Archive`)
+	c.expect("NO [TRYCREATE]", `COPY 1 Unknown`)
+
+	lines = c.expect("OK", `MOVE 1 Archive`)
+	checkLine(t, lines, fmt.Sprintf("* OK [COPYUID %d 1 2] messages moved",
+		archive.UIDValidity))
+	checkLine(t, lines, "* 1 EXPUNGE")
+
+	lines = c.expect("OK", `EXPUNGE`)
+	checkLine(t, lines, "* 1 EXPUNGE")
+
+	lines = c.expect("OK", `STATUS Archive (MESSAGES UNSEEN)`)
+	checkLine(t, lines, `* STATUS "Archive" (MESSAGES 2 UNSEEN 0)`)
+
+	// Changes made by other sessions while idling
+	c.write("A200 IDLE\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("invalid continuation request %q", line)
+	}
+
+	_, err = account.AppendMessage("INBOX", []byte(testMessage), nil,
+		time.Now())
+	if err != nil {
+		t.Fatalf("cannot append message: %v", err)
+	}
+
+	if line := c.readLine(); line != "* 1 EXISTS" {
+		t.Errorf("invalid IDLE response %q", line)
+	}
+
+	c.write("DONE\r\n")
+	if _, response := c.readResponse("A200"); !strings.HasPrefix(response, "OK") {
+		t.Errorf("invalid IDLE response %q", response)
+	}
+
+	c.expect("OK", `CLOSE`)
+	c.expect("BAD", `FETCH 1 FLAGS`)
+
+	lines = c.expect("OK", `LOGOUT`)
+	checkLine(t, lines, "* BYE logging out")
+}
+
+func TestServerImplicitTLS(t *testing.T) {
+	server := startTestServer(t, ServerCfg{
+		TLSConfig:   testutils.TLSConfig(t),
+		ImplicitTLS: true,
+	})
+
+	c := newTestClient(t, server)
+
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReader(tlsConn)
+
+	greeting := c.readLine()
+	if strings.Contains(greeting, "STARTTLS") ||
+		!strings.Contains(greeting, "AUTH=PLAIN") {
+		t.Errorf("invalid greeting %q", greeting)
+	}
+
+	for i := 1; i < MaxAuthenticationFailures; i++ {
+		c.expect("NO", `LOGIN bob invalid`)
+	}
+
+	c.write("A100 LOGIN bob invalid\r\n")
+	if line := c.readLine(); line != "* BYE too many authentication failures" {
+		t.Errorf("invalid response %q", line)
+	}
+}
+
+func TestMatchMailboxPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*", "INBOX", true},
+		{"*", "a/b/c", true},
+		{"%", "a", true},
+		{"%", "a/b", false},
+		{"a/%", "a/b", true},
+		{"a/%", "a/b/c", false},
+		{"a/*", "a/b/c", true},
+		{"a%c", "abc", true},
+		{"a%c", "a/c", false},
+		{"a", "ab", false},
+		{"", "a", false},
+	}
+
+	for _, test := range tests {
+		match := matchMailboxPattern(test.pattern, test.name)
+		if match != test.match {
+			t.Errorf("pattern %q should %smatch %q", test.pattern,
+				map[bool]string{false: "not ", true: ""}[test.match], test.name)
+		}
+	}
+}
+
+func TestServerSynchronization(t *testing.T) {
+	server := startTestServer(t, ServerCfg{AllowInsecureAuthentication: true})
+
+	c := newTestClient(t, server)
+	c.readLine()
+
+	c.expect("OK", `LOGIN bob secret`)
+
+	// Special use mailboxes
+	c.expect("OK", `CREATE Sent (USE (\Sent))`)
+	c.expect("NO [USEATTR]", `CREATE All (USE (\All))`)
+
+	lines := c.expect("OK", `LIST "" *`)
+	checkLine(t, lines, `* LIST (\HasNoChildren \Sent) "/" "Sent"`)
+
+	lines = c.expect("OK", `LIST (SPECIAL-USE) "" *`)
+	if len(lines) != 1 {
+		t.Errorf("invalid special use mailbox list %q", lines)
+	}
+
+	lines = c.expect("OK", `ENABLE QRESYNC X-UNKNOWN`)
+	checkLine(t, lines, "* ENABLED QRESYNC")
+
+	// Non-synchronizing literals are not limited to 4096 bytes
+	largeMessage := testMessage + strings.Repeat("a", 5000) + "\r\n"
+
+	c.expect("OK", `APPEND INBOX %s`, literal(testMessage))
+	c.expect("OK", `APPEND INBOX %s`, literal(largeMessage))
+	c.expect("OK", `APPEND INBOX %s`, literal(testMessage))
+
+	account, err := server.Cfg.Store.Account("bob")
+	if err != nil {
+		t.Fatalf("cannot open account: %v", err)
+	}
+
+	inbox, err := account.Mailbox("INBOX")
+	if err != nil {
+		t.Fatalf("cannot read mailbox: %v", err)
+	}
+
+	lines = c.expect("OK", `SELECT INBOX`)
+	checkLine(t, lines, "* OK [HIGHESTMODSEQ 4] highest modification sequence")
+
+	// Conditional changes
+	lines = c.expect("OK", `STORE 1 (UNCHANGEDSINCE 4) +FLAGS (\Flagged)`)
+	checkLine(t, lines, `* 1 FETCH (UID 1 FLAGS (\Flagged) MODSEQ (5))`)
+
+	c.expect("OK [MODIFIED 1]", `STORE 1:2 (UNCHANGEDSINCE 4) +FLAGS.SILENT (\Seen)`)
+
+	lines = c.expect("OK", `FETCH 1 (FLAGS)`)
+	checkLine(t, lines, `* 1 FETCH (UID 1 FLAGS (\Flagged) MODSEQ (5))`)
+
+	lines = c.expect("OK", `UID FETCH 1:* (FLAGS) (CHANGEDSINCE 5)`)
+	checkLine(t, lines, `* 2 FETCH (UID 2 FLAGS (\Seen) MODSEQ (6))`)
+	if len(lines) != 1 {
+		t.Errorf("invalid changes %q", lines)
+	}
+
+	lines = c.expect("OK", `UID STORE 3 +FLAGS.SILENT (\Deleted)`)
+	checkLine(t, lines, `* 3 FETCH (UID 3 MODSEQ (7))`)
+
+	lines = c.expect("OK [HIGHESTMODSEQ 8]", `EXPUNGE`)
+	checkLine(t, lines, "* VANISHED 3")
+
+	lines = c.expect("OK", `UID FETCH 1:* (FLAGS) (CHANGEDSINCE 4 VANISHED)`)
+	if strings.Join(lines, ", ") != `* VANISHED (EARLIER) 3, `+
+		`* 1 FETCH (UID 1 FLAGS (\Flagged) MODSEQ (5)), `+
+		`* 2 FETCH (UID 2 FLAGS (\Seen) MODSEQ (6))` {
+		t.Errorf("invalid changes %q", lines)
+	}
+
+	c.expect("BAD", `FETCH 1:* (FLAGS) (CHANGEDSINCE 4 VANISHED)`)
+
+	lines = c.expect("OK", `SEARCH MODSEQ "/flags/\\seen" all 6`)
+	checkLine(t, lines, fmt.Sprintf(`* ESEARCH (TAG "A%d") ALL 2 MODSEQ 6`,
+		c.nbCommands))
+
+	lines = c.expect("OK", `STATUS INBOX (HIGHESTMODSEQ)`)
+	checkLine(t, lines, `* STATUS "INBOX" (HIGHESTMODSEQ 8)`)
+
+	// Resynchronization
+	c.expect("OK", `UNSELECT`)
+
+	lines = c.expect("OK", `SELECT INBOX (QRESYNC (%d 5 1:3))`,
+		inbox.UIDValidity)
+	checkLine(t, lines, "* VANISHED (EARLIER) 3")
+	checkLine(t, lines, `* 2 FETCH (UID 2 FLAGS (\Seen) MODSEQ (6))`)
+
+	c.expect("OK", `LOGOUT`)
+}
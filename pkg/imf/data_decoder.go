@@ -3,6 +3,7 @@ package imf
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -1323,3 +1324,245 @@ func (d *DataDecoder) ReadReceivedTokens() (ReceivedTokens, error) {
 
 	return tokens, nil
 }
+
+func (d *DataDecoder) ReadComment() ([]byte, error) {
+	// Same as SkipComment but returns the content of the comment, without the
+	// enclosing parentheses, with folding removed and quoted pairs replaced by
+	// the character they represent.
+	start := d.buf
+
+	if err := d.SkipComment(0); err != nil {
+		return nil, err
+	}
+
+	raw := start[1 : len(start)-len(d.buf)-1]
+
+	var comment []byte
+
+	for i := 0; i < len(raw); i++ {
+		switch c := raw[i]; {
+		case c == '\r' || c == '\n':
+		case c == '\\' && i < len(raw)-1:
+			i++
+			comment = append(comment, raw[i])
+		default:
+			comment = append(comment, c)
+		}
+	}
+
+	return comment, nil
+}
+
+func (d *DataDecoder) ReadToken() ([]byte, error) {
+	if _, err := d.ReadCFWS(); err != nil {
+		return nil, err
+	}
+
+	if len(d.buf) == 0 {
+		return nil, fmt.Errorf("invalid empty value")
+	}
+
+	if !IsTokenChar(d.buf[0]) {
+		return nil, fmt.Errorf("invalid character %s",
+			utils.QuoteByte(d.buf[0]))
+	}
+
+	return d.ReadWhile(IsTokenChar), nil
+}
+
+func (d *DataDecoder) ReadValue() ([]byte, error) {
+	// RFC 2045 5.1. A value is either a token or a quoted string.
+	if _, err := d.ReadCFWS(); err != nil {
+		return nil, err
+	}
+
+	if d.StartsWithByte('"') {
+		return d.ReadQuotedString()
+	}
+
+	return d.ReadToken()
+}
+
+func (d *DataDecoder) ReadKeyword() ([]byte, error) {
+	if _, err := d.ReadCFWS(); err != nil {
+		return nil, err
+	}
+
+	if len(d.buf) == 0 {
+		return nil, fmt.Errorf("invalid empty keyword")
+	}
+
+	if !IsKeywordChar(d.buf[0]) {
+		return nil, fmt.Errorf("invalid character %s",
+			utils.QuoteByte(d.buf[0]))
+	}
+
+	return d.ReadWhile(IsKeywordChar), nil
+}
+
+func (d *DataDecoder) ReadAuthenticationResult() (*AuthenticationResult, error) {
+	// RFC 8601 2.2. Formal Definition
+	var r AuthenticationResult
+
+	method, err := d.ReadKeyword()
+	if err != nil {
+		return nil, fmt.Errorf("invalid method: %w", err)
+	}
+	r.Method = string(method)
+
+	if _, err := d.ReadCFWS(); err != nil {
+		return nil, err
+	}
+
+	if d.SkipByte('/') {
+		version, err := d.ReadInteger(9, 1, math.MaxInt32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid method version: %w", err)
+		}
+		r.MethodVersion = version
+
+		if _, err := d.ReadCFWS(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !d.SkipByte('=') {
+		return nil, fmt.Errorf("missing '=' character after method")
+	}
+
+	result, err := d.ReadKeyword()
+	if err != nil {
+		return nil, fmt.Errorf("invalid result: %w", err)
+	}
+	r.Result = string(result)
+
+	// Comments are not semantically relevant, but a comment directly
+	// following the result is commonly used to provide additional
+	// information, e.g. "dmarc=pass (p=reject dis=none)".
+	if _, err := d.ReadFWS(); err != nil {
+		return nil, err
+	}
+
+	if d.StartsWithByte('(') {
+		comment, err := d.ReadComment()
+		if err != nil {
+			return nil, fmt.Errorf("invalid comment: %w", err)
+		}
+		r.Comment = string(comment)
+	}
+
+	for {
+		if _, err := d.ReadCFWS(); err != nil {
+			return nil, err
+		}
+
+		if len(d.buf) == 0 || d.StartsWithByte(';') {
+			break
+		}
+
+		name, err := d.ReadKeyword()
+		if err != nil {
+			return nil, fmt.Errorf("invalid property type: %w", err)
+		}
+
+		if _, err := d.ReadCFWS(); err != nil {
+			return nil, err
+		}
+
+		if d.SkipByte('=') {
+			if !strings.EqualFold(string(name), "reason") || r.Reason != nil ||
+				len(r.Properties) > 0 {
+				return nil, fmt.Errorf("invalid keyword %q", name)
+			}
+
+			reason, err := d.ReadValue()
+			if err != nil {
+				return nil, fmt.Errorf("invalid reason: %w", err)
+			}
+			r.Reason = utils.Ref(string(reason))
+
+			continue
+		}
+
+		if !d.SkipByte('.') {
+			return nil, fmt.Errorf("missing '.' character after property "+
+				"type %q", name)
+		}
+
+		property, err := d.ReadKeyword()
+		if err != nil {
+			return nil, fmt.Errorf("invalid property: %w", err)
+		}
+
+		if _, err := d.ReadCFWS(); err != nil {
+			return nil, err
+		}
+
+		if !d.SkipByte('=') {
+			return nil, fmt.Errorf("missing '=' character after property %q",
+				property)
+		}
+
+		value, err := d.ReadPropertyValue()
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for property %q: %w",
+				property, err)
+		}
+
+		r.Properties = append(r.Properties, AuthenticationResultProperty{
+			Type:  string(name),
+			Name:  string(property),
+			Value: string(value),
+		})
+	}
+
+	return &r, nil
+}
+
+func (d *DataDecoder) ReadPropertyValue() ([]byte, error) {
+	// RFC 8601 2.2. A property value is either a value or an email address
+	// whose local part is optional.
+	if _, err := d.ReadCFWS(); err != nil {
+		return nil, err
+	}
+
+	var value []byte
+
+	if d.StartsWithByte('"') {
+		s, err := d.ReadQuotedString()
+		if err != nil {
+			return nil, err
+		}
+
+		value = s
+	} else if !d.StartsWithByte('@') {
+		// Values should be tokens, but some implementations do not quote
+		// values such as base64 signature prefixes, so we accept any atom
+		// character.
+		value = d.ReadWhile(func(c byte) bool {
+			return IsAtomChar(c) || c == '.'
+		})
+
+		if len(value) == 0 {
+			return nil, fmt.Errorf("invalid empty value")
+		}
+	}
+
+	if d.SkipByte('@') {
+		domain, err := d.ReadDotAtom()
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain: %w", err)
+		}
+
+		// The value may point to the internal buffer of the decoder, it must
+		// not be modified.
+		addr := make([]byte, 0, len(value)+1+len(domain))
+		addr = append(addr, value...)
+		addr = append(addr, '@')
+		addr = append(addr, domain...)
+
+		value = addr
+	}
+
+	return value, nil
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -82,8 +84,32 @@ func (e *DataEncoder) WriteEOL() {
 }
 
 func (e *DataEncoder) WriteUnstructured(s string) {
-	for _, c := range s {
-		e.WriteRune(c)
+	// RFC 5322 3.2.2. only allows folding before whitespace characters: we
+	// cannot insert a whitespace character in the middle of a word without
+	// changing the value. So we write each word with its leading whitespace,
+	// folding if necessary. Words longer than the maximum line length are
+	// kept intact.
+
+	for len(s) > 0 {
+		end := 0
+		for end < len(s) && IsWSP(s[end]) {
+			end++
+		}
+		for end < len(s) && !IsWSP(s[end]) {
+			end++
+		}
+
+		segment := s[:end]
+		s = s[end:]
+
+		if e.MaxLineLength > 0 && e.lineLength+len(segment) > e.MaxLineLength &&
+			IsWSP(segment[0]) {
+			e.buf.WriteString("\r\n")
+			e.lineLength = 0
+		}
+
+		e.buf.WriteString(segment)
+		e.lineLength += len(segment)
 	}
 }
 
@@ -329,6 +355,10 @@ func (e *DataEncoder) WriteReceivedTokens(tokens ReceivedTokens) error {
 			e.WriteDomain(v)
 		case string:
 			e.WriteWord(v)
+		case ReceivedComment:
+			if err := e.WriteComment(string(v)); err != nil {
+				return fmt.Errorf("invalid comment: %w", err)
+			}
 		default:
 			utils.Panicf("unhandle received token %#v (%T)", token, token)
 		}
@@ -336,3 +366,109 @@ func (e *DataEncoder) WriteReceivedTokens(tokens ReceivedTokens) error {
 
 	return nil
 }
+
+func (e *DataEncoder) WriteComment(s string) error {
+	var buf bytes.Buffer
+
+	buf.WriteByte('(')
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c < 32 && c != '\t':
+			return fmt.Errorf("unencodable control character 0x%x", c)
+		case c == '(' || c == ')' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+
+	buf.WriteByte(')')
+
+	e.WriteString(buf.String())
+	return nil
+}
+
+func (e *DataEncoder) WriteValue(s string) error {
+	if IsToken(s) {
+		e.WriteString(s)
+		return nil
+	}
+
+	return e.WriteQuotedString(s)
+}
+
+func (e *DataEncoder) WriteAuthenticationResult(r *AuthenticationResult) error {
+	if !IsKeyword(r.Method) {
+		return fmt.Errorf("invalid method %q", r.Method)
+	}
+
+	if !IsKeyword(r.Result) {
+		return fmt.Errorf("invalid result %q", r.Result)
+	}
+
+	method := r.Method
+	if r.MethodVersion > 0 {
+		method += "/" + strconv.Itoa(r.MethodVersion)
+	}
+
+	e.WriteString(method + "=" + r.Result)
+
+	if r.Comment != "" {
+		e.WriteRune(' ')
+
+		if err := e.WriteComment(r.Comment); err != nil {
+			return fmt.Errorf("invalid comment: %w", err)
+		}
+	}
+
+	if r.Reason != nil {
+		e.WriteString(" reason=")
+
+		if err := e.WriteValue(*r.Reason); err != nil {
+			return fmt.Errorf("invalid reason: %w", err)
+		}
+	}
+
+	for _, p := range r.Properties {
+		if !IsKeyword(p.Type) || !IsKeyword(p.Name) {
+			return fmt.Errorf("invalid property %q", p.Type+"."+p.Name)
+		}
+
+		e.WriteString(" " + p.Type + "." + p.Name + "=")
+
+		if err := e.WritePropertyValue(p.Value); err != nil {
+			return fmt.Errorf("invalid value for property %q: %w",
+				p.Type+"."+p.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (e *DataEncoder) WritePropertyValue(s string) error {
+	if IsToken(s) {
+		e.WriteString(s)
+		return nil
+	}
+
+	if at := strings.LastIndexByte(s, '@'); at >= 0 && IsDotAtom(s[at+1:]) {
+		localPart, domain := s[:at], s[at+1:]
+
+		switch {
+		case localPart == "" || IsDotAtom(localPart):
+			e.WriteString(s)
+		default:
+			if err := e.WriteQuotedString(localPart); err != nil {
+				return err
+			}
+
+			e.WriteString("@" + domain)
+		}
+
+		return nil
+	}
+
+	return e.WriteQuotedString(s)
+}
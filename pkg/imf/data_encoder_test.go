@@ -0,0 +1,42 @@
+package imf
+
+import (
+	"testing"
+)
+
+func TestWriteUnstructured(t *testing.T) {
+	value := "multipart/report; report-type=delivery-status; " +
+		"boundary=\"0123456789abcdef\""
+
+	tests := []struct {
+		maxLineLength int
+		output        string
+	}{
+		{
+			0,
+			value,
+		},
+		{
+			40,
+			"multipart/report;\r\n" +
+				" report-type=delivery-status;\r\n" +
+				" boundary=\"0123456789abcdef\"",
+		},
+		{
+			20,
+			"multipart/report;\r\n" +
+				" report-type=delivery-status;\r\n" +
+				" boundary=\"0123456789abcdef\"",
+		},
+	}
+
+	for _, test := range tests {
+		e := NewDataEncoder(test.maxLineLength)
+		e.WriteUnstructured(value)
+
+		if output := string(e.Bytes()); output != test.output {
+			t.Errorf("%d: output is %q but should be %q",
+				test.maxLineLength, output, test.output)
+		}
+	}
+}
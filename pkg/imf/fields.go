@@ -3,6 +3,9 @@ package imf
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -790,6 +793,147 @@ func (v KeywordsFieldValue) testCheck(t *testing.T, g *TestMessageGenerator, ev
 	g.checkPhrases(t, []string(*ev2), []string(v))
 }
 
+// Authentication-Results (RFC 8601)
+type AuthenticationResultsFieldValue struct {
+	AuthservId string
+	Version    int // optional, 0 if not set
+
+	// An empty list of results means that no authentication was performed
+	// ("none").
+	Results []*AuthenticationResult
+}
+
+func (v *AuthenticationResultsFieldValue) String() string {
+	return MustEncodeInlineData(v.Encode)
+}
+
+func (v *AuthenticationResultsFieldValue) Decode(d *DataDecoder) error {
+	authservId, err := d.ReadValue()
+	if err != nil {
+		return fmt.Errorf("invalid authserv-id: %w", err)
+	}
+
+	if _, err := d.ReadCFWS(); err != nil {
+		return err
+	}
+
+	var version int
+	if len(d.buf) > 0 && IsDigitChar(d.buf[0]) {
+		version, err = d.ReadInteger(9, 1, math.MaxInt32)
+		if err != nil {
+			return fmt.Errorf("invalid version: %w", err)
+		}
+	}
+
+	var results []*AuthenticationResult
+	var noResult bool
+
+	for {
+		if _, err := d.ReadCFWS(); err != nil {
+			return err
+		}
+
+		if !d.SkipByte(';') {
+			break
+		}
+
+		if len(results) == 0 {
+			err := d.Try(func() error {
+				keyword, err := d.ReadKeyword()
+				if err != nil {
+					return err
+				}
+
+				if !strings.EqualFold(string(keyword), "none") {
+					return fmt.Errorf("invalid keyword %q", keyword)
+				}
+
+				if _, err := d.ReadCFWS(); err != nil {
+					return err
+				}
+
+				if !d.Empty() {
+					return fmt.Errorf("invalid trailing data")
+				}
+
+				return nil
+			})
+			if err == nil {
+				noResult = true
+				break
+			}
+		}
+
+		result, err := d.ReadAuthenticationResult()
+		if err != nil {
+			return fmt.Errorf("invalid result: %w", err)
+		}
+
+		results = append(results, result)
+	}
+
+	if len(results) == 0 && !noResult {
+		return fmt.Errorf("missing result")
+	}
+
+	v.AuthservId = string(authservId)
+	v.Version = version
+	v.Results = results
+
+	return nil
+}
+
+func (v AuthenticationResultsFieldValue) Encode(e *DataEncoder) error {
+	if err := e.WriteValue(v.AuthservId); err != nil {
+		return fmt.Errorf("invalid authserv-id: %w", err)
+	}
+
+	if v.Version > 0 {
+		e.WriteString(" " + strconv.Itoa(v.Version))
+	}
+
+	if len(v.Results) == 0 {
+		e.WriteString("; none")
+		return nil
+	}
+
+	for _, result := range v.Results {
+		e.WriteString("; ")
+
+		if err := e.WriteAuthenticationResult(result); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *AuthenticationResultsFieldValue) testGenerate(g *TestMessageGenerator) {
+	v.AuthservId = g.generateValue()
+
+	if g.maybe(0.2) {
+		g.generateCFWS()
+		v.Version = g.generateNumber(1, 9)
+	}
+
+	v.Results = g.generateAuthenticationResults()
+}
+
+func (v AuthenticationResultsFieldValue) testCheck(t *testing.T, g *TestMessageGenerator, ev FieldValue) {
+	ev2 := ev.(*AuthenticationResultsFieldValue)
+
+	if v.AuthservId != ev2.AuthservId {
+		t.Errorf("authserv-id is %q but should be %q",
+			v.AuthservId, ev2.AuthservId)
+	}
+
+	if v.Version != ev2.Version {
+		t.Errorf("version is %d but should be %d", v.Version, ev2.Version)
+	}
+
+	g.checkAuthenticationResults(t, ev2.Results, v.Results)
+}
+
 // Optional fields
 type OptionalFieldValue string
 
@@ -132,3 +132,8 @@ func TestReadOptionalField(t *testing.T) {
 		g.GenerateAndTestField(t, string(name))
 	}
 }
+
+func TestReadAuthenticationResultsField(t *testing.T) {
+	g := NewTestMessageGenerator()
+	g.GenerateAndTestFieldN(t, "Authentication-Results")
+}
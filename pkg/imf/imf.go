@@ -2,6 +2,7 @@ package imf
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -131,7 +132,12 @@ func (ids MessageIds) String() string {
 	})
 }
 
-type ReceivedToken interface{} // SpecificAddress, Domain or string
+type ReceivedToken interface{} // SpecificAddress, Domain, string or ReceivedComment
+
+// ReceivedComment is a comment in the tokens of a Received field, e.g. the
+// TCP-info part of the from clause (RFC 5321 4.4.). Comments are only encoded;
+// the decoder skips them.
+type ReceivedComment string
 
 type ReceivedTokens []ReceivedToken
 
@@ -142,6 +148,40 @@ func (ts ReceivedTokens) String() string {
 	})
 }
 
+// RFC 8601 2.2. Formal Definition
+type AuthenticationResult struct {
+	Method        string
+	MethodVersion int // optional, 0 if not set
+	Result        string
+	Comment       string  // optional
+	Reason        *string // optional
+	Properties    []AuthenticationResultProperty
+}
+
+type AuthenticationResultProperty struct {
+	Type  string // e.g. "smtp" or "header"
+	Name  string
+	Value string
+}
+
+func (r AuthenticationResult) String() string {
+	return MustEncodeInlineData(func(e *DataEncoder) error {
+		return e.WriteAuthenticationResult(&r)
+	})
+}
+
+// Property returns the value of a property, or an empty string if the result
+// does not contain it. Type and name are case-insensitive.
+func (r *AuthenticationResult) Property(ptype, name string) string {
+	for _, p := range r.Properties {
+		if strings.EqualFold(p.Type, ptype) && strings.EqualFold(p.Name, name) {
+			return p.Value
+		}
+	}
+
+	return ""
+}
+
 type Domain string
 
 func (d Domain) String() string {
@@ -215,6 +215,8 @@ func (d *MessageDecoder) maybeProcessLine() error {
 		field.Value = utils.Ref(CommentsFieldValue(""))
 	case "keywords":
 		field.Value = &KeywordsFieldValue{}
+	case "authentication-results":
+		field.Value = &AuthenticationResultsFieldValue{}
 	default:
 		field.Value = utils.Ref(OptionalFieldValue(""))
 	}
@@ -51,6 +51,16 @@ func IsAtomChar(c byte) bool {
 		c == '~'
 }
 
+func IsTokenChar(c byte) bool {
+	// RFC 2045 5.1. Syntax of the Content-Type Header Field
+	return c > 32 && c < 127 && strings.IndexByte("()<>@,;:\\\"/[]?=", c) == -1
+}
+
+func IsKeywordChar(c byte) bool {
+	// RFC 8601 2.2. Formal Definition (ldh-str, RFC 5321 4.1.2.)
+	return IsAlphaChar(c) || IsDigitChar(c) || c == '-'
+}
+
 func IsWSCtlChar(c byte) bool {
 	return (c >= 1 && c <= 8) || (c >= 11 && c <= 12) || (c >= 14 && c <= 31) ||
 		c == 127
@@ -86,6 +96,36 @@ func IsDotAtom(s string) bool {
 	return true
 }
 
+func IsToken(s string) bool {
+	// RFC 2045 5.1. Syntax of the Content-Type Header Field
+	if len(s) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !IsTokenChar(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func IsKeyword(s string) bool {
+	// RFC 8601 2.2. Formal Definition
+	if len(s) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !IsKeywordChar(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func CharRange(cmin, cmax byte) string {
 	chars := make([]byte, cmax-cmin+1)
 
@@ -31,6 +31,12 @@ var (
 
 	commentChars = quotedStringChars
 
+	tokenChars = CharRange('a', 'z') + CharRange('A', 'Z') +
+		CharRange('0', '9') + "!#$%&'*+-.^_`{|}~"
+
+	keywordChars = CharRange('a', 'z') + CharRange('A', 'Z') +
+		CharRange('0', '9') + "-"
+
 	unstructuredChars = CharRange(0, 0) + noWSCtlChars + vChars
 )
 
@@ -156,6 +162,8 @@ func (g *TestMessageGenerator) generateField(name string) *Field {
 		field.Value = utils.Ref(CommentsFieldValue(""))
 	case "keywords":
 		field.Value = &KeywordsFieldValue{}
+	case "authentication-results":
+		field.Value = &AuthenticationResultsFieldValue{}
 	default:
 		field.Value = utils.Ref(OptionalFieldValue(""))
 	}
@@ -802,6 +810,197 @@ func (g *TestMessageGenerator) generateMessageIds() MessageIds {
 	return ids
 }
 
+func (g *TestMessageGenerator) generateNumber(min, max int) int {
+	n := min + rand.Intn(max-min+1)
+	g.writeString(strconv.Itoa(n))
+	return n
+}
+
+func (g *TestMessageGenerator) generateToken() string {
+	token := make([]byte, rand.Intn(12)+1)
+
+	for i := 0; i < len(token); i++ {
+		token[i] = tokenChars[rand.Intn(len(tokenChars))]
+	}
+
+	return g.writeString(string(token))
+}
+
+func (g *TestMessageGenerator) generateValue() string {
+	if g.maybe(0.25) {
+		return g.generateQuotedString()
+	}
+
+	return g.generateToken()
+}
+
+func (g *TestMessageGenerator) generateKeyword() string {
+	keyword := make([]byte, rand.Intn(8)+1)
+
+	for i := 0; i < len(keyword); i++ {
+		keyword[i] = keywordChars[rand.Intn(len(keywordChars))]
+	}
+
+	return g.writeString(string(keyword))
+}
+
+func (g *TestMessageGenerator) generateAuthenticationResultComment() string {
+	var buf bytes.Buffer
+
+	g.writeByte('(')
+
+	for i := 0; i < rand.Intn(12); i++ {
+		c := commentChars[rand.Intn(len(commentChars))]
+		if g.maybe(0.1) {
+			c = ' '
+		}
+
+		if c == '\\' || c == '(' || c == ')' || g.maybe(0.05) {
+			g.writeByte('\\')
+		}
+
+		g.writeByte(c)
+		buf.WriteByte(c)
+	}
+
+	g.writeByte(')')
+
+	return buf.String()
+}
+
+func (g *TestMessageGenerator) generatePropertyValue() string {
+	switch rand.Intn(5) {
+	case 0:
+		return g.generateToken()
+	case 1:
+		return g.generateQuotedString()
+	case 2:
+		return g.writeByte('@') + g.generateDotAtom()
+	case 3:
+		localPart := g.generateQuotedString()
+		return localPart + g.writeByte('@') + g.generateDotAtom()
+	default:
+		localPart := g.generateDotAtom()
+		return localPart + g.writeByte('@') + g.generateDotAtom()
+	}
+}
+
+func (g *TestMessageGenerator) generateAuthenticationResult() *AuthenticationResult {
+	var r AuthenticationResult
+
+	r.Method = g.generateKeyword()
+
+	if g.maybe(0.1) {
+		if g.maybe(0.1) {
+			g.generateCFWS()
+		}
+
+		g.writeByte('/')
+
+		if g.maybe(0.1) {
+			g.generateCFWS()
+		}
+
+		r.MethodVersion = g.generateNumber(1, 99)
+	}
+
+	if g.maybe(0.1) {
+		g.generateCFWS()
+	}
+
+	g.writeByte('=')
+
+	if g.maybe(0.1) {
+		g.generateCFWS()
+	}
+
+	r.Result = g.generateKeyword()
+
+	// A comment directly following the result is part of the value, so we
+	// only generate folding whitespace before other elements.
+
+	if g.maybe(0.2) {
+		if g.maybe(0.5) {
+			g.generateFWS()
+		}
+
+		r.Comment = g.generateAuthenticationResultComment()
+	}
+
+	if g.maybe(0.2) {
+		g.generateFWS()
+		g.writeString("reason")
+
+		if g.maybe(0.1) {
+			g.generateFWS()
+		}
+
+		g.writeByte('=')
+
+		if g.maybe(0.1) {
+			g.generateFWS()
+		}
+
+		r.Reason = utils.Ref(g.generateValue())
+	}
+
+	for i := 0; i < rand.Intn(4); i++ {
+		g.generateFWS()
+
+		var p AuthenticationResultProperty
+
+		p.Type = g.generateKeyword()
+		g.writeByte('.')
+		p.Name = g.generateKeyword()
+		g.writeByte('=')
+		p.Value = g.generatePropertyValue()
+
+		r.Properties = append(r.Properties, p)
+	}
+
+	return &r
+}
+
+func (g *TestMessageGenerator) generateAuthenticationResults() []*AuthenticationResult {
+	if g.maybe(0.1) {
+		if g.maybe(0.25) {
+			g.generateCFWS()
+		}
+
+		g.writeByte(';')
+
+		if g.maybe(0.25) {
+			g.generateCFWS()
+		}
+
+		g.writeString("none")
+
+		return nil
+	}
+
+	var results []*AuthenticationResult
+
+	for i := 0; i < rand.Intn(3)+1; i++ {
+		// A comment following the previous result would be decoded as part
+		// of it.
+		if i == 0 && g.maybe(0.25) {
+			g.generateCFWS()
+		} else if g.maybe(0.25) {
+			g.generateFWS()
+		}
+
+		g.writeByte(';')
+
+		if g.maybe(0.75) {
+			g.generateCFWS()
+		}
+
+		results = append(results, g.generateAuthenticationResult())
+	}
+
+	return results
+}
+
 func (g *TestMessageGenerator) checkPhrases(t *testing.T, ePhrases, phrases []string) bool {
 	if len(phrases) != len(ePhrases) {
 		t.Errorf("list contains %d phrases but should contain %d phrases",
@@ -981,3 +1180,73 @@ func (g *TestMessageGenerator) checkMessageIds(t *testing.T, eIds, ids MessageId
 
 	return valid
 }
+
+func (g *TestMessageGenerator) checkAuthenticationResult(t *testing.T, eResult, result *AuthenticationResult) bool {
+	valid := true
+
+	check := func(name, eValue, value string) {
+		if value != eValue {
+			t.Errorf("%s is %q but should be %q", name, value, eValue)
+			valid = false
+		}
+	}
+
+	check("method", eResult.Method, result.Method)
+	check("result", eResult.Result, result.Result)
+	check("comment", eResult.Comment, result.Comment)
+
+	if result.MethodVersion != eResult.MethodVersion {
+		t.Errorf("method version is %d but should be %d",
+			result.MethodVersion, eResult.MethodVersion)
+		valid = false
+	}
+
+	switch {
+	case result.Reason == nil && eResult.Reason != nil:
+		t.Errorf("reason is null but should be %q", *eResult.Reason)
+		valid = false
+	case result.Reason != nil && eResult.Reason == nil:
+		t.Errorf("reason is %q but should be null", *result.Reason)
+		valid = false
+	case result.Reason != nil && eResult.Reason != nil:
+		check("reason", *eResult.Reason, *result.Reason)
+	}
+
+	if len(result.Properties) != len(eResult.Properties) {
+		t.Errorf("result contains %d properties but should contain %d "+
+			"properties", len(result.Properties), len(eResult.Properties))
+		return false
+	}
+
+	for i, p := range result.Properties {
+		ep := eResult.Properties[i]
+
+		check("property type", ep.Type, p.Type)
+		check("property name", ep.Name, p.Name)
+		check("property value", ep.Value, p.Value)
+	}
+
+	return valid
+}
+
+func (g *TestMessageGenerator) checkAuthenticationResults(t *testing.T, eResults, results []*AuthenticationResult) bool {
+	if len(results) != len(eResults) {
+		t.Errorf("list contains %d results but should contain %d results",
+			len(results), len(eResults))
+		return false
+	}
+
+	valid := true
+
+	for i, result := range results {
+		eResult := eResults[i]
+
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if !g.checkAuthenticationResult(t, eResult, result) {
+				valid = false
+			}
+		})
+	}
+
+	return valid
+}
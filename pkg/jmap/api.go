@@ -0,0 +1,529 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/go-log"
+)
+
+// RFC 8620 3. Structured Data Exchange
+
+type request struct {
+	Using       []string          `json:"using"`
+	MethodCalls []*invocation     `json:"methodCalls"`
+	CreatedIds  map[string]string `json:"createdIds,omitempty"`
+}
+
+type response struct {
+	MethodResponses []*invocation     `json:"methodResponses"`
+	CreatedIds      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// invocation is a method call or a method response, encoded as a
+// [name, arguments, call id] array.
+type invocation struct {
+	Name      string
+	Arguments json.RawMessage
+	CallId    string
+}
+
+func (inv *invocation) UnmarshalJSON(data []byte) error {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return err
+	}
+
+	if len(elements) != 3 {
+		return fmt.Errorf("invocations must contain three elements")
+	}
+
+	if err := json.Unmarshal(elements[0], &inv.Name); err != nil {
+		return fmt.Errorf("invalid method name: %w", err)
+	}
+
+	if len(elements[1]) == 0 || elements[1][0] != '{' {
+		return fmt.Errorf("method arguments must be an object")
+	}
+
+	inv.Arguments = elements[1]
+
+	if err := json.Unmarshal(elements[2], &inv.CallId); err != nil {
+		return fmt.Errorf("invalid method call id: %w", err)
+	}
+
+	return nil
+}
+
+func (inv *invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{inv.Name, inv.Arguments, inv.CallId})
+}
+
+// RFC 8620 3.6.2. Method-level errors
+type MethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (err *MethodError) Error() string {
+	if err.Description == "" {
+		return err.Type
+	}
+
+	return err.Type + ": " + err.Description
+}
+
+func methodErrorf(errType string, format string, args ...any) *MethodError {
+	return &MethodError{
+		Type:        errType,
+		Description: fmt.Sprintf(format, args...),
+	}
+}
+
+func invalidArgumentsf(format string, args ...any) *MethodError {
+	return methodErrorf("invalidArguments", format, args...)
+}
+
+// RFC 8620 5.3. Errors of individual objects in /set methods
+type SetError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+func setErrorf(errType string, format string, args ...any) *SetError {
+	return &SetError{
+		Type:        errType,
+		Description: fmt.Sprintf(format, args...),
+	}
+}
+
+func invalidPropertiesf(properties []string, format string, args ...any) *SetError {
+	err := setErrorf("invalidProperties", format, args...)
+	err.Properties = properties
+	return err
+}
+
+type methodFunc func(*apiContext, json.RawMessage) (any, error)
+
+type method struct {
+	Capability string
+	Fn         methodFunc
+}
+
+var methods = map[string]method{
+	"Core/echo": {CapabilityCore, coreEcho},
+
+	"Mailbox/get":     {CapabilityMail, mailboxGet},
+	"Mailbox/changes": {CapabilityMail, mailboxChanges},
+	"Mailbox/set":     {CapabilityMail, mailboxSet},
+
+	"Email/get":          {CapabilityMail, emailGet},
+	"Email/query":        {CapabilityMail, emailQuery},
+	"Email/queryChanges": {CapabilityMail, emailQueryChanges},
+	"Email/changes":      {CapabilityMail, emailChanges},
+	"Email/set":          {CapabilityMail, emailSet},
+	"Email/import":       {CapabilityMail, emailImport},
+
+	"Thread/get":     {CapabilityMail, threadGet},
+	"Thread/changes": {CapabilityMail, threadChanges},
+
+	"Identity/get":        {CapabilitySubmission, identityGet},
+	"EmailSubmission/set": {CapabilitySubmission, emailSubmissionSet},
+}
+
+// apiContext is the state of an API request shared by all method calls.
+type apiContext struct {
+	Server *Server
+	Log    *log.Logger
+
+	username  string
+	accountId string
+	account   *mailstore.Account
+
+	// Identifiers of objects created in this request indexed by creation
+	// identifier
+	createdIds map[string]string
+
+	responses []*invocation
+
+	// Responses of methods called implicitly by the current method call,
+	// e.g. Email/set after EmailSubmission/set (RFC 8621 7.5.)
+	implicitResponses []*invocation
+}
+
+func (s *Server) hAPI(w http.ResponseWriter, r *http.Request) {
+	username := s.authenticate(w, r)
+	if username == "" {
+		return
+	}
+
+	if r.ContentLength > int64(s.Cfg.MaxRequestSize) {
+		s.replyLimitError(w, "maxSizeRequest", "request too large")
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(s.Cfg.MaxRequestSize)+1))
+	if err != nil {
+		s.replyError(w, http.StatusBadRequest, "cannot read request: %v", err)
+		return
+	}
+
+	if len(data) > s.Cfg.MaxRequestSize {
+		s.replyLimitError(w, "maxSizeRequest", "request too large")
+		return
+	}
+
+	if !json.Valid(data) {
+		s.replyProblem(w, &problem{
+			Type:   "urn:ietf:params:jmap:error:notJSON",
+			Status: http.StatusBadRequest,
+			Detail: "request body is not a valid JSON value",
+		})
+		return
+	}
+
+	var req request
+	if err := json.Unmarshal(data, &req); err != nil ||
+		req.Using == nil || req.MethodCalls == nil {
+		detail := "invalid request object"
+		if err != nil {
+			detail = fmt.Sprintf("invalid request object: %v", err)
+		}
+
+		s.replyProblem(w, &problem{
+			Type:   "urn:ietf:params:jmap:error:notRequest",
+			Status: http.StatusBadRequest,
+			Detail: detail,
+		})
+		return
+	}
+
+	caps := s.capabilities()
+	for _, capability := range req.Using {
+		if _, found := caps[capability]; !found {
+			s.replyProblem(w, &problem{
+				Type:   "urn:ietf:params:jmap:error:unknownCapability",
+				Status: http.StatusBadRequest,
+				Detail: fmt.Sprintf("unknown capability %q", capability),
+			})
+			return
+		}
+	}
+
+	if len(req.MethodCalls) > MaxCallsInRequest {
+		s.replyLimitError(w, "maxCallsInRequest", "too many method calls")
+		return
+	}
+
+	account, err := s.Cfg.Store.Account(username)
+	if err != nil {
+		s.Log.Error("cannot open account %q: %v", username, err)
+		s.replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	c := apiContext{
+		Server: s,
+		Log:    s.Log.Child("api", log.Data{"user": username}),
+
+		username:  username,
+		accountId: accountId(username),
+		account:   account,
+
+		createdIds: make(map[string]string),
+	}
+
+	for id, createdId := range req.CreatedIds {
+		c.createdIds[id] = createdId
+	}
+
+	for _, call := range req.MethodCalls {
+		c.processCall(call, req.Using)
+	}
+
+	res := response{
+		MethodResponses: c.responses,
+		SessionState:    sessionState,
+	}
+
+	if req.CreatedIds != nil {
+		res.CreatedIds = c.createdIds
+	}
+
+	s.replyJSON(w, http.StatusOK, &res)
+}
+
+func (s *Server) replyLimitError(w http.ResponseWriter, limit, detail string) {
+	s.replyProblem(w, &problem{
+		Type:   "urn:ietf:params:jmap:error:limit",
+		Status: http.StatusBadRequest,
+		Detail: detail,
+		Limit:  limit,
+	})
+}
+
+func (c *apiContext) processCall(call *invocation, using []string) {
+	result, err := c.executeCall(call, using)
+	if err != nil {
+		c.implicitResponses = nil
+
+		var methodErr *MethodError
+		if !errors.As(err, &methodErr) {
+			c.Log.Error("%s: %v", call.Name, err)
+			methodErr = &MethodError{Type: "serverFail"}
+		}
+
+		c.addResponse("error", methodErr, call.CallId)
+		return
+	}
+
+	c.addResponse(call.Name, result, call.CallId)
+
+	for _, res := range c.implicitResponses {
+		res.CallId = call.CallId
+		c.responses = append(c.responses, res)
+	}
+
+	c.implicitResponses = nil
+}
+
+func (c *apiContext) executeCall(call *invocation, using []string) (any, error) {
+	m, found := methods[call.Name]
+	if !found {
+		return nil, methodErrorf("unknownMethod", "unknown method %q",
+			call.Name)
+	}
+
+	usable := false
+	for _, capability := range using {
+		if capability == m.Capability {
+			usable = true
+			break
+		}
+	}
+
+	if !usable {
+		return nil, methodErrorf("unknownMethod",
+			"capability %q required", m.Capability)
+	}
+
+	args, err := c.resolveReferences(call.Arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Fn(c, args)
+}
+
+func (c *apiContext) addResponse(name string, result any, callId string) {
+	c.responses = append(c.responses, c.newResponse(name, result, callId))
+}
+
+func (c *apiContext) addImplicitResponse(name string, result any) {
+	c.implicitResponses = append(c.implicitResponses,
+		c.newResponse(name, result, ""))
+}
+
+func (c *apiContext) newResponse(name string, result any, callId string) *invocation {
+	data, err := json.Marshal(result)
+	if err != nil {
+		c.Log.Error("cannot encode %s response: %v", name, err)
+		name = "error"
+		data, _ = json.Marshal(&MethodError{Type: "serverFail"})
+	}
+
+	return &invocation{
+		Name:      name,
+		Arguments: data,
+		CallId:    callId,
+	}
+}
+
+// decodeArguments decodes the arguments of a method call; unknown arguments
+// are rejected (RFC 8620 3.6.2.).
+func decodeArguments(data json.RawMessage, args any) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	if err := d.Decode(args); err != nil {
+		return invalidArgumentsf("%v", err)
+	}
+
+	return nil
+}
+
+func (c *apiContext) checkAccountId(id string) error {
+	if id != c.accountId {
+		return methodErrorf("accountNotFound", "unknown account %q", id)
+	}
+
+	return nil
+}
+
+// resolveId returns the identifier referenced by a value which can be a
+// creation identifier reference ("#" followed by a creation identifier, RFC
+// 8620 5.3.).
+func (c *apiContext) resolveId(id string) (string, bool) {
+	if creationId, found := strings.CutPrefix(id, "#"); found {
+		id, found := c.createdIds[creationId]
+		return id, found
+	}
+
+	return id, true
+}
+
+// RFC 8620 3.7. References to Previous Method Results
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+func (c *apiContext) resolveReferences(data json.RawMessage) (json.RawMessage, error) {
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, invalidArgumentsf("%v", err)
+	}
+
+	resolved := false
+
+	for name, value := range args {
+		refName, found := strings.CutPrefix(name, "#")
+		if !found {
+			continue
+		}
+
+		if _, found := args[refName]; found {
+			return nil, invalidArgumentsf("argument %q is both set and "+
+				"referenced", refName)
+		}
+
+		var ref resultReference
+		if err := json.Unmarshal(value, &ref); err != nil {
+			return nil, methodErrorf("invalidResultReference",
+				"invalid reference: %v", err)
+		}
+
+		refValue, err := c.resolveReference(&ref)
+		if err != nil {
+			return nil, methodErrorf("invalidResultReference", "%v", err)
+		}
+
+		refData, err := json.Marshal(refValue)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode reference value: %w", err)
+		}
+
+		delete(args, name)
+		args[refName] = refData
+
+		resolved = true
+	}
+
+	if !resolved {
+		return data, nil
+	}
+
+	return json.Marshal(args)
+}
+
+func (c *apiContext) resolveReference(ref *resultReference) (any, error) {
+	var res *invocation
+
+	for _, res2 := range c.responses {
+		if res2.CallId == ref.ResultOf {
+			res = res2
+			break
+		}
+	}
+
+	if res == nil {
+		return nil, fmt.Errorf("unknown method call %q", ref.ResultOf)
+	}
+
+	if res.Name != ref.Name {
+		return nil, fmt.Errorf("method call %q is a %q response",
+			ref.ResultOf, res.Name)
+	}
+
+	var value any
+	if err := json.Unmarshal(res.Arguments, &value); err != nil {
+		return nil, fmt.Errorf("cannot decode response: %w", err)
+	}
+
+	return evaluatePointer(value, ref.Path)
+}
+
+// evaluatePointer evaluates a JSON pointer (RFC 6901) extended with the "*"
+// token which applies the rest of the pointer to all elements of an array
+// and flattens the results (RFC 8620 3.7.).
+func evaluatePointer(value any, pointer string) (any, error) {
+	if pointer == "" {
+		return value, nil
+	}
+
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+
+	token, rest := pointer[1:], ""
+	if i := strings.IndexByte(token, '/'); i >= 0 {
+		token, rest = token[:i], token[i:]
+	}
+
+	token = strings.ReplaceAll(token, "~1", "/")
+	token = strings.ReplaceAll(token, "~0", "~")
+
+	switch v := value.(type) {
+	case map[string]any:
+		child, found := v[token]
+		if !found {
+			return nil, fmt.Errorf("missing property %q", token)
+		}
+
+		return evaluatePointer(child, rest)
+
+	case []any:
+		if token == "*" {
+			values := []any{}
+
+			for _, element := range v {
+				result, err := evaluatePointer(element, rest)
+				if err != nil {
+					return nil, err
+				}
+
+				if array, ok := result.([]any); ok {
+					values = append(values, array...)
+				} else {
+					values = append(values, result)
+				}
+			}
+
+			return values, nil
+		}
+
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, fmt.Errorf("invalid array index %q", token)
+		}
+
+		return evaluatePointer(v[i], rest)
+	}
+
+	return nil, fmt.Errorf("cannot apply token %q to a scalar value", token)
+}
+
+// RFC 8620 4. The Core/echo Method
+func coreEcho(c *apiContext, data json.RawMessage) (any, error) {
+	return data, nil
+}
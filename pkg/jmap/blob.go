@@ -0,0 +1,216 @@
+package jmap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	stdmime "mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+// RFC 8620 6. Binary Data
+//
+// Blobs are either messages and message parts of the store, or data uploaded
+// by clients. Uploaded blobs are kept in memory until they expire: they are
+// only used to create or import messages, which copies their content to the
+// store.
+
+type uploadedBlob struct {
+	accountId  string
+	data       []byte
+	mediaType  string
+	expiration time.Time
+}
+
+func generateUploadedBlobId() (string, error) {
+	data := make([]byte, 12)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	return "u" + hex.EncodeToString(data), nil
+}
+
+// RFC 8620 6.1. Uploading Binary Data
+func (s *Server) hUpload(w http.ResponseWriter, r *http.Request) {
+	username := s.authenticate(w, r)
+	if username == "" {
+		return
+	}
+
+	id := r.PathValue("accountId")
+	if id != accountId(username) {
+		s.replyError(w, http.StatusNotFound, "unknown account %q", id)
+		return
+	}
+
+	maxSize := int64(s.Cfg.MaxUploadSize)
+
+	if r.ContentLength > maxSize {
+		s.replyLimitError(w, "maxSizeUpload", "blob too large")
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		s.replyError(w, http.StatusBadRequest, "cannot read blob: %v", err)
+		return
+	}
+
+	if int64(len(data)) > maxSize {
+		s.replyLimitError(w, "maxSizeUpload", "blob too large")
+		return
+	}
+
+	mediaType := r.Header.Get("Content-Type")
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+
+	blobId, err := generateUploadedBlobId()
+	if err != nil {
+		s.Log.Error("%v", err)
+		s.replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	now := time.Now()
+
+	s.uploadedBlobsMutex.Lock()
+
+	for id, blob := range s.uploadedBlobs {
+		if now.After(blob.expiration) {
+			delete(s.uploadedBlobs, id)
+		}
+	}
+
+	s.uploadedBlobs[blobId] = &uploadedBlob{
+		accountId:  id,
+		data:       data,
+		mediaType:  mediaType,
+		expiration: now.Add(UploadedBlobLifetime),
+	}
+
+	s.uploadedBlobsMutex.Unlock()
+
+	s.replyJSON(w, http.StatusCreated, map[string]any{
+		"accountId": id,
+		"blobId":    blobId,
+		"type":      mediaType,
+		"size":      len(data),
+	})
+}
+
+// RFC 8620 6.2. Downloading Binary Data
+func (s *Server) hDownload(w http.ResponseWriter, r *http.Request) {
+	username := s.authenticate(w, r)
+	if username == "" {
+		return
+	}
+
+	id := r.PathValue("accountId")
+	if id != accountId(username) {
+		s.replyError(w, http.StatusNotFound, "unknown account %q", id)
+		return
+	}
+
+	account, err := s.Cfg.Store.Account(username)
+	if err != nil {
+		s.Log.Error("cannot open account %q: %v", username, err)
+		s.replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	data, mediaType, err := s.blob(account, id, r.PathValue("blobId"))
+	if err != nil {
+		s.Log.Error("cannot read blob: %v", err)
+		s.replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	} else if data == nil {
+		s.replyError(w, http.StatusNotFound, "unknown blob")
+		return
+	}
+
+	if accept := r.URL.Query().Get("accept"); accept != "" {
+		mediaType = accept
+	}
+
+	disposition := stdmime.FormatMediaType("attachment",
+		map[string]string{"filename": r.PathValue("name")})
+
+	header := w.Header()
+	header.Set("Content-Type", mediaType)
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	header.Set("Cache-Control", "private, immutable, max-age=31536000")
+	if disposition != "" {
+		header.Set("Content-Disposition", disposition)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// blob returns the content and media type of a blob, or nil if the blob does
+// not exist. Message parts are returned after transfer decoding.
+func (s *Server) blob(account *mailstore.Account, accountId, blobId string) ([]byte, string, error) {
+	s.uploadedBlobsMutex.Lock()
+	blob := s.uploadedBlobs[blobId]
+	s.uploadedBlobsMutex.Unlock()
+
+	if blob != nil {
+		if blob.accountId != accountId || time.Now().After(blob.expiration) {
+			return nil, "", nil
+		}
+
+		return blob.data, blob.mediaType, nil
+	}
+
+	mbId, uid, partId, ok := parseBlobId(blobId)
+	if !ok {
+		return nil, "", nil
+	}
+
+	var mailboxName string
+	for _, info := range account.Mailboxes() {
+		if info.Id == mbId {
+			mailboxName = info.Name
+			break
+		}
+	}
+
+	if mailboxName == "" {
+		return nil, "", nil
+	}
+
+	data, err := account.MessageData(mailboxName, uid)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMessageNotFound) ||
+			errors.Is(err, mailstore.ErrMailboxNotFound) {
+			return nil, "", nil
+		}
+
+		return nil, "", err
+	}
+
+	if partId == "" {
+		return data, "message/rfc822", nil
+	}
+
+	part := parseBody(data).find(partId)
+	if part == nil {
+		return nil, "", nil
+	}
+
+	content := part.content()
+	if content == nil {
+		content = []byte{}
+	}
+
+	return content, part.mediaType, nil
+}
@@ -0,0 +1,452 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	stdmime "mime"
+	"mime/quotedprintable"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/galdor/emaild/pkg/mime"
+)
+
+// RFC 8621 4.1.4. Body Parts
+
+var bodyPartProperties = []string{
+	"partId", "blobId", "size", "headers", "name", "type", "charset",
+	"disposition", "cid", "language", "location", "subParts",
+}
+
+var defaultBodyPartProperties = []string{
+	"partId", "blobId", "size", "name", "type", "charset", "disposition",
+	"cid", "language", "location",
+}
+
+type bodyPart struct {
+	partId string // empty for multipart entities
+	fields []mime.HeaderField
+	body   []byte // encoded
+
+	mediaType string // lower case
+	params    map[string]string
+
+	subParts []*bodyPart
+}
+
+// parseBody parses the MIME structure of a message. Leaf parts are numbered
+// in depth-first order.
+func parseBody(data []byte) *bodyPart {
+	var nbParts int
+	return parseBodyPart(data, "text/plain", &nbParts)
+}
+
+func parseBodyPart(data []byte, defaultType string, nbParts *int) *bodyPart {
+	header, body := mime.SplitHeader(data)
+
+	p := bodyPart{
+		fields: mime.ParseHeaderFields(header),
+		body:   body,
+	}
+
+	mediaType, params, err := stdmime.ParseMediaType(p.field("Content-Type"))
+	if err != nil {
+		mediaType, params = defaultType, nil
+	}
+
+	p.mediaType = mediaType
+	p.params = params
+
+	if strings.HasPrefix(p.mediaType, "multipart/") {
+		childType := "text/plain"
+		if p.mediaType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+
+		for _, partData := range mime.SplitMultipartBody(body, p.params["boundary"]) {
+			p.subParts = append(p.subParts,
+				parseBodyPart(partData, childType, nbParts))
+		}
+
+		if len(p.subParts) > 0 {
+			return &p
+		}
+
+		// A multipart entity must contain at least one part
+		p.mediaType, p.params = "text/plain", nil
+	}
+
+	*nbParts++
+	p.partId = strconv.Itoa(*nbParts)
+
+	return &p
+}
+
+func (p *bodyPart) field(name string) string {
+	for _, field := range p.fields {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+
+	return ""
+}
+
+func (p *bodyPart) isMultipart() bool {
+	return len(p.subParts) > 0
+}
+
+func (p *bodyPart) find(partId string) *bodyPart {
+	if p.partId == partId {
+		return p
+	}
+
+	for _, child := range p.subParts {
+		if p2 := child.find(partId); p2 != nil {
+			return p2
+		}
+	}
+
+	return nil
+}
+
+func (p *bodyPart) disposition() (string, map[string]string) {
+	disposition, params, err := stdmime.ParseMediaType(p.field("Content-Disposition"))
+	if err != nil {
+		return "", nil
+	}
+
+	return disposition, params
+}
+
+func (p *bodyPart) name() string {
+	_, params := p.disposition()
+
+	name := params["filename"]
+	if name == "" {
+		name = p.params["name"]
+	}
+
+	return decodeText(name)
+}
+
+func (p *bodyPart) charset() string {
+	charset := strings.ToLower(p.params["charset"])
+	if charset == "" && strings.HasPrefix(p.mediaType, "text/") {
+		charset = "us-ascii"
+	}
+
+	return charset
+}
+
+// content returns the content of a part after transfer decoding.
+func (p *bodyPart) content() []byte {
+	encoding := strings.ToLower(p.field("Content-Transfer-Encoding"))
+
+	switch encoding {
+	case "base64":
+		data := bytes.Map(func(c rune) rune {
+			if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+				return -1
+			}
+
+			return c
+		}, p.body)
+
+		data = bytes.TrimRight(data, "=")
+
+		decoded := make([]byte, base64.RawStdEncoding.DecodedLen(len(data)))
+		n, _ := base64.RawStdEncoding.Decode(decoded, data)
+		return decoded[:n]
+
+	case "quoted-printable":
+		r := quotedprintable.NewReader(bytes.NewReader(p.body))
+		decoded, _ := io.ReadAll(r)
+		return decoded
+	}
+
+	return p.body
+}
+
+// text returns the content of a text part decoded to UTF-8, and whether
+// decoding failed for some characters.
+func (p *bodyPart) text() (string, bool) {
+	data := p.content()
+
+	switch p.charset() {
+	case "", "us-ascii", "utf-8", "utf8":
+		if utf8.Valid(data) {
+			return string(data), false
+		}
+
+		return strings.ToValidUTF8(string(data), "�"), true
+
+	case "iso-8859-1", "latin1":
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+
+		return string(runes), false
+	}
+
+	return strings.ToValidUTF8(string(data), "�"), true
+}
+
+func (p *bodyPart) object(blobId func(string) string, properties []string) map[string]any {
+	obj := make(map[string]any, len(properties))
+
+	for _, property := range properties {
+		switch property {
+		case "partId":
+			obj[property] = nullableString(p.partId)
+
+		case "blobId":
+			if p.partId == "" {
+				obj[property] = nil
+			} else {
+				obj[property] = blobId(p.partId)
+			}
+
+		case "size":
+			if p.isMultipart() {
+				obj[property] = 0
+			} else {
+				obj[property] = len(p.content())
+			}
+
+		case "headers":
+			obj[property] = headersObject(p.fields)
+
+		case "name":
+			obj[property] = nullableString(p.name())
+
+		case "type":
+			obj[property] = p.mediaType
+
+		case "charset":
+			obj[property] = nullableString(p.charset())
+
+		case "disposition":
+			disposition, _ := p.disposition()
+			obj[property] = nullableString(disposition)
+
+		case "cid":
+			cid := strings.TrimSpace(p.field("Content-ID"))
+			cid = strings.TrimSuffix(strings.TrimPrefix(cid, "<"), ">")
+			obj[property] = nullableString(cid)
+
+		case "language":
+			var languages []string
+			for _, language := range strings.Split(p.field("Content-Language"), ",") {
+				if language = strings.TrimSpace(language); language != "" {
+					languages = append(languages, language)
+				}
+			}
+
+			if languages == nil {
+				obj[property] = nil
+			} else {
+				obj[property] = languages
+			}
+
+		case "location":
+			obj[property] = nullableString(p.field("Content-Location"))
+
+		case "subParts":
+			if p.isMultipart() {
+				subParts := make([]map[string]any, len(p.subParts))
+				for i, child := range p.subParts {
+					subParts[i] = child.object(blobId, properties)
+				}
+
+				obj[property] = subParts
+			} else {
+				obj[property] = nil
+			}
+
+		default:
+			if prop, ok := parseHeaderProperty(property); ok {
+				obj[property] = prop.value(p.fields)
+			}
+		}
+	}
+
+	return obj
+}
+
+func headersObject(fields []mime.HeaderField) []map[string]string {
+	headers := make([]map[string]string, len(fields))
+
+	for i, field := range fields {
+		headers[i] = map[string]string{
+			"name":  field.Name,
+			"value": rawFieldValue(&field),
+		}
+	}
+
+	return headers
+}
+
+func nullableString(s string) any {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+func isInlineMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "image/") ||
+		strings.HasPrefix(mediaType, "audio/") ||
+		strings.HasPrefix(mediaType, "video/")
+}
+
+// bodyLists contains the parts selected by the algorithm of RFC 8621
+// 4.1.4.; a nil list pointer is the null value of the algorithm.
+type bodyLists struct {
+	textBody    []*bodyPart
+	htmlBody    []*bodyPart
+	attachments []*bodyPart
+}
+
+func (p *bodyPart) lists() *bodyLists {
+	var lists bodyLists
+
+	parseStructure([]*bodyPart{p}, "mixed", false,
+		&lists.htmlBody, &lists.textBody, &lists.attachments)
+
+	return &lists
+}
+
+func parseStructure(parts []*bodyPart, multipartType string, inAlternative bool, htmlBody, textBody, attachments *[]*bodyPart) {
+	textLength, htmlLength := -1, -1
+	if textBody != nil {
+		textLength = len(*textBody)
+	}
+	if htmlBody != nil {
+		htmlLength = len(*htmlBody)
+	}
+
+	for i, part := range parts {
+		disposition, _ := part.disposition()
+
+		isInline := disposition != "attachment" &&
+			(part.mediaType == "text/plain" || part.mediaType == "text/html" ||
+				isInlineMediaType(part.mediaType)) &&
+			(i == 0 || (multipartType != "related" &&
+				(isInlineMediaType(part.mediaType) || part.name() == "")))
+
+		if part.isMultipart() {
+			subType := strings.TrimPrefix(part.mediaType, "multipart/")
+
+			parseStructure(part.subParts, subType,
+				inAlternative || subType == "alternative",
+				htmlBody, textBody, attachments)
+		} else if isInline {
+			if multipartType == "alternative" {
+				switch {
+				case part.mediaType == "text/plain" && textBody != nil:
+					*textBody = append(*textBody, part)
+				case part.mediaType == "text/html" && htmlBody != nil:
+					*htmlBody = append(*htmlBody, part)
+				default:
+					*attachments = append(*attachments, part)
+				}
+
+				continue
+			} else if inAlternative {
+				if part.mediaType == "text/plain" {
+					htmlBody = nil
+				}
+
+				if part.mediaType == "text/html" {
+					textBody = nil
+				}
+			}
+
+			if textBody != nil {
+				*textBody = append(*textBody, part)
+			}
+
+			if htmlBody != nil {
+				*htmlBody = append(*htmlBody, part)
+			}
+
+			if (textBody == nil || htmlBody == nil) &&
+				isInlineMediaType(part.mediaType) {
+				*attachments = append(*attachments, part)
+			}
+		} else {
+			*attachments = append(*attachments, part)
+		}
+	}
+
+	if multipartType == "alternative" && textBody != nil && htmlBody != nil {
+		// Only HTML parts found
+		if textLength == len(*textBody) && htmlLength != len(*htmlBody) {
+			*textBody = append(*textBody, (*htmlBody)[htmlLength:]...)
+		}
+
+		// Only text parts found
+		if htmlLength == len(*htmlBody) && textLength != len(*textBody) {
+			*htmlBody = append(*htmlBody, (*textBody)[textLength:]...)
+		}
+	}
+}
+
+// preview returns the beginning of the text of a message with whitespace
+// collapsed (RFC 8621 4.1.4.).
+func (l *bodyLists) preview() string {
+	const maxLength = 256
+
+	var buf strings.Builder
+
+	for _, part := range l.textBody {
+		if !strings.HasPrefix(part.mediaType, "text/") {
+			continue
+		}
+
+		text, _ := part.text()
+		if part.mediaType == "text/html" {
+			text = stripHTMLTags(text)
+		}
+
+		buf.WriteString(text)
+		buf.WriteByte(' ')
+
+		if buf.Len() > maxLength*4 {
+			break
+		}
+	}
+
+	preview := strings.Join(strings.Fields(buf.String()), " ")
+
+	if utf8.RuneCountInString(preview) > maxLength {
+		preview = string([]rune(preview)[:maxLength])
+	}
+
+	return preview
+}
+
+func stripHTMLTags(s string) string {
+	var buf strings.Builder
+
+	inTag := false
+
+	for _, c := range s {
+		switch {
+		case c == '<':
+			inTag = true
+		case c == '>' && inTag:
+			inTag = false
+			buf.WriteByte(' ')
+		case !inTag:
+			buf.WriteRune(c)
+		}
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,634 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/mime"
+)
+
+// RFC 8621 4. Emails
+//
+// Each message of the store is an email contained in a single mailbox.
+// Messages are not grouped in conversations: each email is the only member
+// of its thread.
+
+var emailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size",
+	"receivedAt", "messageId", "inReplyTo", "references", "sender", "from",
+	"to", "cc", "bcc", "replyTo", "subject", "sentAt", "hasAttachment",
+	"preview", "headers", "bodyStructure", "bodyValues", "textBody",
+	"htmlBody", "attachments",
+}
+
+var defaultEmailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size",
+	"receivedAt", "messageId", "inReplyTo", "references", "sender", "from",
+	"to", "cc", "bcc", "replyTo", "subject", "sentAt", "hasAttachment",
+	"preview", "bodyValues", "textBody", "htmlBody", "attachments",
+}
+
+// Convenience properties are shortcuts for header properties (RFC 8621
+// 4.1.3.).
+var emailHeaderProperties = map[string]*headerProperty{
+	"messageId":  {Name: "Message-ID", Form: headerFormMessageIds},
+	"inReplyTo":  {Name: "In-Reply-To", Form: headerFormMessageIds},
+	"references": {Name: "References", Form: headerFormMessageIds},
+	"sender":     {Name: "Sender", Form: headerFormAddresses},
+	"from":       {Name: "From", Form: headerFormAddresses},
+	"to":         {Name: "To", Form: headerFormAddresses},
+	"cc":         {Name: "Cc", Form: headerFormAddresses},
+	"bcc":        {Name: "Bcc", Form: headerFormAddresses},
+	"replyTo":    {Name: "Reply-To", Form: headerFormAddresses},
+	"subject":    {Name: "Subject", Form: headerFormText},
+	"sentAt":     {Name: "Date", Form: headerFormDate},
+}
+
+// RFC 8621 4.1.1. IMAP system flags are mapped to keywords; \Deleted has no
+// equivalent and is hidden.
+var systemFlagKeywords = map[string]string{
+	mailstore.FlagSeen:     "$seen",
+	mailstore.FlagAnswered: "$answered",
+	mailstore.FlagFlagged:  "$flagged",
+	mailstore.FlagDraft:    "$draft",
+}
+
+func flagKeywords(flags []string) map[string]bool {
+	keywords := make(map[string]bool)
+
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, `\`) {
+			if keyword, found := systemFlagKeywords[flag]; found {
+				keywords[keyword] = true
+			}
+
+			continue
+		}
+
+		keywords[strings.ToLower(flag)] = true
+	}
+
+	return keywords
+}
+
+func keywordFlag(keyword string) (string, bool) {
+	keyword = strings.ToLower(keyword)
+
+	for flag, keyword2 := range systemFlagKeywords {
+		if keyword == keyword2 {
+			return flag, true
+		}
+	}
+
+	if keyword == "" || len(keyword) > 255 {
+		return "", false
+	}
+
+	for i := 0; i < len(keyword); i++ {
+		c := keyword[i]
+
+		if c <= 0x20 || c >= 0x7f || strings.IndexByte(`(){]%*"\`, c) >= 0 {
+			return "", false
+		}
+	}
+
+	return keyword, true
+}
+
+func keywordFlags(keywords map[string]bool) ([]string, bool) {
+	flags := []string{}
+
+	for keyword, value := range keywords {
+		flag, ok := keywordFlag(keyword)
+		if !ok || !value {
+			return nil, false
+		}
+
+		flags = append(flags, flag)
+	}
+
+	return flags, true
+}
+
+// email is a message of the store with its content loaded on demand.
+type email struct {
+	mailbox *mailstore.MailboxInfo
+	info    *mailstore.MessageInfo
+
+	data   []byte
+	fields []mime.HeaderField
+	body   *bodyPart
+	lists  *bodyLists
+}
+
+func (e *email) id() string {
+	return emailId(e.mailbox.Id, e.info.UID)
+}
+
+// email returns an email from its identifier or nil if it does not exist.
+func (c *apiContext) email(t *mailboxTable, id string) (*email, error) {
+	mbId, uid, ok := parseEmailId(id)
+	if !ok {
+		return nil, nil
+	}
+
+	return c.messageEmail(t, mbId, uid)
+}
+
+func (c *apiContext) messageEmail(t *mailboxTable, mbId, uid uint32) (*email, error) {
+	mailbox := t.byId[mbId]
+	if mailbox == nil {
+		return nil, nil
+	}
+
+	info, err := c.account.Message(mailbox.Name, uid)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMessageNotFound) ||
+			errors.Is(err, mailstore.ErrMailboxNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &email{mailbox: mailbox, info: info}, nil
+}
+
+// load reads and parses the content of the message. It returns false if the
+// message was expunged in the meantime.
+func (c *apiContext) loadEmail(e *email) (bool, error) {
+	if e.data != nil {
+		return true, nil
+	}
+
+	data, err := c.account.MessageData(e.mailbox.Name, e.info.UID)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMessageNotFound) ||
+			errors.Is(err, mailstore.ErrMailboxNotFound) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	e.data = data
+	e.body = parseBody(data)
+	e.fields = e.body.fields
+	e.lists = e.body.lists()
+
+	return true, nil
+}
+
+type emailGetArgs struct {
+	getArgs
+
+	BodyProperties      *[]string `json:"bodyProperties"`
+	FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+}
+
+// needsContent returns true if a property cannot be computed without
+// reading the message.
+func needsContent(property string) bool {
+	switch property {
+	case "id", "blobId", "threadId", "mailboxIds", "keywords", "size",
+		"receivedAt":
+		return false
+	}
+
+	return true
+}
+
+func checkEmailProperties(properties []string) error {
+	for _, property := range properties {
+		if _, ok := parseHeaderProperty(property); ok {
+			continue
+		}
+
+		if !slices.Contains(emailProperties, property) {
+			return invalidArgumentsf("unknown property %q", property)
+		}
+	}
+
+	return nil
+}
+
+// RFC 8621 4.2. Email/get
+func emailGet(c *apiContext, data json.RawMessage) (any, error) {
+	var args emailGetArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	if err := args.getArgs.check(c, nil); err != nil {
+		return nil, err
+	}
+
+	properties := defaultEmailProperties
+	if args.Properties != nil {
+		properties = append([]string{"id"}, *args.Properties...)
+	}
+
+	if err := checkEmailProperties(properties); err != nil {
+		return nil, err
+	}
+
+	bodyProperties := defaultBodyPartProperties
+	if args.BodyProperties != nil {
+		bodyProperties = *args.BodyProperties
+
+		for _, property := range bodyProperties {
+			_, isHeader := parseHeaderProperty(property)
+			if !isHeader && !slices.Contains(bodyPartProperties, property) {
+				return nil, invalidArgumentsf("unknown body property %q",
+					property)
+			}
+		}
+	}
+
+	if args.MaxBodyValueBytes < 0 {
+		return nil, invalidArgumentsf("invalid maxBodyValueBytes value")
+	}
+
+	t := c.mailboxes()
+
+	res := getResult{
+		AccountId: c.accountId,
+		State:     emailsState(t.infos),
+		List:      []map[string]any{},
+		NotFound:  []string{},
+	}
+
+	var emails []*email
+
+	if args.Ids == nil {
+		all, err := c.allEmails(t)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(all) > MaxObjectsInGet {
+			return nil, methodErrorf("requestTooLarge", "too many emails")
+		}
+
+		emails = all
+	} else {
+		for _, id := range *args.Ids {
+			e, err := c.email(t, id)
+			if err != nil {
+				return nil, err
+			} else if e == nil {
+				res.NotFound = append(res.NotFound, id)
+				continue
+			}
+
+			emails = append(emails, e)
+		}
+	}
+
+	loadContent := false
+	for _, property := range properties {
+		if needsContent(property) {
+			loadContent = true
+			break
+		}
+	}
+
+	for _, e := range emails {
+		if loadContent {
+			found, err := c.loadEmail(e)
+			if err != nil {
+				return nil, err
+			} else if !found {
+				res.NotFound = append(res.NotFound, e.id())
+				continue
+			}
+		}
+
+		obj := c.emailObject(e, properties, bodyProperties, &args)
+		res.List = append(res.List, obj)
+	}
+
+	return &res, nil
+}
+
+func (c *apiContext) allEmails(t *mailboxTable) ([]*email, error) {
+	var emails []*email
+
+	for _, mailbox := range t.infos {
+		infos, err := c.account.Messages(mailbox.Name)
+		if err != nil {
+			if errors.Is(err, mailstore.ErrMailboxNotFound) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		for _, info := range infos {
+			emails = append(emails, &email{mailbox: mailbox, info: info})
+		}
+	}
+
+	return emails, nil
+}
+
+func (c *apiContext) emailObject(e *email, properties, bodyProperties []string, args *emailGetArgs) map[string]any {
+	obj := make(map[string]any, len(properties))
+
+	blobId := func(partId string) string {
+		return partBlobId(e.mailbox.Id, e.info.UID, partId)
+	}
+
+	partObjects := func(parts []*bodyPart) []map[string]any {
+		objs := make([]map[string]any, len(parts))
+		for i, part := range parts {
+			objs[i] = part.object(blobId, bodyProperties)
+		}
+
+		return objs
+	}
+
+	for _, property := range properties {
+		switch property {
+		case "id":
+			obj[property] = e.id()
+
+		case "blobId":
+			obj[property] = messageBlobId(e.mailbox.Id, e.info.UID)
+
+		case "threadId":
+			obj[property] = threadId(e.mailbox.Id, e.info.UID)
+
+		case "mailboxIds":
+			obj[property] = map[string]bool{mailboxId(e.mailbox.Id): true}
+
+		case "keywords":
+			obj[property] = flagKeywords(e.info.Flags)
+
+		case "size":
+			obj[property] = e.info.Size
+
+		case "receivedAt":
+			obj[property] = e.info.InternalDate.UTC().Format(time.RFC3339)
+
+		case "hasAttachment":
+			obj[property] = len(e.lists.attachments) > 0
+
+		case "preview":
+			obj[property] = e.lists.preview()
+
+		case "headers":
+			obj[property] = headersObject(e.fields)
+
+		case "bodyStructure":
+			obj[property] = e.body.object(blobId,
+				append(bodyProperties, "subParts"))
+
+		case "textBody":
+			obj[property] = partObjects(e.lists.textBody)
+
+		case "htmlBody":
+			obj[property] = partObjects(e.lists.htmlBody)
+
+		case "attachments":
+			obj[property] = partObjects(e.lists.attachments)
+
+		case "bodyValues":
+			obj[property] = e.bodyValues(args)
+
+		default:
+			prop, ok := emailHeaderProperties[property]
+			if !ok {
+				prop, _ = parseHeaderProperty(property)
+			}
+
+			obj[property] = prop.value(e.fields)
+		}
+	}
+
+	return obj
+}
+
+type bodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+func (e *email) bodyValues(args *emailGetArgs) map[string]*bodyValue {
+	values := make(map[string]*bodyValue)
+
+	addParts := func(parts []*bodyPart) {
+		for _, part := range parts {
+			if strings.HasPrefix(part.mediaType, "text/") {
+				values[part.partId] = newBodyValue(part,
+					args.MaxBodyValueBytes)
+			}
+		}
+	}
+
+	if args.FetchAllBodyValues {
+		var walk func(*bodyPart)
+		walk = func(p *bodyPart) {
+			if !p.isMultipart() {
+				addParts([]*bodyPart{p})
+			}
+
+			for _, child := range p.subParts {
+				walk(child)
+			}
+		}
+
+		walk(e.body)
+	} else {
+		if args.FetchTextBodyValues {
+			addParts(e.lists.textBody)
+		}
+
+		if args.FetchHTMLBodyValues {
+			addParts(e.lists.htmlBody)
+		}
+	}
+
+	return values
+}
+
+func newBodyValue(part *bodyPart, maxBytes int) *bodyValue {
+	text, encodingProblem := part.text()
+
+	value := bodyValue{
+		Value:             text,
+		IsEncodingProblem: encodingProblem,
+	}
+
+	if maxBytes > 0 && len(text) > maxBytes {
+		// Values are truncated on a character boundary
+		end := maxBytes
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+
+		value.Value = text[:end]
+		value.IsTruncated = true
+	}
+
+	return &value
+}
+
+// RFC 8621 3.1. Thread/get
+func threadGet(c *apiContext, data json.RawMessage) (any, error) {
+	var args getArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	if err := args.check(c, []string{"id", "emailIds"}); err != nil {
+		return nil, err
+	}
+
+	t := c.mailboxes()
+
+	res := getResult{
+		AccountId: c.accountId,
+		State:     emailsState(t.infos),
+		List:      []map[string]any{},
+		NotFound:  []string{},
+	}
+
+	if args.Ids == nil {
+		return nil, methodErrorf("requestTooLarge",
+			"threads must be requested by identifier")
+	}
+
+	for _, id := range *args.Ids {
+		var e *email
+
+		if mbId, uid, ok := parseThreadId(id); ok {
+			var err error
+			if e, err = c.messageEmail(t, mbId, uid); err != nil {
+				return nil, err
+			}
+		}
+
+		if e == nil {
+			res.NotFound = append(res.NotFound, id)
+			continue
+		}
+
+		obj := map[string]any{
+			"id":       id,
+			"emailIds": []string{e.id()},
+		}
+
+		res.List = append(res.List, selectProperties(obj, args.Properties))
+	}
+
+	return &res, nil
+}
+
+// RFC 8621 4.3. Email/changes
+func emailChanges(c *apiContext, data json.RawMessage) (any, error) {
+	return messageChanges(c, data, emailId)
+}
+
+// RFC 8621 3.2. Thread/changes
+func threadChanges(c *apiContext, data json.RawMessage) (any, error) {
+	return messageChanges(c, data, threadId)
+}
+
+// messageChanges computes the changes of Email or Thread objects: since each
+// thread only contains one email, both change at the same time.
+func messageChanges(c *apiContext, data json.RawMessage, objectId func(uint32, uint32) string) (any, error) {
+	var args changesArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	if err := args.check(c); err != nil {
+		return nil, err
+	}
+
+	oldStates, err := parseEmailsState(args.SinceState)
+	if err != nil {
+		return nil, methodErrorf("cannotCalculateChanges", "%v", err)
+	}
+
+	t := c.mailboxes()
+
+	res := changesResult{
+		AccountId: c.accountId,
+		OldState:  args.SinceState,
+		NewState:  emailsState(t.infos),
+		Created:   []string{},
+		Updated:   []string{},
+		Destroyed: []string{},
+	}
+
+	// Messages of deleted mailboxes are unknown
+	for id := range oldStates {
+		if t.byId[id] == nil {
+			return nil, methodErrorf("cannotCalculateChanges",
+				"mailbox %q has been deleted", mailboxId(id))
+		}
+	}
+
+	for _, mailbox := range t.infos {
+		oldState := oldStates[mailbox.Id]
+
+		if oldState != nil && oldState.UIDValidity != mailbox.UIDValidity {
+			return nil, methodErrorf("cannotCalculateChanges",
+				"mailbox %q has been reset", mailboxId(mailbox.Id))
+		}
+
+		if oldState != nil && oldState.HighestModSeq == mailbox.HighestModSeq {
+			continue
+		}
+
+		infos, err := c.account.Messages(mailbox.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range infos {
+			id := objectId(mailbox.Id, info.UID)
+
+			switch {
+			case oldState == nil || info.UID >= oldState.UIDNext:
+				res.Created = append(res.Created, id)
+			case info.ModSeq > oldState.HighestModSeq:
+				res.Updated = append(res.Updated, id)
+			}
+		}
+
+		if oldState == nil {
+			continue
+		}
+
+		uids, err := c.account.ExpungedMessages(mailbox.Name,
+			oldState.HighestModSeq)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, uid := range uids {
+			if uid < oldState.UIDNext {
+				res.Destroyed = append(res.Destroyed,
+					objectId(mailbox.Id, uid))
+			}
+		}
+	}
+
+	if err := args.checkNbChanges(&res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
@@ -0,0 +1,555 @@
+package jmap
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+// RFC 8621 4.4. Email/query
+//
+// Queries are evaluated on the fly; most filters only use the envelope
+// stored with messages, but body and header filters require reading message
+// files.
+
+const MaxQueryResults = 1000
+
+var emailSortProperties = []string{
+	"receivedAt", "size", "from", "to", "subject", "sentAt", "hasKeyword",
+	"allInThreadHaveKeyword", "someInThreadHaveKeyword",
+}
+
+type emailFilter struct {
+	// Filter operators
+	Operator   *string        `json:"operator"`
+	Conditions []*emailFilter `json:"conditions"`
+
+	// Filter conditions
+	InMailbox               *string    `json:"inMailbox"`
+	InMailboxOtherThan      []string   `json:"inMailboxOtherThan"`
+	Before                  *time.Time `json:"before"`
+	After                   *time.Time `json:"after"`
+	MinSize                 *int64     `json:"minSize"`
+	MaxSize                 *int64     `json:"maxSize"`
+	AllInThreadHaveKeyword  *string    `json:"allInThreadHaveKeyword"`
+	SomeInThreadHaveKeyword *string    `json:"someInThreadHaveKeyword"`
+	NoneInThreadHaveKeyword *string    `json:"noneInThreadHaveKeyword"`
+	HasKeyword              *string    `json:"hasKeyword"`
+	NotKeyword              *string    `json:"notKeyword"`
+	HasAttachment           *bool      `json:"hasAttachment"`
+	Text                    *string    `json:"text"`
+	From                    *string    `json:"from"`
+	To                      *string    `json:"to"`
+	Cc                      *string    `json:"cc"`
+	Bcc                     *string    `json:"bcc"`
+	Subject                 *string    `json:"subject"`
+	Body                    *string    `json:"body"`
+	Header                  []string   `json:"header"`
+}
+
+type emailComparator struct {
+	Property    string  `json:"property"`
+	IsAscending *bool   `json:"isAscending"`
+	Collation   *string `json:"collation"`
+	Keyword     *string `json:"keyword"`
+}
+
+type emailQueryArgs struct {
+	AccountId       string             `json:"accountId"`
+	Filter          *emailFilter       `json:"filter"`
+	Sort            []*emailComparator `json:"sort"`
+	Position        int                `json:"position"`
+	Anchor          *string            `json:"anchor"`
+	AnchorOffset    int                `json:"anchorOffset"`
+	Limit           *int               `json:"limit"`
+	CalculateTotal  bool               `json:"calculateTotal"`
+	CollapseThreads bool               `json:"collapseThreads"`
+}
+
+type emailQueryResult struct {
+	AccountId           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	Ids                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+	Limit               *int     `json:"limit,omitempty"`
+}
+
+func (f *emailFilter) check(c *apiContext) error {
+	if f.Operator != nil {
+		switch *f.Operator {
+		case "AND", "OR", "NOT":
+		default:
+			return methodErrorf("unsupportedFilter",
+				"unknown operator %q", *f.Operator)
+		}
+
+		for _, condition := range f.Conditions {
+			if err := condition.check(c); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if f.InMailbox != nil {
+		id, _ := c.resolveId(*f.InMailbox)
+		f.InMailbox = &id
+	}
+
+	for i, id := range f.InMailboxOtherThan {
+		f.InMailboxOtherThan[i], _ = c.resolveId(id)
+	}
+
+	if f.Header != nil && (len(f.Header) == 0 || len(f.Header) > 2) {
+		return methodErrorf("unsupportedFilter", "invalid header filter")
+	}
+
+	return nil
+}
+
+func (f *emailFilter) match(c *apiContext, e *email) (bool, error) {
+	if f.Operator != nil {
+		for _, condition := range f.Conditions {
+			matched, err := condition.match(c, e)
+			if err != nil {
+				return false, err
+			}
+
+			switch {
+			case *f.Operator == "AND" && !matched:
+				return false, nil
+			case *f.Operator == "OR" && matched:
+				return true, nil
+			case *f.Operator == "NOT" && matched:
+				return false, nil
+			}
+		}
+
+		return *f.Operator != "OR", nil
+	}
+
+	info := e.info
+	id := mailboxId(e.mailbox.Id)
+
+	if f.InMailbox != nil && *f.InMailbox != id {
+		return false, nil
+	}
+
+	if slices.Contains(f.InMailboxOtherThan, id) {
+		return false, nil
+	}
+
+	if f.Before != nil && !info.InternalDate.Before(*f.Before) {
+		return false, nil
+	}
+
+	if f.After != nil && info.InternalDate.Before(*f.After) {
+		return false, nil
+	}
+
+	if f.MinSize != nil && info.Size < *f.MinSize {
+		return false, nil
+	}
+
+	if f.MaxSize != nil && info.Size >= *f.MaxSize {
+		return false, nil
+	}
+
+	keywords := flagKeywords(info.Flags)
+
+	for _, keyword := range []*string{f.AllInThreadHaveKeyword,
+		f.SomeInThreadHaveKeyword, f.HasKeyword} {
+		if keyword != nil && !keywords[strings.ToLower(*keyword)] {
+			return false, nil
+		}
+	}
+
+	for _, keyword := range []*string{f.NoneInThreadHaveKeyword,
+		f.NotKeyword} {
+		if keyword != nil && keywords[strings.ToLower(*keyword)] {
+			return false, nil
+		}
+	}
+
+	envelope := info.Envelope
+	if envelope == nil {
+		envelope = &mailstore.Envelope{}
+	}
+
+	addressFilters := []struct {
+		value *string
+		addrs []mailstore.Address
+	}{
+		{f.From, envelope.From},
+		{f.To, envelope.To},
+		{f.Cc, envelope.Cc},
+		{f.Bcc, envelope.Bcc},
+	}
+
+	for _, filter := range addressFilters {
+		if filter.value != nil && !matchAddresses(filter.addrs, *filter.value) {
+			return false, nil
+		}
+	}
+
+	if f.Subject != nil && !containsFold(envelope.Subject, *f.Subject) {
+		return false, nil
+	}
+
+	if f.HasAttachment == nil && f.Body == nil && f.Text == nil &&
+		f.Header == nil {
+		return true, nil
+	}
+
+	// The remaining conditions require the content of the message
+	found, err := c.loadEmail(e)
+	if err != nil || !found {
+		return false, err
+	}
+
+	if f.HasAttachment != nil &&
+		(len(e.lists.attachments) > 0) != *f.HasAttachment {
+		return false, nil
+	}
+
+	if f.Body != nil && !e.bodyContains(*f.Body) {
+		return false, nil
+	}
+
+	if f.Text != nil {
+		text := *f.Text
+
+		matched := containsFold(envelope.Subject, text) ||
+			matchAddresses(envelope.From, text) ||
+			matchAddresses(envelope.To, text) ||
+			matchAddresses(envelope.Cc, text) ||
+			matchAddresses(envelope.Bcc, text) ||
+			e.bodyContains(text)
+
+		if !matched {
+			return false, nil
+		}
+	}
+
+	if f.Header != nil {
+		matched := false
+
+		for _, field := range e.fields {
+			if !strings.EqualFold(field.Name, f.Header[0]) {
+				continue
+			}
+
+			if len(f.Header) == 1 ||
+				containsFold(decodeText(field.Value), f.Header[1]) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (e *email) bodyContains(s string) bool {
+	for _, parts := range [][]*bodyPart{e.lists.textBody, e.lists.htmlBody} {
+		for _, part := range parts {
+			if !strings.HasPrefix(part.mediaType, "text/") {
+				continue
+			}
+
+			text, _ := part.text()
+			if part.mediaType == "text/html" {
+				text = stripHTMLTags(text)
+			}
+
+			if containsFold(text, s) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func matchAddresses(addrs []mailstore.Address, s string) bool {
+	for _, addr := range addrs {
+		if containsFold(addressString(addr), s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func addressString(addr mailstore.Address) string {
+	s := addr.LocalPart + "@" + addr.Domain
+	if addr.Name != "" {
+		s = addr.Name + " <" + s + ">"
+	}
+
+	return s
+}
+
+func containsFold(s, substring string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substring))
+}
+
+func (cmp *emailComparator) check() error {
+	if !slices.Contains(emailSortProperties, cmp.Property) {
+		return methodErrorf("unsupportedSort",
+			"unsupported sort property %q", cmp.Property)
+	}
+
+	if strings.HasSuffix(cmp.Property, "Keyword") && cmp.Keyword == nil {
+		return invalidArgumentsf("missing keyword for sort property %q",
+			cmp.Property)
+	}
+
+	if cmp.Collation != nil && *cmp.Collation != "i;ascii-casemap" &&
+		*cmp.Collation != "i;unicode-casemap" {
+		return methodErrorf("unsupportedSort",
+			"unsupported collation %q", *cmp.Collation)
+	}
+
+	return nil
+}
+
+// compare returns a negative value if a is before b, a positive value if a
+// is after b and 0 if they are equal.
+func (cmp *emailComparator) compare(a, b *email) int {
+	var n int
+
+	firstAddress := func(addrs []mailstore.Address) string {
+		if len(addrs) == 0 {
+			return ""
+		}
+
+		addr := addrs[0]
+		if addr.Name != "" {
+			return strings.ToLower(addr.Name)
+		}
+
+		return strings.ToLower(addr.LocalPart + "@" + addr.Domain)
+	}
+
+	envA, envB := a.info.Envelope, b.info.Envelope
+	if envA == nil {
+		envA = &mailstore.Envelope{}
+	}
+	if envB == nil {
+		envB = &mailstore.Envelope{}
+	}
+
+	switch cmp.Property {
+	case "receivedAt":
+		n = a.info.InternalDate.Compare(b.info.InternalDate)
+
+	case "size":
+		n = compareValues(a.info.Size, b.info.Size)
+
+	case "from":
+		n = strings.Compare(firstAddress(envA.From), firstAddress(envB.From))
+
+	case "to":
+		n = strings.Compare(firstAddress(envA.To), firstAddress(envB.To))
+
+	case "subject":
+		n = strings.Compare(strings.ToLower(envA.Subject),
+			strings.ToLower(envB.Subject))
+
+	case "sentAt":
+		dateA, dateB := a.info.InternalDate, b.info.InternalDate
+		if envA.Date != nil {
+			dateA = *envA.Date
+		}
+		if envB.Date != nil {
+			dateB = *envB.Date
+		}
+
+		n = dateA.Compare(dateB)
+
+	default:
+		keyword := strings.ToLower(*cmp.Keyword)
+
+		var valueA, valueB int
+		if flagKeywords(a.info.Flags)[keyword] {
+			valueA = 1
+		}
+		if flagKeywords(b.info.Flags)[keyword] {
+			valueB = 1
+		}
+
+		n = compareValues(valueA, valueB)
+	}
+
+	if cmp.IsAscending != nil && !*cmp.IsAscending {
+		n = -n
+	}
+
+	return n
+}
+
+func compareValues[T int | int64 | uint32](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func emailQuery(c *apiContext, data json.RawMessage) (any, error) {
+	var args emailQueryArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	if err := c.checkAccountId(args.AccountId); err != nil {
+		return nil, err
+	}
+
+	t := c.mailboxes()
+
+	if args.Filter != nil {
+		if err := args.Filter.check(c); err != nil {
+			return nil, err
+		}
+	}
+
+	sortCmps := args.Sort
+	if len(sortCmps) == 0 {
+		isAscending := false
+		sortCmps = []*emailComparator{
+			{Property: "receivedAt", IsAscending: &isAscending},
+		}
+	}
+
+	for _, cmp := range sortCmps {
+		if err := cmp.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	if args.Limit != nil && *args.Limit < 0 {
+		return nil, invalidArgumentsf("invalid limit value")
+	}
+
+	all, err := c.allEmails(t)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []*email
+
+	for _, e := range all {
+		if args.Filter != nil {
+			matched, err := args.Filter.match(c, e)
+			if err != nil {
+				return nil, err
+			} else if !matched {
+				continue
+			}
+		}
+
+		emails = append(emails, e)
+	}
+
+	sort.SliceStable(emails, func(i, j int) bool {
+		for _, cmp := range sortCmps {
+			if n := cmp.compare(emails[i], emails[j]); n != 0 {
+				return n < 0
+			}
+		}
+
+		if n := compareValues(emails[i].mailbox.Id, emails[j].mailbox.Id); n != 0 {
+			return n < 0
+		}
+
+		return emails[i].info.UID < emails[j].info.UID
+	})
+
+	total := len(emails)
+
+	position := args.Position
+	if args.Anchor != nil {
+		idx := slices.IndexFunc(emails, func(e *email) bool {
+			return e.id() == *args.Anchor
+		})
+
+		if idx == -1 {
+			return nil, methodErrorf("anchorNotFound",
+				"unknown email %q", *args.Anchor)
+		}
+
+		position = idx + args.AnchorOffset
+	} else if position < 0 {
+		position += total
+	}
+
+	position = max(0, min(position, total))
+
+	res := emailQueryResult{
+		AccountId:  c.accountId,
+		QueryState: emailsState(t.infos),
+		Position:   position,
+		Ids:        []string{},
+	}
+
+	if args.CalculateTotal {
+		res.Total = &total
+	}
+
+	limit := MaxQueryResults
+	if args.Limit != nil && *args.Limit <= limit {
+		limit = *args.Limit
+	} else {
+		res.Limit = &limit
+	}
+
+	for _, e := range emails[position:min(position+limit, total)] {
+		res.Ids = append(res.Ids, e.id())
+	}
+
+	return &res, nil
+}
+
+// RFC 8621 4.5. Email/queryChanges
+//
+// Query results are not cached: the changes of a query cannot be computed
+// and clients must run the query again.
+func emailQueryChanges(c *apiContext, data json.RawMessage) (any, error) {
+	var args struct {
+		AccountId       string             `json:"accountId"`
+		Filter          *emailFilter       `json:"filter"`
+		Sort            []*emailComparator `json:"sort"`
+		SinceQueryState string             `json:"sinceQueryState"`
+		MaxChanges      *int               `json:"maxChanges"`
+		UpToId          *string            `json:"upToId"`
+		CalculateTotal  bool               `json:"calculateTotal"`
+		CollapseThreads bool               `json:"collapseThreads"`
+	}
+
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	if err := c.checkAccountId(args.AccountId); err != nil {
+		return nil, err
+	}
+
+	return nil, methodErrorf("cannotCalculateChanges",
+		"query changes are not supported")
+}
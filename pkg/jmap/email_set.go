@@ -0,0 +1,920 @@
+package jmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	stdmime "mime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/mime"
+)
+
+// RFC 8621 4.6. Email/set
+//
+// Emails are immutable except for their keywords and mailboxes. Since
+// identifiers are derived from the mailbox of a message, moving an email to
+// another mailbox changes its identifier; the new identifier is returned in
+// the list of updated emails.
+
+type emailCreateObject struct {
+	MailboxIds map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt *time.Time      `json:"receivedAt"`
+
+	MessageId  []string        `json:"messageId"`
+	InReplyTo  []string        `json:"inReplyTo"`
+	References []string        `json:"references"`
+	Sender     []*emailAddress `json:"sender"`
+	From       []*emailAddress `json:"from"`
+	To         []*emailAddress `json:"to"`
+	Cc         []*emailAddress `json:"cc"`
+	Bcc        []*emailAddress `json:"bcc"`
+	ReplyTo    []*emailAddress `json:"replyTo"`
+	Subject    *string         `json:"subject"`
+	SentAt     *time.Time      `json:"sentAt"`
+
+	BodyStructure json.RawMessage        `json:"bodyStructure"`
+	BodyValues    map[string]*bodyValue  `json:"bodyValues"`
+	TextBody      []*emailCreateBodyPart `json:"textBody"`
+	HTMLBody      []*emailCreateBodyPart `json:"htmlBody"`
+	Attachments   []*emailCreateBodyPart `json:"attachments"`
+
+	// Fields set with header:* properties
+	headers []*emailCreateHeader
+}
+
+type emailCreateBodyPart struct {
+	PartId      *string  `json:"partId"`
+	BlobId      *string  `json:"blobId"`
+	Size        *int     `json:"size"`
+	Type        *string  `json:"type"`
+	Charset     *string  `json:"charset"`
+	Name        *string  `json:"name"`
+	Disposition *string  `json:"disposition"`
+	Cid         *string  `json:"cid"`
+	Language    []string `json:"language"`
+	Location    *string  `json:"location"`
+}
+
+type emailCreateHeader struct {
+	Name  string
+	Value string // encoded
+}
+
+// RFC 8621 4.6. Email/set
+func emailSet(c *apiContext, data json.RawMessage) (any, error) {
+	var args setArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	return c.setEmails(&args)
+}
+
+func (c *apiContext) setEmails(args *setArgs) (*setResult, error) {
+	t := c.mailboxes()
+
+	state := emailsState(t.infos)
+	if err := args.check(c, state); err != nil {
+		return nil, err
+	}
+
+	res := newSetResult(c.accountId, state)
+
+	creationIds := make([]string, 0, len(args.Create))
+	for creationId := range args.Create {
+		creationIds = append(creationIds, creationId)
+	}
+
+	sort.Strings(creationIds)
+
+	for _, creationId := range creationIds {
+		obj, setErr, err := c.createEmail(t, args.Create[creationId])
+		if err != nil {
+			return nil, err
+		} else if setErr != nil {
+			res.NotCreated[creationId] = setErr
+			continue
+		}
+
+		c.createdIds[creationId] = obj["id"].(string)
+		res.Created[creationId] = obj
+	}
+
+	for id, patch := range args.Update {
+		obj, setErr, err := c.updateEmail(t, id, patch)
+		if err != nil {
+			return nil, err
+		} else if setErr != nil {
+			res.NotUpdated[id] = setErr
+			continue
+		}
+
+		res.Updated[id] = obj
+	}
+
+	res.Destroyed = []string{}
+
+	for _, id := range args.Destroy {
+		setErr, err := c.destroyEmail(t, id)
+		if err != nil {
+			return nil, err
+		} else if setErr != nil {
+			res.NotDestroyed[id] = setErr
+			continue
+		}
+
+		res.Destroyed = append(res.Destroyed, id)
+	}
+
+	res.NewState = emailsState(c.account.Mailboxes())
+
+	return res, nil
+}
+
+func decodeEmailCreateObject(data json.RawMessage) (*emailCreateObject, *SetError) {
+	// Header properties cannot be decoded with the rest of the object
+	var properties map[string]json.RawMessage
+	if err := json.Unmarshal(data, &properties); err != nil {
+		return nil, invalidPropertiesf(nil, "invalid object: %v", err)
+	}
+
+	var headers []*emailCreateHeader
+
+	for property, value := range properties {
+		prop, ok := parseHeaderProperty(property)
+		if !ok {
+			continue
+		}
+
+		delete(properties, property)
+
+		if strings.HasPrefix(strings.ToLower(prop.Name), "content-") {
+			return nil, invalidPropertiesf([]string{property},
+				"content header fields cannot be set")
+		}
+
+		var values []string
+
+		switch {
+		case prop.Form != headerFormRaw && prop.Form != headerFormText:
+			return nil, invalidPropertiesf([]string{property},
+				"unsupported header form %q", prop.Form)
+
+		case prop.All:
+			if err := json.Unmarshal(value, &values); err != nil {
+				return nil, invalidPropertiesf([]string{property},
+					"invalid value: %v", err)
+			}
+
+		default:
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return nil, invalidPropertiesf([]string{property},
+					"invalid value: %v", err)
+			}
+
+			values = []string{s}
+		}
+
+		for _, value := range values {
+			if prop.Form == headerFormText {
+				value = " " + encodeText(value)
+			}
+
+			headers = append(headers,
+				&emailCreateHeader{Name: prop.Name, Value: value})
+		}
+	}
+
+	data, _ = json.Marshal(properties)
+
+	var obj emailCreateObject
+	if err := decodeObject(data, &obj); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(headers, func(i, j int) bool {
+		return headers[i].Name < headers[j].Name
+	})
+
+	obj.headers = headers
+
+	return &obj, nil
+}
+
+func (c *apiContext) createEmail(t *mailboxTable, data json.RawMessage) (map[string]any, *SetError, error) {
+	obj, setErr := decodeEmailCreateObject(data)
+	if setErr != nil {
+		return nil, setErr, nil
+	}
+
+	mailbox, setErr := c.emailMailbox(t, obj.MailboxIds)
+	if setErr != nil {
+		return nil, setErr, nil
+	}
+
+	flags, ok := keywordFlags(obj.Keywords)
+	if !ok {
+		return nil, invalidPropertiesf([]string{"keywords"},
+			"invalid keywords"), nil
+	}
+
+	msgData, setErr, err := c.generateMessage(obj)
+	if err != nil || setErr != nil {
+		return nil, setErr, err
+	}
+
+	date := time.Now()
+	if obj.ReceivedAt != nil {
+		date = *obj.ReceivedAt
+	}
+
+	return c.appendEmail(mailbox, msgData, flags, date)
+}
+
+// emailMailbox returns the mailbox referenced by the mailboxIds property of
+// an email; emails must belong to exactly one mailbox.
+func (c *apiContext) emailMailbox(t *mailboxTable, mailboxIds map[string]bool) (*mailstore.MailboxInfo, *SetError) {
+	var mailbox *mailstore.MailboxInfo
+
+	for id, value := range mailboxIds {
+		if !value {
+			return nil, invalidPropertiesf([]string{"mailboxIds"},
+				"invalid mailbox value")
+		}
+
+		if mailbox != nil {
+			return nil, setErrorf("tooManyMailboxes",
+				"emails can only belong to one mailbox")
+		}
+
+		id, _ = c.resolveId(id)
+
+		if mailbox = t.byJMAPId[id]; mailbox == nil {
+			return nil, invalidPropertiesf([]string{"mailboxIds"},
+				"unknown mailbox %q", id)
+		}
+	}
+
+	if mailbox == nil {
+		return nil, invalidPropertiesf([]string{"mailboxIds"},
+			"missing mailbox")
+	}
+
+	return mailbox, nil
+}
+
+func (c *apiContext) appendEmail(mailbox *mailstore.MailboxInfo, data []byte, flags []string, date time.Time) (map[string]any, *SetError, error) {
+	uid, err := c.account.AppendMessage(mailbox.Name, data, flags, date)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMailboxNotFound) {
+			return nil, invalidPropertiesf([]string{"mailboxIds"},
+				"unknown mailbox"), nil
+		}
+
+		return nil, nil, err
+	}
+
+	obj := map[string]any{
+		"id":       emailId(mailbox.Id, uid),
+		"blobId":   messageBlobId(mailbox.Id, uid),
+		"threadId": threadId(mailbox.Id, uid),
+		"size":     len(data),
+	}
+
+	return obj, nil, nil
+}
+
+// generateMessage builds a message from the properties of an Email object
+// (RFC 8621 4.6.).
+func (c *apiContext) generateMessage(obj *emailCreateObject) ([]byte, *SetError, error) {
+	if obj.BodyStructure != nil {
+		return nil, invalidPropertiesf([]string{"bodyStructure"},
+			"body structures are not supported"), nil
+	}
+
+	var buf bytes.Buffer
+
+	writeField := func(name, value string) {
+		buf.WriteString(name)
+		buf.WriteString(":")
+		buf.WriteString(value)
+		buf.WriteString("\r\n")
+	}
+
+	addressFields := []struct {
+		name  string
+		value []*emailAddress
+	}{
+		{"From", obj.From},
+		{"Sender", obj.Sender},
+		{"Reply-To", obj.ReplyTo},
+		{"To", obj.To},
+		{"Cc", obj.Cc},
+		{"Bcc", obj.Bcc},
+	}
+
+	for _, field := range addressFields {
+		if field.value == nil {
+			continue
+		}
+
+		value, err := encodeAddresses(field.value)
+		if err != nil {
+			property := strings.ToLower(field.name[:1]) +
+				strings.ReplaceAll(field.name[1:], "-", "")
+			return nil, invalidPropertiesf([]string{property}, "%v", err),
+				nil
+		}
+
+		writeField(field.name, " "+value)
+	}
+
+	if obj.Subject != nil {
+		writeField("Subject", " "+encodeText(*obj.Subject))
+	}
+
+	date := time.Now()
+	if obj.SentAt != nil {
+		date = *obj.SentAt
+	}
+
+	writeField("Date", " "+date.Format(time.RFC1123Z))
+
+	messageIds := obj.MessageId
+	if messageIds == nil {
+		domain := "localhost"
+		if len(obj.From) > 0 {
+			_, domain, _ = strings.Cut(obj.From[0].Email, "@")
+		}
+
+		id, err := generateMessageId(domain)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		messageIds = []string{id}
+	}
+
+	messageIdFields := []struct {
+		name     string
+		property string
+		value    []string
+	}{
+		{"Message-ID", "messageId", messageIds},
+		{"In-Reply-To", "inReplyTo", obj.InReplyTo},
+		{"References", "references", obj.References},
+	}
+
+	for _, field := range messageIdFields {
+		if field.value == nil {
+			continue
+		}
+
+		value, err := encodeMessageIds(field.value)
+		if err != nil {
+			return nil, invalidPropertiesf([]string{field.property}, "%v",
+				err), nil
+		}
+
+		writeField(field.name, " "+value)
+	}
+
+	for _, header := range obj.headers {
+		writeField(header.Name, header.Value)
+	}
+
+	writeField("MIME-Version", " 1.0")
+
+	body, setErr, err := c.generateBody(obj)
+	if err != nil || setErr != nil {
+		return nil, setErr, err
+	}
+
+	buf.Write(body)
+
+	return buf.Bytes(), nil, nil
+}
+
+// generateBody returns the content fields and body of a message.
+func (c *apiContext) generateBody(obj *emailCreateObject) ([]byte, *SetError, error) {
+	if len(obj.TextBody) > 1 || len(obj.HTMLBody) > 1 {
+		return nil, invalidPropertiesf([]string{"textBody", "htmlBody"},
+			"text and html bodies must contain a single part"), nil
+	}
+
+	var textParts [][]byte
+
+	textBodies := []struct {
+		property  string
+		mediaType string
+		parts     []*emailCreateBodyPart
+	}{
+		{"textBody", "text/plain", obj.TextBody},
+		{"htmlBody", "text/html", obj.HTMLBody},
+	}
+
+	for _, body := range textBodies {
+		if len(body.parts) == 0 {
+			continue
+		}
+
+		part := body.parts[0]
+
+		if part.Type != nil && *part.Type != body.mediaType {
+			return nil, invalidPropertiesf([]string{body.property},
+				"invalid media type"), nil
+		}
+
+		if part.PartId == nil || obj.BodyValues[*part.PartId] == nil {
+			return nil, invalidPropertiesf([]string{body.property},
+				"missing body value"), nil
+		}
+
+		value := obj.BodyValues[*part.PartId]
+		if value.IsEncodingProblem || value.IsTruncated {
+			return nil, invalidPropertiesf([]string{"bodyValues"},
+				"invalid body value"), nil
+		}
+
+		text := strings.ReplaceAll(value.Value, "\r\n", "\n")
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+
+		content := mime.QuotedPrintableEncode(text)
+		if !strings.HasSuffix(content, "\r\n") {
+			content += "\r\n"
+		}
+
+		var partBuf bytes.Buffer
+		partBuf.WriteString("Content-Type: " + body.mediaType +
+			"; charset=utf-8\r\n")
+		partBuf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+		partBuf.WriteString("\r\n")
+		partBuf.WriteString(content)
+
+		textParts = append(textParts, partBuf.Bytes())
+	}
+
+	var content []byte
+
+	switch len(textParts) {
+	case 0:
+		content = []byte("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	case 1:
+		content = textParts[0]
+	default:
+		var err error
+		content, err = multipartEntity("alternative", textParts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(obj.Attachments) == 0 {
+		return content, nil, nil
+	}
+
+	parts := [][]byte{content}
+
+	for _, attachment := range obj.Attachments {
+		part, setErr, err := c.generateAttachment(attachment)
+		if err != nil || setErr != nil {
+			return nil, setErr, err
+		}
+
+		parts = append(parts, part)
+	}
+
+	mixed, err := multipartEntity("mixed", parts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mixed, nil, nil
+}
+
+func (c *apiContext) generateAttachment(part *emailCreateBodyPart) ([]byte, *SetError, error) {
+	if part.BlobId == nil {
+		return nil, invalidPropertiesf([]string{"attachments"},
+			"missing blob identifier"), nil
+	}
+
+	blobId, _ := c.resolveId(*part.BlobId)
+
+	data, mediaType, err := c.Server.blob(c.account, c.accountId, blobId)
+	if err != nil {
+		return nil, nil, err
+	} else if data == nil {
+		return nil, setErrorf("blobNotFound", "unknown blob %q", blobId), nil
+	}
+
+	if part.Type != nil {
+		mediaType = *part.Type
+	}
+
+	params := make(map[string]string)
+	if part.Charset != nil {
+		params["charset"] = *part.Charset
+	}
+
+	contentType := stdmime.FormatMediaType(mediaType, params)
+	if contentType == "" {
+		return nil, invalidPropertiesf([]string{"attachments"},
+			"invalid media type %q", mediaType), nil
+	}
+
+	disposition := "attachment"
+	if part.Disposition != nil {
+		disposition = *part.Disposition
+	}
+
+	dispositionParams := make(map[string]string)
+	if part.Name != nil {
+		dispositionParams["filename"] = *part.Name
+	}
+
+	contentDisposition := stdmime.FormatMediaType(disposition,
+		dispositionParams)
+	if contentDisposition == "" {
+		return nil, invalidPropertiesf([]string{"attachments"},
+			"invalid disposition %q", disposition), nil
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString("Content-Type: " + contentType + "\r\n")
+	buf.WriteString("Content-Disposition: " + contentDisposition + "\r\n")
+
+	if part.Cid != nil {
+		buf.WriteString("Content-ID: <" + *part.Cid + ">\r\n")
+	}
+
+	if len(part.Language) > 0 {
+		buf.WriteString("Content-Language: " +
+			strings.Join(part.Language, ", ") + "\r\n")
+	}
+
+	if part.Location != nil {
+		buf.WriteString("Content-Location: " + *part.Location + "\r\n")
+	}
+
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(mime.Base64Encode(data))
+	buf.WriteString("\r\n")
+
+	return buf.Bytes(), nil, nil
+}
+
+// multipartEntity returns the content fields and body of a multipart entity
+// containing a list of entities.
+func multipartEntity(subType string, parts [][]byte) ([]byte, error) {
+	data := make([]byte, 12)
+	if _, err := rand.Read(data); err != nil {
+		return nil, fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	boundary := "=_" + hex.EncodeToString(data)
+
+	var buf bytes.Buffer
+
+	buf.WriteString("Content-Type: multipart/" + subType + "; boundary=\"" +
+		boundary + "\"\r\n")
+	buf.WriteString("\r\n")
+
+	for _, part := range parts {
+		buf.WriteString("--" + boundary + "\r\n")
+		buf.Write(part)
+	}
+
+	buf.WriteString("--" + boundary + "--\r\n")
+
+	return buf.Bytes(), nil
+}
+
+// encodeText encodes a header field value with RFC 2047 encoded words if it
+// contains non-ASCII characters.
+func encodeText(s string) string {
+	return stdmime.QEncoding.Encode("utf-8", s)
+}
+
+func encodeAddresses(addrs []*emailAddress) (string, error) {
+	values := make([]string, len(addrs))
+
+	for i, addr := range addrs {
+		spec, err := parseSpecificAddress(addr.Email)
+		if err != nil {
+			return "", fmt.Errorf("invalid email address %q", addr.Email)
+		}
+
+		value := spec.String()
+
+		if addr.Name != nil && *addr.Name != "" {
+			name := encodeText(*addr.Name)
+			if name == *addr.Name {
+				name = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).
+					Replace(name) + `"`
+			}
+
+			value = name + " <" + value + ">"
+		}
+
+		values[i] = value
+	}
+
+	return strings.Join(values, ", "), nil
+}
+
+func encodeMessageIds(ids []string) (string, error) {
+	values := make([]string, len(ids))
+
+	for i, id := range ids {
+		d := imf.NewDataDecoder([]byte("<" + id + ">"))
+
+		if _, err := d.ReadMessageIdList(false); err != nil || !d.Empty() {
+			return "", fmt.Errorf("invalid message id %q", id)
+		}
+
+		values[i] = "<" + id + ">"
+	}
+
+	return strings.Join(values, " "), nil
+}
+
+func generateMessageId(domain string) (string, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	return hex.EncodeToString(data) + "@" + domain, nil
+}
+
+func (c *apiContext) updateEmail(t *mailboxTable, id string, patch map[string]json.RawMessage) (map[string]any, *SetError, error) {
+	e, err := c.email(t, id)
+	if err != nil {
+		return nil, nil, err
+	} else if e == nil {
+		return nil, setErrorf("notFound", "unknown email"), nil
+	}
+
+	keywords := flagKeywords(e.info.Flags)
+	mailboxIds := map[string]bool{mailboxId(e.mailbox.Id): true}
+
+	for path, value := range patch {
+		name, key, isPatch := strings.Cut(path, "/")
+		if isPatch {
+			key = strings.ReplaceAll(key, "~1", "/")
+			key = strings.ReplaceAll(key, "~0", "~")
+		}
+
+		var table map[string]bool
+
+		switch name {
+		case "keywords":
+			table = keywords
+		case "mailboxIds":
+			table = mailboxIds
+		default:
+			return nil, invalidPropertiesf([]string{name},
+				"property cannot be modified"), nil
+		}
+
+		if isPatch {
+			var v *bool
+			if err := json.Unmarshal(value, &v); err != nil ||
+				(v != nil && !*v) {
+				return nil, invalidPropertiesf([]string{path},
+					"invalid value"), nil
+			}
+
+			if name == "keywords" {
+				key = strings.ToLower(key)
+			}
+
+			if v == nil {
+				delete(table, key)
+			} else {
+				table[key] = true
+			}
+
+			continue
+		}
+
+		var newTable map[string]bool
+		if err := json.Unmarshal(value, &newTable); err != nil {
+			return nil, invalidPropertiesf([]string{path},
+				"invalid value"), nil
+		}
+
+		clear(table)
+		for key, value := range newTable {
+			if name == "keywords" {
+				key = strings.ToLower(key)
+			}
+
+			table[key] = value
+		}
+	}
+
+	flags, ok := keywordFlags(keywords)
+	if !ok {
+		return nil, invalidPropertiesf([]string{"keywords"},
+			"invalid keywords"), nil
+	}
+
+	// \Deleted has no keyword and must be preserved
+	for _, flag := range e.info.Flags {
+		if flag == mailstore.FlagDeleted {
+			flags = append(flags, flag)
+		}
+	}
+
+	mailbox, setErr := c.emailMailbox(t, mailboxIds)
+	if setErr != nil {
+		return nil, setErr, nil
+	}
+
+	_, err = c.account.StoreFlags(e.mailbox.Name, []uint32{e.info.UID},
+		mailstore.FlagOperationReplace, flags)
+	if err != nil {
+		if setErr := emailSetError(err); setErr != nil {
+			return nil, setErr, nil
+		}
+
+		return nil, nil, err
+	}
+
+	if mailbox.Id == e.mailbox.Id {
+		return nil, nil, nil
+	}
+
+	uids, err := c.account.CopyMessages(e.mailbox.Name,
+		[]uint32{e.info.UID}, mailbox.Name)
+	if err != nil {
+		if setErr := emailSetError(err); setErr != nil {
+			return nil, setErr, nil
+		}
+
+		return nil, nil, err
+	} else if uids[0] == 0 {
+		return nil, setErrorf("notFound", "unknown email"), nil
+	}
+
+	err = c.account.ExpungeMessages(e.mailbox.Name, []uint32{e.info.UID})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj := map[string]any{
+		"id":       emailId(mailbox.Id, uids[0]),
+		"blobId":   messageBlobId(mailbox.Id, uids[0]),
+		"threadId": threadId(mailbox.Id, uids[0]),
+	}
+
+	return obj, nil, nil
+}
+
+func (c *apiContext) destroyEmail(t *mailboxTable, id string) (*SetError, error) {
+	e, err := c.email(t, id)
+	if err != nil {
+		return nil, err
+	} else if e == nil {
+		return setErrorf("notFound", "unknown email"), nil
+	}
+
+	err = c.account.ExpungeMessages(e.mailbox.Name, []uint32{e.info.UID})
+	if err != nil {
+		if setErr := emailSetError(err); setErr != nil {
+			return setErr, nil
+		}
+
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func emailSetError(err error) *SetError {
+	switch {
+	case errors.Is(err, mailstore.ErrMailboxNotFound),
+		errors.Is(err, mailstore.ErrMessageNotFound):
+		return setErrorf("notFound", "unknown email")
+
+	case errors.Is(err, mailstore.ErrInvalidFlag):
+		return invalidPropertiesf([]string{"keywords"}, "invalid keywords")
+	}
+
+	return nil
+}
+
+type emailImportObject struct {
+	BlobId     string          `json:"blobId"`
+	MailboxIds map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt *time.Time      `json:"receivedAt"`
+}
+
+type emailImportArgs struct {
+	AccountId string                        `json:"accountId"`
+	IfInState *string                       `json:"ifInState"`
+	Emails    map[string]*emailImportObject `json:"emails"`
+}
+
+type emailImportResult struct {
+	AccountId  string               `json:"accountId"`
+	OldState   string               `json:"oldState"`
+	NewState   string               `json:"newState"`
+	Created    map[string]any       `json:"created"`
+	NotCreated map[string]*SetError `json:"notCreated"`
+}
+
+// RFC 8621 4.8. Email/import
+func emailImport(c *apiContext, data json.RawMessage) (any, error) {
+	var args emailImportArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	t := c.mailboxes()
+	state := emailsState(t.infos)
+
+	setArgs := setArgs{AccountId: args.AccountId, IfInState: args.IfInState}
+	if err := setArgs.check(c, state); err != nil {
+		return nil, err
+	}
+
+	if len(args.Emails) > MaxObjectsInSet {
+		return nil, methodErrorf("requestTooLarge", "too many objects")
+	}
+
+	res := emailImportResult{
+		AccountId:  c.accountId,
+		OldState:   state,
+		Created:    make(map[string]any),
+		NotCreated: make(map[string]*SetError),
+	}
+
+	for creationId, importObj := range args.Emails {
+		obj, setErr, err := c.importEmail(t, importObj)
+		if err != nil {
+			return nil, err
+		} else if setErr != nil {
+			res.NotCreated[creationId] = setErr
+			continue
+		}
+
+		c.createdIds[creationId] = obj["id"].(string)
+		res.Created[creationId] = obj
+	}
+
+	res.NewState = emailsState(c.account.Mailboxes())
+
+	return &res, nil
+}
+
+func (c *apiContext) importEmail(t *mailboxTable, obj *emailImportObject) (map[string]any, *SetError, error) {
+	blobId, _ := c.resolveId(obj.BlobId)
+
+	data, _, err := c.Server.blob(c.account, c.accountId, blobId)
+	if err != nil {
+		return nil, nil, err
+	} else if data == nil {
+		return nil, setErrorf("blobNotFound", "unknown blob %q", blobId), nil
+	}
+
+	decoder := imf.NewMessageDecoder()
+	decoder.MixedEOL = true
+
+	if _, err := decoder.DecodeAll(data); err != nil {
+		return nil, setErrorf("invalidEmail", "invalid message: %v", err),
+			nil
+	}
+
+	mailbox, setErr := c.emailMailbox(t, obj.MailboxIds)
+	if setErr != nil {
+		return nil, setErr, nil
+	}
+
+	flags, ok := keywordFlags(obj.Keywords)
+	if !ok {
+		return nil, invalidPropertiesf([]string{"keywords"},
+			"invalid keywords"), nil
+	}
+
+	date := time.Now()
+	if obj.ReceivedAt != nil {
+		date = *obj.ReceivedAt
+	}
+
+	return c.appendEmail(mailbox, data, flags, date)
+}
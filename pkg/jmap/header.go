@@ -0,0 +1,306 @@
+package jmap
+
+import (
+	"bytes"
+	stdmime "mime"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/mime"
+)
+
+// RFC 8621 4.1.2. Header Fields Parsed Forms
+//
+// Structured forms are decoded with the same functions as the fields of the
+// imf package, e.g. header:From:asAddresses uses the decoder of
+// imf.Addresses.
+
+const (
+	headerFormRaw              = "Raw"
+	headerFormText             = "Text"
+	headerFormAddresses        = "Addresses"
+	headerFormGroupedAddresses = "GroupedAddresses"
+	headerFormMessageIds       = "MessageIds"
+	headerFormDate             = "Date"
+	headerFormURLs             = "URLs"
+)
+
+var headerForms = []string{
+	headerFormRaw,
+	headerFormText,
+	headerFormAddresses,
+	headerFormGroupedAddresses,
+	headerFormMessageIds,
+	headerFormDate,
+	headerFormURLs,
+}
+
+// headerProperty is a "header:{name}[:as{form}][:all]" property.
+type headerProperty struct {
+	Name string
+	Form string
+	All  bool
+}
+
+func parseHeaderProperty(s string) (*headerProperty, bool) {
+	s, found := strings.CutPrefix(s, "header:")
+	if !found {
+		return nil, false
+	}
+
+	parts := strings.Split(s, ":")
+	if parts[0] == "" {
+		return nil, false
+	}
+
+	prop := headerProperty{Name: parts[0], Form: headerFormRaw}
+	parts = parts[1:]
+
+	if len(parts) > 0 {
+		if form, found := strings.CutPrefix(parts[0], "as"); found {
+			valid := false
+			for _, form2 := range headerForms {
+				if form == form2 {
+					valid = true
+					break
+				}
+			}
+
+			if !valid {
+				return nil, false
+			}
+
+			prop.Form = form
+			parts = parts[1:]
+		}
+	}
+
+	if len(parts) > 0 {
+		if parts[0] != "all" {
+			return nil, false
+		}
+
+		prop.All = true
+		parts = parts[1:]
+	}
+
+	if len(parts) > 0 {
+		return nil, false
+	}
+
+	return &prop, true
+}
+
+// value returns the value of the last field with the name of the property,
+// or of all fields if the :all suffix is used.
+func (prop *headerProperty) value(fields []mime.HeaderField) any {
+	values := []any{}
+
+	for _, field := range fields {
+		if strings.EqualFold(field.Name, prop.Name) {
+			values = append(values, headerFieldValue(&field, prop.Form))
+		}
+	}
+
+	if prop.All {
+		return values
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	return values[len(values)-1]
+}
+
+func headerFieldValue(field *mime.HeaderField, form string) any {
+	switch form {
+	case headerFormRaw:
+		return rawFieldValue(field)
+
+	case headerFormText:
+		return decodeText(field.Value)
+
+	case headerFormAddresses:
+		addrs := parseAddresses(field.Value)
+		if addrs == nil {
+			return nil
+		}
+
+		return emailAddresses(addrs)
+
+	case headerFormGroupedAddresses:
+		addrs := parseAddresses(field.Value)
+		if addrs == nil {
+			return nil
+		}
+
+		return emailAddressGroups(addrs)
+
+	case headerFormMessageIds:
+		d := imf.NewDataDecoder([]byte(field.Value))
+
+		ids, err := d.ReadMessageIdList(true)
+		if err != nil {
+			return nil
+		}
+
+		values := make([]string, len(ids))
+		for i, id := range ids {
+			values[i] = id.Left + "@" + string(id.Right)
+		}
+
+		return values
+
+	case headerFormDate:
+		d := imf.NewDataDecoder([]byte(field.Value))
+
+		date, err := d.ReadDateTime()
+		if err != nil {
+			return nil
+		}
+
+		return date.Format(time.RFC3339)
+
+	case headerFormURLs:
+		return parseURLs(field.Value)
+	}
+
+	return nil
+}
+
+// rawFieldValue returns the raw value of a field, i.e. everything after the
+// colon without the final line ending.
+func rawFieldValue(field *mime.HeaderField) string {
+	_, value, _ := bytes.Cut(field.Raw, []byte{':'})
+
+	value = bytes.TrimSuffix(value, []byte{'\n'})
+	value = bytes.TrimSuffix(value, []byte{'\r'})
+
+	return string(value)
+}
+
+// decodeText decodes RFC 2047 encoded words; invalid encoded words are kept
+// as they are.
+func decodeText(s string) string {
+	var decoder stdmime.WordDecoder
+
+	if decoded, err := decoder.DecodeHeader(s); err == nil {
+		s = decoded
+	}
+
+	return strings.TrimSpace(strings.ToValidUTF8(s, "�"))
+}
+
+func parseAddresses(s string) imf.Addresses {
+	d := imf.NewDataDecoder([]byte(s))
+
+	addrs, err := d.ReadAddressList(true)
+	if err != nil {
+		return nil
+	}
+
+	return imf.Addresses(addrs)
+}
+
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+type emailAddressGroup struct {
+	Name      *string         `json:"name"`
+	Addresses []*emailAddress `json:"addresses"`
+}
+
+func newEmailAddress(mb *imf.Mailbox) *emailAddress {
+	addr := emailAddress{
+		Email: mb.LocalPart + "@" + string(mb.Domain),
+	}
+
+	if mb.DisplayName != nil {
+		name := decodeText(*mb.DisplayName)
+		addr.Name = &name
+	}
+
+	return &addr
+}
+
+// emailAddresses returns the addresses of a list; group members are
+// included in the list.
+func emailAddresses(addrs imf.Addresses) []*emailAddress {
+	values := []*emailAddress{}
+
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *imf.Mailbox:
+			values = append(values, newEmailAddress(v))
+
+		case *imf.Group:
+			for _, mb := range v.Mailboxes {
+				values = append(values, newEmailAddress(mb))
+			}
+		}
+	}
+
+	return values
+}
+
+// emailAddressGroups returns the groups of a list; consecutive addresses
+// which are not part of a group are returned as a group without name.
+func emailAddressGroups(addrs imf.Addresses) []*emailAddressGroup {
+	groups := []*emailAddressGroup{}
+
+	var lastGroup *emailAddressGroup
+
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *imf.Mailbox:
+			if lastGroup == nil || lastGroup.Name != nil {
+				lastGroup = &emailAddressGroup{Addresses: []*emailAddress{}}
+				groups = append(groups, lastGroup)
+			}
+
+			lastGroup.Addresses = append(lastGroup.Addresses,
+				newEmailAddress(v))
+
+		case *imf.Group:
+			name := decodeText(v.DisplayName)
+
+			lastGroup = &emailAddressGroup{
+				Name:      &name,
+				Addresses: []*emailAddress{},
+			}
+
+			for _, mb := range v.Mailboxes {
+				lastGroup.Addresses = append(lastGroup.Addresses,
+					newEmailAddress(mb))
+			}
+
+			groups = append(groups, lastGroup)
+		}
+	}
+
+	return groups
+}
+
+// parseURLs parses a list of URLs in angle brackets (e.g. List-Unsubscribe,
+// RFC 2369).
+func parseURLs(s string) []string {
+	urls := []string{}
+
+	for _, element := range strings.Split(s, ",") {
+		element = strings.TrimSpace(element)
+
+		start := strings.IndexByte(element, '<')
+		end := strings.LastIndexByte(element, '>')
+		if start == -1 || end < start {
+			continue
+		}
+
+		urls = append(urls, strings.TrimSpace(element[start+1:end]))
+	}
+
+	return urls
+}
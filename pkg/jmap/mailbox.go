@@ -0,0 +1,531 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+// RFC 8621 2. Mailboxes
+//
+// Mailbox names are paths in the store; the parent of a mailbox is the
+// closest existing mailbox whose name is a prefix of its name. Threads only
+// contain a single email, so thread counters are equal to email counters.
+
+var mailboxProperties = []string{
+	"id", "name", "parentId", "role", "sortOrder", "totalEmails",
+	"unreadEmails", "totalThreads", "unreadThreads", "myRights",
+	"isSubscribed",
+}
+
+var mailboxRoles = map[string]string{
+	"archive": mailstore.SpecialUseArchive,
+	"drafts":  mailstore.SpecialUseDrafts,
+	"junk":    mailstore.SpecialUseJunk,
+	"sent":    mailstore.SpecialUseSent,
+	"trash":   mailstore.SpecialUseTrash,
+}
+
+type mailboxTable struct {
+	infos    []*mailstore.MailboxInfo
+	byId     map[uint32]*mailstore.MailboxInfo
+	byName   map[string]*mailstore.MailboxInfo
+	byJMAPId map[string]*mailstore.MailboxInfo
+}
+
+func (c *apiContext) mailboxes() *mailboxTable {
+	infos := c.account.Mailboxes()
+
+	t := mailboxTable{
+		infos:    infos,
+		byId:     make(map[uint32]*mailstore.MailboxInfo),
+		byName:   make(map[string]*mailstore.MailboxInfo),
+		byJMAPId: make(map[string]*mailstore.MailboxInfo),
+	}
+
+	for _, info := range infos {
+		t.byId[info.Id] = info
+		t.byName[info.Name] = info
+		t.byJMAPId[mailboxId(info.Id)] = info
+	}
+
+	return &t
+}
+
+// parent returns the parent of a mailbox (nil for top-level mailboxes) and
+// the name of the mailbox relative to its parent.
+func (t *mailboxTable) parent(name string) (*mailstore.MailboxInfo, string) {
+	sep := mailstore.Separator
+
+	for i := strings.LastIndex(name, sep); i > 0; i = strings.LastIndex(name[:i], sep) {
+		if parent := t.byName[name[:i]]; parent != nil {
+			return parent, name[i+len(sep):]
+		}
+	}
+
+	return nil, name
+}
+
+func (t *mailboxTable) hasChildren(info *mailstore.MailboxInfo) bool {
+	for _, info2 := range t.infos {
+		if strings.HasPrefix(info2.Name, info.Name+mailstore.Separator) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func mailboxRole(info *mailstore.MailboxInfo) any {
+	if info.Name == mailstore.InboxName {
+		return "inbox"
+	}
+
+	for role, specialUse := range mailboxRoles {
+		if info.SpecialUse == specialUse {
+			return role
+		}
+	}
+
+	return nil
+}
+
+func mailboxRights(info *mailstore.MailboxInfo) map[string]bool {
+	isInbox := info.Name == mailstore.InboxName
+
+	return map[string]bool{
+		"mayReadItems":   true,
+		"mayAddItems":    true,
+		"mayRemoveItems": true,
+		"maySetSeen":     true,
+		"maySetKeywords": true,
+		"mayCreateChild": true,
+		"mayRename":      !isInbox,
+		"mayDelete":      !isInbox,
+		"maySubmit":      true,
+	}
+}
+
+func (t *mailboxTable) object(info *mailstore.MailboxInfo) map[string]any {
+	parent, name := t.parent(info.Name)
+
+	var parentId any
+	if parent != nil {
+		parentId = mailboxId(parent.Id)
+	}
+
+	return map[string]any{
+		"id":            mailboxId(info.Id),
+		"name":          name,
+		"parentId":      parentId,
+		"role":          mailboxRole(info),
+		"sortOrder":     0,
+		"totalEmails":   info.NbMessages,
+		"unreadEmails":  info.NbUnseen,
+		"totalThreads":  info.NbMessages,
+		"unreadThreads": info.NbUnseen,
+		"myRights":      mailboxRights(info),
+		"isSubscribed":  true,
+	}
+}
+
+// RFC 8621 2.1. Mailbox/get
+func mailboxGet(c *apiContext, data json.RawMessage) (any, error) {
+	var args getArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	if err := args.check(c, mailboxProperties); err != nil {
+		return nil, err
+	}
+
+	t := c.mailboxes()
+
+	res := getResult{
+		AccountId: c.accountId,
+		State:     mailboxesState(t.infos),
+		List:      []map[string]any{},
+		NotFound:  []string{},
+	}
+
+	if args.Ids == nil {
+		for _, info := range t.infos {
+			res.List = append(res.List,
+				selectProperties(t.object(info), args.Properties))
+		}
+	} else {
+		for _, id := range *args.Ids {
+			info := t.byJMAPId[id]
+			if info == nil {
+				res.NotFound = append(res.NotFound, id)
+				continue
+			}
+
+			res.List = append(res.List,
+				selectProperties(t.object(info), args.Properties))
+		}
+	}
+
+	return &res, nil
+}
+
+// RFC 8621 2.2. Mailbox/changes
+func mailboxChanges(c *apiContext, data json.RawMessage) (any, error) {
+	var args changesArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	if err := args.check(c); err != nil {
+		return nil, err
+	}
+
+	oldStates, err := parseMailboxesState(args.SinceState)
+	if err != nil {
+		return nil, methodErrorf("cannotCalculateChanges", "%v", err)
+	}
+
+	t := c.mailboxes()
+
+	res := changesResult{
+		AccountId: c.accountId,
+		OldState:  args.SinceState,
+		NewState:  mailboxesState(t.infos),
+		Created:   []string{},
+		Updated:   []string{},
+		Destroyed: []string{},
+	}
+
+	for _, info := range t.infos {
+		oldState := oldStates[info.Id]
+
+		if oldState == nil {
+			res.Created = append(res.Created, mailboxId(info.Id))
+		} else if oldState.HighestModSeq != info.HighestModSeq ||
+			oldState.Hash != mailboxHash(info) {
+			res.Updated = append(res.Updated, mailboxId(info.Id))
+		}
+	}
+
+	for id := range oldStates {
+		if t.byId[id] == nil {
+			res.Destroyed = append(res.Destroyed, mailboxId(id))
+		}
+	}
+
+	if err := args.checkNbChanges(&res); err != nil {
+		return nil, err
+	}
+
+	// Mailbox/changes has an additional property (RFC 8621 2.2.)
+	return &struct {
+		*changesResult
+		UpdatedProperties []string `json:"updatedProperties"`
+	}{changesResult: &res}, nil
+}
+
+type mailboxSetArgs struct {
+	setArgs
+
+	OnDestroyRemoveEmails bool `json:"onDestroyRemoveEmails"`
+}
+
+type mailboxObject struct {
+	Name         *string `json:"name"`
+	ParentId     *string `json:"parentId"`
+	Role         *string `json:"role"`
+	SortOrder    *int    `json:"sortOrder"`
+	IsSubscribed *bool   `json:"isSubscribed"`
+}
+
+// RFC 8621 2.5. Mailbox/set
+func mailboxSet(c *apiContext, data json.RawMessage) (any, error) {
+	var args mailboxSetArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	t := c.mailboxes()
+
+	if err := args.check(c, mailboxesState(t.infos)); err != nil {
+		return nil, err
+	}
+
+	res := newSetResult(c.accountId, mailboxesState(t.infos))
+
+	// Mailboxes can be created as children of mailboxes created in the same
+	// call: parents must be created first.
+	creationIds := make([]string, 0, len(args.Create))
+	objs := make(map[string]*mailboxObject)
+
+	for creationId, data := range args.Create {
+		var obj mailboxObject
+		if err := decodeObject(data, &obj); err != nil {
+			res.NotCreated[creationId] = err
+			continue
+		}
+
+		creationIds = append(creationIds, creationId)
+		objs[creationId] = &obj
+	}
+
+	sort.Strings(creationIds)
+
+	for len(creationIds) > 0 {
+		var pendingIds []string
+
+		for _, creationId := range creationIds {
+			obj := objs[creationId]
+
+			if obj.ParentId != nil {
+				parentRef, isRef := strings.CutPrefix(*obj.ParentId, "#")
+				if _, pending := objs[parentRef]; isRef && pending &&
+					c.createdIds[parentRef] == "" &&
+					res.NotCreated[parentRef] == nil {
+					pendingIds = append(pendingIds, creationId)
+					continue
+				}
+			}
+
+			id, setErr, err := c.createMailbox(t, obj)
+			if err != nil {
+				return nil, err
+			} else if setErr != nil {
+				res.NotCreated[creationId] = setErr
+				continue
+			}
+
+			t = c.mailboxes()
+			info := t.byJMAPId[id]
+
+			c.createdIds[creationId] = id
+			res.Created[creationId] = selectProperties(t.object(info),
+				&[]string{"role", "sortOrder", "totalEmails", "unreadEmails",
+					"totalThreads", "unreadThreads", "myRights",
+					"isSubscribed"})
+		}
+
+		if len(pendingIds) == len(creationIds) {
+			// Circular references
+			for _, creationId := range pendingIds {
+				res.NotCreated[creationId] = invalidPropertiesf(
+					[]string{"parentId"}, "invalid parent mailbox")
+			}
+
+			break
+		}
+
+		creationIds = pendingIds
+	}
+
+	for id, patch := range args.Update {
+		setErr, err := c.updateMailbox(t, id, patch)
+		if err != nil {
+			return nil, err
+		} else if setErr != nil {
+			res.NotUpdated[id] = setErr
+			continue
+		}
+
+		t = c.mailboxes()
+		res.Updated[id] = nil
+	}
+
+	res.Destroyed = []string{}
+
+	for _, id := range args.Destroy {
+		setErr, err := c.destroyMailbox(t, id, args.OnDestroyRemoveEmails)
+		if err != nil {
+			return nil, err
+		} else if setErr != nil {
+			res.NotDestroyed[id] = setErr
+			continue
+		}
+
+		t = c.mailboxes()
+		res.Destroyed = append(res.Destroyed, id)
+	}
+
+	res.NewState = mailboxesState(t.infos)
+
+	return res, nil
+}
+
+// mailboxName returns the full name of a mailbox from its name relative to
+// its parent.
+func (c *apiContext) mailboxName(t *mailboxTable, name string, parentId *string) (string, *SetError) {
+	if name == "" || strings.Contains(name, mailstore.Separator) {
+		return "", invalidPropertiesf([]string{"name"}, "invalid name")
+	}
+
+	if parentId == nil {
+		return name, nil
+	}
+
+	id, found := c.resolveId(*parentId)
+	if !found || t.byJMAPId[id] == nil {
+		return "", invalidPropertiesf([]string{"parentId"},
+			"unknown parent mailbox")
+	}
+
+	return t.byJMAPId[id].Name + mailstore.Separator + name, nil
+}
+
+func (c *apiContext) createMailbox(t *mailboxTable, obj *mailboxObject) (string, *SetError, error) {
+	if obj.Name == nil {
+		return "", invalidPropertiesf([]string{"name"}, "missing name"), nil
+	}
+
+	if obj.SortOrder != nil && *obj.SortOrder != 0 {
+		return "", invalidPropertiesf([]string{"sortOrder"},
+			"sort orders are not supported"), nil
+	}
+
+	name, setErr := c.mailboxName(t, *obj.Name, obj.ParentId)
+	if setErr != nil {
+		return "", setErr, nil
+	}
+
+	var err error
+
+	if obj.Role != nil {
+		specialUse, found := mailboxRoles[*obj.Role]
+		if !found {
+			return "", invalidPropertiesf([]string{"role"},
+				"invalid role %q", *obj.Role), nil
+		}
+
+		err = c.account.CreateSpecialUseMailbox(name, specialUse)
+	} else {
+		err = c.account.CreateMailbox(name)
+	}
+
+	if err != nil {
+		if setErr := mailboxSetError(err); setErr != nil {
+			return "", setErr, nil
+		}
+
+		return "", nil, err
+	}
+
+	info, err := c.account.Mailbox(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return mailboxId(info.Id), nil, nil
+}
+
+func (c *apiContext) updateMailbox(t *mailboxTable, id string, patch map[string]json.RawMessage) (*SetError, error) {
+	info := t.byJMAPId[id]
+	if info == nil {
+		return setErrorf("notFound", "unknown mailbox"), nil
+	}
+
+	var obj mailboxObject
+	data, _ := json.Marshal(patch)
+	if err := decodeObject(data, &obj); err != nil {
+		return err, nil
+	}
+
+	// Properties which cannot be modified are accepted if their value does
+	// not change.
+	current := t.object(info)
+
+	if obj.Role != nil && *obj.Role != current["role"] {
+		return invalidPropertiesf([]string{"role"},
+			"roles cannot be modified"), nil
+	}
+
+	if obj.SortOrder != nil && *obj.SortOrder != 0 {
+		return invalidPropertiesf([]string{"sortOrder"},
+			"sort orders are not supported"), nil
+	}
+
+	if obj.Name == nil && obj.ParentId == nil {
+		if _, found := patch["parentId"]; !found {
+			return nil, nil
+		}
+	}
+
+	name, _ := current["name"].(string)
+	if obj.Name != nil {
+		name = *obj.Name
+	}
+
+	parentId, _ := current["parentId"].(string)
+	parentIdRef := &parentId
+	if parentId == "" {
+		parentIdRef = nil
+	}
+
+	if _, found := patch["parentId"]; found {
+		parentIdRef = obj.ParentId
+	}
+
+	newName, setErr := c.mailboxName(t, name, parentIdRef)
+	if setErr != nil {
+		return setErr, nil
+	}
+
+	if newName == info.Name {
+		return nil, nil
+	}
+
+	if err := c.account.RenameMailbox(info.Name, newName); err != nil {
+		if setErr := mailboxSetError(err); setErr != nil {
+			return setErr, nil
+		}
+
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (c *apiContext) destroyMailbox(t *mailboxTable, id string, removeEmails bool) (*SetError, error) {
+	info := t.byJMAPId[id]
+	if info == nil {
+		return setErrorf("notFound", "unknown mailbox"), nil
+	}
+
+	if t.hasChildren(info) {
+		return setErrorf("mailboxHasChild", "mailbox has child mailboxes"), nil
+	}
+
+	if info.NbMessages > 0 && !removeEmails {
+		return setErrorf("mailboxHasEmail", "mailbox is not empty"), nil
+	}
+
+	if err := c.account.DeleteMailbox(info.Name); err != nil {
+		if setErr := mailboxSetError(err); setErr != nil {
+			return setErr, nil
+		}
+
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func mailboxSetError(err error) *SetError {
+	switch {
+	case errors.Is(err, mailstore.ErrMailboxNotFound):
+		return setErrorf("notFound", "unknown mailbox")
+
+	case errors.Is(err, mailstore.ErrMailboxExists):
+		return invalidPropertiesf([]string{"name"}, "mailbox already exists")
+
+	case errors.Is(err, mailstore.ErrInvalidMailboxName):
+		return invalidPropertiesf([]string{"name"}, "invalid name")
+
+	case errors.Is(err, mailstore.ErrInboxOperation):
+		return setErrorf("forbidden", "operation not allowed on the inbox")
+	}
+
+	return nil
+}
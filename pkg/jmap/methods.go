@@ -0,0 +1,175 @@
+package jmap
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+)
+
+// RFC 8620 5. Standard Methods and Naming Convention
+
+type getArgs struct {
+	AccountId  string    `json:"accountId"`
+	Ids        *[]string `json:"ids"` // all objects if null
+	Properties *[]string `json:"properties"`
+}
+
+type getResult struct {
+	AccountId string           `json:"accountId"`
+	State     string           `json:"state"`
+	List      []map[string]any `json:"list"`
+	NotFound  []string         `json:"notFound"`
+}
+
+type changesArgs struct {
+	AccountId  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+type changesResult struct {
+	AccountId      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+type setArgs struct {
+	AccountId string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+type setResult struct {
+	AccountId    string               `json:"accountId"`
+	OldState     string               `json:"oldState"`
+	NewState     string               `json:"newState"`
+	Created      map[string]any       `json:"created"`
+	Updated      map[string]any       `json:"updated"`
+	Destroyed    []string             `json:"destroyed"`
+	NotCreated   map[string]*SetError `json:"notCreated"`
+	NotUpdated   map[string]*SetError `json:"notUpdated"`
+	NotDestroyed map[string]*SetError `json:"notDestroyed"`
+}
+
+func (args *getArgs) check(c *apiContext, properties []string) error {
+	if err := c.checkAccountId(args.AccountId); err != nil {
+		return err
+	}
+
+	if args.Ids != nil {
+		if len(*args.Ids) > MaxObjectsInGet {
+			return methodErrorf("requestTooLarge", "too many objects")
+		}
+
+		for i, id := range *args.Ids {
+			resolvedId, found := c.resolveId(id)
+			if !found {
+				return invalidArgumentsf("unknown creation id %q", id)
+			}
+
+			(*args.Ids)[i] = resolvedId
+		}
+	}
+
+	if args.Properties != nil {
+		for _, property := range *args.Properties {
+			if !slices.Contains(properties, property) {
+				return invalidArgumentsf("unknown property %q", property)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (args *changesArgs) check(c *apiContext) error {
+	if err := c.checkAccountId(args.AccountId); err != nil {
+		return err
+	}
+
+	if args.MaxChanges != nil && *args.MaxChanges <= 0 {
+		return invalidArgumentsf("invalid maxChanges value")
+	}
+
+	return nil
+}
+
+// checkNbChanges fails if there are more changes than requested: states do
+// not allow intermediate states to be returned.
+func (args *changesArgs) checkNbChanges(res *changesResult) error {
+	n := len(res.Created) + len(res.Updated) + len(res.Destroyed)
+
+	if args.MaxChanges != nil && n > *args.MaxChanges {
+		return methodErrorf("cannotCalculateChanges",
+			"too many changes since state %q", args.SinceState)
+	}
+
+	sort.Strings(res.Created)
+	sort.Strings(res.Updated)
+	sort.Strings(res.Destroyed)
+
+	return nil
+}
+
+func (args *setArgs) check(c *apiContext, state string) error {
+	if err := c.checkAccountId(args.AccountId); err != nil {
+		return err
+	}
+
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > MaxObjectsInSet {
+		return methodErrorf("requestTooLarge", "too many objects")
+	}
+
+	if args.IfInState != nil && *args.IfInState != state {
+		return methodErrorf("stateMismatch", "current state is %q", state)
+	}
+
+	return nil
+}
+
+func newSetResult(accountId, state string) *setResult {
+	return &setResult{
+		AccountId: accountId,
+		OldState:  state,
+
+		Created:      make(map[string]any),
+		Updated:      make(map[string]any),
+		NotCreated:   make(map[string]*SetError),
+		NotUpdated:   make(map[string]*SetError),
+		NotDestroyed: make(map[string]*SetError),
+	}
+}
+
+// selectProperties returns an object only containing a list of properties;
+// the identifier is always included.
+func selectProperties(obj map[string]any, properties *[]string) map[string]any {
+	if properties == nil {
+		return obj
+	}
+
+	obj2 := map[string]any{"id": obj["id"]}
+
+	for _, property := range *properties {
+		if value, found := obj[property]; found {
+			obj2[property] = value
+		}
+	}
+
+	return obj2
+}
+
+// decodeObject decodes an object sent in a /set method; unknown properties
+// are rejected.
+func decodeObject(data json.RawMessage, obj any) *SetError {
+	if err := decodeArguments(data, obj); err != nil {
+		return invalidPropertiesf(nil, "%v", err.(*MethodError).Description)
+	}
+
+	return nil
+}
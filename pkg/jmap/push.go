@@ -0,0 +1,178 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+// RFC 8620 7.3. Event Source
+
+const MinPingInterval = 10 * time.Second
+
+var pushTypes = []string{"Mailbox", "Email", "Thread"}
+
+type stateChange struct {
+	Type    string                       `json:"@type"`
+	Changed map[string]map[string]string `json:"changed"`
+}
+
+func (s *Server) hEventSource(w http.ResponseWriter, r *http.Request) {
+	username := s.authenticate(w, r)
+	if username == "" {
+		return
+	}
+
+	query := r.URL.Query()
+
+	types := pushTypes
+	if value := query.Get("types"); value != "" && value != "*" {
+		types = strings.Split(value, ",")
+	}
+
+	closeAfterState := false
+	switch value := query.Get("closeafter"); value {
+	case "", "no":
+	case "state":
+		closeAfterState = true
+	default:
+		s.replyError(w, http.StatusBadRequest, "invalid closeafter value")
+		return
+	}
+
+	var pingInterval time.Duration
+	if value := query.Get("ping"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			s.replyError(w, http.StatusBadRequest, "invalid ping value")
+			return
+		}
+
+		if seconds > 0 {
+			pingInterval = max(time.Duration(seconds)*time.Second,
+				MinPingInterval)
+		}
+	}
+
+	account, err := s.Cfg.Store.Account(username)
+	if err != nil {
+		s.Log.Error("cannot open account %q: %v", username, err)
+		s.replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	watcher, unwatch := account.Watch()
+	defer unwatch()
+
+	rc := http.NewResponseController(w)
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var pingChan <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+
+		pingChan = ticker.C
+	}
+
+	id := accountId(username)
+
+	sendEvent := func(name string, value any) bool {
+		data, err := json.Marshal(value)
+		if err != nil {
+			s.Log.Error("cannot encode %s event: %v", name, err)
+			return false
+		}
+
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name,
+			data); err != nil {
+			return false
+		}
+
+		return rc.Flush() == nil
+	}
+
+	// The current state is sent when the connection is established so that
+	// clients can detect changes which happened before.
+	states := accountStates(account, types)
+
+	if !sendEvent("state", &stateChange{
+		Type:    "StateChange",
+		Changed: map[string]map[string]string{id: states},
+	}) {
+		return
+	}
+
+	for {
+		select {
+		case <-watcher:
+			newStates := accountStates(account, types)
+			if maps.Equal(states, newStates) {
+				continue
+			}
+
+			changed := make(map[string]string)
+			for name, state := range newStates {
+				if states[name] != state {
+					changed[name] = state
+				}
+			}
+
+			states = newStates
+
+			if !sendEvent("state", &stateChange{
+				Type:    "StateChange",
+				Changed: map[string]map[string]string{id: changed},
+			}) {
+				return
+			}
+
+			if closeAfterState {
+				return
+			}
+
+		case <-pingChan:
+			interval := int(pingInterval / time.Second)
+			if !sendEvent("ping", map[string]int{"interval": interval}) {
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func accountStates(account *mailstore.Account, types []string) map[string]string {
+	infos := account.Mailboxes()
+
+	states := make(map[string]string)
+
+	if slices.Contains(types, "Mailbox") {
+		states["Mailbox"] = mailboxesState(infos)
+	}
+
+	if slices.Contains(types, "Email") {
+		states["Email"] = emailsState(infos)
+	}
+
+	if slices.Contains(types, "Thread") {
+		states["Thread"] = emailsState(infos)
+	}
+
+	return states
+}
@@ -0,0 +1,355 @@
+package jmap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-ejson"
+	"github.com/galdor/go-log"
+)
+
+// RFC 8620 The JSON Meta Application Protocol (JMAP)
+// RFC 8621 The JSON Meta Application Protocol (JMAP) for Mail
+
+const (
+	DefaultPort    = 80
+	DefaultTLSPort = 443
+
+	DefaultMaxRequestSize = 10_000_000
+	DefaultMaxUploadSize  = 50_000_000
+
+	MaxCallsInRequest = 16
+	MaxObjectsInGet   = 500
+	MaxObjectsInSet   = 500
+
+	// RFC 8620 6.1. Uploaded blobs must be kept for at least one hour
+	UploadedBlobLifetime = time.Hour
+)
+
+// Submission is a message sent with EmailSubmission/set.
+type Submission struct {
+	Identity     string               // the authenticated user
+	ReversePath  *imf.SpecificAddress // nil for the null reverse-path
+	ForwardPaths []imf.SpecificAddress
+
+	Message *imf.Message
+}
+
+// SubmissionHandler is called for each message sent by a client. Returning an
+// error causes the submission to fail.
+type SubmissionHandler func(*Submission) error
+
+type ServerCfg struct {
+	Log           *log.Logger        `json:"-"`
+	Authenticator sasl.Authenticator `json:"-"`
+	Store         *mailstore.Store   `json:"-"`
+
+	// EmailSubmission/set is not available if no handler is set
+	SubmissionHandler SubmissionHandler `json:"-"`
+
+	// The TLS configuration used by listeners, loaded from TLS if not set
+	TLSConfig *tls.Config `json:"-"`
+
+	Host string `json:"host"`
+	Port int    `json:"port,omitempty"`
+
+	TLS *utils.TLSCfg `json:"tls,omitempty"`
+
+	// The URL of the server as seen by clients (e.g. behind a reverse
+	// proxy), used to build the URLs of the session resource. The default
+	// is derived from each request.
+	BaseURL string `json:"base_url,omitempty"`
+
+	MaxRequestSize int `json:"max_request_size,omitempty"`
+	MaxUploadSize  int `json:"max_upload_size,omitempty"`
+
+	// Basic authentication transmits passwords in clear text and is
+	// therefore only allowed on TLS connections unless this option is set
+	// (e.g. when TLS is handled by a reverse proxy).
+	AllowInsecureAuthentication bool `json:"allow_insecure_authentication,omitempty"`
+}
+
+func (cfg *ServerCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("host", cfg.Host)
+
+	if cfg.Port != 0 {
+		v.CheckIntMinMax("port", cfg.Port, 1, 65535)
+	}
+
+	v.CheckOptionalObject("tls", cfg.TLS)
+
+	if cfg.BaseURL != "" {
+		v.Check("base_url", strings.HasPrefix(cfg.BaseURL, "http://") ||
+			strings.HasPrefix(cfg.BaseURL, "https://"), "invalid_url",
+			"base URL must be an absolute HTTP URL")
+	}
+
+	v.CheckIntMin("max_request_size", cfg.MaxRequestSize, 0)
+	v.CheckIntMin("max_upload_size", cfg.MaxUploadSize, 0)
+}
+
+type Server struct {
+	Cfg ServerCfg
+	Log *log.Logger
+
+	listeners  []net.Listener
+	httpServer *http.Server
+	mux        *http.ServeMux
+
+	uploadedBlobs      map[string]*uploadedBlob
+	uploadedBlobsMutex sync.Mutex
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewServer(cfg ServerCfg) (*Server, error) {
+	if cfg.TLSConfig == nil && cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.ServerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.TLSConfig = tlsCfg
+	}
+
+	if cfg.Port == 0 {
+		if cfg.TLSConfig != nil {
+			cfg.Port = DefaultTLSPort
+		} else {
+			cfg.Port = DefaultPort
+		}
+	}
+
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+
+	if cfg.MaxRequestSize == 0 {
+		cfg.MaxRequestSize = DefaultMaxRequestSize
+	}
+
+	if cfg.MaxUploadSize == 0 {
+		cfg.MaxUploadSize = DefaultMaxUploadSize
+	}
+
+	s := Server{
+		Cfg: cfg,
+		Log: cfg.Log,
+
+		uploadedBlobs: make(map[string]*uploadedBlob),
+
+		stopChan: make(chan struct{}),
+	}
+
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET /.well-known/jmap", s.hSession)
+	s.mux.HandleFunc("POST /jmap/api", s.hAPI)
+	s.mux.HandleFunc("POST /jmap/upload/{accountId}", s.hUpload)
+	s.mux.HandleFunc("GET /jmap/download/{accountId}/{blobId}/{name}",
+		s.hDownload)
+	s.mux.HandleFunc("GET /jmap/eventsource", s.hEventSource)
+
+	s.httpServer = &http.Server{
+		Handler:           &s,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          s.Log.StdLogger(log.LevelError),
+	}
+
+	return &s, nil
+}
+
+func (s *Server) Start() error {
+	addrs, err := s.resolveHost()
+	if err != nil {
+		return err
+	}
+
+	addrTable := make(map[string]struct{})
+	for _, addr := range addrs {
+		addrTable[addr] = struct{}{}
+	}
+
+	port := strconv.Itoa(s.Cfg.Port)
+
+	for addr := range addrTable {
+		listener, err := net.Listen("tcp", net.JoinHostPort(addr, port))
+		if err != nil {
+			return fmt.Errorf("cannot listen on %q: %w", addr, err)
+		}
+
+		s.Log.Info("listening on %q", addr)
+
+		s.listeners = append(s.listeners, listener)
+
+		if s.Cfg.TLSConfig != nil {
+			listener = tls.NewListener(listener, s.Cfg.TLSConfig)
+		}
+
+		s.wg.Add(1)
+		go s.serve(listener)
+	}
+
+	return nil
+}
+
+func (s *Server) resolveHost() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var resolver net.Resolver
+
+	addrs, err := resolver.LookupHost(ctx, s.Cfg.Host)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve host: %w", err)
+	}
+
+	return addrs, nil
+}
+
+func (s *Server) Stop() {
+	// Event streams are closed as soon as the stop channel is closed
+	close(s.stopChan)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.Log.Error("cannot shutdown http server: %v", err)
+		s.httpServer.Close()
+	}
+
+	s.wg.Wait()
+}
+
+func (s *Server) serve(listener net.Listener) {
+	defer s.wg.Done()
+
+	err := s.httpServer.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.Log.Error("cannot serve http connections: %v", err)
+	}
+}
+
+// ServeHTTP handles all JMAP requests; the server can therefore be used with
+// any HTTP server, e.g. net/http/httptest.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(err)
+			}
+
+			msg := utils.RecoverValueString(v)
+			trace := utils.StackTrace(0, 20, true)
+
+			s.Log.Error("panic: %s\n%s", msg, trace)
+
+			s.replyError(w, http.StatusInternalServerError, "internal error")
+		}
+	}()
+
+	s.Log.Debug(1, "%s %s", r.Method, r.URL.Path)
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// authenticate checks the credentials of a request with HTTP basic
+// authentication (RFC 7617) and returns the name of the user. If
+// authentication fails, an error response is sent and the user name is
+// empty.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) string {
+	if r.TLS == nil && !s.Cfg.AllowInsecureAuthentication {
+		s.replyError(w, http.StatusForbidden,
+			"authentication requires a TLS connection")
+		return ""
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jmap", charset="UTF-8"`)
+		s.replyError(w, http.StatusUnauthorized, "missing credentials")
+		return ""
+	}
+
+	if err := s.Cfg.Authenticator.Authenticate(username, password); err != nil {
+		if !errors.Is(err, sasl.ErrAuthenticationFailed) {
+			s.Log.Error("authentication error: %v", err)
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="jmap", charset="UTF-8"`)
+		s.replyError(w, http.StatusUnauthorized, "authentication failed")
+		return ""
+	}
+
+	return username
+}
+
+// accountId returns the identifier of the account of a user. Each user only
+// has access to its own account.
+func accountId(username string) string {
+	return "a" + base64.RawURLEncoding.EncodeToString([]byte(username))
+}
+
+func (s *Server) baseURL(r *http.Request) string {
+	if s.Cfg.BaseURL != "" {
+		return s.Cfg.BaseURL
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+}
+
+func (s *Server) replyJSON(w http.ResponseWriter, status int, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		s.Log.Error("cannot encode response: %v", err)
+		s.replyError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// RFC 8620 3.6.1. Request-level errors are problem details objects (RFC
+// 7807).
+type problem struct {
+	Type   string `json:"type,omitempty"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Limit  string `json:"limit,omitempty"`
+}
+
+func (s *Server) replyError(w http.ResponseWriter, status int, format string, args ...any) {
+	s.replyProblem(w, &problem{
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+func (s *Server) replyProblem(w http.ResponseWriter, p *problem) {
+	data, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(data)
+}
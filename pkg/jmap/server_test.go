@@ -0,0 +1,514 @@
+package jmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/go-log"
+)
+
+const testMessage = "From: Alice <alice@example.org>\r\n" +
+	"To: Bob <bob@example.com>\r\n" +
+	"Subject: Meeting\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"Message-ID: <1@example.org>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello Bob.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"agenda.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0=\r\n" +
+	"--b1--\r\n"
+
+type testClient struct {
+	t          *testing.T
+	httpServer *httptest.Server
+	server     *Server
+	accountId  string
+
+	submissions []*Submission
+}
+
+func newTestClient(t *testing.T) *testClient {
+	hash, err := sasl.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	c := testClient{
+		t:         t,
+		accountId: accountId("bob"),
+	}
+
+	store := mailstore.NewStore(mailstore.Cfg{
+		Log:  log.DefaultLogger("test"),
+		Path: t.TempDir(),
+	})
+
+	cfg := ServerCfg{
+		Log:           log.DefaultLogger("test"),
+		Authenticator: sasl.PasswordTable{"bob": hash},
+		Store:         store,
+		SubmissionHandler: func(s *Submission) error {
+			c.submissions = append(c.submissions, s)
+			return nil
+		},
+		Host:                        "127.0.0.1",
+		AllowInsecureAuthentication: true,
+	}
+
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("cannot create server: %v", err)
+	}
+
+	c.server = server
+	c.httpServer = httptest.NewServer(server)
+
+	t.Cleanup(func() {
+		c.httpServer.Close()
+		store.Close()
+	})
+
+	return &c
+}
+
+func (c *testClient) request(method, path string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, c.httpServer.URL+path,
+		bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("cannot create request: %v", err)
+	}
+
+	req.SetBasicAuth("bob", "secret")
+
+	res, err := c.httpServer.Client().Do(req)
+	if err != nil {
+		c.t.Fatalf("cannot send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatalf("cannot read response: %v", err)
+	}
+
+	return res.StatusCode, data
+}
+
+// call sends method calls and returns the arguments of the responses. Method
+// calls are [name, arguments] pairs; call ids are "c0", "c1", etc.
+func (c *testClient) call(calls ...[]any) []map[string]any {
+	req := map[string]any{
+		"using": []string{CapabilityCore, CapabilityMail,
+			CapabilitySubmission},
+		"methodCalls": [][]any{},
+	}
+
+	for i, call := range calls {
+		req["methodCalls"] = append(req["methodCalls"].([][]any),
+			[]any{call[0], call[1], "c" + string(rune('0'+i))})
+	}
+
+	body, _ := json.Marshal(req)
+
+	status, data := c.request("POST", "/jmap/api", body)
+	if status != http.StatusOK {
+		c.t.Fatalf("request failed with status %d: %s", status, data)
+	}
+
+	var res struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+
+	if err := json.Unmarshal(data, &res); err != nil {
+		c.t.Fatalf("cannot decode response: %v", err)
+	}
+
+	var results []map[string]any
+
+	for _, methodRes := range res.MethodResponses {
+		var name string
+		var args map[string]any
+
+		json.Unmarshal(methodRes[0], &name)
+		json.Unmarshal(methodRes[1], &args)
+
+		if name == "error" {
+			c.t.Fatalf("method error: %s", methodRes[1])
+		}
+
+		results = append(results, args)
+	}
+
+	return results
+}
+
+func (c *testClient) upload(data string) string {
+	status, resData := c.request("POST", "/jmap/upload/"+c.accountId,
+		[]byte(data))
+	if status != http.StatusCreated {
+		c.t.Fatalf("upload failed with status %d: %s", status, resData)
+	}
+
+	var res map[string]any
+	json.Unmarshal(resData, &res)
+
+	return res["blobId"].(string)
+}
+
+func (c *testClient) inboxId() string {
+	res := c.call([]any{"Mailbox/get", map[string]any{
+		"accountId": c.accountId,
+	}})
+
+	for _, obj := range res[0]["list"].([]any) {
+		mailbox := obj.(map[string]any)
+		if mailbox["role"] == "inbox" {
+			return mailbox["id"].(string)
+		}
+	}
+
+	c.t.Fatalf("inbox not found")
+	return ""
+}
+
+func TestServerSession(t *testing.T) {
+	c := newTestClient(t)
+
+	status, data := c.request("GET", "/.well-known/jmap", nil)
+	if status != http.StatusOK {
+		t.Fatalf("session request failed with status %d", status)
+	}
+
+	var session map[string]any
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatalf("cannot decode session: %v", err)
+	}
+
+	if session["username"] != "bob" {
+		t.Errorf("unexpected username %v", session["username"])
+	}
+
+	accounts := session["accounts"].(map[string]any)
+	if _, found := accounts[c.accountId]; !found {
+		t.Errorf("missing account %q", c.accountId)
+	}
+
+	// Authentication is required
+	res, err := http.Get(c.httpServer.URL + "/.well-known/jmap")
+	if err != nil {
+		t.Fatalf("cannot send request: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unexpected status %d without credentials", res.StatusCode)
+	}
+}
+
+func TestServerEmails(t *testing.T) {
+	c := newTestClient(t)
+
+	inboxId := c.inboxId()
+
+	// Import
+	blobId := c.upload(testMessage)
+
+	res := c.call([]any{"Email/import", map[string]any{
+		"accountId": c.accountId,
+		"emails": map[string]any{
+			"m1": map[string]any{
+				"blobId":     blobId,
+				"mailboxIds": map[string]bool{inboxId: true},
+				"keywords":   map[string]bool{"$flagged": true},
+			},
+		},
+	}})
+
+	created := res[0]["created"].(map[string]any)
+	if len(created) != 1 {
+		t.Fatalf("email not imported: %v", res[0]["notCreated"])
+	}
+
+	emailState := res[0]["newState"].(string)
+
+	// Query and get
+	res = c.call(
+		[]any{"Email/query", map[string]any{
+			"accountId": c.accountId,
+			"filter":    map[string]any{"inMailbox": inboxId, "from": "alice"},
+		}},
+		[]any{"Email/get", map[string]any{
+			"accountId": c.accountId,
+			"#ids": map[string]any{
+				"resultOf": "c0",
+				"name":     "Email/query",
+				"path":     "/ids",
+			},
+			"fetchTextBodyValues": true,
+		}})
+
+	ids := res[0]["ids"].([]any)
+	if len(ids) != 1 {
+		t.Fatalf("unexpected query result %v", ids)
+	}
+
+	emailId := ids[0].(string)
+
+	email := res[1]["list"].([]any)[0].(map[string]any)
+
+	if subject := email["subject"]; subject != "Meeting" {
+		t.Errorf("unexpected subject %v", subject)
+	}
+
+	from := email["from"].([]any)[0].(map[string]any)
+	if from["email"] != "alice@example.org" || from["name"] != "Alice" {
+		t.Errorf("unexpected from address %v", from)
+	}
+
+	if !email["keywords"].(map[string]any)["$flagged"].(bool) {
+		t.Errorf("missing $flagged keyword")
+	}
+
+	if email["hasAttachment"] != true {
+		t.Errorf("attachment not detected")
+	}
+
+	textPart := email["textBody"].([]any)[0].(map[string]any)
+	values := email["bodyValues"].(map[string]any)
+	value := values[textPart["partId"].(string)].(map[string]any)
+
+	if text := value["value"]; text != "Hello Bob." {
+		t.Errorf("unexpected body value %q", text)
+	}
+
+	// Attachment download
+	attachment := email["attachments"].([]any)[0].(map[string]any)
+
+	status, data := c.request("GET", "/jmap/download/"+c.accountId+"/"+
+		attachment["blobId"].(string)+"/agenda.pdf", nil)
+	if status != http.StatusOK {
+		t.Fatalf("download failed with status %d", status)
+	}
+
+	if string(data) != "%PDF-" {
+		t.Errorf("unexpected attachment content %q", data)
+	}
+
+	// Update and changes
+	res = c.call(
+		[]any{"Email/set", map[string]any{
+			"accountId": c.accountId,
+			"update": map[string]any{
+				emailId: map[string]any{"keywords/$seen": true},
+			},
+		}},
+		[]any{"Email/changes", map[string]any{
+			"accountId":  c.accountId,
+			"sinceState": emailState,
+		}})
+
+	if _, found := res[0]["updated"].(map[string]any)[emailId]; !found {
+		t.Fatalf("email not updated: %v", res[0]["notUpdated"])
+	}
+
+	updated := res[1]["updated"].([]any)
+	if len(updated) != 1 || updated[0] != emailId {
+		t.Errorf("unexpected changes %v", res[1])
+	}
+
+	// Destroy
+	res = c.call([]any{"Email/set", map[string]any{
+		"accountId": c.accountId,
+		"destroy":   []string{emailId},
+	}})
+
+	if destroyed := res[0]["destroyed"].([]any); len(destroyed) != 1 {
+		t.Errorf("email not destroyed: %v", res[0]["notDestroyed"])
+	}
+}
+
+func TestServerSubmission(t *testing.T) {
+	c := newTestClient(t)
+
+	res := c.call([]any{"Mailbox/set", map[string]any{
+		"accountId": c.accountId,
+		"create": map[string]any{
+			"mb1": map[string]any{"name": "Drafts", "role": "drafts"},
+			"mb2": map[string]any{"name": "Sent", "role": "sent"},
+		},
+	}})
+
+	mailboxes := res[0]["created"].(map[string]any)
+	draftsId := mailboxes["mb1"].(map[string]any)["id"].(string)
+	sentId := mailboxes["mb2"].(map[string]any)["id"].(string)
+
+	res = c.call(
+		[]any{"Email/set", map[string]any{
+			"accountId": c.accountId,
+			"create": map[string]any{
+				"e1": map[string]any{
+					"mailboxIds": map[string]bool{draftsId: true},
+					"keywords":   map[string]bool{"$draft": true},
+					"from": []any{map[string]any{
+						"name": "Bob", "email": "bob@example.com"}},
+					"to": []any{map[string]any{
+						"email": "alice@example.org"}},
+					"bcc": []any{map[string]any{
+						"email": "eve@example.net"}},
+					"subject": "Café",
+					"textBody": []any{map[string]any{
+						"partId": "1", "type": "text/plain"}},
+					"bodyValues": map[string]any{
+						"1": map[string]any{"value": "Hi Alice."}},
+				},
+			},
+		}},
+		[]any{"EmailSubmission/set", map[string]any{
+			"accountId": c.accountId,
+			"create": map[string]any{
+				"s1": map[string]any{
+					"identityId": defaultIdentityId,
+					"emailId":    "#e1",
+				},
+			},
+			"onSuccessUpdateEmail": map[string]any{
+				"#s1": map[string]any{
+					"mailboxIds":      map[string]bool{sentId: true},
+					"keywords/$draft": nil,
+				},
+			},
+		}})
+
+	if len(res) != 3 {
+		t.Fatalf("unexpected number of responses %d", len(res))
+	}
+
+	if created := res[1]["created"].(map[string]any); len(created) != 1 {
+		t.Fatalf("email not submitted: %v", res[1]["notCreated"])
+	}
+
+	if updated := res[2]["updated"].(map[string]any); len(updated) != 1 {
+		t.Fatalf("email not updated: %v", res[2]["notUpdated"])
+	}
+
+	if len(c.submissions) != 1 {
+		t.Fatalf("unexpected number of submissions %d", len(c.submissions))
+	}
+
+	s := c.submissions[0]
+
+	if s.ReversePath == nil || s.ReversePath.String() != "bob@example.com" {
+		t.Errorf("unexpected reverse path %v", s.ReversePath)
+	}
+
+	var recipients []string
+	for _, forwardPath := range s.ForwardPaths {
+		recipients = append(recipients, forwardPath.String())
+	}
+
+	if strings.Join(recipients, ",") != "alice@example.org,eve@example.net" {
+		t.Errorf("unexpected recipients %v", recipients)
+	}
+
+	for _, field := range s.Message.Header {
+		if strings.EqualFold(field.Name, "Bcc") {
+			t.Errorf("bcc field not removed")
+		}
+	}
+
+	data, err := imf.NewMessageEncoder(s.Message).Encode()
+	if err != nil {
+		t.Fatalf("cannot encode message: %v", err)
+	}
+
+	if !bytes.Contains(data, []byte("=?utf-8?q?Caf=C3=A9?=")) {
+		t.Errorf("subject not encoded:\n%s", data)
+	}
+
+	// The draft was moved to the sent mailbox
+	res = c.call([]any{"Email/query", map[string]any{
+		"accountId": c.accountId,
+		"filter":    map[string]any{"inMailbox": sentId},
+	}})
+
+	if ids := res[0]["ids"].([]any); len(ids) != 1 {
+		t.Errorf("email not moved to the sent mailbox")
+	}
+}
+
+func TestServerEventSource(t *testing.T) {
+	c := newTestClient(t)
+
+	c.inboxId() // make sure the account exists
+
+	req, err := http.NewRequest("GET", c.httpServer.URL+
+		"/jmap/eventsource?types=Mailbox&closeafter=state&ping=0", nil)
+	if err != nil {
+		t.Fatalf("cannot create request: %v", err)
+	}
+
+	req.SetBasicAuth("bob", "secret")
+
+	res, err := c.httpServer.Client().Do(req)
+	if err != nil {
+		t.Fatalf("cannot send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	rbuf := bufio.NewReader(res.Body)
+
+	readEvent := func() string {
+		var lines []string
+
+		for {
+			line, err := rbuf.ReadString('\n')
+			if err != nil {
+				t.Fatalf("cannot read event: %v", err)
+			}
+
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+
+			lines = append(lines, line)
+		}
+	}
+
+	if event := readEvent(); !strings.Contains(event, `"Mailbox"`) {
+		t.Fatalf("unexpected initial event %q", event)
+	}
+
+	c.call([]any{"Mailbox/set", map[string]any{
+		"accountId": c.accountId,
+		"create": map[string]any{
+			"mb1": map[string]any{"name": "Archive"},
+		},
+	}})
+
+	if event := readEvent(); !strings.Contains(event, `"Mailbox"`) {
+		t.Fatalf("unexpected state event %q", event)
+	}
+
+	// The stream is closed after the state change
+	if _, err := rbuf.ReadString('\n'); err != io.EOF {
+		t.Errorf("stream not closed after state change")
+	}
+}
@@ -0,0 +1,118 @@
+package jmap
+
+import (
+	"net/http"
+)
+
+// RFC 8620 2. The JMAP Session Resource
+
+const (
+	CapabilityCore       = "urn:ietf:params:jmap:core"
+	CapabilityMail       = "urn:ietf:params:jmap:mail"
+	CapabilitySubmission = "urn:ietf:params:jmap:submission"
+)
+
+// The session state never changes: each user has access to a single account
+// whose capabilities are fixed.
+const sessionState = "0"
+
+type session struct {
+	Capabilities    map[string]any      `json:"capabilities"`
+	Accounts        map[string]*account `json:"accounts"`
+	PrimaryAccounts map[string]string   `json:"primaryAccounts"`
+	Username        string              `json:"username"`
+	APIURL          string              `json:"apiUrl"`
+	DownloadURL     string              `json:"downloadUrl"`
+	UploadURL       string              `json:"uploadUrl"`
+	EventSourceURL  string              `json:"eventSourceUrl"`
+	State           string              `json:"state"`
+}
+
+type account struct {
+	Name                string         `json:"name"`
+	IsPersonal          bool           `json:"isPersonal"`
+	IsReadOnly          bool           `json:"isReadOnly"`
+	AccountCapabilities map[string]any `json:"accountCapabilities"`
+}
+
+func (s *Server) capabilities() map[string]any {
+	caps := map[string]any{
+		CapabilityCore: map[string]any{
+			"maxSizeUpload":         s.Cfg.MaxUploadSize,
+			"maxConcurrentUpload":   4,
+			"maxSizeRequest":        s.Cfg.MaxRequestSize,
+			"maxConcurrentRequests": 4,
+			"maxCallsInRequest":     MaxCallsInRequest,
+			"maxObjectsInGet":       MaxObjectsInGet,
+			"maxObjectsInSet":       MaxObjectsInSet,
+			"collationAlgorithms":   []string{"i;ascii-casemap"},
+		},
+		CapabilityMail: map[string]any{},
+	}
+
+	if s.Cfg.SubmissionHandler != nil {
+		caps[CapabilitySubmission] = map[string]any{}
+	}
+
+	return caps
+}
+
+func (s *Server) hSession(w http.ResponseWriter, r *http.Request) {
+	username := s.authenticate(w, r)
+	if username == "" {
+		return
+	}
+
+	id := accountId(username)
+	baseURL := s.baseURL(r)
+
+	accountCaps := map[string]any{
+		// RFC 8621 1.3.1. Messages are stored in a single mailbox
+		CapabilityMail: map[string]any{
+			"maxMailboxesPerEmail":       1,
+			"maxMailboxDepth":            nil,
+			"maxSizeMailboxName":         255,
+			"maxSizeAttachmentsPerEmail": s.Cfg.MaxUploadSize,
+			"emailQuerySortOptions":      emailSortProperties,
+			"mayCreateTopLevelMailbox":   true,
+		},
+	}
+
+	primaryAccounts := map[string]string{
+		CapabilityMail: id,
+	}
+
+	if s.Cfg.SubmissionHandler != nil {
+		// RFC 8621 7. Sending is immediate: delayed sending is not
+		// supported.
+		accountCaps[CapabilitySubmission] = map[string]any{
+			"maxDelayedSend":       0,
+			"submissionExtensions": map[string][]string{},
+		}
+
+		primaryAccounts[CapabilitySubmission] = id
+	}
+
+	sess := session{
+		Capabilities: s.capabilities(),
+		Accounts: map[string]*account{
+			id: {
+				Name:                username,
+				IsPersonal:          true,
+				IsReadOnly:          false,
+				AccountCapabilities: accountCaps,
+			},
+		},
+		PrimaryAccounts: primaryAccounts,
+		Username:        username,
+		APIURL:          baseURL + "/jmap/api",
+		DownloadURL: baseURL +
+			"/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		UploadURL: baseURL + "/jmap/upload/{accountId}",
+		EventSourceURL: baseURL +
+			"/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		State: sessionState,
+	}
+
+	s.replyJSON(w, http.StatusOK, &sess)
+}
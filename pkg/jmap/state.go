@@ -0,0 +1,211 @@
+package jmap
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+// Messages are identified by their mailbox and their UID; both never change
+// for the life of a message in the store. Part identifiers may contain dots
+// which are not valid in identifiers (RFC 8620 1.2.) and are replaced by
+// underscores in blob identifiers.
+
+func mailboxId(id uint32) string {
+	return "m" + strconv.FormatUint(uint64(id), 10)
+}
+
+func parseMailboxId(s string) (uint32, bool) {
+	idString, found := strings.CutPrefix(s, "m")
+	if !found {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(idString, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint32(id), true
+}
+
+func emailId(mailboxId, uid uint32) string {
+	return fmt.Sprintf("e%d-%d", mailboxId, uid)
+}
+
+func threadId(mailboxId, uid uint32) string {
+	return fmt.Sprintf("t%d-%d", mailboxId, uid)
+}
+
+func messageBlobId(mailboxId, uid uint32) string {
+	return fmt.Sprintf("b%d-%d", mailboxId, uid)
+}
+
+func partBlobId(mailboxId, uid uint32, partId string) string {
+	return messageBlobId(mailboxId, uid) + "-" +
+		strings.ReplaceAll(partId, ".", "_")
+}
+
+func parseEmailId(s string) (uint32, uint32, bool) {
+	return parseMessageRef(s, "e")
+}
+
+func parseThreadId(s string) (uint32, uint32, bool) {
+	return parseMessageRef(s, "t")
+}
+
+// parseBlobId returns the message and the optional part referenced by a
+// blob identifier.
+func parseBlobId(s string) (uint32, uint32, string, bool) {
+	s, found := strings.CutPrefix(s, "b")
+	if !found {
+		return 0, 0, "", false
+	}
+
+	parts := strings.SplitN(s, "-", 3)
+	if len(parts) < 2 {
+		return 0, 0, "", false
+	}
+
+	mbId, uid, ok := parseMessageRef("b"+parts[0]+"-"+parts[1], "b")
+	if !ok {
+		return 0, 0, "", false
+	}
+
+	var partId string
+	if len(parts) == 3 {
+		partId = strings.ReplaceAll(parts[2], "_", ".")
+	}
+
+	return mbId, uid, partId, true
+}
+
+func parseMessageRef(s, prefix string) (uint32, uint32, bool) {
+	s, found := strings.CutPrefix(s, prefix)
+	if !found {
+		return 0, 0, false
+	}
+
+	mbIdString, uidString, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	mbId, err := strconv.ParseUint(mbIdString, 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	uid, err := strconv.ParseUint(uidString, 10, 32)
+	if err != nil || uid == 0 {
+		return 0, 0, false
+	}
+
+	return uint32(mbId), uint32(uid), true
+}
+
+// The store does not keep a history of changes for the whole account, but
+// each mailbox has a modification sequence (RFC 7162) and keeps track of
+// expunged messages. States therefore contain the synchronization data of
+// each mailbox, which is enough to compute changes as long as mailboxes are
+// not deleted.
+
+type mailboxSyncState struct {
+	UIDValidity   uint32
+	UIDNext       uint32
+	HighestModSeq uint64
+	Hash          uint32 // name and role
+}
+
+func mailboxHash(info *mailstore.MailboxInfo) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(info.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(info.SpecialUse))
+	return h.Sum32()
+}
+
+// mailboxesState returns the state of Mailbox objects, which changes when
+// mailboxes are created, deleted or renamed, or when their content changes
+// since this affects counters.
+func mailboxesState(infos []*mailstore.MailboxInfo) string {
+	return encodeState(infos, func(info *mailstore.MailboxInfo) string {
+		return fmt.Sprintf("%d.%d.%d", info.Id, info.HighestModSeq,
+			mailboxHash(info))
+	})
+}
+
+// emailsState returns the state of Email and Thread objects.
+func emailsState(infos []*mailstore.MailboxInfo) string {
+	return encodeState(infos, func(info *mailstore.MailboxInfo) string {
+		return fmt.Sprintf("%d.%d.%d.%d", info.Id, info.UIDValidity,
+			info.UIDNext, info.HighestModSeq)
+	})
+}
+
+func encodeState(infos []*mailstore.MailboxInfo, fn func(*mailstore.MailboxInfo) string) string {
+	infos = append([]*mailstore.MailboxInfo(nil), infos...)
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+
+	elements := make([]string, len(infos))
+	for i, info := range infos {
+		elements[i] = fn(info)
+	}
+
+	return strings.Join(elements, ",")
+}
+
+func parseMailboxesState(s string) (map[uint32]*mailboxSyncState, error) {
+	return parseState(s, 3, func(values []uint64) *mailboxSyncState {
+		return &mailboxSyncState{
+			HighestModSeq: values[1],
+			Hash:          uint32(values[2]),
+		}
+	})
+}
+
+func parseEmailsState(s string) (map[uint32]*mailboxSyncState, error) {
+	return parseState(s, 4, func(values []uint64) *mailboxSyncState {
+		return &mailboxSyncState{
+			UIDValidity:   uint32(values[1]),
+			UIDNext:       uint32(values[2]),
+			HighestModSeq: values[3],
+		}
+	})
+}
+
+func parseState(s string, nbValues int, fn func([]uint64) *mailboxSyncState) (map[uint32]*mailboxSyncState, error) {
+	states := make(map[uint32]*mailboxSyncState)
+
+	if s == "" {
+		return states, nil
+	}
+
+	for _, element := range strings.Split(s, ",") {
+		parts := strings.Split(element, ".")
+		if len(parts) != nbValues {
+			return nil, fmt.Errorf("invalid state element %q", element)
+		}
+
+		values := make([]uint64, nbValues)
+
+		for i, part := range parts {
+			value, err := strconv.ParseUint(part, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid state element %q", element)
+			}
+
+			values[i] = value
+		}
+
+		states[uint32(values[0])] = fn(values)
+	}
+
+	return states, nil
+}
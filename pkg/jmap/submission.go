@@ -0,0 +1,416 @@
+package jmap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/mailstore"
+)
+
+// RFC 8621 6. Identities
+// RFC 8621 7. Email Submission
+//
+// Each user has a single identity whose address is the name of the user.
+// Messages are handed to the submission handler as soon as they are
+// submitted: submissions are final and are not kept by the server.
+
+const (
+	defaultIdentityId = "i0"
+
+	submissionState = "0"
+)
+
+var identityProperties = []string{
+	"id", "name", "email", "replyTo", "bcc", "textSignature",
+	"htmlSignature", "mayDelete",
+}
+
+// RFC 8621 6.1. Identity/get
+func identityGet(c *apiContext, data json.RawMessage) (any, error) {
+	var args getArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	if err := args.check(c, identityProperties); err != nil {
+		return nil, err
+	}
+
+	identity := map[string]any{
+		"id":            defaultIdentityId,
+		"name":          "",
+		"email":         c.username,
+		"replyTo":       nil,
+		"bcc":           nil,
+		"textSignature": "",
+		"htmlSignature": "",
+		"mayDelete":     false,
+	}
+
+	res := getResult{
+		AccountId: c.accountId,
+		State:     submissionState,
+		List:      []map[string]any{},
+		NotFound:  []string{},
+	}
+
+	if args.Ids == nil {
+		res.List = append(res.List,
+			selectProperties(identity, args.Properties))
+	} else {
+		for _, id := range *args.Ids {
+			if id != defaultIdentityId {
+				res.NotFound = append(res.NotFound, id)
+				continue
+			}
+
+			res.List = append(res.List,
+				selectProperties(identity, args.Properties))
+		}
+	}
+
+	return &res, nil
+}
+
+type emailSubmissionSetArgs struct {
+	setArgs
+
+	OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+	OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+}
+
+type emailSubmissionObject struct {
+	IdentityId string    `json:"identityId"`
+	EmailId    string    `json:"emailId"`
+	Envelope   *envelope `json:"envelope"`
+}
+
+type envelope struct {
+	MailFrom *envelopeAddress  `json:"mailFrom"`
+	RcptTo   []envelopeAddress `json:"rcptTo"`
+}
+
+type envelopeAddress struct {
+	Email      string         `json:"email"`
+	Parameters map[string]any `json:"parameters"`
+}
+
+// RFC 8621 7.5. EmailSubmission/set
+func emailSubmissionSet(c *apiContext, data json.RawMessage) (any, error) {
+	var args emailSubmissionSetArgs
+	if err := decodeArguments(data, &args); err != nil {
+		return nil, err
+	}
+
+	if err := args.check(c, submissionState); err != nil {
+		return nil, err
+	}
+
+	t := c.mailboxes()
+
+	res := newSetResult(c.accountId, submissionState)
+	res.NewState = submissionState
+
+	// Emails submitted indexed by submission identifier
+	emailIds := make(map[string]string)
+
+	creationIds := make([]string, 0, len(args.Create))
+	for creationId := range args.Create {
+		creationIds = append(creationIds, creationId)
+	}
+
+	sort.Strings(creationIds)
+
+	for _, creationId := range creationIds {
+		var obj emailSubmissionObject
+		if setErr := decodeObject(args.Create[creationId], &obj); setErr != nil {
+			res.NotCreated[creationId] = setErr
+			continue
+		}
+
+		setErr, err := c.submitEmail(t, &obj)
+		if err != nil {
+			return nil, err
+		} else if setErr != nil {
+			res.NotCreated[creationId] = setErr
+			continue
+		}
+
+		id, err := generateSubmissionId()
+		if err != nil {
+			return nil, err
+		}
+
+		emailId, _ := c.resolveId(obj.EmailId)
+		mbId, uid, _ := parseEmailId(emailId)
+
+		c.createdIds[creationId] = id
+		emailIds[id] = emailId
+
+		res.Created[creationId] = map[string]any{
+			"id":         id,
+			"threadId":   threadId(mbId, uid),
+			"sendAt":     time.Now().UTC().Format(time.RFC3339),
+			"undoStatus": "final",
+		}
+	}
+
+	for id := range args.Update {
+		res.NotUpdated[id] = setErrorf("notFound", "unknown submission")
+	}
+
+	res.Destroyed = []string{}
+
+	for _, id := range args.Destroy {
+		res.NotDestroyed[id] = setErrorf("notFound", "unknown submission")
+	}
+
+	if args.OnSuccessUpdateEmail == nil && args.OnSuccessDestroyEmail == nil {
+		return res, nil
+	}
+
+	// RFC 8621 7.5. Changes applied to submitted emails are reported in an
+	// implicit Email/set response.
+	emailArgs := setArgs{
+		AccountId: c.accountId,
+		Update:    make(map[string]map[string]json.RawMessage),
+	}
+
+	submittedEmailId := func(id string) (string, bool) {
+		id, found := c.resolveId(id)
+		if !found {
+			return "", false
+		}
+
+		emailId, found := emailIds[id]
+		return emailId, found
+	}
+
+	for id, patch := range args.OnSuccessUpdateEmail {
+		if emailId, found := submittedEmailId(id); found {
+			emailArgs.Update[emailId] = patch
+		}
+	}
+
+	for _, id := range args.OnSuccessDestroyEmail {
+		if emailId, found := submittedEmailId(id); found {
+			emailArgs.Destroy = append(emailArgs.Destroy, emailId)
+		}
+	}
+
+	emailRes, err := c.setEmails(&emailArgs)
+	if err != nil {
+		var methodErr *MethodError
+		if !errors.As(err, &methodErr) {
+			return nil, err
+		}
+
+		c.addImplicitResponse("error", methodErr)
+	} else {
+		c.addImplicitResponse("Email/set", emailRes)
+	}
+
+	return res, nil
+}
+
+func generateSubmissionId() (string, error) {
+	data := make([]byte, 12)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	return "s" + hex.EncodeToString(data), nil
+}
+
+func (c *apiContext) submitEmail(t *mailboxTable, obj *emailSubmissionObject) (*SetError, error) {
+	if id, _ := c.resolveId(obj.IdentityId); id != defaultIdentityId {
+		return invalidPropertiesf([]string{"identityId"},
+			"unknown identity"), nil
+	}
+
+	id, _ := c.resolveId(obj.EmailId)
+
+	e, err := c.email(t, id)
+	if err != nil {
+		return nil, err
+	} else if e == nil {
+		return invalidPropertiesf([]string{"emailId"}, "unknown email"), nil
+	}
+
+	data, err := c.account.MessageData(e.mailbox.Name, e.info.UID)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMessageNotFound) ||
+			errors.Is(err, mailstore.ErrMailboxNotFound) {
+			return invalidPropertiesf([]string{"emailId"},
+				"unknown email"), nil
+		}
+
+		return nil, err
+	}
+
+	decoder := imf.NewMessageDecoder()
+	decoder.MixedEOL = true
+
+	msg, err := decoder.DecodeAll(data)
+	if err != nil {
+		return setErrorf("invalidEmail", "invalid message: %v", err), nil
+	}
+
+	submission := Submission{
+		Identity: c.username,
+		Message:  msg,
+	}
+
+	if obj.Envelope == nil {
+		if setErr := setSubmissionEnvelope(&submission); setErr != nil {
+			return setErr, nil
+		}
+	} else {
+		if setErr := decodeSubmissionEnvelope(obj.Envelope, &submission); setErr != nil {
+			return setErr, nil
+		}
+	}
+
+	// RFC 8621 7. Bcc fields must be removed before sending
+	header := msg.Header[:0]
+	for _, field := range msg.Header {
+		if !strings.EqualFold(field.Name, "Bcc") {
+			header = append(header, field)
+		}
+	}
+
+	msg.Header = header
+
+	if err := c.Server.Cfg.SubmissionHandler(&submission); err != nil {
+		c.Log.Error("cannot submit message: %v", err)
+		return setErrorf("forbiddenToSend", "%v", err), nil
+	}
+
+	c.Log.Info("message %s submitted", id)
+
+	return nil, nil
+}
+
+// setSubmissionEnvelope sets the envelope of a submission from the fields of
+// the message (RFC 8621 7.).
+func setSubmissionEnvelope(s *Submission) *SetError {
+	var from, sender imf.Addresses
+	var recipients []imf.SpecificAddress
+
+	for _, field := range s.Message.Header {
+		if field.HasError() {
+			continue
+		}
+
+		switch v := field.Value.(type) {
+		case *imf.FromFieldValue:
+			from = imf.Addresses(*v)
+		case *imf.SenderFieldValue:
+			sender = imf.Addresses{v.Address}
+		case *imf.ToFieldValue:
+			recipients = append(recipients, specificAddresses(imf.Addresses(*v))...)
+		case *imf.CcFieldValue:
+			recipients = append(recipients, specificAddresses(imf.Addresses(*v))...)
+		case *imf.BccFieldValue:
+			recipients = append(recipients, specificAddresses(imf.Addresses(*v))...)
+		}
+	}
+
+	if sender == nil {
+		sender = from
+	}
+
+	senderAddrs := specificAddresses(sender)
+	if len(senderAddrs) == 0 {
+		return setErrorf("invalidEmail", "missing sender address")
+	}
+
+	s.ReversePath = &senderAddrs[0]
+
+	seen := make(map[string]bool)
+	for _, recipient := range recipients {
+		key := strings.ToLower(recipient.String())
+		if !seen[key] {
+			seen[key] = true
+			s.ForwardPaths = append(s.ForwardPaths, recipient)
+		}
+	}
+
+	if len(s.ForwardPaths) == 0 {
+		return setErrorf("noRecipients", "missing recipient addresses")
+	}
+
+	return nil
+}
+
+func decodeSubmissionEnvelope(env *envelope, s *Submission) *SetError {
+	if env.MailFrom == nil {
+		return invalidPropertiesf([]string{"envelope"},
+			"missing mailFrom address")
+	}
+
+	if env.MailFrom.Email != "" {
+		spec, err := parseSpecificAddress(env.MailFrom.Email)
+		if err != nil {
+			return invalidPropertiesf([]string{"envelope"},
+				"invalid mailFrom address %q", env.MailFrom.Email)
+		}
+
+		s.ReversePath = spec
+	}
+
+	for _, rcptTo := range env.RcptTo {
+		spec, err := parseSpecificAddress(rcptTo.Email)
+		if err != nil {
+			return setErrorf("invalidRecipients",
+				"invalid rcptTo address %q", rcptTo.Email)
+		}
+
+		s.ForwardPaths = append(s.ForwardPaths, *spec)
+	}
+
+	if len(s.ForwardPaths) == 0 {
+		return setErrorf("noRecipients", "missing recipient addresses")
+	}
+
+	return nil
+}
+
+func specificAddresses(addrs imf.Addresses) []imf.SpecificAddress {
+	var specs []imf.SpecificAddress
+
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *imf.Mailbox:
+			specs = append(specs, v.SpecificAddress)
+		case *imf.Group:
+			for _, mb := range v.Mailboxes {
+				specs = append(specs, mb.SpecificAddress)
+			}
+		}
+	}
+
+	return specs
+}
+
+func parseSpecificAddress(s string) (*imf.SpecificAddress, error) {
+	d := imf.NewDataDecoder([]byte(s))
+
+	spec, err := d.ReadSpecificAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Empty() {
+		return nil, fmt.Errorf("invalid trailing data")
+	}
+
+	return spec, nil
+}
@@ -0,0 +1,215 @@
+package maildir
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Maildir directories contain three subdirectories: messages are written to
+// "tmp", then moved to "new" once they are complete; mail clients move them
+// to "cur" once they have seen them. The rename being atomic, readers never
+// see incomplete messages.
+//
+// See https://cr.yp.to/proto/maildir.html.
+//
+// Folders follow the Maildir++ convention: each folder is a Maildir directory
+// stored in the root directory, whose name is the name of the folder prefixed
+// by a dot. Folders contain an empty "maildirfolder" file.
+
+var deliveryCounter atomic.Uint64
+
+type Maildir struct {
+	Path string
+
+	folder bool
+}
+
+func NewMaildir(dirPath string) *Maildir {
+	return &Maildir{
+		Path: dirPath,
+	}
+}
+
+// IsValidFolderName returns true if a name can be used for a Maildir++
+// folder. Hierarchy levels are separated by dots.
+func IsValidFolderName(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/\\\x00") {
+		return false
+	}
+
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Folder returns a folder of the directory; the name must be valid (see
+// IsValidFolderName).
+func (m *Maildir) Folder(name string) *Maildir {
+	return &Maildir{
+		Path: path.Join(m.Path, "."+name),
+
+		folder: true,
+	}
+}
+
+// Create creates the directory and its subdirectories if they do not exist.
+func (m *Maildir) Create() error {
+	for _, name := range []string{"tmp", "new", "cur"} {
+		dirPath := path.Join(m.Path, name)
+
+		if err := os.MkdirAll(dirPath, 0700); err != nil {
+			return fmt.Errorf("cannot create directory %q: %w", dirPath, err)
+		}
+	}
+
+	if m.folder {
+		filePath := path.Join(m.Path, "maildirfolder")
+
+		file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("cannot create %q: %w", filePath, err)
+		}
+
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("cannot close %q: %w", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+// Deliver writes a message to the "new" subdirectory and returns the unique
+// name of the file. The message is only visible once it has been entirely
+// written and synced to disk.
+func (m *Maildir) Deliver(data []byte) (string, error) {
+	return m.DeliverWithFlags(data, "")
+}
+
+// DeliverWithFlags writes a message with a set of flags, each flag being a
+// single letter (e.g. "S" for seen messages). Messages with flags are written
+// to the "cur" subdirectory since the flags are part of the file name; the
+// returned name does not include them.
+func (m *Maildir) DeliverWithFlags(data []byte, flags string) (string, error) {
+	name, err := uniqueName()
+	if err != nil {
+		return "", err
+	}
+
+	tmpPath := path.Join(m.Path, "tmp", name)
+	newPath := path.Join(m.Path, "new", name)
+
+	if flags != "" {
+		// Flags are sorted in ASCII order after the "2," prefix
+		letters := strings.Split(flags, "")
+		sort.Strings(letters)
+		letters = slices.Compact(letters)
+
+		info := ":2," + strings.Join(letters, "")
+		newPath = path.Join(m.Path, "cur", name+info)
+	}
+
+	if err := writeFile(tmpPath, data); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("cannot rename %q: %w", tmpPath, err)
+	}
+
+	// The rename is only durable once the directory itself has been synced
+	if err := syncDirectory(path.Dir(newPath)); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+func writeFile(filePath string, data []byte) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %w", filePath, err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot write %q: %w", filePath, err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot sync %q: %w", filePath, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("cannot close %q: %w", filePath, err)
+	}
+
+	return nil
+}
+
+func syncDirectory(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", dirPath, err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("cannot sync %q: %w", dirPath, err)
+	}
+
+	return nil
+}
+
+// uniqueName returns a name of the form "<seconds>.M<microseconds>P<pid>
+// Q<counter>R<random>.<host>" which cannot be generated twice, even by
+// multiple processes on the same host.
+func uniqueName() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	// Slashes cannot appear in file names and colons separate the unique
+	// name from the flags of messages in "cur".
+	hostname = strings.ReplaceAll(hostname, "/", `\057`)
+	hostname = strings.ReplaceAll(hostname, ":", `\072`)
+
+	now := time.Now()
+
+	var buf strings.Builder
+
+	buf.WriteString(strconv.FormatInt(now.Unix(), 10))
+	buf.WriteString(".M")
+	buf.WriteString(strconv.Itoa(now.Nanosecond() / 1000))
+	buf.WriteString("P")
+	buf.WriteString(strconv.Itoa(os.Getpid()))
+	buf.WriteString("Q")
+	buf.WriteString(strconv.FormatUint(deliveryCounter.Add(1), 10))
+	buf.WriteString("R")
+	buf.WriteString(hex.EncodeToString(random))
+	buf.WriteString(".")
+	buf.WriteString(hostname)
+
+	return buf.String(), nil
+}
@@ -0,0 +1,90 @@
+package maildir
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMaildirDeliver(t *testing.T) {
+	m := NewMaildir(path.Join(t.TempDir(), "bob"))
+
+	if err := m.Create(); err != nil {
+		t.Fatalf("cannot create maildir: %v", err)
+	}
+
+	names := make(map[string]bool)
+
+	for i := 0; i < 100; i++ {
+		name, err := m.Deliver([]byte("Subject: test\r\n\r\nHello.\r\n"))
+		if err != nil {
+			t.Fatalf("cannot deliver message: %v", err)
+		}
+
+		if names[name] {
+			t.Fatalf("name %q generated twice", name)
+		}
+
+		if strings.ContainsAny(name, "/:") {
+			t.Errorf("invalid name %q", name)
+		}
+
+		names[name] = true
+	}
+
+	entries, err := os.ReadDir(path.Join(m.Path, "new"))
+	if err != nil {
+		t.Fatalf("cannot read directory: %v", err)
+	}
+
+	if len(entries) != len(names) {
+		t.Errorf("%d messages found instead of %d", len(entries), len(names))
+	}
+}
+
+func TestMaildirFolder(t *testing.T) {
+	m := NewMaildir(path.Join(t.TempDir(), "bob"))
+
+	folder := m.Folder("Lists.golang")
+
+	if err := folder.Create(); err != nil {
+		t.Fatalf("cannot create folder: %v", err)
+	}
+
+	if folder.Path != path.Join(m.Path, ".Lists.golang") {
+		t.Errorf("invalid folder path %q", folder.Path)
+	}
+
+	if _, err := os.Stat(path.Join(folder.Path, "maildirfolder")); err != nil {
+		t.Errorf("cannot stat maildirfolder file: %v", err)
+	}
+
+	if _, err := folder.Deliver([]byte("Subject: test\r\n\r\nHello.\r\n")); err != nil {
+		t.Fatalf("cannot deliver message: %v", err)
+	}
+
+	for _, name := range []string{"", ".Junk", "Junk.", "a..b", "a/b"} {
+		if IsValidFolderName(name) {
+			t.Errorf("folder name %q should be invalid", name)
+		}
+	}
+}
+
+func TestMaildirDeliverWithFlags(t *testing.T) {
+	m := NewMaildir(path.Join(t.TempDir(), "bob"))
+
+	if err := m.Create(); err != nil {
+		t.Fatalf("cannot create maildir: %v", err)
+	}
+
+	name, err := m.DeliverWithFlags([]byte("Subject: test\r\n\r\nHello.\r\n"),
+		"SFS")
+	if err != nil {
+		t.Fatalf("cannot deliver message: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(m.Path, "cur", name+":2,FS")); err != nil {
+		t.Errorf("cannot stat message: %v", err)
+	}
+}
@@ -0,0 +1,1113 @@
+package mailstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-log"
+)
+
+const (
+	indexFileName      = "index.json"
+	logFileName        = "log"
+	messagesDirName    = "messages"
+	tmpMessagesDirName = "tmp"
+	tmpFileNameSuffix  = ".tmp"
+)
+
+type mailboxState struct {
+	Id            uint32 `json:"id"`
+	Name          string `json:"name"`
+	UIDValidity   uint32 `json:"uid_validity"`
+	UIDNext       uint32 `json:"uid_next"`
+	HighestModSeq uint64 `json:"highest_modseq"`
+	SpecialUse    string `json:"special_use,omitempty"`
+
+	// Only used in snapshots
+	Messages       []*MessageInfo     `json:"messages,omitempty"`
+	Expunged       []*ExpungedMessage `json:"expunged,omitempty"`
+	ExpungedModSeq uint64             `json:"expunged_modseq,omitempty"`
+}
+
+type snapshot struct {
+	// Identifiers and UIDVALIDITY values of deleted mailboxes must never be
+	// reused.
+	NextMailboxId   uint32 `json:"next_mailbox_id"`
+	LastUIDValidity uint32 `json:"last_uid_validity"`
+
+	Mailboxes []*mailboxState `json:"mailboxes"`
+}
+
+type mailbox struct {
+	mailboxState
+
+	messages []*MessageInfo // sorted by UID
+
+	// Expunged messages are remembered so that clients can find which
+	// messages were expunged since their last synchronization. Only the
+	// last maxExpungedMessages messages are kept; expungedModSeq is the
+	// highest modification sequence of messages which were forgotten.
+	expunged       []*ExpungedMessage // sorted by modification sequence
+	expungedModSeq uint64
+}
+
+func (mb *mailbox) info() *MailboxInfo {
+	info := MailboxInfo{
+		Id:            mb.Id,
+		Name:          mb.Name,
+		UIDValidity:   mb.UIDValidity,
+		UIDNext:       mb.UIDNext,
+		HighestModSeq: mb.HighestModSeq,
+		SpecialUse:    mb.SpecialUse,
+		NbMessages:    len(mb.messages),
+	}
+
+	for _, msg := range mb.messages {
+		if !msg.HasFlag(FlagSeen) {
+			info.NbUnseen++
+		}
+	}
+
+	return &info
+}
+
+func (mb *mailbox) messageIndex(uid uint32) (int, bool) {
+	i := sort.Search(len(mb.messages), func(i int) bool {
+		return mb.messages[i].UID >= uid
+	})
+
+	return i, i < len(mb.messages) && mb.messages[i].UID == uid
+}
+
+func (mb *mailbox) addExpungedMessage(uid uint32, modSeq uint64) {
+	mb.expunged = append(mb.expunged, &ExpungedMessage{
+		UID:    uid,
+		ModSeq: modSeq,
+	})
+
+	if n := len(mb.expunged) - maxExpungedMessages; n > 0 {
+		mb.expungedModSeq = mb.expunged[n-1].ModSeq
+		mb.expunged = append([]*ExpungedMessage(nil), mb.expunged[n:]...)
+	}
+}
+
+func (mb *mailbox) message(uid uint32) *MessageInfo {
+	if i, found := mb.messageIndex(uid); found {
+		return mb.messages[i]
+	}
+
+	return nil
+}
+
+// Account contains the mailboxes of a user. All methods are safe for
+// concurrent use.
+type Account struct {
+	Log *log.Logger
+
+	dirPath    string
+	maxLogSize int
+
+	mailboxes     map[uint32]*mailbox
+	mailboxNames  map[string]uint32
+	nextMailboxId uint32
+	lastValidity  uint32
+
+	wal *writeAheadLog
+
+	watchers map[chan struct{}]struct{}
+
+	mutex sync.Mutex
+}
+
+func openAccount(dirPath string, maxLogSize int, logger *log.Logger) (*Account, error) {
+	a := Account{
+		Log: logger,
+
+		dirPath:    dirPath,
+		maxLogSize: maxLogSize,
+
+		mailboxes:     make(map[uint32]*mailbox),
+		mailboxNames:  make(map[string]uint32),
+		nextMailboxId: 1,
+
+		watchers: make(map[chan struct{}]struct{}),
+	}
+
+	tmpDirPath := path.Join(dirPath, messagesDirName, tmpMessagesDirName)
+	if err := os.MkdirAll(tmpDirPath, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create directory %q: %w", tmpDirPath, err)
+	}
+
+	if err := a.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	wal, changes, err := openLog(path.Join(dirPath, logFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	a.wal = wal
+
+	for _, records := range changes {
+		a.apply(records)
+	}
+
+	if _, found := a.mailboxNames[InboxName]; !found {
+		if err := a.createMailbox(InboxName, ""); err != nil {
+			a.wal.close()
+			return nil, fmt.Errorf("cannot create INBOX: %w", err)
+		}
+	}
+
+	if err := a.deleteOrphanFiles(); err != nil {
+		a.wal.close()
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func (a *Account) close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var err error
+	if a.wal.size > 0 {
+		err = a.checkpoint()
+	}
+
+	if err2 := a.wal.close(); err == nil {
+		err = err2
+	}
+
+	return err
+}
+
+// Watch returns a channel which receives a value after each change of the
+// account, and a function to call when notifications are not needed anymore.
+// Notifications are coalesced: a single value can signal several changes.
+func (a *Account) Watch() (<-chan struct{}, func()) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	watcher := make(chan struct{}, 1)
+	a.watchers[watcher] = struct{}{}
+
+	unwatch := func() {
+		a.mutex.Lock()
+		delete(a.watchers, watcher)
+		a.mutex.Unlock()
+	}
+
+	return watcher, unwatch
+}
+
+// Mailboxes returns information about all mailboxes sorted by name.
+func (a *Account) Mailboxes() []*MailboxInfo {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	infos := make([]*MailboxInfo, 0, len(a.mailboxes))
+	for _, mb := range a.mailboxes {
+		infos = append(infos, mb.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+// Size returns the sum of the size of all messages of the account.
+func (a *Account) Size() int64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var size int64
+
+	for _, mb := range a.mailboxes {
+		for _, msg := range mb.messages {
+			size += msg.Size
+		}
+	}
+
+	return size
+}
+
+func (a *Account) Mailbox(name string) (*MailboxInfo, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return mb.info(), nil
+}
+
+func (a *Account) mailbox(name string) (*mailbox, error) {
+	id, found := a.mailboxNames[NormalizeMailboxName(name)]
+	if !found {
+		return nil, ErrMailboxNotFound
+	}
+
+	return a.mailboxes[id], nil
+}
+
+func (a *Account) CreateMailbox(name string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.createMailbox(name, "")
+}
+
+// CreateSpecialUseMailbox creates a mailbox with a special use attribute
+// (RFC 6154).
+func (a *Account) CreateSpecialUseMailbox(name, specialUse string) error {
+	specialUse, err := normalizeSpecialUse(specialUse)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.createMailbox(name, specialUse)
+}
+
+func (a *Account) createMailbox(name, specialUse string) error {
+	name = NormalizeMailboxName(name)
+
+	if !IsValidMailboxName(name) {
+		return ErrInvalidMailboxName
+	}
+
+	if name == InboxName && specialUse != "" {
+		return ErrInboxOperation
+	}
+
+	if _, found := a.mailboxNames[name]; found {
+		return ErrMailboxExists
+	}
+
+	// RFC 9051 2.3.1.1. A mailbox created with the name of a deleted mailbox
+	// must have a different UIDVALIDITY value.
+	validity := uint32(time.Now().Unix())
+	if validity <= a.lastValidity {
+		validity = a.lastValidity + 1
+	}
+
+	// RFC 7162 3.1.1. Modification sequences are positive; the first
+	// change of the mailbox uses 2 so that clients synchronizing an empty
+	// mailbox do not miss it.
+	state := mailboxState{
+		Id:            a.nextMailboxId,
+		Name:          name,
+		UIDValidity:   validity,
+		UIDNext:       1,
+		HighestModSeq: 1,
+		SpecialUse:    specialUse,
+	}
+
+	dirPath := a.mailboxDirPath(state.Id)
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		return fmt.Errorf("cannot create directory %q: %w", dirPath, err)
+	}
+
+	return a.commit(&logRecord{
+		Type:      logRecordPutMailbox,
+		MailboxId: state.Id,
+		Mailbox:   &state,
+	})
+}
+
+// DeleteMailbox deletes a mailbox and all its messages. Child mailboxes are
+// not affected.
+func (a *Account) DeleteMailbox(name string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(name)
+	if err != nil {
+		return err
+	}
+
+	if mb.Name == InboxName {
+		return ErrInboxOperation
+	}
+
+	err = a.commit(&logRecord{
+		Type:      logRecordDeleteMailbox,
+		MailboxId: mb.Id,
+	})
+	if err != nil {
+		return err
+	}
+
+	dirPath := a.mailboxDirPath(mb.Id)
+	if err := os.RemoveAll(dirPath); err != nil {
+		// Remaining files will be deleted the next time the account is
+		// opened.
+		a.Log.Error("cannot delete %q: %v", dirPath, err)
+	}
+
+	return nil
+}
+
+// RenameMailbox renames a mailbox and its child mailboxes. Messages keep their
+// UIDs.
+func (a *Account) RenameMailbox(oldName, newName string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(oldName)
+	if err != nil {
+		return err
+	}
+
+	newName = NormalizeMailboxName(newName)
+
+	if mb.Name == InboxName || newName == InboxName {
+		return ErrInboxOperation
+	}
+
+	if !IsValidMailboxName(newName) {
+		return ErrInvalidMailboxName
+	}
+
+	if _, found := a.mailboxNames[newName]; found {
+		return ErrMailboxExists
+	}
+
+	if strings.HasPrefix(newName, mb.Name+Separator) {
+		return ErrInvalidMailboxName
+	}
+
+	var records []*logRecord
+
+	for _, mb2 := range a.mailboxes {
+		var name string
+
+		if mb2.Name == mb.Name {
+			name = newName
+		} else if suffix, found := strings.CutPrefix(mb2.Name, mb.Name+Separator); found {
+			name = newName + Separator + suffix
+		} else {
+			continue
+		}
+
+		if _, found := a.mailboxNames[name]; found {
+			return ErrMailboxExists
+		}
+
+		state := mb2.mailboxState
+		state.Name = name
+
+		records = append(records, &logRecord{
+			Type:      logRecordPutMailbox,
+			MailboxId: state.Id,
+			Mailbox:   &state,
+		})
+	}
+
+	return a.commit(records...)
+}
+
+// Messages returns information about all messages of a mailbox sorted by
+// UID.
+func (a *Account) Messages(mailboxName string) ([]*MessageInfo, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(mailboxName)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*MessageInfo, len(mb.messages))
+	for i, msg := range mb.messages {
+		infos[i] = msg.clone()
+	}
+
+	return infos, nil
+}
+
+func (a *Account) Message(mailboxName string, uid uint32) (*MessageInfo, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(mailboxName)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := mb.message(uid)
+	if msg == nil {
+		return nil, ErrMessageNotFound
+	}
+
+	return msg.clone(), nil
+}
+
+// MessageData returns the content of a message.
+func (a *Account) MessageData(mailboxName string, uid uint32) ([]byte, error) {
+	a.mutex.Lock()
+
+	mb, err := a.mailbox(mailboxName)
+	if err != nil {
+		a.mutex.Unlock()
+		return nil, err
+	}
+
+	if mb.message(uid) == nil {
+		a.mutex.Unlock()
+		return nil, ErrMessageNotFound
+	}
+
+	filePath := a.messageFilePath(mb.Id, uid)
+
+	a.mutex.Unlock()
+
+	// Message files are never modified, we do not need to hold the lock
+	// while reading them.
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Expunged in the meantime
+			return nil, ErrMessageNotFound
+		}
+
+		return nil, fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	return data, nil
+}
+
+// AppendMessage stores a new message in a mailbox and returns its UID. If
+// the internal date is zero, the current date is used.
+func (a *Account) AppendMessage(mailboxName string, data []byte, flags []string, date time.Time) (uint32, error) {
+	flags, err := normalizeFlags(flags)
+	if err != nil {
+		return 0, err
+	}
+
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	envelope := ParseEnvelope(data)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(mailboxName)
+	if err != nil {
+		return 0, err
+	}
+
+	state := mb.mailboxState
+	state.UIDNext++
+	state.HighestModSeq++
+
+	msg := MessageInfo{
+		UID:          mb.UIDNext,
+		ModSeq:       state.HighestModSeq,
+		Flags:        flags,
+		InternalDate: date.UTC(),
+		Size:         int64(len(data)),
+		Envelope:     envelope,
+	}
+
+	filePath := a.messageFilePath(mb.Id, msg.UID)
+
+	if err := a.writeMessageFile(filePath, data); err != nil {
+		return 0, err
+	}
+
+	err = a.commit(
+		&logRecord{
+			Type:      logRecordPutMessage,
+			MailboxId: mb.Id,
+			Message:   &msg,
+		},
+		&logRecord{
+			Type:      logRecordPutMailbox,
+			MailboxId: mb.Id,
+			Mailbox:   &state,
+		},
+	)
+	if err != nil {
+		os.Remove(filePath)
+		return 0, err
+	}
+
+	return msg.UID, nil
+}
+
+// CopyMessages copies messages to another mailbox and returns the UIDs of the
+// new messages in the same order. Messages which do not exist are ignored and
+// their UID is zero in the returned list.
+func (a *Account) CopyMessages(mailboxName string, uids []uint32, destName string) ([]uint32, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(mailboxName)
+	if err != nil {
+		return nil, err
+	}
+
+	destMb, err := a.mailbox(destName)
+	if err != nil {
+		return nil, err
+	}
+
+	state := destMb.mailboxState
+	state.HighestModSeq++
+
+	newUIDs := make([]uint32, len(uids))
+	var records []*logRecord
+	var filePaths []string
+
+	for i, uid := range uids {
+		msg := mb.message(uid)
+		if msg == nil {
+			continue
+		}
+
+		newMsg := msg.clone()
+		newMsg.UID = state.UIDNext
+		newMsg.ModSeq = state.HighestModSeq
+
+		state.UIDNext++
+
+		filePath := a.messageFilePath(destMb.Id, newMsg.UID)
+
+		if err := copyFile(a.messageFilePath(mb.Id, uid), filePath); err != nil {
+			removeFiles(filePaths)
+			return nil, err
+		}
+
+		filePaths = append(filePaths, filePath)
+		newUIDs[i] = newMsg.UID
+
+		records = append(records, &logRecord{
+			Type:      logRecordPutMessage,
+			MailboxId: destMb.Id,
+			Message:   newMsg,
+		})
+	}
+
+	if len(records) == 0 {
+		return newUIDs, nil
+	}
+
+	if err := utils.SyncDirectory(a.mailboxDirPath(destMb.Id)); err != nil {
+		removeFiles(filePaths)
+		return nil, err
+	}
+
+	records = append(records, &logRecord{
+		Type:      logRecordPutMailbox,
+		MailboxId: destMb.Id,
+		Mailbox:   &state,
+	})
+
+	if err := a.commit(records...); err != nil {
+		removeFiles(filePaths)
+		return nil, err
+	}
+
+	return newUIDs, nil
+}
+
+// StoreFlags modifies the flags of messages and returns the messages which
+// were modified. All modified messages share the same new modification
+// sequence.
+func (a *Account) StoreFlags(mailboxName string, uids []uint32, op FlagOperation, flags []string) ([]*MessageInfo, error) {
+	msgs, _, err := a.storeFlags(mailboxName, uids, op, flags, 0)
+	return msgs, err
+}
+
+// StoreFlagsUnchangedSince modifies the flags of messages whose modification
+// sequence is lower or equal to modSeq (RFC 7162 3.1.3.). It returns the
+// messages which were modified and the UIDs of the messages which were not
+// because they changed after modSeq.
+func (a *Account) StoreFlagsUnchangedSince(mailboxName string, uids []uint32, op FlagOperation, flags []string, modSeq uint64) ([]*MessageInfo, []uint32, error) {
+	return a.storeFlags(mailboxName, uids, op, flags, modSeq)
+}
+
+func (a *Account) storeFlags(mailboxName string, uids []uint32, op FlagOperation, flags []string, unchangedSince uint64) ([]*MessageInfo, []uint32, error) {
+	flags, err := normalizeFlags(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(mailboxName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := mb.mailboxState
+	state.HighestModSeq++
+
+	var records []*logRecord
+	var modifiedMsgs []*MessageInfo
+	var failedUIDs []uint32
+
+	for _, uid := range uids {
+		msg := mb.message(uid)
+		if msg == nil {
+			continue
+		}
+
+		if unchangedSince > 0 && msg.ModSeq > unchangedSince {
+			failedUIDs = append(failedUIDs, uid)
+			continue
+		}
+
+		newFlags := applyFlagOperation(msg.Flags, op, flags)
+		if equalFlags(newFlags, msg.Flags) {
+			continue
+		}
+
+		newMsg := msg.clone()
+		newMsg.Flags = newFlags
+		newMsg.ModSeq = state.HighestModSeq
+
+		records = append(records, &logRecord{
+			Type:      logRecordPutMessage,
+			MailboxId: mb.Id,
+			Message:   newMsg,
+		})
+
+		modifiedMsgs = append(modifiedMsgs, newMsg.clone())
+	}
+
+	if len(records) == 0 {
+		return nil, failedUIDs, nil
+	}
+
+	records = append(records, &logRecord{
+		Type:      logRecordPutMailbox,
+		MailboxId: mb.Id,
+		Mailbox:   &state,
+	})
+
+	if err := a.commit(records...); err != nil {
+		return nil, nil, err
+	}
+
+	return modifiedMsgs, failedUIDs, nil
+}
+
+// ExpungeMessages deletes messages from a mailbox. Messages which do not exist
+// are ignored.
+func (a *Account) ExpungeMessages(mailboxName string, uids []uint32) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(mailboxName)
+	if err != nil {
+		return err
+	}
+
+	state := mb.mailboxState
+	state.HighestModSeq++
+
+	var records []*logRecord
+	var filePaths []string
+
+	for _, uid := range uids {
+		if mb.message(uid) == nil {
+			continue
+		}
+
+		records = append(records, &logRecord{
+			Type:      logRecordDeleteMessage,
+			MailboxId: mb.Id,
+			UID:       uid,
+			ModSeq:    state.HighestModSeq,
+		})
+
+		filePaths = append(filePaths, a.messageFilePath(mb.Id, uid))
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	records = append(records, &logRecord{
+		Type:      logRecordPutMailbox,
+		MailboxId: mb.Id,
+		Mailbox:   &state,
+	})
+
+	if err := a.commit(records...); err != nil {
+		return err
+	}
+
+	// Files which cannot be deleted now will be the next time the account
+	// is opened.
+	removeFiles(filePaths)
+
+	return nil
+}
+
+// ExpungedMessages returns the UIDs of the messages of a mailbox which were
+// expunged after a modification sequence (RFC 7162 3.2.5.). If this
+// information is not available anymore, the UIDs of all messages which may
+// have been expunged are returned, i.e. all UIDs lower than UIDNEXT which do
+// not belong to an existing message.
+func (a *Account) ExpungedMessages(mailboxName string, modSeq uint64) ([]uint32, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mb, err := a.mailbox(mailboxName)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+
+	if modSeq < mb.expungedModSeq {
+		for uid, i := uint32(1), 0; uid < mb.UIDNext; uid++ {
+			for i < len(mb.messages) && mb.messages[i].UID < uid {
+				i++
+			}
+
+			if i == len(mb.messages) || mb.messages[i].UID != uid {
+				uids = append(uids, uid)
+			}
+		}
+
+		return uids, nil
+	}
+
+	for _, msg := range mb.expunged {
+		if msg.ModSeq > modSeq {
+			uids = append(uids, msg.UID)
+		}
+	}
+
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	return uids, nil
+}
+
+// commit writes a change to the write-ahead log and applies it. The lock
+// must be held.
+func (a *Account) commit(records ...*logRecord) error {
+	if err := a.wal.append(records); err != nil {
+		return err
+	}
+
+	a.apply(records)
+
+	for watcher := range a.watchers {
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+
+	if a.wal.size > int64(a.maxLogSize) {
+		if err := a.checkpoint(); err != nil {
+			// The change is safely stored in the log
+			a.Log.Error("cannot write snapshot: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (a *Account) apply(records []*logRecord) {
+	for _, record := range records {
+		mb := a.mailboxes[record.MailboxId]
+
+		switch record.Type {
+		case logRecordPutMailbox:
+			state := *record.Mailbox
+			state.Messages = nil
+			state.Expunged = nil
+			state.ExpungedModSeq = 0
+
+			if mb == nil {
+				mb = &mailbox{}
+				a.mailboxes[state.Id] = mb
+			} else {
+				delete(a.mailboxNames, mb.Name)
+			}
+
+			mb.mailboxState = state
+			a.mailboxNames[state.Name] = state.Id
+
+			a.nextMailboxId = max(a.nextMailboxId, state.Id+1)
+			a.lastValidity = max(a.lastValidity, state.UIDValidity)
+
+		case logRecordDeleteMailbox:
+			if mb != nil {
+				delete(a.mailboxNames, mb.Name)
+				delete(a.mailboxes, mb.Id)
+			}
+
+		case logRecordPutMessage:
+			if mb == nil {
+				continue
+			}
+
+			msg := record.Message.clone()
+
+			if i, found := mb.messageIndex(msg.UID); found {
+				mb.messages[i] = msg
+			} else {
+				mb.messages = append(mb.messages, nil)
+				copy(mb.messages[i+1:], mb.messages[i:])
+				mb.messages[i] = msg
+			}
+
+		case logRecordDeleteMessage:
+			if mb == nil {
+				continue
+			}
+
+			if i, found := mb.messageIndex(record.UID); found {
+				mb.messages = append(mb.messages[:i], mb.messages[i+1:]...)
+				mb.addExpungedMessage(record.UID, record.ModSeq)
+			}
+		}
+	}
+}
+
+// checkpoint writes a snapshot of the index and truncates the log. The lock
+// must be held.
+func (a *Account) checkpoint() error {
+	s := snapshot{
+		NextMailboxId:   a.nextMailboxId,
+		LastUIDValidity: a.lastValidity,
+	}
+
+	for _, mb := range a.mailboxes {
+		state := mb.mailboxState
+		state.Messages = mb.messages
+		state.Expunged = mb.expunged
+		state.ExpungedModSeq = mb.expungedModSeq
+
+		s.Mailboxes = append(s.Mailboxes, &state)
+	}
+
+	sort.Slice(s.Mailboxes, func(i, j int) bool {
+		return s.Mailboxes[i].Id < s.Mailboxes[j].Id
+	})
+
+	data, err := json.Marshal(&s)
+	if err != nil {
+		return fmt.Errorf("cannot encode snapshot: %w", err)
+	}
+
+	filePath := path.Join(a.dirPath, indexFileName)
+
+	if err := utils.WriteFileAtomically(filePath, data); err != nil {
+		return err
+	}
+
+	return a.wal.truncate()
+}
+
+func (a *Account) loadSnapshot() error {
+	filePath := path.Join(a.dirPath, indexFileName)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("cannot decode %q: %w", filePath, err)
+	}
+
+	a.nextMailboxId = max(a.nextMailboxId, s.NextMailboxId)
+	a.lastValidity = s.LastUIDValidity
+
+	for _, state := range s.Mailboxes {
+		a.apply([]*logRecord{{
+			Type:      logRecordPutMailbox,
+			MailboxId: state.Id,
+			Mailbox:   state,
+		}})
+
+		mb := a.mailboxes[state.Id]
+		mb.messages = state.Messages
+		mb.expunged = state.Expunged
+		mb.expungedModSeq = state.ExpungedModSeq
+
+		sort.Slice(mb.messages, func(i, j int) bool {
+			return mb.messages[i].UID < mb.messages[j].UID
+		})
+	}
+
+	return nil
+}
+
+// deleteOrphanFiles deletes message files which are not referenced by the
+// index, i.e. files written for changes which were never committed or not
+// deleted after a change was committed.
+func (a *Account) deleteOrphanFiles() error {
+	messagesPath := path.Join(a.dirPath, messagesDirName)
+
+	entries, err := os.ReadDir(messagesPath)
+	if err != nil {
+		return fmt.Errorf("cannot read directory %q: %w", messagesPath, err)
+	}
+
+	for _, entry := range entries {
+		entryPath := path.Join(messagesPath, entry.Name())
+
+		if entry.Name() == tmpMessagesDirName {
+			if err := a.deleteDirectoryContent(entryPath, nil); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		id, err := strconv.ParseUint(entry.Name(), 10, 32)
+		mb := a.mailboxes[uint32(id)]
+
+		if err != nil || mb == nil {
+			a.Log.Info("deleting orphan directory %q", entryPath)
+
+			if err := os.RemoveAll(entryPath); err != nil {
+				return fmt.Errorf("cannot delete %q: %w", entryPath, err)
+			}
+
+			continue
+		}
+
+		keep := func(name string) bool {
+			uid, err := strconv.ParseUint(name, 10, 32)
+			return err == nil && mb.message(uint32(uid)) != nil
+		}
+
+		if err := a.deleteDirectoryContent(entryPath, keep); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *Account) deleteDirectoryContent(dirPath string, keep func(string) bool) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return fmt.Errorf("cannot read directory %q: %w", dirPath, err)
+	}
+
+	for _, entry := range entries {
+		if keep != nil && keep(entry.Name()) {
+			continue
+		}
+
+		filePath := path.Join(dirPath, entry.Name())
+
+		a.Log.Info("deleting orphan file %q", filePath)
+
+		if err := os.RemoveAll(filePath); err != nil {
+			return fmt.Errorf("cannot delete %q: %w", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+func (a *Account) mailboxDirPath(id uint32) string {
+	return path.Join(a.dirPath, messagesDirName,
+		strconv.FormatUint(uint64(id), 10))
+}
+
+func (a *Account) messageFilePath(mailboxId, uid uint32) string {
+	return path.Join(a.mailboxDirPath(mailboxId),
+		strconv.FormatUint(uint64(uid), 10))
+}
+
+func (a *Account) writeMessageFile(filePath string, data []byte) error {
+	tmpPath := path.Join(a.dirPath, messagesDirName, tmpMessagesDirName,
+		path.Base(path.Dir(filePath))+"-"+path.Base(filePath)+tmpFileNameSuffix)
+
+	if err := utils.WriteFileSync(tmpPath, data); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cannot rename %q: %w", tmpPath, err)
+	}
+
+	if err := utils.SyncDirectory(path.Dir(filePath)); err != nil {
+		os.Remove(filePath)
+		return err
+	}
+
+	return nil
+}
+
+func copyFile(srcPath, destPath string) error {
+	// Message files are never modified so they can be shared
+	if err := os.Link(srcPath, destPath); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", srcPath, err)
+	}
+	defer src.Close()
+
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %w", destPath, err)
+	}
+
+	if _, err := io.Copy(dest, src); err != nil {
+		dest.Close()
+		return fmt.Errorf("cannot copy %q to %q: %w", srcPath, destPath, err)
+	}
+
+	if err := dest.Sync(); err != nil {
+		dest.Close()
+		return fmt.Errorf("cannot sync %q: %w", destPath, err)
+	}
+
+	if err := dest.Close(); err != nil {
+		return fmt.Errorf("cannot close %q: %w", destPath, err)
+	}
+
+	return nil
+}
+
+func removeFiles(filePaths []string) {
+	for _, filePath := range filePaths {
+		os.Remove(filePath)
+	}
+}
@@ -0,0 +1,139 @@
+package mailstore
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+// Envelope contains the header fields indexed for each message so that
+// listing a mailbox does not require reading and parsing messages. Only the
+// first occurrence of each field is used.
+type Envelope struct {
+	Date      *time.Time `json:"date,omitempty"`
+	Subject   string     `json:"subject,omitempty"`
+	From      []Address  `json:"from,omitempty"`
+	Sender    []Address  `json:"sender,omitempty"`
+	ReplyTo   []Address  `json:"reply_to,omitempty"`
+	To        []Address  `json:"to,omitempty"`
+	Cc        []Address  `json:"cc,omitempty"`
+	Bcc       []Address  `json:"bcc,omitempty"`
+	InReplyTo string     `json:"in_reply_to,omitempty"`
+	MessageId string     `json:"message_id,omitempty"`
+}
+
+// Address is a mailbox; group addresses are replaced by their members.
+type Address struct {
+	Name      string `json:"name,omitempty"`
+	LocalPart string `json:"local_part"`
+	Domain    string `json:"domain"`
+}
+
+func ParseEnvelope(data []byte) *Envelope {
+	var envelope Envelope
+
+	// Only the header is needed; the body may not even be a valid IMF body
+	// (e.g. lines longer than the maximum length).
+	header := data
+	if end := bytes.Index(data, []byte("\r\n\r\n")); end >= 0 {
+		header = data[:end+2]
+	} else if end := bytes.Index(data, []byte("\n\n")); end >= 0 {
+		header = data[:end+1]
+	}
+
+	decoder := imf.NewMessageDecoder()
+	decoder.MixedEOL = true
+
+	msg, err := decoder.DecodeAll(header)
+	if err != nil {
+		return &envelope
+	}
+
+	seen := make(map[string]bool)
+
+	for _, field := range msg.Header {
+		if field.HasError() {
+			continue
+		}
+
+		switch v := field.Value.(type) {
+		case *imf.DateFieldValue:
+			if !seen["date"] {
+				envelope.Date = (*time.Time)(v)
+			}
+			seen["date"] = true
+
+		case *imf.SubjectFieldValue:
+			if !seen["subject"] {
+				envelope.Subject = string(*v)
+			}
+			seen["subject"] = true
+
+		case *imf.FromFieldValue:
+			setAddresses(&envelope.From, imf.Addresses(*v))
+
+		case *imf.SenderFieldValue:
+			setAddresses(&envelope.Sender, imf.Addresses{v.Address})
+
+		case *imf.ReplyToFieldValue:
+			setAddresses(&envelope.ReplyTo, imf.Addresses(*v))
+
+		case *imf.ToFieldValue:
+			setAddresses(&envelope.To, imf.Addresses(*v))
+
+		case *imf.CcFieldValue:
+			setAddresses(&envelope.Cc, imf.Addresses(*v))
+
+		case *imf.BccFieldValue:
+			setAddresses(&envelope.Bcc, imf.Addresses(*v))
+
+		case *imf.InReplyToFieldValue:
+			if !seen["in-reply-to"] {
+				envelope.InReplyTo = imf.MessageIds(*v).String()
+			}
+			seen["in-reply-to"] = true
+
+		case *imf.MessageIdFieldValue:
+			if !seen["message-id"] {
+				envelope.MessageId = imf.MessageId(*v).String()
+			}
+			seen["message-id"] = true
+		}
+	}
+
+	return &envelope
+}
+
+func setAddresses(envelopeAddrs *[]Address, addrs imf.Addresses) {
+	if *envelopeAddrs != nil {
+		return
+	}
+
+	*envelopeAddrs = []Address{}
+
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *imf.Mailbox:
+			*envelopeAddrs = append(*envelopeAddrs, newAddress(v))
+
+		case *imf.Group:
+			for _, mailbox := range v.Mailboxes {
+				*envelopeAddrs = append(*envelopeAddrs, newAddress(mailbox))
+			}
+		}
+	}
+}
+
+func newAddress(mailbox *imf.Mailbox) Address {
+	addr := Address{
+		LocalPart: mailbox.LocalPart,
+		Domain:    string(mailbox.Domain),
+	}
+
+	if mailbox.DisplayName != nil {
+		addr.Name = *mailbox.DisplayName
+	}
+
+	return addr
+}
@@ -0,0 +1,204 @@
+package mailstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+)
+
+// The write-ahead log contains one line per committed change. Each line
+// starts with the CRC-32 checksum of the rest of the line so that a change
+// partially written during a crash can be detected and discarded. A change is
+// made of one or more records which are always applied together.
+//
+// Records contain the new state of objects rather than operations: replaying
+// a record twice, for example because the process stopped after writing a
+// snapshot but before truncating the log, is harmless.
+
+type logRecordType string
+
+const (
+	logRecordPutMailbox    logRecordType = "put_mailbox"
+	logRecordDeleteMailbox logRecordType = "delete_mailbox"
+	logRecordPutMessage    logRecordType = "put_message"
+	logRecordDeleteMessage logRecordType = "delete_message"
+)
+
+type logRecord struct {
+	Type      logRecordType `json:"type"`
+	MailboxId uint32        `json:"mailbox_id"`
+	Mailbox   *mailboxState `json:"mailbox,omitempty"`
+	Message   *MessageInfo  `json:"message,omitempty"`
+	UID       uint32        `json:"uid,omitempty"`
+	ModSeq    uint64        `json:"modseq,omitempty"`
+}
+
+type writeAheadLog struct {
+	path string
+	file *os.File
+	size int64
+}
+
+// openLog opens the log file, creating it if necessary, and returns the
+// changes it contains. Invalid data at the end of the file are truncated.
+func openLog(filePath string) (*writeAheadLog, [][]*logRecord, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open %q: %w", filePath, err)
+	}
+
+	changes, size, err := readLog(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("cannot truncate %q: %w", filePath, err)
+	}
+
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("cannot seek in %q: %w", filePath, err)
+	}
+
+	l := writeAheadLog{
+		path: filePath,
+		file: file,
+		size: size,
+	}
+
+	return &l, changes, nil
+}
+
+// readLog returns all valid changes and the offset of the end of the last
+// one.
+func readLog(r io.Reader) ([][]*logRecord, int64, error) {
+	var changes [][]*logRecord
+	var size int64
+
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// Either the end of the file or a partially written line
+				break
+			}
+
+			return nil, 0, err
+		}
+
+		records, err := decodeLogLine(line)
+		if err != nil {
+			// Nothing after a corrupted line can be trusted
+			break
+		}
+
+		changes = append(changes, records)
+		size += int64(len(line))
+	}
+
+	return changes, size, nil
+}
+
+func encodeLogLine(records []*logRecord) ([]byte, error) {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%08x ", crc32.ChecksumIEEE(data))
+	buf.Write(data)
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), nil
+}
+
+func decodeLogLine(line []byte) ([]*logRecord, error) {
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+
+	checksumData, data, found := bytes.Cut(line, []byte{' '})
+	if !found || len(checksumData) != 8 {
+		return nil, fmt.Errorf("invalid line format")
+	}
+
+	checksum, err := strconv.ParseUint(string(checksumData), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum: %w", err)
+	}
+
+	if crc32.ChecksumIEEE(data) != uint32(checksum) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+
+	var records []*logRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("invalid records: %w", err)
+	}
+
+	return records, nil
+}
+
+// append writes a change to the log; it returns once the change is stored on
+// disk.
+func (l *writeAheadLog) append(records []*logRecord) error {
+	line, err := encodeLogLine(records)
+	if err != nil {
+		return fmt.Errorf("cannot encode records: %w", err)
+	}
+
+	if _, err := l.file.Write(line); err != nil {
+		l.rollback()
+		return fmt.Errorf("cannot write %q: %w", l.path, err)
+	}
+
+	if err := l.file.Sync(); err != nil {
+		l.rollback()
+		return fmt.Errorf("cannot sync %q: %w", l.path, err)
+	}
+
+	l.size += int64(len(line))
+
+	return nil
+}
+
+// rollback removes data written after the last valid change. Leaving a
+// partial line would hide all the changes written after it; leaving a change
+// which was not synced would cause a failed operation to be replayed.
+func (l *writeAheadLog) rollback() {
+	l.file.Truncate(l.size)
+	l.file.Seek(l.size, io.SeekStart)
+}
+
+func (l *writeAheadLog) truncate() error {
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("cannot truncate %q: %w", l.path, err)
+	}
+
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("cannot seek in %q: %w", l.path, err)
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync %q: %w", l.path, err)
+	}
+
+	l.size = 0
+
+	return nil
+}
+
+func (l *writeAheadLog) close() error {
+	return l.file.Close()
+}
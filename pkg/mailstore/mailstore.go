@@ -0,0 +1,358 @@
+package mailstore
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galdor/go-ejson"
+	"github.com/galdor/go-log"
+)
+
+// The message store contains the mailboxes of each user. It is designed for
+// mailbox access protocols: mailboxes have a UIDVALIDITY value and assign
+// increasing UIDs to messages (RFC 9051 2.3.1.1.), and each change increases
+// the modification sequence of the mailbox (RFC 7162 3.1.).
+//
+// Each user has a directory containing:
+//
+//   - "index.json", a snapshot of the index of all mailboxes;
+//   - "log", the write-ahead log containing changes made since the snapshot;
+//   - "messages/<mailbox-id>/<uid>", the content of each message.
+//
+// Message files are written before the change referencing them is logged,
+// and deleted after the change removing them is logged. Files which are not
+// referenced by the index after a crash are deleted when the account is
+// opened.
+
+const (
+	DefaultMaxLogSize = 1024 * 1024
+
+	InboxName = "INBOX"
+
+	// The hierarchy separator of mailbox names
+	Separator = "/"
+
+	// The number of expunged messages remembered for each mailbox
+	maxExpungedMessages = 10_000
+)
+
+var (
+	ErrInvalidUser        = errors.New("invalid user name")
+	ErrMailboxNotFound    = errors.New("mailbox not found")
+	ErrMailboxExists      = errors.New("mailbox already exists")
+	ErrInvalidMailboxName = errors.New("invalid mailbox name")
+	ErrInboxOperation     = errors.New("operation not allowed on INBOX")
+	ErrMessageNotFound    = errors.New("message not found")
+	ErrInvalidFlag        = errors.New("invalid flag")
+	ErrInvalidSpecialUse  = errors.New("invalid special use attribute")
+)
+
+type Cfg struct {
+	Log *log.Logger `json:"-"`
+
+	Path string `json:"path"`
+
+	// The size of the write-ahead log (bytes) after which a snapshot is
+	// written and the log is truncated.
+	MaxLogSize int `json:"max_log_size,omitempty"`
+}
+
+func (cfg *Cfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("path", cfg.Path)
+
+	v.CheckIntMin("max_log_size", cfg.MaxLogSize, 0)
+}
+
+type MailboxInfo struct {
+	Id            uint32 // never reused, even after deletion
+	Name          string
+	UIDValidity   uint32
+	UIDNext       uint32
+	HighestModSeq uint64
+	SpecialUse    string // empty if the mailbox has no special use
+	NbMessages    int
+	NbUnseen      int
+}
+
+type MessageInfo struct {
+	UID          uint32    `json:"uid"`
+	ModSeq       uint64    `json:"modseq"`
+	Flags        []string  `json:"flags,omitempty"`
+	InternalDate time.Time `json:"internal_date"`
+	Size         int64     `json:"size"`
+	Envelope     *Envelope `json:"envelope"`
+}
+
+type ExpungedMessage struct {
+	UID    uint32 `json:"uid"`
+	ModSeq uint64 `json:"modseq"`
+}
+
+func (info *MessageInfo) HasFlag(flag string) bool {
+	for _, f := range info.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (info *MessageInfo) clone() *MessageInfo {
+	info2 := *info
+	info2.Flags = append([]string(nil), info.Flags...)
+	return &info2
+}
+
+// RFC 9051 2.3.2. System flags start with a backslash; other flags are
+// keywords.
+const (
+	FlagSeen     = `\Seen`
+	FlagAnswered = `\Answered`
+	FlagFlagged  = `\Flagged`
+	FlagDeleted  = `\Deleted`
+	FlagDraft    = `\Draft`
+)
+
+var SystemFlags = []string{
+	FlagSeen,
+	FlagAnswered,
+	FlagFlagged,
+	FlagDeleted,
+	FlagDraft,
+}
+
+// RFC 6154 2. Special use attributes identify mailboxes used for common
+// purposes. \All and \Flagged are not supported since they designate
+// virtual mailboxes.
+const (
+	SpecialUseArchive = `\Archive`
+	SpecialUseDrafts  = `\Drafts`
+	SpecialUseJunk    = `\Junk`
+	SpecialUseSent    = `\Sent`
+	SpecialUseTrash   = `\Trash`
+)
+
+var SpecialUses = []string{
+	SpecialUseArchive,
+	SpecialUseDrafts,
+	SpecialUseJunk,
+	SpecialUseSent,
+	SpecialUseTrash,
+}
+
+func normalizeSpecialUse(use string) (string, error) {
+	for _, use2 := range SpecialUses {
+		if strings.EqualFold(use, use2) {
+			return use2, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w %q", ErrInvalidSpecialUse, use)
+}
+
+type FlagOperation string
+
+const (
+	FlagOperationReplace FlagOperation = "replace"
+	FlagOperationAdd     FlagOperation = "add"
+	FlagOperationRemove  FlagOperation = "remove"
+)
+
+// normalizeFlags returns a sorted list of unique flags, with system flags
+// using their canonical case. Flags are case-insensitive.
+func normalizeFlags(flags []string) ([]string, error) {
+	table := make(map[string]string)
+
+	for _, flag := range flags {
+		canonicalFlag, err := normalizeFlag(flag)
+		if err != nil {
+			return nil, err
+		}
+
+		table[strings.ToLower(canonicalFlag)] = canonicalFlag
+	}
+
+	normalizedFlags := make([]string, 0, len(table))
+	for _, flag := range table {
+		normalizedFlags = append(normalizedFlags, flag)
+	}
+
+	sort.Strings(normalizedFlags)
+
+	return normalizedFlags, nil
+}
+
+// IsValidFlag returns true if a flag is either a system flag or a valid
+// keyword.
+func IsValidFlag(flag string) bool {
+	_, err := normalizeFlag(flag)
+	return err == nil
+}
+
+func normalizeFlag(flag string) (string, error) {
+	if strings.HasPrefix(flag, `\`) {
+		for _, systemFlag := range SystemFlags {
+			if strings.EqualFold(flag, systemFlag) {
+				return systemFlag, nil
+			}
+		}
+
+		return "", fmt.Errorf("%w %q", ErrInvalidFlag, flag)
+	}
+
+	// RFC 9051 9. Keywords are atoms
+	if flag == "" {
+		return "", fmt.Errorf("%w %q", ErrInvalidFlag, flag)
+	}
+
+	for i := 0; i < len(flag); i++ {
+		c := flag[i]
+
+		if c <= 0x20 || c >= 0x7f || strings.IndexByte(`(){%*"\]`, c) >= 0 {
+			return "", fmt.Errorf("%w %q", ErrInvalidFlag, flag)
+		}
+	}
+
+	return flag, nil
+}
+
+func applyFlagOperation(flags []string, op FlagOperation, opFlags []string) []string {
+	var newFlags []string
+
+	switch op {
+	case FlagOperationReplace:
+		newFlags = opFlags
+
+	case FlagOperationAdd:
+		newFlags = append(append([]string(nil), flags...), opFlags...)
+
+	case FlagOperationRemove:
+		for _, flag := range flags {
+			removed := false
+
+			for _, opFlag := range opFlags {
+				if strings.EqualFold(flag, opFlag) {
+					removed = true
+					break
+				}
+			}
+
+			if !removed {
+				newFlags = append(newFlags, flag)
+			}
+		}
+	}
+
+	// Flags are already valid
+	newFlags, _ = normalizeFlags(newFlags)
+
+	return newFlags
+}
+
+func equalFlags(flags1, flags2 []string) bool {
+	if len(flags1) != len(flags2) {
+		return false
+	}
+
+	for i := range flags1 {
+		if flags1[i] != flags2[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NormalizeMailboxName returns the canonical form of a mailbox name: "INBOX"
+// is case-insensitive (RFC 9051 5.1.).
+func NormalizeMailboxName(name string) string {
+	if strings.EqualFold(name, InboxName) {
+		return InboxName
+	}
+
+	return name
+}
+
+func IsValidMailboxName(name string) bool {
+	if name == "" || strings.HasPrefix(name, Separator) ||
+		strings.HasSuffix(name, Separator) ||
+		strings.Contains(name, Separator+Separator) {
+		return false
+	}
+
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || c == '*' || c == '%' {
+			return false
+		}
+	}
+
+	return true
+}
+
+type Store struct {
+	Cfg Cfg
+	Log *log.Logger
+
+	accounts map[string]*Account
+	mutex    sync.Mutex
+}
+
+func NewStore(cfg Cfg) *Store {
+	if cfg.MaxLogSize == 0 {
+		cfg.MaxLogSize = DefaultMaxLogSize
+	}
+
+	s := Store{
+		Cfg: cfg,
+		Log: cfg.Log,
+
+		accounts: make(map[string]*Account),
+	}
+
+	return &s
+}
+
+// Account returns the account of a user, opening it if necessary.
+func (s *Store) Account(user string) (*Account, error) {
+	if user == "" || user[0] == '.' || strings.ContainsAny(user, "/\\\x00") {
+		return nil, ErrInvalidUser
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if account, found := s.accounts[user]; found {
+		return account, nil
+	}
+
+	logger := s.Log.Child("account", log.Data{"user": user})
+
+	account, err := openAccount(path.Join(s.Cfg.Path, user), s.Cfg.MaxLogSize,
+		logger)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open account of user %q: %w", user, err)
+	}
+
+	s.accounts[user] = account
+
+	return account, nil
+}
+
+func (s *Store) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for user, account := range s.accounts {
+		if err := account.close(); err != nil {
+			s.Log.Error("cannot close account of user %q: %v", user, err)
+		}
+	}
+
+	s.accounts = make(map[string]*Account)
+}
@@ -0,0 +1,407 @@
+package mailstore
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-log"
+)
+
+const testMessage = "From: Alice <alice@example.org>\r\n" +
+	"To: bob@example.com, team: carol@example.com;\r\n" +
+	"Subject: Meeting\r\n" +
+	"Date: Mon, 1 Jul 2024 12:00:00 +0000\r\n" +
+	"Message-ID: <2@example.org>\r\n" +
+	"In-Reply-To: <1@example.org>\r\n" +
+	"\r\n" +
+	"Hello Bob.\r\n"
+
+func newTestStore(dirPath string, maxLogSize int) *Store {
+	return NewStore(Cfg{
+		Log:        log.DefaultLogger("test"),
+		Path:       dirPath,
+		MaxLogSize: maxLogSize,
+	})
+}
+
+func openTestAccount(t *testing.T, s *Store) *Account {
+	account, err := s.Account("bob")
+	if err != nil {
+		t.Fatalf("cannot open account: %v", err)
+	}
+
+	return account
+}
+
+func appendTestMessage(t *testing.T, a *Account, mailbox string, flags ...string) uint32 {
+	uid, err := a.AppendMessage(mailbox, []byte(testMessage), flags,
+		time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("cannot append message: %v", err)
+	}
+
+	return uid
+}
+
+func mailboxInfo(t *testing.T, a *Account, name string) *MailboxInfo {
+	info, err := a.Mailbox(name)
+	if err != nil {
+		t.Fatalf("cannot read mailbox %q: %v", name, err)
+	}
+
+	return info
+}
+
+func TestAccount(t *testing.T) {
+	s := newTestStore(t.TempDir(), DefaultMaxLogSize)
+	defer s.Close()
+
+	a := openTestAccount(t, s)
+
+	inbox := mailboxInfo(t, a, "inbox")
+	if inbox.Name != InboxName || inbox.UIDNext != 1 {
+		t.Fatalf("invalid INBOX %#v", inbox)
+	}
+
+	// Messages
+	uid1 := appendTestMessage(t, a, "INBOX")
+	uid2 := appendTestMessage(t, a, "INBOX", `\seen`, "$Important")
+
+	if uid1 != 1 || uid2 != 2 {
+		t.Errorf("invalid uids %d, %d", uid1, uid2)
+	}
+
+	msg, err := a.Message("INBOX", uid2)
+	if err != nil {
+		t.Fatalf("cannot read message: %v", err)
+	}
+
+	if strings.Join(msg.Flags, " ") != `$Important \Seen` {
+		t.Errorf("invalid flags %q", msg.Flags)
+	}
+
+	envelope := msg.Envelope
+
+	if envelope.Subject != "Meeting" ||
+		envelope.MessageId != "<2@example.org>" ||
+		envelope.InReplyTo != "<1@example.org>" ||
+		envelope.Date == nil || envelope.Date.Day() != 1 {
+		t.Errorf("invalid envelope %#v", envelope)
+	}
+
+	if len(envelope.From) != 1 || envelope.From[0] != (Address{"Alice",
+		"alice", "example.org"}) {
+		t.Errorf("invalid from addresses %#v", envelope.From)
+	}
+
+	if len(envelope.To) != 2 || envelope.To[1].LocalPart != "carol" {
+		t.Errorf("invalid to addresses %#v", envelope.To)
+	}
+
+	data, err := a.MessageData("INBOX", uid1)
+	if err != nil {
+		t.Fatalf("cannot read message data: %v", err)
+	} else if string(data) != testMessage {
+		t.Errorf("invalid message data %q", data)
+	}
+
+	if _, err := a.AppendMessage("INBOX", nil, []string{`\Recent`},
+		time.Time{}); !errors.Is(err, ErrInvalidFlag) {
+		t.Errorf("invalid flag accepted")
+	}
+
+	// Flags
+	modSeq := mailboxInfo(t, a, "INBOX").HighestModSeq
+
+	msgs, err := a.StoreFlags("INBOX", []uint32{uid1, uid2, 42},
+		FlagOperationAdd, []string{`\Seen`})
+	if err != nil {
+		t.Fatalf("cannot store flags: %v", err)
+	}
+
+	if len(msgs) != 1 || msgs[0].UID != uid1 || msgs[0].ModSeq <= modSeq {
+		t.Errorf("invalid modified messages %#v", msgs)
+	}
+
+	if info := mailboxInfo(t, a, "INBOX"); info.NbUnseen != 0 ||
+		info.HighestModSeq != msgs[0].ModSeq {
+		t.Errorf("invalid mailbox %#v", info)
+	}
+
+	// Mailboxes
+	if err := a.CreateMailbox("Archives/2024"); err != nil {
+		t.Fatalf("cannot create mailbox: %v", err)
+	}
+
+	if err := a.CreateMailbox("archives/2024"); err != nil {
+		t.Fatalf("cannot create mailbox: %v", err)
+	}
+
+	if err := a.CreateMailbox("Archives/2024"); !errors.Is(err, ErrMailboxExists) {
+		t.Errorf("duplicate mailbox created")
+	}
+
+	if err := a.CreateMailbox("Archives//2024"); !errors.Is(err, ErrInvalidMailboxName) {
+		t.Errorf("invalid mailbox created")
+	}
+
+	uids, err := a.CopyMessages("INBOX", []uint32{uid2, 42}, "Archives/2024")
+	if err != nil {
+		t.Fatalf("cannot copy messages: %v", err)
+	}
+
+	if len(uids) != 2 || uids[0] != 1 || uids[1] != 0 {
+		t.Errorf("invalid copied message uids %v", uids)
+	}
+
+	if err := a.RenameMailbox("Archives", "Old"); !errors.Is(err, ErrMailboxNotFound) {
+		t.Errorf("unknown mailbox renamed")
+	}
+
+	if err := a.CreateMailbox("Archives"); err != nil {
+		t.Fatalf("cannot create mailbox: %v", err)
+	}
+
+	if err := a.RenameMailbox("Archives", "Old"); err != nil {
+		t.Fatalf("cannot rename mailbox: %v", err)
+	}
+
+	if data, err := a.MessageData("Old/2024", 1); err != nil {
+		t.Errorf("cannot read copied message: %v", err)
+	} else if string(data) != testMessage {
+		t.Errorf("invalid copied message data %q", data)
+	}
+
+	if err := a.RenameMailbox("INBOX", "Old INBOX"); !errors.Is(err, ErrInboxOperation) {
+		t.Errorf("INBOX renamed")
+	}
+
+	var names []string
+	for _, info := range a.Mailboxes() {
+		names = append(names, info.Name)
+	}
+
+	if strings.Join(names, ", ") != "INBOX, Old, Old/2024, archives/2024" {
+		t.Errorf("invalid mailboxes %q", names)
+	}
+
+	// Expunge
+	if err := a.ExpungeMessages("INBOX", []uint32{uid1}); err != nil {
+		t.Fatalf("cannot expunge messages: %v", err)
+	}
+
+	if _, err := a.MessageData("INBOX", uid1); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expunged message still readable")
+	}
+
+	// Copies share the file of the original message
+	if err := a.ExpungeMessages("INBOX", []uint32{uid2}); err != nil {
+		t.Fatalf("cannot expunge messages: %v", err)
+	}
+
+	if _, err := a.MessageData("Old/2024", 1); err != nil {
+		t.Errorf("cannot read copied message: %v", err)
+	}
+
+	if info := mailboxInfo(t, a, "INBOX"); info.NbMessages != 0 ||
+		info.UIDNext != 3 {
+		t.Errorf("invalid mailbox %#v", info)
+	}
+
+	if err := a.DeleteMailbox("Old/2024"); err != nil {
+		t.Fatalf("cannot delete mailbox: %v", err)
+	}
+
+	if err := a.DeleteMailbox("INBOX"); !errors.Is(err, ErrInboxOperation) {
+		t.Errorf("INBOX deleted")
+	}
+}
+
+func TestAccountRecovery(t *testing.T) {
+	dirPath := t.TempDir()
+
+	// Small enough to force checkpoints
+	s := newTestStore(dirPath, 4096)
+
+	a := openTestAccount(t, s)
+
+	for i := 0; i < 20; i++ {
+		appendTestMessage(t, a, "INBOX")
+	}
+
+	if err := a.CreateMailbox("Drafts"); err != nil {
+		t.Fatalf("cannot create mailbox: %v", err)
+	}
+
+	validity := mailboxInfo(t, a, "Drafts").UIDValidity
+
+	if err := a.DeleteMailbox("Drafts"); err != nil {
+		t.Fatalf("cannot delete mailbox: %v", err)
+	}
+
+	if _, err := a.StoreFlags("INBOX", []uint32{3}, FlagOperationReplace,
+		[]string{`\Flagged`}); err != nil {
+		t.Fatalf("cannot store flags: %v", err)
+	}
+
+	if err := a.ExpungeMessages("INBOX", []uint32{1, 2}); err != nil {
+		t.Fatalf("cannot expunge messages: %v", err)
+	}
+
+	expectedInfo := mailboxInfo(t, a, "INBOX")
+
+	if _, err := os.Stat(path.Join(dirPath, "bob", indexFileName)); err != nil {
+		t.Errorf("snapshot not written: %v", err)
+	}
+
+	// Simulate a crash: the log is not truncated, a change is partially
+	// written and a message file was written without being committed.
+	a.wal.close()
+
+	logFile, err := os.OpenFile(path.Join(dirPath, "bob", logFileName),
+		os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("cannot open log: %v", err)
+	}
+
+	logFile.WriteString(`0badc0de [{"type":"delete_mailbox","mailbox_id":1}]`)
+	logFile.Close()
+
+	orphanPath := path.Join(dirPath, "bob", messagesDirName, "1", "42")
+	if err := os.WriteFile(orphanPath, []byte(testMessage), 0600); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+
+	s = newTestStore(dirPath, 4096)
+	defer s.Close()
+
+	a = openTestAccount(t, s)
+
+	info := mailboxInfo(t, a, "INBOX")
+	if *info != *expectedInfo {
+		t.Errorf("mailbox is %#v after recovery but should be %#v",
+			info, expectedInfo)
+	}
+
+	msg, err := a.Message("INBOX", 3)
+	if err != nil {
+		t.Fatalf("cannot read message: %v", err)
+	} else if !msg.HasFlag(`\Flagged`) || msg.Envelope.Subject != "Meeting" {
+		t.Errorf("invalid message %#v", msg)
+	}
+
+	if _, err := a.Message("INBOX", 1); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expunged message found after recovery")
+	}
+
+	if uids, err := a.ExpungedMessages("INBOX", 0); err != nil {
+		t.Errorf("cannot read expunged messages: %v", err)
+	} else if len(uids) != 2 || uids[0] != 1 || uids[1] != 2 {
+		t.Errorf("invalid expunged messages %v after recovery", uids)
+	}
+
+	if _, err := os.Stat(orphanPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("orphan file was not deleted")
+	}
+
+	if err := a.CreateMailbox("Drafts"); err != nil {
+		t.Fatalf("cannot create mailbox: %v", err)
+	}
+
+	if mailboxInfo(t, a, "Drafts").UIDValidity <= validity {
+		t.Errorf("UIDVALIDITY value reused")
+	}
+
+	if uid := appendTestMessage(t, a, "INBOX"); uid != 21 {
+		t.Errorf("new message has uid %d instead of 21", uid)
+	}
+}
+
+func TestAccountSynchronization(t *testing.T) {
+	s := newTestStore(t.TempDir(), DefaultMaxLogSize)
+	defer s.Close()
+
+	a := openTestAccount(t, s)
+
+	// Special use
+	if err := a.CreateSpecialUseMailbox("Sent", `\sent`); err != nil {
+		t.Fatalf("cannot create mailbox: %v", err)
+	}
+
+	if info := mailboxInfo(t, a, "Sent"); info.SpecialUse != SpecialUseSent {
+		t.Errorf("invalid special use %q", info.SpecialUse)
+	}
+
+	if err := a.CreateSpecialUseMailbox("All", `\All`); !errors.Is(err, ErrInvalidSpecialUse) {
+		t.Errorf("unsupported special use accepted")
+	}
+
+	// Conditional flag changes
+	modSeq := mailboxInfo(t, a, "INBOX").HighestModSeq
+	if modSeq == 0 {
+		t.Errorf("invalid initial modification sequence")
+	}
+
+	uid1 := appendTestMessage(t, a, "INBOX")
+	uid2 := appendTestMessage(t, a, "INBOX")
+
+	msg1, err := a.Message("INBOX", uid1)
+	if err != nil {
+		t.Fatalf("cannot read message: %v", err)
+	}
+
+	if _, err := a.StoreFlags("INBOX", []uint32{uid2}, FlagOperationAdd,
+		[]string{`\Seen`}); err != nil {
+		t.Fatalf("cannot store flags: %v", err)
+	}
+
+	msgs, failedUIDs, err := a.StoreFlagsUnchangedSince("INBOX",
+		[]uint32{uid1, uid2}, FlagOperationAdd, []string{`\Flagged`},
+		msg1.ModSeq)
+	if err != nil {
+		t.Fatalf("cannot store flags: %v", err)
+	}
+
+	if len(msgs) != 1 || msgs[0].UID != uid1 {
+		t.Errorf("invalid modified messages %#v", msgs)
+	}
+
+	if len(failedUIDs) != 1 || failedUIDs[0] != uid2 {
+		t.Errorf("invalid failed uids %v", failedUIDs)
+	}
+
+	// Expunged messages
+	uid3 := appendTestMessage(t, a, "INBOX")
+
+	if err := a.ExpungeMessages("INBOX", []uint32{uid1}); err != nil {
+		t.Fatalf("cannot expunge messages: %v", err)
+	}
+
+	modSeq = mailboxInfo(t, a, "INBOX").HighestModSeq
+
+	if err := a.ExpungeMessages("INBOX", []uint32{uid3}); err != nil {
+		t.Fatalf("cannot expunge messages: %v", err)
+	}
+
+	uids, err := a.ExpungedMessages("INBOX", modSeq)
+	if err != nil {
+		t.Fatalf("cannot read expunged messages: %v", err)
+	} else if len(uids) != 1 || uids[0] != uid3 {
+		t.Errorf("invalid expunged messages %v", uids)
+	}
+
+	// Without information about old expunged messages, all missing UIDs
+	// are returned.
+	a.mailboxes[a.mailboxNames[InboxName]].expungedModSeq = modSeq + 1
+
+	uids, err = a.ExpungedMessages("INBOX", modSeq)
+	if err != nil {
+		t.Fatalf("cannot read expunged messages: %v", err)
+	} else if len(uids) != 2 || uids[0] != uid1 || uids[1] != uid3 {
+		t.Errorf("invalid expunged messages %v", uids)
+	}
+}
@@ -0,0 +1,741 @@
+package managesieve
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/sieve"
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-log"
+)
+
+type ExpectedError struct {
+	Err error
+}
+
+func NewExpectedError(err error) *ExpectedError {
+	return &ExpectedError{Err: err}
+}
+
+func (err *ExpectedError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *ExpectedError) Unwrap() error {
+	return err.Err
+}
+
+// RequestError is an error caused by an invalid request; the client receives
+// a NO response and the connection stays open.
+type RequestError struct {
+	Code    string // optional response code
+	Message string
+}
+
+func (err *RequestError) Error() string {
+	return err.Message
+}
+
+func requestErrorf(code, format string, args ...any) *RequestError {
+	return &RequestError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+type Request struct {
+	Command   string
+	Arguments []string // strings and numbers
+}
+
+type ServerConn struct {
+	Server *Server
+	Log    *log.Logger
+
+	tls            bool
+	identity       string // empty until authenticated
+	nbAuthFailures int
+
+	conn net.Conn
+	rbuf *bufio.Reader
+	wbuf bytes.Buffer
+}
+
+func (c *ServerConn) Start() {
+	c.rbuf = bufio.NewReaderSize(c.conn, MaxLineLength)
+
+	c.Server.wg.Add(1)
+	go c.main()
+}
+
+func (c *ServerConn) Close() {
+	c.conn.Close()
+}
+
+func (c *ServerConn) main() {
+	defer func() {
+		c.conn.Close()
+
+		c.Server.connsMutex.Lock()
+		delete(c.Server.conns, c)
+		c.Server.connsMutex.Unlock()
+
+		c.Server.wg.Done()
+	}()
+
+	defer func() {
+		if v := recover(); v != nil {
+			if err, ok := v.(error); ok {
+				var expectedError *ExpectedError
+
+				if errors.As(err, &expectedError) {
+					return
+				}
+			}
+
+			msg := utils.RecoverValueString(v)
+			trace := utils.StackTrace(0, 20, true)
+
+			c.Log.Error("panic: %s\n%s", msg, trace)
+		}
+	}()
+
+	// RFC 5804 1.7. The server sends its capabilities when the connection
+	// is established.
+	c.writeCapabilities()
+
+	for {
+		r, err := c.readRequest()
+		if err != nil {
+			var requestErr *RequestError
+			if errors.As(err, &requestErr) {
+				c.writeRequestError(requestErr)
+				continue
+			}
+
+			c.Log.Error("cannot read request: %v", err)
+			c.writeResponse("BYE", "", "%v", err)
+			return
+		}
+
+		if err := c.processRequest(r); err != nil {
+			var requestErr *RequestError
+			if errors.As(err, &requestErr) {
+				c.writeRequestError(requestErr)
+				continue
+			}
+
+			c.Log.Error("%s: %v", r.Command, err)
+			c.writeResponse("BYE", "", "internal error")
+			return
+		}
+
+		if r.Command == "LOGOUT" {
+			return
+		}
+	}
+}
+
+func (c *ServerConn) readLine() ([]byte, error) {
+	s, err := c.rbuf.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			panic(NewExpectedError(err))
+		} else if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("line too long")
+		}
+
+		return nil, fmt.Errorf("cannot read connection: %w", err)
+	}
+
+	if len(s) < 2 || s[len(s)-2] != '\r' {
+		return nil, fmt.Errorf("missing carriage return before newline")
+	}
+
+	return bytes.Clone(s[:len(s)-2]), nil
+}
+
+// RFC 5804 4. Formal Syntax
+func (c *ServerConn) readRequest() (*Request, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	command, rest, _ := bytes.Cut(line, []byte{' '})
+	if len(command) == 0 {
+		return nil, requestErrorf("", "missing command")
+	}
+
+	args, err := c.readArguments(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	r := Request{
+		Command:   strings.ToUpper(string(command)),
+		Arguments: args,
+	}
+
+	return &r, nil
+}
+
+func (c *ServerConn) readArguments(line []byte) ([]string, error) {
+	var args []string
+
+	for {
+		line = bytes.TrimLeft(line, " ")
+		if len(line) == 0 {
+			break
+		}
+
+		switch {
+		case line[0] == '"':
+			s, rest, err := parseQuotedString(line)
+			if err != nil {
+				return nil, err
+			}
+
+			args = append(args, s)
+			line = rest
+
+		case line[0] == '{':
+			// Literals always end the line; the rest of the request follows
+			// the content of the literal.
+			s, err := c.readLiteral(line)
+			if err != nil {
+				return nil, err
+			}
+
+			args = append(args, s)
+
+			line, err = c.readLine()
+			if err != nil {
+				return nil, err
+			}
+
+		case line[0] >= '0' && line[0] <= '9':
+			end := bytes.IndexByte(line, ' ')
+			if end == -1 {
+				end = len(line)
+			}
+
+			number := string(line[:end])
+			if _, err := strconv.ParseUint(number, 10, 32); err != nil {
+				return nil, requestErrorf("", "invalid number %q", number)
+			}
+
+			args = append(args, number)
+			line = line[end:]
+
+		default:
+			return nil, requestErrorf("", "invalid argument")
+		}
+	}
+
+	return args, nil
+}
+
+func (c *ServerConn) readLiteral(line []byte) (string, error) {
+	// Both synchronizing and non-synchronizing literals are accepted; in both
+	// cases the server does not send any continuation response.
+	spec := bytes.TrimSuffix(line[1:], []byte{'}'})
+	if len(spec) == len(line)-1 {
+		return "", fmt.Errorf("invalid literal")
+	}
+
+	spec = bytes.TrimSuffix(spec, []byte{'+'})
+
+	size, err := strconv.ParseInt(string(spec), 10, 64)
+	if err != nil || size < 0 {
+		return "", fmt.Errorf("invalid literal size")
+	}
+
+	if size > c.maxLiteralSize() {
+		// The content has already been sent by the client and must be
+		// skipped before reading the next request.
+		if _, err := io.CopyN(io.Discard, c.rbuf, size); err != nil {
+			return "", fmt.Errorf("cannot read literal: %w", err)
+		}
+
+		if _, err := c.readLine(); err != nil {
+			return "", err
+		}
+
+		return "", requestErrorf("QUOTA/MAXSIZE", "literal too large")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.rbuf, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			panic(NewExpectedError(err))
+		}
+
+		return "", fmt.Errorf("cannot read literal: %w", err)
+	}
+
+	return string(data), nil
+}
+
+func (c *ServerConn) maxLiteralSize() int64 {
+	return int64(c.Server.Cfg.Scripts.Cfg.MaxScriptSize)
+}
+
+func parseQuotedString(data []byte) (string, []byte, error) {
+	var buf []byte
+
+	for i := 1; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '"':
+			return string(buf), data[i+1:], nil
+
+		case '\\':
+			if i+1 == len(data) || (data[i+1] != '"' && data[i+1] != '\\') {
+				return "", nil, requestErrorf("", "invalid escape sequence")
+			}
+
+			i++
+			buf = append(buf, data[i])
+
+		default:
+			buf = append(buf, c)
+		}
+	}
+
+	return "", nil, requestErrorf("", "unterminated quoted string")
+}
+
+func (c *ServerConn) writeLine(format string, args ...any) {
+	c.wbuf.Reset()
+
+	fmt.Fprintf(&c.wbuf, format, args...)
+	c.wbuf.WriteString("\r\n")
+
+	c.flush()
+}
+
+func (c *ServerConn) flush() {
+	if _, err := io.Copy(c.conn, &c.wbuf); err != nil {
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			panic(NewExpectedError(err))
+		}
+
+		panic(err)
+	}
+}
+
+func (c *ServerConn) writeResponse(status, code, format string, args ...any) {
+	c.wbuf.Reset()
+
+	c.wbuf.WriteString(status)
+
+	if code != "" {
+		c.wbuf.WriteString(" (" + code + ")")
+	}
+
+	if msg := fmt.Sprintf(format, args...); msg != "" {
+		c.wbuf.WriteByte(' ')
+		c.wbuf.WriteString(encodeString(msg))
+	}
+
+	c.wbuf.WriteString("\r\n")
+
+	c.flush()
+}
+
+func (c *ServerConn) writeOK(format string, args ...any) {
+	c.writeResponse("OK", "", format, args...)
+}
+
+func (c *ServerConn) writeRequestError(err *RequestError) {
+	c.writeResponse("NO", err.Code, "%s", err.Message)
+}
+
+// encodeString returns a quoted string if possible, or a literal for strings
+// which cannot be quoted.
+func encodeString(s string) string {
+	if len(s) <= 1024 && !strings.ContainsAny(s, "\r\n\x00") {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+		s = strings.ReplaceAll(s, `"`, `\"`)
+
+		return `"` + s + `"`
+	}
+
+	return "{" + strconv.Itoa(len(s)) + "}\r\n" + s
+}
+
+func (c *ServerConn) canAuthenticate() bool {
+	return c.tls || c.Server.Cfg.AllowInsecureAuthentication
+}
+
+func (c *ServerConn) writeCapabilities() {
+	// RFC 5804 1.7. Capabilities
+	c.writeLine(`"IMPLEMENTATION" "emaild"`)
+
+	var mechanisms []string
+	if c.canAuthenticate() && c.identity == "" {
+		mechanisms = sasl.Mechanisms
+	}
+	c.writeLine(`"SASL" %s`, encodeString(strings.Join(mechanisms, " ")))
+
+	c.writeLine(`"SIEVE" %s`, encodeString(strings.Join(sieve.Extensions, " ")))
+
+	if c.Server.Cfg.TLSConfig != nil && !c.tls {
+		c.writeLine(`"STARTTLS"`)
+	}
+
+	c.writeLine(`"MAXREDIRECTS" "%d"`, sieve.MaxRedirects)
+
+	if c.identity != "" {
+		c.writeLine(`"OWNER" %s`, encodeString(c.identity))
+	}
+
+	c.writeLine(`"VERSION" "1.0"`)
+
+	c.writeOK("")
+}
+
+func (c *ServerConn) processRequest(r *Request) error {
+	var fn func(*Request) error
+	var nbArgs, maxNbArgs int
+	authenticated := true
+
+	switch r.Command {
+	case "AUTHENTICATE":
+		fn, nbArgs, maxNbArgs = c.processAUTHENTICATE, 1, 2
+		authenticated = false
+	case "STARTTLS":
+		fn = c.processSTARTTLS
+		authenticated = false
+	case "LOGOUT":
+		fn = c.processLOGOUT
+		authenticated = false
+	case "CAPABILITY":
+		fn = c.processCAPABILITY
+		authenticated = false
+	case "NOOP":
+		fn, maxNbArgs = c.processNOOP, 1
+		authenticated = false
+	case "HAVESPACE":
+		fn, nbArgs = c.processHAVESPACE, 2
+	case "PUTSCRIPT":
+		fn, nbArgs = c.processPUTSCRIPT, 2
+	case "LISTSCRIPTS":
+		fn = c.processLISTSCRIPTS
+	case "SETACTIVE":
+		fn, nbArgs = c.processSETACTIVE, 1
+	case "GETSCRIPT":
+		fn, nbArgs = c.processGETSCRIPT, 1
+	case "DELETESCRIPT":
+		fn, nbArgs = c.processDELETESCRIPT, 1
+	case "RENAMESCRIPT":
+		fn, nbArgs = c.processRENAMESCRIPT, 2
+	case "CHECKSCRIPT":
+		fn, nbArgs = c.processCHECKSCRIPT, 1
+	default:
+		return requestErrorf("", "unknown command %q", r.Command)
+	}
+
+	maxNbArgs = max(nbArgs, maxNbArgs)
+	if len(r.Arguments) < nbArgs || len(r.Arguments) > maxNbArgs {
+		return requestErrorf("", "invalid number of arguments")
+	}
+
+	if authenticated && c.identity == "" {
+		return requestErrorf("", "authentication required")
+	}
+
+	return fn(r)
+}
+
+func (c *ServerConn) processAUTHENTICATE(r *Request) error {
+	if c.identity != "" {
+		return requestErrorf("", "already authenticated")
+	}
+
+	if !c.canAuthenticate() {
+		return requestErrorf("ENCRYPT-NEEDED",
+			"authentication requires a TLS connection")
+	}
+
+	mechanism, err := sasl.NewServerMechanism(r.Arguments[0],
+		c.Server.Cfg.Authenticator)
+	if err != nil {
+		return requestErrorf("", "unsupported mechanism %q", r.Arguments[0])
+	}
+
+	var response []byte
+
+	if len(r.Arguments) > 1 {
+		response, err = base64.StdEncoding.DecodeString(r.Arguments[1])
+		if err != nil {
+			return requestErrorf("", "invalid initial response")
+		}
+	}
+
+	for {
+		challenge, done, err := mechanism.Next(response)
+		if err != nil {
+			return c.authenticationFailure(err)
+		}
+
+		if done {
+			break
+		}
+
+		c.writeLine("%s", encodeString(
+			base64.StdEncoding.EncodeToString(challenge)))
+
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+
+		// RFC 5804 2.1. The client can abort the exchange
+		if string(line) == `"*"` || string(line) == "*" {
+			return requestErrorf("", "authentication aborted")
+		}
+
+		args, err := c.readArguments(line)
+		if err != nil {
+			return err
+		} else if len(args) != 1 {
+			return requestErrorf("", "invalid response")
+		}
+
+		response, err = base64.StdEncoding.DecodeString(args[0])
+		if err != nil {
+			return requestErrorf("", "invalid response")
+		}
+
+		if response == nil {
+			response = []byte{}
+		}
+	}
+
+	c.identity = mechanism.Identity()
+	c.Log.Info("user %q authenticated", c.identity)
+
+	c.writeOK("authenticated")
+	return nil
+}
+
+func (c *ServerConn) authenticationFailure(err error) error {
+	if !errors.Is(err, sasl.ErrAuthenticationFailed) {
+		c.Log.Error("authentication error: %v", err)
+	}
+
+	c.nbAuthFailures++
+
+	if c.nbAuthFailures >= MaxAuthenticationFailures {
+		c.writeResponse("BYE", "", "too many authentication failures")
+		panic(NewExpectedError(err))
+	}
+
+	return requestErrorf("", "authentication failed")
+}
+
+func (c *ServerConn) processSTARTTLS(r *Request) error {
+	tlsCfg := c.Server.Cfg.TLSConfig
+
+	if tlsCfg == nil {
+		return requestErrorf("", "STARTTLS not supported")
+	}
+
+	if c.tls {
+		return requestErrorf("", "TLS already active")
+	}
+
+	// Data sent by the client after the command must not be processed once
+	// TLS is active.
+	if c.rbuf.Buffered() > 0 {
+		return requestErrorf("", "unexpected data after STARTTLS")
+	}
+
+	c.writeOK("begin TLS negotiation")
+
+	tlsConn := tls.Server(c.conn, tlsCfg)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Log.Error("cannot establish TLS connection: %v", err)
+		panic(NewExpectedError(err))
+	}
+
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReaderSize(c.conn, MaxLineLength)
+	c.tls = true
+
+	// RFC 5804 2.2. Capabilities are sent again after the negotiation
+	c.writeCapabilities()
+	return nil
+}
+
+func (c *ServerConn) processLOGOUT(r *Request) error {
+	c.writeOK("logout completed")
+	return nil
+}
+
+func (c *ServerConn) processCAPABILITY(r *Request) error {
+	c.writeCapabilities()
+	return nil
+}
+
+func (c *ServerConn) processNOOP(r *Request) error {
+	if len(r.Arguments) > 0 {
+		c.writeResponse("OK", "TAG "+encodeString(r.Arguments[0]), "done")
+		return nil
+	}
+
+	c.writeOK("done")
+	return nil
+}
+
+func (c *ServerConn) processHAVESPACE(r *Request) error {
+	size, err := strconv.Atoi(r.Arguments[1])
+	if err != nil {
+		return requestErrorf("", "invalid script size")
+	}
+
+	err = c.Server.Cfg.Scripts.CheckSpace(c.identity, r.Arguments[0], size)
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.writeOK("")
+	return nil
+}
+
+func (c *ServerConn) processPUTSCRIPT(r *Request) error {
+	name, content := r.Arguments[0], r.Arguments[1]
+
+	if _, err := sieve.Parse([]byte(content)); err != nil {
+		return requestErrorf("", "%v", err)
+	}
+
+	err := c.Server.Cfg.Scripts.PutScript(c.identity, name, []byte(content))
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.Log.Info("script %q stored", name)
+
+	c.writeOK("")
+	return nil
+}
+
+func (c *ServerConn) processLISTSCRIPTS(r *Request) error {
+	scripts, err := c.Server.Cfg.Scripts.Scripts(c.identity)
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	for _, script := range scripts {
+		if script.Active {
+			c.writeLine("%s ACTIVE", encodeString(script.Name))
+		} else {
+			c.writeLine("%s", encodeString(script.Name))
+		}
+	}
+
+	c.writeOK("")
+	return nil
+}
+
+func (c *ServerConn) processSETACTIVE(r *Request) error {
+	name := r.Arguments[0]
+
+	if err := c.Server.Cfg.Scripts.SetActiveScript(c.identity, name); err != nil {
+		return c.storeError(err)
+	}
+
+	if name == "" {
+		c.Log.Info("active script deactivated")
+	} else {
+		c.Log.Info("script %q activated", name)
+	}
+
+	c.writeOK("")
+	return nil
+}
+
+func (c *ServerConn) processGETSCRIPT(r *Request) error {
+	data, err := c.Server.Cfg.Scripts.Script(c.identity, r.Arguments[0])
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	// Scripts are always sent as literals
+	c.wbuf.Reset()
+	fmt.Fprintf(&c.wbuf, "{%d}\r\n", len(data))
+	c.wbuf.Write(data)
+	c.wbuf.WriteString("\r\n")
+	c.flush()
+
+	c.writeOK("")
+	return nil
+}
+
+func (c *ServerConn) processDELETESCRIPT(r *Request) error {
+	name := r.Arguments[0]
+
+	if err := c.Server.Cfg.Scripts.DeleteScript(c.identity, name); err != nil {
+		return c.storeError(err)
+	}
+
+	c.Log.Info("script %q deleted", name)
+
+	c.writeOK("")
+	return nil
+}
+
+func (c *ServerConn) processRENAMESCRIPT(r *Request) error {
+	oldName, newName := r.Arguments[0], r.Arguments[1]
+
+	err := c.Server.Cfg.Scripts.RenameScript(c.identity, oldName, newName)
+	if err != nil {
+		return c.storeError(err)
+	}
+
+	c.Log.Info("script %q renamed to %q", oldName, newName)
+
+	c.writeOK("")
+	return nil
+}
+
+func (c *ServerConn) processCHECKSCRIPT(r *Request) error {
+	if _, err := sieve.Parse([]byte(r.Arguments[0])); err != nil {
+		return requestErrorf("", "%v", err)
+	}
+
+	c.writeOK("")
+	return nil
+}
+
+// RFC 5804 1.3. Response Codes
+func (c *ServerConn) storeError(err error) error {
+	switch {
+	case errors.Is(err, sieve.ErrScriptNotFound):
+		return requestErrorf("NONEXISTENT", "script does not exist")
+	case errors.Is(err, sieve.ErrScriptExists):
+		return requestErrorf("ALREADYEXISTS", "script already exists")
+	case errors.Is(err, sieve.ErrActiveScript):
+		return requestErrorf("ACTIVE", "script is active")
+	case errors.Is(err, sieve.ErrScriptTooLarge):
+		return requestErrorf("QUOTA/MAXSIZE", "script too large")
+	case errors.Is(err, sieve.ErrTooManyScripts):
+		return requestErrorf("QUOTA/MAXSCRIPTS", "too many scripts")
+	case errors.Is(err, sieve.ErrInvalidScriptName):
+		return requestErrorf("", "invalid script name")
+	}
+
+	c.Log.Error("script store error: %v", err)
+	return requestErrorf("TRYLATER", "internal error")
+}
@@ -0,0 +1,266 @@
+package managesieve
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/sieve"
+	"github.com/galdor/emaild/pkg/testutils"
+	"github.com/galdor/go-log"
+)
+
+func startTestServer(t *testing.T, cfg ServerCfg) *Server {
+	hash, err := sasl.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	cfg.Log = log.DefaultLogger("test")
+	cfg.Authenticator = sasl.PasswordTable{"bob": hash}
+	cfg.Scripts = sieve.NewStore(sieve.StoreCfg{
+		Path:       t.TempDir(),
+		MaxScripts: 2,
+	})
+	cfg.Host = "127.0.0.1"
+
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("cannot create server: %v", err)
+	}
+
+	server.Cfg.Port = 0 // random port instead of the default one
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+
+	t.Cleanup(server.Stop)
+
+	return server
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	rbuf *bufio.Reader
+}
+
+func newTestClient(t *testing.T, server *Server) *testClient {
+	address := server.listeners[0].Addr().String()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("cannot connect to server: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	c := testClient{
+		t:    t,
+		conn: conn,
+		rbuf: bufio.NewReader(conn),
+	}
+
+	return &c
+}
+
+func (c *testClient) send(format string, args ...any) {
+	data := fmt.Sprintf(format, args...) + "\r\n"
+
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatalf("cannot write data: %v", err)
+	}
+}
+
+// readResponse returns the lines preceding the response and the response
+// itself. Literals are included in the line which contains them.
+func (c *testClient) readResponse() ([]string, string) {
+	var lines []string
+
+	for {
+		line, err := c.rbuf.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("cannot read response: %v", err)
+		}
+
+		line = strings.TrimSuffix(line, "\r\n")
+
+		if strings.HasPrefix(line, "{") && strings.HasSuffix(line, "}") {
+			size, _ := strconv.Atoi(line[1 : len(line)-1])
+
+			data := make([]byte, size)
+			if _, err := io.ReadFull(c.rbuf, data); err != nil {
+				c.t.Fatalf("cannot read literal: %v", err)
+			}
+
+			rest, err := c.rbuf.ReadString('\n')
+			if err != nil {
+				c.t.Fatalf("cannot read response: %v", err)
+			}
+
+			line += string(data) + strings.TrimSuffix(rest, "\r\n")
+		}
+
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") ||
+			strings.HasPrefix(line, "BYE") {
+			return lines, line
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+func (c *testClient) expect(prefix string, format string, args ...any) []string {
+	c.send(format, args...)
+
+	lines, response := c.readResponse()
+	if !strings.HasPrefix(response, prefix) {
+		c.t.Fatalf("%q: response is %q but should start with %q",
+			fmt.Sprintf(format, args...), response, prefix)
+	}
+
+	return lines
+}
+
+func (c *testClient) startTLS() []string {
+	c.expect("OK", "STARTTLS")
+
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("cannot establish TLS connection: %v", err)
+	}
+
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReader(tlsConn)
+
+	lines, response := c.readResponse()
+	if response != "OK" {
+		c.t.Fatalf("invalid response after STARTTLS: %q", response)
+	}
+
+	return lines
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+
+	return false
+}
+
+func literal(s string) string {
+	return "{" + strconv.Itoa(len(s)) + "+}\r\n" + s
+}
+
+func TestServer(t *testing.T) {
+	server := startTestServer(t, ServerCfg{TLSConfig: testutils.TLSConfig(t)})
+
+	c := newTestClient(t, server)
+
+	capabilities, _ := c.readResponse()
+	if !containsLine(capabilities, `"STARTTLS"`) {
+		t.Errorf("missing STARTTLS capability in %q", capabilities)
+	}
+
+	if !containsLine(capabilities, `"SASL" ""`) {
+		t.Errorf("authentication offered without TLS in %q", capabilities)
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00bob\x00secret"))
+
+	c.expect("NO (ENCRYPT-NEEDED)", `AUTHENTICATE "PLAIN" "%s"`, credentials)
+	c.expect("NO", `LISTSCRIPTS`)
+
+	capabilities = c.startTLS()
+	if !containsLine(capabilities, `"SASL" "PLAIN LOGIN"`) {
+		t.Errorf("missing authentication mechanisms in %q", capabilities)
+	}
+
+	invalidCredentials := base64.StdEncoding.EncodeToString(
+		[]byte("\x00bob\x00invalid"))
+
+	c.expect("NO", `AUTHENTICATE "PLAIN" "%s"`, invalidCredentials)
+
+	// Authentication without initial response
+	c.send(`AUTHENTICATE "PLAIN"`)
+	if challenge, _ := c.rbuf.ReadString('\n'); challenge != "\"\"\r\n" {
+		t.Fatalf("invalid challenge %q", challenge)
+	}
+	c.expect("OK", `"%s"`, credentials)
+
+	script := "require \"fileinto\";\r\nfileinto \"Lists\";\r\n"
+
+	c.expect("NO", `PUTSCRIPT "main" %s`, literal("invalid;\r\n"))
+	c.expect("NO", `CHECKSCRIPT %s`, literal("keep"))
+	c.expect("OK", `CHECKSCRIPT %s`, literal(script))
+	c.expect("OK", `PUTSCRIPT "main" %s`, literal(script))
+	c.expect("OK", `PUTSCRIPT "other" %s`, literal("keep;"))
+	c.expect("NO (QUOTA/MAXSCRIPTS)", `PUTSCRIPT "third" %s`, literal("keep;"))
+	c.expect("OK", `HAVESPACE "main" 1000`)
+	c.expect("NO (QUOTA/MAXSIZE)", `HAVESPACE "main" 10000000`)
+
+	c.expect("NO (NONEXISTENT)", `SETACTIVE "unknown"`)
+	c.expect("OK", `SETACTIVE "main"`)
+
+	lines := c.expect("OK", `LISTSCRIPTS`)
+	if strings.Join(lines, ", ") != `"main" ACTIVE, "other"` {
+		t.Errorf("invalid script list %q", lines)
+	}
+
+	lines = c.expect("OK", `GETSCRIPT "main"`)
+	if len(lines) != 1 || lines[0] != fmt.Sprintf("{%d}", len(script))+script {
+		t.Errorf("invalid script %q", lines)
+	}
+
+	c.expect("NO (ACTIVE)", `DELETESCRIPT "main"`)
+	c.expect("OK", `DELETESCRIPT "other"`)
+	c.expect("NO (NONEXISTENT)", `GETSCRIPT "other"`)
+	c.expect("OK", `RENAMESCRIPT "main" "filters"`)
+
+	lines = c.expect("OK", `LISTSCRIPTS`)
+	if strings.Join(lines, ", ") != `"filters" ACTIVE` {
+		t.Errorf("invalid script list %q", lines)
+	}
+
+	activeScript, err := server.Cfg.Scripts.ActiveScript("bob")
+	if err != nil {
+		t.Errorf("cannot load active script: %v", err)
+	} else if activeScript == nil || !activeScript.Extensions["fileinto"] {
+		t.Errorf("invalid active script")
+	}
+
+	c.expect("OK", `SETACTIVE ""`)
+
+	if activeScript, _ := server.Cfg.Scripts.ActiveScript("bob"); activeScript != nil {
+		t.Errorf("script still active")
+	}
+
+	c.expect("OK", `LOGOUT`)
+}
+
+func TestServerAuthenticationFailures(t *testing.T) {
+	server := startTestServer(t, ServerCfg{AllowInsecureAuthentication: true})
+
+	c := newTestClient(t, server)
+	c.readResponse()
+
+	invalidCredentials := base64.StdEncoding.EncodeToString(
+		[]byte("\x00bob\x00invalid"))
+
+	for i := 1; i < MaxAuthenticationFailures; i++ {
+		c.expect("NO", `AUTHENTICATE "PLAIN" "%s"`, invalidCredentials)
+	}
+
+	c.expect("BYE", `AUTHENTICATE "PLAIN" "%s"`, invalidCredentials)
+}
@@ -0,0 +1,136 @@
+package mime
+
+import (
+	"bytes"
+)
+
+// RFC 2045 MIME Part One: Format of Internet Message Bodies
+
+type HeaderField struct {
+	Name  string
+	Value string // unfolded
+	Raw   []byte // including the final line ending
+}
+
+// SplitHeader returns the header of an entity, including the empty line
+// ending it, and its body.
+func SplitHeader(data []byte) ([]byte, []byte) {
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		return data[:2], data[2:]
+	} else if bytes.HasPrefix(data, []byte("\n")) {
+		return data[:1], data[1:]
+	}
+
+	end := -1
+
+	if i := bytes.Index(data, []byte("\n\r\n")); i >= 0 {
+		end = i + 3
+	}
+
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 && (end == -1 || i+2 < end) {
+		end = i + 2
+	}
+
+	if end == -1 {
+		return data, data[len(data):]
+	}
+
+	return data[:end], data[end:]
+}
+
+func ParseHeaderFields(header []byte) []HeaderField {
+	var fields []HeaderField
+
+	for len(header) > 0 {
+		end := bytes.IndexByte(header, '\n') + 1
+		if end == 0 {
+			end = len(header)
+		}
+
+		// Continuation lines start with whitespace
+		for end < len(header) && (header[end] == ' ' || header[end] == '\t') {
+			next := bytes.IndexByte(header[end:], '\n') + 1
+			if next == 0 {
+				end = len(header)
+			} else {
+				end += next
+			}
+		}
+
+		raw := header[:end]
+		header = header[end:]
+
+		name, value, found := bytes.Cut(raw, []byte{':'})
+		if !found {
+			continue
+		}
+
+		value = bytes.ReplaceAll(value, []byte("\r\n"), nil)
+		value = bytes.ReplaceAll(value, []byte("\n"), nil)
+
+		fields = append(fields, HeaderField{
+			Name:  string(bytes.TrimSpace(name)),
+			Value: string(bytes.TrimSpace(value)),
+			Raw:   raw,
+		})
+	}
+
+	return fields
+}
+
+// SplitMultipartBody returns the content of each part of a multipart body
+// (RFC 2046 5.1.1.).
+func SplitMultipartBody(body []byte, boundary string) [][]byte {
+	if boundary == "" {
+		return nil
+	}
+
+	delimiter := []byte("--" + boundary)
+
+	var parts [][]byte
+	start := -1
+
+	for pos := 0; pos < len(body); {
+		next := len(body)
+		if i := bytes.IndexByte(body[pos:], '\n'); i >= 0 {
+			next = pos + i + 1
+		}
+
+		line := body[pos:next]
+
+		if rest, found := bytes.CutPrefix(line, delimiter); found {
+			rest, closing := bytes.CutPrefix(rest, []byte("--"))
+
+			if len(bytes.TrimRight(rest, " \t\r\n")) == 0 {
+				if start >= 0 {
+					// The line ending before the delimiter is part of the
+					// delimiter.
+					end := pos
+					if end > start && body[end-1] == '\n' {
+						end--
+
+						if end > start && body[end-1] == '\r' {
+							end--
+						}
+					}
+
+					parts = append(parts, body[start:end])
+				}
+
+				if closing {
+					return parts
+				}
+
+				start = next
+			}
+		}
+
+		pos = next
+	}
+
+	if start >= 0 && start < len(body) {
+		parts = append(parts, body[start:])
+	}
+
+	return parts
+}
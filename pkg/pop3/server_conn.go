@@ -0,0 +1,773 @@
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-log"
+)
+
+type ExpectedError struct {
+	Err error
+}
+
+func NewExpectedError(err error) *ExpectedError {
+	return &ExpectedError{Err: err}
+}
+
+func (err *ExpectedError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *ExpectedError) Unwrap() error {
+	return err.Err
+}
+
+// RequestError is an error caused by a command which cannot be executed; the
+// client receives a negative response and the connection stays open.
+type RequestError struct {
+	Code    string // optional RFC 2449 response code
+	Message string
+}
+
+func (err *RequestError) Error() string {
+	return err.Message
+}
+
+func requestErrorf(code, format string, args ...any) *RequestError {
+	return &RequestError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// The maildrop is the INBOX mailbox of the user. Its content is fixed when
+// the session enters the TRANSACTION state (RFC 1939 5.); messages added
+// afterwards are not visible.
+type maildropMessage struct {
+	uid     uint32
+	size    int64
+	deleted bool
+}
+
+type ServerConn struct {
+	Server *Server
+	Log    *log.Logger
+
+	tls            bool
+	username       string // USER argument
+	identity       string // empty until authenticated
+	nbAuthFailures int
+
+	account     *mailstore.Account
+	uidValidity uint32
+	messages    []*maildropMessage
+
+	conn net.Conn
+	rbuf *bufio.Reader
+	wbuf bytes.Buffer
+}
+
+func (c *ServerConn) Start() {
+	c.rbuf = bufio.NewReaderSize(c.conn, MaxLineLength)
+
+	c.Server.wg.Add(1)
+	go c.main()
+}
+
+func (c *ServerConn) Close() {
+	c.conn.Close()
+}
+
+func (c *ServerConn) main() {
+	defer func() {
+		c.conn.Close()
+
+		if c.identity != "" {
+			c.Server.unlockMaildrop(c.identity)
+		}
+
+		c.Server.connsMutex.Lock()
+		delete(c.Server.conns, c)
+		c.Server.connsMutex.Unlock()
+
+		c.Server.wg.Done()
+	}()
+
+	defer func() {
+		if v := recover(); v != nil {
+			if err, ok := v.(error); ok {
+				var expectedError *ExpectedError
+
+				if errors.As(err, &expectedError) {
+					return
+				}
+			}
+
+			msg := utils.RecoverValueString(v)
+			trace := utils.StackTrace(0, 20, true)
+
+			c.Log.Error("panic: %s\n%s", msg, trace)
+		}
+	}()
+
+	if c.Server.Cfg.ImplicitTLS {
+		c.startTLS()
+	}
+
+	c.writeLine("+OK emaild POP3 server ready")
+
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.Log.Error("cannot read command: %v", err)
+			c.writeError(requestErrorf("", "%v", err))
+			return
+		}
+
+		name, rest, _ := strings.Cut(line, " ")
+		name = strings.ToUpper(name)
+
+		quit, err := c.processCommand(name, rest)
+		if err != nil {
+			var requestErr *RequestError
+			if errors.As(err, &requestErr) {
+				c.writeError(requestErr)
+				continue
+			}
+
+			c.Log.Error("%s: %v", name, err)
+			c.writeError(requestErrorf("SYS/TEMP", "internal error"))
+			return
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+func (c *ServerConn) readLine() (string, error) {
+	s, err := c.rbuf.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			panic(NewExpectedError(err))
+		} else if errors.Is(err, bufio.ErrBufferFull) {
+			return "", fmt.Errorf("line too long")
+		}
+
+		return "", fmt.Errorf("cannot read connection: %w", err)
+	}
+
+	if len(s) < 2 || s[len(s)-2] != '\r' {
+		return "", fmt.Errorf("missing carriage return before newline")
+	}
+
+	return string(s[:len(s)-2]), nil
+}
+
+func (c *ServerConn) writeLine(format string, args ...any) {
+	c.wbuf.Reset()
+
+	fmt.Fprintf(&c.wbuf, format, args...)
+	c.wbuf.WriteString("\r\n")
+
+	c.flush()
+}
+
+func (c *ServerConn) writeError(err *RequestError) {
+	if err.Code == "" {
+		c.writeLine("-ERR %s", err.Message)
+	} else {
+		c.writeLine("-ERR [%s] %s", err.Code, err.Message)
+	}
+}
+
+// writeMultiline writes a positive response followed by a multi-line block
+// (RFC 1939 3.): line endings are normalized and lines starting with a dot
+// are byte-stuffed.
+func (c *ServerConn) writeMultiline(status string, data []byte) {
+	c.wbuf.Reset()
+
+	c.wbuf.WriteString("+OK " + status + "\r\n")
+
+	for len(data) > 0 {
+		line := data
+		data = nil
+
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, data = line[:i], line[i+1:]
+		}
+
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+
+		if len(line) > 0 && line[0] == '.' {
+			c.wbuf.WriteByte('.')
+		}
+
+		c.wbuf.Write(line)
+		c.wbuf.WriteString("\r\n")
+	}
+
+	c.wbuf.WriteString(".\r\n")
+
+	c.flush()
+}
+
+func (c *ServerConn) flush() {
+	if _, err := io.Copy(c.conn, &c.wbuf); err != nil {
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			panic(NewExpectedError(err))
+		}
+
+		panic(err)
+	}
+}
+
+func (c *ServerConn) canAuthenticate() bool {
+	return c.tls || c.Server.Cfg.AllowInsecureAuthentication
+}
+
+func (c *ServerConn) processCommand(name, rest string) (bool, error) {
+	args := strings.Fields(rest)
+
+	checkNbArgs := func(min, max int) error {
+		if len(args) < min || len(args) > max {
+			return requestErrorf("", "invalid number of arguments")
+		}
+
+		return nil
+	}
+
+	// Commands available in both states
+	switch name {
+	case "CAPA":
+		return false, c.processCAPA()
+	case "QUIT":
+		return true, c.processQUIT()
+	}
+
+	if c.identity == "" {
+		// AUTHORIZATION state
+		switch name {
+		case "STLS":
+			return false, c.processSTLS()
+
+		case "USER":
+			if err := checkNbArgs(1, 1); err != nil {
+				return false, err
+			}
+
+			return false, c.processUSER(args[0])
+
+		case "PASS":
+			// Passwords may contain spaces
+			return false, c.processPASS(rest)
+
+		case "AUTH":
+			if err := checkNbArgs(1, 2); err != nil {
+				return false, err
+			}
+
+			return false, c.processAUTH(args)
+
+		case "STAT", "LIST", "RETR", "DELE", "NOOP", "RSET", "TOP", "UIDL":
+			return false, requestErrorf("", "authentication required")
+		}
+
+		return false, requestErrorf("", "unknown command %q", name)
+	}
+
+	// TRANSACTION state
+	switch name {
+	case "STAT":
+		if err := checkNbArgs(0, 0); err != nil {
+			return false, err
+		}
+
+		return false, c.processSTAT()
+
+	case "LIST":
+		if err := checkNbArgs(0, 1); err != nil {
+			return false, err
+		}
+
+		return false, c.processLIST(args)
+
+	case "RETR":
+		if err := checkNbArgs(1, 1); err != nil {
+			return false, err
+		}
+
+		return false, c.processRETR(args[0])
+
+	case "DELE":
+		if err := checkNbArgs(1, 1); err != nil {
+			return false, err
+		}
+
+		return false, c.processDELE(args[0])
+
+	case "NOOP":
+		if err := checkNbArgs(0, 0); err != nil {
+			return false, err
+		}
+
+		c.writeLine("+OK")
+		return false, nil
+
+	case "RSET":
+		if err := checkNbArgs(0, 0); err != nil {
+			return false, err
+		}
+
+		return false, c.processRSET()
+
+	case "TOP":
+		if err := checkNbArgs(2, 2); err != nil {
+			return false, err
+		}
+
+		return false, c.processTOP(args[0], args[1])
+
+	case "UIDL":
+		if err := checkNbArgs(0, 1); err != nil {
+			return false, err
+		}
+
+		return false, c.processUIDL(args)
+
+	case "STLS", "USER", "PASS", "AUTH":
+		return false, requestErrorf("", "already authenticated")
+	}
+
+	return false, requestErrorf("", "unknown command %q", name)
+}
+
+// RFC 2449 5. The CAPA Command
+func (c *ServerConn) processCAPA() error {
+	caps := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE"}
+
+	if c.identity == "" {
+		if c.Server.Cfg.TLSConfig != nil && !c.tls {
+			caps = append(caps, "STLS")
+		}
+
+		// RFC 2595 4. Plain text authentication is not advertised before
+		// TLS is active.
+		if c.canAuthenticate() {
+			caps = append(caps, "USER",
+				"SASL "+strings.Join(sasl.Mechanisms, " "))
+		}
+	}
+
+	c.writeMultiline("capability list follows",
+		[]byte(strings.Join(caps, "\r\n")+"\r\n"))
+
+	return nil
+}
+
+func (c *ServerConn) processQUIT() error {
+	if c.identity == "" {
+		c.writeLine("+OK bye")
+		return nil
+	}
+
+	// RFC 1939 6. The UPDATE state
+	var uids []uint32
+	for _, msg := range c.messages {
+		if msg.deleted {
+			uids = append(uids, msg.uid)
+		}
+	}
+
+	if err := c.account.ExpungeMessages(mailstore.InboxName, uids); err != nil {
+		c.Log.Error("cannot delete messages: %v", err)
+		c.writeError(requestErrorf("SYS/TEMP",
+			"cannot delete messages marked as deleted"))
+		return nil
+	}
+
+	c.writeLine("+OK bye")
+	return nil
+}
+
+// RFC 2595 4. POP3 STARTTLS extension
+func (c *ServerConn) processSTLS() error {
+	if c.Server.Cfg.TLSConfig == nil {
+		return requestErrorf("", "STLS not supported")
+	}
+
+	if c.tls {
+		return requestErrorf("", "TLS already active")
+	}
+
+	// Data sent by the client after the command must not be processed once
+	// TLS is active.
+	if c.rbuf.Buffered() > 0 {
+		return requestErrorf("", "unexpected data after STLS")
+	}
+
+	c.writeLine("+OK begin TLS negotiation")
+
+	c.startTLS()
+	return nil
+}
+
+func (c *ServerConn) startTLS() {
+	tlsConn := tls.Server(c.conn, c.Server.Cfg.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Log.Error("cannot establish TLS connection: %v", err)
+		panic(NewExpectedError(err))
+	}
+
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReaderSize(c.conn, MaxLineLength)
+	c.tls = true
+}
+
+func (c *ServerConn) processUSER(username string) error {
+	if !c.canAuthenticate() {
+		return requestErrorf("", "authentication requires a TLS connection")
+	}
+
+	c.username = username
+
+	c.writeLine("+OK")
+	return nil
+}
+
+func (c *ServerConn) processPASS(password string) error {
+	if c.username == "" {
+		return requestErrorf("", "USER command required")
+	}
+
+	username := c.username
+	c.username = ""
+
+	err := c.Server.Cfg.Authenticator.Authenticate(username, password)
+	if err != nil {
+		return c.authenticationFailure(err)
+	}
+
+	return c.authenticated(username)
+}
+
+// RFC 5034 4. The AUTH Command
+func (c *ServerConn) processAUTH(args []string) error {
+	if !c.canAuthenticate() {
+		return requestErrorf("", "authentication requires a TLS connection")
+	}
+
+	mechanism, err := sasl.NewServerMechanism(strings.ToUpper(args[0]),
+		c.Server.Cfg.Authenticator)
+	if err != nil {
+		return requestErrorf("", "unsupported mechanism %q", args[0])
+	}
+
+	var response []byte
+
+	// "=" is an empty initial response
+	if len(args) > 1 {
+		if response, err = decodeSASLResponse(args[1]); err != nil {
+			return err
+		}
+	}
+
+	for {
+		challenge, done, err := mechanism.Next(response)
+		if err != nil {
+			return c.authenticationFailure(err)
+		}
+
+		if done {
+			break
+		}
+
+		c.writeLine("+ %s", base64.StdEncoding.EncodeToString(challenge))
+
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+
+		if line == "*" {
+			return requestErrorf("", "authentication aborted")
+		}
+
+		if response, err = decodeSASLResponse(line); err != nil {
+			return err
+		}
+	}
+
+	return c.authenticated(mechanism.Identity())
+}
+
+func decodeSASLResponse(s string) ([]byte, error) {
+	if s == "=" {
+		return []byte{}, nil
+	}
+
+	response, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, requestErrorf("", "invalid response")
+	}
+
+	if response == nil {
+		response = []byte{}
+	}
+
+	return response, nil
+}
+
+func (c *ServerConn) authenticated(identity string) error {
+	account, err := c.Server.Cfg.Store.Account(identity)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrInvalidUser) {
+			return requestErrorf("AUTH", "invalid user")
+		}
+
+		return err
+	}
+
+	// RFC 1939 8. Only one session can access the maildrop at a time
+	if !c.Server.lockMaildrop(identity) {
+		return requestErrorf("IN-USE", "maildrop already locked")
+	}
+
+	inbox, err := account.Mailbox(mailstore.InboxName)
+	if err != nil {
+		c.Server.unlockMaildrop(identity)
+		return err
+	}
+
+	msgs, err := account.Messages(mailstore.InboxName)
+	if err != nil {
+		c.Server.unlockMaildrop(identity)
+		return err
+	}
+
+	c.identity = identity
+	c.account = account
+	c.uidValidity = inbox.UIDValidity
+
+	c.messages = make([]*maildropMessage, len(msgs))
+	for i, msg := range msgs {
+		c.messages[i] = &maildropMessage{
+			uid:  msg.UID,
+			size: msg.Size,
+		}
+	}
+
+	c.Log.Info("user %q authenticated", c.identity)
+
+	c.writeLine("+OK maildrop locked and ready")
+	return nil
+}
+
+func (c *ServerConn) authenticationFailure(err error) error {
+	if !errors.Is(err, sasl.ErrAuthenticationFailed) {
+		c.Log.Error("authentication error: %v", err)
+	}
+
+	c.nbAuthFailures++
+
+	if c.nbAuthFailures >= MaxAuthenticationFailures {
+		c.writeError(requestErrorf("AUTH",
+			"too many authentication failures"))
+		panic(NewExpectedError(err))
+	}
+
+	return requestErrorf("AUTH", "authentication failed")
+}
+
+// message returns a message which was not marked as deleted.
+func (c *ServerConn) message(arg string) (int, *maildropMessage, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(c.messages) {
+		return 0, nil, requestErrorf("", "no such message")
+	}
+
+	msg := c.messages[n-1]
+	if msg.deleted {
+		return 0, nil, requestErrorf("", "message %d already deleted", n)
+	}
+
+	return n, msg, nil
+}
+
+func (c *ServerConn) messageData(msg *maildropMessage) ([]byte, error) {
+	data, err := c.account.MessageData(mailstore.InboxName, msg.uid)
+	if err != nil {
+		if errors.Is(err, mailstore.ErrMessageNotFound) ||
+			errors.Is(err, mailstore.ErrMailboxNotFound) {
+			// Deleted by another protocol (e.g. IMAP)
+			return nil, requestErrorf("", "message no longer exists")
+		}
+
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c *ServerConn) processSTAT() error {
+	var nbMessages int
+	var size int64
+
+	for _, msg := range c.messages {
+		if !msg.deleted {
+			nbMessages++
+			size += msg.size
+		}
+	}
+
+	c.writeLine("+OK %d %d", nbMessages, size)
+	return nil
+}
+
+func (c *ServerConn) processLIST(args []string) error {
+	if len(args) == 1 {
+		n, msg, err := c.message(args[0])
+		if err != nil {
+			return err
+		}
+
+		c.writeLine("+OK %d %d", n, msg.size)
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	for i, msg := range c.messages {
+		if !msg.deleted {
+			fmt.Fprintf(&buf, "%d %d\r\n", i+1, msg.size)
+		}
+	}
+
+	c.writeMultiline("scan listing follows", buf.Bytes())
+	return nil
+}
+
+func (c *ServerConn) processRETR(arg string) error {
+	_, msg, err := c.message(arg)
+	if err != nil {
+		return err
+	}
+
+	data, err := c.messageData(msg)
+	if err != nil {
+		return err
+	}
+
+	c.writeMultiline(fmt.Sprintf("%d octets", len(data)), data)
+	return nil
+}
+
+func (c *ServerConn) processDELE(arg string) error {
+	n, msg, err := c.message(arg)
+	if err != nil {
+		return err
+	}
+
+	msg.deleted = true
+
+	c.writeLine("+OK message %d deleted", n)
+	return nil
+}
+
+func (c *ServerConn) processRSET() error {
+	for _, msg := range c.messages {
+		msg.deleted = false
+	}
+
+	c.writeLine("+OK")
+	return nil
+}
+
+// RFC 1939 7. TOP returns the header and the first lines of the body
+func (c *ServerConn) processTOP(arg, nbLinesArg string) error {
+	_, msg, err := c.message(arg)
+	if err != nil {
+		return err
+	}
+
+	nbLines, err := strconv.Atoi(nbLinesArg)
+	if err != nil || nbLines < 0 {
+		return requestErrorf("", "invalid number of lines")
+	}
+
+	data, err := c.messageData(msg)
+	if err != nil {
+		return err
+	}
+
+	body := data[headerEnd(data):]
+
+	for i := 0; i < nbLines && len(body) > 0; i++ {
+		if j := bytes.IndexByte(body, '\n'); j >= 0 {
+			body = body[j+1:]
+		} else {
+			body = body[len(body):]
+		}
+	}
+
+	c.writeMultiline("top of message follows", data[:len(data)-len(body)])
+	return nil
+}
+
+// headerEnd returns the offset of the body of a message, i.e. the position
+// following the empty line ending the header.
+func headerEnd(data []byte) int {
+	for pos := 0; pos < len(data); {
+		end := bytes.IndexByte(data[pos:], '\n')
+		if end == -1 {
+			return len(data)
+		}
+
+		line := data[pos : pos+end]
+		pos += end + 1
+
+		if len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			return pos
+		}
+	}
+
+	return len(data)
+}
+
+// RFC 1939 7. Unique identifiers are derived from the UIDVALIDITY value of
+// the mailbox and the UID of the message, both of which never change.
+func (c *ServerConn) processUIDL(args []string) error {
+	if len(args) == 1 {
+		n, msg, err := c.message(args[0])
+		if err != nil {
+			return err
+		}
+
+		c.writeLine("+OK %d %d.%d", n, c.uidValidity, msg.uid)
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	for i, msg := range c.messages {
+		if !msg.deleted {
+			fmt.Fprintf(&buf, "%d %d.%d\r\n", i+1, c.uidValidity, msg.uid)
+		}
+	}
+
+	c.writeMultiline("unique-id listing follows", buf.Bytes())
+	return nil
+}
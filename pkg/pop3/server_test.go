@@ -0,0 +1,291 @@
+package pop3
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/testutils"
+	"github.com/galdor/go-log"
+)
+
+const testMessage1 = "From: Alice <alice@example.org>\r\n" +
+	"To: Bob <bob@example.com>\r\n" +
+	"Subject: Meeting\r\n" +
+	"\r\n" +
+	"Hello Bob.\r\n" +
+	"See you tomorrow.\r\n"
+
+const testMessage2 = "From: Alice <alice@example.org>\r\n" +
+	"To: Bob <bob@example.com>\r\n" +
+	"Subject: Dots\r\n" +
+	"\r\n" +
+	".hidden\r\n" +
+	".\r\n" +
+	"end\r\n"
+
+func startTestServer(t *testing.T, cfg ServerCfg) *Server {
+	hash, err := sasl.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	cfg.Log = log.DefaultLogger("test")
+	cfg.Authenticator = sasl.PasswordTable{"bob": hash}
+	cfg.Store = mailstore.NewStore(mailstore.Cfg{
+		Log:  log.DefaultLogger("test"),
+		Path: t.TempDir(),
+	})
+	cfg.Host = "127.0.0.1"
+
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("cannot create server: %v", err)
+	}
+
+	server.Cfg.Port = 0 // random port instead of the default one
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+
+	t.Cleanup(func() {
+		server.Stop()
+		cfg.Store.Close()
+	})
+
+	return server
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	rbuf *bufio.Reader
+}
+
+func newTestClient(t *testing.T, server *Server) *testClient {
+	address := server.listeners[0].Addr().String()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("cannot connect to server: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	c := testClient{
+		t:    t,
+		conn: conn,
+		rbuf: bufio.NewReader(conn),
+	}
+
+	return &c
+}
+
+func (c *testClient) write(data string) {
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatalf("cannot write data: %v", err)
+	}
+}
+
+func (c *testClient) readLine() string {
+	line, err := c.rbuf.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("cannot read response: %v", err)
+	}
+
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// expect sends a command and checks the prefix of the response.
+func (c *testClient) expect(prefix string, format string, args ...any) string {
+	c.write(fmt.Sprintf(format, args...) + "\r\n")
+
+	response := c.readLine()
+	if !strings.HasPrefix(response, prefix) {
+		c.t.Fatalf("%q: response is %q but should start with %q",
+			fmt.Sprintf(format, args...), response, prefix)
+	}
+
+	return response
+}
+
+// expectMultiline sends a command and returns the lines of the multi-line
+// block of the positive response, byte-stuffing included.
+func (c *testClient) expectMultiline(format string, args ...any) []string {
+	c.expect("+OK", format, args...)
+
+	var lines []string
+
+	for {
+		line := c.readLine()
+		if line == "." {
+			return lines
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+func (c *testClient) startTLS() {
+	c.expect("+OK", "STLS")
+
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("cannot establish TLS connection: %v", err)
+	}
+
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReader(tlsConn)
+}
+
+func checkLines(t *testing.T, lines []string, expectedLines ...string) {
+	t.Helper()
+
+	if strings.Join(lines, "\n") != strings.Join(expectedLines, "\n") {
+		t.Errorf("lines are %q but should be %q", lines, expectedLines)
+	}
+}
+
+func TestServer(t *testing.T) {
+	server := startTestServer(t, ServerCfg{TLSConfig: testutils.TLSConfig(t)})
+
+	account, err := server.Cfg.Store.Account("bob")
+	if err != nil {
+		t.Fatalf("cannot open account: %v", err)
+	}
+
+	for _, data := range []string{testMessage1, testMessage2} {
+		_, err := account.AppendMessage(mailstore.InboxName, []byte(data),
+			nil, time.Now())
+		if err != nil {
+			t.Fatalf("cannot append message: %v", err)
+		}
+	}
+
+	inbox, err := account.Mailbox(mailstore.InboxName)
+	if err != nil {
+		t.Fatalf("cannot read mailbox: %v", err)
+	}
+
+	c := newTestClient(t, server)
+
+	if greeting := c.readLine(); !strings.HasPrefix(greeting, "+OK") {
+		t.Errorf("invalid greeting %q", greeting)
+	}
+
+	caps := c.expectMultiline("CAPA")
+	checkLines(t, caps, "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "STLS")
+
+	c.expect("-ERR", "USER bob")
+	c.expect("-ERR", "STAT")
+
+	c.startTLS()
+
+	caps = c.expectMultiline("CAPA")
+	checkLines(t, caps, "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE",
+		"USER", "SASL PLAIN LOGIN")
+
+	c.expect("+OK", "USER bob")
+	c.expect("-ERR [AUTH]", "PASS invalid")
+	c.expect("-ERR", "PASS secret")
+
+	c.expect("+OK", "AUTH PLAIN %s",
+		base64.StdEncoding.EncodeToString([]byte("\x00bob\x00secret")))
+
+	// The maildrop is locked for the duration of the session
+	c2 := newTestClient(t, server)
+	c2.readLine()
+	c2.startTLS()
+	c2.expect("+OK", "USER bob")
+	c2.expect("-ERR [IN-USE]", "PASS secret")
+
+	size1, size2 := len(testMessage1), len(testMessage2)
+
+	c.expect(fmt.Sprintf("+OK 2 %d", size1+size2), "STAT")
+	c.expect(fmt.Sprintf("+OK 2 %d", size2), "LIST 2")
+	c.expect("-ERR", "LIST 3")
+
+	checkLines(t, c.expectMultiline("LIST"),
+		fmt.Sprintf("1 %d", size1), fmt.Sprintf("2 %d", size2))
+
+	checkLines(t, c.expectMultiline("UIDL"),
+		fmt.Sprintf("1 %d.1", inbox.UIDValidity),
+		fmt.Sprintf("2 %d.2", inbox.UIDValidity))
+
+	checkLines(t, c.expectMultiline("TOP 1 1"),
+		"From: Alice <alice@example.org>",
+		"To: Bob <bob@example.com>",
+		"Subject: Meeting",
+		"",
+		"Hello Bob.")
+
+	checkLines(t, c.expectMultiline("RETR 2"),
+		"From: Alice <alice@example.org>",
+		"To: Bob <bob@example.com>",
+		"Subject: Dots",
+		"",
+		"..hidden",
+		"..",
+		"end")
+
+	c.expect("+OK", "DELE 1")
+	c.expect("-ERR", "RETR 1")
+	c.expect("-ERR", "DELE 1")
+	c.expect(fmt.Sprintf("+OK 1 %d", size2), "STAT")
+
+	c.expect("+OK", "RSET")
+	c.expect(fmt.Sprintf("+OK 2 %d", size1+size2), "STAT")
+
+	c.expect("+OK", "DELE 1")
+	c.expect("+OK", "NOOP")
+	c.expect("+OK", "QUIT")
+
+	msgs, err := account.Messages(mailstore.InboxName)
+	if err != nil {
+		t.Fatalf("cannot read messages: %v", err)
+	}
+
+	if len(msgs) != 1 || msgs[0].UID != 2 {
+		t.Errorf("invalid messages after QUIT: %v", msgs)
+	}
+
+	// The maildrop is unlocked at the end of the session
+	c2.expect("+OK", "USER bob")
+	c2.expect("+OK", "PASS secret")
+	c2.expect("+OK 1 ", "STAT")
+}
+
+func TestServerImplicitTLS(t *testing.T) {
+	server := startTestServer(t, ServerCfg{
+		TLSConfig:   testutils.TLSConfig(t),
+		ImplicitTLS: true,
+	})
+
+	c := newTestClient(t, server)
+
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReader(tlsConn)
+
+	if greeting := c.readLine(); !strings.HasPrefix(greeting, "+OK") {
+		t.Errorf("invalid greeting %q", greeting)
+	}
+
+	c.expect("-ERR", "STLS")
+
+	for i := 1; i < MaxAuthenticationFailures; i++ {
+		c.expect("+OK", "USER bob")
+		c.expect("-ERR [AUTH] authentication failed", "PASS invalid")
+	}
+
+	c.expect("+OK", "USER bob")
+	c.expect("-ERR [AUTH] too many authentication failures", "PASS invalid")
+}
@@ -0,0 +1,196 @@
+package sasl
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Passwords are stored using the SHA-512 variant of the crypt function
+// ("$6$" prefix), as described in "Unix crypt using SHA-256 and SHA-512" by
+// Ulrich Drepper. Hashes can be generated with "openssl passwd -6" or
+// "mkpasswd -m sha-512".
+
+const (
+	sha512CryptPrefix = "$6$"
+
+	DefaultSHA512CryptRounds = 5000
+	MinSHA512CryptRounds     = 1000
+	MaxSHA512CryptRounds     = 999_999_999
+	MaxSHA512CryptSaltLength = 16
+)
+
+const cryptBase64Chars = "./0123456789" +
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// HashPassword returns a SHA-512 crypt hash of a password using a random
+// salt.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, MaxSHA512CryptSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("cannot generate salt: %w", err)
+	}
+
+	for i, b := range salt {
+		salt[i] = cryptBase64Chars[b%64]
+	}
+
+	return sha512Crypt(password, string(salt), DefaultSHA512CryptRounds, false),
+		nil
+}
+
+// CheckPassword returns true if a password matches a hash.
+func CheckPassword(hash, password string) (bool, error) {
+	if !strings.HasPrefix(hash, sha512CryptPrefix) {
+		return false, fmt.Errorf("unsupported hash format")
+	}
+
+	params := strings.Split(hash[len(sha512CryptPrefix):], "$")
+
+	rounds := DefaultSHA512CryptRounds
+	explicitRounds := false
+
+	if len(params) == 3 && strings.HasPrefix(params[0], "rounds=") {
+		n, err := strconv.Atoi(params[0][len("rounds="):])
+		if err != nil {
+			return false, fmt.Errorf("invalid number of rounds")
+		}
+
+		rounds = min(max(n, MinSHA512CryptRounds), MaxSHA512CryptRounds)
+		explicitRounds = true
+
+		params = params[1:]
+	}
+
+	if len(params) != 2 {
+		return false, fmt.Errorf("invalid hash format")
+	}
+
+	expectedHash := sha512Crypt(password, params[0], rounds, explicitRounds)
+
+	ok := subtle.ConstantTimeCompare([]byte(hash), []byte(expectedHash)) == 1
+	return ok, nil
+}
+
+func sha512Crypt(password, salt string, rounds int, explicitRounds bool) string {
+	if len(salt) > MaxSHA512CryptSaltLength {
+		salt = salt[:MaxSHA512CryptSaltLength]
+	}
+
+	p := []byte(password)
+	s := []byte(salt)
+
+	// Digest B
+	h := sha512.New()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	// Digest A
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	h.Write(repeatBytes(b, len(p)))
+
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+
+	a := h.Sum(nil)
+
+	// Byte sequence P
+	h.Reset()
+	for range len(p) {
+		h.Write(p)
+	}
+	ps := repeatBytes(h.Sum(nil), len(p))
+
+	// Byte sequence S
+	h.Reset()
+	for range 16 + int(a[0]) {
+		h.Write(s)
+	}
+	ss := repeatBytes(h.Sum(nil), len(s))
+
+	// Rounds
+	c := a
+
+	for i := range rounds {
+		h.Reset()
+
+		if i&1 != 0 {
+			h.Write(ps)
+		} else {
+			h.Write(c)
+		}
+
+		if i%3 != 0 {
+			h.Write(ss)
+		}
+
+		if i%7 != 0 {
+			h.Write(ps)
+		}
+
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(ps)
+		}
+
+		c = h.Sum(nil)
+	}
+
+	var buf strings.Builder
+
+	buf.WriteString(sha512CryptPrefix)
+	if explicitRounds {
+		fmt.Fprintf(&buf, "rounds=%d$", rounds)
+	}
+	buf.WriteString(salt)
+	buf.WriteByte('$')
+
+	// The digest is encoded by groups of three bytes in a specific order
+	for i := range 21 {
+		i0, i1, i2 := i, i+21, i+42
+
+		switch i % 3 {
+		case 0:
+			writeCryptBase64(&buf, c[i0], c[i1], c[i2], 4)
+		case 1:
+			writeCryptBase64(&buf, c[i1], c[i2], c[i0], 4)
+		case 2:
+			writeCryptBase64(&buf, c[i2], c[i0], c[i1], 4)
+		}
+	}
+	writeCryptBase64(&buf, 0, 0, c[63], 2)
+
+	return buf.String()
+}
+
+func repeatBytes(data []byte, n int) []byte {
+	buf := make([]byte, n)
+
+	for i := 0; i < n; i += len(data) {
+		copy(buf[i:], data)
+	}
+
+	return buf
+}
+
+func writeCryptBase64(buf *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+
+	for range n {
+		buf.WriteByte(cryptBase64Chars[w&0x3f])
+		w >>= 6
+	}
+}
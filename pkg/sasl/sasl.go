@@ -0,0 +1,158 @@
+package sasl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RFC 4422 Simple Authentication and Security Layer (SASL)
+//
+// Only server-side mechanisms transmitting the password in clear text are
+// supported; they must only be offered over TLS connections.
+
+var (
+	ErrAuthenticationFailed = errors.New("authentication failed")
+	ErrUnsupportedMechanism = errors.New("unsupported mechanism")
+)
+
+// Mechanisms contains the names of supported mechanisms in order of
+// preference.
+var Mechanisms = []string{
+	"PLAIN",
+	"LOGIN",
+}
+
+// Authenticator is implemented by credential stores. Authenticate must return
+// ErrAuthenticationFailed if the user does not exist or if the password is
+// incorrect, so that both cases are indistinguishable to clients.
+type Authenticator interface {
+	Authenticate(username, password string) error
+}
+
+// ServerMechanism is the server side of an authentication exchange.
+type ServerMechanism interface {
+	// Next processes a client response and returns the next challenge to
+	// send, or done=true once the client is authenticated. The response of
+	// the first call is nil if the client did not send an initial response.
+	Next(response []byte) (challenge []byte, done bool, err error)
+
+	// Identity returns the name of the authenticated user
+	Identity() string
+}
+
+func NewServerMechanism(name string, authenticator Authenticator) (ServerMechanism, error) {
+	switch strings.ToUpper(name) {
+	case "PLAIN":
+		return &plainMechanism{authenticator: authenticator}, nil
+	case "LOGIN":
+		return &loginMechanism{authenticator: authenticator}, nil
+	}
+
+	return nil, ErrUnsupportedMechanism
+}
+
+// RFC 4616 The PLAIN Simple Authentication and Security Layer (SASL)
+// Mechanism
+type plainMechanism struct {
+	authenticator Authenticator
+	identity      string
+}
+
+func (m *plainMechanism) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, fmt.Errorf("invalid response")
+	}
+
+	authzid := string(parts[0])
+	authcid := string(parts[1])
+	password := string(parts[2])
+
+	if authcid == "" {
+		return nil, false, fmt.Errorf("empty authentication identity")
+	}
+
+	// Users cannot act on behalf of other users
+	if authzid != "" && authzid != authcid {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	if err := m.authenticator.Authenticate(authcid, password); err != nil {
+		return nil, false, err
+	}
+
+	m.identity = authcid
+
+	return nil, true, nil
+}
+
+func (m *plainMechanism) Identity() string {
+	return m.identity
+}
+
+// The LOGIN mechanism is obsolete but still used by various clients; it is
+// described in draft-murchison-sasl-login-00.
+type loginMechanism struct {
+	authenticator Authenticator
+	username      *string
+	identity      string
+}
+
+func (m *loginMechanism) Next(response []byte) ([]byte, bool, error) {
+	if m.username == nil {
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+
+		username := string(response)
+		m.username = &username
+
+		return []byte("Password:"), false, nil
+	}
+
+	if *m.username == "" {
+		return nil, false, fmt.Errorf("empty user name")
+	}
+
+	err := m.authenticator.Authenticate(*m.username, string(response))
+	if err != nil {
+		return nil, false, err
+	}
+
+	m.identity = *m.username
+
+	return nil, true, nil
+}
+
+func (m *loginMechanism) Identity() string {
+	return m.identity
+}
+
+// PasswordTable is an authenticator associating user names with password
+// hashes.
+type PasswordTable map[string]string
+
+func (t PasswordTable) Authenticate(username, password string) error {
+	hash, found := t[username]
+	if !found {
+		return ErrAuthenticationFailed
+	}
+
+	ok, err := CheckPassword(hash, password)
+	if err != nil {
+		return fmt.Errorf("invalid password hash for user %q: %w",
+			username, err)
+	}
+
+	if !ok {
+		return ErrAuthenticationFailed
+	}
+
+	return nil
+}
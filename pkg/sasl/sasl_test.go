@@ -0,0 +1,120 @@
+package sasl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	// Test vectors from "Unix crypt using SHA-256 and SHA-512" and
+	// "openssl passwd -6"
+	tests := []struct {
+		hash     string
+		password string
+	}{
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNj" +
+			"nQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			"Hello world!"},
+		{"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0s" +
+			"bHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+			"Hello world!"},
+		{"$6$anotherlongsalts$zCB2J77iwc/56nB80mcnR6gCDELuiqcwDzPCm3OZnzRQy" +
+			"xT9pVMJ2vfOf0YI0AvrvfVu.AqASga4nxwhEPO7Z0",
+			"a very much longer text to encrypt.  This one even stretches " +
+				"over morethan one line."},
+	}
+
+	for _, test := range tests {
+		ok, err := CheckPassword(test.hash, test.password)
+		if err != nil {
+			t.Errorf("cannot check password %q: %v", test.password, err)
+		} else if !ok {
+			t.Errorf("password %q does not match hash %q",
+				test.password, test.hash)
+		}
+
+		if ok, _ := CheckPassword(test.hash, "invalid"); ok {
+			t.Errorf("invalid password matches hash %q", test.hash)
+		}
+	}
+
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	if ok, err := CheckPassword(hash, "secret"); err != nil || !ok {
+		t.Errorf("password does not match generated hash %q", hash)
+	}
+}
+
+func TestServerMechanisms(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	authenticator := PasswordTable{"bob": hash}
+
+	tests := []struct {
+		mechanism string
+		responses []string // "nil" for a missing initial response
+		identity  string   // empty if authentication must fail
+	}{
+		{"PLAIN", []string{"\x00bob\x00secret"}, "bob"},
+		{"plain", []string{"nil", "bob\x00bob\x00secret"}, "bob"},
+		{"PLAIN", []string{"\x00bob\x00invalid"}, ""},
+		{"PLAIN", []string{"alice\x00bob\x00secret"}, ""},
+		{"PLAIN", []string{"\x00alice\x00secret"}, ""},
+		{"PLAIN", []string{"bob"}, ""},
+		{"LOGIN", []string{"nil", "bob", "secret"}, "bob"},
+		{"LOGIN", []string{"bob", "secret"}, "bob"},
+		{"LOGIN", []string{"nil", "bob", "invalid"}, ""},
+	}
+
+	for _, test := range tests {
+		m, err := NewServerMechanism(test.mechanism, authenticator)
+		if err != nil {
+			t.Errorf("cannot create %s mechanism: %v", test.mechanism, err)
+			continue
+		}
+
+		var done bool
+
+		for _, response := range test.responses {
+			var data []byte
+			if response != "nil" {
+				data = []byte(response)
+			}
+
+			_, done, err = m.Next(data)
+			if err != nil {
+				break
+			}
+		}
+
+		if test.identity == "" {
+			if err == nil {
+				t.Errorf("%s authentication with %q should have failed",
+					test.mechanism, test.responses)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s authentication with %q failed: %v",
+				test.mechanism, test.responses, err)
+		} else if !done {
+			t.Errorf("%s authentication with %q is not complete",
+				test.mechanism, test.responses)
+		} else if m.Identity() != test.identity {
+			t.Errorf("%s authentication with %q returned identity %q",
+				test.mechanism, test.responses, m.Identity())
+		}
+	}
+
+	if _, err := NewServerMechanism("CRAM-MD5", authenticator); !errors.Is(err, ErrUnsupportedMechanism) {
+		t.Errorf("unsupported mechanism accepted")
+	}
+}
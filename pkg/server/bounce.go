@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/galdor/emaild/pkg/delivery"
+	"github.com/galdor/emaild/pkg/dsn"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/smtp"
+)
+
+// RFC 3463 2. Enhanced status codes at the beginning of reply lines.
+var enhancedStatusRE = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}\b`)
+
+// bounceQueuedMessage notifies the sender of a queued message that it could
+// not be delivered to some of its recipients.
+func (s *Server) bounceQueuedMessage(msg *delivery.QueuedMessage, failures []delivery.QueueFailure) {
+	if msg.ReversePath == nil {
+		return
+	}
+
+	// The original message is included in the report if possible, but the
+	// sender must be notified even if it cannot be decoded.
+	original, err := imf.NewMessageDecoder().DecodeAll(msg.Data)
+	if err != nil {
+		s.Log.Error("cannot decode message %s: %v", msg.Id, err)
+		original = &imf.Message{}
+	}
+
+	s.bounceMessage(msg.Id, msg.ReversePath, msg.DSNParameters, original,
+		msg.CreationTime, failures)
+}
+
+// bounceMessage notifies the sender of a message that it could not be
+// delivered to some of its recipients (RFC 5321 4.5.5.). Recipients whose
+// NOTIFY parameter excludes failures are not reported (RFC 3461 4.1.).
+func (s *Server) bounceMessage(id string, reversePath *imf.SpecificAddress, params dsn.Parameters, msg *imf.Message, arrivalDate time.Time, failures []delivery.QueueFailure) {
+	if reversePath == nil {
+		return
+	}
+
+	now := time.Now()
+
+	report := dsn.Report{
+		ReportingMTA:   s.Cfg.Hostname,
+		EnvelopeId:     params.EnvelopeId,
+		ArrivalDate:    arrivalDate,
+		ReturnType:     params.ReturnType,
+		Date:           now,
+		MessageIdRight: imf.Domain(s.Cfg.Hostname),
+	}
+
+	for _, failure := range failures {
+		if !failure.DSNParameters.Notifies(dsn.NotifyFailure) {
+			continue
+		}
+
+		status, diagnosticCode := bounceStatus(failure)
+
+		rs := dsn.RecipientStatus{
+			OriginalRecipient: failure.DSNParameters.OriginalRecipient,
+			FinalRecipient:    failure.Recipient,
+			Action:            dsn.ActionFailed,
+			Status:            status,
+			DiagnosticCode:    diagnosticCode,
+			LastAttemptDate:   now,
+		}
+
+		report.Recipients = append(report.Recipients, &rs)
+	}
+
+	if len(report.Recipients) == 0 {
+		return
+	}
+
+	bounce, err := dsn.GenerateBounce(&report, reversePath, msg)
+	if err != nil {
+		s.Log.Error("cannot generate bounce for message %s: %v", id, err)
+		return
+	}
+
+	if err := s.sendMessage(bounce.Recipient, bounce.Message); err != nil {
+		s.Log.Error("cannot send bounce for message %s to %q: %v", id,
+			bounce.Recipient.String(), err)
+		return
+	}
+
+	s.Log.Info("bounce for message %s sent to %q", id,
+		bounce.Recipient.String())
+}
+
+// bounceStatus returns the status code and the diagnostic code reported for a
+// delivery failure. The diagnostic code is the SMTP reply which caused the
+// failure, if there is one.
+func bounceStatus(failure delivery.QueueFailure) (string, string) {
+	status := "5.0.0"
+	diagnosticCode := ""
+
+	var replyErr *smtp.ReplyError
+	var smtpErr *smtp.Error
+
+	switch {
+	case errors.As(failure.Err, &replyErr):
+		reply := replyErr.Reply
+
+		if len(reply.Lines) > 0 {
+			if s := enhancedStatusRE.FindString(reply.Lines[0]); s != "" {
+				status = s
+			}
+		}
+
+		diagnosticCode = reply.String()
+
+	case errors.As(failure.Err, &smtpErr):
+		if smtpErr.Status != "" {
+			status = smtpErr.Status
+		}
+
+		diagnosticCode = smtpErr.Error()
+	}
+
+	// RFC 3463 X.4.7 Delivery time expired
+	if failure.Expired {
+		status = "4.4.7"
+	}
+
+	return status, diagnosticCode
+}
+
+// sendMessage signs and delivers a message generated by the server.
+// Generated messages always have a null reverse-path so that they never
+// cause a bounce.
+func (s *Server) sendMessage(recipient imf.SpecificAddress, msg *imf.Message) error {
+	if err := s.signMessage(msg); err != nil {
+		return err
+	}
+
+	tx := smtp.Transaction{
+		ForwardPaths: []imf.SpecificAddress{recipient},
+		Message:      msg,
+	}
+
+	plan := newDeliveryPlan(true)
+
+	err := s.planDelivery(plan, recipient, dsn.RecipientParameters{})
+	if err != nil {
+		return err
+	}
+
+	return s.executePlan(&tx, plan)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/delivery"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/emaild/pkg/testutils"
+)
+
+// startTestRejectingServer starts a minimal SMTP server which rejects all
+// recipients and returns its port.
+func startTestRejectingServer(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				conn.Write([]byte("220 test\r\n"))
+
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					var reply string
+
+					switch {
+					case strings.HasPrefix(line, "RCPT"):
+						reply = "550 5.1.1 unknown mailbox"
+					case strings.HasPrefix(line, "QUIT"):
+						conn.Write([]byte("221 bye\r\n"))
+						return
+					default:
+						reply = "250 ok"
+					}
+
+					conn.Write([]byte(reply + "\r\n"))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func freeTestPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestBounceDSNParameters(t *testing.T) {
+	hash, err := sasl.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	maildirPath := t.TempDir()
+	if err := os.Mkdir(path.Join(maildirPath, "alice"), 0700); err != nil {
+		t.Fatalf("cannot create maildir: %v", err)
+	}
+
+	port := freeTestPort(t)
+
+	cfg := ServerCfg{
+		Hostname: "mx.example.com",
+		Users:    map[string]string{"alice@example.com": hash},
+		SMTPServers: map[string]*smtp.ServerCfg{
+			"submission": {
+				Host:       "127.0.0.1",
+				Port:       port,
+				PublicHost: "mx.example.com",
+				Mode:       smtp.ServerModeMSA,
+				TLSConfig:  testutils.TLSConfig(t),
+			},
+		},
+		Routing: &delivery.RoutingCfg{
+			Transports: map[string]*delivery.TransportCfg{
+				"local": {
+					Type:  delivery.TransportTypeLocal,
+					Local: &delivery.LocalTransportCfg{Path: maildirPath},
+				},
+				"relay": {
+					Type: delivery.TransportTypeRelay,
+					Relay: &delivery.RelayTransportCfg{
+						Host: "127.0.0.1",
+						Port: startTestRejectingServer(t),
+						TLS:  delivery.TLSModeNone,
+					},
+				},
+			},
+			Routes: map[string]string{
+				"example.com": "local",
+				"example.net": "relay",
+			},
+		},
+		Queue: &delivery.QueueCfg{Path: t.TempDir()},
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("cannot create server: %v", err)
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+	defer s.Stop()
+
+	client, err := smtp.NewClient("127.0.0.1:"+strconv.Itoa(port),
+		smtp.ClientCfg{
+			Domain:    "client.example.com",
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		})
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+	defer client.Close()
+
+	if !client.HasExtension("DSN") {
+		t.Errorf("missing DSN extension")
+	}
+
+	if err := client.StartTLS(); err != nil {
+		t.Fatalf("cannot start TLS: %v", err)
+	}
+
+	if err := client.Auth("alice@example.com", "secret"); err != nil {
+		t.Fatalf("cannot authenticate: %v", err)
+	}
+
+	for _, command := range []string{
+		"MAIL FROM:<alice@example.com> RET=FULL ENVID=QQ+2B42",
+		"RCPT TO:<bob@example.net> ORCPT=rfc822;robert@example.net",
+		"RCPT TO:<carol@example.net> NOTIFY=NEVER",
+	} {
+		reply, err := client.Command("%s", command)
+		if err != nil {
+			t.Fatalf("cannot send command: %v", err)
+		} else if reply.Code != 250 {
+			t.Fatalf("unexpected reply %v to %q", reply, command)
+		}
+	}
+
+	data := "From: alice@example.com\r\n" +
+		"Subject: test\r\n" +
+		"\r\n" +
+		"Hello.\r\n"
+
+	if err := client.Data([]byte(data)); err != nil {
+		t.Fatalf("cannot send DATA command: %v", err)
+	}
+
+	// The queue gives up on both recipients after the first attempt; only
+	// the first one is reported.
+	newPath := path.Join(maildirPath, "alice", "new")
+
+	var bounce string
+
+	for deadline := time.Now().Add(10 * time.Second); bounce == ""; {
+		if time.Now().After(deadline) {
+			t.Fatalf("bounce not delivered")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		entries, _ := os.ReadDir(newPath)
+		if len(entries) == 0 {
+			continue
+		}
+
+		content, err := os.ReadFile(path.Join(newPath, entries[0].Name()))
+		if err != nil {
+			t.Fatalf("cannot read bounce: %v", err)
+		}
+
+		bounce = string(content)
+	}
+
+	for _, s := range []string{
+		"Original-Envelope-Id: QQ+42\n",
+		"Original-Recipient: rfc822; robert@example.net\n",
+		"Final-Recipient: rfc822; bob@example.net\n",
+		"Content-Type: message/rfc822\n",
+		"\nHello.\n",
+	} {
+		if !strings.Contains(bounce, s) {
+			t.Errorf("bounce does not contain %q", s)
+		}
+	}
+
+	if strings.Contains(bounce, "carol@example.net") {
+		t.Errorf("bounce reports a recipient with NOTIFY=NEVER")
+	}
+}
@@ -4,7 +4,21 @@ import (
 	"fmt"
 	"io/ioutil"
 
+	"github.com/galdor/emaild/pkg/arc"
+	"github.com/galdor/emaild/pkg/delivery"
+	"github.com/galdor/emaild/pkg/directory"
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/dmarc"
+	"github.com/galdor/emaild/pkg/dnsbl"
+	"github.com/galdor/emaild/pkg/greylist"
+	"github.com/galdor/emaild/pkg/imap"
+	"github.com/galdor/emaild/pkg/jmap"
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/managesieve"
+	"github.com/galdor/emaild/pkg/pop3"
+	"github.com/galdor/emaild/pkg/sieve"
 	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/emaild/pkg/vacation"
 	"github.com/galdor/go-ejson"
 	"github.com/galdor/go-log"
 	"go.n16f.net/eyaml"
@@ -13,8 +27,45 @@ import (
 type ServerCfg struct {
 	BuildId string `json:"-"`
 
+	// The name of the host sent to remote servers; the default is the host
+	// name of the system.
+	Hostname string `json:"hostname,omitempty"`
+
 	Logger      *log.LoggerCfg             `json:"logger"`
 	SMTPServers map[string]*smtp.ServerCfg `json:"smtp_servers"`
+	POP3Servers map[string]*pop3.ServerCfg `json:"pop3_servers"`
+	Routing     *delivery.RoutingCfg       `json:"routing"`
+
+	// Messages sent to remote recipients are stored in the queue until they
+	// are delivered; remote delivery is disabled if there is no queue.
+	Queue *delivery.QueueCfg `json:"queue"`
+
+	ConnectionPool *delivery.PoolCfg `json:"connection_pool"`
+
+	DKIMSigning *dkim.SignerCfg `json:"dkim_signing"`
+	ARCSealing  *arc.SealerCfg  `json:"arc_sealing"`
+	DMARC       *dmarc.Cfg      `json:"dmarc"`
+	DNSBL       *dnsbl.Cfg      `json:"dnsbl"`
+	Greylisting *greylist.Cfg   `json:"greylisting"`
+
+	// SHA-512 crypt password hashes indexed by user name
+	Users map[string]string `json:"users"`
+
+	// The addresses users of the users map can send messages from, indexed
+	// by user name. Users whose name is an address can always use it.
+	UserAddresses map[string][]string `json:"user_addresses"`
+
+	// Hosted domains, users, aliases and lists; read again on reload
+	Directory *directory.Cfg `json:"directory"`
+
+	SieveScripts       *sieve.StoreCfg                   `json:"sieve_scripts"`
+	ManageSieveServers map[string]*managesieve.ServerCfg `json:"managesieve_servers"`
+
+	Vacation *vacation.Cfg `json:"vacation"`
+
+	MessageStore *mailstore.Cfg             `json:"message_store"`
+	IMAPServers  map[string]*imap.ServerCfg `json:"imap_servers"`
+	JMAPServers  map[string]*jmap.ServerCfg `json:"jmap_servers"`
 }
 
 func (cfg *ServerCfg) ValidateJSON(v *ejson.Validator) {
@@ -25,6 +76,66 @@ func (cfg *ServerCfg) ValidateJSON(v *ejson.Validator) {
 			v.CheckObject(name, cfg)
 		}
 	})
+
+	v.WithChild("pop3_servers", func() {
+		for name, cfg := range cfg.POP3Servers {
+			v.CheckObject(name, cfg)
+		}
+	})
+
+	v.CheckOptionalObject("routing", cfg.Routing)
+	v.CheckOptionalObject("queue", cfg.Queue)
+	v.CheckOptionalObject("connection_pool", cfg.ConnectionPool)
+
+	v.CheckOptionalObject("dkim_signing", cfg.DKIMSigning)
+	v.CheckOptionalObject("arc_sealing", cfg.ARCSealing)
+	v.CheckOptionalObject("dmarc", cfg.DMARC)
+	v.CheckOptionalObject("dnsbl", cfg.DNSBL)
+	v.CheckOptionalObject("greylisting", cfg.Greylisting)
+
+	v.WithChild("users", func() {
+		for name, hash := range cfg.Users {
+			v.CheckStringNotEmpty(name, hash)
+		}
+	})
+
+	v.WithChild("user_addresses", func() {
+		for name, addresses := range cfg.UserAddresses {
+			v.WithChild(name, func() {
+				for i, address := range addresses {
+					_, err := parseAddress(address)
+					v.Check(i, err == nil, "invalid_address",
+						"invalid address %q", address)
+				}
+			})
+		}
+	})
+
+	v.CheckOptionalObject("directory", cfg.Directory)
+
+	v.CheckOptionalObject("sieve_scripts", cfg.SieveScripts)
+
+	v.WithChild("managesieve_servers", func() {
+		for name, cfg := range cfg.ManageSieveServers {
+			v.CheckObject(name, cfg)
+		}
+	})
+
+	v.CheckOptionalObject("vacation", cfg.Vacation)
+
+	v.CheckOptionalObject("message_store", cfg.MessageStore)
+
+	v.WithChild("imap_servers", func() {
+		for name, cfg := range cfg.IMAPServers {
+			v.CheckObject(name, cfg)
+		}
+	})
+
+	v.WithChild("jmap_servers", func() {
+		for name, cfg := range cfg.JMAPServers {
+			v.CheckObject(name, cfg)
+		}
+	})
 }
 
 func (cfg *ServerCfg) Load(filePath string) error {
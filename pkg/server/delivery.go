@@ -0,0 +1,615 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/delivery"
+	"github.com/galdor/emaild/pkg/directory"
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/dsn"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/jmap"
+	"github.com/galdor/emaild/pkg/sieve"
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/emaild/pkg/vacation"
+)
+
+func (s *Server) handleMessage(tx *smtp.Transaction) error {
+	// Messages submitted by authenticated users are signed before being
+	// delivered, whatever their recipients.
+	if tx.Identity != "" {
+		if err := s.signMessage(tx.Message); err != nil {
+			return err
+		}
+	}
+
+	if tx.LMTP {
+		return s.handleLMTPMessage(tx)
+	}
+
+	// Messages are only accepted if all recipients can be handled, so that a
+	// partial failure never causes the client to resend the message to
+	// recipients which already received it. This includes the expansion of
+	// aliases and lists.
+	plan := newDeliveryPlan(tx.Identity != "")
+
+	for i, forwardPath := range tx.ForwardPaths {
+		params := tx.RecipientDSNParameters[i]
+
+		if err := s.planDelivery(plan, forwardPath, params); err != nil {
+			return err
+		}
+	}
+
+	return s.executePlan(tx, plan)
+}
+
+// handleLMTPMessage delivers a message received in LMTP mode. LMTP clients
+// receive one reply per recipient (RFC 2033 4.2.), so a failure for one
+// recipient does not prevent delivery to the others.
+func (s *Server) handleLMTPMessage(tx *smtp.Transaction) error {
+	errs := make(smtp.RecipientErrors, len(tx.ForwardPaths))
+	failed := false
+
+	delivered := make(map[string]bool)
+
+	for i, forwardPath := range tx.ForwardPaths {
+		plan := newDeliveryPlan(tx.Identity != "")
+		plan.delivered = delivered
+
+		err := s.planDelivery(plan, forwardPath,
+			tx.RecipientDSNParameters[i])
+		if err == nil {
+			err = s.executePlan(tx, plan)
+		}
+
+		if err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+
+	return nil
+}
+
+// localDelivery is the delivery of a message to a single mailbox, either the
+// account of a directory user in the message store or a Maildir directory.
+type localDelivery struct {
+	recipient     imf.SpecificAddress
+	dsnParameters dsn.RecipientParameters
+	user          *directory.User
+	transport     *delivery.LocalTransport
+	redirected    bool // true if the message was redirected by a Sieve script
+}
+
+// remoteDelivery is the delivery of a message to a remote address through
+// the queue.
+type remoteDelivery struct {
+	recipient     imf.SpecificAddress
+	dsnParameters dsn.RecipientParameters
+}
+
+// deliveryPlan contains the deliveries required for a set of recipients.
+// Mailboxes and addresses found in the delivered set are skipped so that each
+// of them receives a single copy of the message, even when it is reached
+// through several recipients.
+type deliveryPlan struct {
+	local     []localDelivery
+	remote    []remoteDelivery
+	forwarded []remoteDelivery // remote addresses of aliases and lists
+	delivered map[string]bool
+
+	// Only messages sent by authenticated users and messages generated by
+	// the server can be sent to remote recipients.
+	relay bool
+
+	// True for messages redirected by a Sieve script; remote recipients
+	// are then forwarded.
+	redirected bool
+}
+
+func newDeliveryPlan(relay bool) *deliveryPlan {
+	return &deliveryPlan{
+		delivered: make(map[string]bool),
+		relay:     relay,
+	}
+}
+
+// planDelivery adds the deliveries required for a recipient to a plan.
+// Addresses of hosted domains are expanded using the directory; other
+// addresses are routed. Addresses obtained by expanding aliases and lists are
+// always accepted, even if the plan does not allow relaying. The DSN
+// parameters of the recipient apply to all the addresses it expands to.
+func (s *Server) planDelivery(plan *deliveryPlan, forwardPath imf.SpecificAddress, params dsn.RecipientParameters) error {
+	dir := s.Directory()
+	if dir == nil || !dir.HasDomain(string(forwardPath.Domain)) {
+		return s.planAddressDelivery(plan, forwardPath, params, false)
+	}
+
+	recipients, err := dir.Resolve(forwardPath)
+	if err != nil {
+		if errors.Is(err, directory.ErrRecipientNotFound) {
+			return smtp.NewError(550, "5.1.1", "unknown mailbox %q",
+				forwardPath.String())
+		}
+
+		return fmt.Errorf("cannot resolve %q: %w", forwardPath.String(),
+			err)
+	}
+
+	for _, user := range recipients.Users {
+		if !plan.delivered[user.Name] {
+			plan.delivered[user.Name] = true
+
+			d := localDelivery{
+				recipient:     forwardPath,
+				dsnParameters: params,
+				user:          user,
+				redirected:    plan.redirected,
+			}
+
+			plan.local = append(plan.local, d)
+		}
+	}
+
+	for _, addr := range recipients.Addresses {
+		if err := s.planAddressDelivery(plan, addr, params, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planAddressDelivery routes an address which is not expanded by the
+// directory. Remote addresses obtained by expansion or by a Sieve redirection
+// are forwarded: the message is sealed before being sent to them.
+func (s *Server) planAddressDelivery(plan *deliveryPlan, addr imf.SpecificAddress, params dsn.RecipientParameters, expanded bool) error {
+	key := strings.ToLower(addr.String())
+	if plan.delivered[key] {
+		return nil
+	}
+
+	route, err := s.Router.Route(string(addr.Domain))
+	if err != nil {
+		return fmt.Errorf("cannot route message to %q: %w", addr.String(),
+			err)
+	}
+
+	switch route.Transport.Type {
+	case delivery.TransportTypeLocal:
+		transport := s.localTransports[route.TransportName]
+
+		if err := transport.CheckRecipient(addr); err != nil {
+			return s.localDeliveryError(addr.String(), err)
+		}
+
+		d := localDelivery{
+			recipient:     addr,
+			dsnParameters: params,
+			transport:     transport,
+			redirected:    plan.redirected,
+		}
+
+		plan.local = append(plan.local, d)
+
+	case delivery.TransportTypeReject:
+		return route.RejectionError()
+
+	default:
+		if !plan.relay && !expanded {
+			return smtp.NewError(554, "5.7.1", "relay access denied")
+		}
+
+		if s.Queue == nil {
+			return smtp.NewError(554, "5.3.2", "remote delivery not available")
+		}
+
+		d := remoteDelivery{
+			recipient:     addr,
+			dsnParameters: params,
+		}
+
+		if expanded || plan.redirected {
+			plan.forwarded = append(plan.forwarded, d)
+		} else {
+			plan.remote = append(plan.remote, d)
+		}
+	}
+
+	plan.delivered[key] = true
+
+	return nil
+}
+
+// executePlan checks that all local mailboxes can receive the message before
+// writing anything: the client can then safely send the message again if the
+// check fails. Local deliveries are performed first since they are the most
+// likely to fail. Once the message has been delivered to a recipient,
+// failures are reported to the sender with a bounce: returning an error
+// would cause the client to send the message again to all recipients.
+func (s *Server) executePlan(tx *smtp.Transaction, plan *deliveryPlan) error {
+	if err := s.checkQuotas(tx, plan); err != nil {
+		return err
+	}
+
+	var failures []delivery.QueueFailure
+	delivered := false
+
+	fail := func(recipient imf.SpecificAddress, params dsn.RecipientParameters, err error) error {
+		if !delivered {
+			return err
+		}
+
+		failure := delivery.QueueFailure{
+			Recipient:     recipient,
+			DSNParameters: params,
+			Err:           err,
+		}
+
+		failures = append(failures, failure)
+
+		return nil
+	}
+
+	failRemote := func(ds []remoteDelivery, err error) error {
+		for _, d := range ds {
+			if err := fail(d.recipient, d.dsnParameters, err); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, d := range plan.local {
+		if err := s.deliverMessage(tx, d); err != nil {
+			if err := fail(d.recipient, d.dsnParameters, err); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		delivered = true
+	}
+
+	if len(plan.remote) > 0 {
+		err := s.enqueueMessage(tx, plan.remote, tx.Message)
+		if err != nil {
+			if err := failRemote(plan.remote, err); err != nil {
+				return err
+			}
+		} else {
+			delivered = true
+		}
+	}
+
+	if len(plan.forwarded) > 0 {
+		err := s.enqueueMessage(tx, plan.forwarded, s.forwardedMessage(tx))
+		if err != nil {
+			if err := failRemote(plan.forwarded, err); err != nil {
+				return err
+			}
+		} else {
+			delivered = true
+		}
+	}
+
+	if len(failures) > 0 {
+		s.bounceMessage(tx.Id, tx.ReversePath, tx.DSNParameters, tx.Message,
+			time.Now(), failures)
+	}
+
+	return nil
+}
+
+// checkQuotas makes sure that the message fits in the accounts of all the
+// users of a plan. The size of the message is approximate since the fields
+// added at delivery are not included; quotas are checked again for each
+// delivery.
+func (s *Server) checkQuotas(tx *smtp.Transaction, plan *deliveryPlan) error {
+	size := -1
+
+	for _, d := range plan.local {
+		if d.user == nil || d.user.Quota == 0 {
+			continue
+		}
+
+		if size < 0 {
+			data, err := delivery.EncodeMessage(tx.Message)
+			if err != nil {
+				return err
+			}
+
+			size = len(data)
+		}
+
+		err := s.storeTransport.CheckQuota(d.user.Name, d.user.Quota, size)
+		if err != nil {
+			return s.localDeliveryError(d.user.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) enqueueMessage(tx *smtp.Transaction, ds []remoteDelivery, msg *imf.Message) error {
+	data, err := delivery.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	qmsg := delivery.QueuedMessage{
+		ReversePath:   tx.ReversePath,
+		DSNParameters: tx.DSNParameters,
+		Data:          data,
+	}
+
+	for _, d := range ds {
+		qmsg.Recipients = append(qmsg.Recipients, d.recipient)
+		qmsg.RecipientDSNParameters = append(qmsg.RecipientDSNParameters,
+			d.dsnParameters)
+	}
+
+	if _, err := s.Queue.Enqueue(&qmsg); err != nil {
+		s.Log.Error("cannot queue message: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// forwardedMessage returns the message sent to forwarded addresses. Messages
+// received from other servers are sealed (RFC 8617 5.1.) so that the
+// authentication results we obtained survive the modifications performed by
+// forwarding.
+func (s *Server) forwardedMessage(tx *smtp.Transaction) *imf.Message {
+	if s.ARCSealer == nil || tx.ARCResult == nil {
+		return tx.Message
+	}
+
+	msg := *tx.Message
+
+	err := s.ARCSealer.Seal(&msg, tx.PublicHost, tx.ARCResult.Status,
+		time.Now())
+	if err != nil {
+		s.Log.Error("cannot seal message %s: %v", tx.Id, err)
+		return tx.Message
+	}
+
+	return &msg
+}
+
+// deliverMessage performs a local delivery according to the Sieve script of
+// the owner of the mailbox. Messages quarantined because of the DMARC policy
+// of their author domain are kept in the junk mailbox.
+func (s *Server) deliverMessage(tx *smtp.Transaction, d localDelivery) error {
+	mailbox := d.recipient.String()
+	if d.user != nil {
+		mailbox = d.user.Name
+	}
+
+	actions := s.sieveActions(tx, d)
+
+	var vacationAction *sieve.VacationAction
+
+	for _, action := range actions {
+		// Replies are only sent once the message has been delivered
+		if a, ok := action.(*sieve.VacationAction); ok {
+			vacationAction = a
+			continue
+		}
+
+		err := s.executeSieveAction(tx, d, action)
+
+		// RFC 5228 2.10.6. The message is kept if it cannot be redirected
+		if _, ok := action.(*sieve.RedirectAction); ok && err != nil {
+			s.Log.Error("cannot redirect message: %v", err)
+
+			if !storesMessage(actions) {
+				err = s.executeSieveAction(tx, d, &sieve.KeepAction{})
+			} else {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			var smtpErr *smtp.Error
+			if errors.As(err, &smtpErr) {
+				return err
+			}
+
+			return s.localDeliveryError(mailbox, err)
+		}
+	}
+
+	if tx.Quarantine {
+		s.Log.Info("message delivered to %q (quarantined)", mailbox)
+	} else {
+		s.Log.Info("message delivered to %q", mailbox)
+	}
+
+	// Quarantined messages are never answered. Without vacation action,
+	// configured replies are only sent for messages which were stored.
+	if !tx.Quarantine && (vacationAction != nil || storesMessage(actions)) {
+		s.sendVacationReply(tx, d, vacationAction)
+	}
+
+	return nil
+}
+
+// sendVacationReply sends the automatic reply of the owner of a mailbox,
+// either for the vacation action of their Sieve script or, without action, if
+// vacation replies are enabled for them in the configuration. Failures do not
+// affect the delivery of the original message.
+func (s *Server) sendVacationReply(tx *smtp.Transaction, d localDelivery, action *sieve.VacationAction) {
+	user := mailboxOwner(d)
+
+	if s.VacationResponder == nil {
+		if action != nil {
+			s.Log.Error("cannot execute vacation action of user %q: "+
+				"vacation replies are disabled", user)
+		}
+
+		return
+	}
+
+	var reply *vacation.Reply
+	var err error
+
+	if action == nil {
+		reply, err = s.VacationResponder.Respond(user, tx.ReversePath,
+			tx.Message, time.Now())
+	} else {
+		userCfg, handle := s.sieveVacationCfg(d, action)
+		reply, err = s.VacationResponder.RespondWith(user, handle, userCfg,
+			tx.ReversePath, tx.Message, time.Now())
+	}
+
+	if err != nil {
+		s.Log.Error("cannot generate vacation reply for user %q: %v", user,
+			err)
+		return
+	} else if reply == nil {
+		return
+	}
+
+	if err := s.sendMessage(reply.Recipient, reply.Message); err != nil {
+		s.Log.Error("cannot send vacation reply of user %q to %q: %v", user,
+			reply.Recipient.String(), err)
+		return
+	}
+
+	s.Log.Info("vacation reply of user %q sent to %q", user,
+		reply.Recipient.String())
+}
+
+// localDeliveryError converts errors of local transports to the SMTP errors
+// returned to clients.
+func (s *Server) localDeliveryError(mailbox string, err error) error {
+	switch {
+	case errors.Is(err, delivery.ErrMailboxNotFound):
+		return smtp.NewError(550, "5.1.1", "unknown mailbox %q", mailbox)
+
+	case errors.Is(err, delivery.ErrQuotaExceeded):
+		// RFC 3463 X.2.2 Mailbox full
+		s.Log.Info("cannot deliver message to %q: quota exceeded", mailbox)
+		return smtp.NewError(552, "5.2.2", "mailbox full")
+	}
+
+	s.Log.Error("cannot deliver message to %q: %v", mailbox, err)
+	return err
+}
+
+// handleSubmission delivers a message sent by a JMAP client; submitted
+// messages are prepared as messages received in MSA mode and go through the
+// same delivery process.
+func (s *Server) handleSubmission(submission *jmap.Submission) error {
+	addresses, err := s.senderAddresses(submission.Identity)
+	if err != nil {
+		return err
+	}
+
+	err = smtp.PrepareSubmission(submission.Message, addresses,
+		s.Cfg.Hostname)
+	if err != nil {
+		return err
+	}
+
+	tx := smtp.Transaction{
+		Identity: submission.Identity,
+
+		ReversePath:  submission.ReversePath,
+		ForwardPaths: submission.ForwardPaths,
+		Message:      submission.Message,
+	}
+
+	s.Log.Info("message submitted by %q", submission.Identity)
+
+	return s.handleMessage(&tx)
+}
+
+// signMessage adds a DKIM signature to a message sent by one of our users or
+// generated by the server. Messages whose From domain has no signing key are
+// sent unsigned.
+func (s *Server) signMessage(msg *imf.Message) error {
+	err := s.DKIMSigner.Sign(msg)
+	if err != nil && !errors.Is(err, dkim.ErrNoSigningDomain) {
+		return fmt.Errorf("cannot sign message: %w", err)
+	}
+
+	return nil
+}
+
+// deliverQueuedMessage delivers a message of the queue to remote servers.
+// Recipients are grouped by domain so that each server receives a single
+// copy of the message for all its recipients. Routes are looked up for each
+// attempt so that routing changes apply to queued messages.
+func (s *Server) deliverQueuedMessage(ctx context.Context, msg *delivery.QueuedMessage) []error {
+	errs := make([]error, len(msg.Recipients))
+
+	var domains []string
+	domainRecipients := make(map[string][]int)
+
+	for i, recipient := range msg.Recipients {
+		domain := strings.ToLower(string(recipient.Domain))
+
+		if _, found := domainRecipients[domain]; !found {
+			domains = append(domains, domain)
+		}
+
+		domainRecipients[domain] = append(domainRecipients[domain], i)
+	}
+
+	for _, domain := range domains {
+		indexes := domainRecipients[domain]
+
+		recipients := make([]imf.SpecificAddress, len(indexes))
+		for i, index := range indexes {
+			recipients[i] = msg.Recipients[index]
+		}
+
+		domainErrs := s.deliverRemoteMessage(ctx, domain, msg.ReversePath,
+			recipients, msg.Data)
+
+		for i, index := range indexes {
+			errs[index] = domainErrs[i]
+		}
+	}
+
+	return errs
+}
+
+func (s *Server) deliverRemoteMessage(ctx context.Context, domain string, reversePath *imf.SpecificAddress, recipients []imf.SpecificAddress, data []byte) []error {
+	route, err := s.Router.Route(domain)
+	if err == nil {
+		switch route.Transport.Type {
+		case delivery.TransportTypeMX, delivery.TransportTypeRelay:
+			return s.remoteTransport.Deliver(ctx, route, domain, reversePath,
+				recipients, data)
+
+		case delivery.TransportTypeReject:
+			err = route.RejectionError()
+
+		default:
+			err = smtp.NewError(554, "5.3.2", "no remote route to domain %q",
+				domain)
+		}
+	}
+
+	errs := make([]error, len(recipients))
+	for i := range errs {
+		errs[i] = err
+	}
+
+	return errs
+}
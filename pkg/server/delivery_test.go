@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/delivery"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/go-log"
+)
+
+func TestExecutePlanForwarded(t *testing.T) {
+	msgChan := make(chan *delivery.QueuedMessage, 1)
+
+	queue, err := delivery.NewQueue(delivery.QueueCfg{
+		Log:  log.DefaultLogger("test"),
+		Path: t.TempDir(),
+		Handler: func(ctx context.Context, msg *delivery.QueuedMessage) []error {
+			msgChan <- msg
+			return make([]error, len(msg.Recipients))
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot create queue: %v", err)
+	}
+
+	queue.Start()
+	defer queue.Stop()
+
+	s := Server{
+		Log:   log.DefaultLogger("test"),
+		Queue: queue,
+	}
+
+	msg, err := imf.NewMessageDecoder().DecodeAll([]byte(
+		"From: alice@example.com\r\n" +
+			"Subject: test\r\n" +
+			"\r\n" +
+			"Hello.\r\n"))
+	if err != nil {
+		t.Fatalf("cannot decode message: %v", err)
+	}
+
+	alice := imf.SpecificAddress{LocalPart: "alice", Domain: "example.com"}
+	bob := imf.SpecificAddress{LocalPart: "bob", Domain: "example.net"}
+
+	tx := smtp.Transaction{
+		Id:           "test",
+		ReversePath:  &alice,
+		ForwardPaths: []imf.SpecificAddress{bob},
+		Message:      msg,
+	}
+
+	// All recipients of the message are forwarded to a remote address
+	plan := newDeliveryPlan(false)
+	plan.forwarded = []remoteDelivery{{recipient: bob}}
+
+	if err := s.executePlan(&tx, plan); err != nil {
+		t.Fatalf("cannot execute plan: %v", err)
+	}
+
+	select {
+	case queuedMsg := <-msgChan:
+		if len(queuedMsg.Recipients) != 1 || queuedMsg.Recipients[0] != bob {
+			t.Errorf("message queued for %v instead of %v",
+				queuedMsg.Recipients, bob)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("forwarded message not delivered")
+	}
+}
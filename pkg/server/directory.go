@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/galdor/emaild/pkg/directory"
+	"github.com/galdor/emaild/pkg/dsn"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/smtp"
+)
+
+// Directory returns the current directory, or nil if the directory is
+// disabled. The directory is replaced when the server is reloaded, so callers
+// must not keep it.
+func (s *Server) Directory() *directory.Directory {
+	s.directoryMutex.RLock()
+	defer s.directoryMutex.RUnlock()
+
+	return s.directory
+}
+
+func (s *Server) loadDirectory(cfg ServerCfg) (*directory.Directory, error) {
+	if cfg.Directory == nil {
+		return nil, nil
+	}
+
+	if s.MessageStore == nil {
+		return nil, fmt.Errorf("directory requires a message store")
+	}
+
+	dir, err := directory.Load(*cfg.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load directory: %w", err)
+	}
+
+	return dir, nil
+}
+
+// Reload applies a new configuration. Only the directory is reloaded; other
+// changes require a restart. The current configuration is kept if the new
+// one is invalid.
+func (s *Server) Reload(cfg ServerCfg) error {
+	dir, err := s.loadDirectory(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.directoryMutex.Lock()
+	s.directory = dir
+	s.directoryMutex.Unlock()
+
+	s.Log.Info("directory reloaded")
+
+	return nil
+}
+
+// authenticator checks credentials of directory users first, then of users
+// listed in the configuration.
+type authenticator struct {
+	server    *Server
+	passwords sasl.PasswordTable
+}
+
+func (a *authenticator) Authenticate(username, password string) error {
+	if dir := a.server.Directory(); dir != nil && dir.User(username) != nil {
+		return dir.Authenticate(username, password)
+	}
+
+	return a.passwords.Authenticate(username, password)
+}
+
+// senderAddresses returns the addresses a user can send messages from: those
+// of directory users, i.e. their address and the aliases leading to them, or
+// the addresses configured for other users.
+func (s *Server) senderAddresses(identity string) ([]imf.SpecificAddress, error) {
+	if dir := s.Directory(); dir != nil && dir.User(identity) != nil {
+		return dir.UserAddresses(identity), nil
+	}
+
+	addrs := smtp.IdentityAddresses(identity)
+
+	for _, address := range s.Cfg.UserAddresses[identity] {
+		addr, err := parseAddress(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", address, err)
+		}
+
+		addrs = append(addrs, *addr)
+	}
+
+	return addrs, nil
+}
+
+// checkRecipient rejects recipients during the SMTP transaction instead of
+// accepting messages which cannot be delivered: unknown addresses of hosted
+// domains, rejected domains and remote recipients of unauthenticated
+// clients. Recipients are checked with the same planning process used for
+// delivery.
+func (s *Server) checkRecipient(identity string, forwardPath imf.SpecificAddress) error {
+	plan := newDeliveryPlan(identity != "")
+	return s.planDelivery(plan, forwardPath, dsn.RecipientParameters{})
+}
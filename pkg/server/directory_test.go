@@ -0,0 +1,47 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSenderAddresses(t *testing.T) {
+	s := Server{
+		Cfg: ServerCfg{
+			Users: map[string]string{
+				"bob":               "",
+				"alice@example.com": "",
+			},
+			UserAddresses: map[string][]string{
+				"bob": {"bob@example.com", "robert@example.com"},
+			},
+		},
+	}
+
+	tests := []struct {
+		identity  string
+		addresses []string
+	}{
+		{"bob", []string{"bob@example.com", "robert@example.com"}},
+		{"alice@example.com", []string{"alice@example.com"}},
+		{"carol", nil},
+	}
+
+	for _, test := range tests {
+		addrs, err := s.senderAddresses(test.identity)
+		if err != nil {
+			t.Errorf("cannot obtain addresses of %q: %v", test.identity, err)
+			continue
+		}
+
+		var addresses []string
+		for _, addr := range addrs {
+			addresses = append(addresses, addr.String())
+		}
+
+		if strings.Join(addresses, ",") != strings.Join(test.addresses, ",") {
+			t.Errorf("addresses of %q are %v instead of %v", test.identity,
+				addresses, test.addresses)
+		}
+	}
+}
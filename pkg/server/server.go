@@ -2,9 +2,27 @@ package server
 
 import (
 	"fmt"
+	"os"
 	"sync"
 
+	"github.com/galdor/emaild/pkg/arc"
+	"github.com/galdor/emaild/pkg/delivery"
+	"github.com/galdor/emaild/pkg/directory"
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/dmarc"
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/dnsbl"
+	"github.com/galdor/emaild/pkg/greylist"
+	"github.com/galdor/emaild/pkg/imap"
+	"github.com/galdor/emaild/pkg/jmap"
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/managesieve"
+	"github.com/galdor/emaild/pkg/pop3"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/sieve"
 	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/emaild/pkg/spf"
+	"github.com/galdor/emaild/pkg/vacation"
 	"github.com/galdor/go-log"
 )
 
@@ -12,7 +30,42 @@ type Server struct {
 	Cfg ServerCfg
 	Log *log.Logger
 
-	smtpServers map[string]*smtp.Server
+	Router         *delivery.Router
+	ConnectionPool *delivery.Pool
+	Queue          *delivery.Queue // nil if remote delivery is disabled
+
+	DKIMSigner   *dkim.Signer
+	DKIMVerifier *dkim.Verifier
+	SPFChecker   *spf.Checker
+	DNSBLChecker *dnsbl.Checker     // nil if no list is configured
+	Greylist     *greylist.Greylist // nil if greylisting is disabled
+
+	ARCVerifier *arc.Verifier
+	ARCSealer   *arc.Sealer // nil if sealing is disabled
+
+	DMARCEvaluator  *dmarc.Evaluator // nil if DMARC evaluation is disabled
+	DMARCAggregator *dmarc.Aggregator
+	DMARCReporter   *dmarc.Reporter // nil if reporting is disabled
+
+	Authenticator sasl.Authenticator
+	SieveStore    *sieve.Store // nil if sieve scripts are disabled
+
+	VacationResponder *vacation.Responder // nil if auto-replies are disabled
+
+	MessageStore *mailstore.Store // nil if the message store is disabled
+
+	localTransports map[string]*delivery.LocalTransport
+	remoteTransport *delivery.RemoteTransport
+	storeTransport  *delivery.StoreTransport // nil if the message store is disabled
+
+	directory      *directory.Directory // nil if the directory is disabled
+	directoryMutex sync.RWMutex
+
+	smtpServers        map[string]*smtp.Server
+	pop3Servers        map[string]*pop3.Server
+	manageSieveServers map[string]*managesieve.Server
+	imapServers        map[string]*imap.Server
+	jmapServers        map[string]*jmap.Server
 
 	stopChan chan struct{}
 	wg       sync.WaitGroup
@@ -30,25 +83,257 @@ func NewServer(cfg ServerCfg) (*Server, error) {
 		}
 	}
 
+	if cfg.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read host name: %w", err)
+		}
+
+		cfg.Hostname = hostname
+	}
+
+	var routingCfg delivery.RoutingCfg
+	if cfg.Routing != nil {
+		routingCfg = *cfg.Routing
+	}
+
+	var poolCfg delivery.PoolCfg
+	if cfg.ConnectionPool != nil {
+		poolCfg = *cfg.ConnectionPool
+	}
+	poolCfg.Log = logger.Child("connection_pool", nil)
+
+	var dkimSigningCfg dkim.SignerCfg
+	if cfg.DKIMSigning != nil {
+		dkimSigningCfg = *cfg.DKIMSigning
+	}
+
+	dkimSigner, err := dkim.NewSigner(dkimSigningCfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create dkim signer: %w", err)
+	}
+
+	var arcSealer *arc.Sealer
+	if cfg.ARCSealing != nil {
+		arcSealer, err = arc.NewSealer(*cfg.ARCSealing, dkimSigner)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create arc sealer: %w", err)
+		}
+	}
+
+	dkimVerifier := dkim.NewVerifier(dns.DefaultResolver)
+
+	var dmarcCfg dmarc.Cfg
+	if cfg.DMARC != nil {
+		dmarcCfg = *cfg.DMARC
+	}
+
+	// Organizational domains cannot be found without the Public Suffix
+	// List, so DMARC evaluation is only enabled when it is available.
+	var dmarcEvaluator *dmarc.Evaluator
+	if cfg.DMARC != nil {
+		if dmarcCfg.PublicSuffixListPath == "" {
+			return nil, fmt.Errorf("dmarc evaluation requires a public " +
+				"suffix list")
+		}
+
+		psl, err := dmarc.LoadPublicSuffixList(dmarcCfg.PublicSuffixListPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load public suffix list: %w", err)
+		}
+
+		dmarcEvaluator = dmarc.NewEvaluator(dns.DefaultResolver, psl)
+	}
+
+	dmarcAggregator := dmarc.NewAggregator()
+
+	var dmarcReporter *dmarc.Reporter
+	if dmarcCfg.Reporting != nil {
+		reportingCfg := *dmarcCfg.Reporting
+		reportingCfg.Log = logger.Child("dmarc_reporter", nil)
+
+		dmarcReporter = dmarc.NewReporter(reportingCfg, dmarcAggregator)
+	}
+
+	var dnsblChecker *dnsbl.Checker
+	if cfg.DNSBL != nil {
+		dnsblChecker = dnsbl.NewChecker(*cfg.DNSBL, dns.DefaultResolver)
+	}
+
+	var greylisting *greylist.Greylist
+	if cfg.Greylisting != nil {
+		greylistCfg := *cfg.Greylisting
+		greylistCfg.Log = logger.Child("greylist", nil)
+
+		greylisting, err = greylist.NewGreylist(greylistCfg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create greylist: %w", err)
+		}
+	}
+
+	localTransports := make(map[string]*delivery.LocalTransport)
+	for name, transport := range routingCfg.Transports {
+		if transport.Type == delivery.TransportTypeLocal && transport.Local != nil {
+			localTransports[name] = delivery.NewLocalTransport(*transport.Local)
+		}
+	}
+
+	var sieveStore *sieve.Store
+	if cfg.SieveScripts != nil {
+		sieveStore = sieve.NewStore(*cfg.SieveScripts)
+	} else if len(cfg.ManageSieveServers) > 0 {
+		return nil, fmt.Errorf("managesieve servers require a sieve script " +
+			"store")
+	}
+
+	var vacationResponder *vacation.Responder
+	if cfg.Vacation != nil {
+		vacationCfg := *cfg.Vacation
+		vacationCfg.Log = logger.Child("vacation", nil)
+
+		vacationResponder, err = vacation.NewResponder(vacationCfg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create vacation responder: %w",
+				err)
+		}
+	}
+
+	var messageStore *mailstore.Store
+	var storeTransport *delivery.StoreTransport
+	if cfg.MessageStore != nil {
+		messageStoreCfg := *cfg.MessageStore
+		messageStoreCfg.Log = logger.Child("message_store", nil)
+
+		messageStore = mailstore.NewStore(messageStoreCfg)
+		storeTransport = delivery.NewStoreTransport(messageStore)
+	} else if len(cfg.IMAPServers) > 0 {
+		return nil, fmt.Errorf("imap servers require a message store")
+	} else if len(cfg.POP3Servers) > 0 {
+		return nil, fmt.Errorf("pop3 servers require a message store")
+	} else if len(cfg.JMAPServers) > 0 {
+		return nil, fmt.Errorf("jmap servers require a message store")
+	}
+
+	connectionPool := delivery.NewPool(poolCfg)
+
+	remoteTransport := delivery.NewRemoteTransport(delivery.RemoteTransportCfg{
+		Log:      logger.Child("remote_transport", nil),
+		Pool:     connectionPool,
+		Resolver: dns.DefaultResolver,
+		Domain:   cfg.Hostname,
+	})
+
 	s := Server{
 		Cfg: cfg,
 		Log: logger,
 
-		smtpServers: make(map[string]*smtp.Server),
+		Router:         delivery.NewRouter(routingCfg),
+		ConnectionPool: connectionPool,
+
+		DKIMSigner:   dkimSigner,
+		DKIMVerifier: dkimVerifier,
+		SPFChecker:   spf.NewChecker(dns.DefaultResolver),
+		DNSBLChecker: dnsblChecker,
+		Greylist:     greylisting,
+
+		ARCVerifier: arc.NewVerifier(dkimVerifier),
+		ARCSealer:   arcSealer,
+
+		DMARCEvaluator:  dmarcEvaluator,
+		DMARCAggregator: dmarcAggregator,
+		DMARCReporter:   dmarcReporter,
+
+		SieveStore: sieveStore,
+
+		VacationResponder: vacationResponder,
+
+		MessageStore: messageStore,
+
+		localTransports: localTransports,
+		remoteTransport: remoteTransport,
+		storeTransport:  storeTransport,
+
+		smtpServers:        make(map[string]*smtp.Server),
+		pop3Servers:        make(map[string]*pop3.Server),
+		manageSieveServers: make(map[string]*managesieve.Server),
+		imapServers:        make(map[string]*imap.Server),
+		jmapServers:        make(map[string]*jmap.Server),
 
 		stopChan: make(chan struct{}),
 	}
 
+	s.Authenticator = &authenticator{
+		server:    &s,
+		passwords: sasl.PasswordTable(cfg.Users),
+	}
+
+	if cfg.Queue != nil {
+		queueCfg := *cfg.Queue
+		queueCfg.Log = logger.Child("queue", nil)
+		queueCfg.Handler = s.deliverQueuedMessage
+		queueCfg.FailureHandler = s.bounceQueuedMessage
+
+		s.Queue, err = delivery.NewQueue(queueCfg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create queue: %w", err)
+		}
+	}
+
+	s.directory, err = s.loadDirectory(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &s, nil
 }
 
 func (s *Server) Start() error {
 	s.Log.Debug(1, "starting")
 
+	s.ConnectionPool.Start()
+
+	if s.Queue != nil {
+		s.Queue.Start()
+	}
+
+	if s.DMARCReporter != nil {
+		if err := s.DMARCReporter.Start(); err != nil {
+			return fmt.Errorf("cannot start dmarc reporter: %w", err)
+		}
+	}
+
+	if s.Greylist != nil {
+		if err := s.Greylist.Start(); err != nil {
+			return fmt.Errorf("cannot start greylist: %w", err)
+		}
+	}
+
+	if s.VacationResponder != nil {
+		if err := s.VacationResponder.Start(); err != nil {
+			return fmt.Errorf("cannot start vacation responder: %w", err)
+		}
+	}
+
 	if err := s.startSMTPServers(); err != nil {
 		return err
 	}
 
+	if err := s.startPOP3Servers(); err != nil {
+		return err
+	}
+
+	if err := s.startManageSieveServers(); err != nil {
+		return err
+	}
+
+	if err := s.startIMAPServers(); err != nil {
+		return err
+	}
+
+	if err := s.startJMAPServers(); err != nil {
+		return err
+	}
+
 	s.Log.Debug(1, "running")
 	return nil
 }
@@ -57,6 +342,20 @@ func (s *Server) startSMTPServers() error {
 	for name, pcfg := range s.Cfg.SMTPServers {
 		cfg := *pcfg
 		cfg.Log = s.Log.Child("smtp_server", log.Data{"server": name})
+		cfg.DKIMVerifier = s.DKIMVerifier
+		cfg.SPFChecker = s.SPFChecker
+		cfg.DNSBLChecker = s.DNSBLChecker
+		cfg.Greylist = s.Greylist
+		cfg.ARCVerifier = s.ARCVerifier
+		cfg.DMARCEvaluator = s.DMARCEvaluator
+		if s.DMARCReporter != nil {
+			cfg.DMARCAggregator = s.DMARCAggregator
+		}
+		cfg.MessageHandler = s.handleMessage
+		cfg.RecipientHandler = s.checkRecipient
+		cfg.SenderHandler = s.senderAddresses
+		cfg.Authenticator = s.Authenticator
+		cfg.Resolver = dns.DefaultResolver
 
 		server, err := smtp.NewServer(cfg)
 		if err != nil {
@@ -64,7 +363,7 @@ func (s *Server) startSMTPServers() error {
 		}
 
 		if err := server.Start(); err != nil {
-			return fmt.Errorf("cannot start SMTP server %q: %w", err)
+			return fmt.Errorf("cannot start SMTP server %q: %w", name, err)
 		}
 
 		s.smtpServers[name] = server
@@ -74,11 +373,131 @@ func (s *Server) startSMTPServers() error {
 	return nil
 }
 
+func (s *Server) startPOP3Servers() error {
+	for name, pcfg := range s.Cfg.POP3Servers {
+		cfg := *pcfg
+		cfg.Log = s.Log.Child("pop3_server", log.Data{"server": name})
+		cfg.Authenticator = s.Authenticator
+		cfg.Store = s.MessageStore
+
+		server, err := pop3.NewServer(cfg)
+		if err != nil {
+			return fmt.Errorf("cannot create POP3 server %q: %w", name, err)
+		}
+
+		if err := server.Start(); err != nil {
+			return fmt.Errorf("cannot start POP3 server %q: %w", name, err)
+		}
+
+		s.pop3Servers[name] = server
+	}
+
+	return nil
+}
+
+func (s *Server) startManageSieveServers() error {
+	for name, pcfg := range s.Cfg.ManageSieveServers {
+		cfg := *pcfg
+		cfg.Log = s.Log.Child("managesieve_server", log.Data{"server": name})
+		cfg.Authenticator = s.Authenticator
+		cfg.Scripts = s.SieveStore
+
+		server, err := managesieve.NewServer(cfg)
+		if err != nil {
+			return fmt.Errorf("cannot create ManageSieve server %q: %w",
+				name, err)
+		}
+
+		if err := server.Start(); err != nil {
+			return fmt.Errorf("cannot start ManageSieve server %q: %w",
+				name, err)
+		}
+
+		s.manageSieveServers[name] = server
+	}
+
+	return nil
+}
+
+func (s *Server) startIMAPServers() error {
+	for name, pcfg := range s.Cfg.IMAPServers {
+		cfg := *pcfg
+		cfg.Log = s.Log.Child("imap_server", log.Data{"server": name})
+		cfg.Authenticator = s.Authenticator
+		cfg.Store = s.MessageStore
+
+		server, err := imap.NewServer(cfg)
+		if err != nil {
+			return fmt.Errorf("cannot create IMAP server %q: %w", name, err)
+		}
+
+		if err := server.Start(); err != nil {
+			return fmt.Errorf("cannot start IMAP server %q: %w", name, err)
+		}
+
+		s.imapServers[name] = server
+	}
+
+	return nil
+}
+
+func (s *Server) startJMAPServers() error {
+	for name, pcfg := range s.Cfg.JMAPServers {
+		cfg := *pcfg
+		cfg.Log = s.Log.Child("jmap_server", log.Data{"server": name})
+		cfg.Authenticator = s.Authenticator
+		cfg.Store = s.MessageStore
+		cfg.SubmissionHandler = s.handleSubmission
+
+		server, err := jmap.NewServer(cfg)
+		if err != nil {
+			return fmt.Errorf("cannot create JMAP server %q: %w", name, err)
+		}
+
+		if err := server.Start(); err != nil {
+			return fmt.Errorf("cannot start JMAP server %q: %w", name, err)
+		}
+
+		s.jmapServers[name] = server
+	}
+
+	return nil
+}
+
 func (s *Server) Stop() {
 	s.Log.Debug(1, "stopping")
 
+	s.stopJMAPServers()
+	s.stopIMAPServers()
+	s.stopManageSieveServers()
+	s.stopPOP3Servers()
 	s.stopSMTPServers()
 
+	// Queue workers deliver messages to local mailboxes and send bounces
+	// and vacation replies: the queue must be stopped before the stores
+	// and services it uses.
+	if s.Queue != nil {
+		s.Queue.Stop()
+	}
+
+	s.ConnectionPool.Stop()
+
+	if s.DMARCReporter != nil {
+		s.DMARCReporter.Stop()
+	}
+
+	if s.Greylist != nil {
+		s.Greylist.Stop()
+	}
+
+	if s.VacationResponder != nil {
+		s.VacationResponder.Stop()
+	}
+
+	if s.MessageStore != nil {
+		s.MessageStore.Close()
+	}
+
 	close(s.stopChan)
 	s.wg.Wait()
 }
@@ -88,3 +507,27 @@ func (s *Server) stopSMTPServers() {
 		server.Stop()
 	}
 }
+
+func (s *Server) stopPOP3Servers() {
+	for _, server := range s.pop3Servers {
+		server.Stop()
+	}
+}
+
+func (s *Server) stopManageSieveServers() {
+	for _, server := range s.manageSieveServers {
+		server.Stop()
+	}
+}
+
+func (s *Server) stopIMAPServers() {
+	for _, server := range s.imapServers {
+		server.Stop()
+	}
+}
+
+func (s *Server) stopJMAPServers() {
+	for _, server := range s.jmapServers {
+		server.Stop()
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/delivery"
+	"github.com/galdor/emaild/pkg/dsn"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/maildir"
+	"github.com/galdor/emaild/pkg/mailstore"
+	"github.com/galdor/emaild/pkg/sieve"
+	"github.com/galdor/emaild/pkg/smtp"
+	"github.com/galdor/emaild/pkg/vacation"
+)
+
+// mailboxOwner returns the name identifying the owner of a local mailbox,
+// used for Sieve scripts and vacation replies.
+func mailboxOwner(d localDelivery) string {
+	if d.user != nil {
+		return d.user.Name
+	}
+
+	return strings.ToLower(d.recipient.String())
+}
+
+// sieveActions returns the actions to perform to deliver a message to a
+// local mailbox: those of the active Sieve script of its owner, or an
+// implicit keep if there is no script or if it cannot be evaluated (RFC 5228
+// 2.10.6.).
+func (s *Server) sieveActions(tx *smtp.Transaction, d localDelivery) []sieve.Action {
+	keep := []sieve.Action{&sieve.KeepAction{Implicit: true}}
+
+	// Scripts are not evaluated for messages redirected by another script
+	// so that redirections cannot loop.
+	if s.SieveStore == nil || d.redirected {
+		return keep
+	}
+
+	user := mailboxOwner(d)
+
+	script, err := s.SieveStore.ActiveScript(user)
+	if err != nil {
+		s.Log.Error("cannot load sieve script of user %q: %v", user, err)
+		return keep
+	} else if script == nil {
+		return keep
+	}
+
+	data, err := delivery.EncodeMessage(tx.Message)
+	if err != nil {
+		s.Log.Error("cannot encode message: %v", err)
+		return keep
+	}
+
+	input := sieve.Input{
+		Envelope: sieve.Envelope{
+			To: d.recipient.String(),
+		},
+		Message: tx.Message,
+		Size:    int64(len(data)),
+	}
+
+	if tx.ReversePath != nil {
+		input.Envelope.From = tx.ReversePath.String()
+	}
+
+	result, err := script.Evaluate(&input)
+	if err != nil {
+		s.Log.Error("cannot evaluate sieve script of user %q: %v", user, err)
+		return keep
+	}
+
+	return result.Actions
+}
+
+// storesMessage returns true if a list of actions contains an action storing
+// the message in a mailbox.
+func storesMessage(actions []sieve.Action) bool {
+	for _, action := range actions {
+		switch action.(type) {
+		case *sieve.KeepAction, *sieve.FileIntoAction:
+			return true
+		}
+	}
+
+	return false
+}
+
+// executeSieveAction performs an action of a Sieve script for a local
+// delivery.
+func (s *Server) executeSieveAction(tx *smtp.Transaction, d localDelivery, action sieve.Action) error {
+	switch a := action.(type) {
+	case *sieve.KeepAction:
+		return s.storeMessage(tx, d, "", a.Flags)
+
+	case *sieve.FileIntoAction:
+		return s.storeMessage(tx, d, a.Mailbox, a.Flags)
+
+	case *sieve.RedirectAction:
+		return s.redirectMessage(tx, a.Address)
+
+	case *sieve.DiscardAction:
+		s.Log.Info("message to %q discarded by sieve script",
+			d.recipient.String())
+
+	case *sieve.RejectAction:
+		// RFC 5429 2.1. Rejecting at the SMTP level
+		return smtp.NewError(550, "5.7.1", "%s", replyText(a.Reason))
+
+	default:
+		return fmt.Errorf("unsupported sieve action %v", action)
+	}
+
+	return nil
+}
+
+// sieveVacationCfg returns the settings and the handle of the reply of a
+// vacation action (RFC 5230). The envelope recipient is always one of the
+// addresses of the user.
+func (s *Server) sieveVacationCfg(d localDelivery, action *sieve.VacationAction) (*vacation.UserCfg, string) {
+	var addresses []string
+
+	if action.From != "" {
+		if _, err := parseAddress(action.From); err == nil {
+			addresses = append(addresses, action.From)
+		} else {
+			s.Log.Info("ignoring invalid vacation sender %q: %v",
+				action.From, err)
+		}
+	}
+
+	addresses = append(addresses, d.recipient.String())
+	addresses = append(addresses, action.Addresses...)
+
+	userCfg := vacation.UserCfg{
+		Addresses: addresses,
+		Subject:   action.Subject,
+		Message:   action.Reason,
+		Days:      action.Days,
+		MIME:      action.MIME,
+	}
+
+	// RFC 5230 4.2. Without explicit handle, actions with the same
+	// parameters share the same handle.
+	handle := action.Handle
+	if handle == "" {
+		hash := sha256.New()
+		for _, s := range []string{action.Subject, action.From,
+			action.Reason, strconv.FormatBool(action.MIME)} {
+			hash.Write([]byte(s))
+			hash.Write([]byte{0})
+		}
+
+		handle = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	return &userCfg, handle
+}
+
+// storeMessage stores a message in a local mailbox. If the mailbox name is
+// empty, the message is stored in the inbox, or in the junk mailbox if it was
+// quarantined. Messages filed into a mailbox which does not exist are stored
+// in the inbox (RFC 5228 4.1.).
+func (s *Server) storeMessage(tx *smtp.Transaction, d localDelivery, mailbox string, flags []string) error {
+	if d.user != nil {
+		var err error
+		if mailbox == "" && tx.Quarantine {
+			mailbox, err = s.storeTransport.JunkMailbox(d.user.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.storeTransport.Deliver(tx.ReversePath, d.recipient,
+			d.user.Name, d.user.Quota, mailbox, flags, tx.Message)
+		if errors.Is(err, delivery.ErrMailboxNotFound) && mailbox != "" {
+			s.Log.Info("mailbox %q of user %q not found, delivering to %s",
+				mailbox, d.user.Name, mailstore.InboxName)
+
+			err = s.storeTransport.Deliver(tx.ReversePath, d.recipient,
+				d.user.Name, d.user.Quota, "", flags, tx.Message)
+		}
+
+		return err
+	}
+
+	// Maildir++ folders use dots as hierarchy separator
+	folder := strings.ReplaceAll(mailbox, mailstore.Separator, ".")
+
+	switch {
+	case strings.EqualFold(folder, mailstore.InboxName):
+		folder = ""
+
+	case folder == "" && tx.Quarantine:
+		folder = delivery.JunkMailboxName
+
+	case folder != "" && !maildir.IsValidFolderName(folder):
+		s.Log.Info("invalid folder name %q, delivering to the inbox",
+			mailbox)
+		folder = ""
+	}
+
+	return d.transport.Deliver(tx.ReversePath, d.recipient, folder, flags,
+		tx.Message)
+}
+
+// redirectMessage sends a message to the address of a Sieve redirect action.
+// The original envelope sender is kept; remote recipients are forwarded.
+func (s *Server) redirectMessage(tx *smtp.Transaction, address string) error {
+	addr, err := parseAddress(address)
+	if err != nil {
+		return fmt.Errorf("invalid redirection address %q: %w", address, err)
+	}
+
+	plan := newDeliveryPlan(true)
+	plan.redirected = true
+
+	err = s.planDelivery(plan, *addr, dsn.RecipientParameters{})
+	if err != nil {
+		return err
+	}
+
+	if err := s.executePlan(tx, plan); err != nil {
+		return err
+	}
+
+	s.Log.Info("message redirected to %q", address)
+
+	return nil
+}
+
+func parseAddress(s string) (*imf.SpecificAddress, error) {
+	d := imf.NewDataDecoder([]byte(s))
+
+	spec, err := d.ReadSpecificAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Empty() {
+		return nil, fmt.Errorf("invalid trailing data")
+	}
+
+	return spec, nil
+}
+
+// replyText converts a string so that it can be used in an SMTP reply, which
+// only contains printable ASCII characters.
+func replyText(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c < 32 || c > 126 {
+			return ' '
+		}
+
+		return c
+	}, s)
+}
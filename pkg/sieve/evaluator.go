@@ -0,0 +1,772 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+const (
+	// The maximum number of redirect actions executed by a script
+	MaxRedirects = 10
+
+	// RFC 5230 4.1. Days Parameter
+	DefaultVacationDays = 7
+)
+
+var errStop = errors.New("stop")
+
+// Envelope contains the SMTP envelope of the message being delivered.
+type Envelope struct {
+	From string // empty for the null reverse-path
+	To   string // the recipient the message is delivered to
+}
+
+type Input struct {
+	Envelope Envelope
+	Message  *imf.Message
+	Size     int64 // the size of the message in bytes
+}
+
+type Action interface {
+	String() string
+}
+
+type KeepAction struct {
+	Flags    []string
+	Implicit bool
+}
+
+func (a *KeepAction) String() string {
+	s := "keep"
+	if a.Implicit {
+		s = "implicit keep"
+	}
+
+	return s + flagsString(a.Flags)
+}
+
+type FileIntoAction struct {
+	Mailbox string
+	Flags   []string
+	Copy    bool
+}
+
+func (a *FileIntoAction) String() string {
+	return fmt.Sprintf("fileinto %q", a.Mailbox) + flagsString(a.Flags)
+}
+
+type RedirectAction struct {
+	Address string
+	Copy    bool
+}
+
+func (a *RedirectAction) String() string {
+	return fmt.Sprintf("redirect %q", a.Address)
+}
+
+type DiscardAction struct{}
+
+func (a *DiscardAction) String() string {
+	return "discard"
+}
+
+type RejectAction struct {
+	Reason string
+}
+
+func (a *RejectAction) String() string {
+	return fmt.Sprintf("reject %q", a.Reason)
+}
+
+// VacationAction contains the parameters of an auto-reply; checking whether
+// the reply must actually be sent (previous replies, list messages, etc.) is
+// the responsibility of the caller.
+type VacationAction struct {
+	Reason    string
+	Days      int
+	Subject   string // optional
+	From      string // optional
+	Addresses []string
+	MIME      bool
+	Handle    string // optional
+}
+
+func (a *VacationAction) String() string {
+	return fmt.Sprintf("vacation (%d days)", a.Days)
+}
+
+func flagsString(flags []string) string {
+	if len(flags) == 0 {
+		return ""
+	}
+
+	return " (" + strings.Join(flags, " ") + ")"
+}
+
+type Result struct {
+	Actions []Action
+}
+
+type evaluation struct {
+	script *Script
+	input  *Input
+
+	variables      map[string]string
+	matchVariables []string
+	flags          []string // RFC 5232 3. the internal flag variable
+
+	actions     []Action
+	cancelKeep  bool
+	nbRedirects int
+	hasVacation bool
+	hasReject   bool
+}
+
+// Evaluate executes a script for a message and returns the list of actions
+// to perform. If an error is returned, the caller should deliver the message
+// as if the script did not exist (RFC 5228 2.10.6.).
+func (s *Script) Evaluate(input *Input) (*Result, error) {
+	e := evaluation{
+		script: s,
+		input:  input,
+
+		variables: make(map[string]string),
+	}
+
+	if err := e.executeCommands(s.Commands); err != nil &&
+		!errors.Is(err, errStop) {
+		return nil, err
+	}
+
+	// RFC 5228 2.10.2. Implicit Keep
+	if !e.cancelKeep {
+		e.actions = append(e.actions, &KeepAction{
+			Flags:    e.flags,
+			Implicit: true,
+		})
+	}
+
+	result := Result{
+		Actions: e.actions,
+	}
+
+	return &result, nil
+}
+
+func (e *evaluation) executeCommands(commands []*Command) error {
+	for i := 0; i < len(commands); i++ {
+		cmd := commands[i]
+
+		if cmd.Name != "if" {
+			if err := e.executeCommand(cmd); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// Execute the first block of the if/elsif/else sequence whose test
+		// succeeds.
+		start := i
+		var done bool
+
+		for ; i < len(commands); i++ {
+			cmd := commands[i]
+
+			if i > start && cmd.Name != "elsif" && cmd.Name != "else" {
+				break
+			}
+
+			if done {
+				continue
+			}
+
+			ok := true
+
+			if cmd.Name != "else" {
+				var err error
+
+				ok, err = e.evaluateTest(cmd.Tests[0])
+				if err != nil {
+					return err
+				}
+			}
+
+			if ok {
+				done = true
+
+				if err := e.executeCommands(cmd.Block); err != nil {
+					return err
+				}
+			}
+		}
+
+		i--
+	}
+
+	return nil
+}
+
+func (e *evaluation) executeCommand(cmd *Command) error {
+	args := cmd.args
+
+	switch cmd.Name {
+	case "require":
+
+	case "stop":
+		return errStop
+
+	case "keep":
+		flags := e.flags
+		if arg := args.tag("flags"); arg != nil {
+			flags = parseFlags(e.expandList(arg.Strings))
+		}
+
+		e.addAction(&KeepAction{Flags: flags})
+		e.cancelKeep = true
+
+	case "discard":
+		e.addAction(&DiscardAction{})
+		e.cancelKeep = true
+
+	case "fileinto":
+		flags := e.flags
+		if arg := args.tag("flags"); arg != nil {
+			flags = parseFlags(e.expandList(arg.Strings))
+		}
+
+		action := FileIntoAction{
+			Mailbox: e.expand(args.positional[0].Strings[0]),
+			Flags:   flags,
+			Copy:    args.hasTag("copy"),
+		}
+
+		if action.Mailbox == "" {
+			return fmt.Errorf("line %d: empty mailbox name", cmd.Line)
+		}
+
+		e.addAction(&action)
+
+		if !action.Copy {
+			e.cancelKeep = true
+		}
+
+	case "redirect":
+		action := RedirectAction{
+			Address: e.expand(args.positional[0].Strings[0]),
+			Copy:    args.hasTag("copy"),
+		}
+
+		if !isValidAddress(action.Address) {
+			return fmt.Errorf("line %d: invalid redirection address %q",
+				cmd.Line, action.Address)
+		}
+
+		e.nbRedirects++
+		if e.nbRedirects > MaxRedirects {
+			return fmt.Errorf("line %d: too many redirections", cmd.Line)
+		}
+
+		e.addAction(&action)
+
+		if !action.Copy {
+			e.cancelKeep = true
+		}
+
+	case "reject":
+		e.addAction(&RejectAction{
+			Reason: e.expand(args.positional[0].Strings[0]),
+		})
+
+		e.hasReject = true
+		e.cancelKeep = true
+
+	case "set":
+		e.executeSet(cmd)
+
+	case "vacation":
+		if e.hasVacation {
+			return fmt.Errorf("line %d: multiple vacation actions", cmd.Line)
+		}
+
+		e.addAction(e.vacationAction(cmd))
+		e.hasVacation = true
+
+	case "setflag", "addflag", "removeflag":
+		e.executeFlagCommand(cmd)
+
+	default:
+		return fmt.Errorf("line %d: unknown command %q", cmd.Line, cmd.Name)
+	}
+
+	return e.checkActions(cmd)
+}
+
+func (e *evaluation) addAction(action Action) {
+	// RFC 5228 2.10.3. Executing the same action twice does not have any
+	// additional effect.
+	for _, a := range e.actions {
+		if a.String() == action.String() {
+			return
+		}
+	}
+
+	e.actions = append(e.actions, action)
+}
+
+func (e *evaluation) checkActions(cmd *Command) error {
+	if !e.hasReject {
+		return nil
+	}
+
+	// RFC 5429 2.1. and RFC 5230 4.7. Reject cannot be combined with actions
+	// delivering the message or replying to it.
+	for _, action := range e.actions {
+		switch action.(type) {
+		case *KeepAction, *FileIntoAction, *RedirectAction, *VacationAction:
+			return fmt.Errorf("line %d: reject cannot be used with %s",
+				cmd.Line, action)
+		}
+	}
+
+	return nil
+}
+
+func (e *evaluation) executeSet(cmd *Command) {
+	args := cmd.args
+
+	name := strings.ToLower(args.positional[0].Strings[0])
+	value := e.expand(args.positional[1].Strings[0])
+
+	// RFC 5229 4. Modifiers are applied by decreasing order of precedence
+	switch {
+	case args.hasTag("lower"):
+		value = strings.ToLower(value)
+	case args.hasTag("upper"):
+		value = strings.ToUpper(value)
+	}
+
+	if value != "" {
+		r, size := utf8.DecodeRuneInString(value)
+
+		switch {
+		case args.hasTag("lowerfirst"):
+			value = strings.ToLower(string(r)) + value[size:]
+		case args.hasTag("upperfirst"):
+			value = strings.ToUpper(string(r)) + value[size:]
+		}
+	}
+
+	if args.hasTag("quotewildcard") {
+		value = quoteWildcards(value)
+	}
+
+	if args.hasTag("length") {
+		value = strconv.Itoa(utf8.RuneCountInString(value))
+	}
+
+	e.variables[name] = value
+}
+
+func (e *evaluation) vacationAction(cmd *Command) *VacationAction {
+	args := cmd.args
+
+	action := VacationAction{
+		Reason: e.expand(args.positional[0].Strings[0]),
+		Days:   DefaultVacationDays,
+		MIME:   args.hasTag("mime"),
+	}
+
+	if arg := args.tag("days"); arg != nil {
+		action.Days = int(max(min(arg.Number, 365), 1))
+	}
+
+	if arg := args.tag("subject"); arg != nil {
+		action.Subject = e.expand(arg.Strings[0])
+	}
+
+	if arg := args.tag("from"); arg != nil {
+		action.From = e.expand(arg.Strings[0])
+	}
+
+	if arg := args.tag("addresses"); arg != nil {
+		action.Addresses = e.expandList(arg.Strings)
+	}
+
+	if arg := args.tag("handle"); arg != nil {
+		action.Handle = e.expand(arg.Strings[0])
+	}
+
+	return &action
+}
+
+func (e *evaluation) executeFlagCommand(cmd *Command) {
+	args := cmd.args
+
+	var variable string
+	if arg := args.positional[0]; arg != nil {
+		variable = strings.ToLower(arg.Strings[0])
+	}
+
+	flags := parseFlags(e.expandList(args.positional[1].Strings))
+
+	switch cmd.Name {
+	case "setflag":
+		e.setFlags(variable, flags)
+
+	case "addflag":
+		e.setFlags(variable, parseFlags(append(e.getFlags(variable), flags...)))
+
+	case "removeflag":
+		var newFlags []string
+
+		for _, flag := range e.getFlags(variable) {
+			if !containsFlag(flags, flag) {
+				newFlags = append(newFlags, flag)
+			}
+		}
+
+		e.setFlags(variable, newFlags)
+	}
+}
+
+func (e *evaluation) getFlags(variable string) []string {
+	if variable == "" {
+		return e.flags
+	}
+
+	return parseFlags([]string{e.variables[variable]})
+}
+
+func (e *evaluation) setFlags(variable string, flags []string) {
+	if variable == "" {
+		e.flags = flags
+	} else {
+		e.variables[variable] = strings.Join(flags, " ")
+	}
+}
+
+// RFC 5232 3. Flags are separated by spaces and duplicate flags are ignored.
+// Flag names are case-insensitive.
+func parseFlags(ss []string) []string {
+	var flags []string
+
+	for _, s := range ss {
+		for _, flag := range strings.Fields(s) {
+			if !containsFlag(flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+
+	return flags
+}
+
+func containsFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *evaluation) evaluateTest(test *Test) (bool, error) {
+	args := test.args
+
+	switch test.Name {
+	case "true":
+		return true, nil
+
+	case "false":
+		return false, nil
+
+	case "not":
+		ok, err := e.evaluateTest(test.Tests[0])
+		return !ok, err
+
+	case "allof":
+		for _, t := range test.Tests {
+			if ok, err := e.evaluateTest(t); err != nil || !ok {
+				return false, err
+			}
+		}
+
+		return true, nil
+
+	case "anyof":
+		for _, t := range test.Tests {
+			if ok, err := e.evaluateTest(t); err != nil || ok {
+				return ok, err
+			}
+		}
+
+		return false, nil
+
+	case "address":
+		var values []string
+
+		for _, name := range e.expandList(args.positional[0].Strings) {
+			for _, field := range e.fields(name) {
+				for _, spec := range fieldAddresses(field) {
+					values = append(values, addressPart(args,
+						spec.LocalPart, string(spec.Domain)))
+				}
+			}
+		}
+
+		return e.match(args, values), nil
+
+	case "envelope":
+		var values []string
+
+		for _, part := range e.expandList(args.positional[0].Strings) {
+			var address string
+
+			switch strings.ToLower(part) {
+			case "from":
+				address = e.input.Envelope.From
+			case "to":
+				address = e.input.Envelope.To
+			default:
+				continue
+			}
+
+			// RFC 5228 5.4. The null reverse-path only matches the empty
+			// string, whatever the address part.
+			if address == "" {
+				values = append(values, "")
+				continue
+			}
+
+			localPart, domain := address, ""
+			if i := strings.LastIndexByte(address, '@'); i >= 0 {
+				localPart, domain = address[:i], address[i+1:]
+			}
+
+			values = append(values, addressPart(args, localPart, domain))
+		}
+
+		return e.match(args, values), nil
+
+	case "exists":
+		for _, name := range e.expandList(args.positional[0].Strings) {
+			if len(e.fields(name)) == 0 {
+				return false, nil
+			}
+		}
+
+		return true, nil
+
+	case "header":
+		var values []string
+
+		for _, name := range e.expandList(args.positional[0].Strings) {
+			for _, field := range e.fields(name) {
+				values = append(values, fieldValue(field))
+			}
+		}
+
+		return e.match(args, values), nil
+
+	case "size":
+		limit := args.positional[0].Number
+
+		if args.hasTag("over") {
+			return e.input.Size > limit, nil
+		}
+
+		return e.input.Size < limit, nil
+
+	case "string":
+		return e.match(args, e.expandList(args.positional[0].Strings)), nil
+
+	case "hasflag":
+		var flags []string
+
+		if arg := args.positional[0]; arg != nil {
+			for _, name := range arg.Strings {
+				flags = append(flags, e.getFlags(strings.ToLower(name))...)
+			}
+		} else {
+			flags = e.flags
+		}
+
+		return e.match(args, flags), nil
+	}
+
+	return false, fmt.Errorf("line %d: unknown test %q", test.Line, test.Name)
+}
+
+func (e *evaluation) match(args *arguments, values []string) bool {
+	m := newMatcher(args)
+
+	keys := e.expandList(args.positional[1].Strings)
+
+	for _, value := range values {
+		for _, key := range keys {
+			if ok, vars := m.match(value, key); ok {
+				if vars != nil {
+					e.matchVariables = vars
+				}
+
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (e *evaluation) fields(name string) []*imf.Field {
+	var fields []*imf.Field
+
+	for _, field := range e.input.Message.Header {
+		if strings.EqualFold(field.Name, name) {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// fieldValue returns the unfolded value of a field, with RFC 2047 encoded
+// words decoded (RFC 5228 2.7.2.).
+func fieldValue(field *imf.Field) string {
+	value := field.Raw
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		value = value[i+1:]
+	}
+
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.ReplaceAll(value, "\n", "")
+	value = strings.Trim(value, " \t")
+
+	var decoder mime.WordDecoder
+
+	if decodedValue, err := decoder.DecodeHeader(value); err == nil {
+		value = decodedValue
+	}
+
+	return value
+}
+
+// fieldAddresses returns the addresses contained in a field, including the
+// members of groups. Fields which do not contain addresses are ignored.
+func fieldAddresses(field *imf.Field) []imf.SpecificAddress {
+	d := imf.NewDataDecoder([]byte(fieldValue(field)))
+
+	addrs, err := d.ReadAddressList(true)
+	if err != nil {
+		return nil
+	}
+
+	var specs []imf.SpecificAddress
+
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *imf.Mailbox:
+			specs = append(specs, v.SpecificAddress)
+
+		case *imf.Group:
+			for _, mailbox := range v.Mailboxes {
+				specs = append(specs, mailbox.SpecificAddress)
+			}
+		}
+	}
+
+	return specs
+}
+
+func addressPart(args *arguments, localPart, domain string) string {
+	switch {
+	case args.hasTag("localpart"):
+		return localPart
+	case args.hasTag("domain"):
+		return domain
+	}
+
+	if domain == "" {
+		return localPart
+	}
+
+	return localPart + "@" + domain
+}
+
+// RFC 5229 3. Variable expansion. Variables are only expanded if the
+// "variables" extension is loaded; unknown variables expand to an empty
+// string.
+func (e *evaluation) expand(s string) string {
+	if !e.script.Extensions["variables"] || !strings.Contains(s, "${") {
+		return s
+	}
+
+	var buf strings.Builder
+
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			break
+		}
+
+		end := strings.IndexByte(s[start:], '}')
+		if end == -1 {
+			break
+		}
+
+		end += start
+
+		buf.WriteString(s[:start])
+
+		if value, ok := e.variable(s[start+2 : end]); ok {
+			buf.WriteString(value)
+			s = s[end+1:]
+		} else {
+			// Invalid variable references are kept as they are
+			buf.WriteString("${")
+			s = s[start+2:]
+		}
+	}
+
+	buf.WriteString(s)
+
+	return buf.String()
+}
+
+func (e *evaluation) expandList(ss []string) []string {
+	values := make([]string, len(ss))
+
+	for i, s := range ss {
+		values[i] = e.expand(s)
+	}
+
+	return values
+}
+
+func (e *evaluation) variable(name string) (string, bool) {
+	if name != "" && strings.Trim(name, "0123456789") == "" {
+		n, err := strconv.Atoi(name)
+		if err != nil {
+			return "", false
+		}
+
+		if n < len(e.matchVariables) {
+			return e.matchVariables[n], true
+		}
+
+		return "", true
+	}
+
+	if !isIdentifier(name) {
+		return "", false
+	}
+
+	return e.variables[strings.ToLower(name)], true
+}
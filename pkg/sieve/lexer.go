@@ -0,0 +1,389 @@
+package sieve
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/utils"
+)
+
+type tokenType int
+
+const (
+	tokenIdentifier tokenType = iota
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenMultiLineString
+	tokenLeftBracket
+	tokenRightBracket
+	tokenLeftParenthesis
+	tokenRightParenthesis
+	tokenLeftBrace
+	tokenRightBrace
+	tokenComma
+	tokenSemicolon
+	tokenEOF
+)
+
+func (t tokenType) String() string {
+	switch t {
+	case tokenIdentifier:
+		return "identifier"
+	case tokenTag:
+		return "tag"
+	case tokenNumber:
+		return "number"
+	case tokenString, tokenMultiLineString:
+		return "string"
+	case tokenLeftBracket:
+		return "'['"
+	case tokenRightBracket:
+		return "']'"
+	case tokenLeftParenthesis:
+		return "'('"
+	case tokenRightParenthesis:
+		return "')'"
+	case tokenLeftBrace:
+		return "'{'"
+	case tokenRightBrace:
+		return "'}'"
+	case tokenComma:
+		return "','"
+	case tokenSemicolon:
+		return "';'"
+	case tokenEOF:
+		return "end of script"
+	}
+
+	return fmt.Sprintf("token %d", t)
+}
+
+type token struct {
+	Type   tokenType
+	Value  string // identifiers (lower case), tags (lower case) and strings
+	Number int64
+	Line   int
+}
+
+type lexer struct {
+	buf  []byte
+	line int
+}
+
+// RFC 5228 8.1. Lexical Tokens
+func tokenize(data []byte) ([]*token, error) {
+	l := lexer{
+		buf:  data,
+		line: 1,
+	}
+
+	var tokens []*token
+
+	for {
+		if err := l.skipWhitespaceAndComments(); err != nil {
+			return nil, &ParseError{Line: l.line, Message: err.Error()}
+		}
+
+		t, err := l.readToken()
+		if err != nil {
+			return nil, &ParseError{Line: l.line, Message: err.Error()}
+		}
+
+		tokens = append(tokens, t)
+
+		if t.Type == tokenEOF {
+			break
+		}
+	}
+
+	return tokens, nil
+}
+
+func (l *lexer) skip(n int) {
+	l.line += bytes.Count(l.buf[:n], []byte{'\n'})
+	l.buf = l.buf[n:]
+}
+
+func (l *lexer) skipWhitespaceAndComments() error {
+	for len(l.buf) > 0 {
+		switch c := l.buf[0]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			l.skip(1)
+
+		case c == '#':
+			// Hash comments end with the line
+			end := bytes.IndexByte(l.buf, '\n')
+			if end == -1 {
+				end = len(l.buf) - 1
+			}
+
+			l.skip(end + 1)
+
+		case bytes.HasPrefix(l.buf, []byte("/*")):
+			end := bytes.Index(l.buf[2:], []byte("*/"))
+			if end == -1 {
+				return fmt.Errorf("unterminated bracket comment")
+			}
+
+			l.skip(end + 4)
+
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (l *lexer) readToken() (*token, error) {
+	t := token{Line: l.line}
+
+	if len(l.buf) == 0 {
+		t.Type = tokenEOF
+		return &t, nil
+	}
+
+	c := l.buf[0]
+
+	switch {
+	case c == '[':
+		t.Type = tokenLeftBracket
+	case c == ']':
+		t.Type = tokenRightBracket
+	case c == '(':
+		t.Type = tokenLeftParenthesis
+	case c == ')':
+		t.Type = tokenRightParenthesis
+	case c == '{':
+		t.Type = tokenLeftBrace
+	case c == '}':
+		t.Type = tokenRightBrace
+	case c == ',':
+		t.Type = tokenComma
+	case c == ';':
+		t.Type = tokenSemicolon
+
+	case c == ':':
+		l.skip(1)
+
+		if len(l.buf) == 0 || !isIdentifierStartChar(l.buf[0]) {
+			return nil, fmt.Errorf("invalid tag")
+		}
+
+		t.Type = tokenTag
+		t.Value = l.readIdentifier()
+		return &t, nil
+
+	case c == '"':
+		s, err := l.readQuotedString()
+		if err != nil {
+			return nil, err
+		}
+
+		t.Type = tokenString
+		t.Value = s
+		return &t, nil
+
+	case isDigit(c):
+		n, err := l.readNumber()
+		if err != nil {
+			return nil, err
+		}
+
+		t.Type = tokenNumber
+		t.Number = n
+		return &t, nil
+
+	case isIdentifierStartChar(c):
+		t.Type = tokenIdentifier
+		t.Value = l.readIdentifier()
+
+		if t.Value == "text" && len(l.buf) > 0 && l.buf[0] == ':' {
+			s, err := l.readMultiLineString()
+			if err != nil {
+				return nil, err
+			}
+
+			t.Type = tokenMultiLineString
+			t.Value = s
+		}
+
+		return &t, nil
+
+	default:
+		return nil, fmt.Errorf("invalid character %s", utils.QuoteByte(c))
+	}
+
+	l.skip(1)
+	return &t, nil
+}
+
+func (l *lexer) readIdentifier() string {
+	end := 1
+	for end < len(l.buf) && isIdentifierChar(l.buf[end]) {
+		end++
+	}
+
+	// Identifiers, and therefore command names and tags, are case-insensitive
+	s := strings.ToLower(string(l.buf[:end]))
+	l.skip(end)
+
+	return s
+}
+
+func (l *lexer) readNumber() (int64, error) {
+	end := 0
+	for end < len(l.buf) && isDigit(l.buf[end]) {
+		end++
+	}
+
+	var n int64
+
+	for _, c := range l.buf[:end] {
+		if n > (math.MaxInt64-9)/10 {
+			return 0, fmt.Errorf("number too large")
+		}
+
+		n = n*10 + int64(c-'0')
+	}
+
+	l.skip(end)
+
+	if len(l.buf) > 0 {
+		var quantifier int64
+
+		switch l.buf[0] {
+		case 'k', 'K':
+			quantifier = 1 << 10
+		case 'm', 'M':
+			quantifier = 1 << 20
+		case 'g', 'G':
+			quantifier = 1 << 30
+		}
+
+		if quantifier > 0 {
+			if n > math.MaxInt64/quantifier {
+				return 0, fmt.Errorf("number too large")
+			}
+
+			n *= quantifier
+
+			l.skip(1)
+		}
+	}
+
+	return n, nil
+}
+
+func (l *lexer) readQuotedString() (string, error) {
+	l.skip(1)
+
+	var buf []byte
+
+	for i := 0; i < len(l.buf); i++ {
+		switch c := l.buf[i]; c {
+		case '"':
+			l.skip(i + 1)
+			return string(buf), nil
+
+		case '\\':
+			// RFC 5228 2.4.2. Only \" and \\ are defined, but the backslash
+			// is removed from any other escape sequence.
+			if i+1 < len(l.buf) {
+				i++
+				buf = append(buf, l.buf[i])
+			}
+
+		default:
+			buf = append(buf, c)
+		}
+	}
+
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (l *lexer) readMultiLineString() (string, error) {
+	// The "text" identifier has already been read
+	l.skip(1)
+
+	for len(l.buf) > 0 && (l.buf[0] == ' ' || l.buf[0] == '\t') {
+		l.skip(1)
+	}
+
+	if len(l.buf) > 0 && l.buf[0] == '#' {
+		end := bytes.IndexByte(l.buf, '\n')
+		if end == -1 {
+			end = len(l.buf)
+		}
+
+		l.skip(end)
+	}
+
+	if bytes.HasPrefix(l.buf, []byte("\r\n")) {
+		l.skip(2)
+	} else if bytes.HasPrefix(l.buf, []byte("\n")) {
+		l.skip(1)
+	} else {
+		return "", fmt.Errorf("missing end of line after \"text:\"")
+	}
+
+	var buf bytes.Buffer
+
+	for len(l.buf) > 0 {
+		var line []byte
+
+		if end := bytes.IndexByte(l.buf, '\n'); end >= 0 {
+			line = l.buf[:end]
+			l.skip(end + 1)
+		} else {
+			// The final dot may be the last character of the script
+			line = l.buf
+			l.skip(len(l.buf))
+		}
+
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+
+		if bytes.Equal(line, []byte{'.'}) {
+			return buf.String(), nil
+		}
+
+		// Dot-stuffing
+		if len(line) > 1 && line[0] == '.' && line[1] == '.' {
+			line = line[1:]
+		}
+
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+
+	return "", fmt.Errorf("unterminated multi-line string")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierStartChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStartChar(c) || isDigit(c)
+}
+
+func isIdentifier(s string) bool {
+	if s == "" || !isIdentifierStartChar(s[0]) {
+		return false
+	}
+
+	for i := 1; i < len(s); i++ {
+		if !isIdentifierChar(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,188 @@
+package sieve
+
+import (
+	"strings"
+)
+
+// RFC 5228 2.7.1. Match Type
+//
+// The "i;ascii-casemap" comparator only folds ASCII characters, so that
+// folded strings have the same length as the original ones and match
+// positions can be used to extract match variables from original values.
+
+type matcher struct {
+	comparator string
+	matchType  string
+}
+
+func newMatcher(args *arguments) *matcher {
+	m := matcher{
+		comparator: "i;ascii-casemap",
+		matchType:  "is",
+	}
+
+	if arg := args.tag("comparator"); arg != nil {
+		m.comparator = strings.ToLower(arg.Strings[0])
+	}
+
+	for _, matchType := range []string{"is", "contains", "matches"} {
+		if args.hasTag(matchType) {
+			m.matchType = matchType
+		}
+	}
+
+	return &m
+}
+
+// match returns true if the value matches the key. Match variables (RFC 5229
+// 3.2.) are only returned for the :matches match type.
+func (m *matcher) match(value, key string) (bool, []string) {
+	v, k := value, key
+
+	if m.comparator == "i;ascii-casemap" {
+		v = asciiToLower(v)
+		k = asciiToLower(k)
+	}
+
+	switch m.matchType {
+	case "is":
+		return v == k, nil
+
+	case "contains":
+		return strings.Contains(v, k), nil
+
+	case "matches":
+		spans, ok := matchWildcard(parseWildcardPattern(k), v)
+		if !ok {
+			return false, nil
+		}
+
+		vars := make([]string, len(spans)+1)
+
+		vars[0] = value
+		for i, span := range spans {
+			vars[i+1] = value[span[0]:span[1]]
+		}
+
+		return true, vars
+	}
+
+	return false, nil
+}
+
+type wildcardElement struct {
+	c        byte
+	wildcard byte // '?', '*' or 0 for literal characters
+}
+
+func parseWildcardPattern(pattern string) []wildcardElement {
+	var elts []wildcardElement
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '?', '*':
+			elts = append(elts, wildcardElement{wildcard: c})
+
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+
+			elts = append(elts, wildcardElement{c: pattern[i]})
+
+		default:
+			elts = append(elts, wildcardElement{c: c})
+		}
+	}
+
+	return elts
+}
+
+// matchWildcard matches a string against a wildcard pattern, and returns the
+// start and end position of the string matched by each wildcard. Each "*"
+// wildcard matches as few characters as possible.
+func matchWildcard(pattern []wildcardElement, s string) ([][2]int, bool) {
+	starts := make([]int, len(pattern))
+
+	pi, si := 0, 0
+	starPi, starSi := -1, 0
+
+	for pi < len(pattern) || si < len(s) {
+		if pi < len(pattern) {
+			elt := pattern[pi]
+
+			switch {
+			case elt.wildcard == '*':
+				starts[pi] = si
+				starPi, starSi = pi, si
+				pi++
+				continue
+
+			case si < len(s) && (elt.wildcard == '?' || elt.c == s[si]):
+				starts[pi] = si
+				pi++
+				si++
+				continue
+			}
+		}
+
+		// Backtrack by extending the last "*" wildcard by one character
+		if starPi == -1 || starSi >= len(s) {
+			return nil, false
+		}
+
+		starSi++
+		pi, si = starPi+1, starSi
+	}
+
+	var spans [][2]int
+
+	for i, elt := range pattern {
+		if elt.wildcard == 0 {
+			continue
+		}
+
+		end := len(s)
+		if i+1 < len(pattern) {
+			end = starts[i+1]
+		}
+
+		spans = append(spans, [2]int{starts[i], end})
+	}
+
+	return spans, true
+}
+
+func asciiToLower(s string) string {
+	var buf []byte
+
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 'A' && c <= 'Z' {
+			if buf == nil {
+				buf = []byte(s)
+			}
+
+			buf[i] = c + ('a' - 'A')
+		}
+	}
+
+	if buf == nil {
+		return s
+	}
+
+	return string(buf)
+}
+
+func quoteWildcards(s string) string {
+	var buf strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '*' || c == '?' || c == '\\' {
+			buf.WriteByte('\\')
+		}
+
+		buf.WriteByte(s[i])
+	}
+
+	return buf.String()
+}
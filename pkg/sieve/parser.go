@@ -0,0 +1,250 @@
+package sieve
+
+// RFC 5228 8.2. Grammar
+
+type parser struct {
+	tokens []*token
+}
+
+func (p *parser) peek() *token {
+	return p.tokens[0]
+}
+
+func (p *parser) next() *token {
+	t := p.tokens[0]
+
+	// The last token is always the end of the script
+	if t.Type != tokenEOF {
+		p.tokens = p.tokens[1:]
+	}
+
+	return t
+}
+
+func (p *parser) expect(tt tokenType) (*token, error) {
+	t := p.next()
+	if t.Type != tt {
+		return nil, parseErrorf(t.Line, "expected %v but found %v", tt, t.Type)
+	}
+
+	return t, nil
+}
+
+func (p *parser) parseCommands(inBlock bool) ([]*Command, error) {
+	commands := []*Command{}
+
+	for {
+		t := p.peek()
+
+		if t.Type == tokenEOF {
+			if inBlock {
+				return nil, parseErrorf(t.Line, "missing '}' at end of block")
+			}
+
+			break
+		}
+
+		if t.Type == tokenRightBrace {
+			if !inBlock {
+				return nil, parseErrorf(t.Line, "unexpected '}'")
+			}
+
+			break
+		}
+
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+
+		commands = append(commands, cmd)
+	}
+
+	return commands, nil
+}
+
+func (p *parser) parseCommand() (*Command, error) {
+	t := p.next()
+	if t.Type != tokenIdentifier {
+		return nil, parseErrorf(t.Line, "expected command but found %v", t.Type)
+	}
+
+	cmd := Command{
+		Name: t.Value,
+		Line: t.Line,
+	}
+
+	args, tests, err := p.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.Arguments = args
+	cmd.Tests = tests
+
+	switch t := p.next(); t.Type {
+	case tokenSemicolon:
+
+	case tokenLeftBrace:
+		block, err := p.parseCommands(true)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := p.expect(tokenRightBrace); err != nil {
+			return nil, err
+		}
+
+		cmd.Block = block
+
+	default:
+		return nil, parseErrorf(t.Line, "expected ';' or '{' but found %v",
+			t.Type)
+	}
+
+	return &cmd, nil
+}
+
+func (p *parser) parseArguments() ([]*Argument, []*Test, error) {
+	var args []*Argument
+
+loop:
+	for {
+		t := p.peek()
+
+		arg := Argument{Line: t.Line}
+
+		switch t.Type {
+		case tokenLeftBracket:
+			ss, err := p.parseStringList()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			arg.Type = ArgumentTypeStringList
+			arg.Strings = ss
+
+		case tokenString, tokenMultiLineString:
+			p.next()
+
+			arg.Type = ArgumentTypeString
+			arg.Strings = []string{t.Value}
+
+		case tokenNumber:
+			p.next()
+
+			arg.Type = ArgumentTypeNumber
+			arg.Number = t.Number
+
+		case tokenTag:
+			p.next()
+
+			arg.Type = ArgumentTypeTag
+			arg.Tag = t.Value
+
+		default:
+			break loop
+		}
+
+		args = append(args, &arg)
+	}
+
+	var tests []*Test
+
+	switch p.peek().Type {
+	case tokenLeftParenthesis:
+		list, err := p.parseTestList()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tests = list
+
+	case tokenIdentifier:
+		test, err := p.parseTest()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tests = []*Test{test}
+	}
+
+	return args, tests, nil
+}
+
+func (p *parser) parseTest() (*Test, error) {
+	t := p.next()
+	if t.Type != tokenIdentifier {
+		return nil, parseErrorf(t.Line, "expected test but found %v", t.Type)
+	}
+
+	test := Test{
+		Name: t.Value,
+		Line: t.Line,
+	}
+
+	args, tests, err := p.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+
+	test.Arguments = args
+	test.Tests = tests
+
+	return &test, nil
+}
+
+func (p *parser) parseTestList() ([]*Test, error) {
+	if _, err := p.expect(tokenLeftParenthesis); err != nil {
+		return nil, err
+	}
+
+	var tests []*Test
+
+	for {
+		test, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+
+		tests = append(tests, test)
+
+		t := p.next()
+		if t.Type == tokenRightParenthesis {
+			break
+		} else if t.Type != tokenComma {
+			return nil, parseErrorf(t.Line, "expected ',' or ')' but found %v",
+				t.Type)
+		}
+	}
+
+	return tests, nil
+}
+
+func (p *parser) parseStringList() ([]string, error) {
+	if _, err := p.expect(tokenLeftBracket); err != nil {
+		return nil, err
+	}
+
+	var ss []string
+
+	for {
+		t := p.next()
+		if t.Type != tokenString && t.Type != tokenMultiLineString {
+			return nil, parseErrorf(t.Line, "expected string but found %v",
+				t.Type)
+		}
+
+		ss = append(ss, t.Value)
+
+		t = p.next()
+		if t.Type == tokenRightBracket {
+			break
+		} else if t.Type != tokenComma {
+			return nil, parseErrorf(t.Line, "expected ',' or ']' but found %v",
+				t.Type)
+		}
+	}
+
+	return ss, nil
+}
@@ -0,0 +1,136 @@
+package sieve
+
+import (
+	"fmt"
+	"slices"
+)
+
+// RFC 5228 Sieve: An Email Filtering Language
+//
+// Supported extensions:
+//
+// - RFC 3894 Sieve Extension: Copying Without Side Effects
+// - RFC 5229 Sieve Email Filtering: Variables Extension
+// - RFC 5230 Sieve Email Filtering: Vacation Extension
+// - RFC 5232 Sieve Email Filtering: Imap4flags Extension
+// - RFC 5429 Sieve Email Filtering: Reject and Extended Reject Extensions
+//   (reject only)
+
+// Extensions contains the names of all extensions which can be loaded with
+// the "require" command.
+var Extensions = []string{
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"copy",
+	"envelope",
+	"fileinto",
+	"imap4flags",
+	"reject",
+	"vacation",
+	"variables",
+}
+
+func IsSupportedExtension(name string) bool {
+	return slices.Contains(Extensions, name)
+}
+
+type ParseError struct {
+	Line    int
+	Message string
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", err.Line, err.Message)
+}
+
+func parseErrorf(line int, format string, args ...interface{}) *ParseError {
+	return &ParseError{
+		Line:    line,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+type ArgumentType string
+
+const (
+	ArgumentTypeString     ArgumentType = "string"
+	ArgumentTypeStringList ArgumentType = "string-list"
+	ArgumentTypeNumber     ArgumentType = "number"
+	ArgumentTypeTag        ArgumentType = "tag"
+)
+
+type Argument struct {
+	Type    ArgumentType
+	Strings []string // string (one element) and string list arguments
+	Number  int64
+	Tag     string
+	Line    int
+}
+
+func (a *Argument) String() string {
+	switch a.Type {
+	case ArgumentTypeString:
+		return fmt.Sprintf("%q", a.Strings[0])
+	case ArgumentTypeStringList:
+		return fmt.Sprintf("%q", a.Strings)
+	case ArgumentTypeNumber:
+		return fmt.Sprintf("%d", a.Number)
+	case ArgumentTypeTag:
+		return ":" + a.Tag
+	}
+
+	return string(a.Type)
+}
+
+type Command struct {
+	Name      string
+	Arguments []*Argument
+	Tests     []*Test
+	Block     []*Command // nil for commands without block
+	Line      int
+
+	args *arguments
+}
+
+type Test struct {
+	Name      string
+	Arguments []*Argument
+	Tests     []*Test
+	Line      int
+
+	args *arguments
+}
+
+type Script struct {
+	Commands []*Command
+
+	// The set of extensions loaded with the "require" command
+	Extensions map[string]bool
+}
+
+// Parse parses and validates a script. Errors are returned as *ParseError
+// values.
+func Parse(data []byte) (*Script, error) {
+	tokens, err := tokenize(data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+
+	commands, err := p.parseCommands(false)
+	if err != nil {
+		return nil, err
+	}
+
+	script := Script{
+		Commands:   commands,
+		Extensions: make(map[string]bool),
+	}
+
+	if err := script.validate(); err != nil {
+		return nil, err
+	}
+
+	return &script, nil
+}
@@ -0,0 +1,291 @@
+package sieve
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		script string
+		line   int // 0 if the script is valid
+	}{
+		{"", 0},
+		{"keep;", 0},
+		{"# comment\r\n/* multi-line\r\ncomment */ discard;", 0},
+		{"if true { stop; } elsif false { keep; } else { discard; }", 0},
+		{`require ["fileinto", "copy"]; fileinto :copy "INBOX.lists";`, 0},
+		{`if header :contains ["Subject", "Comments"] ["a", "b"] { keep; }`, 0},
+		{`if size :over 100K { discard; }`, 0},
+		{`if anyof (not exists "To", address :domain :is "From" "a.b") {}`, 0},
+		{"require \"vacation\";\nvacation :days 3 text:\nI am away.\r\n..\r\n.\r\n;", 0},
+		{`require ["variables", "imap4flags"]; setflag "f" "\\Seen";`, 0},
+		{`redirect "bob@example.com";`, 0},
+
+		{"keep", 1},
+		{"keep;\n\ndiscard", 3},
+		{"unknown;", 1},
+		{`fileinto "INBOX";`, 1},
+		{`require "unknown";`, 1},
+		{"keep;\nrequire \"fileinto\";", 2},
+		{"else { keep; }", 1},
+		{"if true;", 1},
+		{"keep { }", 1},
+		{`if header :is :contains "To" "a" {}`, 1},
+		{`if header :unknown "To" "a" {}`, 1},
+		{`if header "To" {}`, 1},
+		{`if size 100 {}`, 1},
+		{`if header :comparator "i;unknown" "To" "a" {}`, 1},
+		{`if allof () {}`, 1},
+		{`redirect "invalid address";`, 1},
+		{`require "variables"; set "1a" "b";`, 1},
+		{`require "imap4flags"; keep :flags;`, 1},
+		{`keep :flags "\\Seen";`, 1},
+		{`if header "To" :is "a" {}`, 1},
+		{"if true {\n\n", 3},
+		{`"unterminated`, 1},
+	}
+
+	for _, test := range tests {
+		_, err := Parse([]byte(test.script))
+
+		if test.line == 0 {
+			if err != nil {
+				t.Errorf("cannot parse %q: %v", test.script, err)
+			}
+
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("parsing %q should have failed", test.script)
+			continue
+		}
+
+		if perr, ok := err.(*ParseError); !ok {
+			t.Errorf("parsing %q returned a %T error", test.script, err)
+		} else if perr.Line != test.line {
+			t.Errorf("parsing %q failed on line %d instead of line %d: %v",
+				test.script, perr.Line, test.line, err)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	data := "From: Alice <Alice@Example.org>\r\n" +
+		"To: bob@example.com, Friends: carol@example.net;\r\n" +
+		"Subject: [list] Weekly\r\n report\r\n" +
+		"X-Spam-Score: =?utf-8?q?caf=C3=A9?=\r\n" +
+		"\r\n" +
+		"Hello.\r\n"
+
+	msg, err := imf.NewMessageDecoder().DecodeAll([]byte(data))
+	if err != nil {
+		t.Fatalf("cannot decode message: %v", err)
+	}
+
+	input := Input{
+		Envelope: Envelope{
+			From: "alice@example.org",
+			To:   "bob+lists@example.com",
+		},
+		Message: msg,
+		Size:    int64(len(data)),
+	}
+
+	tests := []struct {
+		script  string
+		actions []string
+	}{
+		// Implicit keep
+		{``,
+			[]string{`implicit keep`}},
+		{`keep;`,
+			[]string{`keep`}},
+		{`discard;`,
+			[]string{`discard`}},
+		{`discard; stop; keep;`,
+			[]string{`discard`}},
+
+		// Control commands
+		{`if false { discard; } elsif true { keep; } else { stop; }`,
+			[]string{`keep`}},
+		{`if false { discard; } if true { keep; }`,
+			[]string{`keep`}},
+		{`if false { discard; } else { stop; } discard;`,
+			[]string{`implicit keep`}},
+
+		// Tests
+		{`if header :contains "subject" "WEEKLY REPORT" { discard; }`,
+			[]string{`discard`}},
+		{`if header :is :comparator "i;octet" "Subject" "[LIST] weekly report"
+            { discard; }`,
+			[]string{`implicit keep`}},
+		{`if header :matches "Subject" "[list] *" { discard; }`,
+			[]string{`discard`}},
+		{`if header :is "X-Spam-Score" "café" { discard; }`,
+			[]string{`discard`}},
+		{`if address :is "From" "alice@example.org" { discard; }`,
+			[]string{`discard`}},
+		{`if address :domain "to" "example.net" { discard; }`,
+			[]string{`discard`}},
+		{`if address :localpart "to" "example.net" { discard; }`,
+			[]string{`implicit keep`}},
+		{`require "envelope";
+          if envelope :matches :localpart "to" "*+lists" { discard; }`,
+			[]string{`discard`}},
+		{`require "envelope";
+          if envelope :all :is "from" "" { discard; }`,
+			[]string{`implicit keep`}},
+		{`if exists ["From", "To"] { discard; }`,
+			[]string{`discard`}},
+		{`if exists ["From", "Cc"] { discard; }`,
+			[]string{`implicit keep`}},
+		{`if size :over 100 { discard; }`,
+			[]string{`discard`}},
+		{`if size :under 1K { discard; }`,
+			[]string{`discard`}},
+		{`if allof (true, header :contains "From" "alice") { discard; }`,
+			[]string{`discard`}},
+		{`if allof (true, false) { discard; }`,
+			[]string{`implicit keep`}},
+		{`if anyof (false, not false) { discard; }`,
+			[]string{`discard`}},
+
+		// Actions
+		{`require "fileinto"; fileinto "Lists"; fileinto "Lists";`,
+			[]string{`fileinto "Lists"`}},
+		{`require ["fileinto", "copy"]; fileinto :copy "Lists";`,
+			[]string{`fileinto "Lists"`, `implicit keep`}},
+		{`redirect "carol@example.net";`,
+			[]string{`redirect "carol@example.net"`}},
+		{`require "reject"; reject "go away";`,
+			[]string{`reject "go away"`}},
+		{`require "vacation"; vacation :days 3 "I am away";`,
+			[]string{`vacation (3 days)`, `implicit keep`}},
+
+		// Variables
+		{`require ["variables", "fileinto"];
+          if header :matches "Subject" "[*] *" {
+            set :upperfirst "list" "${1}";
+            fileinto "Lists/${list}/${2}";
+          }`,
+			[]string{`fileinto "Lists/List/Weekly report"`}},
+		{`require ["variables", "fileinto"];
+          set :length "n" "abc";
+          set :upper "s" "${n} ${unknown}${invalid";
+          fileinto "${s}";`,
+			[]string{`fileinto "3 ${INVALID"`}},
+		{`require ["variables", "fileinto"];
+          set :quotewildcard "p" "a*b";
+          if string :matches "a*b" "${p}" { fileinto "quoted"; }`,
+			[]string{`fileinto "quoted"`}},
+
+		// Flags
+		{`require "imap4flags";
+          addflag ["\\Seen", "$Label1 \\Flagged"];
+          removeflag "\\flagged";`,
+			[]string{`implicit keep (\Seen $Label1)`}},
+		{`require ["imap4flags", "fileinto"];
+          setflag "\\Seen";
+          if hasflag :is "\\seen" { fileinto :flags "\\Answered" "Read"; }
+          keep;`,
+			[]string{`fileinto "Read" (\Answered)`, `keep (\Seen)`}},
+		{`require ["imap4flags", "variables"];
+          setflag "f" "\\Deleted";
+          if hasflag "f" "\\Deleted" { discard; }`,
+			[]string{`discard`}},
+	}
+
+	for _, test := range tests {
+		script, err := Parse([]byte(test.script))
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", test.script, err)
+			continue
+		}
+
+		result, err := script.Evaluate(&input)
+		if err != nil {
+			t.Errorf("cannot evaluate %q: %v", test.script, err)
+			continue
+		}
+
+		actions := make([]string, len(result.Actions))
+		for i, action := range result.Actions {
+			actions[i] = action.String()
+		}
+
+		if strings.Join(actions, ", ") != strings.Join(test.actions, ", ") {
+			t.Errorf("script %q returned actions %q but should have "+
+				"returned %q", test.script, actions, test.actions)
+		}
+	}
+
+	// Runtime errors
+	errorScripts := []string{
+		`require "reject"; keep; reject "no";`,
+		`require "vacation"; vacation "a"; vacation "b";`,
+		`require ["variables"]; set "a" "invalid"; redirect "${a}";`,
+	}
+
+	for _, s := range errorScripts {
+		script, err := Parse([]byte(s))
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", s, err)
+			continue
+		}
+
+		if _, err := script.Evaluate(&input); err == nil {
+			t.Errorf("evaluation of %q should have failed", s)
+		}
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		vars    []string // nil if the string does not match
+	}{
+		{"", "", []string{}},
+		{"*", "", []string{""}},
+		{"*", "abc", []string{"abc"}},
+		{"a?c", "abc", []string{"b"}},
+		{"a?c", "ac", nil},
+		{"*.*", "a.b.c", []string{"a", "b.c"}},
+		{"*@*.com", "alice@example.com", []string{"alice", "example"}},
+		{"*b*b", "abcbdb", []string{"a", "cbd"}},
+		{"a\\*", "a*", []string{}},
+		{"a\\*", "ab", nil},
+		{"a*?", "a", nil},
+	}
+
+	for _, test := range tests {
+		spans, ok := matchWildcard(parseWildcardPattern(test.pattern), test.s)
+
+		if test.vars == nil {
+			if ok {
+				t.Errorf("%q should not match %q", test.s, test.pattern)
+			}
+
+			continue
+		}
+
+		if !ok {
+			t.Errorf("%q should match %q", test.s, test.pattern)
+			continue
+		}
+
+		vars := make([]string, len(spans))
+		for i, span := range spans {
+			vars[i] = test.s[span[0]:span[1]]
+		}
+
+		if strings.Join(vars, "|") != strings.Join(test.vars, "|") {
+			t.Errorf("%q matched against %q returned %q instead of %q",
+				test.s, test.pattern, vars, test.vars)
+		}
+	}
+}
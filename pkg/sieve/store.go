@@ -0,0 +1,413 @@
+package sieve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-ejson"
+)
+
+// Scripts are stored in one directory per user, as "<name>.sieve" files. The
+// name of the active script, if there is one, is stored in the "active" file.
+
+const (
+	DefaultMaxScriptSize = 1024 * 1024
+	DefaultMaxScripts    = 32
+
+	MaxScriptNameLength = 128
+
+	scriptFileExtension = ".sieve"
+	activeFileName      = "active"
+)
+
+var (
+	ErrScriptNotFound    = errors.New("script not found")
+	ErrScriptExists      = errors.New("script already exists")
+	ErrActiveScript      = errors.New("script is active")
+	ErrInvalidScriptName = errors.New("invalid script name")
+	ErrInvalidUser       = errors.New("invalid user name")
+	ErrScriptTooLarge    = errors.New("script too large")
+	ErrTooManyScripts    = errors.New("too many scripts")
+)
+
+type StoreCfg struct {
+	Path string `json:"path"`
+
+	MaxScriptSize int `json:"max_script_size,omitempty"`
+	MaxScripts    int `json:"max_scripts,omitempty"` // per user
+}
+
+func (cfg *StoreCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("path", cfg.Path)
+
+	v.CheckIntMin("max_script_size", cfg.MaxScriptSize, 0)
+	v.CheckIntMin("max_scripts", cfg.MaxScripts, 0)
+}
+
+type ScriptInfo struct {
+	Name   string
+	Active bool
+}
+
+type Store struct {
+	Cfg StoreCfg
+
+	mutex sync.Mutex
+}
+
+func NewStore(cfg StoreCfg) *Store {
+	if cfg.MaxScriptSize == 0 {
+		cfg.MaxScriptSize = DefaultMaxScriptSize
+	}
+
+	if cfg.MaxScripts == 0 {
+		cfg.MaxScripts = DefaultMaxScripts
+	}
+
+	return &Store{
+		Cfg: cfg,
+	}
+}
+
+// RFC 5804 1.6. Script names are UTF-8 strings without control characters;
+// we also reject characters which are not safe in file names.
+func IsValidScriptName(name string) bool {
+	if name == "" || len(name) > MaxScriptNameLength || name[0] == '.' {
+		return false
+	}
+
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || (c >= 0x80 && c <= 0x9f) ||
+			c == 0x2028 || c == 0x2029 || c == '/' || c == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Store) userPath(user string) (string, error) {
+	if user == "" || user[0] == '.' || strings.ContainsAny(user, "/\\\x00") {
+		return "", ErrInvalidUser
+	}
+
+	return path.Join(s.Cfg.Path, user), nil
+}
+
+func (s *Store) scriptPath(user, name string) (string, error) {
+	userPath, err := s.userPath(user)
+	if err != nil {
+		return "", err
+	}
+
+	if !IsValidScriptName(name) {
+		return "", ErrInvalidScriptName
+	}
+
+	return path.Join(userPath, name+scriptFileExtension), nil
+}
+
+func (s *Store) Scripts(user string) ([]ScriptInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.scripts(user)
+}
+
+func (s *Store) scripts(user string) ([]ScriptInfo, error) {
+	userPath, err := s.userPath(user)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(userPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("cannot read directory %q: %w", userPath, err)
+	}
+
+	activeName, err := s.activeScriptName(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var scripts []ScriptInfo
+
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), scriptFileExtension)
+		if !found || !entry.Type().IsRegular() {
+			continue
+		}
+
+		scripts = append(scripts, ScriptInfo{
+			Name:   name,
+			Active: name == activeName,
+		})
+	}
+
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Name < scripts[j].Name
+	})
+
+	return scripts, nil
+}
+
+func (s *Store) Script(user, name string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.script(user, name)
+}
+
+func (s *Store) script(user, name string) ([]byte, error) {
+	scriptPath, err := s.scriptPath(user, name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(scriptPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrScriptNotFound
+		}
+
+		return nil, fmt.Errorf("cannot read %q: %w", scriptPath, err)
+	}
+
+	return data, nil
+}
+
+// CheckSpace returns an error if a script of a specific size could not be
+// stored.
+func (s *Store) CheckSpace(user, name string, size int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.checkSpace(user, name, size)
+}
+
+func (s *Store) checkSpace(user, name string, size int) error {
+	if _, err := s.scriptPath(user, name); err != nil {
+		return err
+	}
+
+	if size > s.Cfg.MaxScriptSize {
+		return ErrScriptTooLarge
+	}
+
+	scripts, err := s.scripts(user)
+	if err != nil {
+		return err
+	}
+
+	if len(scripts) < s.Cfg.MaxScripts {
+		return nil
+	}
+
+	// Replacing a script does not require more space
+	for _, script := range scripts {
+		if script.Name == name {
+			return nil
+		}
+	}
+
+	return ErrTooManyScripts
+}
+
+// PutScript stores a script, replacing any existing script with the same
+// name. The content of the script must have been validated by the caller.
+func (s *Store) PutScript(user, name string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.checkSpace(user, name, len(data)); err != nil {
+		return err
+	}
+
+	scriptPath, err := s.scriptPath(user, name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(scriptPath), 0700); err != nil {
+		return fmt.Errorf("cannot create directory %q: %w",
+			path.Dir(scriptPath), err)
+	}
+
+	return utils.WriteFileAtomically(scriptPath, data)
+}
+
+func (s *Store) DeleteScript(user, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	scriptPath, err := s.scriptPath(user, name)
+	if err != nil {
+		return err
+	}
+
+	activeName, err := s.activeScriptName(user)
+	if err != nil {
+		return err
+	}
+
+	// RFC 5804 2.10. The active script cannot be deleted
+	if name == activeName {
+		return ErrActiveScript
+	}
+
+	if err := os.Remove(scriptPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrScriptNotFound
+		}
+
+		return fmt.Errorf("cannot delete %q: %w", scriptPath, err)
+	}
+
+	return nil
+}
+
+func (s *Store) RenameScript(user, oldName, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	oldPath, err := s.scriptPath(user, oldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := s.scriptPath(user, newName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(oldPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrScriptNotFound
+		}
+
+		return fmt.Errorf("cannot stat %q: %w", oldPath, err)
+	}
+
+	if _, err := os.Stat(newPath); err == nil {
+		return ErrScriptExists
+	}
+
+	activeName, err := s.activeScriptName(user)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("cannot rename %q: %w", oldPath, err)
+	}
+
+	if oldName == activeName {
+		return s.setActiveScriptName(user, newName)
+	}
+
+	return nil
+}
+
+// SetActiveScript activates a script; an empty name deactivates the current
+// active script if there is one.
+func (s *Store) SetActiveScript(user, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if name != "" {
+		scriptPath, err := s.scriptPath(user, name)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(scriptPath); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return ErrScriptNotFound
+			}
+
+			return fmt.Errorf("cannot stat %q: %w", scriptPath, err)
+		}
+	}
+
+	return s.setActiveScriptName(user, name)
+}
+
+// ActiveScript returns the parsed active script of a user, or nil if the user
+// does not have any active script.
+func (s *Store) ActiveScript(user string) (*Script, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name, err := s.activeScriptName(user)
+	if err != nil || name == "" {
+		return nil, err
+	}
+
+	data, err := s.script(user, name)
+	if err != nil {
+		return nil, err
+	}
+
+	script, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid script %q: %w", name, err)
+	}
+
+	return script, nil
+}
+
+func (s *Store) activeScriptName(user string) (string, error) {
+	userPath, err := s.userPath(user)
+	if err != nil {
+		return "", err
+	}
+
+	filePath := path.Join(userPath, activeFileName)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("cannot read %q: %w", filePath, err)
+	}
+
+	name := string(bytes.TrimSpace(data))
+	if name != "" && !IsValidScriptName(name) {
+		return "", fmt.Errorf("invalid script name %q in %q", name, filePath)
+	}
+
+	return name, nil
+}
+
+func (s *Store) setActiveScriptName(user, name string) error {
+	userPath, err := s.userPath(user)
+	if err != nil {
+		return err
+	}
+
+	filePath := path.Join(userPath, activeFileName)
+
+	if name == "" {
+		if err := os.Remove(filePath); err != nil &&
+			!errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot delete %q: %w", filePath, err)
+		}
+
+		return nil
+	}
+
+	return utils.WriteFileAtomically(filePath, []byte(name+"\n"))
+}
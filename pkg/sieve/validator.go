@@ -0,0 +1,548 @@
+package sieve
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+type tagSpec struct {
+	Value     ArgumentType // empty for tags without value
+	Group     string       // tags of the same group are mutually exclusive
+	Extension string
+}
+
+type commandSpec struct {
+	Extension string
+	Tags      map[string]tagSpec
+
+	// Exactly one tag of this group must be present
+	RequiredGroup string
+
+	// Leading positional arguments can be omitted, e.g. the variable name
+	// of imap4flags commands.
+	Positional         []ArgumentType
+	OptionalPositional int
+
+	// The number of tests: 0 for no test, 1 for a single test, -1 for a list
+	// of tests.
+	Tests int
+
+	Block bool
+}
+
+var comparatorTags = map[string]tagSpec{
+	"comparator": {Value: ArgumentTypeString, Group: "comparator"},
+}
+
+var matchTypeTags = map[string]tagSpec{
+	"is":       {Group: "match-type"},
+	"contains": {Group: "match-type"},
+	"matches":  {Group: "match-type"},
+}
+
+var addressPartTags = map[string]tagSpec{
+	"all":       {Group: "address-part"},
+	"localpart": {Group: "address-part"},
+	"domain":    {Group: "address-part"},
+}
+
+var flagsTags = map[string]tagSpec{
+	"flags": {Value: ArgumentTypeStringList, Extension: "imap4flags"},
+}
+
+var copyTags = map[string]tagSpec{
+	"copy": {Extension: "copy"},
+}
+
+func tagSpecs(tables ...map[string]tagSpec) map[string]tagSpec {
+	specs := make(map[string]tagSpec)
+
+	for _, table := range tables {
+		maps.Copy(specs, table)
+	}
+
+	return specs
+}
+
+var commandSpecs = map[string]*commandSpec{
+	// Control commands
+	"require": {
+		Positional: []ArgumentType{ArgumentTypeStringList},
+	},
+	"if": {
+		Tests: 1,
+		Block: true,
+	},
+	"elsif": {
+		Tests: 1,
+		Block: true,
+	},
+	"else": {
+		Block: true,
+	},
+	"stop": {},
+
+	// Actions
+	"keep": {
+		Tags: tagSpecs(flagsTags),
+	},
+	"discard": {},
+	"fileinto": {
+		Extension:  "fileinto",
+		Tags:       tagSpecs(flagsTags, copyTags),
+		Positional: []ArgumentType{ArgumentTypeString},
+	},
+	"redirect": {
+		Tags:       tagSpecs(copyTags),
+		Positional: []ArgumentType{ArgumentTypeString},
+	},
+	"reject": {
+		Extension:  "reject",
+		Positional: []ArgumentType{ArgumentTypeString},
+	},
+
+	// RFC 5229 3. Action set
+	"set": {
+		Extension: "variables",
+		Tags: map[string]tagSpec{
+			"lower":         {Group: "case"},
+			"upper":         {Group: "case"},
+			"lowerfirst":    {Group: "case-first"},
+			"upperfirst":    {Group: "case-first"},
+			"quotewildcard": {},
+			"length":        {},
+		},
+		Positional: []ArgumentType{ArgumentTypeString, ArgumentTypeString},
+	},
+
+	// RFC 5230 4. Vacation Action
+	"vacation": {
+		Extension: "vacation",
+		Tags: map[string]tagSpec{
+			"days":      {Value: ArgumentTypeNumber},
+			"subject":   {Value: ArgumentTypeString},
+			"from":      {Value: ArgumentTypeString},
+			"addresses": {Value: ArgumentTypeStringList},
+			"mime":      {},
+			"handle":    {Value: ArgumentTypeString},
+		},
+		Positional: []ArgumentType{ArgumentTypeString},
+	},
+
+	// RFC 5232 3. Actions
+	"setflag": {
+		Extension:          "imap4flags",
+		Positional:         []ArgumentType{ArgumentTypeString, ArgumentTypeStringList},
+		OptionalPositional: 1,
+	},
+	"addflag": {
+		Extension:          "imap4flags",
+		Positional:         []ArgumentType{ArgumentTypeString, ArgumentTypeStringList},
+		OptionalPositional: 1,
+	},
+	"removeflag": {
+		Extension:          "imap4flags",
+		Positional:         []ArgumentType{ArgumentTypeString, ArgumentTypeStringList},
+		OptionalPositional: 1,
+	},
+}
+
+var testSpecs = map[string]*commandSpec{
+	"address": {
+		Tags:       tagSpecs(comparatorTags, matchTypeTags, addressPartTags),
+		Positional: []ArgumentType{ArgumentTypeStringList, ArgumentTypeStringList},
+	},
+	"allof": {
+		Tests: -1,
+	},
+	"anyof": {
+		Tests: -1,
+	},
+	"envelope": {
+		Extension:  "envelope",
+		Tags:       tagSpecs(comparatorTags, matchTypeTags, addressPartTags),
+		Positional: []ArgumentType{ArgumentTypeStringList, ArgumentTypeStringList},
+	},
+	"exists": {
+		Positional: []ArgumentType{ArgumentTypeStringList},
+	},
+	"false": {},
+	"header": {
+		Tags:       tagSpecs(comparatorTags, matchTypeTags),
+		Positional: []ArgumentType{ArgumentTypeStringList, ArgumentTypeStringList},
+	},
+	"not": {
+		Tests: 1,
+	},
+	"size": {
+		Tags: map[string]tagSpec{
+			"over":  {Group: "size"},
+			"under": {Group: "size"},
+		},
+		RequiredGroup: "size",
+		Positional:    []ArgumentType{ArgumentTypeNumber},
+	},
+	"true": {},
+
+	// RFC 5229 5. Test string
+	"string": {
+		Extension:  "variables",
+		Tags:       tagSpecs(comparatorTags, matchTypeTags),
+		Positional: []ArgumentType{ArgumentTypeStringList, ArgumentTypeStringList},
+	},
+
+	// RFC 5232 4. Test hasflag
+	"hasflag": {
+		Extension:          "imap4flags",
+		Tags:               tagSpecs(comparatorTags, matchTypeTags),
+		Positional:         []ArgumentType{ArgumentTypeStringList, ArgumentTypeStringList},
+		OptionalPositional: 1,
+	},
+}
+
+// RFC 5228 2.7.3. Comparators
+var comparators = []string{
+	"i;octet",
+	"i;ascii-casemap",
+}
+
+type arguments struct {
+	tags       map[string]*Argument // nil values for tags without value
+	positional []*Argument          // nil values for omitted arguments
+}
+
+func (args *arguments) hasTag(name string) bool {
+	_, found := args.tags[name]
+	return found
+}
+
+func (args *arguments) tag(name string) *Argument {
+	return args.tags[name]
+}
+
+func (s *Script) validate() error {
+	return s.validateCommands(s.Commands, true)
+}
+
+func (s *Script) validateCommands(commands []*Command, topLevel bool) error {
+	requireAllowed := topLevel
+
+	for i, cmd := range commands {
+		if cmd.Name != "require" {
+			requireAllowed = false
+		}
+
+		spec := commandSpecs[cmd.Name]
+		if spec == nil {
+			return parseErrorf(cmd.Line, "unknown command %q", cmd.Name)
+		}
+
+		if err := s.validateExtension(cmd.Line, cmd.Name, spec); err != nil {
+			return err
+		}
+
+		args, err := s.validateArguments(cmd.Line, cmd.Name, spec, cmd.Arguments)
+		if err != nil {
+			return err
+		}
+
+		cmd.args = args
+
+		if err := s.validateTests(cmd.Line, cmd.Name, spec, cmd.Tests); err != nil {
+			return err
+		}
+
+		if spec.Block && cmd.Block == nil {
+			return parseErrorf(cmd.Line, "missing block after %q", cmd.Name)
+		} else if !spec.Block && cmd.Block != nil {
+			return parseErrorf(cmd.Line, "unexpected block after %q", cmd.Name)
+		}
+
+		switch cmd.Name {
+		case "require":
+			if !requireAllowed {
+				return parseErrorf(cmd.Line,
+					"\"require\" must be used at the beginning of the script")
+			}
+
+			for _, name := range args.positional[0].Strings {
+				if !IsSupportedExtension(name) {
+					return parseErrorf(cmd.Line, "unsupported extension %q",
+						name)
+				}
+
+				s.Extensions[name] = true
+			}
+
+		case "elsif", "else":
+			if i == 0 || (commands[i-1].Name != "if" &&
+				commands[i-1].Name != "elsif") {
+				return parseErrorf(cmd.Line, "%q must follow \"if\" or \"elsif\"",
+					cmd.Name)
+			}
+
+		case "redirect":
+			address := args.positional[0].Strings[0]
+			if !s.containsVariables(address) && !isValidAddress(address) {
+				return parseErrorf(cmd.Line, "invalid address %q", address)
+			}
+
+		case "set":
+			name := args.positional[0].Strings[0]
+			if !isIdentifier(name) {
+				return parseErrorf(cmd.Line, "invalid variable name %q", name)
+			}
+
+		case "setflag", "addflag", "removeflag":
+			if arg := args.positional[0]; arg != nil {
+				if !s.Extensions["variables"] {
+					return parseErrorf(cmd.Line, "variable names require "+
+						"extension \"variables\"")
+				}
+
+				if name := arg.Strings[0]; !isIdentifier(name) {
+					return parseErrorf(cmd.Line, "invalid variable name %q",
+						name)
+				}
+			}
+		}
+
+		if cmd.Block != nil {
+			if err := s.validateCommands(cmd.Block, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Script) validateTest(test *Test) error {
+	spec := testSpecs[test.Name]
+	if spec == nil {
+		return parseErrorf(test.Line, "unknown test %q", test.Name)
+	}
+
+	if err := s.validateExtension(test.Line, test.Name, spec); err != nil {
+		return err
+	}
+
+	args, err := s.validateArguments(test.Line, test.Name, spec, test.Arguments)
+	if err != nil {
+		return err
+	}
+
+	test.args = args
+
+	if err := s.validateTests(test.Line, test.Name, spec, test.Tests); err != nil {
+		return err
+	}
+
+	if arg := args.tag("comparator"); arg != nil {
+		name := strings.ToLower(arg.Strings[0])
+		if !slices.Contains(comparators, name) {
+			return parseErrorf(test.Line, "unsupported comparator %q", name)
+		}
+	}
+
+	switch test.Name {
+	case "address", "exists", "header":
+		for _, name := range args.positional[0].Strings {
+			if !s.containsVariables(name) && !isFieldName(name) {
+				return parseErrorf(test.Line, "invalid header name %q", name)
+			}
+		}
+
+	case "envelope":
+		for _, part := range args.positional[0].Strings {
+			if s.containsVariables(part) {
+				continue
+			}
+
+			switch strings.ToLower(part) {
+			case "from", "to":
+			default:
+				return parseErrorf(test.Line, "unsupported envelope part %q",
+					part)
+			}
+		}
+
+	case "hasflag":
+		if arg := args.positional[0]; arg != nil {
+			if !s.Extensions["variables"] {
+				return parseErrorf(test.Line, "variable names require "+
+					"extension \"variables\"")
+			}
+
+			for _, name := range arg.Strings {
+				if !isIdentifier(name) {
+					return parseErrorf(test.Line, "invalid variable name %q",
+						name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Script) validateExtension(line int, name string, spec *commandSpec) error {
+	if spec.Extension != "" && !s.Extensions[spec.Extension] {
+		return parseErrorf(line, "%q requires extension %q", name,
+			spec.Extension)
+	}
+
+	return nil
+}
+
+func (s *Script) validateArguments(line int, name string, spec *commandSpec, args []*Argument) (*arguments, error) {
+	parsedArgs := arguments{
+		tags: make(map[string]*Argument),
+	}
+
+	groups := make(map[string]string)
+
+	var positional []*Argument
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg.Type != ArgumentTypeTag {
+			positional = append(positional, arg)
+			continue
+		}
+
+		// RFC 5228 2.6.2. Tagged arguments must appear before positional
+		// arguments.
+		if len(positional) > 0 {
+			return nil, parseErrorf(arg.Line, "unexpected tag :%s after "+
+				"positional arguments", arg.Tag)
+		}
+
+		tag, found := spec.Tags[arg.Tag]
+		if !found {
+			return nil, parseErrorf(arg.Line, "unknown tag :%s for %q",
+				arg.Tag, name)
+		}
+
+		if tag.Extension != "" && !s.Extensions[tag.Extension] {
+			return nil, parseErrorf(arg.Line, "tag :%s requires extension %q",
+				arg.Tag, tag.Extension)
+		}
+
+		if _, found := parsedArgs.tags[arg.Tag]; found {
+			return nil, parseErrorf(arg.Line, "duplicate tag :%s", arg.Tag)
+		}
+
+		if tag.Group != "" {
+			if tag2, found := groups[tag.Group]; found {
+				return nil, parseErrorf(arg.Line, "tag :%s cannot be used "+
+					"with tag :%s", arg.Tag, tag2)
+			}
+
+			groups[tag.Group] = arg.Tag
+		}
+
+		var value *Argument
+
+		if tag.Value != "" {
+			if i+1 >= len(args) || !isArgumentOfType(args[i+1], tag.Value) {
+				return nil, parseErrorf(arg.Line, "tag :%s requires a %s value",
+					arg.Tag, tag.Value)
+			}
+
+			i++
+			value = args[i]
+		}
+
+		parsedArgs.tags[arg.Tag] = value
+	}
+
+	if spec.RequiredGroup != "" {
+		if _, found := groups[spec.RequiredGroup]; !found {
+			return nil, parseErrorf(line, "missing %s tag for %q",
+				spec.RequiredGroup, name)
+		}
+	}
+
+	nbArgs := len(spec.Positional)
+	minNbArgs := nbArgs - spec.OptionalPositional
+
+	if len(positional) < minNbArgs || len(positional) > nbArgs {
+		return nil, parseErrorf(line, "invalid number of arguments for %q",
+			name)
+	}
+
+	parsedArgs.positional = make([]*Argument, nbArgs)
+	copy(parsedArgs.positional[nbArgs-len(positional):], positional)
+
+	for i, arg := range parsedArgs.positional {
+		if arg != nil && !isArgumentOfType(arg, spec.Positional[i]) {
+			return nil, parseErrorf(arg.Line, "invalid argument %v for %q: "+
+				"expected %s", arg, name, spec.Positional[i])
+		}
+	}
+
+	return &parsedArgs, nil
+}
+
+func (s *Script) validateTests(line int, name string, spec *commandSpec, tests []*Test) error {
+	switch {
+	case spec.Tests == 0 && len(tests) > 0:
+		return parseErrorf(line, "unexpected test for %q", name)
+
+	case spec.Tests == 1 && len(tests) != 1:
+		return parseErrorf(line, "%q requires a single test", name)
+
+	case spec.Tests == -1 && len(tests) == 0:
+		return parseErrorf(line, "%q requires a list of tests", name)
+	}
+
+	for _, test := range tests {
+		if err := s.validateTest(test); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Script) containsVariables(str string) bool {
+	return s.Extensions["variables"] && strings.Contains(str, "${")
+}
+
+func isArgumentOfType(arg *Argument, t ArgumentType) bool {
+	if t == ArgumentTypeStringList {
+		return arg.Type == ArgumentTypeString ||
+			arg.Type == ArgumentTypeStringList
+	}
+
+	return arg.Type == t
+}
+
+func isFieldName(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !imf.IsFieldChar(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isValidAddress(s string) bool {
+	d := imf.NewDataDecoder([]byte(s))
+
+	if _, err := d.ReadSpecificAddress(); err != nil {
+		return false
+	}
+
+	return d.Empty()
+}
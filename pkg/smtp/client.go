@@ -1,27 +1,81 @@
 package smtp
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/galdor/emaild/pkg/imf"
 	"github.com/galdor/go-log"
 )
 
 const (
 	DefaultConnectionTimeout = 10 * time.Second
+	DefaultCommandTimeout    = 5 * time.Minute
 )
 
 type ClientCfg struct {
 	Log               *log.Logger
 	ConnectionTimeout time.Duration
+	CommandTimeout    time.Duration
+
+	// The domain sent with EHLO and HELO commands
+	Domain string
+
+	// The TLS configuration used for STARTTLS or implicit TLS
+	TLSConfig   *tls.Config
+	ImplicitTLS bool
+}
+
+type Reply struct {
+	Code  int
+	Lines []string
+}
+
+func (r *Reply) String() string {
+	return fmt.Sprintf("%d %s", r.Code, strings.Join(r.Lines, " "))
+}
+
+func (r *Reply) IsPositive() bool {
+	return r.Code >= 200 && r.Code < 400
+}
+
+func (r *Reply) IsTransientFailure() bool {
+	return r.Code >= 400 && r.Code < 500
+}
+
+func (r *Reply) IsPermanentFailure() bool {
+	return r.Code >= 500
+}
+
+type ReplyError struct {
+	Command string
+	Reply   *Reply
+}
+
+func (err *ReplyError) Error() string {
+	return fmt.Sprintf("%s command failed: %v", err.Command, err.Reply)
 }
 
 type Client struct {
 	Cfg ClientCfg
 	Log *log.Logger
 
+	// Extensions announced by the server in its EHLO reply, with their
+	// parameters. Keys are upper case.
+	Extensions map[string]string
+
 	conn net.Conn
+	rbuf *bufio.Reader
+	wbuf bytes.Buffer
+	tls  bool
 }
 
 func NewClient(address string, cfg ClientCfg) (*Client, error) {
@@ -29,7 +83,25 @@ func NewClient(address string, cfg ClientCfg) (*Client, error) {
 		cfg.ConnectionTimeout = DefaultConnectionTimeout
 	}
 
-	conn, err := net.DialTimeout("tcp", address, cfg.ConnectionTimeout)
+	if cfg.CommandTimeout == 0 {
+		cfg.CommandTimeout = DefaultCommandTimeout
+	}
+
+	if cfg.Domain == "" {
+		cfg.Domain = "localhost"
+	}
+
+	dialer := net.Dialer{Timeout: cfg.ConnectionTimeout}
+
+	var conn net.Conn
+	var err error
+
+	if cfg.ImplicitTLS {
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: cfg.TLSConfig}
+		conn, err = tlsDialer.Dial("tcp", address)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect: %w", err)
 	}
@@ -39,11 +111,265 @@ func NewClient(address string, cfg ClientCfg) (*Client, error) {
 		Log: cfg.Log,
 
 		conn: conn,
+		rbuf: bufio.NewReader(conn),
+		tls:  cfg.ImplicitTLS,
+	}
+
+	if err := c.start(); err != nil {
+		conn.Close()
+		return nil, err
 	}
 
 	return &c, nil
 }
 
+func (c *Client) start() error {
+	greeting, err := c.readReply()
+	if err != nil {
+		return fmt.Errorf("cannot read greeting: %w", err)
+	}
+
+	if greeting.Code != 220 {
+		return &ReplyError{Command: "greeting", Reply: greeting}
+	}
+
+	return c.hello()
+}
+
+func (c *Client) hello() error {
+	// RFC 5321 3.2. Clients should fall back to HELO if the server does not
+	// support EHLO.
+	reply, err := c.Command("EHLO %s", c.Cfg.Domain)
+	if err != nil {
+		return err
+	}
+
+	if reply.Code == 250 {
+		c.Extensions = make(map[string]string)
+
+		for _, line := range reply.Lines[1:] {
+			name, value, _ := strings.Cut(line, " ")
+			c.Extensions[strings.ToUpper(name)] = value
+		}
+
+		return nil
+	}
+
+	reply, err = c.Command("HELO %s", c.Cfg.Domain)
+	if err != nil {
+		return err
+	}
+
+	if reply.Code != 250 {
+		return &ReplyError{Command: "HELO", Reply: reply}
+	}
+
+	c.Extensions = make(map[string]string)
+
+	return nil
+}
+
 func (c *Client) Close() {
 	c.conn.Close()
 }
+
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Client) TLS() bool {
+	return c.tls
+}
+
+func (c *Client) HasExtension(name string) bool {
+	_, found := c.Extensions[name]
+	return found
+}
+
+func (c *Client) StartTLS() error {
+	// RFC 3207 SMTP Service Extension for Secure SMTP over Transport Layer
+	// Security
+	if c.tls {
+		return fmt.Errorf("tls already active")
+	}
+
+	if !c.HasExtension("STARTTLS") {
+		return fmt.Errorf("server does not support STARTTLS")
+	}
+
+	if err := c.expect(220, "STARTTLS", "STARTTLS"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(c.conn, c.Cfg.TLSConfig)
+
+	c.setDeadline(c.Cfg.ConnectionTimeout)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("tls handshake failed: %w", err)
+	}
+
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReader(tlsConn)
+	c.tls = true
+
+	// RFC 3207 4.2. The client must discard any knowledge obtained from the
+	// server before the TLS negotiation.
+	return c.hello()
+}
+
+func (c *Client) Auth(username, password string) error {
+	// RFC 4954 SMTP Service Extension for Authentication. We only support the
+	// PLAIN mechanism (RFC 4616) which is only acceptable over TLS.
+	mechanisms, found := c.Extensions["AUTH"]
+	if !found {
+		return fmt.Errorf("server does not support AUTH")
+	}
+
+	supported := false
+	for _, mechanism := range strings.Fields(mechanisms) {
+		if strings.EqualFold(mechanism, "PLAIN") {
+			supported = true
+		}
+	}
+
+	if !supported {
+		return fmt.Errorf("server does not support the PLAIN mechanism")
+	}
+
+	credentials := "\x00" + username + "\x00" + password
+	response := base64.StdEncoding.EncodeToString([]byte(credentials))
+
+	return c.expect(235, "AUTH", "AUTH PLAIN %s", response)
+}
+
+func (c *Client) Mail(reversePath *imf.SpecificAddress) error {
+	return c.expect(250, "MAIL", "MAIL FROM:%s", FormatPath(reversePath))
+}
+
+func (c *Client) Rcpt(forwardPath imf.SpecificAddress) error {
+	return c.expect(250, "RCPT", "RCPT TO:%s", FormatPath(&forwardPath))
+}
+
+func (c *Client) Data(data []byte) error {
+	if err := c.expect(354, "DATA", "DATA"); err != nil {
+		return err
+	}
+
+	c.setDeadline(c.Cfg.CommandTimeout)
+
+	if _, err := c.conn.Write(EncodeDataBlock(data)); err != nil {
+		return fmt.Errorf("cannot write connection: %w", err)
+	}
+
+	reply, err := c.readReply()
+	if err != nil {
+		return err
+	}
+
+	if reply.Code != 250 {
+		return &ReplyError{Command: "DATA", Reply: reply}
+	}
+
+	return nil
+}
+
+func (c *Client) Reset() error {
+	return c.expect(250, "RSET", "RSET")
+}
+
+func (c *Client) Noop() error {
+	return c.expect(250, "NOOP", "NOOP")
+}
+
+func (c *Client) Quit() error {
+	defer c.Close()
+	return c.expect(221, "QUIT", "QUIT")
+}
+
+func (c *Client) Command(format string, args ...any) (*Reply, error) {
+	c.wbuf.Reset()
+	fmt.Fprintf(&c.wbuf, format, args...)
+	c.wbuf.WriteString("\r\n")
+
+	c.setDeadline(c.Cfg.CommandTimeout)
+
+	if _, err := c.conn.Write(c.wbuf.Bytes()); err != nil {
+		return nil, fmt.Errorf("cannot write connection: %w", err)
+	}
+
+	return c.readReply()
+}
+
+func (c *Client) expect(code int, command, format string, args ...any) error {
+	reply, err := c.Command(format, args...)
+	if err != nil {
+		return err
+	}
+
+	if reply.Code != code {
+		return &ReplyError{Command: command, Reply: reply}
+	}
+
+	return nil
+}
+
+func (c *Client) setDeadline(timeout time.Duration) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func (c *Client) readReply() (*Reply, error) {
+	// RFC 5321 4.2. SMTP Replies
+	var reply Reply
+
+	for {
+		line, err := c.rbuf.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("cannot read connection: %w", err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if len(line) < 3 {
+			return nil, fmt.Errorf("truncated reply line %q", line)
+		}
+
+		code, err := strconv.Atoi(line[:3])
+		if err != nil || code < 200 || code > 599 {
+			return nil, fmt.Errorf("invalid reply code in line %q", line)
+		}
+
+		if reply.Code != 0 && code != reply.Code {
+			return nil, fmt.Errorf("inconsistent reply codes %d and %d",
+				reply.Code, code)
+		}
+
+		reply.Code = code
+
+		more := len(line) > 3 && line[3] == '-'
+		if len(line) > 3 && !more && line[3] != ' ' {
+			return nil, fmt.Errorf("invalid separator in reply line %q", line)
+		}
+
+		if len(line) > 4 {
+			reply.Lines = append(reply.Lines, line[4:])
+		} else {
+			reply.Lines = append(reply.Lines, "")
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	return &reply, nil
+}
+
+func IsTransientError(err error) bool {
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Reply.IsTransientFailure()
+	}
+
+	// Network errors are always transient
+	return true
+}
@@ -15,9 +15,11 @@ type LineReader struct {
 }
 
 func NewLineReader(data []byte) (*LineReader, error) {
+	// Some commands such as DATA or QUIT do not have any parameter, so there
+	// may not be any space character after the keyword.
 	space := bytes.IndexByte(data, ' ')
 	if space == -1 {
-		return nil, fmt.Errorf("truncated line")
+		space = len(data)
 	}
 
 	if space == 0 {
@@ -26,8 +28,10 @@ func NewLineReader(data []byte) (*LineReader, error) {
 
 	r := LineReader{
 		Keyword: string(data[:space]),
+	}
 
-		data: data[space+1:],
+	if space < len(data) {
+		r.data = data[space+1:]
 	}
 
 	isCode := true
@@ -76,6 +80,10 @@ func (r *LineReader) SkipStringCaseInsensitive(s string) bool {
 	return true
 }
 
+func (r *LineReader) Empty() bool {
+	return len(r.data) == 0
+}
+
 func (r *LineReader) ReadAll() []byte {
 	data := r.data
 	r.data = nil
@@ -2,30 +2,225 @@ package smtp
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io/fs"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/galdor/emaild/pkg/arc"
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/dmarc"
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/dnsbl"
+	"github.com/galdor/emaild/pkg/greylist"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/spf"
+	"github.com/galdor/emaild/pkg/utils"
 	"github.com/galdor/go-ejson"
 	"github.com/galdor/go-log"
 )
 
+const (
+	DefaultMaxMessageSize  = 32 * 1024 * 1024
+	DefaultMaxRecipients   = 100
+	DefaultTarpitThreshold = 3
+
+	// RFC 5321 6.3. The hop count limit must be at least 100.
+	DefaultMaxReceivedFields = 100
+
+	MaxTarpitDelay = 30 * time.Second
+
+	// The number of failed authentication attempts after which the
+	// connection is closed
+	MaxAuthenticationFailures = 3
+)
+
+type ServerMode string
+
+const (
+	// Mail exchanger: accept messages from other servers for local
+	// recipients (RFC 5321).
+	ServerModeMX ServerMode = "mx"
+
+	// Message submission agent: accept messages from authenticated users
+	// and fix them up before relaying them (RFC 6409).
+	ServerModeMSA ServerMode = "msa"
+
+	// Local mail transfer: accept messages from trusted MTAs for local
+	// delivery, with one reply per recipient (RFC 2033).
+	ServerModeLMTP ServerMode = "lmtp"
+)
+
+var ServerModeValues = []ServerMode{
+	ServerModeMX,
+	ServerModeMSA,
+	ServerModeLMTP,
+}
+
+type SPFPolicy string
+
+const (
+	// Only record the result of SPF checks in the message header
+	SPFPolicyRecord SPFPolicy = "record"
+
+	// Reject the MAIL command when SPF checks fail
+	SPFPolicyReject SPFPolicy = "reject"
+)
+
+var SPFPolicyValues = []SPFPolicy{
+	SPFPolicyRecord,
+	SPFPolicyReject,
+}
+
+type DMARCPolicy string
+
+const (
+	// Only record the result of DMARC evaluation in the message header
+	DMARCPolicyRecord DMARCPolicy = "record"
+
+	// Reject messages when the policy of the author domain requests it;
+	// messages to quarantine are marked with Transaction.Quarantine and left
+	// to the message handler.
+	DMARCPolicyEnforce DMARCPolicy = "enforce"
+)
+
+var DMARCPolicyValues = []DMARCPolicy{
+	DMARCPolicyRecord,
+	DMARCPolicyEnforce,
+}
+
+type DNSBLPolicy string
+
+const (
+	// Reject listed clients with a 554 greeting
+	DNSBLPolicyGreeting DNSBLPolicy = "greeting"
+
+	// Reject RCPT commands of listed clients, except for the postmaster
+	// mailbox, so that they can still report the problem.
+	DNSBLPolicyRCPT DNSBLPolicy = "rcpt"
+)
+
+var DNSBLPolicyValues = []DNSBLPolicy{
+	DNSBLPolicyGreeting,
+	DNSBLPolicyRCPT,
+}
+
 type ServerCfg struct {
-	Log *log.Logger `json:"-"`
+	Log              *log.Logger      `json:"-"`
+	MessageHandler   MessageHandler   `json:"-"`
+	RecipientHandler RecipientHandler `json:"-"` // all recipients accepted if nil
+	SenderHandler    SenderHandler    `json:"-"` // identity used as address if nil
+	DKIMVerifier     *dkim.Verifier   `json:"-"`
+	ARCVerifier      *arc.Verifier    `json:"-"`
+	SPFChecker       *spf.Checker     `json:"-"`
+	DNSBLChecker     *dnsbl.Checker   `json:"-"`
+
+	// Greylisting is applied to all recipients when set
+	Greylist *greylist.Greylist `json:"-"`
+
+	DMARCEvaluator  *dmarc.Evaluator  `json:"-"`
+	DMARCAggregator *dmarc.Aggregator `json:"-"`
+
+	// Used to look up the host name of clients for trace fields; no lookup
+	// is performed if not set.
+	Resolver dns.Resolver `json:"-"`
+
+	// Used to authenticate users in MSA mode
+	Authenticator sasl.Authenticator `json:"-"`
+
+	// The TLS configuration used for STARTTLS or implicit TLS, loaded from
+	// TLS if not set
+	TLSConfig *tls.Config `json:"-"`
 
 	Host string `json:"host"`
 	Port int    `json:"port"`
 
+	// The path of a UNIX domain socket to listen on instead of Host and Port,
+	// only supported in LMTP mode
+	Path string `json:"path,omitempty"`
+
 	PublicHost string `json:"public_host"`
+
+	Mode ServerMode `json:"mode,omitempty"`
+
+	TLS *utils.TLSCfg `json:"tls,omitempty"`
+
+	// Establish TLS as soon as the connection is accepted instead of waiting
+	// for the STARTTLS command (RFC 8314 3.3.).
+	ImplicitTLS bool `json:"implicit_tls,omitempty"`
+
+	// Authentication transmits passwords in clear text and is therefore only
+	// allowed on TLS connections unless this option is set.
+	AllowInsecureAuthentication bool `json:"allow_insecure_authentication,omitempty"`
+
+	MaxMessageSize int `json:"max_message_size,omitempty"`
+	MaxRecipients  int `json:"max_recipients,omitempty"`
+
+	// Messages containing more Received fields are rejected, assuming they
+	// are caught in a routing loop.
+	MaxReceivedFields int `json:"max_received_fields,omitempty"`
+
+	SPFPolicy   SPFPolicy   `json:"spf_policy,omitempty"`
+	DMARCPolicy DMARCPolicy `json:"dmarc_policy,omitempty"`
+	DNSBLPolicy DNSBLPolicy `json:"dnsbl_policy,omitempty"`
+
+	// The time to wait before sending the greeting (seconds); clients which
+	// send data during this delay are rejected. Zero to disable.
+	GreetingDelay int `json:"greeting_delay,omitempty"`
+
+	// The delay added to each error reply once the client has received more
+	// than TarpitThreshold error replies (seconds); the delay increases with
+	// each new error up to MaxTarpitDelay. Zero to disable.
+	TarpitDelay     int `json:"tarpit_delay,omitempty"`
+	TarpitThreshold int `json:"tarpit_threshold,omitempty"`
 }
 
 func (cfg *ServerCfg) ValidateJSON(v *ejson.Validator) {
-	v.CheckStringNotEmpty("host", cfg.Host)
-	v.CheckIntMinMax("port", cfg.Port, 1, 65535)
+	if cfg.Path == "" {
+		v.CheckStringNotEmpty("host", cfg.Host)
+		v.CheckIntMinMax("port", cfg.Port, 1, 65535)
+	} else {
+		v.Check("path", cfg.Mode == ServerModeLMTP, "invalid_mode",
+			"UNIX domain sockets are only supported in LMTP mode")
+	}
+
 	v.CheckStringNotEmpty("public_host", cfg.PublicHost)
+
+	if cfg.Mode != "" {
+		v.CheckStringValue("mode", cfg.Mode, ServerModeValues)
+	}
+
+	v.CheckOptionalObject("tls", cfg.TLS)
+
+	if cfg.ImplicitTLS {
+		v.Check("tls", cfg.TLS != nil, "missing_tls_configuration",
+			"implicit TLS requires a TLS configuration")
+	}
+
+	v.CheckIntMin("max_message_size", cfg.MaxMessageSize, 0)
+	v.CheckIntMin("max_recipients", cfg.MaxRecipients, 0)
+	v.CheckIntMin("max_received_fields", cfg.MaxReceivedFields, 0)
+
+	if cfg.SPFPolicy != "" {
+		v.CheckStringValue("spf_policy", cfg.SPFPolicy, SPFPolicyValues)
+	}
+
+	if cfg.DMARCPolicy != "" {
+		v.CheckStringValue("dmarc_policy", cfg.DMARCPolicy, DMARCPolicyValues)
+	}
+
+	if cfg.DNSBLPolicy != "" {
+		v.CheckStringValue("dnsbl_policy", cfg.DNSBLPolicy, DNSBLPolicyValues)
+	}
+
+	v.CheckIntMin("greeting_delay", cfg.GreetingDelay, 0)
+	v.CheckIntMin("tarpit_delay", cfg.TarpitDelay, 0)
+	v.CheckIntMin("tarpit_threshold", cfg.TarpitThreshold, 0)
 }
 
 type Server struct {
@@ -44,6 +239,60 @@ type Server struct {
 }
 
 func NewServer(cfg ServerCfg) (*Server, error) {
+	if cfg.Mode == "" {
+		cfg.Mode = ServerModeMX
+	}
+
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = DefaultMaxMessageSize
+	}
+
+	if cfg.MaxRecipients == 0 {
+		cfg.MaxRecipients = DefaultMaxRecipients
+	}
+
+	if cfg.MaxReceivedFields == 0 {
+		cfg.MaxReceivedFields = DefaultMaxReceivedFields
+	}
+
+	if cfg.SPFPolicy == "" {
+		cfg.SPFPolicy = SPFPolicyRecord
+	}
+
+	if cfg.DMARCPolicy == "" {
+		cfg.DMARCPolicy = DMARCPolicyEnforce
+	}
+
+	if cfg.DNSBLPolicy == "" {
+		cfg.DNSBLPolicy = DNSBLPolicyGreeting
+	}
+
+	if cfg.TarpitThreshold == 0 {
+		cfg.TarpitThreshold = DefaultTarpitThreshold
+	}
+
+	if cfg.TLSConfig == nil && cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.ServerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.TLSConfig = tlsCfg
+	}
+
+	if cfg.ImplicitTLS && cfg.TLSConfig == nil {
+		return nil, fmt.Errorf("implicit TLS requires a TLS configuration")
+	}
+
+	if cfg.Mode == ServerModeMSA && cfg.Authenticator == nil {
+		return nil, fmt.Errorf("MSA mode requires an authenticator")
+	}
+
+	if cfg.Path != "" && cfg.Mode != ServerModeLMTP {
+		return nil, fmt.Errorf("UNIX domain sockets are only supported " +
+			"in LMTP mode")
+	}
+
 	s := Server{
 		Cfg: cfg,
 		Log: cfg.Log,
@@ -56,11 +305,23 @@ func NewServer(cfg ServerCfg) (*Server, error) {
 	}
 
 	s.extensions["8BITMIME"] = ""
+	s.extensions["DSN"] = ""
+	s.extensions["ENHANCEDSTATUSCODES"] = ""
+	s.extensions["SIZE"] = strconv.Itoa(cfg.MaxMessageSize)
+
+	// RFC 2033 5. Implementation requirements
+	if cfg.Mode == ServerModeLMTP {
+		s.extensions["PIPELINING"] = ""
+	}
 
 	return &s, nil
 }
 
 func (s *Server) Start() error {
+	if s.Cfg.Path != "" {
+		return s.listenUnix(s.Cfg.Path)
+	}
+
 	addrs, err := s.resolveHost()
 	if err != nil {
 		return err
@@ -90,6 +351,34 @@ func (s *Server) Start() error {
 	return nil
 }
 
+func (s *Server) listenUnix(path string) error {
+	// Sockets left behind by a previous process would prevent us from
+	// listening.
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return fmt.Errorf("%q exists and is not a socket", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("cannot delete %q: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %q: %w", path, err)
+	}
+
+	s.Log.Info("listening on %q", path)
+
+	s.listeners = append(s.listeners, listener)
+
+	s.wg.Add(1)
+	go s.listen(listener)
+
+	return nil
+}
+
 func (s *Server) resolveHost() ([]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -149,11 +438,16 @@ func (s *Server) listen(listener net.Listener) {
 }
 
 func (s *Server) handleConnection(conn net.Conn) error {
-	remoteAddr := conn.RemoteAddr().String()
+	// Clients connected to a UNIX domain socket do not have any address
+	addr := "local"
 
-	addr, _, err := net.SplitHostPort(remoteAddr)
-	if err != nil {
-		return fmt.Errorf("invalid remote address %q: %w", remoteAddr, err)
+	if remoteAddr := conn.RemoteAddr(); remoteAddr.Network() != "unix" {
+		host, _, err := net.SplitHostPort(remoteAddr.String())
+		if err != nil {
+			return fmt.Errorf("invalid remote address %q: %w", remoteAddr, err)
+		}
+
+		addr = host
 	}
 
 	s.Log.Debug(1, "accepting connection from %q", addr)
@@ -166,6 +460,8 @@ func (s *Server) handleConnection(conn net.Conn) error {
 		Server: s,
 		Log:    s.Log.Child("conn", logData),
 
+		clientAddress: net.ParseIP(addr),
+
 		conn: conn,
 	}
 
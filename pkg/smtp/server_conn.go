@@ -3,11 +3,23 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
+	"strings"
+	"time"
 
+	"github.com/galdor/emaild/pkg/dmarc"
+	"github.com/galdor/emaild/pkg/dnsbl"
+	"github.com/galdor/emaild/pkg/dsn"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/spf"
 	"github.com/galdor/emaild/pkg/utils"
 	"github.com/galdor/go-log"
 )
@@ -32,7 +44,27 @@ type ServerConn struct {
 	Server *Server
 	Log    *log.Logger
 
-	domain string // value sent by EHLO or HELO
+	domain        string // value sent by EHLO, HELO or LHLO
+	extended      bool   // true if the client sent EHLO or LHLO
+	clientAddress net.IP
+	clientHost    string // forward-confirmed reverse DNS name
+
+	tls            bool
+	identity       string // authenticated user
+	nbAuthFailures int
+
+	dnsblResult *dnsbl.Result
+	rejected    bool // true if the greeting was a 554 reply
+	greeted     bool // true once the 220 greeting has been sent
+	nbErrors    int  // number of error replies sent after the greeting
+
+	// Current transaction
+	reversePath            *imf.SpecificAddress
+	hasReversePath         bool // true once MAIL has been accepted
+	forwardPaths           []imf.SpecificAddress
+	dsnParameters          dsn.Parameters
+	recipientDSNParameters []dsn.RecipientParameters
+	spfResult              *spf.CheckResult
 
 	conn net.Conn
 	rbuf *bufio.Reader
@@ -78,6 +110,15 @@ func (c *ServerConn) main() {
 		}
 	}()
 
+	if c.Server.Cfg.ImplicitTLS {
+		c.startTLS()
+	}
+
+	// DNS lookups are performed here rather than when the connection is
+	// accepted so that slow servers do not delay other clients.
+	c.lookupClientHost()
+	c.checkDNSBL()
+
 	c.writeGreeting()
 
 	for {
@@ -92,11 +133,6 @@ func (c *ServerConn) main() {
 			return
 		}
 	}
-
-	select {
-	case <-c.Server.stopChan:
-		return
-	}
 }
 
 func (c *ServerConn) readLine() ([]byte, error) {
@@ -126,6 +162,13 @@ func (c *ServerConn) readRequest() (*LineReader, error) {
 }
 
 func (c *ServerConn) writeLine(code int, more bool, line string) {
+	// Rejected clients only receive error replies; they are not delayed since
+	// all they can do is to close the connection.
+	if code >= 400 && !more && c.greeted {
+		c.nbErrors++
+		c.tarpit()
+	}
+
 	c.wbuf.Reset()
 
 	fmt.Fprintf(&c.wbuf, "%d", code)
@@ -153,28 +196,206 @@ func (c *ServerConn) writeError(code int, format string, args ...any) {
 	c.writeLine(code, false, fmt.Sprintf(format, args...))
 }
 
+func (c *ServerConn) writeReply(code int, status, format string, args ...any) {
+	c.writeLine(code, false, status+" "+fmt.Sprintf(format, args...))
+}
+
+func (c *ServerConn) writeErrorReply(err error) {
+	var smtpErr *Error
+	if !errors.As(err, &smtpErr) {
+		smtpErr = NewError(451, "4.3.0", "temporary failure")
+	}
+
+	c.writeReply(smtpErr.Code, smtpErr.Status, "%s", smtpErr.Message)
+}
+
 func (c *ServerConn) writeGreeting() {
+	if c.rejected {
+		// RFC 5321 3.1. Session Initiation
+		c.writeReply(554, "5.7.1", "%s", c.dnsblRejectionMessage())
+		return
+	}
+
+	if c.detectEarlyTalker() {
+		c.Log.Info("data received before greeting")
+
+		c.rejected = true
+		c.writeReply(554, "5.5.1", "data received before greeting")
+		return
+	}
+
 	c.writeLine(220, false, c.Server.Cfg.PublicHost)
+	c.greeted = true
+}
+
+// detectEarlyTalker waits for the greeting delay and returns true if the
+// client sent data in the mean time. Legitimate clients must wait for the
+// greeting (RFC 5321 3.1.), while spam software often does not.
+func (c *ServerConn) detectEarlyTalker() bool {
+	delay := time.Duration(c.Server.Cfg.GreetingDelay) * time.Second
+	if delay == 0 {
+		return false
+	}
+
+	if err := c.conn.SetReadDeadline(time.Now().Add(delay)); err != nil {
+		panic(fmt.Errorf("cannot set read deadline: %w", err))
+	}
+
+	_, err := c.rbuf.Peek(1)
+
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		panic(fmt.Errorf("cannot reset read deadline: %w", err))
+	}
+
+	if err == nil {
+		return true
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		panic(NewExpectedError(err))
+	}
+
+	panic(fmt.Errorf("cannot read connection: %w", err))
+}
+
+// tarpit delays the current reply if the client has received too many error
+// replies, slowing down clients trying random recipients or commands.
+func (c *ServerConn) tarpit() {
+	// Authenticated users and LMTP clients are trusted
+	if c.identity != "" || c.Server.Cfg.Mode == ServerModeLMTP {
+		return
+	}
+
+	delay := time.Duration(c.Server.Cfg.TarpitDelay) * time.Second
+	n := c.nbErrors - c.Server.Cfg.TarpitThreshold
+
+	if delay == 0 || n <= 0 {
+		return
+	}
+
+	delay = min(delay*time.Duration(n), MaxTarpitDelay)
+
+	c.Log.Debug(1, "tarpitting client for %v after %d errors", delay,
+		c.nbErrors)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-c.Server.stopChan:
+		panic(NewExpectedError(net.ErrClosed))
+	}
+}
+
+func (c *ServerConn) checkDNSBL() {
+	// Submission clients often connect from dynamic addresses found in DNS
+	// block lists; they are authenticated instead. LMTP clients are trusted.
+	checker := c.Server.Cfg.DNSBLChecker
+	if checker == nil || c.Server.Cfg.Mode != ServerModeMX {
+		return
+	}
+
+	result := checker.Check(context.Background(), c.clientAddress)
+
+	for _, err := range result.Errors {
+		c.Log.Error("dnsbl check: %v", err)
+	}
+
+	c.Log.Debug(1, "dnsbl check: %v", result)
+
+	c.dnsblResult = result
+
+	if result.Listed && c.Server.Cfg.DNSBLPolicy == DNSBLPolicyGreeting {
+		c.rejected = true
+	}
+}
+
+func (c *ServerConn) dnsblRejectionMessage() string {
+	msg := fmt.Sprintf("client host [%s] blocked", c.clientAddress)
+
+	if match := c.dnsblResult.BlockMatch(); match != nil {
+		msg += " using " + match.Zone
+
+		if match.Reason != "" {
+			msg += "; " + match.Reason
+		}
+	}
+
+	return msg
 }
 
 func (c *ServerConn) processRequest(r *LineReader) error {
 	var fn func(*LineReader) error
 
-	switch r.Keyword {
+	keyword := strings.ToUpper(r.Keyword)
+
+	// RFC 5321 3.1. After a 554 greeting, the server must wait for the client
+	// to send QUIT and reply 503 to any other command.
+	if c.rejected && keyword != "QUIT" {
+		c.writeReply(503, "5.5.1", "no SMTP service available")
+		return nil
+	}
+
+	// RFC 5321 2.4. Commands are case-insensitive.
+	switch keyword {
 	case "EHLO":
 		fn = c.processEHLO
 	case "HELO":
 		fn = c.processHELO
+	case "LHLO":
+		fn = c.processLHLO
+	case "MAIL":
+		fn = c.processMAIL
+	case "RCPT":
+		fn = c.processRCPT
+	case "DATA":
+		fn = c.processDATA
 	case "RSET":
 		fn = c.processRSET
+	case "NOOP":
+		fn = c.processNOOP
+	case "VRFY":
+		fn = c.processVRFY
+	case "QUIT":
+		fn = c.processQUIT
+	case "STARTTLS":
+		fn = c.processSTARTTLS
+	case "AUTH":
+		fn = c.processAUTH
 	default:
-		return fmt.Errorf("unknown keyword %q", r.Keyword)
+		c.writeReply(500, "5.5.1", "unknown command")
+		return nil
 	}
 
 	return fn(r)
 }
 
 func (c *ServerConn) processEHLO(r *LineReader) error {
+	// RFC 2033 4.1. LHLO replaces both HELO and EHLO.
+	if c.Server.Cfg.Mode == ServerModeLMTP {
+		c.writeReply(500, "5.5.1", "unknown command")
+		return nil
+	}
+
+	return c.processExtendedHello(r)
+}
+
+// RFC 2033 4.1. The LHLO Command
+func (c *ServerConn) processLHLO(r *LineReader) error {
+	if c.Server.Cfg.Mode != ServerModeLMTP {
+		c.writeReply(500, "5.5.1", "unknown command")
+		return nil
+	}
+
+	return c.processExtendedHello(r)
+}
+
+func (c *ServerConn) processExtendedHello(r *LineReader) error {
 	domainData := r.ReadAll()
 
 	domain, err := ValidateDomain(domainData)
@@ -184,8 +405,9 @@ func (c *ServerConn) processEHLO(r *LineReader) error {
 	}
 
 	c.domain = domain
+	c.extended = true
 
-	extensions := c.Server.extensions
+	extensions := c.extensions()
 
 	c.writeLine(250, len(extensions) > 0, c.Server.Cfg.PublicHost)
 
@@ -206,7 +428,28 @@ func (c *ServerConn) processEHLO(r *LineReader) error {
 	return nil
 }
 
+// extensions returns the extensions announced in the EHLO reply, some of them
+// depending on the state of the connection.
+func (c *ServerConn) extensions() map[string]string {
+	extensions := maps.Clone(c.Server.extensions)
+
+	if c.Server.Cfg.TLSConfig != nil && !c.tls {
+		extensions["STARTTLS"] = ""
+	}
+
+	if c.Server.Cfg.Mode == ServerModeMSA && c.canAuthenticate() {
+		extensions["AUTH"] = strings.Join(sasl.Mechanisms, " ")
+	}
+
+	return extensions
+}
+
 func (c *ServerConn) processHELO(r *LineReader) error {
+	if c.Server.Cfg.Mode == ServerModeLMTP {
+		c.writeReply(500, "5.5.1", "unknown command")
+		return nil
+	}
+
 	domainData := r.ReadUntilWhitespace()
 
 	domain, err := ValidateDomain(domainData)
@@ -216,6 +459,7 @@ func (c *ServerConn) processHELO(r *LineReader) error {
 	}
 
 	c.domain = domain
+	c.extended = false
 
 	c.writeLine(250, false, c.Server.Cfg.PublicHost)
 
@@ -225,11 +469,735 @@ func (c *ServerConn) processHELO(r *LineReader) error {
 	return nil
 }
 
+func (c *ServerConn) processMAIL(r *LineReader) error {
+	if c.domain == "" {
+		c.writeReply(503, "5.5.1", "missing EHLO or HELO command")
+		return nil
+	}
+
+	if c.hasReversePath {
+		c.writeReply(503, "5.5.1", "nested MAIL command")
+		return nil
+	}
+
+	if c.Server.Cfg.Mode == ServerModeMSA && c.identity == "" {
+		// RFC 4954 6. Status Codes
+		c.writeReply(530, "5.7.0", "authentication required")
+		return nil
+	}
+
+	if !r.SkipStringCaseInsensitive("FROM:") {
+		c.writeReply(501, "5.5.4", "invalid MAIL command")
+		return nil
+	}
+
+	reversePath, params, err := ParsePath(r.ReadAll(), true)
+	if err != nil {
+		c.writeReply(501, "5.1.7", "invalid reverse-path: %v", err)
+		return nil
+	}
+
+	dsnParameters, err := dsn.ParseParameters(params)
+	if err != nil {
+		c.writeReply(501, "5.5.4", "%v", err)
+		return nil
+	}
+
+	if err := c.checkSPF(reversePath); err != nil {
+		c.writeErrorReply(err)
+		return nil
+	}
+
+	c.reversePath = reversePath
+	c.hasReversePath = true
+	c.dsnParameters = *dsnParameters
+
+	c.writeReply(250, "2.1.0", "OK")
+
+	return nil
+}
+
+func (c *ServerConn) checkSPF(reversePath *imf.SpecificAddress) error {
+	// SPF is about the relation between the client and the domain of the
+	// reverse-path, which is meaningless for submission and LMTP clients.
+	checker := c.Server.Cfg.SPFChecker
+	if checker == nil || c.Server.Cfg.Mode != ServerModeMX {
+		return nil
+	}
+
+	ctx := context.Background()
+	receiver := c.Server.Cfg.PublicHost
+
+	// RFC 7208 2.3. A fail result for the HELO identity is conclusive and
+	// saves the evaluation of the MAIL FROM identity. For the null
+	// reverse-path, the HELO identity is the only one available.
+	result := checker.CheckHELO(ctx, c.clientAddress, c.domain, receiver)
+	if result.Result != spf.ResultFail && reversePath != nil {
+		result = checker.CheckMailFrom(ctx, c.clientAddress, reversePath,
+			c.domain, receiver)
+	}
+
+	c.Log.Debug(1, "spf check (%s %s): %v", result.Query.Identity,
+		result.Domain, result)
+
+	c.spfResult = result
+
+	if result.Result == spf.ResultFail &&
+		c.Server.Cfg.SPFPolicy == SPFPolicyReject {
+		// RFC 7208 8.4. Fail
+		msg := result.Explanation
+		if msg == "" {
+			msg = fmt.Sprintf("SPF check failed for %s", result.Domain)
+		}
+
+		return NewError(550, "5.7.23", "%s", msg)
+	}
+
+	return nil
+}
+
+func (c *ServerConn) processRCPT(r *LineReader) error {
+	if !c.hasReversePath {
+		c.writeReply(503, "5.5.1", "missing MAIL command")
+		return nil
+	}
+
+	if !r.SkipStringCaseInsensitive("TO:") {
+		c.writeReply(501, "5.5.4", "invalid RCPT command")
+		return nil
+	}
+
+	forwardPath, params, err := ParsePath(r.ReadAll(), false)
+	if err != nil {
+		c.writeReply(501, "5.1.3", "invalid forward-path: %v", err)
+		return nil
+	}
+
+	dsnParameters, err := dsn.ParseRecipientParameters(params)
+	if err != nil {
+		c.writeReply(501, "5.5.4", "%v", err)
+		return nil
+	}
+
+	if result := c.dnsblResult; result != nil && result.Listed &&
+		c.Server.Cfg.DNSBLPolicy == DNSBLPolicyRCPT &&
+		!strings.EqualFold(forwardPath.LocalPart, "postmaster") {
+		c.writeReply(554, "5.7.1", "%s", c.dnsblRejectionMessage())
+		return nil
+	}
+
+	if len(c.forwardPaths) >= c.Server.Cfg.MaxRecipients {
+		// RFC 5321 4.5.3.1.10. Too many recipients
+		c.writeReply(452, "4.5.3", "too many recipients")
+		return nil
+	}
+
+	if handler := c.Server.Cfg.RecipientHandler; handler != nil {
+		if err := handler(c.identity, *forwardPath); err != nil {
+			c.Log.Debug(1, "recipient %q rejected: %v", forwardPath.String(),
+				err)
+			c.writeErrorReply(err)
+			return nil
+		}
+	}
+
+	if !c.checkGreylist(forwardPath) {
+		c.writeReply(451, "4.7.1", "greylisted, please try again later")
+		return nil
+	}
+
+	c.forwardPaths = append(c.forwardPaths, *forwardPath)
+	c.recipientDSNParameters = append(c.recipientDSNParameters,
+		*dsnParameters)
+
+	c.writeReply(250, "2.1.5", "OK")
+
+	return nil
+}
+
+func (c *ServerConn) checkGreylist(forwardPath *imf.SpecificAddress) bool {
+	list := c.Server.Cfg.Greylist
+	if list == nil || c.Server.Cfg.Mode != ServerModeMX {
+		return true
+	}
+
+	// Clients found in DNS allow lists are trusted
+	if result := c.dnsblResult; result != nil && result.Score < 0 {
+		return true
+	}
+
+	var sender string
+	if c.reversePath != nil {
+		sender = c.reversePath.String()
+	}
+
+	accepted := list.Check(c.clientAddress, sender, forwardPath.String(),
+		time.Now())
+	if !accepted {
+		c.Log.Debug(1, "greylisting %s for %q -> %q", c.clientAddress, sender,
+			forwardPath.String())
+	}
+
+	return accepted
+}
+
+func (c *ServerConn) processDATA(r *LineReader) error {
+	if !c.hasReversePath {
+		c.writeReply(503, "5.5.1", "missing MAIL command")
+		return nil
+	}
+
+	if len(c.forwardPaths) == 0 {
+		c.writeReply(554, "5.5.1", "no valid recipient")
+		return nil
+	}
+
+	c.writeLine(354, false, "end data with <CR><LF>.<CR><LF>")
+
+	data, err := c.readData()
+	if err != nil {
+		return err
+	}
+
+	// RFC 5321 4.1.4. Whatever the outcome, the transaction is over once the
+	// data have been read.
+	defer c.reset()
+
+	if data == nil {
+		c.writeDataReplies(NewError(552, "5.3.4", "message too big"))
+		return nil
+	}
+
+	decoder := imf.NewMessageDecoder()
+
+	msg, err := decoder.DecodeAll(data)
+	if err != nil {
+		c.writeDataReplies(NewError(554, "5.6.0", "invalid message: %v", err))
+		return nil
+	}
+
+	if err := c.checkLoop(msg); err != nil {
+		c.Log.Error("%v", err)
+		c.writeDataReplies(err)
+		return nil
+	}
+
+	id, err := generateTransactionId()
+	if err != nil {
+		return err
+	}
+
+	tx := Transaction{
+		Id: id,
+
+		PublicHost:    c.Server.Cfg.PublicHost,
+		Domain:        c.domain,
+		ClientAddress: c.clientAddress,
+		ClientHost:    c.clientHost,
+		Identity:      c.identity,
+
+		ReversePath:  c.reversePath,
+		ForwardPaths: c.forwardPaths,
+
+		DSNParameters:          c.dsnParameters,
+		RecipientDSNParameters: c.recipientDSNParameters,
+
+		LMTP: c.Server.Cfg.Mode == ServerModeLMTP,
+
+		DNSBLResult: c.dnsblResult,
+		SPFResult:   c.spfResult,
+
+		Message: msg,
+	}
+
+	// Signatures are verified on the header as it was received: DKIM and ARC
+	// signatures frequently cover Received fields, so our own fields must
+	// only be added once verification is done. The trace field is added
+	// first so that authentication fields end up above it (RFC 8601 5.).
+	var authFields []*imf.Field
+
+	if c.Server.Cfg.Mode == ServerModeMX {
+		authFields = c.authenticateMessage(&tx)
+	}
+
+	msg.Header = append([]*imf.Field{c.receivedField(&tx, time.Now())},
+		msg.Header...)
+	msg.Header = append(authFields, msg.Header...)
+
+	switch c.Server.Cfg.Mode {
+	case ServerModeMX:
+		if result := tx.DMARCResult; result != nil &&
+			c.Server.Cfg.DMARCPolicy == DMARCPolicyEnforce {
+			switch result.Disposition {
+			case dmarc.PolicyReject:
+				// RFC 7489 10.3. Rejecting Messages
+				c.writeReply(550, "5.7.1", "message rejected by the DMARC "+
+					"policy of %s", result.PolicyDomain)
+				return nil
+
+			case dmarc.PolicyQuarantine:
+				tx.Quarantine = true
+			}
+		}
+
+	case ServerModeMSA:
+		if err := c.prepareSubmission(&tx); err != nil {
+			c.Log.Error("cannot accept submission: %v", err)
+			c.writeErrorReply(err)
+			return nil
+		}
+	}
+
+	err = c.handleMessage(&tx)
+	if err != nil {
+		c.Log.Error("cannot handle message %s: %v", tx.Id, err)
+	} else {
+		c.Log.Info("message %s accepted", tx.Id)
+	}
+
+	c.writeDataReplies(err)
+
+	return nil
+}
+
+// writeDataReplies sends the reply to the content of a message. In LMTP mode,
+// there is one reply for each recipient accepted by RCPT, in the same order
+// (RFC 2033 4.2.).
+func (c *ServerConn) writeDataReplies(err error) {
+	var rcptErrs RecipientErrors
+	errors.As(err, &rcptErrs)
+
+	if c.Server.Cfg.Mode != ServerModeLMTP {
+		if rcptErrs != nil {
+			err = rcptErrs.First()
+		}
+
+		if err != nil {
+			c.writeErrorReply(err)
+		} else {
+			c.writeReply(250, "2.0.0", "OK")
+		}
+
+		return
+	}
+
+	for i, forwardPath := range c.forwardPaths {
+		rcptErr := err
+		if rcptErrs != nil {
+			rcptErr = nil
+			if i < len(rcptErrs) {
+				rcptErr = rcptErrs[i]
+			}
+		}
+
+		if rcptErr != nil {
+			c.writeErrorReply(rcptErr)
+		} else {
+			c.writeReply(250, "2.0.0", "%s OK", FormatPath(&forwardPath))
+		}
+	}
+}
+
+func (c *ServerConn) readData() ([]byte, error) {
+	// RFC 5321 4.5.2. Transparency. If the message is too large, we keep
+	// reading until the end of the data but return a nil buffer.
+
+	maxSize := c.Server.Cfg.MaxMessageSize
+
+	var buf bytes.Buffer
+	tooLarge := false
+
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read data: %w", err)
+		}
+
+		if len(line) == 1 && line[0] == '.' {
+			break
+		}
+
+		if len(line) > 0 && line[0] == '.' {
+			line = line[1:]
+		}
+
+		if tooLarge {
+			continue
+		}
+
+		if buf.Len()+len(line)+2 > maxSize {
+			tooLarge = true
+			buf.Reset()
+			continue
+		}
+
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+
+	if tooLarge {
+		return nil, nil
+	}
+
+	return buf.Bytes(), nil
+}
+
+// authenticateMessage runs authentication checks on a message and returns
+// the fields containing their results, which must be added on top of the
+// header.
+func (c *ServerConn) authenticateMessage(tx *Transaction) []*imf.Field {
+	authservId := c.Server.Cfg.PublicHost
+
+	var fields []*imf.Field
+	var results []*imf.AuthenticationResult
+
+	if verifier := c.Server.Cfg.DKIMVerifier; verifier != nil {
+		tx.DKIMResults = verifier.Verify(context.Background(), tx.Message)
+
+		if len(tx.DKIMResults) == 0 {
+			results = append(results, &imf.AuthenticationResult{
+				Method: "dkim",
+				Result: "none",
+			})
+		}
+
+		for _, result := range tx.DKIMResults {
+			c.Log.Debug(1, "dkim verification: %v", result)
+			results = append(results, result.AuthenticationResult())
+		}
+	}
+
+	if verifier := c.Server.Cfg.ARCVerifier; verifier != nil {
+		tx.ARCResult = verifier.Validate(context.Background(), tx.Message)
+		c.Log.Debug(1, "arc validation: %v", tx.ARCResult)
+
+		results = append(results, tx.ARCResult.AuthenticationResult())
+	}
+
+	// RFC 8601 5. Fields using our authserv-id which were added before the
+	// message reached us are forged and must be removed.
+	removeAuthenticationResultsFields(tx.Message, authservId)
+
+	if spfResult := tx.SPFResult; spfResult != nil {
+		field := imf.Field{
+			Name:  "Received-SPF",
+			Value: utils.Ref(imf.OptionalFieldValue(spfResult.ReceivedSPF())),
+		}
+
+		fields = append(fields, &field)
+
+		results = append([]*imf.AuthenticationResult{
+			spfResult.AuthenticationResult()}, results...)
+	}
+
+	if evaluator := c.Server.Cfg.DMARCEvaluator; evaluator != nil {
+		result := evaluator.Evaluate(context.Background(), tx.Message,
+			tx.SPFResult, tx.DKIMResults)
+		c.Log.Debug(1, "dmarc evaluation: %v", result)
+
+		tx.DMARCResult = result
+		results = append(results, result.AuthenticationResult())
+
+		if aggregator := c.Server.Cfg.DMARCAggregator; aggregator != nil {
+			var envelopeFrom string
+			if tx.SPFResult != nil {
+				envelopeFrom = tx.SPFResult.Domain
+			} else if tx.ReversePath != nil {
+				envelopeFrom = string(tx.ReversePath.Domain)
+			}
+
+			aggregator.Add(result, c.clientAddress, envelopeFrom)
+		}
+	}
+
+	if len(results) == 0 {
+		return fields
+	}
+
+	value := imf.AuthenticationResultsFieldValue{
+		AuthservId: authservId,
+		Results:    results,
+	}
+
+	field := imf.Field{
+		Name:  "Authentication-Results",
+		Value: &value,
+	}
+
+	return append([]*imf.Field{&field}, fields...)
+}
+
+func removeAuthenticationResultsFields(msg *imf.Message, authservId string) {
+	var header []*imf.Field
+
+	for _, field := range msg.Header {
+		if strings.EqualFold(field.Name, "Authentication-Results") &&
+			strings.EqualFold(fieldAuthservId(field), authservId) {
+			continue
+		}
+
+		header = append(header, field)
+	}
+
+	msg.Header = header
+}
+
+// fieldAuthservId returns the authserv-id of an Authentication-Results field.
+// Forged fields do not have to be valid: for fields we failed to parse, the
+// authserv-id is extracted from the raw value so that they are removed as
+// well.
+func fieldAuthservId(field *imf.Field) string {
+	if !field.HasError() {
+		value, ok := field.Value.(*imf.AuthenticationResultsFieldValue)
+		if ok {
+			return value.AuthservId
+		}
+	}
+
+	_, value, found := strings.Cut(field.Raw, ":")
+	if !found {
+		return ""
+	}
+
+	value, _, _ = strings.Cut(value, ";")
+
+	// The authserv-id can be surrounded by comments and followed by a
+	// version number (RFC 8601 2.2.).
+	var buf strings.Builder
+
+	depth := 0
+	for _, c := range value {
+		switch {
+		case c == '(':
+			depth++
+			buf.WriteByte(' ')
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			buf.WriteRune(c)
+		}
+	}
+
+	words := strings.Fields(buf.String())
+	if len(words) == 0 {
+		return ""
+	}
+
+	return words[0]
+}
+
+func (c *ServerConn) handleMessage(tx *Transaction) error {
+	handler := c.Server.Cfg.MessageHandler
+	if handler == nil {
+		return NewError(554, "5.3.2", "message delivery not available")
+	}
+
+	return handler(tx)
+}
+
 func (c *ServerConn) processRSET(r *LineReader) error {
 	c.reset()
+
+	c.writeReply(250, "2.0.0", "OK")
+
 	return nil
 }
 
+func (c *ServerConn) processNOOP(r *LineReader) error {
+	c.writeReply(250, "2.0.0", "OK")
+	return nil
+}
+
+func (c *ServerConn) processVRFY(r *LineReader) error {
+	// RFC 5321 3.5.3. We do not disclose whether addresses exist or not.
+	c.writeReply(252, "2.5.0", "cannot verify user")
+	return nil
+}
+
+func (c *ServerConn) processQUIT(r *LineReader) error {
+	c.writeReply(221, "2.0.0", "closing connection")
+	panic(NewExpectedError(errors.New("connection closed by client")))
+}
+
+// RFC 3207 4. The STARTTLS Keyword
+func (c *ServerConn) processSTARTTLS(r *LineReader) error {
+	if c.Server.Cfg.TLSConfig == nil {
+		c.writeReply(502, "5.5.1", "STARTTLS not available")
+		return nil
+	}
+
+	if c.tls {
+		c.writeReply(503, "5.5.1", "TLS already active")
+		return nil
+	}
+
+	if !r.Empty() {
+		c.writeReply(501, "5.5.4", "invalid STARTTLS command")
+		return nil
+	}
+
+	// Data sent by the client after the command must not be processed once
+	// TLS is active.
+	if c.rbuf.Buffered() > 0 {
+		c.writeReply(503, "5.5.1", "unexpected data after STARTTLS")
+		return nil
+	}
+
+	c.writeReply(220, "2.0.0", "ready to start TLS")
+
+	c.startTLS()
+
+	// RFC 3207 4.2. The server must discard any knowledge obtained from the
+	// client before the TLS negotiation.
+	c.domain = ""
+	c.extended = false
+	c.identity = ""
+	c.reset()
+
+	return nil
+}
+
+func (c *ServerConn) startTLS() {
+	tlsConn := tls.Server(c.conn, c.Server.Cfg.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Log.Error("cannot establish TLS connection: %v", err)
+		panic(NewExpectedError(err))
+	}
+
+	c.conn = tlsConn
+	c.rbuf = bufio.NewReader(c.conn)
+	c.tls = true
+}
+
+func (c *ServerConn) canAuthenticate() bool {
+	return c.tls || c.Server.Cfg.AllowInsecureAuthentication
+}
+
+// RFC 4954 4. The AUTH Command
+func (c *ServerConn) processAUTH(r *LineReader) error {
+	if c.Server.Cfg.Mode != ServerModeMSA {
+		c.writeReply(502, "5.5.1", "authentication not available")
+		return nil
+	}
+
+	if c.domain == "" {
+		c.writeReply(503, "5.5.1", "missing EHLO command")
+		return nil
+	}
+
+	if c.identity != "" {
+		c.writeReply(503, "5.5.1", "already authenticated")
+		return nil
+	}
+
+	if c.hasReversePath {
+		c.writeReply(503, "5.5.1", "AUTH not allowed during a mail transaction")
+		return nil
+	}
+
+	if !c.canAuthenticate() {
+		c.writeReply(538, "5.7.11", "encryption required for authentication")
+		return nil
+	}
+
+	args := strings.Fields(string(r.ReadAll()))
+	if len(args) < 1 || len(args) > 2 {
+		c.writeReply(501, "5.5.4", "invalid AUTH command")
+		return nil
+	}
+
+	mechanism, err := sasl.NewServerMechanism(strings.ToUpper(args[0]),
+		c.Server.Cfg.Authenticator)
+	if err != nil {
+		c.writeReply(504, "5.5.4", "unsupported mechanism %q", args[0])
+		return nil
+	}
+
+	var response []byte
+
+	// "=" is an empty initial response
+	if len(args) > 1 {
+		if response, err = decodeSASLResponse(args[1]); err != nil {
+			c.writeReply(501, "5.5.2", "invalid response")
+			return nil
+		}
+	}
+
+	for {
+		challenge, done, err := mechanism.Next(response)
+		if err != nil {
+			c.authenticationFailure(err)
+			return nil
+		}
+
+		if done {
+			break
+		}
+
+		c.writeLine(334, false, base64.StdEncoding.EncodeToString(challenge))
+
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+
+		if string(line) == "*" {
+			c.writeReply(501, "5.0.0", "authentication aborted")
+			return nil
+		}
+
+		if response, err = decodeSASLResponse(string(line)); err != nil {
+			c.writeReply(501, "5.5.2", "invalid response")
+			return nil
+		}
+	}
+
+	c.identity = mechanism.Identity()
+
+	c.Log.Info("user %q authenticated", c.identity)
+
+	c.writeReply(235, "2.7.0", "authentication successful")
+
+	return nil
+}
+
+func decodeSASLResponse(s string) ([]byte, error) {
+	if s == "=" {
+		return []byte{}, nil
+	}
+
+	response, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if response == nil {
+		response = []byte{}
+	}
+
+	return response, nil
+}
+
+func (c *ServerConn) authenticationFailure(err error) {
+	if !errors.Is(err, sasl.ErrAuthenticationFailed) {
+		c.Log.Error("authentication error: %v", err)
+	}
+
+	c.nbAuthFailures++
+
+	if c.nbAuthFailures >= MaxAuthenticationFailures {
+		c.writeReply(421, "4.7.0", "too many authentication failures")
+		panic(NewExpectedError(err))
+	}
+
+	c.writeReply(535, "5.7.8", "authentication credentials invalid")
+}
+
 func (c *ServerConn) reset() {
-	// TODO
+	c.reversePath = nil
+	c.hasReversePath = false
+	c.forwardPaths = nil
+	c.dsnParameters = dsn.Parameters{}
+	c.recipientDSNParameters = nil
+	c.spfResult = nil
 }
@@ -0,0 +1,954 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/dnsbl"
+	"github.com/galdor/emaild/pkg/dsn"
+	"github.com/galdor/emaild/pkg/greylist"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/sasl"
+	"github.com/galdor/emaild/pkg/spf"
+	"github.com/galdor/emaild/pkg/testutils"
+	"github.com/galdor/go-log"
+)
+
+func startTestServer(t *testing.T, cfg ServerCfg) *Server {
+	cfg.Log = log.DefaultLogger("test")
+	cfg.Host = "127.0.0.1"
+	cfg.PublicHost = "mx.example.com"
+
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("cannot create server: %v", err)
+	}
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+
+	t.Cleanup(server.Stop)
+
+	return server
+}
+
+func newTestClient(t *testing.T, server *Server) *Client {
+	address := server.listeners[0].Addr().String()
+
+	client, err := NewClient(address, ClientCfg{Domain: "client.example.com"})
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+
+	t.Cleanup(client.Close)
+
+	return client
+}
+
+func TestServerTransaction(t *testing.T) {
+	txChan := make(chan *Transaction, 1)
+
+	server := startTestServer(t, ServerCfg{
+		MessageHandler: func(tx *Transaction) error {
+			txChan <- tx
+			return nil
+		},
+		DKIMVerifier: dkim.NewVerifier(dns.NewFakeResolver()),
+	})
+
+	client := newTestClient(t, server)
+
+	if !client.HasExtension("ENHANCEDSTATUSCODES") {
+		t.Errorf("missing ENHANCEDSTATUSCODES extension")
+	}
+
+	reversePath := imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+	if err := client.Mail(&reversePath); err != nil {
+		t.Fatalf("cannot send MAIL command: %v", err)
+	}
+
+	forwardPath := imf.SpecificAddress{LocalPart: "bob", Domain: "example.com"}
+	if err := client.Rcpt(forwardPath); err != nil {
+		t.Fatalf("cannot send RCPT command: %v", err)
+	}
+
+	data := "From: alice@example.org\r\n" +
+		"Subject: test\r\n" +
+		"\r\n" +
+		".leading period\r\n"
+
+	if err := client.Data([]byte(data)); err != nil {
+		t.Fatalf("cannot send DATA command: %v", err)
+	}
+
+	tx := <-txChan
+
+	if tx.Domain != "client.example.com" {
+		t.Errorf("domain is %q", tx.Domain)
+	}
+
+	if tx.ReversePath == nil || *tx.ReversePath != reversePath {
+		t.Errorf("reverse-path is %v", tx.ReversePath)
+	}
+
+	if len(tx.ForwardPaths) != 1 || tx.ForwardPaths[0] != forwardPath {
+		t.Errorf("forward-paths are %v", tx.ForwardPaths)
+	}
+
+	if body := string(tx.Message.Body); body != ".leading period\r\n" {
+		t.Errorf("body is %q", body)
+	}
+
+	field := tx.Message.Header[0]
+	if field.Name != "Authentication-Results" {
+		t.Errorf("first field is %q instead of Authentication-Results",
+			field.Name)
+	} else {
+		value := field.Value.(*imf.AuthenticationResultsFieldValue).String()
+		if value != "mx.example.com; dkim=none" {
+			t.Errorf("authentication results are %q", value)
+		}
+	}
+
+	if err := client.Quit(); err != nil {
+		t.Errorf("cannot send QUIT command: %v", err)
+	}
+}
+
+func TestServerOverSignedMessage(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	resolver := dns.NewFakeResolver()
+	resolver.TXT["test._domainkey.example.org"] = []string{
+		"v=DKIM1; k=ed25519; p=" +
+			base64.StdEncoding.EncodeToString(publicKey),
+	}
+
+	txChan := make(chan *Transaction, 1)
+
+	server := startTestServer(t, ServerCfg{
+		MessageHandler: func(tx *Transaction) error {
+			txChan <- tx
+			return nil
+		},
+		DKIMVerifier: dkim.NewVerifier(resolver),
+	})
+
+	// Signing Received one more time than it appears in the header protects
+	// against the addition of Received fields by anyone but us.
+	msgData := "Received: from a.example.org by b.example.org; " +
+		"Mon, 1 Jul 2024 12:00:00 +0000\r\n" +
+		"From: alice@example.org\r\n" +
+		"Subject: test\r\n" +
+		"\r\n" +
+		"Hello.\r\n"
+
+	msg, err := imf.NewMessageDecoder().DecodeAll([]byte(msgData))
+	if err != nil {
+		t.Fatalf("cannot decode message: %v", err)
+	}
+
+	sd := dkim.SigningDomain{
+		Domain:   "example.org",
+		Selector: "test",
+		Key: &dkim.PrivateKey{
+			Algorithm: dkim.AlgorithmEd25519SHA256,
+			Signer:    privateKey,
+		},
+		HeaderCanon:  dkim.CanonicalizationRelaxed,
+		BodyCanon:    dkim.CanonicalizationRelaxed,
+		SignedFields: []string{"From", "Subject", "Received", "Received"},
+	}
+
+	field, err := sd.Sign(msg, time.Now())
+	if err != nil {
+		t.Fatalf("cannot sign message: %v", err)
+	}
+
+	data := field.Raw + "\r\n" + msgData
+
+	client := newTestClient(t, server)
+
+	reversePath := imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+	if err := client.Mail(&reversePath); err != nil {
+		t.Fatalf("cannot send MAIL command: %v", err)
+	}
+
+	forwardPath := imf.SpecificAddress{LocalPart: "bob", Domain: "example.com"}
+	if err := client.Rcpt(forwardPath); err != nil {
+		t.Fatalf("cannot send RCPT command: %v", err)
+	}
+
+	if err := client.Data([]byte(data)); err != nil {
+		t.Fatalf("cannot send DATA command: %v", err)
+	}
+
+	tx := <-txChan
+
+	if len(tx.DKIMResults) != 1 || tx.DKIMResults[0].Status != dkim.StatusPass {
+		t.Errorf("dkim results are %v", tx.DKIMResults)
+	}
+}
+
+func TestRemoveAuthenticationResultsFields(t *testing.T) {
+	data := "Authentication-Results: mx.example.com; dkim=pass " +
+		"header.d=bank.example (x\r\n" +
+		"Authentication-Results: (comment) MX.example.com 1; spf=\r\n" +
+		"Authentication-Results: mx.example.com;;;\r\n" +
+		"Authentication-Results: mx.example.com; spf=pass " +
+		"smtp.mailfrom=example.org\r\n" +
+		"Authentication-Results: mx.example.net; spf=pass " +
+		"smtp.mailfrom=example.org\r\n" +
+		"Authentication-Results: mx.example.net; dkim=pass (x\r\n" +
+		"From: alice@example.org\r\n" +
+		"\r\n" +
+		"Hello.\r\n"
+
+	msg, err := imf.NewMessageDecoder().DecodeAll([]byte(data))
+	if err != nil {
+		t.Fatalf("cannot decode message: %v", err)
+	}
+
+	if !msg.Header[0].HasError() {
+		t.Fatalf("forged field should not be valid")
+	}
+
+	removeAuthenticationResultsFields(msg, "mx.example.com")
+
+	var ids []string
+	for _, field := range msg.Header {
+		if field.Name == "Authentication-Results" {
+			ids = append(ids, fieldAuthservId(field))
+		}
+	}
+
+	if len(ids) != 2 || ids[0] != "mx.example.net" ||
+		ids[1] != "mx.example.net" {
+		t.Errorf("remaining authserv-ids are %q", ids)
+	}
+}
+
+func TestServerInvalidSequence(t *testing.T) {
+	server := startTestServer(t, ServerCfg{})
+	client := newTestClient(t, server)
+
+	reply, err := client.Command("RCPT TO:<bob@example.com>")
+	if err != nil {
+		t.Fatalf("cannot send RCPT command: %v", err)
+	}
+
+	if reply.Code != 503 || !strings.HasPrefix(reply.Lines[0], "5.5.1") {
+		t.Errorf("unexpected reply %v", reply)
+	}
+}
+
+func TestServerDSNParameters(t *testing.T) {
+	txChan := make(chan *Transaction, 1)
+
+	server := startTestServer(t, ServerCfg{
+		MessageHandler: func(tx *Transaction) error {
+			txChan <- tx
+			return nil
+		},
+	})
+
+	client := newTestClient(t, server)
+
+	if !client.HasExtension("DSN") {
+		t.Errorf("missing DSN extension")
+	}
+
+	for _, test := range []struct {
+		command string
+		code    int
+	}{
+		{"MAIL FROM:<alice@example.org> RET=BODY", 501},
+		{"MAIL FROM:<alice@example.org> RET=HDRS ENVID=42", 250},
+		{"RCPT TO:<bob@example.com> NOTIFY=NEVER,FAILURE", 501},
+		{"RCPT TO:<bob@example.com> NOTIFY=FAILURE,DELAY", 250},
+		{"RCPT TO:<carol@example.com> ORCPT=rfc822;c@example.com", 250},
+	} {
+		reply, err := client.Command("%s", test.command)
+		if err != nil {
+			t.Fatalf("cannot send command: %v", err)
+		}
+
+		if reply.Code != test.code {
+			t.Errorf("unexpected reply %v to %q", reply, test.command)
+		}
+	}
+
+	if err := client.Data([]byte("Subject: test\r\n\r\nHello.\r\n")); err != nil {
+		t.Fatalf("cannot send DATA command: %v", err)
+	}
+
+	tx := <-txChan
+
+	params := dsn.Parameters{ReturnType: dsn.ReturnHeaders, EnvelopeId: "42"}
+	if tx.DSNParameters != params {
+		t.Errorf("DSN parameters are %#v", tx.DSNParameters)
+	}
+
+	if rps := tx.RecipientDSNParameters; len(rps) != 2 ||
+		len(rps[0].Notify) != 2 || rps[0].OriginalRecipient != nil ||
+		len(rps[1].Notify) != 0 || rps[1].OriginalRecipient == nil ||
+		rps[1].OriginalRecipient.String() != "c@example.com" {
+		t.Errorf("recipient DSN parameters are %#v", rps)
+	}
+}
+
+func TestServerSPF(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+	resolver.TXT["example.org"] = []string{"v=spf1 -all"}
+	resolver.TXT["example.net"] = []string{"v=spf1 ip4:127.0.0.0/8 -all"}
+
+	tests := []struct {
+		policy      SPFPolicy
+		domain      imf.Domain
+		code        int
+		spfResult   spf.Result
+		receivedSPF string
+	}{
+		{SPFPolicyRecord, "example.net", 250, spf.ResultPass,
+			"pass (mx.example.com: domain of alice@example.net designates " +
+				"127.0.0.1 as permitted sender) client-ip=127.0.0.1; " +
+				"envelope-from=alice@example.net; helo=client.example.com; " +
+				"mechanism=ip4:127.0.0.0/8; identity=mailfrom; " +
+				"receiver=mx.example.com;"},
+		{SPFPolicyRecord, "example.org", 250, spf.ResultFail, ""},
+		{SPFPolicyReject, "example.org", 550, "", ""},
+	}
+
+	for _, test := range tests {
+		txChan := make(chan *Transaction, 1)
+
+		server := startTestServer(t, ServerCfg{
+			MessageHandler: func(tx *Transaction) error {
+				txChan <- tx
+				return nil
+			},
+			SPFChecker: spf.NewChecker(resolver),
+			SPFPolicy:  test.policy,
+		})
+
+		client := newTestClient(t, server)
+
+		reply, err := client.Command("MAIL FROM:<alice@%s>", test.domain)
+		if err != nil {
+			t.Fatalf("cannot send MAIL command: %v", err)
+		}
+
+		if reply.Code != test.code {
+			t.Errorf("%s %s: MAIL reply is %v", test.policy, test.domain, reply)
+			continue
+		}
+
+		if test.code != 250 {
+			continue
+		}
+
+		forwardPath := imf.SpecificAddress{LocalPart: "bob", Domain: "example.com"}
+		if err := client.Rcpt(forwardPath); err != nil {
+			t.Fatalf("cannot send RCPT command: %v", err)
+		}
+
+		data := "From: alice@" + string(test.domain) + "\r\n\r\nHello.\r\n"
+		if err := client.Data([]byte(data)); err != nil {
+			t.Fatalf("cannot send DATA command: %v", err)
+		}
+
+		tx := <-txChan
+
+		if tx.SPFResult == nil || tx.SPFResult.Result != test.spfResult {
+			t.Errorf("%s %s: spf result is %v but should be %q",
+				test.policy, test.domain, tx.SPFResult, test.spfResult)
+		}
+
+		field := tx.Message.Header[1]
+		if field.Name != "Received-SPF" {
+			t.Errorf("second field is %q instead of Received-SPF", field.Name)
+		} else if test.receivedSPF != "" {
+			value := string(*field.Value.(*imf.OptionalFieldValue))
+			if value != test.receivedSPF {
+				t.Errorf("Received-SPF is %q but should be %q",
+					value, test.receivedSPF)
+			}
+		}
+	}
+}
+
+func TestServerDNSBL(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+	resolver.IP["1.0.0.127.bl.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+	resolver.TXT["1.0.0.127.bl.example.com"] = []string{"test entry"}
+
+	checker := dnsbl.NewChecker(dnsbl.Cfg{
+		Lists: []*dnsbl.ListCfg{{Zone: "bl.example.com"}},
+	}, resolver)
+
+	// Rejection at greeting time
+	server := startTestServer(t, ServerCfg{
+		DNSBLChecker: checker,
+		DNSBLPolicy:  DNSBLPolicyGreeting,
+	})
+
+	address := server.listeners[0].Addr().String()
+
+	_, err := NewClient(address, ClientCfg{Domain: "client.example.com"})
+
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Reply.Code != 554 {
+		t.Errorf("connection returned %v instead of a 554 greeting", err)
+	}
+
+	// Rejection at RCPT time
+	server = startTestServer(t, ServerCfg{
+		DNSBLChecker: checker,
+		DNSBLPolicy:  DNSBLPolicyRCPT,
+	})
+
+	client := newTestClient(t, server)
+
+	reversePath := imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+	if err := client.Mail(&reversePath); err != nil {
+		t.Fatalf("cannot send MAIL command: %v", err)
+	}
+
+	tests := []struct {
+		mailbox string
+		code    int
+	}{
+		{"bob@example.com", 554},
+		{"postmaster@example.com", 250},
+	}
+
+	for _, test := range tests {
+		reply, err := client.Command("RCPT TO:<%s>", test.mailbox)
+		if err != nil {
+			t.Fatalf("cannot send RCPT command: %v", err)
+		}
+
+		if reply.Code != test.code {
+			t.Errorf("RCPT reply for %s is %v but should have code %d",
+				test.mailbox, reply, test.code)
+		}
+	}
+}
+
+func TestServerGreylisting(t *testing.T) {
+	list, err := greylist.NewGreylist(greylist.Cfg{
+		Log:  log.DefaultLogger("test"),
+		Path: path.Join(t.TempDir(), "greylist.json"),
+	})
+	if err != nil {
+		t.Fatalf("cannot create greylist: %v", err)
+	}
+
+	// First attempt for carol@example.com ten minutes ago
+	list.Check(net.ParseIP("127.0.0.1"), "alice@example.org",
+		"carol@example.com", time.Now().Add(-10*time.Minute))
+
+	server := startTestServer(t, ServerCfg{
+		Greylist: list,
+	})
+
+	client := newTestClient(t, server)
+
+	reversePath := imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+	if err := client.Mail(&reversePath); err != nil {
+		t.Fatalf("cannot send MAIL command: %v", err)
+	}
+
+	tests := []struct {
+		mailbox string
+		code    int
+	}{
+		{"bob@example.com", 451},
+		{"bob@example.com", 451},
+		{"carol@example.com", 250},
+	}
+
+	for _, test := range tests {
+		reply, err := client.Command("RCPT TO:<%s>", test.mailbox)
+		if err != nil {
+			t.Fatalf("cannot send RCPT command: %v", err)
+		}
+
+		if reply.Code != test.code {
+			t.Errorf("RCPT reply for %s is %v but should have code %d",
+				test.mailbox, reply, test.code)
+		}
+	}
+}
+
+func TestServerEarlyTalker(t *testing.T) {
+	server := startTestServer(t, ServerCfg{
+		GreetingDelay:   1,
+		TarpitDelay:     1,
+		TarpitThreshold: 1,
+	})
+
+	address := server.listeners[0].Addr().String()
+
+	// Client sending a command before the greeting
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("cannot connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("EHLO client.example.com\r\n")); err != nil {
+		t.Fatalf("cannot write command: %v", err)
+	}
+
+	rbuf := bufio.NewReader(conn)
+
+	greeting, err := rbuf.ReadString('\n')
+	if err != nil {
+		t.Fatalf("cannot read greeting: %v", err)
+	}
+
+	if !strings.HasPrefix(greeting, "554 ") {
+		t.Errorf("greeting is %q instead of a 554 reply", greeting)
+	}
+
+	// Rejected clients are not tarpitted: the reply to EHLO and the replies
+	// to the next commands are sent immediately.
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			if _, err := conn.Write([]byte("NOOP\r\n")); err != nil {
+				t.Fatalf("cannot write command: %v", err)
+			}
+		}
+
+		reply, err := rbuf.ReadString('\n')
+		if err != nil {
+			t.Fatalf("cannot read reply: %v", err)
+		}
+
+		if !strings.HasPrefix(reply, "503 ") {
+			t.Errorf("reply is %q instead of a 503 reply", reply)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("replies to rejected client delayed by %v", elapsed)
+	}
+
+	// Client waiting for the greeting
+	newTestClient(t, server)
+}
+
+func TestServerTarpit(t *testing.T) {
+	server := startTestServer(t, ServerCfg{
+		TarpitDelay:     1,
+		TarpitThreshold: 1,
+	})
+
+	client := newTestClient(t, server)
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+
+		reply, err := client.Command("FOO")
+		if err != nil {
+			t.Fatalf("cannot send command: %v", err)
+		}
+
+		if reply.Code != 500 {
+			t.Errorf("unexpected reply %v", reply)
+		}
+
+		elapsed := time.Since(start)
+
+		if i == 0 && elapsed >= time.Second {
+			t.Errorf("first error reply delayed by %v", elapsed)
+		} else if i == 1 && elapsed < time.Second {
+			t.Errorf("second error reply only delayed by %v", elapsed)
+		}
+	}
+}
+
+func TestServerSubmission(t *testing.T) {
+	hash, err := sasl.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	txChan := make(chan *Transaction, 1)
+
+	server := startTestServer(t, ServerCfg{
+		MessageHandler: func(tx *Transaction) error {
+			txChan <- tx
+			return nil
+		},
+		RecipientHandler: func(identity string, forwardPath imf.SpecificAddress) error {
+			if identity != "alice@example.org" {
+				return NewError(554, "5.7.1", "relay access denied")
+			}
+
+			if forwardPath.Domain == "example.net" {
+				return NewError(550, "5.1.1", "unknown mailbox")
+			}
+
+			return nil
+		},
+		Authenticator: sasl.PasswordTable{"alice@example.org": hash},
+		TLSConfig:     testutils.TLSConfig(t),
+		Mode:          ServerModeMSA,
+	})
+
+	address := server.listeners[0].Addr().String()
+
+	client, err := NewClient(address, ClientCfg{
+		Domain:    "client.example.com",
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+	defer client.Close()
+
+	if client.HasExtension("AUTH") {
+		t.Errorf("AUTH extension announced before STARTTLS")
+	}
+
+	reply, err := client.Command("MAIL FROM:<alice@example.org>")
+	if err != nil {
+		t.Fatalf("cannot send MAIL command: %v", err)
+	}
+
+	if reply.Code != 530 {
+		t.Errorf("unexpected MAIL reply %v before authentication", reply)
+	}
+
+	if err := client.StartTLS(); err != nil {
+		t.Fatalf("cannot start TLS: %v", err)
+	}
+
+	if err := client.Auth("alice@example.org", "foo"); err == nil {
+		t.Errorf("authentication with an invalid password succeeded")
+	}
+
+	if err := client.Auth("alice@example.org", "secret"); err != nil {
+		t.Fatalf("cannot authenticate: %v", err)
+	}
+
+	reversePath := imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+	forwardPath := imf.SpecificAddress{LocalPart: "bob", Domain: "example.com"}
+
+	sendMessage := func(data string) error {
+		if err := client.Mail(&reversePath); err != nil {
+			t.Fatalf("cannot send MAIL command: %v", err)
+		}
+
+		if err := client.Rcpt(forwardPath); err != nil {
+			t.Fatalf("cannot send RCPT command: %v", err)
+		}
+
+		return client.Data([]byte(data))
+	}
+
+	if err := client.Mail(&reversePath); err != nil {
+		t.Fatalf("cannot send MAIL command: %v", err)
+	}
+
+	err = client.Rcpt(imf.SpecificAddress{LocalPart: "eve",
+		Domain: "example.net"})
+
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Reply.Code != 550 {
+		t.Errorf("recipient was not rejected: %v", err)
+	}
+
+	if err := client.Reset(); err != nil {
+		t.Fatalf("cannot reset transaction: %v", err)
+	}
+
+	err = sendMessage("From: carol@example.org\r\n\r\nHello.\r\n")
+
+	if !errors.As(err, &replyErr) || replyErr.Reply.Code != 550 {
+		t.Errorf("message from another user was not rejected: %v", err)
+	}
+
+	err = sendMessage("From: Alice <alice@example.org>\r\n" +
+		"To: bob@example.com\r\n" +
+		"Bcc: dave@example.com\r\n" +
+		"\r\n" +
+		"Hello.\r\n")
+	if err != nil {
+		t.Fatalf("cannot send message: %v", err)
+	}
+
+	tx := <-txChan
+
+	if tx.Identity != "alice@example.org" {
+		t.Errorf("identity is %q", tx.Identity)
+	}
+
+	var names []string
+	for _, field := range tx.Message.Header {
+		names = append(names, field.Name)
+	}
+
+	expectedNames := []string{"Received", "From", "To", "Date", "Message-ID"}
+	if strings.Join(names, ",") != strings.Join(expectedNames, ",") {
+		t.Errorf("header fields are %v but should be %v", names,
+			expectedNames)
+	}
+
+	received := tx.Message.Header[0].Value.(*imf.ReceivedFieldValue)
+	if !slices.Contains(received.Tokens, imf.ReceivedToken("ESMTPSA")) {
+		t.Errorf("received tokens %v do not contain ESMTPSA", received.Tokens)
+	}
+}
+
+func TestServerSubmissionSenderHandler(t *testing.T) {
+	hash, err := sasl.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+
+	bob := imf.SpecificAddress{LocalPart: "bob", Domain: "example.org"}
+
+	server := startTestServer(t, ServerCfg{
+		MessageHandler: func(tx *Transaction) error {
+			return nil
+		},
+		SenderHandler: func(identity string) ([]imf.SpecificAddress, error) {
+			if identity != "bob" {
+				return nil, nil
+			}
+
+			return []imf.SpecificAddress{bob}, nil
+		},
+		// User names which are not addresses, as in the users map of the
+		// server configuration.
+		Authenticator: sasl.PasswordTable{"bob": hash},
+		TLSConfig:     testutils.TLSConfig(t),
+		Mode:          ServerModeMSA,
+	})
+
+	address := server.listeners[0].Addr().String()
+
+	client, err := NewClient(address, ClientCfg{
+		Domain:    "client.example.com",
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.StartTLS(); err != nil {
+		t.Fatalf("cannot start TLS: %v", err)
+	}
+
+	if err := client.Auth("bob", "secret"); err != nil {
+		t.Fatalf("cannot authenticate: %v", err)
+	}
+
+	forwardPath := imf.SpecificAddress{LocalPart: "alice", Domain: "example.com"}
+
+	sendMessage := func(data string) error {
+		if err := client.Mail(&bob); err != nil {
+			t.Fatalf("cannot send MAIL command: %v", err)
+		}
+
+		if err := client.Rcpt(forwardPath); err != nil {
+			t.Fatalf("cannot send RCPT command: %v", err)
+		}
+
+		return client.Data([]byte(data))
+	}
+
+	if err := sendMessage("From: Bob <BOB@example.org>\r\n\r\nHello.\r\n"); err != nil {
+		t.Errorf("cannot send message: %v", err)
+	}
+
+	err = sendMessage("From: carol@example.org\r\n\r\nHello.\r\n")
+
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Reply.Code != 550 {
+		t.Errorf("message from another user was not rejected: %v", err)
+	}
+}
+
+func TestServerLMTP(t *testing.T) {
+	txChan := make(chan *Transaction, 1)
+
+	server := startTestServer(t, ServerCfg{
+		MessageHandler: func(tx *Transaction) error {
+			txChan <- tx
+
+			return RecipientErrors{
+				nil,
+				NewError(550, "5.1.1", "unknown mailbox"),
+			}
+		},
+		Path: path.Join(t.TempDir(), "lmtp.sock"),
+		Mode: ServerModeLMTP,
+	})
+
+	conn, err := net.Dial("unix", server.Cfg.Path)
+	if err != nil {
+		t.Fatalf("cannot connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	rbuf := bufio.NewReader(conn)
+
+	readReply := func() string {
+		var lines []string
+
+		for {
+			line, err := rbuf.ReadString('\n')
+			if err != nil {
+				t.Fatalf("cannot read reply: %v", err)
+			}
+
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+
+			if len(line) < 4 || line[3] != '-' {
+				return strings.Join(lines, "\n")
+			}
+		}
+	}
+
+	command := func(line string) string {
+		if _, err := conn.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatalf("cannot write command: %v", err)
+		}
+
+		return readReply()
+	}
+
+	readReply()
+
+	if reply := command("EHLO client.example.com"); !strings.HasPrefix(reply, "500 ") {
+		t.Errorf("unexpected EHLO reply %q", reply)
+	}
+
+	if reply := command("LHLO client.example.com"); !strings.Contains(reply, "PIPELINING") {
+		t.Errorf("LHLO reply %q does not contain PIPELINING", reply)
+	}
+
+	command("MAIL FROM:<alice@example.org>")
+	command("RCPT TO:<bob@example.com>")
+	command("RCPT TO:<carol@example.com>")
+
+	if reply := command("DATA"); !strings.HasPrefix(reply, "354 ") {
+		t.Fatalf("unexpected DATA reply %q", reply)
+	}
+
+	if reply := command("From: alice@example.org\r\n\r\nHello.\r\n."); !strings.HasPrefix(reply, "250 ") {
+		t.Errorf("first recipient reply is %q", reply)
+	}
+
+	if reply := readReply(); !strings.HasPrefix(reply, "550 ") {
+		t.Errorf("second recipient reply is %q", reply)
+	}
+
+	tx := <-txChan
+
+	if !tx.LMTP {
+		t.Errorf("transaction is not marked as LMTP")
+	}
+
+	if len(tx.ForwardPaths) != 2 {
+		t.Errorf("forward-paths are %v", tx.ForwardPaths)
+	}
+}
+
+func TestServerTrace(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+	resolver.Addr["127.0.0.1"] = []string{"client.example.com."}
+	resolver.IP["client.example.com"] = []net.IP{net.ParseIP("127.0.0.1")}
+
+	txChan := make(chan *Transaction, 1)
+
+	server := startTestServer(t, ServerCfg{
+		MessageHandler: func(tx *Transaction) error {
+			txChan <- tx
+			return nil
+		},
+		Resolver:          resolver,
+		MaxReceivedFields: 2,
+	})
+
+	client := newTestClient(t, server)
+
+	reversePath := imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+	forwardPath := imf.SpecificAddress{LocalPart: "bob", Domain: "example.com"}
+
+	sendMessage := func(nbReceivedFields int) error {
+		if err := client.Mail(&reversePath); err != nil {
+			t.Fatalf("cannot send MAIL command: %v", err)
+		}
+
+		if err := client.Rcpt(forwardPath); err != nil {
+			t.Fatalf("cannot send RCPT command: %v", err)
+		}
+
+		var data string
+		for i := 0; i < nbReceivedFields; i++ {
+			data += "Received: from a.example.org by b.example.org; " +
+				"Mon, 19 Oct 2026 10:00:00 +0000\r\n"
+		}
+
+		data += "From: alice@example.org\r\n\r\nHello.\r\n"
+
+		return client.Data([]byte(data))
+	}
+
+	if err := sendMessage(2); err != nil {
+		t.Fatalf("cannot send message: %v", err)
+	}
+
+	tx := <-txChan
+
+	if tx.ClientHost != "client.example.com" {
+		t.Errorf("client host is %q", tx.ClientHost)
+	}
+
+	field := tx.Message.Header[0]
+	if field.Name != "Received" {
+		t.Fatalf("first field is %q instead of Received", field.Name)
+	}
+
+	tokens := field.Value.(*imf.ReceivedFieldValue).Tokens.String()
+	expectedTokens := "from client.example.com (client.example.com " +
+		"[127.0.0.1]) by mx.example.com with ESMTP id " + tx.Id +
+		" for bob@example.com"
+
+	if tokens != expectedTokens {
+		t.Errorf("received tokens are %q but should be %q", tokens,
+			expectedTokens)
+	}
+
+	err := sendMessage(3)
+
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Reply.Code != 554 {
+		t.Errorf("looping message was not rejected: %v", err)
+	}
+}
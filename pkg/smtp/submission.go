@@ -0,0 +1,183 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/utils"
+)
+
+// RFC 6409 Message Submission for Mail
+//
+// In MSA mode, messages are sent by authenticated users and are completed
+// before being relayed: the server adds the fields required by RFC 5322 when
+// they are missing and removes blind carbon copy fields.
+
+// prepareSubmission checks and modifies a message received in MSA mode.
+// Errors are *Error values when the message is rejected.
+func (c *ServerConn) prepareSubmission(tx *Transaction) error {
+	var addresses []imf.SpecificAddress
+
+	if handler := c.Server.Cfg.SenderHandler; handler != nil {
+		var err error
+
+		addresses, err = handler(c.identity)
+		if err != nil {
+			return err
+		}
+	} else {
+		addresses = IdentityAddresses(c.identity)
+	}
+
+	return PrepareSubmission(tx.Message, addresses, c.Server.Cfg.PublicHost)
+}
+
+// IdentityAddresses returns the identity of a user as a list of sender
+// addresses if it is an address, or an empty list if it is not.
+func IdentityAddresses(identity string) []imf.SpecificAddress {
+	d := imf.NewDataDecoder([]byte(identity))
+
+	addr, err := d.ReadSpecificAddress()
+	if err != nil || !d.Empty() {
+		return nil
+	}
+
+	return []imf.SpecificAddress{*addr}
+}
+
+// PrepareSubmission checks and modifies a message submitted by an
+// authenticated user before it is delivered. It is used for all submitted
+// messages, whether they are received in MSA mode or by other protocols such
+// as JMAP. Addresses are those the user is allowed to send messages from. The
+// host is used as authserv-id and as domain for generated message ids. Errors
+// are *Error values when the message is rejected.
+func PrepareSubmission(msg *imf.Message, addresses []imf.SpecificAddress, host string) error {
+	// Fields using our authserv-id are forged whatever the origin of the
+	// message (RFC 8601 5.).
+	removeAuthenticationResultsFields(msg, host)
+
+	if err := checkSubmissionSender(msg, addresses); err != nil {
+		return err
+	}
+
+	var hasDate, hasMessageId bool
+
+	header := make([]*imf.Field, 0, len(msg.Header)+3)
+
+	for _, field := range msg.Header {
+		switch {
+		case strings.EqualFold(field.Name, "Bcc"):
+			// Bcc fields would disclose blind recipients to everyone
+			continue
+		case strings.EqualFold(field.Name, "Date"):
+			hasDate = true
+		case strings.EqualFold(field.Name, "Message-ID"):
+			hasMessageId = true
+		}
+
+		header = append(header, field)
+	}
+
+	now := time.Now()
+
+	// RFC 6409 8.2. Add 'Date:'
+	if !hasDate {
+		header = append(header,
+			newField("Date", utils.Ref(imf.DateFieldValue(now))))
+	}
+
+	// RFC 6409 8.3. Add 'Message-ID:'
+	if !hasMessageId {
+		id, err := generateMessageId(imf.Domain(host))
+		if err != nil {
+			return err
+		}
+
+		header = append(header,
+			newField("Message-ID", utils.Ref(imf.MessageIdFieldValue(id))))
+	}
+
+	msg.Header = header
+
+	return nil
+}
+
+// checkSubmissionSender makes sure that users only send messages on their own
+// behalf: all addresses of the From and Sender fields must be addresses of the
+// authenticated user (RFC 6409 8.1. and 6.1.).
+func checkSubmissionSender(msg *imf.Message, addresses []imf.SpecificAddress) error {
+	var addrs []imf.SpecificAddress
+	hasFrom := false
+
+	for _, field := range msg.Header {
+		isFrom := strings.EqualFold(field.Name, "From")
+		isSender := strings.EqualFold(field.Name, "Sender")
+
+		if !isFrom && !isSender {
+			continue
+		}
+
+		if field.HasError() {
+			return NewError(554, "5.6.0", "invalid %s field", field.Name)
+		}
+
+		switch v := field.Value.(type) {
+		case *imf.FromFieldValue:
+			hasFrom = true
+			addrs = append(addrs, specificAddresses(imf.Addresses(*v))...)
+		case *imf.SenderFieldValue:
+			addrs = append(addrs, specificAddresses(imf.Addresses{v.Address})...)
+		}
+	}
+
+	if !hasFrom {
+		return NewError(554, "5.6.0", "missing From field")
+	}
+
+	for _, addr := range addrs {
+		if !slices.ContainsFunc(addresses, func(a imf.SpecificAddress) bool {
+			return strings.EqualFold(a.String(), addr.String())
+		}) {
+			return NewError(550, "5.7.1", "address %s does not belong to "+
+				"the authenticated user", addr)
+		}
+	}
+
+	return nil
+}
+
+func generateMessageId(domain imf.Domain) (imf.MessageId, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return imf.MessageId{}, fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	id := imf.MessageId{
+		Left:  hex.EncodeToString(data),
+		Right: domain,
+	}
+
+	return id, nil
+}
+
+func specificAddresses(addrs imf.Addresses) []imf.SpecificAddress {
+	var specs []imf.SpecificAddress
+
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *imf.Mailbox:
+			specs = append(specs, v.SpecificAddress)
+		case *imf.Group:
+			for _, mb := range v.Mailboxes {
+				specs = append(specs, mb.SpecificAddress)
+			}
+		}
+	}
+
+	return specs
+}
@@ -0,0 +1,148 @@
+package smtp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+// RFC 5321 4.4. Trace Information
+
+const (
+	ClientHostLookupTimeout = 10 * time.Second
+
+	// The maximum number of PTR records checked when looking up the host
+	// name of a client
+	MaxClientHostNames = 10
+)
+
+// lookupClientHost sets the host name of the client if a PTR record of its
+// address points to a name which resolves back to the address
+// (forward-confirmed reverse DNS). Unconfirmed names are trivial to forge and
+// are therefore ignored.
+func (c *ServerConn) lookupClientHost() {
+	resolver := c.Server.Cfg.Resolver
+	if resolver == nil || c.clientAddress == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		ClientHostLookupTimeout)
+	defer cancel()
+
+	names, err := resolver.LookupAddr(ctx, c.clientAddress.String())
+	if err != nil {
+		if !dns.IsNotFound(err) {
+			c.Log.Error("cannot look up host name of %s: %v", c.clientAddress,
+				err)
+		}
+
+		return
+	}
+
+	for _, name := range names[:min(len(names), MaxClientHostNames)] {
+		addrs, err := resolver.LookupIP(ctx, "ip", name)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if addr.Equal(c.clientAddress) {
+				c.clientHost = strings.TrimSuffix(name, ".")
+				c.Log.Debug(1, "client host name: %s", c.clientHost)
+				return
+			}
+		}
+	}
+}
+
+// checkLoop rejects messages which went through too many servers (RFC 5321
+// 6.3.).
+func (c *ServerConn) checkLoop(msg *imf.Message) error {
+	n := 0
+	for _, field := range msg.Header {
+		if strings.EqualFold(field.Name, "Received") {
+			n++
+		}
+	}
+
+	if n > c.Server.Cfg.MaxReceivedFields {
+		return NewError(554, "5.4.6", "routing loop detected (%d Received "+
+			"fields)", n)
+	}
+
+	return nil
+}
+
+// receivedField returns the trace field added to each message accepted by
+// the server.
+func (c *ServerConn) receivedField(tx *Transaction, now time.Time) *imf.Field {
+	tokens := imf.ReceivedTokens{"from", imf.Domain(c.domain)}
+
+	// RFC 5321 4.4. The TCP-info part contains the host name of the client
+	// if it is known, and its address.
+	if c.clientAddress != nil {
+		info := "[" + c.clientAddress.String() + "]"
+		if c.clientHost != "" {
+			info = c.clientHost + " " + info
+		}
+
+		tokens = append(tokens, imf.ReceivedComment(info))
+	}
+
+	tokens = append(tokens,
+		"by", imf.Domain(c.Server.Cfg.PublicHost),
+		"with", c.protocol(),
+		"id", tx.Id)
+
+	// RFC 5321 7.2. Listing several recipients would disclose blind carbon
+	// copy recipients.
+	if len(tx.ForwardPaths) == 1 {
+		tokens = append(tokens, "for", tx.ForwardPaths[0])
+	}
+
+	value := imf.ReceivedFieldValue{
+		Tokens: tokens,
+		Date:   now,
+	}
+
+	return newField("Received", &value)
+}
+
+// protocol returns the name of the protocol used by the client as registered
+// by RFC 3848.
+func (c *ServerConn) protocol() string {
+	if !c.extended {
+		return "SMTP"
+	}
+
+	protocol := "ESMTP"
+	if c.Server.Cfg.Mode == ServerModeLMTP {
+		protocol = "LMTP"
+	}
+
+	if c.tls {
+		protocol += "S"
+	}
+
+	if c.identity != "" {
+		protocol += "A"
+	}
+
+	return protocol
+}
+
+func generateTransactionId() (string, error) {
+	data := make([]byte, 8)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	return strings.ToUpper(hex.EncodeToString(data)), nil
+}
@@ -0,0 +1,126 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/galdor/emaild/pkg/arc"
+	"github.com/galdor/emaild/pkg/dkim"
+	"github.com/galdor/emaild/pkg/dmarc"
+	"github.com/galdor/emaild/pkg/dnsbl"
+	"github.com/galdor/emaild/pkg/dsn"
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/spf"
+)
+
+// Transaction contains the envelope and content of a message received by the
+// server, along with the result of the checks performed during the session.
+type Transaction struct {
+	Id string // identifier used in the Received field and in logs
+
+	PublicHost    string // host of the server, used as authserv-id
+	Domain        string // value sent by EHLO, HELO or LHLO
+	ClientAddress net.IP // nil for UNIX domain socket connections
+	ClientHost    string // forward-confirmed reverse DNS name, if any
+	Identity      string // authenticated user, empty in MX mode
+
+	ReversePath  *imf.SpecificAddress // nil for the null reverse-path
+	ForwardPaths []imf.SpecificAddress
+
+	// Parameters of the DSN extension (RFC 3461) sent with the MAIL command
+	// and with each RCPT command; recipient parameters are indexed as
+	// forward paths.
+	DSNParameters          dsn.Parameters
+	RecipientDSNParameters []dsn.RecipientParameters
+
+	Message *imf.Message
+
+	// True if the message was received in LMTP mode; handlers can then
+	// deliver the message to each recipient independently and return
+	// RecipientErrors.
+	LMTP bool
+
+	DNSBLResult *dnsbl.Result    // nil if DNSBL checks are disabled
+	SPFResult   *spf.CheckResult // nil if SPF checks are disabled
+	DKIMResults []*dkim.Result
+	ARCResult   *arc.Result // nil if ARC validation is disabled
+
+	DMARCResult *dmarc.Result // nil if DMARC evaluation is disabled
+
+	// True if the DMARC policy of the author domain requests the message to
+	// be quarantined and DMARC policies are enforced. Handlers are expected
+	// to deliver such messages to a junk folder.
+	Quarantine bool
+}
+
+// MessageHandler is called once the content of a message has been received
+// and all checks have been performed. Returning an error causes the message
+// to be rejected: *Error values are used for the reply sent to the client,
+// and other errors cause a transient failure reply.
+type MessageHandler func(*Transaction) error
+
+// RecipientHandler is called for each RCPT command to decide whether the
+// recipient is accepted. The identity is the authenticated user, or an empty
+// string if the client is not authenticated. Errors are handled as for
+// MessageHandler.
+type RecipientHandler func(identity string, forwardPath imf.SpecificAddress) error
+
+// SenderHandler returns the addresses an authenticated user is allowed to use
+// in the From and Sender fields of the messages they submit. Errors are
+// handled as for MessageHandler.
+type SenderHandler func(identity string) ([]imf.SpecificAddress, error)
+
+// RecipientErrors is returned by message handlers when the message could
+// not be delivered to some of the recipients. Errors are indexed as forward
+// paths of the transaction and are nil for successful deliveries. In LMTP
+// mode, each recipient receives its own reply; in other modes, the first
+// error is used for the whole transaction.
+type RecipientErrors []error
+
+func (errs RecipientErrors) Error() string {
+	var msgs []string
+
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("recipient %d: %v", i+1, err))
+		}
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// First returns the first non-nil error.
+func (errs RecipientErrors) First() error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Error is used to control the reply sent to the client when an operation
+// fails.
+type Error struct {
+	Code    int
+	Status  string // enhanced status code (RFC 3463), e.g. "5.7.1"
+	Message string
+}
+
+func NewError(code int, status, format string, args ...any) *Error {
+	return &Error{
+		Code:    code,
+		Status:  status,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%d %s %s", err.Code, err.Status, err.Message)
+}
+
+func (err *Error) IsPermanent() bool {
+	return err.Code >= 500
+}
@@ -1,7 +1,9 @@
 package smtp
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 
 	"github.com/galdor/emaild/pkg/imf"
 )
@@ -20,3 +22,91 @@ func ValidateDomain(data []byte) (string, error) {
 
 	return string(*domain), nil
 }
+
+func newField(name string, value imf.FieldValue) *imf.Field {
+	return &imf.Field{Name: name, Value: value}
+}
+
+func FormatPath(addr *imf.SpecificAddress) string {
+	// RFC 5321 4.1.2. A null path is used for the reverse-path of
+	// notification messages.
+	if addr == nil {
+		return "<>"
+	}
+
+	return "<" + addr.String() + ">"
+}
+
+func EncodeDataBlock(data []byte) []byte {
+	// RFC 5321 4.5.2. Transparency. Lines starting with a period character
+	// have an additional period character prepended, and the data block ends
+	// with a line containing a single period character.
+
+	buf := make([]byte, 0, len(data)+len(data)/64+5)
+
+	lineStart := true
+	for _, c := range data {
+		if lineStart && c == '.' {
+			buf = append(buf, '.')
+		}
+
+		buf = append(buf, c)
+		lineStart = c == '\n'
+	}
+
+	if len(buf) > 0 && !lineStart {
+		buf = append(buf, '\r', '\n')
+	}
+
+	buf = append(buf, '.', '\r', '\n')
+
+	return buf
+}
+
+// ParsePath parses a path and its parameters as found in MAIL and RCPT
+// commands (RFC 5321 4.1.2.). The address is nil for a null path.
+func ParsePath(data []byte, allowEmpty bool) (*imf.SpecificAddress, map[string]string, error) {
+	// Some clients insert a space character after the colon of the command
+	data = bytes.TrimLeft(data, " ")
+
+	if len(data) == 0 || data[0] != '<' {
+		return nil, nil, fmt.Errorf("missing '<' character")
+	}
+
+	end := bytes.IndexByte(data, '>')
+	if end == -1 {
+		return nil, nil, fmt.Errorf("missing '>' character")
+	}
+
+	path := data[:end+1]
+
+	// RFC 5321 4.1.2. Source routes are obsolete and must be ignored.
+	if len(path) > 2 && path[1] == '@' {
+		colon := bytes.IndexByte(path, ':')
+		if colon == -1 {
+			return nil, nil, fmt.Errorf("invalid source route")
+		}
+
+		path = append([]byte{'<'}, path[colon+1:]...)
+	}
+
+	decoder := imf.NewDataDecoder(path)
+
+	addr, err := decoder.ReadAngleAddress(allowEmpty)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !decoder.Empty() {
+		return nil, nil, fmt.Errorf("invalid trailing data")
+	}
+
+	params := make(map[string]string)
+
+	for _, param := range strings.Fields(string(data[end+1:])) {
+		name, value, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(name)] = value
+	}
+
+	return addr, params, nil
+}
@@ -0,0 +1,202 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 7208 7. Macros
+
+type macroContext struct {
+	ip       net.IP
+	sender   string
+	domain   string
+	helo     string
+	receiver string
+}
+
+func (c *macroContext) expand(s string, exp bool) (string, error) {
+	var buf strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+
+		if ch != '%' {
+			buf.WriteByte(ch)
+			continue
+		}
+
+		if i == len(s)-1 {
+			return "", fmt.Errorf("truncated macro")
+		}
+
+		i++
+
+		switch s[i] {
+		case '%':
+			buf.WriteByte('%')
+		case '_':
+			buf.WriteByte(' ')
+		case '-':
+			buf.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("missing '}' character in macro")
+			}
+
+			value, err := c.expandMacro(s[i+1:i+end], exp)
+			if err != nil {
+				return "", err
+			}
+
+			buf.WriteString(value)
+			i += end
+		default:
+			return "", fmt.Errorf("invalid macro character %q", s[i])
+		}
+	}
+
+	return buf.String(), nil
+}
+
+func (c *macroContext) expandMacro(s string, exp bool) (string, error) {
+	if len(s) == 0 {
+		return "", fmt.Errorf("empty macro")
+	}
+
+	letter := s[0]
+	s = s[1:]
+
+	upper := letter >= 'A' && letter <= 'Z'
+	if upper {
+		letter += 'a' - 'A'
+	}
+
+	var value string
+
+	switch letter {
+	case 's':
+		value = c.sender
+	case 'l':
+		value, _ = splitSender(c.sender)
+	case 'o':
+		_, value = splitSender(c.sender)
+	case 'd':
+		value = c.domain
+	case 'i':
+		value = formatMacroIP(c.ip)
+	case 'p':
+		// RFC 7208 7.3. The use of this macro is discouraged; we do not
+		// perform the validation it would require.
+		value = "unknown"
+	case 'v':
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		} else {
+			value = "ip6"
+		}
+	case 'h':
+		value = c.helo
+	case 'c', 'r', 't':
+		if !exp {
+			return "", fmt.Errorf("macro %q only allowed in explanations",
+				letter)
+		}
+
+		switch letter {
+		case 'c':
+			value = c.ip.String()
+		case 'r':
+			value = c.receiver
+			if value == "" {
+				value = "unknown"
+			}
+		case 't':
+			value = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	default:
+		return "", fmt.Errorf("unknown macro letter %q", letter)
+	}
+
+	// Transformers
+	nbDigits := 0
+	for len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
+		nbDigits = nbDigits*10 + int(s[0]-'0')
+		s = s[1:]
+
+		if nbDigits > 128 {
+			return "", fmt.Errorf("invalid transformer digit count")
+		}
+	}
+
+	reverse := false
+	if len(s) > 0 && (s[0] == 'r' || s[0] == 'R') {
+		reverse = true
+		s = s[1:]
+	}
+
+	delimiters := "."
+	if len(s) > 0 {
+		for _, c := range s {
+			if !strings.ContainsRune(".-+,/_=", c) {
+				return "", fmt.Errorf("invalid macro delimiter %q", c)
+			}
+		}
+
+		delimiters = s
+	}
+
+	parts := strings.FieldsFunc(value, func(c rune) bool {
+		return strings.ContainsRune(delimiters, c)
+	})
+
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+
+	if nbDigits > 0 && nbDigits < len(parts) {
+		parts = parts[len(parts)-nbDigits:]
+	}
+
+	value = strings.Join(parts, ".")
+
+	if upper {
+		value = url.QueryEscape(value)
+		value = strings.ReplaceAll(value, "+", "%20")
+	}
+
+	return value, nil
+}
+
+func splitSender(sender string) (string, string) {
+	at := strings.LastIndexByte(sender, '@')
+	if at == -1 {
+		return "postmaster", sender
+	}
+
+	return sender[:at], sender[at+1:]
+}
+
+func formatMacroIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	// RFC 7208 7.3. IPv6 addresses are represented as dot-separated nibbles
+	ip6 := ip.To16()
+
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip6 {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16),
+			strconv.FormatUint(uint64(b&0xf), 16))
+	}
+
+	return strings.Join(nibbles, ".")
+}
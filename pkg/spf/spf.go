@@ -0,0 +1,900 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+// RFC 7208 Sender Policy Framework (SPF) for Authorizing Use of Domains in
+// Email, Version 1
+
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultNeutral   Result = "neutral"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultSoftFail  Result = "softfail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+const (
+	// RFC 7208 4.6.4. DNS Lookup Limits
+	MaxDNSLookups  = 10
+	MaxVoidLookups = 2
+	MaxMXNames     = 10
+	MaxPTRNames    = 10
+)
+
+var (
+	errTooManyLookups     = errors.New("too many dns lookups")
+	errTooManyVoidLookups = errors.New("too many void dns lookups")
+)
+
+type Identity string
+
+const (
+	IdentityMailFrom Identity = "mailfrom"
+	IdentityHELO     Identity = "helo"
+)
+
+// Query contains the information available to the receiver for an SPF
+// evaluation.
+type Query struct {
+	Identity Identity
+	ClientIP net.IP
+	Sender   string // MAIL FROM address, or "postmaster@<helo>"
+	HELO     string
+	Receiver string // domain of the receiving MTA, used for the %{r} macro
+}
+
+// CheckResult is the outcome of the evaluation of an SPF policy.
+type CheckResult struct {
+	Query       Query
+	Domain      string
+	Result      Result
+	Mechanism   string // the matching mechanism, if any
+	Explanation string // only set for fail results
+	Err         error  // set for temperror and permerror results
+}
+
+func (r *CheckResult) String() string {
+	s := string(r.Result)
+
+	if r.Mechanism != "" {
+		s += " (" + r.Mechanism + ")"
+	}
+
+	if r.Err != nil {
+		s += ": " + r.Err.Error()
+	}
+
+	return s
+}
+
+// ReceivedSPF returns the value of a Received-SPF header field (RFC 7208
+// 9.1).
+func (r *CheckResult) ReceivedSPF() string {
+	q := r.Query
+
+	var comment string
+	switch r.Result {
+	case ResultPass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender",
+			q.Sender, q.ClientIP)
+	case ResultFail, ResultSoftFail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as "+
+			"permitted sender", q.Sender, q.ClientIP)
+	case ResultNeutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain "+
+			"of %s", q.ClientIP, q.Sender)
+	case ResultNone:
+		comment = fmt.Sprintf("domain of %s does not provide an spf record",
+			q.Sender)
+	default:
+		comment = fmt.Sprintf("error in processing during lookup of %s",
+			q.Sender)
+		if r.Err != nil {
+			comment += ": " + r.Err.Error()
+		}
+	}
+
+	comment = strings.NewReplacer("(", "", ")", "", "\\", "").Replace(comment)
+
+	var buf strings.Builder
+
+	buf.WriteString(string(r.Result))
+	buf.WriteString(" (")
+	if q.Receiver != "" {
+		buf.WriteString(q.Receiver)
+		buf.WriteString(": ")
+	}
+	buf.WriteString(comment)
+	buf.WriteString(")")
+
+	fmt.Fprintf(&buf, " client-ip=%s;", q.ClientIP)
+	fmt.Fprintf(&buf, " envelope-from=%s;", quoteKeyValue(q.Sender))
+	if q.HELO != "" {
+		fmt.Fprintf(&buf, " helo=%s;", quoteKeyValue(q.HELO))
+	}
+	if r.Mechanism != "" {
+		fmt.Fprintf(&buf, " mechanism=%s;", quoteKeyValue(r.Mechanism))
+	}
+	fmt.Fprintf(&buf, " identity=%s;", q.Identity)
+	if q.Receiver != "" {
+		fmt.Fprintf(&buf, " receiver=%s;", quoteKeyValue(q.Receiver))
+	}
+
+	return buf.String()
+}
+
+// AuthenticationResult returns the result formatted for an
+// Authentication-Results header field (RFC 8601 2.7.2).
+func (r *CheckResult) AuthenticationResult() *imf.AuthenticationResult {
+	property := imf.AuthenticationResultProperty{
+		Type:  "smtp",
+		Name:  "mailfrom",
+		Value: r.Query.Sender,
+	}
+
+	if r.Query.Identity == IdentityHELO {
+		property.Name = "helo"
+		property.Value = r.Query.HELO
+	}
+
+	return &imf.AuthenticationResult{
+		Method:     "spf",
+		Result:     string(r.Result),
+		Properties: []imf.AuthenticationResultProperty{property},
+	}
+}
+
+func quoteKeyValue(s string) string {
+	// RFC 7208 9.1. Values are dot-atoms or quoted strings.
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' ||
+			strings.IndexByte("!#$%&'*+-/=?^_`{|}~.@:", c) >= 0) {
+			s = strings.ReplaceAll(s, "\\", "\\\\")
+			s = strings.ReplaceAll(s, "\"", "\\\"")
+			return "\"" + s + "\""
+		}
+	}
+
+	return s
+}
+
+type Checker struct {
+	Resolver dns.Resolver
+	Timeout  time.Duration
+}
+
+func NewChecker(resolver dns.Resolver) *Checker {
+	return &Checker{
+		Resolver: resolver,
+		Timeout:  20 * time.Second,
+	}
+}
+
+type evaluation struct {
+	checker *Checker
+	query   *Query
+
+	nbLookups     int
+	nbVoidLookups int
+}
+
+// CheckHELO evaluates the SPF policy of the HELO identity (RFC 7208 2.3).
+func (c *Checker) CheckHELO(ctx context.Context, ip net.IP, helo, receiver string) *CheckResult {
+	q := Query{
+		Identity: IdentityHELO,
+		ClientIP: ip,
+		Sender:   "postmaster@" + helo,
+		HELO:     helo,
+		Receiver: receiver,
+	}
+
+	return c.CheckHost(ctx, q, helo)
+}
+
+// CheckMailFrom evaluates the SPF policy of the MAIL FROM identity (RFC 7208
+// 2.4). A null reverse-path causes the HELO identity to be used as sender.
+func (c *Checker) CheckMailFrom(ctx context.Context, ip net.IP, reversePath *imf.SpecificAddress, helo, receiver string) *CheckResult {
+	if reversePath == nil {
+		result := c.CheckHELO(ctx, ip, helo, receiver)
+		result.Query.Identity = IdentityMailFrom
+		return result
+	}
+
+	q := Query{
+		Identity: IdentityMailFrom,
+		ClientIP: ip,
+		Sender:   reversePath.String(),
+		HELO:     helo,
+		Receiver: receiver,
+	}
+
+	return c.CheckHost(ctx, q, string(reversePath.Domain))
+}
+
+// CheckHost evaluates the SPF policy of a domain (RFC 7208 4.).
+func (c *Checker) CheckHost(ctx context.Context, q Query, domain string) *CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	e := evaluation{
+		checker: c,
+		query:   &q,
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	result := e.checkHost(ctx, domain, 0)
+	result.Query = q
+	result.Domain = domain
+
+	return result
+}
+
+func (e *evaluation) checkHost(ctx context.Context, domain string, depth int) *CheckResult {
+	if !isValidDomain(domain) {
+		return &CheckResult{Result: ResultNone}
+	}
+
+	record, result := e.lookupRecord(ctx, domain)
+	if result != nil {
+		return result
+	}
+
+	terms, err := parseRecord(record)
+	if err != nil {
+		return permError(err)
+	}
+
+	mc := macroContext{
+		ip:       e.query.ClientIP,
+		sender:   e.query.Sender,
+		domain:   domain,
+		helo:     e.query.HELO,
+		receiver: e.query.Receiver,
+	}
+
+	// RFC 7208 6. Modifiers may appear anywhere in the record.
+	var redirect, explanation string
+
+	for _, term := range terms {
+		if term.modifier {
+			switch term.name {
+			case "redirect":
+				redirect = term.value
+			case "exp":
+				explanation = term.value
+			}
+		}
+	}
+
+	for _, term := range terms {
+		if term.modifier {
+			continue
+		}
+
+		match, err := e.evaluateMechanism(ctx, &mc, term, depth)
+		if err != nil {
+			if isTemporary(err) {
+				return tempError(err)
+			}
+
+			return permError(err)
+		}
+
+		if !match {
+			continue
+		}
+
+		result := CheckResult{
+			Result:    term.qualifier,
+			Mechanism: term.String(),
+		}
+
+		if result.Result == ResultFail && explanation != "" {
+			result.Explanation = e.explanation(ctx, &mc, explanation)
+		}
+
+		return &result
+	}
+
+	if redirect != "" {
+		// RFC 7208 6.1. The redirect modifier counts as a DNS lookup and
+		// its target must have an SPF record.
+		if err := e.countLookup(); err != nil {
+			return permError(err)
+		}
+
+		target, err := mc.expand(redirect, false)
+		if err != nil {
+			return permError(fmt.Errorf("invalid redirect domain: %w", err))
+		}
+
+		if depth >= MaxDNSLookups {
+			return permError(errTooManyLookups)
+		}
+
+		result := e.checkHost(ctx, strings.ToLower(target), depth+1)
+		if result.Result == ResultNone {
+			return permError(fmt.Errorf("no spf record for redirect "+
+				"domain %q", target))
+		}
+
+		return result
+	}
+
+	return &CheckResult{Result: ResultNeutral}
+}
+
+func (e *evaluation) lookupRecord(ctx context.Context, domain string) (string, *CheckResult) {
+	// RFC 7208 4.4. Record Lookup
+	txts, err := e.checker.Resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return "", &CheckResult{Result: ResultNone}
+		}
+
+		return "", tempError(fmt.Errorf("cannot lookup spf record: %w", err))
+	}
+
+	// RFC 7208 4.5. Selecting Records
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") ||
+			len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", &CheckResult{Result: ResultNone}
+	case 1:
+		return records[0], nil
+	}
+
+	return "", permError(fmt.Errorf("multiple spf records"))
+}
+
+func (e *evaluation) countLookup() error {
+	e.nbLookups++
+	if e.nbLookups > MaxDNSLookups {
+		return errTooManyLookups
+	}
+
+	return nil
+}
+
+func (e *evaluation) countVoidLookup(err error) error {
+	if err != nil && dns.IsNotFound(err) {
+		e.nbVoidLookups++
+		if e.nbVoidLookups > MaxVoidLookups {
+			return errTooManyVoidLookups
+		}
+	}
+
+	return nil
+}
+
+func (e *evaluation) evaluateMechanism(ctx context.Context, mc *macroContext, term *term, depth int) (bool, error) {
+	// RFC 7208 5. Mechanism Definitions
+	domain := mc.domain
+
+	if term.domainSpec != "" {
+		expanded, err := mc.expand(term.domainSpec, false)
+		if err != nil {
+			return false, fmt.Errorf("invalid domain spec %q: %w",
+				term.domainSpec, err)
+		}
+
+		domain = strings.ToLower(strings.TrimSuffix(expanded, "."))
+	}
+
+	switch term.name {
+	case "all":
+		return true, nil
+
+	case "include":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+
+		if depth >= MaxDNSLookups {
+			return false, errTooManyLookups
+		}
+
+		// RFC 7208 5.2. Table of results of the recursive evaluation
+		result := e.checkHost(ctx, domain, depth+1)
+
+		switch result.Result {
+		case ResultPass:
+			return true, nil
+		case ResultFail, ResultSoftFail, ResultNeutral:
+			return false, nil
+		case ResultTempError:
+			return false, temporary(result.Err)
+		case ResultNone:
+			return false, fmt.Errorf("no spf record for included domain %q",
+				domain)
+		default:
+			return false, result.Err
+		}
+
+	case "a":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+
+		return e.matchHost(ctx, domain, term)
+
+	case "mx":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+
+		mxs, err := e.checker.Resolver.LookupMX(ctx, domain)
+		if err := e.countVoidLookup(err); err != nil {
+			return false, err
+		}
+		if err != nil && !dns.IsNotFound(err) {
+			return false, temporary(err)
+		}
+
+		if len(mxs) > MaxMXNames {
+			return false, fmt.Errorf("too many mx records")
+		}
+
+		for _, mx := range mxs {
+			match, err := e.matchHost(ctx, mx.Host, term)
+			if err != nil || match {
+				return match, err
+			}
+		}
+
+		return false, nil
+
+	case "ptr":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+
+		return e.matchPTR(ctx, domain)
+
+	case "ip4", "ip6":
+		return term.network.Contains(e.query.ClientIP), nil
+
+	case "exists":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+
+		// RFC 7208 5.7. An A lookup is always used, even for IPv6 clients.
+		ips, err := e.checker.Resolver.LookupIP(ctx, "ip4", domain)
+		if err := e.countVoidLookup(err); err != nil {
+			return false, err
+		}
+		if err != nil && !dns.IsNotFound(err) {
+			return false, temporary(err)
+		}
+
+		return len(ips) > 0, nil
+	}
+
+	return false, fmt.Errorf("unknown mechanism %q", term.name)
+}
+
+func (e *evaluation) matchHost(ctx context.Context, host string, term *term) (bool, error) {
+	network := "ip4"
+	prefixLength := term.cidr4
+	if e.query.ClientIP.To4() == nil {
+		network = "ip6"
+		prefixLength = term.cidr6
+	}
+
+	ips, err := e.checker.Resolver.LookupIP(ctx, network, host)
+	if err := e.countVoidLookup(err); err != nil {
+		return false, err
+	}
+	if err != nil && !dns.IsNotFound(err) {
+		return false, temporary(err)
+	}
+
+	for _, ip := range ips {
+		if matchCIDR(ip, e.query.ClientIP, prefixLength) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (e *evaluation) matchPTR(ctx context.Context, domain string) (bool, error) {
+	names, err := e.checker.Resolver.LookupAddr(ctx, e.query.ClientIP.String())
+	if err != nil {
+		// RFC 7208 5.5. Errors in the reverse lookup cause the mechanism to
+		// not match.
+		return false, nil
+	}
+
+	if len(names) > MaxPTRNames {
+		names = names[:MaxPTRNames]
+	}
+
+	network := "ip4"
+	if e.query.ClientIP.To4() == nil {
+		network = "ip6"
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			continue
+		}
+
+		ips, err := e.checker.Resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			continue
+		}
+
+		for _, ip := range ips {
+			if ip.Equal(e.query.ClientIP) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (e *evaluation) explanation(ctx context.Context, mc *macroContext, spec string) string {
+	// RFC 7208 6.2. Failures to obtain the explanation are silently ignored.
+	domain, err := mc.expand(spec, false)
+	if err != nil {
+		return ""
+	}
+
+	txts, err := e.checker.Resolver.LookupTXT(ctx, domain)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+
+	explanation, err := mc.expand(txts[0], true)
+	if err != nil {
+		return ""
+	}
+
+	for i := 0; i < len(explanation); i++ {
+		if explanation[i] < 32 || explanation[i] > 126 {
+			return ""
+		}
+	}
+
+	return explanation
+}
+
+func matchCIDR(ip, clientIP net.IP, prefixLength int) bool {
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+
+	network := net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLength, bits)}
+	return network.Contains(clientIP)
+}
+
+func isValidDomain(domain string) bool {
+	// RFC 7208 4.3. The domain must be a fully qualified domain name made of
+	// valid labels.
+	domain = strings.TrimSuffix(domain, ".")
+
+	if domain == "" || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+type temporaryError struct {
+	err error
+}
+
+func (err *temporaryError) Error() string {
+	return err.err.Error()
+}
+
+func temporary(err error) error {
+	return &temporaryError{err: err}
+}
+
+func isTemporary(err error) bool {
+	var tmpErr *temporaryError
+	return errors.As(err, &tmpErr)
+}
+
+func tempError(err error) *CheckResult {
+	return &CheckResult{Result: ResultTempError, Err: err}
+}
+
+func permError(err error) *CheckResult {
+	return &CheckResult{Result: ResultPermError, Err: err}
+}
+
+type term struct {
+	modifier bool
+
+	qualifier  Result
+	name       string
+	value      string // modifiers only
+	domainSpec string
+	network    *net.IPNet // ip4 and ip6 only
+	cidr4      int
+	cidr6      int
+
+	raw string
+}
+
+func (t *term) String() string {
+	return t.raw
+}
+
+func parseRecord(record string) ([]*term, error) {
+	// RFC 7208 4.6.1. Term Evaluation
+	var terms []*term
+
+	modifiers := make(map[string]struct{})
+
+	for _, s := range strings.Fields(record)[1:] {
+		t, err := parseTerm(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid term %q: %w", s, err)
+		}
+
+		if t.modifier && (t.name == "redirect" || t.name == "exp") {
+			if _, found := modifiers[t.name]; found {
+				return nil, fmt.Errorf("duplicate modifier %q", t.name)
+			}
+
+			modifiers[t.name] = struct{}{}
+		}
+
+		terms = append(terms, t)
+	}
+
+	// RFC 7208 6.1. The redirect modifier is ignored if there is an "all"
+	// mechanism.
+	for _, t := range terms {
+		if !t.modifier && t.name == "all" {
+			for _, t2 := range terms {
+				if t2.modifier && t2.name == "redirect" {
+					t2.name = "ignored-redirect"
+				}
+			}
+		}
+	}
+
+	return terms, nil
+}
+
+func parseTerm(s string) (*term, error) {
+	t := term{
+		raw:       s,
+		qualifier: ResultPass,
+		cidr4:     32,
+		cidr6:     128,
+	}
+
+	// Modifiers are identified by a name followed by an equal sign; the name
+	// cannot contain any character found in mechanisms.
+	if eq := strings.IndexByte(s, '='); eq > 0 &&
+		!strings.ContainsAny(s[:eq], ":/") {
+		t.modifier = true
+		t.name = strings.ToLower(s[:eq])
+		t.value = s[eq+1:]
+
+		if !isName(t.name) {
+			return nil, fmt.Errorf("invalid modifier name")
+		}
+
+		return &t, nil
+	}
+
+	switch s[0] {
+	case '+':
+		t.qualifier = ResultPass
+		s = s[1:]
+	case '-':
+		t.qualifier = ResultFail
+		s = s[1:]
+	case '~':
+		t.qualifier = ResultSoftFail
+		s = s[1:]
+	case '?':
+		t.qualifier = ResultNeutral
+		s = s[1:]
+	}
+
+	name := s
+	var arg string
+	if idx := strings.IndexAny(s, ":/"); idx >= 0 {
+		name = s[:idx]
+		arg = s[idx:]
+	}
+
+	t.name = strings.ToLower(name)
+
+	switch t.name {
+	case "all":
+		if arg != "" {
+			return nil, fmt.Errorf("unexpected argument")
+		}
+
+	case "include", "exists":
+		if !strings.HasPrefix(arg, ":") || len(arg) == 1 {
+			return nil, fmt.Errorf("missing domain")
+		}
+
+		t.domainSpec = arg[1:]
+
+	case "a", "mx":
+		if strings.HasPrefix(arg, ":") {
+			arg = arg[1:]
+
+			slash := strings.IndexByte(arg, '/')
+			if slash == -1 {
+				t.domainSpec = arg
+				arg = ""
+			} else {
+				t.domainSpec = arg[:slash]
+				arg = arg[slash:]
+			}
+
+			if t.domainSpec == "" {
+				return nil, fmt.Errorf("empty domain")
+			}
+		}
+
+		if err := t.parseDualCIDR(arg); err != nil {
+			return nil, err
+		}
+
+	case "ptr":
+		if strings.HasPrefix(arg, ":") {
+			t.domainSpec = arg[1:]
+		} else if arg != "" {
+			return nil, fmt.Errorf("unexpected argument")
+		}
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return nil, fmt.Errorf("missing address")
+		}
+
+		if err := t.parseNetwork(arg[1:]); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown mechanism")
+	}
+
+	return &t, nil
+}
+
+func (t *term) parseDualCIDR(s string) error {
+	if s == "" {
+		return nil
+	}
+
+	cidr4, cidr6, _ := strings.Cut(s, "//")
+
+	if strings.HasPrefix(s, "//") {
+		cidr4 = ""
+		cidr6 = s[2:]
+	} else {
+		cidr4 = strings.TrimPrefix(cidr4, "/")
+	}
+
+	if cidr4 != "" {
+		n, err := strconv.Atoi(cidr4)
+		if err != nil || n < 0 || n > 32 {
+			return fmt.Errorf("invalid ip4 cidr length %q", cidr4)
+		}
+
+		t.cidr4 = n
+	}
+
+	if cidr6 != "" {
+		n, err := strconv.Atoi(cidr6)
+		if err != nil || n < 0 || n > 128 {
+			return fmt.Errorf("invalid ip6 cidr length %q", cidr6)
+		}
+
+		t.cidr6 = n
+	}
+
+	return nil
+}
+
+func (t *term) parseNetwork(s string) error {
+	addr, prefix, hasPrefix := strings.Cut(s, "/")
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("invalid address %q", addr)
+	}
+
+	bits := 128
+	if t.name == "ip4" {
+		if ip.To4() == nil {
+			return fmt.Errorf("invalid ip4 address %q", addr)
+		}
+
+		bits = 32
+		ip = ip.To4()
+	} else if ip.To4() != nil && !strings.Contains(addr, ":") {
+		return fmt.Errorf("invalid ip6 address %q", addr)
+	}
+
+	prefixLength := bits
+	if hasPrefix {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n < 0 || n > bits {
+			return fmt.Errorf("invalid prefix length %q", prefix)
+		}
+
+		prefixLength = n
+	}
+
+	mask := net.CIDRMask(prefixLength, bits)
+	t.network = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+
+	return nil
+}
+
+func isName(s string) bool {
+	// RFC 7208 12. name = ALPHA *( ALPHA / DIGIT / "-" / "_" / "." )
+	if s == "" || !(s[0] >= 'a' && s[0] <= 'z') {
+		return false
+	}
+
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+
+	return true
+}
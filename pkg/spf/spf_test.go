@@ -0,0 +1,163 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/galdor/emaild/pkg/dns"
+	"github.com/galdor/emaild/pkg/imf"
+)
+
+func TestMacroExpansion(t *testing.T) {
+	// RFC 7208 7.4. Macro Processing Examples
+	mc := macroContext{
+		ip:     net.ParseIP("192.0.2.3"),
+		sender: "strong-bad@email.example.com",
+		domain: "email.example.com",
+	}
+
+	mc6 := mc
+	mc6.ip = net.ParseIP("2001:db8::cb01")
+
+	tests := []struct {
+		mc     *macroContext
+		s      string
+		result string
+	}{
+		{&mc, "%{s}", "strong-bad@email.example.com"},
+		{&mc, "%{o}", "email.example.com"},
+		{&mc, "%{d}", "email.example.com"},
+		{&mc, "%{d4}", "email.example.com"},
+		{&mc, "%{d3}", "email.example.com"},
+		{&mc, "%{d2}", "example.com"},
+		{&mc, "%{d1}", "com"},
+		{&mc, "%{dr}", "com.example.email"},
+		{&mc, "%{d2r}", "example.email"},
+		{&mc, "%{l}", "strong-bad"},
+		{&mc, "%{l-}", "strong.bad"},
+		{&mc, "%{lr}", "strong-bad"},
+		{&mc, "%{lr-}", "bad.strong"},
+		{&mc, "%{l1r-}", "strong"},
+		{&mc, "%{ir}.%{v}._spf.%{d2}",
+			"3.2.0.192.in-addr._spf.example.com"},
+		{&mc, "%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{&mc, "%{d2}.trusted-domains.example.net",
+			"example.com.trusted-domains.example.net"},
+		{&mc6, "%{ir}.%{v}._spf.%{d2}",
+			"1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2" +
+				".ip6._spf.example.com"},
+	}
+
+	for _, test := range tests {
+		result, err := test.mc.expand(test.s, false)
+		if err != nil {
+			t.Errorf("cannot expand %q: %v", test.s, err)
+			continue
+		}
+
+		if result != test.result {
+			t.Errorf("%q is expanded to %q but should be expanded to %q",
+				test.s, result, test.result)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+
+	resolver.TXT["example.com"] = []string{
+		"v=spf1 ip4:192.0.2.0/24 a:mail.example.com mx include:example.net " +
+			"-all",
+	}
+	resolver.IP["mail.example.com"] = []net.IP{net.ParseIP("198.51.100.1")}
+	resolver.MX["example.com"] = []*net.MX{{Host: "mx.example.com", Pref: 10}}
+	resolver.IP["mx.example.com"] = []net.IP{net.ParseIP("198.51.100.2")}
+
+	resolver.TXT["example.net"] = []string{
+		"v=spf1 ip6:2001:db8::/32 exists:%{i}.allowed.example.net ~all",
+	}
+	resolver.IP["198.51.100.3.allowed.example.net"] =
+		[]net.IP{net.ParseIP("127.0.0.2")}
+
+	resolver.TXT["example.org"] = []string{"v=spf1 redirect=example.com"}
+	resolver.TXT["example.info"] = []string{"v=spf1 a -all", "v=spf1 -all"}
+	resolver.TXT["example.biz"] = []string{"v=spf1 include:broken.example"}
+	resolver.TempErrors["broken.example"] = true
+
+	resolver.TXT["loop.example"] = []string{"v=spf1 include:loop.example"}
+
+	resolver.TXT["void.example"] = []string{
+		"v=spf1 a:v1.example a:v2.example a:v3.example -all",
+	}
+
+	resolver.TXT["nospf.example"] = []string{"google-site-verification=x"}
+
+	checker := NewChecker(resolver)
+
+	tests := []struct {
+		ip     string
+		domain string
+		result Result
+	}{
+		{"192.0.2.10", "example.com", ResultPass},
+		{"198.51.100.1", "example.com", ResultPass},
+		{"198.51.100.2", "example.com", ResultPass},
+		{"2001:db8::1", "example.com", ResultPass},
+		{"198.51.100.3", "example.com", ResultPass},
+		{"203.0.113.1", "example.com", ResultFail},
+		{"203.0.113.1", "example.net", ResultSoftFail},
+		{"192.0.2.10", "example.org", ResultPass},
+		{"203.0.113.1", "example.org", ResultFail},
+		{"192.0.2.10", "example.info", ResultPermError},
+		{"192.0.2.10", "example.biz", ResultTempError},
+		{"192.0.2.10", "loop.example", ResultPermError},
+		{"192.0.2.10", "void.example", ResultPermError},
+		{"192.0.2.10", "nospf.example", ResultNone},
+		{"192.0.2.10", "unknown.example", ResultNone},
+	}
+
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		reversePath := imf.SpecificAddress{
+			LocalPart: "alice",
+			Domain:    imf.Domain(test.domain),
+		}
+
+		result := checker.CheckMailFrom(context.Background(), ip,
+			&reversePath, "client.example.com", "mx.example.com")
+
+		if result.Result != test.result {
+			t.Errorf("checking %s for %s returned %v but should have "+
+				"returned %q", test.ip, test.domain, result, test.result)
+		}
+	}
+}
+
+func TestExplanation(t *testing.T) {
+	resolver := dns.NewFakeResolver()
+
+	resolver.TXT["example.com"] = []string{
+		"v=spf1 -all exp=explain._spf.%{d}",
+	}
+	resolver.TXT["explain._spf.example.com"] = []string{
+		"%{i} is not one of %{d}'s designated mail servers.",
+	}
+
+	checker := NewChecker(resolver)
+
+	reversePath := imf.SpecificAddress{LocalPart: "alice", Domain: "example.com"}
+	result := checker.CheckMailFrom(context.Background(),
+		net.ParseIP("192.0.2.1"), &reversePath, "client.example.com", "")
+
+	if result.Result != ResultFail {
+		t.Fatalf("check returned %v", result)
+	}
+
+	explanation := "192.0.2.1 is not one of example.com's designated mail " +
+		"servers."
+	if result.Explanation != explanation {
+		t.Errorf("explanation is %q but should be %q",
+			result.Explanation, explanation)
+	}
+}
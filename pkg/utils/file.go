@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// WriteFileAtomically replaces the content of a file. Data are written to a
+// temporary file first and renamed so that a crash never leaves a truncated
+// file; both the file and its directory are synced before returning.
+func WriteFileAtomically(filePath string, data []byte) error {
+	tmpPath := filePath + ".tmp"
+
+	if err := WriteFileSync(tmpPath, data); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cannot rename %q: %w", tmpPath, err)
+	}
+
+	return SyncDirectory(path.Dir(filePath))
+}
+
+// WriteFileSync writes data to a file and syncs it to disk.
+func WriteFileSync(filePath string, data []byte) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %w", filePath, err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot write %q: %w", filePath, err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot sync %q: %w", filePath, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("cannot close %q: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// SyncDirectory syncs a directory so that the creation, renaming or deletion
+// of the files it contains is durable.
+func SyncDirectory(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", dirPath, err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("cannot sync %q: %w", dirPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/galdor/go-ejson"
+)
+
+type TLSCfg struct {
+	Certificate string `json:"certificate"` // path of a PEM file
+	PrivateKey  string `json:"private_key"` // path of a PEM file
+}
+
+func (cfg *TLSCfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("certificate", cfg.Certificate)
+	v.CheckStringNotEmpty("private_key", cfg.PrivateKey)
+}
+
+// ServerTLSConfig loads the certificate and returns a TLS configuration
+// suitable for server connections.
+func (cfg *TLSCfg) ServerTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Certificate, cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate: %w", err)
+	}
+
+	tlsCfg := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return &tlsCfg, nil
+}
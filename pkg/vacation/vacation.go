@@ -0,0 +1,671 @@
+package vacation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	stdmime "mime"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/emaild/pkg/mime"
+	"github.com/galdor/emaild/pkg/utils"
+	"github.com/galdor/go-ejson"
+	"github.com/galdor/go-log"
+)
+
+// RFC 3834 Recommendations for Automatic Responses to Electronic Mail
+
+const (
+	DefaultDays  = 7
+	MaxDays      = 365
+	SaveInterval = time.Minute
+)
+
+type Cfg struct {
+	Log *log.Logger `json:"-"`
+
+	// The file used to store the date of the last reply sent to each sender
+	Path string `json:"path"`
+
+	// Settings indexed by user name: the name of directory users, or the
+	// lower case address of other local recipients.
+	Users map[string]*UserCfg `json:"users"`
+}
+
+type UserCfg struct {
+	// The addresses of the user. The first one is used as the sender of
+	// replies; messages which do not contain any of them in their recipient
+	// fields are not answered.
+	Addresses []string `json:"addresses"`
+
+	// The subject of replies; the default is the subject of the original
+	// message prefixed with "Auto:".
+	Subject string `json:"subject,omitempty"`
+
+	Message string `json:"message"`
+
+	// The minimal interval between two replies to the same sender (days)
+	Days int `json:"days,omitempty"`
+
+	// The optional period during which replies are sent
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+
+	// If true, the message is a MIME entity whose Content-* header fields
+	// are copied to replies (RFC 5230 5.8.).
+	MIME bool `json:"mime,omitempty"`
+}
+
+func (cfg *Cfg) ValidateJSON(v *ejson.Validator) {
+	v.CheckStringNotEmpty("path", cfg.Path)
+
+	v.WithChild("users", func() {
+		for name, cfg := range cfg.Users {
+			v.CheckObject(name, cfg)
+		}
+	})
+}
+
+func (cfg *UserCfg) ValidateJSON(v *ejson.Validator) {
+	if v.CheckArrayNotEmpty("addresses", cfg.Addresses) {
+		v.WithChild("addresses", func() {
+			for i, address := range cfg.Addresses {
+				_, err := parseAddress(address)
+				v.Check(i, err == nil, "invalid_address",
+					"invalid address %q", address)
+			}
+		})
+	}
+
+	if v.CheckStringNotEmpty("message", cfg.Message) && cfg.MIME {
+		_, err := decodeMIMEMessage(cfg.Message)
+		v.Check("message", err == nil, "invalid_mime_message",
+			"invalid mime message: %v", err)
+	}
+
+	v.CheckIntMinMax("days", cfg.Days, 0, MaxDays)
+
+	if cfg.Start != nil && cfg.End != nil {
+		v.Check("end", cfg.End.After(*cfg.Start), "invalid_period",
+			"end date must be after start date")
+	}
+}
+
+func (cfg *UserCfg) days() int {
+	if cfg.Days == 0 {
+		return DefaultDays
+	}
+
+	return cfg.Days
+}
+
+func (cfg *UserCfg) isActive(now time.Time) bool {
+	return (cfg.Start == nil || !now.Before(*cfg.Start)) &&
+		(cfg.End == nil || now.Before(*cfg.End))
+}
+
+// RFC 3834 3.3. Replies are sent to the reverse-path of the original message
+// with a null reverse-path so that they cannot trigger other automatic
+// responses.
+type Reply struct {
+	Recipient imf.SpecificAddress
+	Message   *imf.Message
+}
+
+type ReplyRecord struct {
+	User   string    `json:"user"`
+	Handle string    `json:"handle,omitempty"`
+	Sender string    `json:"sender"`
+	Date   time.Time `json:"date"`
+
+	// The interval of replies whose settings are not part of the
+	// configuration (days).
+	Days int `json:"days,omitempty"`
+}
+
+func (r *ReplyRecord) key() string {
+	return r.User + " " + r.Handle + " " + r.Sender
+}
+
+type state struct {
+	Replies []*ReplyRecord `json:"replies"`
+}
+
+type Responder struct {
+	Cfg Cfg
+	Log *log.Logger
+
+	replies  map[string]*ReplyRecord
+	modified bool
+	mutex    sync.Mutex
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewResponder(cfg Cfg) (*Responder, error) {
+	r := Responder{
+		Cfg: cfg,
+		Log: cfg.Log,
+
+		replies: make(map[string]*ReplyRecord),
+
+		stopChan: make(chan struct{}),
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (r *Responder) Start() error {
+	r.wg.Add(1)
+	go r.main()
+
+	return nil
+}
+
+func (r *Responder) Stop() {
+	close(r.stopChan)
+	r.wg.Wait()
+
+	if err := r.save(); err != nil {
+		r.Log.Error("cannot save vacation replies: %v", err)
+	}
+}
+
+func (r *Responder) main() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(SaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopChan:
+			return
+
+		case <-ticker.C:
+			r.expire(time.Now())
+
+			if err := r.save(); err != nil {
+				r.Log.Error("cannot save vacation replies: %v", err)
+			}
+		}
+	}
+}
+
+// Respond returns the automatic reply to a message delivered to a user, or
+// nil if no reply must be sent. The reply is recorded as sent: the caller is
+// expected to deliver it.
+func (r *Responder) Respond(user string, reversePath *imf.SpecificAddress, msg *imf.Message, now time.Time) (*Reply, error) {
+	userCfg := r.Cfg.Users[user]
+	if userCfg == nil {
+		return nil, nil
+	}
+
+	return r.respond(user, "", userCfg, reversePath, msg, now)
+}
+
+// RespondWith is similar to Respond but uses settings which are not part of
+// the configuration, e.g. those of the vacation action of a Sieve script.
+// Replies are tracked separately for each handle (RFC 5230 4.2.).
+func (r *Responder) RespondWith(user, handle string, userCfg *UserCfg, reversePath *imf.SpecificAddress, msg *imf.Message, now time.Time) (*Reply, error) {
+	return r.respond(user, handle, userCfg, reversePath, msg, now)
+}
+
+func (r *Responder) respond(user, handle string, userCfg *UserCfg, reversePath *imf.SpecificAddress, msg *imf.Message, now time.Time) (*Reply, error) {
+	if !userCfg.isActive(now) {
+		return nil, nil
+	}
+
+	if reason := ignoreReason(userCfg, reversePath, msg); reason != "" {
+		r.Log.Debug(1, "not replying to message for user %q: %s", user, reason)
+		return nil, nil
+	}
+
+	record := ReplyRecord{
+		User:   user,
+		Handle: handle,
+		Sender: strings.ToLower(reversePath.String()),
+		Date:   now,
+	}
+
+	if handle != "" {
+		record.Days = userCfg.days()
+	}
+
+	key := record.key()
+	interval := time.Duration(userCfg.days()) * 24 * time.Hour
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if previous := r.replies[key]; previous != nil &&
+		now.Sub(previous.Date) < interval {
+		r.Log.Debug(1, "not replying to message for user %q: already "+
+			"replied to %q", user, record.Sender)
+		return nil, nil
+	}
+
+	reply, err := generateReply(userCfg, reversePath, msg, now)
+	if err != nil {
+		return nil, err
+	}
+
+	r.replies[key] = &record
+	r.modified = true
+
+	return reply, nil
+}
+
+// ignoreReason returns the reason why a message must not be answered, or an
+// empty string if it can be.
+func ignoreReason(cfg *UserCfg, reversePath *imf.SpecificAddress, msg *imf.Message) string {
+	// RFC 3834 2. Responses must only be sent to the reverse-path; a null
+	// reverse-path means that no response is wanted.
+	if reversePath == nil {
+		return "null reverse-path"
+	}
+
+	if isAutomatedSender(reversePath) {
+		return "automated sender"
+	}
+
+	for _, address := range cfg.Addresses {
+		if strings.EqualFold(reversePath.String(), address) {
+			return "message sent by the user"
+		}
+	}
+
+	for _, field := range msg.Header {
+		value := ""
+		if v, ok := field.Value.(*imf.OptionalFieldValue); ok {
+			value = strings.ToLower(strings.TrimSpace(string(*v)))
+		}
+
+		switch {
+		case strings.EqualFold(field.Name, "Auto-Submitted"):
+			// RFC 3834 5. "no" is the only value indicating that the
+			// message was not generated automatically.
+			if value != "no" {
+				return "automatically submitted message"
+			}
+
+		case strings.EqualFold(field.Name, "Precedence"):
+			if value == "bulk" || value == "list" || value == "junk" {
+				return "bulk or list message"
+			}
+
+		case strings.EqualFold(field.Name, "List-Id"):
+			return "mailing list message"
+		}
+	}
+
+	// RFC 3834 2. Messages which are not explicitly addressed to the user
+	// were most likely received through a list or an alias.
+	if !isAddressedTo(msg, cfg.Addresses) {
+		return "message not addressed to the user"
+	}
+
+	return ""
+}
+
+func isAutomatedSender(spec *imf.SpecificAddress) bool {
+	localPart := strings.ToLower(spec.LocalPart)
+
+	switch {
+	case localPart == "mailer-daemon",
+		localPart == "listserv",
+		localPart == "majordomo",
+		strings.HasPrefix(localPart, "owner-"),
+		strings.HasSuffix(localPart, "-request"):
+		return true
+	}
+
+	return false
+}
+
+func isAddressedTo(msg *imf.Message, addresses []string) bool {
+	for _, field := range msg.Header {
+		if field.HasError() {
+			continue
+		}
+
+		var addrs imf.Addresses
+
+		switch v := field.Value.(type) {
+		case *imf.ToFieldValue:
+			addrs = imf.Addresses(*v)
+		case *imf.CcFieldValue:
+			addrs = imf.Addresses(*v)
+		case *imf.BccFieldValue:
+			addrs = imf.Addresses(*v)
+		case *imf.ResentToFieldValue:
+			addrs = imf.Addresses(*v)
+		case *imf.ResentCcFieldValue:
+			addrs = imf.Addresses(*v)
+		case *imf.ResentBccFieldValue:
+			addrs = imf.Addresses(*v)
+		default:
+			continue
+		}
+
+		for _, spec := range specificAddresses(addrs) {
+			for _, address := range addresses {
+				if strings.EqualFold(spec.String(), address) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func specificAddresses(addrs imf.Addresses) []imf.SpecificAddress {
+	var specs []imf.SpecificAddress
+
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *imf.Mailbox:
+			specs = append(specs, v.SpecificAddress)
+
+		case *imf.Group:
+			for _, mailbox := range v.Mailboxes {
+				specs = append(specs, mailbox.SpecificAddress)
+			}
+		}
+	}
+
+	return specs
+}
+
+func generateReply(cfg *UserCfg, reversePath *imf.SpecificAddress, msg *imf.Message, now time.Time) (*Reply, error) {
+	fromSpec, err := parseAddress(cfg.Addresses[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", cfg.Addresses[0], err)
+	}
+
+	messageId, err := generateMessageId(fromSpec.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	from := imf.Mailbox{SpecificAddress: *fromSpec}
+	to := imf.Mailbox{SpecificAddress: *reversePath}
+
+	header := []*imf.Field{
+		newField("From", &imf.FromFieldValue{&from}),
+		newField("To", &imf.ToFieldValue{&to}),
+		newField("Subject", utils.Ref(replySubject(cfg, msg))),
+		newField("Date", utils.Ref(imf.DateFieldValue(now))),
+		newField("Message-ID", utils.Ref(imf.MessageIdFieldValue(messageId))),
+	}
+
+	// RFC 5322 3.6.4. Identification Fields
+	if originalId := findMessageId(msg); originalId != nil {
+		references := findReferences(msg)
+		references = append(references, *originalId)
+
+		header = append(header,
+			newField("In-Reply-To",
+				&imf.InReplyToFieldValue{*originalId}),
+			newField("References",
+				utils.Ref(imf.ReferencesFieldValue(references))))
+	}
+
+	header = append(header,
+		newField("Auto-Submitted", utils.Ref(imf.OptionalFieldValue("auto-replied"))),
+		newField("MIME-Version", utils.Ref(imf.OptionalFieldValue("1.0"))))
+
+	var body string
+
+	if cfg.MIME {
+		entity, err := decodeMIMEMessage(cfg.Message)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, field := range entity.Header {
+			if strings.HasPrefix(strings.ToLower(field.Name), "content-") {
+				header = append(header, field)
+			}
+		}
+
+		body = string(entity.Body)
+	} else {
+		header = append(header,
+			newField("Content-Type", utils.Ref(imf.OptionalFieldValue("text/plain; charset=utf-8"))),
+			newField("Content-Transfer-Encoding", utils.Ref(imf.OptionalFieldValue("quoted-printable"))))
+
+		body = mime.QuotedPrintableEncode(cfg.Message)
+	}
+
+	if !strings.HasSuffix(body, "\r\n") {
+		body += "\r\n"
+	}
+
+	reply := Reply{
+		Recipient: *reversePath,
+		Message: &imf.Message{
+			Header: header,
+			Body:   []byte(body),
+		},
+	}
+
+	return &reply, nil
+}
+
+// decodeMIMEMessage decodes a message which is a MIME entity, i.e. header
+// fields followed by an empty line and a body. Line endings are normalized
+// since messages usually come from configuration files or scripts.
+func decodeMIMEMessage(message string) (*imf.Message, error) {
+	data := strings.ReplaceAll(message, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n", "\r\n")
+
+	entity, err := imf.NewMessageDecoder().DecodeAll([]byte(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid mime message: %w", err)
+	}
+
+	for _, field := range entity.Header {
+		if field.HasError() {
+			return nil, fmt.Errorf("invalid mime message: invalid field "+
+				"%q: %s", field.Name, field.Error)
+		}
+	}
+
+	return entity, nil
+}
+
+func replySubject(cfg *UserCfg, msg *imf.Message) imf.SubjectFieldValue {
+	if cfg.Subject != "" {
+		return imf.SubjectFieldValue(stdmime.QEncoding.Encode("utf-8",
+			cfg.Subject))
+	}
+
+	// RFC 3834 3.1.5. The subject of the original message is copied as it
+	// is, encoded words included.
+	subject := ""
+
+	for _, field := range msg.Header {
+		if v, ok := field.Value.(*imf.SubjectFieldValue); ok &&
+			!field.HasError() {
+			subject = strings.TrimSpace(string(*v))
+			break
+		}
+	}
+
+	if subject == "" {
+		return "Auto: (no subject)"
+	}
+
+	return imf.SubjectFieldValue("Auto: " + subject)
+}
+
+func findMessageId(msg *imf.Message) *imf.MessageId {
+	for _, field := range msg.Header {
+		if v, ok := field.Value.(*imf.MessageIdFieldValue); ok &&
+			!field.HasError() {
+			return utils.Ref(imf.MessageId(*v))
+		}
+	}
+
+	return nil
+}
+
+func findReferences(msg *imf.Message) imf.MessageIds {
+	var inReplyTo imf.MessageIds
+
+	for _, field := range msg.Header {
+		if field.HasError() {
+			continue
+		}
+
+		switch v := field.Value.(type) {
+		case *imf.ReferencesFieldValue:
+			return append(imf.MessageIds{}, *v...)
+
+		case *imf.InReplyToFieldValue:
+			inReplyTo = imf.MessageIds(*v)
+		}
+	}
+
+	// Without References field, the In-Reply-To field is only used if it
+	// contains a single identifier.
+	if len(inReplyTo) == 1 {
+		return imf.MessageIds{inReplyTo[0]}
+	}
+
+	return nil
+}
+
+func newField(name string, value imf.FieldValue) *imf.Field {
+	return &imf.Field{Name: name, Value: value}
+}
+
+func generateMessageId(domain imf.Domain) (imf.MessageId, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return imf.MessageId{}, fmt.Errorf("cannot generate random data: %w", err)
+	}
+
+	id := imf.MessageId{
+		Left:  "vacation." + hex.EncodeToString(data),
+		Right: domain,
+	}
+
+	return id, nil
+}
+
+func parseAddress(s string) (*imf.SpecificAddress, error) {
+	d := imf.NewDataDecoder([]byte(s))
+
+	spec, err := d.ReadSpecificAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Empty() {
+		return nil, fmt.Errorf("invalid trailing data")
+	}
+
+	return spec, nil
+}
+
+func (r *Responder) expire(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for key, record := range r.replies {
+		days := record.Days
+
+		if record.Handle == "" {
+			if userCfg := r.Cfg.Users[record.User]; userCfg != nil {
+				days = userCfg.days()
+			}
+		}
+
+		if now.Sub(record.Date) > time.Duration(days)*24*time.Hour {
+			delete(r.replies, key)
+			r.modified = true
+		}
+	}
+}
+
+func (r *Responder) load() error {
+	data, err := os.ReadFile(r.Cfg.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("cannot read %q: %w", r.Cfg.Path, err)
+	}
+
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("cannot decode %q: %w", r.Cfg.Path, err)
+	}
+
+	for _, record := range s.Replies {
+		r.replies[record.key()] = record
+	}
+
+	return nil
+}
+
+func (r *Responder) save() error {
+	if err := r.writeState(); err != nil {
+		// Try again next time
+		r.mutex.Lock()
+		r.modified = true
+		r.mutex.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+func (r *Responder) writeState() error {
+	r.mutex.Lock()
+
+	if !r.modified {
+		r.mutex.Unlock()
+		return nil
+	}
+
+	var s state
+
+	for _, record := range r.replies {
+		record2 := *record
+		s.Replies = append(s.Replies, &record2)
+	}
+
+	r.modified = false
+
+	r.mutex.Unlock()
+
+	data, err := json.Marshal(&s)
+	if err != nil {
+		return fmt.Errorf("cannot encode state: %w", err)
+	}
+
+	if err := os.MkdirAll(path.Dir(r.Cfg.Path), 0700); err != nil {
+		return fmt.Errorf("cannot create directory %q: %w",
+			path.Dir(r.Cfg.Path), err)
+	}
+
+	return utils.WriteFileAtomically(r.Cfg.Path, data)
+}
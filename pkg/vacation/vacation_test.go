@@ -0,0 +1,259 @@
+package vacation
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/emaild/pkg/imf"
+	"github.com/galdor/go-log"
+)
+
+func newTestResponder(t *testing.T, filePath string) *Responder {
+	r, err := NewResponder(Cfg{
+		Log:  log.DefaultLogger("test"),
+		Path: filePath,
+		Users: map[string]*UserCfg{
+			"bob": {
+				Addresses: []string{"bob@example.com", "b@example.com"},
+				Message:   "I am away until Monday.\n",
+				Days:      3,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot create responder: %v", err)
+	}
+
+	return r
+}
+
+func testMessage(t *testing.T, fields ...string) *imf.Message {
+	data := "From: alice@example.org\r\n" +
+		"Subject: Meeting\r\n" +
+		"Message-ID: <2@example.org>\r\n" +
+		"In-Reply-To: <1@example.org>\r\n"
+
+	for _, field := range fields {
+		data += field + "\r\n"
+	}
+
+	data += "\r\nHello.\r\n"
+
+	msg, err := imf.NewMessageDecoder().DecodeAll([]byte(data))
+	if err != nil {
+		t.Fatalf("cannot decode message: %v", err)
+	}
+
+	return msg
+}
+
+func TestRespond(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "vacation.json")
+
+	r := newTestResponder(t, filePath)
+
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	alice := &imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+	carol := &imf.SpecificAddress{LocalPart: "carol", Domain: "example.org"}
+	daemon := &imf.SpecificAddress{LocalPart: "MAILER-DAEMON",
+		Domain: "example.org"}
+	list := &imf.SpecificAddress{LocalPart: "dev-request",
+		Domain: "example.org"}
+
+	to := "To: Bob <bob@example.com>"
+
+	tests := []struct {
+		user        string
+		reversePath *imf.SpecificAddress
+		fields      []string
+		delay       time.Duration
+		replied     bool
+	}{
+		// Unknown user
+		{"alice", alice, []string{to}, 0, false},
+		// Null reverse-path
+		{"bob", nil, []string{to}, 0, false},
+		// Automated senders
+		{"bob", daemon, []string{to}, 0, false},
+		{"bob", list, []string{to}, 0, false},
+		// Automatic, bulk and list messages
+		{"bob", alice, []string{to, "Auto-Submitted: auto-generated"}, 0,
+			false},
+		{"bob", alice, []string{to, "Precedence: bulk"}, 0, false},
+		{"bob", alice, []string{to, "Precedence: List"}, 0, false},
+		{"bob", alice, []string{to, "List-Id: <dev.example.org>"}, 0, false},
+		// Message not explicitly addressed to the user
+		{"bob", alice, []string{"To: dev@example.org"}, 0, false},
+		// First message
+		{"bob", alice, []string{to, "Auto-Submitted: no"}, 0, true},
+		// Second message from the same sender
+		{"bob", alice, []string{"Cc: B@example.com"}, time.Hour, false},
+		// Another sender
+		{"bob", carol, []string{"To: team: b@example.com, eve@example.com;"},
+			0, true},
+		// After the interval
+		{"bob", alice, []string{to}, 3 * 24 * time.Hour, true},
+	}
+
+	for i, test := range tests {
+		now = now.Add(test.delay)
+
+		msg := testMessage(t, test.fields...)
+
+		reply, err := r.Respond(test.user, test.reversePath, msg, now)
+		if err != nil {
+			t.Errorf("test %d: cannot respond: %v", i, err)
+			continue
+		}
+
+		if test.replied && reply == nil {
+			t.Errorf("test %d: message was not answered", i)
+		} else if !test.replied && reply != nil {
+			t.Errorf("test %d: message was answered", i)
+		}
+	}
+
+	if err := r.save(); err != nil {
+		t.Fatalf("cannot save responder state: %v", err)
+	}
+
+	// State must survive restarts
+	r = newTestResponder(t, filePath)
+
+	reply, err := r.Respond("bob", alice, testMessage(t, to), now)
+	if err != nil {
+		t.Fatalf("cannot respond: %v", err)
+	} else if reply != nil {
+		t.Errorf("message answered twice after reload")
+	}
+}
+
+func TestReply(t *testing.T) {
+	r := newTestResponder(t, path.Join(t.TempDir(), "vacation.json"))
+
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	reversePath := &imf.SpecificAddress{LocalPart: "alice",
+		Domain: "example.org"}
+
+	msg := testMessage(t, "To: bob@example.com")
+
+	reply, err := r.Respond("bob", reversePath, msg, now)
+	if err != nil {
+		t.Fatalf("cannot respond: %v", err)
+	} else if reply == nil {
+		t.Fatalf("message was not answered")
+	}
+
+	if reply.Recipient != *reversePath {
+		t.Errorf("reply is sent to %v but should be sent to %v",
+			reply.Recipient, reversePath)
+	}
+
+	data, err := imf.NewMessageEncoder(reply.Message).Encode()
+	if err != nil {
+		t.Fatalf("cannot encode reply: %v", err)
+	}
+
+	replyMsg, err := imf.NewMessageDecoder().DecodeAll(data)
+	if err != nil {
+		t.Fatalf("cannot decode reply: %v", err)
+	}
+
+	for _, field := range replyMsg.Header {
+		if field.HasError() {
+			t.Errorf("invalid field %q: %s", field.Name, field.Error)
+		}
+	}
+
+	for _, s := range []string{
+		"From: bob@example.com\r\n",
+		"To: alice@example.org\r\n",
+		"Subject: Auto: Meeting\r\n",
+		"In-Reply-To: <2@example.org>\r\n",
+		"References: <1@example.org> <2@example.org>\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+	} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("reply does not contain %q", s)
+		}
+	}
+
+	if body := string(replyMsg.Body); body != "I am away until Monday.\r\n" {
+		t.Errorf("invalid reply body %q", body)
+	}
+}
+
+func TestRespondWith(t *testing.T) {
+	r := newTestResponder(t, path.Join(t.TempDir(), "vacation.json"))
+
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	alice := &imf.SpecificAddress{LocalPart: "alice", Domain: "example.org"}
+
+	userCfg := UserCfg{
+		Addresses: []string{"bob@example.com"},
+		Message: "Content-Type: text/plain; charset=us-ascii\n" +
+			"\n" +
+			"Back next week.\n",
+		Days: 1,
+		MIME: true,
+	}
+
+	msg := testMessage(t, "To: bob@example.com")
+
+	reply, err := r.RespondWith("bob", "away", &userCfg, alice, msg, now)
+	if err != nil {
+		t.Fatalf("cannot respond: %v", err)
+	} else if reply == nil {
+		t.Fatalf("message was not answered")
+	}
+
+	data, err := imf.NewMessageEncoder(reply.Message).Encode()
+	if err != nil {
+		t.Fatalf("cannot encode reply: %v", err)
+	}
+
+	for _, s := range []string{
+		"Content-Type: text/plain; charset=us-ascii\r\n",
+		"\r\n\r\nBack next week.\r\n",
+	} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("reply does not contain %q", s)
+		}
+	}
+
+	if strings.Contains(string(data), "Content-Transfer-Encoding") {
+		t.Errorf("reply contains a default Content-Transfer-Encoding field")
+	}
+
+	// Replies are tracked for each handle
+	reply, err = r.RespondWith("bob", "away", &userCfg, alice, msg,
+		now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("cannot respond: %v", err)
+	} else if reply != nil {
+		t.Errorf("message answered twice with the same handle")
+	}
+
+	reply, err = r.Respond("bob", alice, msg, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("cannot respond: %v", err)
+	} else if reply == nil {
+		t.Errorf("message not answered with the configured settings")
+	}
+
+	// Records use the interval of their own settings
+	r.expire(now.Add(2 * 24 * time.Hour))
+
+	reply, err = r.RespondWith("bob", "away", &userCfg, alice, msg,
+		now.Add(2*24*time.Hour))
+	if err != nil {
+		t.Fatalf("cannot respond: %v", err)
+	} else if reply == nil {
+		t.Errorf("message not answered after the interval")
+	}
+}